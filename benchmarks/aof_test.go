@@ -0,0 +1,86 @@
+package benchmarks
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/server"
+)
+
+// fillMixed 写入 n 个 key: string, 整数, hash, list, set 和带过期时间的 string 各占一部分
+func fillMixed(b *testing.B, client *server.LocalClient, n int) {
+	ctx := context.Background()
+	const batch = 1000
+	value := strings.Repeat("v", 64)
+	for i := 0; i < n; i += batch {
+		mset := []string{"mset"}
+		for j := i; j < i+batch && j < n; j++ {
+			key := strconv.Itoa(j)
+			var err error
+			switch j % 6 {
+			case 0:
+				mset = append(mset, "str:"+key, value)
+			case 1:
+				mset = append(mset, "int:"+key, key)
+			case 2:
+				_, err = client.Do(ctx, "hset", "hash:"+key, "name", "godis", "field", value, "count", key)
+			case 3:
+				_, err = client.Do(ctx, "rpush", "list:"+key, "a", "b", value, key)
+			case 4:
+				_, err = client.Do(ctx, "sadd", "set:"+key, "a", "b", "c", key)
+			case 5:
+				_, err = client.Do(ctx, "set", "ttl:"+key, value, "ex", "3600")
+			}
+			require.NoError(b, err)
+		}
+		_, err := client.Do(ctx, mset...)
+		require.NoError(b, err)
+	}
+}
+
+// persistenceField INFO persistence 中的一个字段
+func persistenceField(b *testing.B, client *server.LocalClient, field string) string {
+	reply, err := client.Do(context.Background(), "info", "persistence")
+	require.NoError(b, err)
+	info, err := reply.Str()
+	require.NoError(b, err)
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	b.Fatalf("no %s in INFO persistence", field)
+	return ""
+}
+
+// BenchmarkAofRewrite 重写 100k 个 key(-short 时 10k)的 AOF, 每个 op 是一次 BGREWRITEAOF, 等待完成
+func BenchmarkAofRewrite(b *testing.B) {
+	n := 100000
+	if testing.Short() {
+		n = 10000
+	}
+	s := startServer(b, server.WithAppendOnly(b.TempDir()))
+	client := s.NewLocalClient()
+	defer client.Close()
+	fillMixed(b, client, n)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rewrites := persistenceField(b, client, "aof_rewrites")
+		if _, err := client.Do(ctx, "bgrewriteaof"); err != nil {
+			b.Fatal(err)
+		}
+		for persistenceField(b, client, "aof_rewrite_in_progress") != "0" || persistenceField(b, client, "aof_rewrites") == rewrites {
+			time.Sleep(time.Millisecond)
+		}
+		if status := persistenceField(b, client, "aof_last_bgrewrite_status"); status != "ok" {
+			b.Fatalf("rewrite failed: %s", status)
+		}
+	}
+}
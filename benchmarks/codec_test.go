@@ -0,0 +1,110 @@
+package benchmarks
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/redis"
+)
+
+// replayConn 每次从头读取同一段录制好的数据, 只实现解码用到的方法
+type replayConn struct {
+	gnet.Conn
+	data []byte
+	pos  int
+}
+
+func (c *replayConn) InboundBuffered() int {
+	return len(c.data) - c.pos
+}
+
+func (c *replayConn) Peek(n int) ([]byte, error) {
+	if n > c.InboundBuffered() {
+		return nil, io.ErrShortBuffer
+	} else if n <= 0 {
+		n = c.InboundBuffered()
+	}
+	return c.data[c.pos : c.pos+n], nil
+}
+
+func (c *replayConn) Discard(n int) (int, error) {
+	c.pos += n
+	return n, nil
+}
+
+// recordedStream 典型的客户端流量: 短的 SET 和 GET, 批量的 MSET, HSET, 较大的值, inline 为 true 时包括 inline 命令
+func recordedStream(inline bool) ([]byte, int) {
+	buf := &bytes.Buffer{}
+	commands := 0
+	write := func(data string) {
+		buf.WriteString(data)
+		commands++
+	}
+	for i := 0; i < 100; i++ {
+		key := "user:" + strconv.Itoa(i)
+		write(resp("set", key, strings.Repeat("v", 16)))
+		write(resp("get", key))
+		write(resp("hset", "profile:"+strconv.Itoa(i), "name", "godis", "age", strconv.Itoa(i)))
+		if i%10 == 0 {
+			args := []string{"mset"}
+			for j := 0; j < 10; j++ {
+				args = append(args, "k"+strconv.Itoa(j), strconv.Itoa(j))
+			}
+			write(resp(args...))
+			write(resp("lpush", "queue", strings.Repeat("x", 1024)))
+			if inline {
+				write("PING\r\n")
+			}
+		}
+	}
+	return buf.Bytes(), commands
+}
+
+// BenchmarkCodecDecode 只测试解析器, 每个 op 解码一遍录制好的数据
+func BenchmarkCodecDecode(b *testing.B) {
+	data, expected := recordedStream(true)
+	codec := redis.NewCodec()
+	conn := &replayConn{data: data}
+	commands := list.New()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.pos = 0
+		commands.Init()
+		if err := codec.Decode(conn, commands); err != nil {
+			b.Fatal(err)
+		}
+		if commands.Len() != expected {
+			b.Fatalf("decoded %d commands, expected %d", commands.Len(), expected)
+		}
+	}
+}
+
+// BenchmarkDecodeInStream 加载 AOF 和复制使用的流式解析器, 不支持 inline 命令
+func BenchmarkDecodeInStream(b *testing.B) {
+	data, expected := recordedStream(false)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoded := 0
+		for payload := range redis.DecodeInStream(bytes.NewReader(data)) {
+			if payload.Error != nil {
+				if payload.Error == io.EOF {
+					break
+				}
+				b.Fatal(payload.Error)
+			}
+			decoded++
+		}
+		if decoded != expected {
+			b.Fatalf("decoded %d commands, expected %d", decoded, expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package benchmarks
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/intset"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/ziplist"
+)
+
+// zipListEntries 和 redis 的 list-max-ziplist-size 一样, 每个 ziplist 最多 128 项
+const zipListEntries = 128
+
+func BenchmarkZipList(b *testing.B) {
+	values := [][]byte{[]byte("12"), []byte("-70000"), []byte("hello"), []byte("a medium sized value for the ziplist")}
+	b.Run("PushBack", func(b *testing.B) {
+		b.ReportAllocs()
+		zl := ziplist.NewZipList()
+		for i := 0; i < b.N; i++ {
+			if i%zipListEntries == 0 {
+				zl = ziplist.NewZipList()
+			}
+			if err := zl.PushBack(values[i%len(values)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Index", func(b *testing.B) {
+		zl := ziplist.NewZipList()
+		for i := 0; i < zipListEntries; i++ {
+			_ = zl.PushBack(values[i%len(values)])
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := zl.Index(i % zipListEntries); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDictParallel 多个 goroutine 读写同一个 dict. 命令在全局锁中执行, 这里同样用一把锁保护
+func BenchmarkDictParallel(b *testing.B) {
+	const n = 1 << 16
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	var mux sync.Mutex
+	d := dict.MakeSimpleDict()
+	for _, key := range keys {
+		d.Put(key, key)
+	}
+	var seq uint64
+	b.Run("Put", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				key := keys[atomic.AddUint64(&seq, 1)%n]
+				mux.Lock()
+				d.Put(key, key)
+				mux.Unlock()
+			}
+		})
+	})
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				key := keys[atomic.AddUint64(&seq, 1)%n]
+				mux.Lock()
+				_, exists := d.Get(key)
+				mux.Unlock()
+				if !exists {
+					b.Error("missing " + key)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkSetRandomWithReplacement SRANDMEMBER key -100000 的抽样. RandomKeys 每次从 map 的遍历中取第一个 key, 是原来的做法,
+// 作为对照; RandomKeysWithReplacement 按照下标选择, 下标在第一次抽样时创建(FirstSample 包括创建的时间).
+// intset 按照下标选择, 大小是 set-max-intset-entries 的默认值
+func BenchmarkSetRandomWithReplacement(b *testing.B) {
+	members, count := 1000000, 100000
+	if testing.Short() {
+		members = 1 << 16
+	}
+	const intsetMembers = 512
+	ints := intset.NewIntSet(intset.EncInt16)
+	for i := 0; i < intsetMembers; i++ {
+		ints.Add(int64(i))
+	}
+	d := dict.MakeSimpleDict()
+	for i := 0; i < members; i++ {
+		d.Put("member:"+strconv.Itoa(i), nil)
+	}
+	b.Run("RandomKeys", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			d.RandomKeys(count)
+		}
+	})
+	b.Run("RandomKeysWithReplacement", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			d.RandomKeysWithReplacement(count)
+		}
+	})
+	b.Run("FirstSample", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			fresh := dict.MakeSimpleDict()
+			d.ForEach(func(key string, val interface{}) bool {
+				fresh.Put(key, val)
+				return true
+			})
+			b.StartTimer()
+			fresh.RandomKeysWithReplacement(count)
+		}
+	})
+	b.Run("IntSetIndex", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < count; j++ {
+				if _, err := ints.Get(rand.Intn(intsetMembers)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
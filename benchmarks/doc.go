@@ -0,0 +1,10 @@
+// Package benchmarks 解析器, 数据结构, 网络和持久化的微基准测试, 用来发现性能回退. 每个基准测试都报告 ns/op, B/op 和 allocs/op.
+//
+// 改动前后各运行一次, 用 cmd/benchcompare 比较:
+//
+//	go test ./benchmarks -run xxx -bench . -count 5 -short > old.txt
+//	go test ./benchmarks -run xxx -bench . -count 5 -short > new.txt
+//	go run ./cmd/benchcompare old.txt new.txt
+//
+// -short 时使用较小的数据集, 整个套件在两分钟内完成. 还没有有序集合, 没有 ZADD 和 ZRANGEBYSCORE 的基准测试
+package benchmarks
@@ -0,0 +1,96 @@
+package benchmarks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/server"
+	"go.uber.org/zap"
+)
+
+// pipelineDepth 每次写入连接的命令条数
+const pipelineDepth = 64
+
+// startServer 在随机端口上启动不输出日志的 server, 基准测试结束时关闭
+func startServer(b *testing.B, opts ...server.Option) *server.Server {
+	opts = append([]server.Option{server.WithAddr("127.0.0.1:0"), server.WithLogger(logger.Zap(zap.NewNop()))}, opts...)
+	s, err := server.New(opts...)
+	require.NoError(b, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(b, s.Start(ctx))
+	b.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+	return s
+}
+
+// resp 命令编码为 RESP 数组
+func resp(args ...string) string {
+	builder := &strings.Builder{}
+	builder.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		builder.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return builder.String()
+}
+
+// readReply 读取一个不是数组的回复
+func readReply(reader *bufio.Reader) error {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	switch line[0] {
+	case '-':
+		return fmt.Errorf("unexpected error reply: %q", line)
+	case '$':
+		length, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil || length < 0 {
+			return err
+		}
+		_, err = reader.Discard(length + 2)
+		return err
+	}
+	return nil
+}
+
+// BenchmarkPipelinedSetGet 经过本机 TCP 连接, 每次写入 64 条 SET 和 GET 交替的命令. 每个 op 是一条命令
+func BenchmarkPipelinedSetGet(b *testing.B) {
+	s := startServer(b)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(b, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	value := strings.Repeat("v", 32)
+	builder := &strings.Builder{}
+	for i := 0; i < pipelineDepth/2; i++ {
+		key := "key:" + strconv.Itoa(i)
+		builder.WriteString(resp("set", key, value))
+		builder.WriteString(resp("get", key))
+	}
+	batch := []byte(builder.String())
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(batch) / pipelineDepth))
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += pipelineDepth {
+		if _, err := conn.Write(batch); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < pipelineDepth; i++ {
+			if err := readReply(reader); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// units 比较的指标, 除了 MB/s 都是越小越好
+var units = []string{"ns/op", "B/op", "allocs/op", "MB/s"}
+
+// samples 一组运行结果, 基准测试的名字 -> 指标 -> 每次运行的值
+type samples map[string]map[string][]float64
+
+// row 一个基准测试的一项指标的比较结果
+type row struct {
+	name       string
+	unit       string
+	old, new   float64
+	delta      float64
+	regression bool
+}
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, `Usage: benchcompare [--threshold percent] <old.txt> <new.txt>
+Compares two "go test -bench" outputs, runs with -count are reduced to their median.
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	threshold := flag.Float64("threshold", 5, "report a regression when a metric gets worse by more than this percent")
+	flag.Usage = printHelp
+	flag.Parse()
+	if flag.NArg() != 2 {
+		printHelp()
+		os.Exit(1)
+	}
+	before, err := parseFile(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("Cannot read %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	after, err := parseFile(flag.Arg(1))
+	if err != nil {
+		fmt.Printf("Cannot read %s: %v\n", flag.Arg(1), err)
+		os.Exit(1)
+	}
+	rows := compare(before, after, *threshold)
+	if len(rows) == 0 {
+		fmt.Println("No common benchmarks")
+		os.Exit(1)
+	}
+	if regressions := printRows(os.Stdout, rows); regressions > 0 {
+		fmt.Printf("%d regressions beyond %.1f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
+
+func parseFile(filename string) (samples, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parse(file)
+}
+
+// parse 读取 go test -bench 的输出, 忽略其他的行. 名字去掉 -GOMAXPROCS 后缀
+func parse(r io.Reader) (samples, error) {
+	result := samples{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		name := fields[0]
+		if i := strings.LastIndexByte(name, '-'); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+		// 之后是成对的 值 单位
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				break
+			}
+			if result[name] == nil {
+				result[name] = map[string][]float64{}
+			}
+			result[name][fields[i+1]] = append(result[name][fields[i+1]], value)
+		}
+	}
+	return result, scanner.Err()
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// compare 比较两组结果中都有的基准测试, 按照名字排序. 变差超过 threshold 百分比的是回退,
+// 之前为 0 的指标(比如 0 allocs/op)变成非 0 也是回退
+func compare(before, after samples, threshold float64) []row {
+	names := make([]string, 0, len(before))
+	for name := range before {
+		if _, ok := after[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var rows []row
+	for _, unit := range units {
+		for _, name := range names {
+			oldValues, newValues := before[name][unit], after[name][unit]
+			if len(oldValues) == 0 || len(newValues) == 0 {
+				continue
+			}
+			r := row{name: name, unit: unit, old: median(oldValues), new: median(newValues)}
+			switch {
+			case r.old == r.new:
+				r.delta = 0
+			case r.old == 0:
+				r.delta = math.Inf(1)
+			default:
+				r.delta = (r.new - r.old) / r.old * 100
+			}
+			worse := r.delta
+			if unit == "MB/s" {
+				worse = -worse
+			}
+			r.regression = worse > threshold
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+// printRows 每项指标一张表, 返回回退的个数
+func printRows(w io.Writer, rows []row) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	regressions := 0
+	unit := ""
+	for _, r := range rows {
+		if r.unit != unit {
+			if unit != "" {
+				fmt.Fprintln(tw)
+			}
+			unit = r.unit
+			fmt.Fprintf(tw, "name\told %s\tnew %s\tdelta\t\n", unit, unit)
+		}
+		mark := ""
+		if r.regression {
+			mark = "REGRESSION"
+			regressions++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.name, formatValue(r.old), formatValue(r.new), formatDelta(r.delta), mark)
+	}
+	_ = tw.Flush()
+	return regressions
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func formatDelta(delta float64) string {
+	switch {
+	case math.IsInf(delta, 1):
+		return "+Inf%"
+	case delta == 0:
+		return "~"
+	}
+	return fmt.Sprintf("%+.2f%%", delta)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const oldRun = `goos: linux
+goarch: amd64
+pkg: github.com/xuning888/godis-tiny/benchmarks
+BenchmarkCodecDecode-8     	     778	    300000 ns/op	  72.00 MB/s	  124560 B/op	    4670 allocs/op
+BenchmarkCodecDecode-8     	     778	    310000 ns/op	  70.00 MB/s	  124560 B/op	    4670 allocs/op
+BenchmarkCodecDecode-8     	     778	    900000 ns/op	  24.00 MB/s	  124560 B/op	    4670 allocs/op
+BenchmarkDictParallel/Get-8	 2586910	        100 ns/op	       0 B/op	       0 allocs/op
+BenchmarkRemoved-8         	     100	        100 ns/op
+PASS
+ok  	github.com/xuning888/godis-tiny/benchmarks	6.949s
+`
+
+const newRun = `BenchmarkCodecDecode-4     	     778	    330000 ns/op	  66.00 MB/s	  124560 B/op	    4670 allocs/op
+BenchmarkDictParallel/Get-4	 2586910	        102 ns/op	      16 B/op	       1 allocs/op
+BenchmarkAdded-4           	     100	        100 ns/op
+`
+
+func TestParse(t *testing.T) {
+	result, err := parse(strings.NewReader(oldRun))
+	require.NoError(t, err)
+	assert.Len(t, result, 3)
+	assert.Equal(t, []float64{300000, 310000, 900000}, result["BenchmarkCodecDecode"]["ns/op"])
+	assert.Equal(t, []float64{72, 70, 24}, result["BenchmarkCodecDecode"]["MB/s"])
+	assert.Equal(t, []float64{0}, result["BenchmarkDictParallel/Get"]["allocs/op"])
+	// 中位数忽略偶然的慢的一次
+	assert.Equal(t, float64(310000), median(result["BenchmarkCodecDecode"]["ns/op"]))
+	assert.Equal(t, 1.5, median([]float64{2, 1}))
+}
+
+func TestCompare(t *testing.T) {
+	before, _ := parse(strings.NewReader(oldRun))
+	after, _ := parse(strings.NewReader(newRun))
+	rows := compare(before, after, 5)
+	regressions := map[string]bool{}
+	for _, r := range rows {
+		regressions[r.name+" "+r.unit] = r.regression
+	}
+	assert.Equal(t, map[string]bool{
+		"BenchmarkCodecDecode ns/op":          true,
+		"BenchmarkDictParallel/Get ns/op":     false,
+		"BenchmarkCodecDecode B/op":           false,
+		"BenchmarkDictParallel/Get B/op":      true,
+		"BenchmarkCodecDecode allocs/op":      false,
+		"BenchmarkDictParallel/Get allocs/op": true,
+		"BenchmarkCodecDecode MB/s":           true,
+	}, regressions)
+
+	buf := &bytes.Buffer{}
+	assert.Equal(t, 4, printRows(buf, rows))
+	out := buf.String()
+	assert.Contains(t, out, "name                       old ns/op  new ns/op  delta")
+	assert.Contains(t, out, "BenchmarkCodecDecode       310000     330000     +6.45%  REGRESSION")
+	assert.Contains(t, out, "BenchmarkDictParallel/Get  0         16        +Inf%  REGRESSION")
+	assert.Contains(t, out, "BenchmarkCodecDecode  70        66        -5.71%  REGRESSION")
+
+	// 相同的值显示为 ~
+	buf.Reset()
+	assert.Equal(t, 0, printRows(buf, compare(before, before, 5)))
+	assert.Contains(t, buf.String(), "124560    124560    ~")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/xuning888/godis-tiny/redis"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, `Usage: checkaof [--fix [--yes]] <file.aof|file.manifest|appenddirname>
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate the AOF at the last valid command")
+	yes := flag.Bool("yes", false, "do not ask for confirmation before fixing")
+	flag.Usage = printHelp
+	flag.Parse()
+	if flag.NArg() != 1 {
+		printHelp()
+		os.Exit(1)
+	}
+
+	report, err := redis.VerifyAof(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("Cannot check the AOF: %v\n", err)
+		os.Exit(1)
+	}
+	for _, file := range report.Files {
+		format := "RESP"
+		if file.RdbPreamble {
+			format = "RDB preamble"
+		}
+		fmt.Printf("AOF analyzed: filename=%s, format=%s, size=%d, commands=%d, ok_up_to=%d, diff=%d\n",
+			filepath.Base(file.Filename), format, file.Size, file.Commands, file.ValidOffset, file.Size-file.ValidOffset)
+		if file.Err != nil {
+			fmt.Printf("0x%x: %v\n", file.ValidOffset, file.Err)
+		}
+	}
+	if report.Ok() {
+		fmt.Println("AOF is valid")
+		return
+	}
+	if !*fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		os.Exit(1)
+	}
+	for _, file := range report.Files {
+		if file.Err == nil {
+			continue
+		}
+		if !file.Fixable {
+			fmt.Printf("%s can not be fixed\n", filepath.Base(file.Filename))
+			os.Exit(1)
+		}
+		fmt.Printf("This will shrink %s from %d bytes, with %d bytes, to %d bytes\n",
+			filepath.Base(file.Filename), file.Size, file.Size-file.ValidOffset, file.ValidOffset)
+	}
+	if !*yes && !confirm() {
+		fmt.Println("Aborted")
+		os.Exit(1)
+	}
+	if err = report.Fix(); err != nil {
+		fmt.Printf("Failed to truncate AOF: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Successfully truncated AOF")
+}
+
+func confirm() bool {
+	fmt.Print("Continue? [y/N]: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(line)) == "y"
+}
@@ -1,12 +1,8 @@
 package config
 
 import (
-	"bufio"
+	"errors"
 	"github.com/xuning888/godis-tiny/pkg/util"
-	"io"
-	"log"
-	"os"
-	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
@@ -17,124 +13,232 @@ var defaultMaxClients = 10000
 var AppendOnlyDir = "appendOnlyDir/"
 
 type ServerProperties struct {
-	RunID                string `cfg:"runid"`
-	Bind                 string `cfg:"bind"`
-	Port                 int    `cfg:"port"`
-	Dir                  string `cfg:"dir"`
-	AppendOnly           bool   `cfg:"appendonly"`
-	AppendFilename       string `cfg:"appendfilename"`
-	AppendFsync          string `cfg:"appendfsync"`
+	RunID                string `cfg:"runid,readonly"`
+	Bind                 string `cfg:"bind,args,immutable"`
+	Port                 int    `cfg:"port,immutable"`
+	Dir                  string `cfg:"dir,immutable"`
+	DbFilename           string `cfg:"dbfilename,immutable"`
+	AppendOnly           bool   `cfg:"appendonly,immutable"`
+	AppendFilename       string `cfg:"appendfilename,immutable"`
+	AppendDirname        string `cfg:"appenddirname,immutable"`
+	AppendFsync          string `cfg:"appendfsync,immutable,enum=always|everysec|no"`
+	AofLoadTruncated     bool   `cfg:"aof-load-truncated,immutable"`
+	AofUseRdbPreamble    bool   `cfg:"aof-use-rdb-preamble,immutable"`
 	MaxClients           int    `cfg:"maxclients"`
-	Databases            int    `cfg:"databases"`
-	AofRewriteMinSize    int    `cfg:"auto-aof-rewrite-min-size"`
+	Databases            int    `cfg:"databases,immutable"`
+	AofRewriteMinSize    int    `cfg:"auto-aof-rewrite-min-size,megabytes"`
 	AofRewritePercentage int    `cfg:"auto-aof-rewrite-percentage"`
+	NotifyKeyspaceEvents string `cfg:"notify-keyspace-events"`
+	TrackingTableMaxKeys int    `cfg:"tracking-table-max-keys"`
+	BusyReplyThreshold   int    `cfg:"busy-reply-threshold"`
+	ReplBacklogSize      int    `cfg:"repl-backlog-size,memory"`
+	ReplicaReadOnly      bool   `cfg:"replica-read-only"`
+	ReplPingPeriod       int    `cfg:"repl-ping-replica-period"`
+	ReplTimeout          int    `cfg:"repl-timeout"`
+	ProtoMaxBulkLen      int    `cfg:"proto-max-bulk-len,memory"`
+	QueryBufferLimit     int    `cfg:"client-query-buffer-limit,memory"`
+	Timeout              int    `cfg:"timeout"`
+	// ClientWriteTimeout 单位毫秒, 回复超过这个时间没有写出任何字节时按照输出缓冲区的限制处理, 0表示不限制
+	ClientWriteTimeout int    `cfg:"client-write-timeout"`
+	TcpKeepAlive       int    `cfg:"tcp-keepalive"`
+	UnixSocket         string `cfg:"unixsocket,immutable"`
+	UnixSocketPerm     string `cfg:"unixsocketperm,immutable"`
+	ShutdownTimeout    int    `cfg:"shutdown-timeout"`
+	ProtectedMode      bool   `cfg:"protected-mode"`
+	RequirePass        string `cfg:"requirepass"`
+	MasterAuth         string `cfg:"masterauth"`
+	// ClientOutputBufferLimit 三类客户端的限制写在一行, 比如 normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60,
+	// 没有配置的类别使用 redis 的默认值
+	ClientOutputBufferLimit string `cfg:"client-output-buffer-limit,append,args"`
+	// EnableProxyProtocol tcp 连接先发送 PROXY protocol v1/v2 的头部, 用于负载均衡器之后
+	EnableProxyProtocol bool `cfg:"enable-proxy-protocol,immutable"`
+	// MaxMemory 数据使用的内存上限, 单位字节, 0表示不限制
+	MaxMemory int `cfg:"maxmemory,memory"`
+	// MaxMemoryPolicy 超过 maxmemory 时的淘汰策略, MaxMemorySamples 每次淘汰时采样的key的个数
+	MaxMemoryPolicy  string `cfg:"maxmemory-policy,enum=volatile-lru|allkeys-lru|volatile-lfu|allkeys-lfu|volatile-random|allkeys-random|volatile-ttl|noeviction"`
+	MaxMemorySamples int    `cfg:"maxmemory-samples"`
+	// LfuLogFactor LFU 计数器增加的难度, LfuDecayTime 计数器每减一经过的分钟数, 0表示不衰减
+	LfuLogFactor int `cfg:"lfu-log-factor"`
+	LfuDecayTime int `cfg:"lfu-decay-time"`
+	// 以下四项打开时, 淘汰、过期删除、DEL 和 FLUSHDB/FLUSHALL 删除的元素很多的值在后台释放
+	LazyfreeLazyEviction  bool `cfg:"lazyfree-lazy-eviction"`
+	LazyfreeLazyExpire    bool `cfg:"lazyfree-lazy-expire"`
+	LazyfreeLazyUserDel   bool `cfg:"lazyfree-lazy-user-del"`
+	LazyfreeLazyUserFlush bool `cfg:"lazyfree-lazy-user-flush"`
+	// ActiveDefrag 在 serverCron 中重新分配空闲容量很多的值, ActiveDefragCycleMax 每次最多使用的时间, 单位是 cron 周期的百分比
+	ActiveDefrag         bool `cfg:"activedefrag"`
+	ActiveDefragCycleMax int  `cfg:"active-defrag-cycle-max"`
+	// SetMaxIntsetEntries 集合的元素都是整数并且不超过这个个数时使用 intset 编码
+	SetMaxIntsetEntries int `cfg:"set-max-intset-entries"`
+	// ClusterAnnounceIp ClusterAnnouncePort CLUSTER SLOTS 和 CLUSTER SHARDS 返回的地址, 没有配置时是客户端连接的地址
+	ClusterAnnounceIp   string `cfg:"cluster-announce-ip"`
+	ClusterAnnouncePort int    `cfg:"cluster-announce-port"`
+	// StorageBackend db 使用的 dict 实现, simple 或者 tiered; StorageHotKeys tiered 每个 db 在内存中保留的值的个数
+	StorageBackend string `cfg:"storage-backend,immutable"`
+	StorageHotKeys int    `cfg:"storage-hot-keys,immutable"`
+	// Save 与 redis 一样可以写多行 save <seconds> <changes>, 目前只记录在配置中, 不会按照规则自动 BGSAVE
+	Save string `cfg:"save,append,args,immutable"`
+	// CommandTimeout 单位毫秒, 执行时间超过之后 KEYS, SORT 等执行时间很长的命令被中断, 0表示不限制
+	CommandTimeout int `cfg:"command-timeout"`
+	// SuggestCommands 未知命令的错误回复中附带编辑距离很小的已注册命令, 比如 Did you mean HGETALL?
+	SuggestCommands bool `cfg:"suggest-commands"`
+	// LogLevel debug, verbose, notice, warning 或者 nothing
+	LogLevel string `cfg:"loglevel,enum=debug|verbose|notice|warning|nothing"`
+	// MetricsAddr Prometheus 的 /metrics 监听的地址, 比如 127.0.0.1:9121, 为空时不启动
+	MetricsAddr string `cfg:"metrics-addr,immutable"`
 	// config file path
-	CfPath string `cfg:"cf,omitempty"`
+	CfPath string `cfg:"cf,readonly"`
 }
 
 var Properties *ServerProperties = nil
 
 func init() {
-	Properties = &ServerProperties{
-		Bind:           "0.0.0.0",
+	Properties = Default()
+}
+
+// Default 没有配置文件时使用的默认配置, 每次返回新的副本
+func Default() *ServerProperties {
+	return &ServerProperties{
 		Port:           6389,
 		AppendOnly:     false,
-		AppendFilename: "",
-		Databases:      16,
-		RunID:          util.RandStr(40),
+		AppendFilename: "appendonly.aof",
+		AppendDirname:  "appendonlydir",
+		DbFilename:     "dump.rdb",
+		// 与 redis 一样每秒 fsync 一次
+		AppendFsync: "everysec",
+		// aof 末尾的命令不完整时截断之后继续加载
+		AofLoadTruncated: true,
+		// aof 重写时用 rdb 格式写入数据
+		AofUseRdbPreamble: true,
+		Databases:         16,
+		MaxClients:        defaultMaxClients,
+		RunID:             util.RandHex(40),
+		// 与redis保持一致, 0表示不限制
+		TrackingTableMaxKeys: 1000000,
+		// 单位毫秒
+		BusyReplyThreshold: 5000,
+		ReplBacklogSize:    1 << 20,
+		// 从节点默认只读
+		ReplicaReadOnly: true,
+		// 单位秒
+		ReplPingPeriod: 10,
+		ReplTimeout:    60,
+		// 单个字符串参数和单条命令的上限, 单位字节
+		ProtoMaxBulkLen:  512 << 20,
+		QueryBufferLimit: 1 << 30,
+		// 单位秒, 0表示不关闭空闲的客户端
+		Timeout:      0,
+		TcpKeepAlive: 300,
+		// 单位秒, 关闭时等待正在执行的命令和回复的时间
+		ShutdownTimeout: 10,
+		// 没有配置 bind 和密码时只接受本机的连接
+		ProtectedMode:    true,
+		MaxMemoryPolicy:  "noeviction",
+		MaxMemorySamples: 5,
+		LfuLogFactor:     10,
+		LfuDecayTime:     1,
+		// 与 redis 一致, 最多使用 25% 的时间
+		ActiveDefragCycleMax: 25,
+		SetMaxIntsetEntries:  512,
+		StorageBackend:       "simple",
+		StorageHotKeys:       100000,
+		LogLevel:             "notice",
+		SuggestCommands:      true,
 	}
 }
 
-func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+var ErrUnknownParameter = errors.New("unknown parameter")
 
-	// read config file
-	rawMap := make(map[string]string)
-	scanner := bufio.NewScanner(src)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) > 0 && strings.TrimLeft(line, " ")[0] == '#' {
-			continue
-		}
-		pivot := strings.IndexAny(line, " ")
-		if pivot > 0 && pivot < len(line)-1 { // separator found
-			key := line[0:pivot]
-			value := strings.Trim(line[pivot+1:], " ")
-			rawMap[strings.ToLower(key)] = value
-		}
+func cfgName(field reflect.StructField) string {
+	key, ok := field.Tag.Lookup("cfg")
+	if !ok || strings.TrimLeft(key, " ") == "" {
+		key = field.Name
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	if idx := strings.Index(key, ","); idx >= 0 {
+		key = key[:idx]
 	}
+	return strings.ToLower(key)
+}
 
-	// parse format
-	t := reflect.TypeOf(config)
-	v := reflect.ValueOf(config)
-	n := t.Elem().NumField()
-	for i := 0; i < n; i++ {
-		field := t.Elem().Field(i)
-		fieldVal := v.Elem().Field(i)
-		key, ok := field.Tag.Lookup("cfg")
-		if !ok || strings.TrimLeft(key, " ") == "" {
-			key = field.Name
-		}
-		value, ok := rawMap[strings.ToLower(key)]
-		if ok {
-			// fill config
-			switch field.Type.Kind() {
-			case reflect.String:
-				fieldVal.SetString(value)
-			case reflect.Int:
-				intValue, err := strconv.ParseInt(value, 10, 64)
-				if err == nil {
-					fieldVal.SetInt(intValue)
-				}
-			case reflect.Bool:
-				boolValue := "yes" == value
-				fieldVal.SetBool(boolValue)
-			case reflect.Slice:
-				if field.Type.Elem().Kind() == reflect.String {
-					slice := strings.Split(value, ",")
-					fieldVal.Set(reflect.ValueOf(slice))
-				}
-			}
+// cfgOption tag 中名字之后的选项: memory 值可以带单位, megabytes 没有单位时是 MB, append 可以写多行, args 值是多个参数,
+// readonly 不能出现在配置文件中, immutable 不能 CONFIG SET, enum=a|b 只能是列出的值
+func cfgOption(field reflect.StructField, option string) bool {
+	options := strings.Split(field.Tag.Get("cfg"), ",")
+	for _, o := range options[1:] {
+		if o == option {
+			return true
 		}
 	}
-	return config
+	return false
 }
 
-func SetUpConfig(filename string) {
-	file, err := os.Open(filename)
-	if err != nil {
-		panic(err)
+// Names 返回所有配置项的名称
+func Names() []string {
+	names := make([]string, 0, len(params))
+	for _, p := range params {
+		names = append(names, p.Name)
 	}
-	defer util.Close(file)
-	Properties = parse(file)
-	Properties.RunID = util.RandStr(40)
-	configFilePath, err := filepath.Abs(filename)
-	if err != nil {
-		return
+	return names
+}
+
+// Get 按照 CONFIG GET 的格式返回配置项的值, bool 类型渲染为 yes/no, 内存大小是字节数
+func Get(name string) (string, bool) {
+	p, ok := LookupParam(name)
+	if !ok {
+		return "", false
 	}
-	maxClinets := Properties.MaxClients
-	if maxClinets == 0 {
-		maxClinets = defaultMaxClients
-	} else {
-		if maxClinets > defaultMaxClients {
-			maxClinets = defaultMaxClients
+	return p.Value(Properties), true
+}
+
+func formatValue(fieldVal reflect.Value) string {
+	switch fieldVal.Kind() {
+	case reflect.String:
+		return fieldVal.String()
+	case reflect.Int:
+		return strconv.FormatInt(fieldVal.Int(), 10)
+	case reflect.Bool:
+		if fieldVal.Bool() {
+			return "yes"
+		}
+		return "no"
+	case reflect.Slice:
+		if values, ok := fieldVal.Interface().([]string); ok {
+			return strings.Join(values, ",")
 		}
 	}
-	Properties.MaxClients = maxClinets
+	return ""
+}
 
-	Properties.CfPath = configFilePath
-	if Properties.Dir == "" {
-		Properties.Dir = "."
+// Set 修改配置项的值, 值的格式与 CONFIG GET 一致, 内存大小是字节数
+func Set(name string, value string) error {
+	p, ok := LookupParam(name)
+	if !ok {
+		return ErrUnknownParameter
 	}
+	return setValue(p.field(Properties), value)
+}
 
-	// convert to byte
-	rewriteMinSize := Properties.AofRewriteMinSize * 1024 * 1024
-	Properties.AofRewriteMinSize = rewriteMinSize
-
-	if Properties.Databases == 0 {
-		Properties.Databases = 16
+func setValue(fieldVal reflect.Value, value string) error {
+	switch fieldVal.Kind() {
+	case reflect.String:
+		fieldVal.SetString(value)
+	case reflect.Int:
+		intValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("argument couldn't be parsed into an integer")
+		}
+		fieldVal.SetInt(intValue)
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "yes":
+			fieldVal.SetBool(true)
+		case "no":
+			fieldVal.SetBool(false)
+		default:
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+	case reflect.Slice:
+		fieldVal.Set(reflect.ValueOf(strings.Split(value, ",")))
 	}
+	return nil
 }
@@ -0,0 +1,349 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LoadError 配置文件中无效的行, 与 redis 一样在启动时报告文件名和行号之后退出
+type LoadError struct {
+	File string
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%s:%d: '%s': %v", e.File, e.Line, e.Text, e.Err)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// commandLineFile 命令行中的配置在错误中使用的文件名
+const commandLineFile = "(command line)"
+
+// maxIncludeDepth include 嵌套的层数上限
+const maxIncludeDepth = 16
+
+// memoryUnits 与 redis 一致, k/m/g 是1000的倍数, kb/mb/gb 是1024的倍数
+var memoryUnits = []struct {
+	suffix string
+	unit   int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// ParseMemory 解析带单位的内存大小, 比如 64mb, 返回字节数
+func ParseMemory(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	var unit int64 = 1
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, unit = lower[:len(lower)-len(u.suffix)], u.unit
+			break
+		}
+	}
+	num, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || num < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return num * unit, nil
+}
+
+// loader 依次读取配置文件, include 的文件和命令行中的配置
+type loader struct {
+	p        *ServerProperties
+	warnings []string
+	// appended 已经出现过的 append 配置项, 第一次出现时替换默认值
+	appended map[string]bool
+	// including 正在读取的文件, 用来发现循环 include
+	including map[string]bool
+}
+
+// Load 从默认配置开始读取 redis.conf 格式的 filename, 然后依次应用 overrides 中的行(命令行中的 --port 6380 这样的配置).
+// filename 为空时只使用 overrides. 返回未知的配置项等警告; 值无效时返回 *LoadError
+func Load(filename string, overrides ...string) (*ServerProperties, []string, error) {
+	l := &loader{
+		p:         Default(),
+		appended:  make(map[string]bool),
+		including: make(map[string]bool),
+	}
+	if filename != "" {
+		if err := l.loadFile(filename, 0); err != nil {
+			return nil, l.warnings, err
+		}
+		path, err := filepath.Abs(filename)
+		if err != nil {
+			return nil, l.warnings, err
+		}
+		l.p.CfPath = path
+	}
+	for i, line := range overrides {
+		if err := l.loadLine(commandLineFile, i+1, line, 0); err != nil {
+			return nil, l.warnings, err
+		}
+	}
+	l.p.normalize()
+	return l.p, l.warnings, nil
+}
+
+// LoadFile 与 Load 相同, 成功时替换 Properties
+func LoadFile(filename string, overrides ...string) ([]string, error) {
+	p, warnings, err := Load(filename, overrides...)
+	if err != nil {
+		return warnings, err
+	}
+	Properties = p
+	return warnings, nil
+}
+
+// normalize 读取之后修正超出范围的值
+func (p *ServerProperties) normalize() {
+	if p.MaxClients <= 0 || p.MaxClients > defaultMaxClients {
+		p.MaxClients = defaultMaxClients
+	}
+	if p.Dir == "" {
+		p.Dir = "."
+	}
+}
+
+func (l *loader) loadFile(filename string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("too many nested includes reading %s", filename)
+	}
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if l.including[path] {
+		return fmt.Errorf("include cycle detected reading %s", filename)
+	}
+	l.including[path] = true
+	defer delete(l.including, path)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	// 与 redis 一样不限制一行的长度
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if err := l.loadLine(filename, lineNum, scanner.Text(), depth); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *loader) loadLine(filename string, lineNum int, line string, depth int) error {
+	text := strings.TrimSpace(line)
+	if text == "" || text[0] == '#' {
+		return nil
+	}
+	fail := func(err error) error {
+		return &LoadError{File: filename, Line: lineNum, Text: text, Err: err}
+	}
+	argv, err := splitArgs(text)
+	if err != nil {
+		return fail(err)
+	}
+	name := strings.ToLower(argv[0])
+	if name == "include" {
+		if len(argv) != 2 {
+			return fail(errors.New("wrong number of arguments"))
+		}
+		if err := l.include(argv[1], depth); err != nil {
+			return fail(err)
+		}
+		return nil
+	}
+	param, ok := LookupParam(name)
+	if !ok || param.Readonly {
+		l.warnings = append(l.warnings, fmt.Sprintf("%s:%d: unknown directive '%s', ignored", filename, lineNum, argv[0]))
+		return nil
+	}
+	var value string
+	if param.Type == TypeList {
+		value = strings.Join(argv[1:], " ")
+	} else if len(argv) != 2 {
+		return fail(errors.New("wrong number of arguments"))
+	} else {
+		value = argv[1]
+	}
+	if param.Append {
+		// 与 redis 的 save 一样, 第一次出现时替换默认值, 空的值清空之前的所有行
+		if l.appended[name] && value != "" {
+			if previous := param.Value(l.p); previous != "" {
+				value = previous + " " + value
+			}
+		}
+		l.appended[name] = true
+	}
+	if err := param.Parse(l.p, value); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// include 读取 pattern 匹配的所有文件, 没有通配符时文件必须存在
+func (l *loader) include(pattern string, depth int) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		files = []string{pattern}
+	}
+	for _, file := range files {
+		if err := l.loadFile(file, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitArgs 与 redis 的 sdssplitargs 一致: 参数用空白分隔, 双引号中可以使用 \n \t \xHH 这样的转义, 单引号中只能转义 \'
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		var current []byte
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if i >= len(line) {
+				if inDouble || inSingle {
+					return nil, errors.New("unbalanced quotes in configuration line")
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(b))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				} else if c == '"' {
+					// 右引号之后必须是空白或者行尾
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					current = append(current, '\'')
+					i++
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					current = append(current, c)
+				}
+			}
+			i++
+		}
+		args = append(args, string(current))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// QuoteArg 需要时给参数加上双引号, splitArgs 读取之后得到原来的值
+func QuoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n\v\f\"'\\") && isPrintable(arg) {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
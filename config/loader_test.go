@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`port 6379`, []string{"port", "6379"}},
+		{"  save\t900   1 ", []string{"save", "900", "1"}},
+		{`requirepass ""`, []string{"requirepass", ""}},
+		{`dbfilename "my dump.rdb"`, []string{"dbfilename", "my dump.rdb"}},
+		{`masterauth "a\"b\\c\n\x41"`, []string{"masterauth", "a\"b\\c\nA"}},
+		{`masterauth 'it\'s "raw"\n'`, []string{"masterauth", `it's "raw"\n`}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		require.NoError(t, err, tt.line)
+		assert.Equal(t, tt.want, got, tt.line)
+		// QuoteArg 之后读出来是原来的值
+		quoted := make([]string, len(got))
+		for i, arg := range got {
+			quoted[i] = QuoteArg(arg)
+		}
+		again, err := splitArgs(strings.Join(quoted, " "))
+		require.NoError(t, err)
+		assert.Equal(t, got, again)
+	}
+	for _, line := range []string{`requirepass "abc`, `requirepass 'abc`, `requirepass "abc"def`} {
+		_, err := splitArgs(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "redis.conf", `# comment
+  # indented comment
+
+PORT 7000
+appendonly Yes
+auto-aof-rewrite-min-size 64
+repl-backlog-size 1mb
+maxmemory 100k
+save 900 1
+save 300 10
+client-output-buffer-limit normal 0 0 0
+client-output-buffer-limit pubsub 64mb 16mb 30
+maxclients 0
+slowlog-max-len 128
+runid 0123
+`)
+	p, warnings, err := Load(path, "port 7001", `requirepass "a b"`)
+	require.NoError(t, err)
+	assert.Equal(t, 7001, p.Port)
+	assert.True(t, p.AppendOnly)
+	assert.Equal(t, 64<<20, p.AofRewriteMinSize)
+	assert.Equal(t, 1<<20, p.ReplBacklogSize)
+	assert.Equal(t, 100000, p.MaxMemory)
+	assert.Equal(t, "900 1 300 10", p.Save)
+	assert.Equal(t, "normal 0 0 0 pubsub 64mb 16mb 30", p.ClientOutputBufferLimit)
+	assert.Equal(t, defaultMaxClients, p.MaxClients)
+	assert.Equal(t, "a b", p.RequirePass)
+	assert.Equal(t, path, p.CfPath)
+	// 没有出现的配置项是默认值
+	assert.Equal(t, 16, p.Databases)
+	assert.Equal(t, "dump.rdb", p.DbFilename)
+	assert.NotEqual(t, "0123", p.RunID)
+	require.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0], "redis.conf:14: unknown directive 'slowlog-max-len'")
+	assert.Contains(t, warnings[1], "redis.conf:15: unknown directive 'runid'")
+
+	// 空的值清空之前的行
+	path = writeConfig(t, dir, "empty-save.conf", "save 900 1\nsave \"\"\n")
+	p, _, err = Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "", p.Save)
+}
+
+func TestLoadError(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		line    int
+	}{
+		{"port 6379\ndatabases many\n", 2},
+		{"appendonly maybe\n", 1},
+		{"\n\nmaxmemory 10xb\n", 3},
+		{"port 6379 6380\n", 1},
+		{"requirepass \"abc\n", 1},
+		{"include\n", 1},
+		{"appendfsync sometimes\n", 1},
+	}
+	for _, tt := range tests {
+		path := writeConfig(t, dir, "bad.conf", tt.content)
+		_, _, err := Load(path)
+		var loadErr *LoadError
+		require.True(t, errors.As(err, &loadErr), tt.content)
+		assert.Equal(t, path, loadErr.File)
+		assert.Equal(t, tt.line, loadErr.Line, tt.content)
+	}
+	_, _, err := Load("", "port abc")
+	assert.EqualError(t, err, "(command line):1: 'port abc': argument couldn't be parsed into an integer")
+	// 加载失败时 Properties 不变
+	before := Properties
+	_, err = LoadFile(filepath.Join(dir, "bad.conf"))
+	assert.Error(t, err)
+	assert.Same(t, before, Properties)
+}
+
+func TestLoadInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, "a.conf", "port 7001\nsave 60 1\n")
+	writeConfig(t, dir, "b.conf", "port 7002\nsave 30 5\n")
+	path := writeConfig(t, dir, "redis.conf", "port 7000\ndatabases 4\ninclude "+filepath.Join(dir, "[ab].conf")+"\ntimeout 5\n")
+	p, _, err := Load(path)
+	require.NoError(t, err)
+	// 按照出现的顺序生效, 后面的覆盖前面的
+	assert.Equal(t, 7002, p.Port)
+	assert.Equal(t, 4, p.Databases)
+	assert.Equal(t, 5, p.Timeout)
+	assert.Equal(t, "60 1 30 5", p.Save)
+
+	// 没有通配符时文件必须存在
+	path = writeConfig(t, dir, "missing.conf", "include "+filepath.Join(dir, "nothing.conf")+"\n")
+	_, _, err = Load(path)
+	assert.Error(t, err)
+
+	loop := filepath.Join(dir, "loop.conf")
+	writeConfig(t, dir, "loop.conf", "port 7000\ninclude "+loop+"\n")
+	_, _, err = Load(loop)
+	assert.ErrorContains(t, err, "include cycle")
+}
+
+func TestRewrite(t *testing.T) {
+	saved := Properties
+	t.Cleanup(func() {
+		Properties = saved
+	})
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "redis.conf", `# 端口
+port 7000
+
+# 持久化
+save 900 1
+save 300 10
+timeout 10
+timeout 20
+include `+filepath.Join(dir, "*.include")+`
+slowlog-max-len 128
+`)
+	_, err := LoadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, Set("port", "7100"))
+	require.NoError(t, Set("save", "3600 1"))
+	require.NoError(t, Set("maxmemory", "1048576"))
+	require.NoError(t, Set("auto-aof-rewrite-min-size", "1000"))
+	require.NoError(t, Set("masterauth", "a b"))
+	require.NoError(t, Rewrite())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `# 端口
+port 7100
+
+# 持久化
+save 3600 1
+timeout 20
+include `+filepath.Join(dir, "*.include")+`
+slowlog-max-len 128
+# Generated by CONFIG REWRITE
+auto-aof-rewrite-min-size 1000b
+masterauth "a b"
+maxmemory 1mb
+`, string(data))
+
+	// 再次重写时不重复追加
+	require.NoError(t, Rewrite())
+	again, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), string(again))
+
+	p, _, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 7100, p.Port)
+	assert.Equal(t, "3600 1", p.Save)
+	assert.Equal(t, 1000, p.AofRewriteMinSize)
+	assert.Equal(t, "a b", p.MasterAuth)
+
+	Properties = Default()
+	assert.Equal(t, ErrNoConfigFile, Rewrite())
+}
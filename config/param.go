@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ParamType 配置项的值的类型, 决定配置文件中的写法
+type ParamType int
+
+const (
+	TypeString ParamType = iota
+	// TypeBool yes 或者 no
+	TypeBool
+	TypeInt
+	// TypeMemory 字节数, 配置文件中可以带单位, 比如 512mb, 100k
+	TypeMemory
+	// TypeEnum 只能是 Enum 中的一个值
+	TypeEnum
+	// TypeList 多个参数, 比如 save 900 1 300 10
+	TypeList
+)
+
+// Param 配置项的元数据, 从 ServerProperties 的 tag 生成
+type Param struct {
+	Name string
+	Type ParamType
+	// Default 默认值在配置文件中的写法
+	Default string
+	// Immutable 只能在配置文件和命令行中设置, CONFIG SET 返回错误
+	Immutable bool
+	// Readonly 不能出现在配置文件中, 比如 runid
+	Readonly bool
+	// Append 可以写多行, 比如 save
+	Append bool
+	// Enum TypeEnum 允许的值
+	Enum []string
+	// megabytes TypeMemory 的值没有单位时是 MB
+	megabytes bool
+	index     int
+}
+
+var (
+	params     []*Param
+	paramIndex = make(map[string]*Param)
+)
+
+func init() {
+	t := reflect.TypeOf(ServerProperties{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		p := &Param{
+			Name:      cfgName(field),
+			Readonly:  cfgOption(field, "readonly"),
+			Immutable: cfgOption(field, "readonly") || cfgOption(field, "immutable"),
+			Append:    cfgOption(field, "append"),
+			megabytes: cfgOption(field, "megabytes"),
+			index:     i,
+		}
+		switch {
+		case cfgOption(field, "args"):
+			p.Type = TypeList
+		case cfgOption(field, "memory") || p.megabytes:
+			p.Type = TypeMemory
+		case field.Type.Kind() == reflect.Bool:
+			p.Type = TypeBool
+		case field.Type.Kind() == reflect.Int:
+			p.Type = TypeInt
+		}
+		for _, option := range strings.Split(field.Tag.Get("cfg"), ",") {
+			if strings.HasPrefix(option, "enum=") {
+				p.Type = TypeEnum
+				p.Enum = strings.Split(option[len("enum="):], "|")
+			}
+		}
+		params = append(params, p)
+		paramIndex[p.Name] = p
+	}
+	defaults := Default()
+	defaults.normalize()
+	for _, p := range params {
+		p.Default = p.Render(defaults)
+	}
+}
+
+// Params 所有的配置项, 按照 ServerProperties 中的顺序
+func Params() []*Param {
+	return params
+}
+
+// LookupParam 不区分大小写查找配置项
+func LookupParam(name string) (*Param, bool) {
+	if p, ok := paramIndex[name]; ok {
+		return p, true
+	}
+	p, ok := paramIndex[strings.ToLower(name)]
+	return p, ok
+}
+
+func (p *Param) field(props *ServerProperties) reflect.Value {
+	return reflect.ValueOf(props).Elem().Field(p.index)
+}
+
+// Value CONFIG GET 返回的值, 与 redis 一样内存大小是字节数
+func (p *Param) Value(props *ServerProperties) string {
+	return formatValue(p.field(props))
+}
+
+// Render 配置文件中的写法, 内存大小能整除时使用 gb, mb, kb 的单位. Parse 读取之后得到同样的值
+func (p *Param) Render(props *ServerProperties) string {
+	value := p.Value(props)
+	if p.Type != TypeMemory {
+		return value
+	}
+	num := p.field(props).Int()
+	for _, u := range []struct {
+		suffix string
+		unit   int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}} {
+		if num != 0 && num%u.unit == 0 {
+			return strconv.FormatInt(num/u.unit, 10) + u.suffix
+		}
+	}
+	if p.megabytes && num != 0 {
+		// 没有单位时按照 MB 读取
+		return value + "b"
+	}
+	return value
+}
+
+// Parse 按照配置文件中的写法解析 value 并写入 props
+func (p *Param) Parse(props *ServerProperties, value string) error {
+	switch p.Type {
+	case TypeMemory:
+		if p.megabytes {
+			// 与原来的配置文件兼容, 没有单位时是 MB
+			if num, err := strconv.ParseInt(value, 10, 64); err == nil && num >= 0 {
+				value = strconv.FormatInt(num<<20, 10)
+			}
+		}
+		num, err := ParseMemory(value)
+		if err != nil {
+			return err
+		}
+		value = strconv.FormatInt(num, 10)
+	case TypeEnum:
+		lower := strings.ToLower(value)
+		for _, option := range p.Enum {
+			if option == lower {
+				return setValue(p.field(props), lower)
+			}
+		}
+		return errors.New("argument(s) must be one of the following: " + strings.Join(p.Enum, ", "))
+	}
+	return setValue(p.field(props), value)
+}
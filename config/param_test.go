@@ -0,0 +1,84 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := map[string]int64{
+		"0": 0, "100": 100, "100b": 100, "1gb": 1 << 30, "512K": 512000, "512kb": 512 << 10, "64MB": 64 << 20, "2g": 2000000000,
+	}
+	for value, want := range tests {
+		got, err := ParseMemory(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+	for _, value := range []string{"", "mb", "-1", "1tb", "1.5mb"} {
+		_, err := ParseMemory(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParamRender(t *testing.T) {
+	saved := Properties
+	t.Cleanup(func() {
+		Properties = saved
+	})
+	Properties = Default()
+	for name, value := range map[string]string{
+		"maxmemory": "104857600", "proto-max-bulk-len": "1000", "auto-aof-rewrite-min-size": "1000", "appendonly": "yes",
+	} {
+		require.NoError(t, Set(name, value))
+	}
+	render := func(name string) string {
+		p, ok := LookupParam(name)
+		require.True(t, ok, name)
+		return p.Render(Properties)
+	}
+	assert.Equal(t, "100mb", render("maxmemory"))
+	assert.Equal(t, "1000", render("proto-max-bulk-len"))
+	// 没有单位时按照 MB 读取的配置项加上 b
+	assert.Equal(t, "1000b", render("auto-aof-rewrite-min-size"))
+	assert.Equal(t, "yes", render("APPENDONLY"))
+	assert.Equal(t, "", render("requirepass"))
+
+	props := Default()
+	p, _ := LookupParam("maxmemory-policy")
+	assert.Equal(t, TypeEnum, p.Type)
+	assert.Equal(t, "noeviction", p.Default)
+	assert.EqualError(t, p.Parse(props, "lru"), "argument(s) must be one of the following: volatile-lru, allkeys-lru, "+
+		"volatile-lfu, allkeys-lfu, volatile-random, allkeys-random, volatile-ttl, noeviction")
+	require.NoError(t, p.Parse(props, "ALLKEYS-LRU"))
+	assert.Equal(t, "allkeys-lru", props.MaxMemoryPolicy)
+	p, _ = LookupParam("databases")
+	assert.True(t, p.Immutable)
+	assert.Equal(t, "16", p.Default)
+}
+
+// TestParamRoundTrip 每个配置项的默认值和修改之后的值渲染成配置文件中的写法, 再读取出来得到同样的值
+func TestParamRoundTrip(t *testing.T) {
+	samples := map[ParamType][]string{
+		TypeString: {"", "a b", "it's \"quoted\""},
+		TypeBool:   {"yes", "no"},
+		TypeInt:    {"0", "7", "-1"},
+		TypeMemory: {"0", "1", "1000", "1024", "1048576", "1073741824", "1536"},
+		TypeList:   {"", "900 1 300 10"},
+	}
+	for _, p := range Params() {
+		values := append([]string{p.Default}, samples[p.Type]...)
+		if p.Type == TypeEnum {
+			values = append(values, p.Enum...)
+		}
+		for _, value := range values {
+			props := Default()
+			require.NoError(t, p.Parse(props, value), p.Name)
+			want := p.Value(props)
+			loaded := Default()
+			require.NoError(t, p.Parse(loaded, p.Render(props)), p.Name)
+			assert.Equal(t, want, p.Value(loaded), "%s %s", p.Name, p.Render(props))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoConfigFile 没有从配置文件启动时不能 CONFIG REWRITE
+var ErrNoConfigFile = errors.New("The server is running without a config file")
+
+// rewriteSignature 与 redis 一致, 文件中没有的配置项追加在这一行之后
+const rewriteSignature = "# Generated by CONFIG REWRITE"
+
+// rewriteGroups 可以写多行的配置项每一行的参数个数
+var rewriteGroups = map[string]int{
+	"save":                       2,
+	"client-output-buffer-limit": 4,
+}
+
+// Rewrite 与 redis 的 CONFIG REWRITE 一样把当前的配置写回启动时的配置文件: 注释, 空行和 include 保持不变,
+// 文件中已有的配置项在原来的位置改成当前的值, 重复的行被删除, 文件中没有并且不是默认值的配置项追加在末尾.
+// 先写入同一个目录下的临时文件再替换, 失败时原来的文件不受影响. 调用方持有 server 的锁
+func Rewrite() error {
+	path := Properties.CfPath
+	if path == "" {
+		return ErrNoConfigFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	wanted := make(map[string][]string)
+	for _, p := range params {
+		if !p.Readonly {
+			wanted[p.Name] = p.lines(p.Render(Properties))
+		}
+	}
+	written := make(map[string]int)
+	seen := make(map[string]bool)
+	hasSignature := false
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		text := strings.TrimSpace(line)
+		if text == rewriteSignature {
+			hasSignature = true
+		}
+		argv, err := splitArgs(text)
+		if text == "" || text[0] == '#' || err != nil || len(argv) == 0 {
+			result = append(result, line)
+			continue
+		}
+		name := strings.ToLower(argv[0])
+		current, ok := wanted[name]
+		if !ok {
+			// include 和未知的配置项保持不变
+			result = append(result, line)
+			continue
+		}
+		seen[name] = true
+		if n := written[name]; n < len(current) {
+			result = append(result, current[n])
+			written[name] = n + 1
+		}
+	}
+
+	var appended []string
+	for _, p := range params {
+		current := wanted[p.Name]
+		// 文件中没有并且是默认值的配置项不写入
+		if !seen[p.Name] && (p.Readonly || p.Render(Properties) == p.Default) {
+			continue
+		}
+		appended = append(appended, current[written[p.Name]:]...)
+	}
+	if len(appended) > 0 {
+		if !hasSignature {
+			result = append(result, rewriteSignature)
+		}
+		result = append(result, appended...)
+	}
+	return writeFileAtomic(path, []byte(strings.Join(result, "\n")+"\n"))
+}
+
+// lines 配置文件中的写法 value 写成一行或者多行
+func (p *Param) lines(value string) []string {
+	name := p.Name
+	if p.Type != TypeList {
+		return []string{name + " " + QuoteArg(value)}
+	}
+	args := strings.Fields(value)
+	if len(args) == 0 {
+		return []string{name + ` ""`}
+	}
+	group := rewriteGroups[name]
+	if group == 0 {
+		return []string{name + " " + strings.Join(args, " ")}
+	}
+	var lines []string
+	for i := 0; i < len(args); i += group {
+		end := i + group
+		if end > len(args) {
+			end = len(args)
+		}
+		lines = append(lines, name+" "+strings.Join(args[i:end], " "))
+	}
+	return lines
+}
+
+// writeFileAtomic 写入临时文件之后替换 path, 保留原来文件的权限
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(path); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+	}
+	return err
+}
@@ -3,13 +3,18 @@ module github.com/xuning888/godis-tiny
 go 1.17
 
 require (
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/panjf2000/gnet/v2 v2.5.0
 	github.com/stretchr/testify v1.8.4
+	github.com/yuin/gopher-lua v1.1.1
+	go.uber.org/goleak v1.1.11
 	go.uber.org/zap v1.21.0
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
@@ -0,0 +1,168 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const wrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+func TestLists(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		assert.Equal(t, int64(3), client.RPush(ctx, "list", "b", "c", "d").Val())
+		assert.Equal(t, int64(4), client.LPush(ctx, "list", "a").Val())
+		assert.Equal(t, int64(4), client.LLen(ctx, "list").Val())
+		assert.Equal(t, []string{"a", "b", "c", "d"}, client.LRange(ctx, "list", 0, -1).Val())
+		assert.Equal(t, []string{"c", "d"}, client.LRange(ctx, "list", -2, 100).Val())
+		assert.Empty(t, client.LRange(ctx, "list", 10, 20).Val())
+		assert.Equal(t, "b", client.LIndex(ctx, "list", 1).Val())
+		assert.Equal(t, goredis.Nil, client.LIndex(ctx, "list", 10).Err())
+		assert.Equal(t, "a", client.LPop(ctx, "list").Val())
+		assert.Equal(t, "d", client.RPop(ctx, "list").Val())
+		assert.Equal(t, []string{"b", "c"}, client.LPopCount(ctx, "list", 5).Val())
+		assert.Equal(t, goredis.Nil, client.LPop(ctx, "list").Err())
+		assert.Equal(t, int64(0), client.LLen(ctx, "list").Val())
+
+		client.RPush(ctx, "src", "1", "2", "3")
+		assert.Equal(t, "1", client.LMove(ctx, "src", "dst", "LEFT", "RIGHT").Val())
+		assert.Equal(t, "3", client.RPopLPush(ctx, "src", "dst").Val())
+		assert.Equal(t, "2", client.LMove(ctx, "src", "src", "RIGHT", "LEFT").Val())
+		assert.Equal(t, []string{"3", "1"}, client.LRange(ctx, "dst", 0, -1).Val())
+		assert.Equal(t, goredis.Nil, client.LMove(ctx, "missing", "dst", "LEFT", "LEFT").Err())
+
+		client.Set(ctx, "str", "v", 0)
+		assert.EqualError(t, client.LMove(ctx, "src", "str", "LEFT", "LEFT").Err(), wrongType)
+		assert.Equal(t, []string{"2"}, client.LRange(ctx, "src", 0, -1).Val())
+		assert.EqualError(t, client.LPush(ctx, "str", "a").Err(), wrongType)
+		assert.EqualError(t, client.LRange(ctx, "str", 0, -1).Err(), wrongType)
+	})
+}
+
+func TestBlockingLists(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		assert.Equal(t, goredis.Nil, client.BLPop(ctx, 100*time.Millisecond, "queue").Err())
+		pusher := h.GoRedis(t, 2)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			pusher.RPush(ctx, "queue", "a", "b")
+		}()
+		assert.Equal(t, []string{"queue", "b"}, client.BRPop(ctx, 5*time.Second, "queue").Val())
+		assert.Equal(t, []string{"queue", "a"}, client.BLPop(ctx, 0, "other", "queue").Val())
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			pusher.RPush(ctx, "queue", "c")
+		}()
+		assert.Equal(t, "c", client.BLMove(ctx, "queue", "moved", "LEFT", "RIGHT", 5*time.Second).Val())
+		assert.Equal(t, goredis.Nil, client.BRPopLPush(ctx, "queue", "moved", 100*time.Millisecond).Err())
+		assert.Equal(t, []string{"c"}, client.LRange(ctx, "moved", 0, -1).Val())
+		assert.Equal(t, int64(0), client.Wait(ctx, 0, 0).Val())
+	})
+}
+
+func TestHashes(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		assert.Equal(t, int64(2), client.HSet(ctx, "hash", "f1", "v1", "f2", "v2").Val())
+		assert.Equal(t, int64(0), client.HSet(ctx, "hash", "f1", "new").Val())
+		assert.Equal(t, "new", client.HGet(ctx, "hash", "f1").Val())
+		assert.Equal(t, goredis.Nil, client.HGet(ctx, "hash", "missing").Err())
+		// RESP3 中是 map, RESP2 中是数组, 客户端都转换为 map
+		assert.Equal(t, map[string]string{"f1": "new", "f2": "v2"}, client.HGetAll(ctx, "hash").Val())
+		assert.Empty(t, client.HGetAll(ctx, "missing").Val())
+
+		assert.EqualError(t, client.Do(ctx, "hset", "hash", "f1").Err(), "ERR wrong number of arguments for 'hset' command")
+		client.Set(ctx, "str", "v", 0)
+		assert.EqualError(t, client.HGet(ctx, "str", "f").Err(), wrongType)
+	})
+}
+
+func TestSets(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		assert.Equal(t, int64(3), client.SAdd(ctx, "set", "a", "b", "c", "a").Val())
+		assert.Equal(t, int64(3), client.SCard(ctx, "set").Val())
+		// RESP3 中是 set
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, client.SMembers(ctx, "set").Val())
+		assert.Equal(t, int64(1), client.SRem(ctx, "set", "a", "missing").Val())
+		popped := client.SPop(ctx, "set").Val()
+		assert.Contains(t, []string{"b", "c"}, popped)
+		assert.Len(t, client.SPopN(ctx, "set", 5).Val(), 1)
+		assert.Equal(t, int64(0), client.SCard(ctx, "set").Val())
+		assert.Equal(t, goredis.Nil, client.SPop(ctx, "set").Err())
+
+		// 整数集合
+		client.SAdd(ctx, "ints", 3, 1, 2)
+		assert.ElementsMatch(t, []string{"1", "2", "3"}, client.SMembers(ctx, "ints").Val())
+		assert.Contains(t, []string{"1", "2", "3"}, client.SRandMember(ctx, "ints").Val())
+		assert.ElementsMatch(t, []string{"1", "2", "3"}, client.SRandMemberN(ctx, "ints", 5).Val())
+		// 负数可能重复, 超过 1024 个时是流式回复
+		sampled := client.SRandMemberN(ctx, "ints", -2000).Val()
+		assert.Len(t, sampled, 2000)
+		assert.Subset(t, []string{"1", "2", "3"}, sampled)
+		assert.Equal(t, goredis.Nil, client.SRandMember(ctx, "missing").Err())
+
+		// 集合运算
+		client.SAdd(ctx, "s1", "a", "b", "c")
+		client.SAdd(ctx, "s2", "b", "c", "d")
+		assert.ElementsMatch(t, []string{"b", "c"}, client.SInter(ctx, "s1", "s2").Val())
+		assert.Equal(t, int64(1), client.SInterCard(ctx, 1, "s1", "s2").Val())
+		assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, client.SUnion(ctx, "s1", "s2").Val())
+		assert.Equal(t, int64(2), client.SInterStore(ctx, "dest", "s1", "s2").Val())
+		assert.Equal(t, int64(4), client.SUnionStore(ctx, "dest", "s1", "s2").Val())
+		assert.Empty(t, client.SInter(ctx, "s1", "missing").Val())
+
+		client.Set(ctx, "str", "v", 0)
+		assert.EqualError(t, client.SAdd(ctx, "str", "a").Err(), wrongType)
+	})
+}
+
+func TestSort(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		client.RPush(ctx, "list", "3", "1", "2")
+		client.MSet(ctx, "w_1", "30", "w_2", "20", "w_3", "10", "name_1", "one", "name_2", "two", "name_3", "three")
+		assert.Equal(t, []string{"1", "2", "3"}, client.Sort(ctx, "list", &goredis.Sort{}).Val())
+		assert.Equal(t, []string{"3", "2"}, client.SortRO(ctx, "list", &goredis.Sort{Order: "DESC", Count: 2}).Val())
+		assert.Equal(t, []string{"three", "two", "one"},
+			client.Sort(ctx, "list", &goredis.Sort{By: "w_*", Get: []string{"name_*"}}).Val())
+		assert.Equal(t, int64(3), client.SortStore(ctx, "list", "sorted", &goredis.Sort{}).Val())
+		assert.Equal(t, []string{"1", "2", "3"}, client.LRange(ctx, "sorted", 0, -1).Val())
+
+		client.RPush(ctx, "words", "b", "a")
+		assert.EqualError(t, client.Sort(ctx, "words", &goredis.Sort{}).Err(),
+			"ERR One or more scores can't be converted into double")
+		assert.Equal(t, []string{"a", "b"}, client.Sort(ctx, "words", &goredis.Sort{Alpha: true}).Val())
+	})
+}
+
+func TestCollectionsRedigo(t *testing.T) {
+	conn := h.Redigo(t)
+	_, err := conn.Do("rpush", "list", "a", "b")
+	require.NoError(t, err)
+	list, err := redigo.Strings(conn.Do("lrange", "list", 0, -1))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, list)
+	_, err = conn.Do("hset", "hash", "f", "v")
+	require.NoError(t, err)
+	hash, err := redigo.StringMap(conn.Do("hgetall", "hash"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"f": "v"}, hash)
+	_, err = conn.Do("sadd", "set", "x", "y")
+	require.NoError(t, err)
+	members, err := redigo.Strings(conn.Do("smembers", "set"))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"x", "y"}, members)
+	_, err = conn.Do("lpush", "hash", "a")
+	assert.EqualError(t, err, wrongType)
+}
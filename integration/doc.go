@@ -0,0 +1,10 @@
+// Package integration 通过真实的客户端库测试协议层的兼容性: 在随机端口上启动嵌入的 server,
+// 分别使用 go-redis v9 (RESP2 和 RESP3) 和 redigo 执行每一类命令, 按照客户端解析之后的类型检查结果而不是原始的字节.
+// raw 模式直接在 socket 上发送手写的 RESP, 包括流水线和在 bulk 中间拆开的多次写入, 检查 redis.DecodeInStream 能够重新拼接.
+//
+// 这是单独的 module, 客户端库不会出现在 godis-tiny 的依赖中. 测试需要 integration 标签:
+//
+//	cd integration && go test -tags integration ./...
+//
+// 新增的命令需要在这里加上正常的用法和文档中的错误回复.
+package integration
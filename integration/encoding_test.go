@@ -0,0 +1,149 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodingConversions INFO stats 中 encoding_conversions 的计数, 比如 set=2
+func encodingConversions(t *testing.T, client *goredis.Client) map[string]string {
+	info := client.Info(context.Background(), "stats").Val()
+	counts := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if !strings.HasPrefix(line, "encoding_conversions:") {
+			continue
+		}
+		for _, pair := range strings.Split(strings.TrimPrefix(line, "encoding_conversions:"), ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			require.Len(t, kv, 2)
+			counts[kv[0]] = kv[1]
+		}
+	}
+	require.NotEmpty(t, counts, info)
+	return counts
+}
+
+func sorted(values []string) []string {
+	result := append([]string(nil), values...)
+	sort.Strings(result)
+	return result
+}
+
+func TestSetEncodingConversion(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		require.NoError(t, client.ConfigSet(ctx, "set-max-intset-entries", "4").Err())
+		defer client.ConfigSet(ctx, "set-max-intset-entries", "512")
+		require.NoError(t, client.ConfigResetStat(ctx).Err())
+
+		// 读命令的结果, 在转换前后比较
+		reads := func(key string) []interface{} {
+			return []interface{}{
+				sorted(client.SMembers(ctx, key).Val()),
+				client.SCard(ctx, key).Val(),
+				sorted(client.SInter(ctx, key, "other").Val()),
+				sorted(client.SUnion(ctx, key, "other").Val()),
+				client.SInterCard(ctx, 0, key, "other").Val(),
+				client.Sort(ctx, key, &goredis.Sort{}).Val(),
+			}
+		}
+		client.SAdd(ctx, "other", 2, 3, 100)
+
+		// 超过元素个数的上限
+		client.SAdd(ctx, "ints", 1, 2, 3, 4)
+		assert.Equal(t, "intset", client.ObjectEncoding(ctx, "ints").Val())
+		before := reads("ints")
+		assert.Equal(t, int64(1), client.SAdd(ctx, "ints", 5).Val())
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "ints").Val())
+		assert.Equal(t, "1", encodingConversions(t, client)["set"])
+		assert.Equal(t, int64(1), client.SRem(ctx, "ints", 5).Val())
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "ints").Val())
+		assert.Equal(t, before, reads("ints"))
+		// 删除到只剩一个元素也不会变回 intset, 不会再次转换
+		client.SRem(ctx, "ints", 1, 2, 3)
+		client.SAdd(ctx, "ints", 1, 2, 3, 5)
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "ints").Val())
+		assert.Equal(t, "1", encodingConversions(t, client)["set"])
+
+		// 非整数的元素
+		client.SAdd(ctx, "mixed", 1, 2)
+		before = reads("mixed")
+		assert.Equal(t, int64(1), client.SAdd(ctx, "mixed", "a").Val())
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "mixed").Val())
+		assert.Equal(t, int64(1), client.SRem(ctx, "mixed", "a").Val())
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "mixed").Val())
+		assert.Equal(t, before, reads("mixed"))
+		assert.Equal(t, "2", encodingConversions(t, client)["set"])
+
+		assert.Equal(t, map[string]string{"list": "0", "set": "2", "hash": "0"}, encodingConversions(t, client))
+	})
+}
+
+func TestListEncodingStable(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		require.NoError(t, client.ConfigResetStat(ctx).Err())
+		reads := func() []interface{} {
+			return []interface{}{
+				client.LRange(ctx, "list", 0, -1).Val(),
+				client.LLen(ctx, "list").Val(),
+				client.LIndex(ctx, "list", 1).Val(),
+				client.LIndex(ctx, "list", -1).Val(),
+			}
+		}
+		client.RPush(ctx, "list", "a", "b", "c")
+		assert.Equal(t, "linkedlist", client.ObjectEncoding(ctx, "list").Val())
+		before := reads()
+		// 列表只有一种编码, 元素很多或者很长时也不会转换
+		for i := 0; i < 1000; i++ {
+			client.RPush(ctx, "list", strings.Repeat("x", 100)+strconv.Itoa(i))
+		}
+		assert.Equal(t, "linkedlist", client.ObjectEncoding(ctx, "list").Val())
+		assert.Len(t, client.RPopCount(ctx, "list", 1000).Val(), 1000)
+		assert.Equal(t, "linkedlist", client.ObjectEncoding(ctx, "list").Val())
+		assert.Equal(t, before, reads())
+		assert.Equal(t, "0", encodingConversions(t, client)["list"])
+	})
+}
+
+func TestHashEncodingStable(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		require.NoError(t, client.ConfigResetStat(ctx).Err())
+		reads := func() []interface{} {
+			return []interface{}{
+				client.HGet(ctx, "hash", "f1").Val(),
+				client.HGet(ctx, "hash", "f2").Val(),
+				client.HGet(ctx, "hash", "missing").Err(),
+			}
+		}
+		client.HSet(ctx, "hash", "f1", "v1", "f2", "v2")
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "hash").Val())
+		before := reads()
+		// 哈希只有一种编码, 字段很多或者值很长时也不会转换. 还没有 HDEL, 把值改回短的
+		fields := make([]interface{}, 0, 1000)
+		for i := 0; i < 500; i++ {
+			fields = append(fields, "big"+strconv.Itoa(i), strings.Repeat("v", 100))
+		}
+		client.HSet(ctx, "hash", fields...)
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "hash").Val())
+		assert.Equal(t, before, reads())
+		for i := 1; i < len(fields); i += 2 {
+			fields[i] = "v"
+		}
+		client.HSet(ctx, "hash", fields...)
+		assert.Equal(t, "hashtable", client.ObjectEncoding(ctx, "hash").Val())
+		assert.Equal(t, before, reads())
+		assert.Len(t, client.HGetAll(ctx, "hash").Val(), 502)
+		assert.Equal(t, "0", encodingConversions(t, client)["hash"])
+	})
+}
@@ -0,0 +1,113 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/server"
+	"go.uber.org/zap"
+)
+
+// Protocols go-redis 客户端测试的协议版本
+var Protocols = []int{2, 3}
+
+// Harness 在随机端口上运行的 server, 同一个进程中只能有一个
+type Harness struct {
+	srv  *server.Server
+	addr string
+}
+
+// Start 在 127.0.0.1 的随机端口上启动 server, 加载数据完成之后返回
+func Start(opts ...server.Option) (*Harness, error) {
+	opts = append([]server.Option{
+		server.WithAddr("127.0.0.1:0"),
+		server.WithLogger(logger.Zap(zap.NewNop())),
+	}, opts...)
+	srv, err := server.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = srv.Start(ctx); err != nil {
+		return nil, err
+	}
+	return &Harness{srv: srv, addr: srv.Addr().String()}, nil
+}
+
+// Addr server 监听的地址
+func (h *Harness) Addr() string {
+	return h.addr
+}
+
+// Close 关闭 server
+func (h *Harness) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return h.srv.Shutdown(ctx)
+}
+
+// GoRedis 使用 protocol 版本的 go-redis 客户端, 测试开始时清空所有的数据, 结束时关闭
+func (h *Harness) GoRedis(t testing.TB, protocol int) *goredis.Client {
+	t.Helper()
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     h.addr,
+		Protocol: protocol,
+		// 测试的是回复的类型, 不需要重试
+		MaxRetries: -1,
+	})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	if err := client.FlushAll(context.Background()).Err(); err != nil {
+		t.Fatalf("flushall: %v", err)
+	}
+	return client
+}
+
+// Redigo redigo 的连接(RESP2), 测试开始时清空所有的数据, 结束时关闭
+func (h *Harness) Redigo(t testing.TB) redigo.Conn {
+	t.Helper()
+	conn, err := redigo.Dial("tcp", h.addr,
+		redigo.DialConnectTimeout(5*time.Second), redigo.DialReadTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if _, err = conn.Do("flushall"); err != nil {
+		t.Fatalf("flushall: %v", err)
+	}
+	return conn
+}
+
+// Raw 直接读写 socket 的连接, 结束时关闭
+func (h *Harness) Raw(t testing.TB) *RawConn {
+	t.Helper()
+	conn, err := dialRaw(h.addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.t = t
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// Each 分别使用 RESP2 和 RESP3 的 go-redis 客户端执行 fn
+func (h *Harness) Each(t *testing.T, fn func(t *testing.T, client *goredis.Client)) {
+	for _, protocol := range Protocols {
+		t.Run(fmt.Sprintf("resp%d", protocol), func(t *testing.T) {
+			fn(t, h.GoRedis(t, protocol))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		client.Set(ctx, "a", "1", 0)
+		client.Set(ctx, "b", "2", 0)
+		client.RPush(ctx, "list", "x")
+		assert.Equal(t, int64(2), client.Exists(ctx, "a", "b", "missing").Val())
+		assert.Equal(t, "string", client.Type(ctx, "a").Val())
+		assert.Equal(t, "list", client.Type(ctx, "list").Val())
+		assert.Equal(t, "none", client.Type(ctx, "missing").Val())
+		assert.ElementsMatch(t, []string{"a", "b"}, client.Keys(ctx, "[ab]").Val())
+		assert.Contains(t, []string{"a", "b", "list"}, client.RandomKey(ctx).Val())
+
+		// 过期时间
+		assert.Equal(t, time.Duration(-1), client.TTL(ctx, "a").Val())
+		assert.Equal(t, time.Duration(-2), client.TTL(ctx, "missing").Val())
+		assert.True(t, client.Expire(ctx, "a", time.Minute).Val())
+		assert.InDelta(t, float64(time.Minute), float64(client.PTTL(ctx, "a").Val()), float64(time.Second))
+		assert.True(t, client.Persist(ctx, "a").Val())
+		assert.False(t, client.Persist(ctx, "a").Val())
+		assert.True(t, client.ExpireAt(ctx, "b", time.Now().Add(time.Hour)).Val())
+		assert.True(t, client.PExpireAt(ctx, "b", time.Now().Add(-time.Second)).Val())
+		assert.Equal(t, goredis.Nil, client.Get(ctx, "b").Err())
+		assert.False(t, client.Expire(ctx, "missing", time.Minute).Val())
+
+		// DUMP/RESTORE
+		dump := client.Dump(ctx, "list").Val()
+		assert.NotEmpty(t, dump)
+		require.NoError(t, client.Restore(ctx, "copy", 0, dump).Err())
+		assert.Equal(t, []string{"x"}, client.LRange(ctx, "copy", 0, -1).Val())
+		assert.EqualError(t, client.Restore(ctx, "copy", 0, dump).Err(), "BUSYKEY Target key name already exists.")
+		assert.EqualError(t, client.Restore(ctx, "bad", 0, "garbage").Err(), "ERR DUMP payload version or checksum are wrong")
+		assert.Equal(t, goredis.Nil, client.Dump(ctx, "missing").Err())
+
+		assert.Equal(t, int64(2), client.Del(ctx, "a", "list", "missing").Val())
+		assert.Equal(t, int64(1), client.Unlink(ctx, "copy").Val())
+		assert.Empty(t, client.Keys(ctx, "*").Val())
+	})
+}
+
+func TestSelect(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		client.Set(ctx, "k", "db0", 0)
+		conn := client.Conn()
+		defer conn.Close()
+		require.NoError(t, conn.Select(ctx, 1).Err())
+		assert.Equal(t, goredis.Nil, conn.Get(ctx, "k").Err())
+		assert.EqualError(t, conn.Select(ctx, 1000).Err(), "ERR DB index is out of range")
+		require.NoError(t, conn.FlushDB(ctx).Err())
+		assert.Equal(t, "db0", client.Get(ctx, "k").Val())
+	})
+}
+
+func TestKeysRedigo(t *testing.T) {
+	conn := h.Redigo(t)
+	_, err := conn.Do("set", "a", "1")
+	require.NoError(t, err)
+	exists, err := redigo.Bool(conn.Do("exists", "a"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	keys, err := redigo.Strings(conn.Do("keys", "*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+	ttl, err := redigo.Int(conn.Do("ttl", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, -1, ttl)
+	dump, err := redigo.Bytes(conn.Do("dump", "a"))
+	require.NoError(t, err)
+	_, err = conn.Do("restore", "b", 0, dump)
+	require.NoError(t, err)
+	value, err := redigo.String(conn.Do("get", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+	deleted, err := redigo.Int(conn.Do("del", "a", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+}
+
+func TestDelPattern(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		for i := 0; i < 3000; i++ {
+			client.Set(ctx, fmt.Sprintf("session:%d", i), "v", 0)
+		}
+		client.Set(ctx, "user:1", "v", 0)
+		// 超过一步检查的个数, 阻塞到定时任务删除完
+		assert.Equal(t, int64(3000), client.Do(ctx, "delpattern", "session:*").Val())
+		assert.Equal(t, []string{"user:1"}, client.Keys(ctx, "*").Val())
+		assert.Equal(t, int64(0), client.Do(ctx, "delpattern", "session:*", "async", "limit", "10").Val())
+		assert.EqualError(t, client.Do(ctx, "delpattern", "*", "limit", "x").Err(), "ERR LIMIT must be a non-negative integer")
+		assert.EqualError(t, client.Do(ctx, "delpattern", "*", "now").Err(), "ERR syntax error")
+	})
+}
@@ -0,0 +1,25 @@
+//go:build integration
+
+package integration
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// h 所有测试共用的 server, 每个客户端创建时清空数据, 测试不能并行执行
+var h *Harness
+
+func TestMain(m *testing.M) {
+	var err error
+	if h, err = Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "start server: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err = h.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "shutdown server: %v\n", err)
+	}
+	os.Exit(code)
+}
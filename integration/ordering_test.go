@@ -0,0 +1,185 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestModifiedKeyOrder 同一个 key 上有阻塞的 BLPOP, WATCH, keyspace 事件的订阅者和 tracking 的客户端,
+// 一次 LPUSH 之后每个观察者看到的顺序
+func TestModifiedKeyOrder(t *testing.T) {
+	writer := h.Raw(t)
+	writer.Do("flushall")
+	require.Equal(t, "OK", writer.Do("config", "set", "notify-keyspace-events", "KEA").Str)
+	defer writer.Do("config", "set", "notify-keyspace-events", "")
+
+	subscriber := h.Raw(t)
+	subscriber.Do("subscribe", "__keyspace@0__:q")
+	tracker := h.Raw(t)
+	tracker.Do("hello", "3")
+	require.Equal(t, "OK", tracker.Do("client", "tracking", "on").Str)
+	assert.True(t, tracker.Do("get", "q").Null)
+	watcher := h.Raw(t)
+	require.Equal(t, "OK", watcher.Do("watch", "q").Str)
+	blocked := h.Raw(t)
+	blocked.Write(0, Command("blpop", "q", "0"))
+	require.Eventually(t, func() bool {
+		return strings.Contains(writer.Do("client", "list").Str, "flags=b ")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, Value{Kind: ':', Int: 1}, writer.Do("lpush", "q", "v"))
+
+	// BLPOP 取走了元素, 之后 key 被删除
+	assert.Equal(t, "*[$q $v]", blocked.Read().String())
+	assert.Equal(t, Value{Kind: ':', Int: 0}, writer.Do("exists", "q"))
+	// 每个生效的操作一个事件: 写入, 弹出, 删除
+	for _, event := range []string{"lpush", "lpop", "del"} {
+		assert.Equal(t, "*[$message $__keyspace@0__:q $"+event+"]", subscriber.Read().String())
+	}
+	// 只收到一次失效消息
+	assert.Equal(t, ">[$invalidate *[$q]]", tracker.Read().String())
+	assert.Equal(t, "+PONG", tracker.Do("ping").String())
+	// WATCH 的事务失败
+	watcher.Do("multi")
+	watcher.Do("get", "q")
+	assert.True(t, watcher.Do("exec").Null)
+}
+
+// TestPushFloodPipeline 一个 RESP3 客户端订阅频道并打开 tracking, 一边 pipeline 发送命令一边接收其他客户端 PUBLISH 的大量消息和失效消息.
+// 每一帧都能完整解析, 回复按照命令的顺序, 推送只出现在两个回复之间, 每个发布者的消息按照发布的顺序到达
+func TestPushFloodPipeline(t *testing.T) {
+	const (
+		publishers = 4
+		messages   = 2000
+		batches    = 200
+		bigLen     = 300
+	)
+	setup := h.Raw(t)
+	setup.Do("flushall")
+	// 超过 16KB 的 LRANGE 是流式回复, 期间的推送排在回复之后
+	big := strings.Repeat("x", 100)
+	rpush := []string{"rpush", "big"}
+	for i := 0; i < bigLen; i++ {
+		rpush = append(rpush, big)
+	}
+	require.Equal(t, int64(bigLen), setup.Do(rpush...).Int)
+
+	client := h.Raw(t)
+	client.Do("hello", "3")
+	require.Equal(t, ">[$subscribe $flood 1]", client.Do("subscribe", "flood").String())
+	require.Equal(t, "+OK", client.Do("client", "tracking", "on").String())
+
+	// 每个批次的命令和期望的回复
+	var expected []func(v Value) bool
+	pipeline := &bytes.Buffer{}
+	for b := 0; b < batches; b++ {
+		counter := int64(b + 1)
+		echo := "batch:" + strconv.Itoa(b)
+		pipeline.Write(Command("incr", "counter"))
+		pipeline.Write(Command("get", "tracked"))
+		pipeline.Write(Command("echo", echo))
+		expected = append(expected,
+			func(v Value) bool { return v.Kind == ':' && v.Int == counter },
+			func(v Value) bool { return v.Kind == '$' || v.Kind == '_' },
+			func(v Value) bool { return v.Kind == '$' && v.Str == echo },
+		)
+		if b%20 == 0 {
+			pipeline.Write(Command("lrange", "big", "0", "-1"))
+			expected = append(expected, func(v Value) bool {
+				if v.Kind != '*' || len(v.Elems) != bigLen {
+					return false
+				}
+				for _, elem := range v.Elems {
+					if elem.Str != big {
+						return false
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	ctx := context.Background()
+	errs := make(chan error, publishers+1)
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			publisher := goredis.NewClient(&goredis.Options{Addr: h.Addr(), MaxRetries: -1})
+			defer publisher.Close()
+			for i := 0; i < messages; i += 100 {
+				pipe := publisher.Pipeline()
+				for j := i; j < i+100; j++ {
+					pipe.Publish(ctx, "flood", fmt.Sprintf("%d:%d", p, j))
+					// 修改 tracking 的 key, 产生失效消息
+					if j%50 == 0 {
+						pipe.Set(ctx, "tracked", j, 0)
+					}
+				}
+				if _, err := pipe.Exec(ctx); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// 分成很多次写入, 与消息交替到达
+		for _, chunk := range Fragments(pipeline.Bytes(), 512) {
+			if _, err := client.conn.Write(chunk); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	replies, received, invalidations := 0, 0, 0
+	next := make([]int, publishers)
+	for replies < len(expected) || received < publishers*messages {
+		v := client.Read()
+		if v.Kind != '>' {
+			require.Less(t, replies, len(expected), "unexpected reply %s", v)
+			require.True(t, expected[replies](v), "reply %d is %s", replies, v)
+			replies++
+			continue
+		}
+		require.NotEmpty(t, v.Elems, "empty push")
+		switch v.Elems[0].Str {
+		case "message":
+			require.Len(t, v.Elems, 3)
+			require.Equal(t, "flood", v.Elems[1].Str)
+			var p, j int
+			_, err := fmt.Sscanf(v.Elems[2].Str, "%d:%d", &p, &j)
+			require.NoError(t, err, "payload %q", v.Elems[2].Str)
+			require.Equal(t, next[p], j, "publisher %d out of order", p)
+			next[p]++
+			received++
+		case "invalidate":
+			invalidations++
+		default:
+			t.Fatalf("unexpected push %s", v)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	t.Logf("%d replies, %d messages, %d invalidations", replies, received, invalidations)
+	assert.Equal(t, "+PONG", client.Do("ping").String())
+}
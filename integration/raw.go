@@ -0,0 +1,184 @@
+//go:build integration
+
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Value 解析之后的 RESP2/RESP3 回复
+type Value struct {
+	// Kind 类型的前缀: + - : $ * _ , # ( = % ~ >
+	Kind byte
+	// Str 状态, 错误, bulk, double, big number 和 verbatim 的内容
+	Str string
+	Int int64
+	// Null $-1, *-1 和 _
+	Null bool
+	// Elems 数组, set, push 的元素; map 是按顺序排列的 key 和 value
+	Elems []Value
+}
+
+// String 便于在断言失败时阅读
+func (v Value) String() string {
+	switch {
+	case v.Null:
+		return "(nil)"
+	case v.Kind == ':':
+		return strconv.FormatInt(v.Int, 10)
+	case len(v.Elems) > 0 || v.Kind == '*' || v.Kind == '%' || v.Kind == '~' || v.Kind == '>':
+		parts := make([]string, 0, len(v.Elems))
+		for _, elem := range v.Elems {
+			parts = append(parts, elem.String())
+		}
+		return string(v.Kind) + "[" + strings.Join(parts, " ") + "]"
+	}
+	return string(v.Kind) + v.Str
+}
+
+// Command 把命令编码为 multi bulk
+func Command(args ...string) []byte {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return buf
+}
+
+// Fragments 把 data 拆成最多 size 个字节的片段, 用于模拟 TCP 中拆开的命令
+func Fragments(data []byte, size int) [][]byte {
+	chunks := make([][]byte, 0, len(data)/size+1)
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return append(chunks, data)
+}
+
+// RawConn 直接读写 socket, 用来发送客户端库不会产生的数据
+type RawConn struct {
+	t      testing.TB
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialRaw(addr string) (*RawConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &RawConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Write 每个片段单独写入, 片段之间等待 pause, 服务端会分多次读到
+func (c *RawConn) Write(pause time.Duration, chunks ...[]byte) {
+	c.t.Helper()
+	for i, chunk := range chunks {
+		if i > 0 && pause > 0 {
+			time.Sleep(pause)
+		}
+		if _, err := c.conn.Write(chunk); err != nil {
+			c.t.Fatalf("write: %v", err)
+		}
+	}
+}
+
+// Read 读取一个回复
+func (c *RawConn) Read() Value {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	value, err := readValue(c.reader)
+	if err != nil {
+		c.t.Fatalf("read reply: %v", err)
+	}
+	return value
+}
+
+// Do 发送一条命令并读取回复
+func (c *RawConn) Do(args ...string) Value {
+	c.t.Helper()
+	c.Write(0, Command(args...))
+	return c.Read()
+}
+
+// Close 关闭连接
+func (c *RawConn) Close() error {
+	return c.conn.Close()
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("line without CRLF: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readValue(reader *bufio.Reader) (Value, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return Value{}, err
+	}
+	if line == "" {
+		return Value{}, fmt.Errorf("empty line")
+	}
+	value := Value{Kind: line[0]}
+	body := line[1:]
+	switch value.Kind {
+	case '+', '-', ',', '#', '(':
+		value.Str = body
+	case '_':
+		value.Null = true
+	case ':':
+		if value.Int, err = strconv.ParseInt(body, 10, 64); err != nil {
+			return Value{}, err
+		}
+	case '$', '=', '!':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			value.Null = true
+			return value, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			return Value{}, err
+		}
+		value.Str = string(buf[:n])
+	case '*', '~', '>', '%':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			value.Null = true
+			return value, nil
+		}
+		if value.Kind == '%' {
+			n *= 2
+		}
+		value.Elems = make([]Value, 0, n)
+		for i := 0; i < n; i++ {
+			elem, err := readValue(reader)
+			if err != nil {
+				return Value{}, err
+			}
+			value.Elems = append(value.Elems, elem)
+		}
+	default:
+		return Value{}, fmt.Errorf("unknown reply type %q", line)
+	}
+	return value, nil
+}
@@ -0,0 +1,98 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pause 片段之间的等待, 让服务端分多次读到
+const pause = 5 * time.Millisecond
+
+func TestRawPipeline(t *testing.T) {
+	conn := h.Raw(t)
+	conn.Do("flushall")
+	// 一次写入多条命令, 按顺序回复
+	var pipeline []byte
+	for i := 0; i < 100; i++ {
+		pipeline = append(pipeline, Command("rpush", "list", strconv.Itoa(i))...)
+	}
+	pipeline = append(pipeline, Command("llen", "list")...)
+	conn.Write(0, pipeline)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, Value{Kind: ':', Int: int64(i + 1)}, conn.Read())
+	}
+	assert.Equal(t, Value{Kind: ':', Int: 100}, conn.Read())
+}
+
+func TestRawFragmented(t *testing.T) {
+	conn := h.Raw(t)
+	conn.Do("flushall")
+	value := strings.Repeat("0123456789", 1000)
+	data := append(Command("set", "big", value), Command("get", "big")...)
+
+	// 在每一个位置拆开: 类型前缀, 长度, CRLF 和 bulk 的中间
+	for _, size := range []int{1, 2, 3, 7, 64, 4093} {
+		chunks := Fragments(data, size)
+		if len(chunks) > 200 {
+			// 只把开头拆得很碎, 剩下的一次写入
+			chunks = append(chunks[:200], bytes.Join(chunks[200:], nil))
+		}
+		conn.Write(pause/5, chunks...)
+		assert.Equal(t, Value{Kind: '+', Str: "OK"}, conn.Read(), size)
+		assert.Equal(t, Value{Kind: '$', Str: value}, conn.Read(), size)
+	}
+
+	// bulk 的内容在 CRLF 之前拆开, 内容中有 CRLF
+	binary := "a\r\nb\r\n"
+	cmd := Command("set", "crlf", binary)
+	split := bytes.Index(cmd, []byte("a\r\n")) + 2
+	conn.Write(pause, cmd[:split], cmd[split:])
+	assert.Equal(t, Value{Kind: '+', Str: "OK"}, conn.Read())
+	assert.Equal(t, Value{Kind: '$', Str: binary}, conn.Do("get", "crlf"))
+}
+
+func TestRawInline(t *testing.T) {
+	conn := h.Raw(t)
+	// telnet 发送的 inline 命令, 还不支持参数, 整行是命令的名字
+	conn.Write(pause, []byte("PI"), []byte("NG\r\n"))
+	assert.Equal(t, Value{Kind: '+', Str: "PONG"}, conn.Read())
+	conn.Write(0, []byte("PING\r\nPING\r\n"))
+	assert.Equal(t, Value{Kind: '+', Str: "PONG"}, conn.Read())
+	assert.Equal(t, Value{Kind: '+', Str: "PONG"}, conn.Read())
+}
+
+func TestRawResp3(t *testing.T) {
+	conn := h.Raw(t)
+	conn.Do("flushall")
+	hello := conn.Do("hello", "3")
+	assert.Equal(t, byte('%'), hello.Kind, hello.String())
+	conn.Do("hset", "hash", "f", "v")
+	assert.Equal(t, Value{Kind: '%', Elems: []Value{{Kind: '$', Str: "f"}, {Kind: '$', Str: "v"}}}, conn.Do("hgetall", "hash"))
+	conn.Do("sadd", "set", "m")
+	assert.Equal(t, Value{Kind: '~', Elems: []Value{{Kind: '$', Str: "m"}}}, conn.Do("smembers", "set"))
+	assert.Equal(t, Value{Kind: '_', Null: true}, conn.Do("get", "missing"))
+	info := conn.Do("info", "server")
+	assert.Equal(t, byte('='), info.Kind)
+	assert.True(t, strings.HasPrefix(info.Str, "txt:# Server"), info.Str)
+}
+
+func TestRawProtocolErrors(t *testing.T) {
+	// 错误的长度, 回复错误之后关闭连接
+	conn := h.Raw(t)
+	conn.Write(0, []byte("*1\r\n$x\r\n"))
+	reply := conn.Read()
+	assert.Equal(t, byte('-'), reply.Kind)
+	assert.True(t, strings.HasPrefix(reply.Str, "ERR Protocol error"), reply.Str)
+
+	// 错误的命令不影响之后的命令
+	conn = h.Raw(t)
+	assert.Equal(t, byte('-'), conn.Do("nosuchcommand").Kind)
+	assert.Equal(t, Value{Kind: '+', Str: "PONG"}, conn.Do("ping"))
+}
@@ -0,0 +1,75 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const library = "#!lua name=harness\n" +
+	"redis.register_function('setget', function(keys, args) redis.call('set', keys[1], args[1]) return redis.call('get', keys[1]) end)\n" +
+	"redis.register_function{function_name='readkey', callback=function(keys) return redis.call('get', keys[1]) end, flags={'no-writes'}}\n"
+
+func TestEval(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		result, err := client.Eval(ctx, "return {KEYS[1], ARGV[1], 3, {4}}", []string{"k"}, "v").Result()
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"k", "v", int64(3), []interface{}{int64(4)}}, result)
+		assert.Equal(t, "FINE", client.Eval(ctx, "return redis.status_reply('FINE')", nil).Val())
+		assert.Equal(t, goredis.Nil, client.Eval(ctx, "return nil", nil).Err())
+		assert.EqualError(t, client.Eval(ctx, "return redis.error_reply('My Error')", nil).Err(), "My Error")
+
+		script := goredis.NewScript("return redis.call('incrby', KEYS[1], ARGV[1])")
+		// 第一次 EVALSHA 回复 NOSCRIPT, go-redis 改用 EVAL
+		assert.Equal(t, int64(5), script.Run(ctx, client, []string{"counter"}, 5).Val())
+		assert.Equal(t, []bool{true}, client.ScriptExists(ctx, script.Hash()).Val())
+		assert.Equal(t, int64(10), client.EvalSha(ctx, script.Hash(), []string{"counter"}, 5).Val())
+		require.NoError(t, client.ScriptFlush(ctx).Err())
+		assert.EqualError(t, client.EvalSha(ctx, script.Hash(), []string{"counter"}, 5).Err(),
+			"NOSCRIPT No matching script. Please use EVAL.")
+
+		client.Set(ctx, "str", "v", 0)
+		err = client.Eval(ctx, "return redis.call('incr', KEYS[1])", []string{"str"}).Err()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ERR value is not an integer or out of range")
+	})
+}
+
+func TestFunctions(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		require.NoError(t, client.FunctionFlush(ctx).Err())
+		assert.Equal(t, "harness", client.FunctionLoad(ctx, library).Val())
+		assert.Equal(t, "v", client.FCall(ctx, "setget", []string{"k"}, "v").Val())
+		assert.Equal(t, "v", client.FCallRO(ctx, "readkey", []string{"k"}).Val())
+		err := client.FCallRO(ctx, "setget", []string{"k"}, "w").Err()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ERR Can not execute a script with write flag using *_ro command.")
+		err = client.FunctionLoad(ctx, library).Err()
+		assert.EqualError(t, err, "ERR Library 'harness' already exists")
+		libraries, err := client.FunctionList(ctx, goredis.FunctionListQuery{}).Result()
+		require.NoError(t, err)
+		require.Len(t, libraries, 1)
+		assert.Equal(t, "harness", libraries[0].Name)
+		assert.Len(t, libraries[0].Functions, 2)
+		require.NoError(t, client.FunctionDelete(ctx, "harness").Err())
+	})
+}
+
+func TestScriptingRedigo(t *testing.T) {
+	conn := h.Redigo(t)
+	script := redigo.NewScript(1, "return redis.call('set', KEYS[1], ARGV[1])")
+	reply, err := script.Do(conn, "k", "v")
+	require.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+	values, err := redigo.Values(conn.Do("eval", "return {1, 'two', {3}}", 0))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(1), []byte("two"), []interface{}{int64(3)}}, values)
+}
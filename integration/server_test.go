@@ -0,0 +1,174 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		assert.Equal(t, "PONG", client.Ping(ctx).Val())
+		assert.Equal(t, "hello", client.Echo(ctx, "hello").Val())
+		assert.Equal(t, "hello", client.Do(ctx, "ping", "hello").Val())
+
+		conn := client.Conn()
+		defer conn.Close()
+		require.NoError(t, conn.ClientSetName(ctx, "harness").Err())
+		assert.Equal(t, "harness", conn.ClientGetName(ctx).Val())
+		assert.Positive(t, conn.ClientID(ctx).Val())
+		assert.Contains(t, conn.ClientList(ctx).Val(), "name=harness")
+
+		hello, err := client.Do(ctx, "hello").Result()
+		require.NoError(t, err)
+		// RESP3 中是 map, RESP2 中是数组
+		switch reply := hello.(type) {
+		case map[interface{}]interface{}:
+			assert.Equal(t, "redis", reply["server"])
+		case []interface{}:
+			assert.Equal(t, "server", reply[0])
+		default:
+			t.Fatalf("unexpected HELLO reply %T", hello)
+		}
+		assert.EqualError(t, client.Do(ctx, "hello", "4").Err(), "NOPROTO unsupported protocol version")
+	})
+}
+
+func TestClientSetInfo(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		// go-redis 连接之后发送 CLIENT SETINFO, lib-name 是 go-redis(后缀,go版本)
+		conn := client.Conn()
+		defer conn.Close()
+		info, err := conn.ClientInfo(ctx).Result()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(info.LibName, "go-redis("), info.LibName)
+		assert.Equal(t, goredis.Version(), info.LibVer)
+		list := conn.ClientList(ctx).Val()
+		assert.Contains(t, list, " lib-name="+info.LibName+" lib-ver="+goredis.Version())
+
+		clients := client.Info(ctx, "clients").Val()
+		assert.Regexp(t, `client_libs:go-redis=\d+\r\n`, clients)
+
+		reset := goredis.NewStatusCmd(ctx, "reset")
+		require.NoError(t, conn.Process(ctx, reset))
+		assert.Equal(t, "RESET", reset.Val())
+		info, err = conn.ClientInfo(ctx).Result()
+		require.NoError(t, err)
+		assert.Empty(t, info.LibName)
+		assert.Empty(t, info.LibVer)
+		setInfo := goredis.NewStatusCmd(ctx, "client", "setinfo", "lib-name", "has space")
+		assert.EqualError(t, conn.Process(ctx, setInfo), "ERR lib-name cannot contain spaces, newlines or special characters.")
+	})
+}
+
+func TestReadonlyReadwrite(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		// 集群的客户端无条件发送 READONLY, 主节点上只记录连接的标记
+		conn := client.Conn()
+		defer conn.Close()
+		require.NoError(t, conn.ReadOnly(ctx).Err())
+		info, err := conn.ClientInfo(ctx).Result()
+		require.NoError(t, err)
+		assert.NotZero(t, info.Flags&goredis.ClientReadOnly)
+		require.NoError(t, conn.Set(ctx, "readonly", "v", 0).Err())
+		assert.Equal(t, "v", conn.Get(ctx, "readonly").Val())
+		require.NoError(t, conn.ReadWrite(ctx).Err())
+		info, err = conn.ClientInfo(ctx).Result()
+		require.NoError(t, err)
+		assert.Zero(t, info.Flags&goredis.ClientReadOnly)
+	})
+}
+
+func TestServerCommands(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		info := client.Info(ctx, "server").Val()
+		assert.True(t, strings.HasPrefix(info, "# Server\r\n"), info)
+		assert.Contains(t, info, "redis_version:")
+		assert.Contains(t, client.Info(ctx, "persistence").Val(), "loading:0\r\n")
+
+		assert.Equal(t, map[string]string{"maxmemory-policy": "noeviction"},
+			client.ConfigGet(ctx, "maxmemory-policy").Val())
+		require.NoError(t, client.ConfigSet(ctx, "maxmemory-policy", "allkeys-lru").Err())
+		assert.Equal(t, "allkeys-lru", client.ConfigGet(ctx, "maxmemory-policy").Val()["maxmemory-policy"])
+		require.NoError(t, client.ConfigSet(ctx, "maxmemory-policy", "noeviction").Err())
+		assert.EqualError(t, client.ConfigSet(ctx, "no-such-option", "1").Err(),
+			"ERR Unknown option or number of arguments for CONFIG SET - 'no-such-option'")
+
+		assert.Positive(t, client.LastSave(ctx).Val())
+		assert.Positive(t, client.Do(ctx, "command", "count").Val())
+		keys, err := client.CommandGetKeys(ctx, "set", "k", "v").Result()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"k"}, keys)
+		commands, err := client.Command(ctx).Result()
+		require.NoError(t, err)
+		assert.Equal(t, int8(-3), commands["set"].Arity)
+		assert.Equal(t, int8(1), commands["get"].FirstKeyPos)
+
+		client.Set(ctx, "k", "12345", 0)
+		assert.Equal(t, time.Duration(0), client.ObjectIdleTime(ctx, "k").Val())
+		assert.Positive(t, client.MemoryUsage(ctx, "k").Val())
+
+		err = client.Do(ctx, "nosuchcommand", "arg").Err()
+		assert.EqualError(t, err, "ERR unknown command 'nosuchcommand', with args beginning with: 'arg'")
+		assert.EqualError(t, client.Do(ctx, "config", "foo").Err(), "ERR unknown subcommand 'foo'. Try CONFIG HELP.")
+	})
+}
+
+func TestPubSub(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		sub := client.Subscribe(ctx, "news")
+		defer sub.Close()
+		_, err := sub.Receive(ctx)
+		require.NoError(t, err)
+		require.NoError(t, sub.PSubscribe(ctx, "ne*"))
+		_, err = sub.Receive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), client.Publish(ctx, "news", "hello").Val())
+		assert.Equal(t, []string{"news"}, client.PubSubChannels(ctx, "*").Val())
+		assert.Equal(t, map[string]int64{"news": 1}, client.PubSubNumSub(ctx, "news").Val())
+		assert.Equal(t, int64(1), client.PubSubNumPat(ctx).Val())
+
+		received := map[string]string{}
+		for i := 0; i < 2; i++ {
+			msg, err := sub.ReceiveTimeout(ctx, 5*time.Second)
+			require.NoError(t, err)
+			message := msg.(*goredis.Message)
+			received[message.Pattern] = message.Payload
+		}
+		assert.Equal(t, map[string]string{"": "hello", "ne*": "hello"}, received)
+	})
+}
+
+func TestPubSubRedigo(t *testing.T) {
+	conn := h.Redigo(t)
+	sub := redigo.PubSubConn{Conn: h.Redigo(t)}
+	require.NoError(t, sub.Subscribe("news"))
+	subscribed, ok := sub.Receive().(redigo.Subscription)
+	require.True(t, ok)
+	assert.Equal(t, redigo.Subscription{Kind: "subscribe", Channel: "news", Count: 1}, subscribed)
+	receivers, err := redigo.Int(conn.Do("publish", "news", "hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, receivers)
+	message, ok := sub.Receive().(redigo.Message)
+	require.True(t, ok)
+	assert.Equal(t, "hello", string(message.Data))
+	// 订阅模式下的 PING
+	require.NoError(t, sub.Ping("hi"))
+	pong, ok := sub.Receive().(redigo.Pong)
+	require.True(t, ok)
+	assert.Equal(t, "hi", pong.Data)
+	require.NoError(t, sub.Unsubscribe())
+}
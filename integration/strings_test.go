@@ -0,0 +1,102 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrings(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		require.NoError(t, client.Set(ctx, "foo", "bar", 0).Err())
+		assert.Equal(t, "bar", client.Get(ctx, "foo").Val())
+		assert.Equal(t, goredis.Nil, client.Get(ctx, "missing").Err())
+		assert.Equal(t, int64(3), client.StrLen(ctx, "foo").Val())
+		assert.Equal(t, int64(6), client.Append(ctx, "foo", "baz").Val())
+		assert.Equal(t, "arb", client.GetRange(ctx, "foo", 1, 3).Val())
+		assert.Equal(t, int64(6), client.SetRange(ctx, "foo", 3, "BAZ").Val())
+		assert.Equal(t, "barBAZ", client.GetSet(ctx, "foo", "new").Val())
+		assert.Equal(t, "new", client.GetDel(ctx, "foo").Val())
+		assert.True(t, client.SetNX(ctx, "nx", "1", 0).Val())
+		assert.False(t, client.SetNX(ctx, "nx", "2", 0).Val())
+
+		require.NoError(t, client.MSet(ctx, "a", "1", "b", "2").Err())
+		assert.Equal(t, []interface{}{"1", "2", nil}, client.MGet(ctx, "a", "b", "c").Val())
+
+		assert.Equal(t, int64(2), client.Incr(ctx, "a").Val())
+		assert.Equal(t, int64(12), client.IncrBy(ctx, "a", 10).Val())
+		assert.Equal(t, int64(11), client.Decr(ctx, "a").Val())
+		assert.Equal(t, int64(1), client.DecrBy(ctx, "a", 10).Val())
+		assert.Equal(t, 3.5, client.IncrByFloat(ctx, "a", 2.5).Val())
+
+		// SET 的选项
+		assert.Equal(t, "OK", client.SetArgs(ctx, "opt", "v", goredis.SetArgs{Mode: "NX", TTL: time.Minute}).Val())
+		assert.Equal(t, goredis.Nil, client.SetArgs(ctx, "opt", "v", goredis.SetArgs{Mode: "NX"}).Err())
+		assert.Equal(t, "OK", client.SetArgs(ctx, "opt", "w", goredis.SetArgs{Mode: "XX", KeepTTL: true}).Val())
+		assert.True(t, client.TTL(ctx, "opt").Val() > 0)
+
+		// GETEX 读取的同时设置或者移除过期时间
+		assert.Equal(t, "w", client.GetEx(ctx, "opt", 0).Val())
+		assert.Equal(t, time.Duration(-1), client.TTL(ctx, "opt").Val())
+		assert.Equal(t, "w", client.GetEx(ctx, "opt", time.Hour).Val())
+		assert.Equal(t, time.Hour, client.TTL(ctx, "opt").Val())
+		assert.Equal(t, "w", client.Do(ctx, "getex", "opt").Val())
+		assert.Equal(t, goredis.Nil, client.GetEx(ctx, "missing", time.Hour).Err())
+	})
+}
+
+func TestStringErrors(t *testing.T) {
+	ctx := context.Background()
+	h.Each(t, func(t *testing.T, client *goredis.Client) {
+		client.Set(ctx, "str", "abc", 0)
+		client.RPush(ctx, "list", "a")
+		assert.EqualError(t, client.Incr(ctx, "str").Err(), "ERR value is not an integer or out of range")
+		assert.EqualError(t, client.IncrByFloat(ctx, "str", 1).Err(), "ERR value is not a valid float")
+		assert.EqualError(t, client.Get(ctx, "list").Err(),
+			"WRONGTYPE Operation against a key holding the wrong kind of value")
+		client.Set(ctx, "max", "9223372036854775807", 0)
+		assert.EqualError(t, client.Incr(ctx, "max").Err(), "ERR increment or decrement would overflow")
+		assert.EqualError(t, client.Do(ctx, "set", "k").Err(), "ERR wrong number of arguments for 'set' command")
+		assert.EqualError(t, client.Do(ctx, "set", "k", "v", "xx", "nx").Err(), "ERR syntax error")
+		assert.EqualError(t, client.SetRange(ctx, "str", -1, "x").Err(), "ERR offset is out of range")
+	})
+}
+
+func TestStringsRedigo(t *testing.T) {
+	conn := h.Redigo(t)
+	reply, err := conn.Do("set", "foo", "bar")
+	require.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+	value, err := redigo.String(conn.Do("get", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "bar", value)
+	_, err = redigo.String(conn.Do("get", "missing"))
+	assert.Equal(t, redigo.ErrNil, err)
+	n, err := redigo.Int64(conn.Do("incrby", "counter", 5))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	f, err := redigo.Float64(conn.Do("incrbyfloat", "counter", "0.5"))
+	require.NoError(t, err)
+	assert.Equal(t, 5.5, f)
+	values, err := redigo.Values(conn.Do("mget", "foo", "missing"))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{[]byte("bar"), nil}, values)
+	// 二进制安全
+	binary := string([]byte{0, '\r', '\n', 0xff})
+	_, err = conn.Do("set", "binary", binary)
+	require.NoError(t, err)
+	value, err = redigo.String(conn.Do("get", "binary"))
+	require.NoError(t, err)
+	assert.Equal(t, binary, value)
+
+	_, err = conn.Do("incr", "foo")
+	assert.EqualError(t, err, "ERR value is not an integer or out of range")
+}
@@ -1,62 +1,116 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/xuning888/godis-tiny/config"
 	"github.com/xuning888/godis-tiny/pkg/logger"
-	"github.com/xuning888/godis-tiny/pkg/util"
-	"github.com/xuning888/godis-tiny/redis"
+	"github.com/xuning888/godis-tiny/server"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var serverName = "godis-tiny"
 
-var defaultConfig = &config.ServerProperties{
-	Bind:           "0.0.0.0",
-	Port:           6389,
-	AppendOnly:     false,
-	AppendFilename: "",
-	RunID:          util.RandStr(40),
-}
-
 func fileExists(filename string) bool {
 	stat, err := os.Stat(filename)
 	return err == nil && !stat.IsDir()
 }
 
-func setupConfiguration(configPath string) {
+// configOptions 配置文件存在时从文件加载, 否则使用默认配置, overrides 在配置文件之后生效
+func configOptions(configPath string, required bool, overrides []string) []server.Option {
 	if fileExists(configPath) {
-		config.SetUpConfig(configPath)
 		logger.Infof("Loaded configuration from %s", configPath)
-	} else {
-		logger.Infof("Config file '%s' not found. Using default settings.", configPath)
-		config.Properties = defaultConfig
+		return []server.Option{server.WithConfigFile(configPath, overrides...)}
+	}
+	if required {
+		logger.Fatalf("Can't open config file '%s'", configPath)
 	}
+	logger.Infof("Config file '%s' not found. Using default settings.", configPath)
+	if len(overrides) == 0 {
+		return nil
+	}
+	return []server.Option{server.WithConfigLines(overrides...)}
+}
+
+// parseArgs 与 redis-server 一样, --name value [value ...] 转换为配置文件中的一行, 参数一直到下一个 -- 开头的参数为止
+func parseArgs(args []string) (configPath string, required bool, overrides []string, err error) {
+	configPath = "redis.conf"
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--config":
+			if i+1 >= len(args) {
+				return "", false, nil, fmt.Errorf("--config requires a file path")
+			}
+			i++
+			configPath, required = args[i], true
+		case strings.HasPrefix(arg, "--") && len(arg) > 2:
+			line := arg[2:]
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				line += " " + config.QuoteArg(args[i])
+			}
+			overrides = append(overrides, line)
+		case i == 0:
+			configPath = arg
+		default:
+			return "", false, nil, fmt.Errorf("unexpected argument '%s'", arg)
+		}
+	}
+	return configPath, required, overrides, nil
 }
 
 func printHelp() {
-	helpText := `Usage: ./` + serverName + ` [/path/to/redis.conf] [options] [-]
+	helpText := `Usage: ./` + serverName + ` [/path/to/redis.conf] [options]
+       ./` + serverName + ` --config /path/to/redis.conf [options]
        ./` + serverName + ` -h or --help
+
+Examples:
+       ./` + serverName + ` (run the server with redis.conf in the working directory if it exists)
+       ./` + serverName + ` --port 7777
+       ./` + serverName + ` /etc/redis/6379.conf --loglevel verbose
+       ./` + serverName + ` --config /etc/redis/6379.conf --save 900 1 --save 300 10
 `
 	fmt.Print(helpText)
 }
 
 func main() {
 	logger.InitLogger()
-	args := os.Args[1:]
-	if len(args) > 0 {
-		for _, arg := range args {
-			switch arg {
-			case "-h", "--help":
-				printHelp()
-				return
-			default:
-				setupConfiguration(arg)
-			}
+	for _, arg := range os.Args[1:] {
+		if arg == "-h" || arg == "--help" {
+			printHelp()
+			return
 		}
-	} else {
-		setupConfiguration("redis.conf")
 	}
-	s := redis.NewRedisServer()
-	s.Spin()
+	configPath, required, overrides, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printHelp()
+		os.Exit(1)
+	}
+	s, err := server.New(configOptions(configPath, required, overrides)...)
+	if err != nil {
+		logger.Fatalf("Failed creating server: %v", err)
+	}
+	// 收到信号之后和 SHUTDOWN 一样优雅关闭
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
+	if err := s.Start(context.Background()); err != nil {
+		logger.Fatalf("Failed starting server: %v", err)
+	}
+	select {
+	case sig := <-signals:
+		logger.Infof("Received %s scheduling shutdown...", sig)
+	case <-s.Done():
+		return
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Shutdown failed %v", err)
+	}
 }
@@ -0,0 +1,53 @@
+// Package clock 当前时间的来源. 过期时间, LRU/LFU 的访问时间都从 Clock 读取,
+// 测试中用 Manual 控制时间, 不需要 time.Sleep 等待 key 过期
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 返回当前时间
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Real 系统时钟, 没有指定 Clock 时使用
+var Real Clock = realClock{}
+
+// Manual 手动控制的时钟, 只有调用 Advance 或者 Set 时时间才会变化, 可以在多个协程中使用
+type Manual struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+// NewManual 返回从 now 开始的时钟
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.now
+}
+
+// Advance 时间前进 d
+func (m *Manual) Advance(d time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.now = m.now.Add(d)
+}
+
+// Set 把时间设置为 now, 可以向后调整
+func (m *Manual) Set(now time.Time) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.now = now
+}
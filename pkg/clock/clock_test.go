@@ -0,0 +1,24 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManual(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := NewManual(start)
+	assert.Equal(t, start, c.Now())
+	c.Advance(1500 * time.Millisecond)
+	assert.Equal(t, start.Add(1500*time.Millisecond), c.Now())
+	c.Set(start)
+	assert.Equal(t, start, c.Now())
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	now := Real.Now()
+	assert.False(t, now.Before(before))
+}
@@ -0,0 +1,56 @@
+package cluster
+
+// Slots redis cluster 的哈希槽的个数
+const Slots = 16384
+
+// redis 使用的 crc16 (XMODEM, 多项式 0x1021, 初始值为0, 输入输出不反转)
+const crc16Poly = 0x1021
+
+var crc16Table = func() *[256]uint16 {
+	table := &[256]uint16{}
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ crc16Poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// KeyHashSlot key 所在的哈希槽, 与 redis cluster.c 中的 keyHashSlot 一致:
+// key 中有 {...} 并且括号中不为空时只计算第一对括号中的部分, 同一个 hash tag 的 key 在同一个槽中
+func KeyHashSlot(key []byte) int {
+	return int(crc16(hashTag(key)) & (Slots - 1))
+}
+
+// hashTag 第一个 { 和它之后第一个 } 之间的部分, 没有或者为空时是整个 key
+func hashTag(key []byte) []byte {
+	for i := 0; i < len(key); i++ {
+		if key[i] != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j == i+1 {
+					return key
+				}
+				return key[i+1 : j]
+			}
+		}
+		return key
+	}
+	return key
+}
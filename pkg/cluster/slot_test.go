@@ -0,0 +1,38 @@
+package cluster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCrc16(t *testing.T) {
+	// redis crc16.c 中的测试向量
+	assert.Equal(t, uint16(0x31c3), crc16([]byte("123456789")))
+	assert.Equal(t, uint16(0), crc16(nil))
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	cases := []struct {
+		key  string
+		slot int
+	}{
+		// redis 文档中 CLUSTER KEYSLOT 的例子
+		{"somekey", 11058},
+		{"foo{hash_tag}", 2515},
+		{"hash_tag", 2515},
+		{"foo", 12182},
+		{"", 0},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.slot, KeyHashSlot([]byte(c.key)), c.key)
+	}
+	// 只有第一对括号中的部分参与计算
+	assert.Equal(t, KeyHashSlot([]byte("user1000")), KeyHashSlot([]byte("{user1000}.following")))
+	assert.Equal(t, KeyHashSlot([]byte("user1000")), KeyHashSlot([]byte("{user1000}.followers{x}")))
+	// 空的 {} 或者没有 } 时计算整个 key
+	assert.Equal(t, int(crc16([]byte("foo{}{bar}"))&(Slots-1)), KeyHashSlot([]byte("foo{}{bar}")))
+	assert.Equal(t, int(crc16([]byte("foo{bar"))&(Slots-1)), KeyHashSlot([]byte("foo{bar")))
+	// redis 文档中 hash tag 的例子
+	assert.Equal(t, KeyHashSlot([]byte("bar")), KeyHashSlot([]byte("foo{bar}{zap}")))
+	assert.Equal(t, int(crc16([]byte("{bar"))&(Slots-1)), KeyHashSlot([]byte("foo{{bar}}zap")))
+}
@@ -1,7 +1,24 @@
 package dict
 
+import (
+	"fmt"
+	"sort"
+)
+
 type Consumer func(key string, val interface{}) bool
 
+// Dict db 和哈希表, 集合使用的 key-value 存储. 所有的方法都在持有 server 的全局锁时调用, 实现不需要考虑并发.
+// 实现需要满足:
+//   - Get 返回的值可以被调用方原地修改(比如列表的 push), 之后的 Get 和 ForEach 看到修改之后的值
+//   - Put 返回新增的 key 的个数(覆盖已有的 key 返回0), PutIfAbsent, PutIfExists 和 Remove 返回修改的 key 的个数
+//   - ForEach 的 consumer 返回 false 时停止; consumer 中可以 Remove 当前的 key, 其他的修改不保证能被这次遍历看到
+//   - RandomKeys 返回 limit 个 key, 可能重复, 只在 Len 大于0时调用. 用于淘汰和过期的抽样, 要快, 不要求均匀
+//   - RandomKeysWithReplacement 均匀地返回 n 个 key, 可能重复, Len 为0时返回空. 用于 SRANDMEMBER 的负数 count, 见 SampleWithReplacement
+//   - RandomDistinctKeys 返回 min(limit, Len) 个不重复的 key
+//   - Clear 之后 Len 为0, 之前返回的值不再属于这个 Dict
+//
+// 持有文件等资源的实现可以同时实现 io.Closer, 整个 Dict 被丢弃时(FLUSHALL ASYNC)调用; 读取值可能失败的实现同时实现 Loader.
+// pkg/datastruct/dict/dicttest 是所有实现都需要通过的测试
 type Dict interface {
 	Get(key string) (value interface{}, exists bool)
 	Len() int
@@ -12,6 +29,64 @@ type Dict interface {
 	ForEach(consumer Consumer)
 	Keys() []string
 	RandomKeys(limit int) []string
+	RandomKeysWithReplacement(n int) []string
 	RandomDistinctKeys(limit int) []string
 	Clear()
 }
+
+// Loader 读取值可能失败的 Dict(比如从文件中读取). Get 读取失败时只能返回 key 不存在, db 查找 key 时使用 Load,
+// 读取失败的 key 仍然存在, 回复错误而不是当作不存在
+type Loader interface {
+	Load(key string) (value interface{}, exists bool, err error)
+}
+
+// Factory 创建第 index 个 db 使用的 Dict, 创建失败(比如目录不可用)时返回错误
+type Factory func(index int) (Dict, error)
+
+// DefaultBackend 没有配置 storage-backend 时使用的实现
+const DefaultBackend = "simple"
+
+var factories = map[string]Factory{
+	DefaultBackend: func(index int) (Dict, error) {
+		return MakeSimpleDict(), nil
+	},
+}
+
+// Register 注册一个 storage-backend, 在 init 中调用
+func Register(name string, factory Factory) {
+	if _, exists := factories[name]; exists {
+		panic("dict: backend " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Registered 是否注册了名字为 name 的实现, 空字符串表示 DefaultBackend
+func Registered(name string) bool {
+	if name == "" {
+		name = DefaultBackend
+	}
+	_, ok := factories[name]
+	return ok
+}
+
+// New 使用名字为 name 的实现创建第 index 个 db 的 Dict
+func New(name string, index int) (Dict, error) {
+	if name == "" {
+		name = DefaultBackend
+	}
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q, available: %v", name, Backends())
+	}
+	return factory(index)
+}
+
+// Backends 已经注册的实现, 按照名字排序
+func Backends() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,232 @@
+// Package dicttest 检查 dict.Dict 的实现是否满足 dict.Dict 文档中的要求, 每个实现在自己的测试中调用 Run
+package dicttest
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"sort"
+	"testing"
+)
+
+// Harness 被测试的实现
+type Harness struct {
+	// New 创建一个空的 Dict
+	New func(t *testing.T) dict.Dict
+	// Value 第 i 个不同的值, Mutate 原地修改一个值, 之后和 Value(j) 相等
+	Value  func(i int) interface{}
+	Mutate func(value interface{}, j int)
+	// Equal 比较两个值, 实现可能返回值的副本
+	Equal func(a, b interface{}) bool
+}
+
+// Run 运行所有的测试, keys 个数要大到能覆盖实现的分层(比如 tiered 换出到文件)
+func Run(t *testing.T, h Harness) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, h Harness)
+	}{
+		{"PutGet", testPutGet},
+		{"Conditional", testConditional},
+		{"Remove", testRemove},
+		{"Mutate", testMutate},
+		{"ForEach", testForEach},
+		{"ForEachRemove", testForEachRemove},
+		{"Random", testRandom},
+		{"Clear", testClear},
+	} {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			fn(t, h)
+		})
+	}
+}
+
+const keys = 200
+
+func key(i int) string {
+	return fmt.Sprintf("key:%d", i)
+}
+
+func fill(t *testing.T, h Harness) dict.Dict {
+	d := h.New(t)
+	for i := 0; i < keys; i++ {
+		require.Equal(t, 1, d.Put(key(i), h.Value(i)))
+	}
+	return d
+}
+
+func assertValue(t *testing.T, h Harness, d dict.Dict, k string, want int) {
+	t.Helper()
+	value, exists := d.Get(k)
+	require.True(t, exists, k)
+	assert.True(t, h.Equal(h.Value(want), value), k)
+}
+
+func testPutGet(t *testing.T, h Harness) {
+	d := h.New(t)
+	_, exists := d.Get("missing")
+	assert.False(t, exists)
+	assert.Equal(t, 0, d.Len())
+	d = fill(t, h)
+	assert.Equal(t, keys, d.Len())
+	for i := 0; i < keys; i++ {
+		assertValue(t, h, d, key(i), i)
+	}
+	// 覆盖已有的 key 返回0
+	assert.Equal(t, 0, d.Put(key(0), h.Value(keys)))
+	assertValue(t, h, d, key(0), keys)
+	assert.Equal(t, keys, d.Len())
+
+	all := d.Keys()
+	sort.Strings(all)
+	want := make([]string, 0, keys)
+	for i := 0; i < keys; i++ {
+		want = append(want, key(i))
+	}
+	sort.Strings(want)
+	assert.Equal(t, want, all)
+}
+
+func testConditional(t *testing.T, h Harness) {
+	d := fill(t, h)
+	assert.Equal(t, 0, d.PutIfAbsent(key(1), h.Value(keys)))
+	assertValue(t, h, d, key(1), 1)
+	assert.Equal(t, 1, d.PutIfAbsent("new", h.Value(keys)))
+	assertValue(t, h, d, "new", keys)
+
+	assert.Equal(t, 0, d.PutIfExists("absent", h.Value(1)))
+	_, exists := d.Get("absent")
+	assert.False(t, exists)
+	// 最早写入的 key, 分层的实现中可能已经不在内存中
+	assert.Equal(t, 1, d.PutIfExists(key(0), h.Value(keys+1)))
+	assertValue(t, h, d, key(0), keys+1)
+	assert.Equal(t, keys+1, d.Len())
+}
+
+func testRemove(t *testing.T, h Harness) {
+	d := fill(t, h)
+	for i := 0; i < keys; i += 2 {
+		assert.Equal(t, 1, d.Remove(key(i)))
+	}
+	assert.Equal(t, 0, d.Remove(key(0)))
+	assert.Equal(t, keys/2, d.Len())
+	for i := 0; i < keys; i++ {
+		_, exists := d.Get(key(i))
+		assert.Equal(t, i%2 == 1, exists, key(i))
+	}
+	// 删除之后重新写入
+	assert.Equal(t, 1, d.Put(key(0), h.Value(7)))
+	assertValue(t, h, d, key(0), 7)
+}
+
+// testMutate Get 返回的值原地修改之后, 之后读到的是修改之后的值
+func testMutate(t *testing.T, h Harness) {
+	if h.Mutate == nil {
+		t.Skip("values are immutable")
+	}
+	d := fill(t, h)
+	value, _ := d.Get(key(0))
+	h.Mutate(value, keys)
+	// 访问其他所有的 key, 分层的实现会换出 key(0)
+	for i := 1; i < keys; i++ {
+		d.Get(key(i))
+	}
+	assertValue(t, h, d, key(0), keys)
+}
+
+func testForEach(t *testing.T, h Harness) {
+	d := fill(t, h)
+	seen := make(map[string]bool)
+	d.ForEach(func(k string, val interface{}) bool {
+		assert.False(t, seen[k], k)
+		seen[k] = true
+		var i int
+		_, err := fmt.Sscanf(k, "key:%d", &i)
+		require.NoError(t, err)
+		assert.True(t, h.Equal(h.Value(i), val), k)
+		return true
+	})
+	assert.Len(t, seen, keys)
+
+	visited := 0
+	d.ForEach(func(k string, val interface{}) bool {
+		visited++
+		return visited < 10
+	})
+	assert.Equal(t, 10, visited)
+}
+
+// testForEachRemove 和 FLUSHALL ASYNC 在后台释放一样, 遍历的时候删除当前的 key
+func testForEachRemove(t *testing.T, h Harness) {
+	d := fill(t, h)
+	visited := 0
+	d.ForEach(func(k string, val interface{}) bool {
+		visited++
+		assert.Equal(t, 1, d.Remove(k))
+		return true
+	})
+	assert.Equal(t, keys, visited)
+	assert.Equal(t, 0, d.Len())
+}
+
+func testRandom(t *testing.T, h Harness) {
+	d := fill(t, h)
+	random := d.RandomKeys(keys * 2)
+	assert.Len(t, random, keys*2)
+	for _, k := range random {
+		_, exists := d.Get(k)
+		assert.True(t, exists, k)
+	}
+
+	distinct := d.RandomDistinctKeys(keys / 2)
+	assert.Len(t, distinct, keys/2)
+	set := make(map[string]struct{})
+	for _, k := range distinct {
+		set[k] = struct{}{}
+	}
+	assert.Len(t, set, keys/2)
+	assert.Len(t, d.RandomDistinctKeys(keys*2), keys)
+
+	// 有放回的抽样是均匀的, 每个 key 期望被选中 500 次, 标准差大约 22
+	counts := make(map[string]int)
+	for _, k := range d.RandomKeysWithReplacement(keys * 500) {
+		counts[k]++
+	}
+	assert.Len(t, counts, keys)
+	for k, count := range counts {
+		_, exists := d.Get(k)
+		assert.True(t, exists, k)
+		assert.InDelta(t, 500, count, 150, k)
+	}
+	// 抽样之后的修改: 删除的 key 不再被选中, 新增的 key 可以被选中
+	for i := 0; i < keys/2; i++ {
+		assert.Equal(t, 1, d.Remove(key(i)))
+	}
+	assert.Equal(t, 1, d.PutIfAbsent(key(keys), h.Value(keys)))
+	assert.Equal(t, 1, d.Put(key(0), h.Value(0)))
+	counts = make(map[string]int)
+	for _, k := range d.RandomKeysWithReplacement(keys * 100) {
+		counts[k]++
+	}
+	assert.Len(t, counts, keys/2+2)
+	for k := range counts {
+		_, exists := d.Get(k)
+		assert.True(t, exists, k)
+	}
+	d.Clear()
+	assert.Empty(t, d.RandomKeysWithReplacement(10))
+	assert.Empty(t, h.New(t).RandomKeysWithReplacement(10))
+}
+
+func testClear(t *testing.T, h Harness) {
+	d := fill(t, h)
+	d.Clear()
+	assert.Equal(t, 0, d.Len())
+	assert.Empty(t, d.Keys())
+	_, exists := d.Get(key(0))
+	assert.False(t, exists)
+	assert.Equal(t, 1, d.Put(key(0), h.Value(1)))
+	assertValue(t, h, d, key(0), 1)
+}
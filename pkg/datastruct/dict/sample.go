@@ -0,0 +1,20 @@
+package dict
+
+import (
+	"math/rand"
+)
+
+// SampleWithReplacement 从 keys 中均匀地有放回地选择 n 个, 每次选择按照下标是 O(1), keys 为空时返回空.
+// 反复从 map 的遍历中取第一个 key 每次都要创建迭代器, 而且 go 的 map 遍历的起点并不均匀, 有的 key 被选中的次数是其他的几十倍,
+// 所以实现先把 key 放到可以按照下标访问的切片中(见 SimpleDict 的 sampleKeys)
+func SampleWithReplacement(keys []string, n int) []string {
+	if len(keys) == 0 || n <= 0 {
+		return []string{}
+	}
+	result := make([]string, n)
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for i := range result {
+		result[i] = keys[rng.Intn(len(keys))]
+	}
+	return result
+}
@@ -1,7 +1,12 @@
 package dict
 
+import "sort"
+
 type SimpleDict struct {
 	m map[string]interface{}
+	// sampleKeys 按照下标抽样的 key, 第一次调用 RandomKeysWithReplacement 时遍历一次 map 创建. 新增的 key 追加到末尾,
+	// 删除 key 时丢弃, 下一次抽样时重新创建. 没有抽样过的 Dict(比如 db)为 nil, 不占用内存
+	sampleKeys []string
 }
 
 func MakeSimpleDict() *SimpleDict {
@@ -26,6 +31,9 @@ func (s *SimpleDict) Put(key string, val interface{}) (result int) {
 	if ok {
 		return 0
 	}
+	if s.sampleKeys != nil {
+		s.sampleKeys = append(s.sampleKeys, key)
+	}
 	return 1
 }
 
@@ -35,6 +43,9 @@ func (s *SimpleDict) PutIfAbsent(key string, value interface{}) (result int) {
 		return 0
 	}
 	s.m[key] = value
+	if s.sampleKeys != nil {
+		s.sampleKeys = append(s.sampleKeys, key)
+	}
 	return 1
 }
 
@@ -51,6 +62,7 @@ func (s *SimpleDict) Remove(key string) (result int) {
 	_, ok := s.m[key]
 	delete(s.m, key)
 	if ok {
+		s.sampleKeys = nil
 		return 1
 	}
 	return 0
@@ -64,6 +76,18 @@ func (s *SimpleDict) ForEach(consumer Consumer) {
 	}
 }
 
+// SortedForEach 按照 key 的字典序遍历, 用于 aof 重写, DUMP 和 RDB, 同样的数据写出的内容相同.
+// 命令的回复仍然使用 ForEach, 与 redis 一样是不确定的顺序
+func (s *SimpleDict) SortedForEach(consumer Consumer) {
+	keys := s.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !consumer(key, s.m[key]) {
+			break
+		}
+	}
+}
+
 func (s *SimpleDict) Keys() []string {
 	result := make([]string, s.Len())
 	i := 0
@@ -85,6 +109,13 @@ func (s *SimpleDict) RandomKeys(limit int) []string {
 	return result
 }
 
+func (s *SimpleDict) RandomKeysWithReplacement(n int) []string {
+	if s.sampleKeys == nil {
+		s.sampleKeys = s.Keys()
+	}
+	return SampleWithReplacement(s.sampleKeys, n)
+}
+
 func (s *SimpleDict) RandomDistinctKeys(limit int) []string {
 	size := limit
 	if size > s.Len() {
@@ -105,4 +136,5 @@ func (s *SimpleDict) RandomDistinctKeys(limit int) []string {
 func (s *SimpleDict) Clear() {
 	s.m = nil // help gc
 	s.m = make(map[string]interface{})
+	s.sampleKeys = nil
 }
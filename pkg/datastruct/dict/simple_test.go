@@ -0,0 +1,57 @@
+package dict_test
+
+import (
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict/dicttest"
+	"strings"
+	"testing"
+)
+
+type box struct {
+	value int
+}
+
+func TestSimpleDict(t *testing.T) {
+	dicttest.Run(t, dicttest.Harness{
+		New: func(t *testing.T) dict.Dict {
+			return dict.MakeSimpleDict()
+		},
+		Value: func(i int) interface{} {
+			return &box{value: i}
+		},
+		Mutate: func(value interface{}, j int) {
+			value.(*box).value = j
+		},
+		Equal: func(a, b interface{}) bool {
+			return a.(*box).value == b.(*box).value
+		},
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	d, err := dict.New("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(*dict.SimpleDict); !ok {
+		t.Fatalf("default backend is %T", d)
+	}
+	if _, err = dict.New("nosuchbackend", 0); err == nil {
+		t.Fatal("expected an error for an unknown backend")
+	}
+}
+
+func TestSortedForEach(t *testing.T) {
+	d := dict.MakeSimpleDict()
+	for _, key := range []string{"b", "c", "a", "aa"} {
+		d.Put(key, key)
+	}
+	var keys []string
+	d.SortedForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < 3
+	})
+	if strings.Join(keys, ",") != "a,aa,b" {
+		t.Fatalf("unexpected order %v", keys)
+	}
+}
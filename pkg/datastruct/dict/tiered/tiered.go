@@ -0,0 +1,404 @@
+// Package tiered 两层的 dict.Dict: 最近访问的 maxHot 个 key 的值在内存中, 其他的值序列化之后写到磁盘上的临时文件,
+// 读取时重新加载到内存中. 所有的 key 和它们在文件中的位置一直在内存中, Len, Keys 和 RandomKeys 不需要读文件.
+//
+// Get 返回的值会被调用方原地修改, 所以只有最久没有访问的值才会被换出去: maxHot 需要大于一条命令访问的 key 的个数.
+// 临时文件在打开之后立即删除, 进程退出或者 Close 之后磁盘空间被回收; 文件中的数据不是持久化, 重启之后仍然从 rdb/aof 加载
+package tiered
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/rdb"
+	"math/rand"
+	"os"
+)
+
+// compactMinGarbage 文件中的垃圾超过这个大小并且超过有效数据时重写文件
+const compactMinGarbage = 1 << 20
+
+// Codec 值和换出到文件中的数据之间的转换
+type Codec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// RdbCodec 使用 DUMP 的格式(rdb 的值编码和 crc64)序列化 *obj.RedisObject, 读到损坏的数据时返回错误
+var RdbCodec Codec = rdbCodec{}
+
+type rdbCodec struct{}
+
+func (rdbCodec) Marshal(value interface{}) ([]byte, error) {
+	return rdb.DumpValue(value.(*obj.RedisObject))
+}
+
+func (rdbCodec) Unmarshal(data []byte) (interface{}, error) {
+	return rdb.RestoreValue(data)
+}
+
+type entry struct {
+	key   string
+	value interface{}
+}
+
+// location 值在文件中的位置
+type location struct {
+	offset int64
+	size   int
+}
+
+type Dict struct {
+	codec  Codec
+	maxHot int
+	dir    string
+	// hot 内存中的值, lru 从最近访问到最久没有访问
+	hot map[string]*list.Element
+	lru *list.List
+	// cold 换出到文件中的值
+	cold map[string]location
+	// file 第一次换出时创建, size 文件的大小, garbage 已经删除或者重新加载到内存中的数据的大小
+	file    *os.File
+	size    int64
+	garbage int64
+	// err 最近一次读写文件的错误, 写入失败时值留在内存中
+	err error
+}
+
+var (
+	_ dict.Dict   = (*Dict)(nil)
+	_ dict.Loader = (*Dict)(nil)
+)
+
+// New 在内存中保留 maxHot 个值, 其他的值写到 dir 中的临时文件, dir 为空时使用系统的临时目录.
+// 临时文件第一次换出时才创建, 这里先检查 dir 是一个目录
+func New(dir string, maxHot int, codec Codec) (*Dict, error) {
+	if maxHot < 1 {
+		maxHot = 1
+	}
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("tiered: %s is not a directory", dir)
+		}
+	}
+	return &Dict{
+		codec:  codec,
+		maxHot: maxHot,
+		dir:    dir,
+		hot:    make(map[string]*list.Element),
+		lru:    list.New(),
+		cold:   make(map[string]location),
+	}, nil
+}
+
+// HotLen 内存中的值的个数
+func (d *Dict) HotLen() int {
+	return len(d.hot)
+}
+
+// ColdLen 文件中的值的个数
+func (d *Dict) ColdLen() int {
+	return len(d.cold)
+}
+
+// Err 最近一次读写文件的错误
+func (d *Dict) Err() error {
+	return d.err
+}
+
+// Get 读取文件失败时返回 false, key 仍然在文件中, 错误见 Load 和 Err
+func (d *Dict) Get(key string) (interface{}, bool) {
+	value, exists, _ := d.Load(key)
+	return value, exists
+}
+
+// Load 同 Get, 读取或者解码文件中的值失败时返回错误, key 和它在文件中的位置保持不变
+func (d *Dict) Load(key string) (interface{}, bool, error) {
+	if elem, ok := d.hot[key]; ok {
+		d.lru.MoveToFront(elem)
+		return elem.Value.(*entry).value, true, nil
+	}
+	loc, ok := d.cold[key]
+	if !ok {
+		return nil, false, nil
+	}
+	value, err := d.load(loc)
+	if err != nil {
+		d.err = err
+		return nil, false, fmt.Errorf("load %s: %w", key, err)
+	}
+	// 重新加载到内存中, 之后对值的修改不需要写回文件
+	d.dropCold(key, loc)
+	d.addHot(key, value)
+	return value, true, nil
+}
+
+func (d *Dict) Len() int {
+	return len(d.hot) + len(d.cold)
+}
+
+func (d *Dict) contains(key string) bool {
+	if _, ok := d.hot[key]; ok {
+		return true
+	}
+	_, ok := d.cold[key]
+	return ok
+}
+
+func (d *Dict) Put(key string, value interface{}) (result int) {
+	if elem, ok := d.hot[key]; ok {
+		elem.Value.(*entry).value = value
+		d.lru.MoveToFront(elem)
+		return 0
+	}
+	result = 1
+	if loc, ok := d.cold[key]; ok {
+		d.dropCold(key, loc)
+		result = 0
+	}
+	d.addHot(key, value)
+	return result
+}
+
+func (d *Dict) PutIfAbsent(key string, value interface{}) (result int) {
+	if d.contains(key) {
+		return 0
+	}
+	return d.Put(key, value)
+}
+
+func (d *Dict) PutIfExists(key string, value interface{}) (result int) {
+	if !d.contains(key) {
+		return 0
+	}
+	d.Put(key, value)
+	return 1
+}
+
+func (d *Dict) Remove(key string) (result int) {
+	if elem, ok := d.hot[key]; ok {
+		d.lru.Remove(elem)
+		delete(d.hot, key)
+		return 1
+	}
+	if loc, ok := d.cold[key]; ok {
+		d.dropCold(key, loc)
+		return 1
+	}
+	return 0
+}
+
+// ForEach 先遍历内存中的值, 再遍历文件中的值. 文件中的值读出来之后不放进内存, 遍历整个 db(比如 BGSAVE)时不会换出其他的值
+func (d *Dict) ForEach(consumer dict.Consumer) {
+	for _, key := range d.Keys() {
+		var value interface{}
+		if elem, ok := d.hot[key]; ok {
+			value = elem.Value.(*entry).value
+		} else if loc, ok := d.cold[key]; ok {
+			var err error
+			if value, err = d.load(loc); err != nil {
+				d.err = err
+				continue
+			}
+		} else {
+			// consumer 删除了后面的 key
+			continue
+		}
+		if !consumer(key, value) {
+			return
+		}
+	}
+}
+
+func (d *Dict) Keys() []string {
+	keys := make([]string, 0, d.Len())
+	for elem := d.lru.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*entry).key)
+	}
+	for key := range d.cold {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// RandomKeys 按照两层中 key 的个数的比例选择从哪一层取 key
+func (d *Dict) RandomKeys(limit int) []string {
+	result := make([]string, limit)
+	total := d.Len()
+	if total == 0 {
+		return result
+	}
+	for i := 0; i < limit; i++ {
+		if rand.Intn(total) < len(d.hot) {
+			for key := range d.hot {
+				result[i] = key
+				break
+			}
+		} else {
+			for key := range d.cold {
+				result[i] = key
+				break
+			}
+		}
+	}
+	return result
+}
+
+// RandomKeysWithReplacement 取出内存中和文件中所有的 key 之后按照下标抽样, 每次调用遍历一次 key, 不需要读文件
+func (d *Dict) RandomKeysWithReplacement(n int) []string {
+	return dict.SampleWithReplacement(d.Keys(), n)
+}
+
+func (d *Dict) RandomDistinctKeys(limit int) []string {
+	size := limit
+	if size > d.Len() {
+		size = d.Len()
+	}
+	result := make([]string, 0, size)
+	for key := range d.hot {
+		if len(result) == size {
+			return result
+		}
+		result = append(result, key)
+	}
+	for key := range d.cold {
+		if len(result) == size {
+			break
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+func (d *Dict) Clear() {
+	d.hot = make(map[string]*list.Element)
+	d.lru.Init()
+	d.cold = make(map[string]location)
+	d.resetFile()
+}
+
+// Close 关闭临时文件, 之后不能再使用
+func (d *Dict) Close() error {
+	d.hot, d.cold = nil, nil
+	d.lru.Init()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+func (d *Dict) addHot(key string, value interface{}) {
+	d.hot[key] = d.lru.PushFront(&entry{key: key, value: value})
+	for len(d.hot) > d.maxHot {
+		if !d.spill() {
+			return
+		}
+	}
+}
+
+// spill 把最久没有访问的值写到文件中, 写入失败时返回 false, 值留在内存中
+func (d *Dict) spill() bool {
+	elem := d.lru.Back()
+	e := elem.Value.(*entry)
+	data, err := d.codec.Marshal(e.value)
+	if err == nil {
+		err = d.openFile()
+	}
+	if err == nil {
+		_, err = d.file.WriteAt(data, d.size)
+	}
+	if err != nil {
+		d.err = err
+		return false
+	}
+	d.cold[e.key] = location{offset: d.size, size: len(data)}
+	d.size += int64(len(data))
+	d.lru.Remove(elem)
+	delete(d.hot, e.key)
+	return true
+}
+
+func (d *Dict) load(loc location) (interface{}, error) {
+	data := make([]byte, loc.size)
+	if _, err := d.file.ReadAt(data, loc.offset); err != nil {
+		return nil, err
+	}
+	return d.codec.Unmarshal(data)
+}
+
+// dropCold 文件中的值不再有效, 变成垃圾
+func (d *Dict) dropCold(key string, loc location) {
+	delete(d.cold, key)
+	d.garbage += int64(loc.size)
+	if len(d.cold) == 0 {
+		d.resetFile()
+		return
+	}
+	if d.garbage > compactMinGarbage && d.garbage > d.size-d.garbage {
+		d.compact()
+	}
+}
+
+func (d *Dict) openFile() error {
+	if d.file != nil {
+		return nil
+	}
+	file, err := os.CreateTemp(d.dir, "godis-tiered-*")
+	if err != nil {
+		return err
+	}
+	// 只通过文件描述符访问, 关闭之后系统回收空间
+	if err = os.Remove(file.Name()); err != nil {
+		_ = file.Close()
+		return err
+	}
+	d.file = file
+	return nil
+}
+
+// resetFile 没有换出的值时清空文件
+func (d *Dict) resetFile() {
+	d.size, d.garbage = 0, 0
+	if d.file != nil {
+		if err := d.file.Truncate(0); err != nil {
+			d.err = err
+		}
+	}
+}
+
+// compact 把有效的数据写到新的文件中, 失败时继续使用原来的文件
+func (d *Dict) compact() {
+	old := d.file
+	d.file = nil
+	if err := d.openFile(); err != nil {
+		d.err = err
+		d.file = old
+		return
+	}
+	cold := make(map[string]location, len(d.cold))
+	var size int64
+	for key, loc := range d.cold {
+		data := make([]byte, loc.size)
+		_, err := old.ReadAt(data, loc.offset)
+		if err == nil {
+			_, err = d.file.WriteAt(data, size)
+		}
+		if err != nil {
+			d.err = errors.New("tiered: compact failed: " + err.Error())
+			_ = d.file.Close()
+			d.file = old
+			return
+		}
+		cold[key] = location{offset: size, size: loc.size}
+		size += int64(loc.size)
+	}
+	_ = old.Close()
+	d.cold, d.size, d.garbage = cold, size, 0
+}
@@ -0,0 +1,138 @@
+package tiered
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict/dicttest"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/list"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newDict(t *testing.T, maxHot int) *Dict {
+	d, err := New(t.TempDir(), maxHot, RdbCodec)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, d.Err())
+		_ = d.Close()
+	})
+	return d
+}
+
+func stringValue(value interface{}) string {
+	data, err := obj.StringObjEncoding(value.(*obj.RedisObject))
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func TestTieredDict(t *testing.T) {
+	dicttest.Run(t, dicttest.Harness{
+		New: func(t *testing.T) dict.Dict {
+			return newDict(t, 16)
+		},
+		Value: func(i int) interface{} {
+			return obj.NewStringObject([]byte(fmt.Sprintf("value:%d", i)))
+		},
+		Mutate: func(value interface{}, j int) {
+			obj.StringObjSetValue(value.(*obj.RedisObject), []byte(fmt.Sprintf("value:%d", j)))
+		},
+		Equal: func(a, b interface{}) bool {
+			return stringValue(a) == stringValue(b)
+		},
+	})
+}
+
+func TestSpillAndPromote(t *testing.T) {
+	d := newDict(t, 2)
+	for i := 0; i < 5; i++ {
+		d.Put(fmt.Sprintf("k%d", i), obj.NewStringObject([]byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.Equal(t, 2, d.HotLen())
+	assert.Equal(t, 3, d.ColdLen())
+	assert.Equal(t, 5, d.Len())
+
+	// 读取换出的 key 时重新加载到内存中, 最久没有访问的 key 被换出
+	value, ok := d.Get("k0")
+	require.True(t, ok)
+	assert.Equal(t, "v0", stringValue(value))
+	assert.Equal(t, 2, d.HotLen())
+	_, hot := d.hot["k0"]
+	assert.True(t, hot)
+	_, cold := d.cold["k3"]
+	assert.True(t, cold)
+
+	// 列表换出之后保留元素
+	listObj := obj.NewListObject()
+	_ = listObj.Ptr.(list.Dequeue).AddLast([]byte("a"))
+	_ = listObj.Ptr.(list.Dequeue).AddLast([]byte("b"))
+	d.Put("list", listObj)
+	d.Get("k1")
+	d.Get("k2")
+	value, ok = d.Get("list")
+	require.True(t, ok)
+	assert.Equal(t, obj.RedisList, value.(*obj.RedisObject).ObjType)
+	assert.Equal(t, 2, value.(*obj.RedisObject).Ptr.(list.Dequeue).Len())
+}
+
+func TestCompact(t *testing.T) {
+	d := newDict(t, 1)
+	payload := make([]byte, 64<<10)
+	for i := 0; i < 40; i++ {
+		d.Put(fmt.Sprintf("k%d", i), obj.NewStringObject(payload))
+	}
+	// 删除大部分换出的值之后文件被重写
+	for i := 0; i < 30; i++ {
+		d.Remove(fmt.Sprintf("k%d", i))
+	}
+	assert.Less(t, d.size, int64(20*len(payload)))
+	assert.Equal(t, d.size-d.garbage, int64(len(d.cold))*int64(d.cold["k30"].size))
+	for i := 30; i < 40; i++ {
+		value, ok := d.Get(fmt.Sprintf("k%d", i))
+		require.True(t, ok)
+		assert.Len(t, stringValue(value), len(payload))
+	}
+	// 没有换出的值时文件被清空
+	for i := 30; i < 40; i++ {
+		d.Remove(fmt.Sprintf("k%d", i))
+	}
+	assert.Equal(t, 0, d.ColdLen())
+	assert.Equal(t, int64(0), d.size)
+}
+
+func TestLoadError(t *testing.T) {
+	d, err := New(t.TempDir(), 1, RdbCodec)
+	require.NoError(t, err)
+	defer d.Close()
+	d.Put("k0", obj.NewStringObject([]byte("v0")))
+	d.Put("k1", obj.NewStringObject([]byte("v1")))
+	require.Equal(t, 1, d.ColdLen())
+
+	// 文件中的数据损坏之后读取返回错误, key 仍然存在, 不是当作不存在
+	_, err = d.file.WriteAt([]byte("corrupted"), d.cold["k0"].offset)
+	require.NoError(t, err)
+	_, exists, err := d.Load("k0")
+	assert.Error(t, err)
+	assert.False(t, exists)
+	assert.Error(t, d.Err())
+	_, ok := d.Get("k0")
+	assert.False(t, ok)
+	assert.Equal(t, 2, d.Len())
+	assert.Equal(t, 1, d.ColdLen())
+	assert.Equal(t, 1, d.Remove("k0"))
+	assert.Equal(t, 1, d.Len())
+}
+
+func TestNewNotDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	_, err := New(file, 1, RdbCodec)
+	assert.Error(t, err)
+	_, err = New(filepath.Join(t.TempDir(), "missing"), 1, RdbCodec)
+	assert.Error(t, err)
+}
@@ -172,6 +172,11 @@ func (is *IntSet) Elements() []int64 {
 	return result
 }
 
+// Get 按照下标读取元素, 元素从小到大排列. 用于均匀的随机选择, 不需要像 Elements 一样复制所有的元素
+func (is *IntSet) Get(index int) (int64, error) {
+	return is.getAt(index)
+}
+
 func (is *IntSet) getAt(index int) (int64, error) {
 	if index < 0 || index >= is.length {
 		return 0, ErrOutOfBounds
@@ -214,6 +219,11 @@ func (is *IntSet) valueEncoding(value int64) EncodingType {
 	return result
 }
 
+// Memory 编码占用的字节数
+func (is *IntSet) Memory() int {
+	return cap(is.contents)
+}
+
 func (is *IntSet) Len() int {
 	return is.length
 }
@@ -229,3 +239,14 @@ func (is *IntSet) Range(fun RangeFunc) {
 		}
 	}
 }
+
+// Copy 复制一个新的 IntSet, 修改不会互相影响
+func (is *IntSet) Copy() *IntSet {
+	contents := make([]byte, len(is.contents))
+	copy(contents, is.contents)
+	return &IntSet{
+		encoding: is.encoding,
+		length:   is.length,
+		contents: contents,
+	}
+}
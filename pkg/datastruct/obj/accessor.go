@@ -0,0 +1,65 @@
+package obj
+
+import (
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/intset"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/list"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/sds"
+)
+
+// 命令通过这些方法取出对象的值, 同时检查类型和值的实际类型, 不匹配时返回 false, 调用方回复 WRONGTYPE.
+// 不直接断言 Ptr, 类型和编码不一致的对象(比如加载了还不支持的编码)不会让 server panic
+
+// AsList 列表的值
+func (o *RedisObject) AsList() (list.Dequeue, bool) {
+	if o.ObjType != RedisList {
+		return nil, false
+	}
+	dequeue, ok := o.Ptr.(list.Dequeue)
+	return dequeue, ok
+}
+
+// AsHash 哈希的值
+func (o *RedisObject) AsHash() (*dict.SimpleDict, bool) {
+	if o.ObjType != RedisHash {
+		return nil, false
+	}
+	simpleDict, ok := o.Ptr.(*dict.SimpleDict)
+	return simpleDict, ok && simpleDict != nil
+}
+
+// AsIntSet intset 编码的集合
+func (o *RedisObject) AsIntSet() (*intset.IntSet, bool) {
+	if o.ObjType != RedisSet || o.Encoding != EncIntSet {
+		return nil, false
+	}
+	intSet, ok := o.Ptr.(*intset.IntSet)
+	return intSet, ok && intSet != nil
+}
+
+// AsSetDict hashtable 编码的集合
+func (o *RedisObject) AsSetDict() (*dict.SimpleDict, bool) {
+	if o.ObjType != RedisSet || o.Encoding != EncHT {
+		return nil, false
+	}
+	simpleDict, ok := o.Ptr.(*dict.SimpleDict)
+	return simpleDict, ok && simpleDict != nil
+}
+
+// AsSds raw 和 embstr 编码的字符串
+func (o *RedisObject) AsSds() (*sds.Sds, bool) {
+	if o.ObjType != RedisString {
+		return nil, false
+	}
+	str, ok := o.Ptr.(*sds.Sds)
+	return str, ok && str != nil
+}
+
+// AsInt int 编码的字符串
+func (o *RedisObject) AsInt() (int64, bool) {
+	if o.ObjType != RedisString || o.Encoding != EncInt {
+		return 0, false
+	}
+	value, ok := o.Ptr.(int64)
+	return value, ok
+}
@@ -0,0 +1,113 @@
+package obj
+
+import (
+	"github.com/xuning888/godis-tiny/pkg/clock"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// 与 redis 一致, LFU 策略时 LRU 字段的24位分成两部分: 高16位是最后一次衰减的时间(分钟), 低8位是对数计数器.
+// 计数器按照 1/((counter-LFUInitVal)*lfu-log-factor+1) 的概率增加, 每经过 lfu-decay-time 分钟减一
+
+// LFUInitVal 新对象的计数, 避免刚写入的key因为计数为0马上被淘汰
+const LFUInitVal = 5
+
+// lfuEnabled 当前的淘汰策略是否是 LFU, 决定了 LRU 字段的含义
+var lfuEnabled atomic.Bool
+
+// SetLFU 切换 LRU 字段的含义, 之后创建的对象按照新的含义初始化
+func SetLFU(enabled bool) {
+	lfuEnabled.Store(enabled)
+}
+
+// LFUEnabled LRU 字段是否保存的是 LFU 计数
+func LFUEnabled() bool {
+	return lfuEnabled.Load()
+}
+
+// clockHolder atomic.Value 要求每次保存的类型相同
+type clockHolder struct {
+	clock.Clock
+}
+
+// lruClock LRU 和 LFU 访问时间的来源
+var lruClock atomic.Value
+
+// SetClock 修改 LRU 和 LFU 访问时间的来源, c 为 nil 时使用系统时钟
+func SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real
+	}
+	lruClock.Store(clockHolder{c})
+}
+
+// Now LRU 和 LFU 使用的当前时间
+func Now() time.Time {
+	if holder, ok := lruClock.Load().(clockHolder); ok {
+		return holder.Now()
+	}
+	return time.Now()
+}
+
+// InitLRU 按照当前的含义重新初始化对象的访问信息
+func InitLRU(obj *RedisObject) {
+	if LFUEnabled() {
+		obj.LRU = lfuTimeInMinutes()<<8 | LFUInitVal
+	} else {
+		obj.LRU = LRUClock()
+	}
+}
+
+// lfuTimeInMinutes 精度是分钟的16位时钟, 大约45天循环一次
+func lfuTimeInMinutes() uint32 {
+	return uint32(Now().Unix()/60) & 0xffff
+}
+
+// lfuElapsedMinutes 距离 ldt 经过的分钟数, 时钟循环之后按照一次循环计算
+func lfuElapsedMinutes(ldt uint32) uint32 {
+	now := lfuTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 0xffff - ldt + now
+}
+
+// lfuLogIncr 按照概率增加计数, 计数越大越难增加, 255 之后不再增加
+func lfuLogIncr(counter uint32, logFactor int) uint32 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(counter) - LFUInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1.0/(base*float64(logFactor)+1) {
+		counter++
+	}
+	return counter
+}
+
+// LFUFreq 衰减之后的计数, 不修改对象. decayTime 为0时不衰减
+func LFUFreq(obj *RedisObject, decayTime int) uint8 {
+	counter := obj.LRU & 0xff
+	if decayTime <= 0 {
+		return uint8(counter)
+	}
+	periods := lfuElapsedMinutes(obj.LRU>>8) / uint32(decayTime)
+	if periods >= counter {
+		return 0
+	}
+	return uint8(counter - periods)
+}
+
+// LFUTouch 访问对象时先衰减再按照概率增加计数
+func LFUTouch(obj *RedisObject, logFactor, decayTime int) {
+	counter := lfuLogIncr(uint32(LFUFreq(obj, decayTime)), logFactor)
+	obj.LRU = lfuTimeInMinutes()<<8 | counter
+}
+
+// SetLFUFreq 直接设置计数, RESTORE ... FREQ 使用
+func SetLFUFreq(obj *RedisObject, freq uint8) {
+	obj.LRU = lfuTimeInMinutes()<<8 | uint32(freq)
+}
@@ -2,12 +2,12 @@ package obj
 
 import (
 	"errors"
-	"fmt"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/intset"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/list"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/sds"
 	"strconv"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -62,6 +62,8 @@ func EncodingTypeName(encodingType EncodingType) string {
 		return "raw"
 	case EncInt:
 		return "int"
+	case EncEmbStr:
+		return "embstr"
 	case EncHT:
 		return "hashtable"
 	case EncSkipList:
@@ -81,6 +83,25 @@ type RedisObject struct {
 	ObjType  ObjectType
 	Encoding EncodingType
 	Ptr      interface{}
+	// LRU 最近一次访问时的 LRU 时钟, 用于近似 LRU 淘汰; LFU 策略时是访问频率, 见 lfu.go
+	LRU uint32
+}
+
+// LRUClockMax 与 redis 一致, LRU 时钟只保留24位, 精度是1秒, 大约194天循环一次
+const LRUClockMax = 1<<24 - 1
+
+// LRUClock 当前的 LRU 时钟
+func LRUClock() uint32 {
+	return uint32(Now().Unix()) & LRUClockMax
+}
+
+// IdleTime 对象没有被访问的秒数, LRU 时钟循环之后按照一次循环计算
+func IdleTime(obj *RedisObject) int64 {
+	clock := LRUClock()
+	if clock >= obj.LRU {
+		return int64(clock - obj.LRU)
+	}
+	return int64(clock + (LRUClockMax - obj.LRU))
 }
 
 func NewObject(objType ObjectType, ptr interface{}) *RedisObject {
@@ -88,6 +109,7 @@ func NewObject(objType ObjectType, ptr interface{}) *RedisObject {
 	redisObj.ObjType = objType
 	redisObj.Encoding = EncRaw
 	redisObj.Ptr = ptr
+	InitLRU(redisObj)
 	return redisObj
 }
 
@@ -96,18 +118,46 @@ func NewStringObject(p []byte) *RedisObject {
 	if len(p) <= 32 {
 		// 小于32个字节, 编码改为EncEmbStr, 内部还是使用 []byte表示
 		redisObject.Encoding = EncEmbStr
-		if len(p) <= 20 {
-			// 尝试转换为64位整数
-			value, err := strconv.ParseInt(string(p), 10, 64)
-			if err == nil {
-				redisObject.Ptr = value
-				redisObject.Encoding = EncInt
-			}
+		// 尝试转换为64位整数
+		if value, ok := ParseStringInt(p); ok {
+			redisObject.Ptr = value
+			redisObject.Encoding = EncInt
 		}
 	}
 	return redisObject
 }
 
+// SharedIntegers 与 redis 的 OBJ_SHARED_INTEGERS 一致, 0..SharedIntegers-1 的整数字符串可以共用一个只读的对象
+const SharedIntegers = 10000
+
+var sharedIntegers = func() (shared [SharedIntegers]*RedisObject) {
+	for i := range shared {
+		shared[i] = &RedisObject{ObjType: RedisString, Encoding: EncInt, Ptr: int64(i)}
+	}
+	return
+}()
+
+// SharedInteger 返回 value 的共享对象, 共享的对象不能修改
+func SharedInteger(value int64) (*RedisObject, bool) {
+	if value < 0 || value >= SharedIntegers {
+		return nil, false
+	}
+	return sharedIntegers[value], true
+}
+
+// IsShared 是否是共享的对象
+func IsShared(obj *RedisObject) bool {
+	value, ok := obj.Ptr.(int64)
+	return ok && value >= 0 && value < SharedIntegers && sharedIntegers[value] == obj
+}
+
+// NewIntObject 不共享的整数字符串对象
+func NewIntObject(value int64) *RedisObject {
+	redisObject := NewObject(RedisString, value)
+	redisObject.Encoding = EncInt
+	return redisObject
+}
+
 func NewStringEmptyObj() *RedisObject {
 	redisObject := NewObject(RedisString, nil)
 	return redisObject
@@ -126,38 +176,66 @@ func NewHashObject() *RedisObject {
 	return redisObj
 }
 
+// maxIntsetEntries 与 redis 的 set-max-intset-entries 一致, intset 编码的集合最多的元素个数
+var maxIntsetEntries atomic.Int64
+
+func init() {
+	maxIntsetEntries.Store(512)
+}
+
+// SetMaxIntsetEntries 修改 intset 编码的元素上限, 只影响之后的写入, 已经转换的集合不会变回 intset
+func SetMaxIntsetEntries(entries int) {
+	maxIntsetEntries.Store(int64(entries))
+}
+
+// MaxIntsetEntries intset 编码的集合最多的元素个数
+func MaxIntsetEntries() int {
+	return int(maxIntsetEntries.Load())
+}
+
+// NewSetObject 创建集合, 元素都是整数并且不超过 set-max-intset-entries 时使用 intset 编码
 func NewSetObject(members [][]byte) (*RedisObject, int64) {
-	var encoding = EncIntSet
 	var distinct int64 = 0
 	intSet := intset.NewIntSet(intset.EncInt16)
-	simpleDict := dict.MakeSimpleDict()
+	redisObject := NewObject(RedisSet, intSet)
+	redisObject.Encoding = EncIntSet
 	for idx, member := range members {
-		number, err := strconv.ParseInt(string(member), 10, 64)
-		if err == nil {
+		number, ok := ParseStringInt(member)
+		if ok {
 			distinct += intSet.Add(number)
-		} else {
-			distinct = 0
-			encoding = EncHT
-			intSet.Range(func(index int, value int64) bool {
-				distinct += int64(simpleDict.Put(fmt.Sprintf("%d", value), struct{}{}))
-				return true
-			})
-			for _, mem := range members[idx:] {
-				distinct += int64(simpleDict.Put(string(mem), struct{}{}))
+			if intSet.Len() <= MaxIntsetEntries() {
+				continue
 			}
-			break
+			idx++
 		}
-	}
-	redisObject := NewObject(RedisSet, nil)
-	redisObject.Encoding = encoding
-	if encoding == EncIntSet {
-		redisObject.Ptr = intSet
-	} else {
-		redisObject.Ptr = simpleDict
+		// 新建的对象直接使用 hashtable, 不计入编码转换
+		SetConvertToDict(redisObject)
+		simpleDict, _ := redisObject.AsSetDict()
+		for _, mem := range members[idx:] {
+			distinct += int64(simpleDict.Put(string(mem), struct{}{}))
+		}
+		break
 	}
 	return redisObject, distinct
 }
 
+// SetConvertToDict 把 intset 编码的集合转换为 hashtable 编码, 与 redis 一样转换是单向的,
+// 删除元素之后也不会变回 intset, 避免在阈值附近反复转换. 已经是 hashtable 时返回 false
+func SetConvertToDict(obj *RedisObject) bool {
+	intSet, ok := obj.AsIntSet()
+	if !ok {
+		return false
+	}
+	simpleDict := dict.MakeSimpleDict()
+	intSet.Range(func(index int, value int64) bool {
+		simpleDict.Put(strconv.FormatInt(value, 10), struct{}{})
+		return true
+	})
+	obj.Encoding = EncHT
+	obj.Ptr = simpleDict
+	return true
+}
+
 func NewListObject() *RedisObject {
 	redisObj := NewObject(RedisList, list.NewLinked())
 	redisObj.Encoding = EncLinkedList
@@ -196,13 +274,10 @@ func StringObjSetValue(obj *RedisObject, p []byte) {
 		// 小于32个字节, 编码改为EncEmbStr, 内部还是使用 []byte
 		obj.Encoding = EncEmbStr
 		obj.Ptr = sds.NewWithBytes(p)
-		if len(p) <= 20 {
-			// 尝试转换为64位整数
-			value, err := strconv.ParseInt(string(p), 10, 64)
-			if err == nil {
-				obj.Ptr = value
-				obj.Encoding = EncInt
-			}
+		// 尝试转换为64位整数
+		if value, ok := ParseStringInt(p); ok {
+			obj.Ptr = value
+			obj.Encoding = EncInt
 		}
 	} else {
 		obj.Encoding = EncRaw
@@ -214,18 +289,41 @@ func StringObjEncoding(obj *RedisObject) (result []byte, err error) {
 	if obj.ObjType != RedisString {
 		return nil, ErrorObjectType
 	}
-	switch obj.Encoding {
-	case EncEmbStr | EncRaw:
-		sdss := obj.Ptr.(*sds.Sds)
-		result = *sdss
-		break
-	case EncInt:
-		result = strconv.AppendInt([]byte{}, obj.Ptr.(int64), 10)
-		break
-	default:
-		err = ErrorEncodingType
+	if sdss, ok := obj.AsSds(); ok {
+		return *sdss, nil
 	}
-	return
+	if value, ok := obj.AsInt(); ok {
+		return strconv.AppendInt([]byte{}, value, 10), nil
+	}
+	return nil, ErrorEncodingType
+}
+
+// StringObjInt64 字符串对象的整数值, APPEND 和 SETRANGE 之后 raw 编码的值也可能是整数
+func StringObjInt64(obj *RedisObject) (int64, bool) {
+	if obj.ObjType != RedisString {
+		return 0, false
+	}
+	if value, ok := obj.AsInt(); ok {
+		return value, true
+	}
+	bytes, err := StringObjEncoding(obj)
+	if err != nil {
+		return 0, false
+	}
+	return ParseStringInt(bytes)
+}
+
+// ParseStringInt 与 redis 的 string2ll 一致, 只接受整数的标准形式: "04", "+4", " 4" 和 "-0" 不是整数,
+// 否则 int 编码之后读出来的值和写入的不同
+func ParseStringInt(p []byte) (int64, bool) {
+	if len(p) == 0 || len(p) > 20 {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(string(p), 10, 64)
+	if err != nil || strconv.FormatInt(value, 10) != string(p) {
+		return 0, false
+	}
+	return value, true
 }
 
 func StringObjMem(obj *RedisObject) (int64, error) {
@@ -233,15 +331,13 @@ func StringObjMem(obj *RedisObject) (int64, error) {
 		return 0, ErrorObjectType
 	}
 	sizeof := int64(unsafe.Sizeof(*obj)) + 8
-	switch obj.Encoding {
-	case EncRaw | EncEmbStr:
-		sdss := obj.Ptr.(*sds.Sds)
+	if sdss, ok := obj.AsSds(); ok {
 		return sizeof + int64(sdss.Memory()) + int64(8), nil
-	case EncInt:
+	}
+	if _, ok := obj.AsInt(); ok {
 		return sizeof + 8, nil
-	default:
-		return 0, ErrorEncodingType
 	}
+	return 0, ErrorEncodingType
 }
 
 func ListObjMem(obj *RedisObject) (int64, error) {
@@ -249,17 +345,101 @@ func ListObjMem(obj *RedisObject) (int64, error) {
 		return 0, ErrorObjectType
 	}
 	sizeof := int64(unsafe.Sizeof(*obj)) + 8
-	switch obj.Encoding {
-	case EncLinkedList:
-		dequeue := obj.Ptr.(list.Dequeue)
+	dequeue, ok := obj.AsList()
+	if !ok || obj.Encoding != EncLinkedList {
+		return 0, ErrorEncodingType
+	}
+	var sum int64
+	dequeue.ForEach(func(value interface{}, index int) bool {
+		bytes := value.([]byte)
+		sum += int64(cap(bytes))
+		return true
+	})
+	return sizeof + sum, nil
+}
+
+// ObjectMemory 估算对象占用的内存, 用于 MEMORY USAGE 和淘汰时统计释放的内存
+func ObjectMemory(obj *RedisObject) int64 {
+	sizeof := int64(unsafe.Sizeof(*obj)) + 8
+	switch ptr := obj.Ptr.(type) {
+	case *sds.Sds:
+		return sizeof + int64(ptr.Memory()) + 8
+	case int64:
+		return sizeof + 8
+	case list.Dequeue:
+		mem, _ := ListObjMem(obj)
+		return mem
+	case *intset.IntSet:
+		return sizeof + int64(ptr.Memory())
+	case *dict.SimpleDict:
+		// 每个元素按照 map 的一个槽位加上字段和值的长度计算
 		var sum int64
-		dequeue.ForEach(func(value interface{}, index int) bool {
-			bytes := value.([]byte)
-			sum += int64(cap(bytes))
+		ptr.ForEach(func(key string, val interface{}) bool {
+			sum += 32 + int64(len(key))
+			if bytes, ok := val.([]byte); ok {
+				sum += int64(cap(bytes))
+			}
 			return true
 		})
-		return sizeof + sum, nil
+		return sizeof + sum
 	default:
-		return 0, ErrorEncodingType
+		return sizeof
+	}
+}
+
+// FreeEffort 释放对象需要的工作量, 与 redis 的 lazyfreeGetFreeEffort 一致: 容器按照元素的个数计算, 其他的对象是1
+func FreeEffort(obj *RedisObject) int {
+	switch ptr := obj.Ptr.(type) {
+	case list.Dequeue:
+		return ptr.Len()
+	case *dict.SimpleDict:
+		return ptr.Len()
+	default:
+		return 1
+	}
+}
+
+// FreeObject 逐个移除容器中的元素并丢弃对象的值, 只能用于已经不会再被访问的对象
+func FreeObject(obj *RedisObject) {
+	switch ptr := obj.Ptr.(type) {
+	case list.Dequeue:
+		for ptr.Len() > 0 {
+			_, _ = ptr.RemoveFirst()
+		}
+	case *dict.SimpleDict:
+		// 遍历 map 时可以删除其中的元素
+		ptr.ForEach(func(key string, val interface{}) bool {
+			ptr.Remove(key)
+			return true
+		})
+	}
+	obj.Ptr = nil
+}
+
+// DupObject 复制对象, 修改复制出来的对象不会影响原来的对象, list 和 hash 中的元素不会被原地修改, 所以只复制容器
+func DupObject(obj *RedisObject) *RedisObject {
+	dup := &RedisObject{ObjType: obj.ObjType, Encoding: obj.Encoding, Ptr: obj.Ptr, LRU: obj.LRU}
+	switch ptr := obj.Ptr.(type) {
+	case *sds.Sds:
+		bytes := make([]byte, ptr.Len())
+		copy(bytes, *ptr)
+		dup.Ptr = sds.NewWithBytes(bytes)
+	case list.Dequeue:
+		linked := list.NewLinked()
+		ptr.ForEach(func(value interface{}, index int) bool {
+			_ = linked.AddLast(value)
+			return true
+		})
+		dup.Ptr = linked
+	case *intset.IntSet:
+		dup.Ptr = ptr.Copy()
+	case *dict.SimpleDict:
+		simpleDict := dict.MakeSimpleDict()
+		ptr.ForEach(func(key string, val interface{}) bool {
+			simpleDict.Put(key, val)
+			return true
+		})
+		dup.Ptr = simpleDict
 	}
+	return dup
 }
@@ -2,7 +2,11 @@ package obj
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/intset"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/list"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/sds"
+	"strconv"
 	"testing"
 )
 
@@ -59,3 +63,129 @@ func TestStringObjIntConvertRaw(t *testing.T) {
 	assert.Equal(t, EncRaw, redisObj.Encoding)
 	assert.Equal(t, sds.NewWithBytes([]byte("10086hello")), redisObj.Ptr)
 }
+
+func TestDupObject(t *testing.T) {
+	str := NewStringObject([]byte("1234567890abcdefghijklmnopqrstuvwxyz0123456789"))
+	dupStr := DupObject(str)
+	dupStr.Ptr.(*sds.Sds).SdsCat([]byte("tail"))
+	value, _ := StringObjEncoding(str)
+	assert.Equal(t, "1234567890abcdefghijklmnopqrstuvwxyz0123456789", string(value))
+
+	listObj := NewListObject()
+	_ = listObj.Ptr.(list.Dequeue).AddLast([]byte("a"))
+	dupList := DupObject(listObj)
+	_ = dupList.Ptr.(list.Dequeue).AddLast([]byte("b"))
+	assert.Equal(t, 1, listObj.Ptr.(list.Dequeue).Len())
+	assert.Equal(t, 2, dupList.Ptr.(list.Dequeue).Len())
+
+	setObj, _ := NewSetObject([][]byte{[]byte("1"), []byte("2")})
+	dupSet := DupObject(setObj)
+	dupSet.Ptr.(*intset.IntSet).Add(3)
+	assert.Equal(t, 2, setObj.Ptr.(*intset.IntSet).Len())
+	assert.Equal(t, EncIntSet, dupSet.Encoding)
+
+	hashObj := NewHashObject()
+	hashObj.Ptr.(*dict.SimpleDict).Put("f", []byte("v"))
+	dupHash := DupObject(hashObj)
+	dupHash.Ptr.(*dict.SimpleDict).Remove("f")
+	assert.Equal(t, 1, hashObj.Ptr.(*dict.SimpleDict).Len())
+}
+
+func TestIdleTime(t *testing.T) {
+	str := NewStringObject([]byte("value"))
+	assert.Equal(t, int64(0), IdleTime(str))
+	str.LRU = (LRUClock() - 100) & LRUClockMax
+	assert.Equal(t, int64(100), IdleTime(str))
+	// LRU 时钟循环之后
+	str.LRU = (LRUClock() + 10) & LRUClockMax
+	assert.Equal(t, int64(LRUClockMax-10), IdleTime(str))
+	assert.Equal(t, str.LRU, DupObject(str).LRU)
+}
+
+func TestObjectMemory(t *testing.T) {
+	small, large := NewStringObject([]byte("1")), NewStringObject(make([]byte, 1000))
+	assert.True(t, ObjectMemory(large)-ObjectMemory(small) >= 1000)
+
+	hashObj := NewHashObject()
+	empty := ObjectMemory(hashObj)
+	hashObj.Ptr.(*dict.SimpleDict).Put("field", make([]byte, 100))
+	assert.True(t, ObjectMemory(hashObj)-empty >= 105)
+
+	intSetObj, _ := NewSetObject([][]byte{[]byte("1")})
+	setObj, _ := NewSetObject([][]byte{[]byte("1"), []byte("member")})
+	assert.True(t, ObjectMemory(setObj) > ObjectMemory(intSetObj))
+}
+
+func TestLFU(t *testing.T) {
+	SetLFU(true)
+	defer SetLFU(false)
+	str := NewStringObject([]byte("value"))
+	assert.Equal(t, uint8(LFUInitVal), LFUFreq(str, 1))
+	// 计数小于等于初始值时每次访问都增加
+	LFUTouch(str, 10, 1)
+	assert.Equal(t, uint8(LFUInitVal+1), LFUFreq(str, 1))
+
+	// 每经过 decayTime 分钟减一, 0 表示不衰减
+	str.LRU = (lfuTimeInMinutes()-3)&0xffff<<8 | 10
+	assert.Equal(t, uint8(7), LFUFreq(str, 1))
+	assert.Equal(t, uint8(9), LFUFreq(str, 2))
+	assert.Equal(t, uint8(10), LFUFreq(str, 0))
+	str.LRU = (lfuTimeInMinutes()-30)&0xffff<<8 | 10
+	assert.Equal(t, uint8(0), LFUFreq(str, 1))
+
+	SetLFUFreq(str, 255)
+	LFUTouch(str, 0, 1)
+	assert.Equal(t, uint8(255), LFUFreq(str, 1))
+	SetLFU(false)
+	InitLRU(str)
+	assert.Equal(t, int64(0), IdleTime(str))
+}
+
+func TestParseStringInt(t *testing.T) {
+	for _, input := range []string{"0", "4", "-4", "9223372036854775807", "-9223372036854775808"} {
+		value, ok := ParseStringInt([]byte(input))
+		assert.True(t, ok, input)
+		assert.Equal(t, input, strconv.FormatInt(value, 10))
+	}
+	// 不是标准形式的整数按照字符串保存, 读出来和写入的一样
+	for _, input := range []string{"", "04", "+4", " 4", "4 ", "-0", "9223372036854775808", "1e3"} {
+		_, ok := ParseStringInt([]byte(input))
+		assert.False(t, ok, input)
+		redisObj := NewStringObject([]byte(input))
+		assert.NotEqual(t, EncInt, redisObj.Encoding, input)
+		value, _ := StringObjEncoding(redisObj)
+		assert.Equal(t, input, string(value))
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	listObj := NewListObject()
+	_, ok := listObj.AsList()
+	assert.True(t, ok)
+	_, ok = listObj.AsHash()
+	assert.False(t, ok)
+
+	intSetObj, _ := NewSetObject([][]byte{[]byte("1")})
+	_, ok = intSetObj.AsIntSet()
+	assert.True(t, ok)
+	_, ok = intSetObj.AsSetDict()
+	assert.False(t, ok)
+	dictSetObj, _ := NewSetObject([][]byte{[]byte("a")})
+	_, ok = dictSetObj.AsSetDict()
+	assert.True(t, ok)
+
+	_, ok = NewHashObject().AsHash()
+	assert.True(t, ok)
+	value, ok := NewStringObject([]byte("10")).AsInt()
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), value)
+	_, ok = NewStringObject([]byte("hello")).AsSds()
+	assert.True(t, ok)
+
+	// 类型和值不一致时返回 false
+	broken := &RedisObject{ObjType: RedisHash, Encoding: EncZipList, Ptr: []byte("ziplist")}
+	_, ok = broken.AsHash()
+	assert.False(t, ok)
+	_, err := StringObjEncoding(NewStringEmptyObj())
+	assert.Equal(t, ErrorEncodingType, err)
+}
@@ -25,6 +25,18 @@ func (s *Sds) SdsCat(b []byte) {
 	}
 }
 
+// Compact 重新分配长度和内容相同的 Sds, 释放多余的容量, 返回释放的字节数
+func (s *Sds) Compact() int {
+	slack := s.Remining()
+	if slack == 0 {
+		return 0
+	}
+	bytes := make([]byte, s.Len())
+	copy(bytes, *s)
+	*s = bytes
+	return slack
+}
+
 func (s *Sds) Free() {
 	*s = nil
 }
@@ -56,3 +56,16 @@ func TestSds(t *testing.T) {
 		})
 	}
 }
+
+func TestSdsCompact(t *testing.T) {
+	s := append(make(Sds, 0, 64), "hello"...)
+	if reclaimed := s.Compact(); reclaimed != 59 {
+		t.Errorf("expected 59 bytes reclaimed, got %d", reclaimed)
+	}
+	if s.String() != "hello" || cap(s) != 5 {
+		t.Errorf("expected hello with cap 5, got %q with cap %d", s.String(), cap(s))
+	}
+	if reclaimed := s.Compact(); reclaimed != 0 {
+		t.Errorf("expected nothing reclaimed, got %d", reclaimed)
+	}
+}
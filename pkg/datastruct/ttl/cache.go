@@ -2,6 +2,8 @@ package ttl
 
 import (
 	"container/heap"
+	"github.com/xuning888/godis-tiny/pkg/clock"
+	"math/rand"
 	"time"
 )
 
@@ -26,6 +28,10 @@ type Cache interface {
 	Peek() *Item
 	// Clear 清空ttl缓存
 	Clear()
+	// RandomKeys 随机返回 limit 个设置了过期时间的key, 可能重复
+	RandomKeys(limit int) []string
+	// AvgTTL 平均剩余的过期时间, key 超过 samples 个时随机抽取 samples 个估算. 已经过期还没有删除的key不计入, 没有时返回0
+	AvgTTL(samples int) time.Duration
 }
 
 type SimpleCache struct {
@@ -33,6 +39,8 @@ type SimpleCache struct {
 	ttlMap map[string]*Item
 	// ttlHeap, 使用小根堆，按照expireTime排队
 	heap ttlHeap
+	// clock IsExpired 比较的当前时间
+	clock clock.Clock
 }
 
 func (s *SimpleCache) Peek() *Item {
@@ -60,7 +68,7 @@ func (s *SimpleCache) Expire(key string, expireTime time.Time) {
 func (s *SimpleCache) IsExpired(key string) (expired bool, exists bool) {
 	item, ok := s.ttlMap[key]
 	if ok {
-		return time.Now().UnixMilli() > item.ExpireTimestamp, true
+		return s.clock.Now().UnixMilli() > item.ExpireTimestamp, true
 	}
 	return false, false
 }
@@ -101,11 +109,54 @@ func (s *SimpleCache) Clear() {
 	s.ttlMap = make(map[string]*Item)
 }
 
-func MakeSimple() *SimpleCache {
+func (s *SimpleCache) RandomKeys(limit int) []string {
+	if len(s.heap) == 0 {
+		return nil
+	}
+	result := make([]string, limit)
+	for i := 0; i < limit; i++ {
+		result[i] = s.heap[rand.Intn(len(s.heap))].Key
+	}
+	return result
+}
+
+func (s *SimpleCache) AvgTTL(samples int) time.Duration {
+	if len(s.heap) == 0 || samples <= 0 {
+		return 0
+	}
+	now := s.clock.Now().UnixMilli()
+	var sum, count int64
+	add := func(item *Item) {
+		if ttl := item.ExpireTimestamp - now; ttl > 0 {
+			sum += ttl
+			count++
+		}
+	}
+	if len(s.heap) <= samples {
+		for _, item := range s.heap {
+			add(item)
+		}
+	} else {
+		for i := 0; i < samples; i++ {
+			add(s.heap[rand.Intn(len(s.heap))])
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return time.Duration(sum/count) * time.Millisecond
+}
+
+// MakeSimple 按照 c 的时间判断是否过期, c 为 nil 时使用系统时钟
+func MakeSimple(c clock.Clock) *SimpleCache {
+	if c == nil {
+		c = clock.Real
+	}
 	h := make(ttlHeap, 0)
 	heap.Init(&h)
 	return &SimpleCache{
 		ttlMap: make(map[string]*Item),
 		heap:   h,
+		clock:  c,
 	}
 }
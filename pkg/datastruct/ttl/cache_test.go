@@ -2,6 +2,8 @@ package ttl
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/clock"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -11,7 +13,8 @@ func TestTTLCache(t *testing.T) {
 	assert.Nil(t, err)
 	t.Logf("loc: %v", location)
 	baseTime := time.Now()
-	ttlCache := MakeSimple()
+	c := clock.NewManual(baseTime)
+	ttlCache := MakeSimple(c)
 	ttlCache.Expire("1", baseTime.Add(time.Second*time.Duration(1)))
 	ttlCache.Expire("2", baseTime.Add(time.Second*time.Duration(2)))
 	ttlCache.Expire("3", baseTime.Add(time.Second*time.Duration(3)))
@@ -25,14 +28,15 @@ func TestTTLCache(t *testing.T) {
 	assert.Equal(t, baseTime.Add(time.Second*time.Duration(3)).UnixMilli(), ttlCache.ExpireAtTimestamp("3"))
 	assert.Equal(t, EmptyTime.UnixMilli(), ttlCache.ExpireAtTimestamp("4"))
 
-	baseTime2 := time.Now()
+	c.Advance(time.Millisecond)
+	baseTime2 := c.Now()
 	ttlCache.Expire("1", baseTime2.Add(time.Second*time.Duration(1)))
 	assert.Equal(t, baseTime2.Add(time.Second*time.Duration(1)), ttlCache.ExpireAt("1"))
 	assert.Equal(t, baseTime2.Add(time.Second*time.Duration(1)).UnixMilli(), ttlCache.ExpireAtTimestamp("1"))
 
 	assert.Equal(t, 3, ttlCache.Len())
 
-	time.Sleep(time.Second * time.Duration(1))
+	c.Advance(time.Second + time.Millisecond)
 	expired, exists := ttlCache.IsExpired("1")
 	if exists && expired {
 		ttlCache.Remove("1")
@@ -50,7 +54,7 @@ func TestTTLCache(t *testing.T) {
 	assert.False(t, expired)
 
 	// --------------------------
-	time.Sleep(time.Second * time.Duration(1))
+	c.Advance(time.Second + time.Millisecond)
 	expired, exists = ttlCache.IsExpired("1")
 	if exists && expired {
 		ttlCache.Remove("1")
@@ -68,7 +72,7 @@ func TestTTLCache(t *testing.T) {
 	assert.False(t, expired)
 
 	// --------------------------
-	time.Sleep(time.Second * time.Duration(1))
+	c.Advance(time.Second + time.Millisecond)
 	expired, exists = ttlCache.IsExpired("1")
 	if exists && expired {
 		ttlCache.Remove("1")
@@ -87,3 +91,29 @@ func TestTTLCache(t *testing.T) {
 
 	assert.Equal(t, 0, ttlCache.Len())
 }
+
+func TestAvgTTL(t *testing.T) {
+	baseTime := time.Now()
+	c := clock.NewManual(baseTime)
+	ttlCache := MakeSimple(c)
+	assert.Equal(t, time.Duration(0), ttlCache.AvgTTL(10))
+
+	// key 不超过 samples 个时计算所有的key
+	for i := 1; i <= 9; i++ {
+		ttlCache.Expire(strconv.Itoa(i), baseTime.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, 5*time.Second, ttlCache.AvgTTL(10))
+	// 已经过期的key不计入
+	c.Advance(1500 * time.Millisecond)
+	assert.Equal(t, 4*time.Second, ttlCache.AvgTTL(10))
+
+	// 1000 个key的剩余时间均匀分布在 1..1000 秒, 抽样估算
+	ttlCache.Clear()
+	now := c.Now()
+	for i := 1; i <= 1000; i++ {
+		ttlCache.Expire(strconv.Itoa(i), now.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, 1000, ttlCache.Len())
+	avg := ttlCache.AvgTTL(100)
+	assert.InDelta(t, float64(500*time.Second), float64(avg), float64(100*time.Second))
+}
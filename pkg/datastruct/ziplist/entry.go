@@ -0,0 +1,142 @@
+package ziplist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// zlHeaderSize zlbytes(4) zltail(4) zllen(2), 第一个 entry 的位置
+const zlHeaderSize = 10
+
+// CorruptedError ziplist 的内容不合法, Pos 是出错的 entry 在 ziplist 中的位置
+type CorruptedError struct {
+	Pos    int
+	Reason string
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("corrupted ziplist entry at %d: %s", e.Pos, e.Reason)
+}
+
+func corrupted(pos int, format string, args ...interface{}) error {
+	return &CorruptedError{Pos: pos, Reason: fmt.Sprintf(format, args...)}
+}
+
+// entry 解码之后的 entry 头部: prevlen(1或5字节) encoding(1, 2或5字节) payload
+type entry struct {
+	b           []byte
+	pos         int
+	prevLen     int
+	prevLenSize int
+	encoding    byte
+	// headerSize prevlen 和 encoding 一共的字节数
+	headerSize  int
+	payloadSize int
+}
+
+// decodeEntry 解码 b[pos:] 开始的 entry 头部, 每一次读取都检查边界, 不合法时返回 *CorruptedError
+func decodeEntry(b []byte, pos int) (entry, error) {
+	e := entry{b: b, pos: pos}
+	if pos < 0 || pos >= len(b) {
+		return e, corrupted(pos, "entry out of bounds")
+	}
+	if b[pos] == zlEnd {
+		return e, corrupted(pos, "unexpected end of ziplist")
+	}
+	if b[pos] < 254 {
+		e.prevLen, e.prevLenSize = int(b[pos]), 1
+	} else {
+		if pos+5 > len(b) {
+			return e, corrupted(pos, "truncated prevlen")
+		}
+		e.prevLen, e.prevLenSize = int(binary.LittleEndian.Uint32(b[pos+1:pos+5])), 5
+	}
+
+	p := pos + e.prevLenSize
+	if p >= len(b) {
+		return e, corrupted(pos, "missing encoding")
+	}
+	e.encoding = b[p]
+	lenSize := 1
+	switch e.encoding >> 6 {
+	case 0:
+		e.payloadSize = int(e.encoding & 0x3F)
+	case 1:
+		if p+2 > len(b) {
+			return e, corrupted(pos, "truncated 14 bit length")
+		}
+		lenSize, e.payloadSize = 2, int(e.encoding&0x3F)<<8|int(b[p+1])
+	case 2:
+		if p+5 > len(b) {
+			return e, corrupted(pos, "truncated 32 bit length")
+		}
+		lenSize = 5
+		e.payloadSize = int(e.encoding&0x3F)<<32 | int(binary.BigEndian.Uint32(b[p+1:p+5]))
+	default:
+		switch {
+		case e.encoding == encInt8:
+			e.payloadSize = 1
+		case e.encoding == encInt16:
+			e.payloadSize = 2
+		case e.encoding == encInt24:
+			e.payloadSize = 3
+		case e.encoding == encInt32:
+			e.payloadSize = 4
+		case e.encoding == encInt64:
+			e.payloadSize = 8
+		case e.encoding > encInt8Embed && e.encoding < encInt8:
+			e.payloadSize = 0
+		default:
+			return e, corrupted(pos, "invalid encoding 0x%02x", e.encoding)
+		}
+	}
+	e.headerSize = e.prevLenSize + lenSize
+	// 先和剩下的长度比较, 避免很大的长度溢出
+	if e.payloadSize > len(b)-pos-e.headerSize {
+		return e, corrupted(pos, "payload of %d bytes out of bounds", e.payloadSize)
+	}
+	return e, nil
+}
+
+// entrySize 整个 entry 的字节数, 用来跳到下一个 entry
+func (e entry) entrySize() int {
+	return e.headerSize + e.payloadSize
+}
+
+func (e entry) isInt() bool {
+	return e.encoding>>6 == 3
+}
+
+func (e entry) payload() []byte {
+	start := e.pos + e.headerSize
+	return e.b[start : start+e.payloadSize]
+}
+
+// intValue 整数编码的值, 除了 4 位的立即数都是大端
+func (e entry) intValue() int64 {
+	p := e.payload()
+	switch e.encoding {
+	case encInt8:
+		return int64(int8(p[0]))
+	case encInt16:
+		return int64(int16(binary.BigEndian.Uint16(p)))
+	case encInt24:
+		return int64(int32(uint32(p[0])<<24|uint32(p[1])<<16|uint32(p[2])<<8) >> 8)
+	case encInt32:
+		return int64(int32(binary.BigEndian.Uint32(p)))
+	case encInt64:
+		return int64(binary.BigEndian.Uint64(p))
+	default:
+		// 0xF1 到 0xFD 表示 0 到 12
+		return int64(e.encoding&0x0F) - 1
+	}
+}
+
+// value 需要的时候才解码 entry 的值, 返回的是副本
+func (e entry) value() []byte {
+	if e.isInt() {
+		return strconv.AppendInt(nil, e.intValue(), 10)
+	}
+	return append([]byte{}, e.payload()...)
+}
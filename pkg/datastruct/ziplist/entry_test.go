@@ -0,0 +1,97 @@
+package ziplist
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEntry(t *testing.T) {
+	long14 := strings.Repeat("a", 300)
+	long32 := strings.Repeat("b", 1<<14)
+	prevLen5 := []byte{254, 0x00, 0x01, 0x00, 0x00}
+	cases := []struct {
+		name        string
+		data        []byte
+		prevLen     int
+		prevLenSize int
+		headerSize  int
+		payloadSize int
+		value       string
+	}{
+		{"raw6", []byte{3, 0x03, 'a', 'b', 'c'}, 3, 1, 2, 3, "abc"},
+		{"raw6 empty", []byte{0, 0x00}, 0, 1, 2, 0, ""},
+		{"raw6 max", append([]byte{0, 0x3F}, strings.Repeat("c", 63)...), 0, 1, 2, 63, strings.Repeat("c", 63)},
+		{"raw14", append([]byte{0, 0x41, 0x2C}, long14...), 0, 1, 3, 300, long14},
+		{"raw32", append([]byte{0, 0x80, 0x00, 0x00, 0x40, 0x00}, long32...), 0, 1, 6, 1 << 14, long32},
+		{"prevlen 5 bytes", append(prevLen5, 0x01, 'x'), 256, 5, 6, 1, "x"},
+		{"embed 0", []byte{0, 0xF1}, 0, 1, 2, 0, "0"},
+		{"embed 12", []byte{0, 0xFD}, 0, 1, 2, 0, "12"},
+		{"int8", []byte{0, encInt8, 0x80}, 0, 1, 2, 1, "-128"},
+		{"int16", []byte{0, encInt16, 0x80, 0x00}, 0, 1, 2, 2, "-32768"},
+		{"int24", []byte{0, encInt24, 0xFF, 0xFF, 0xFE}, 0, 1, 2, 3, "-2"},
+		{"int24 positive", []byte{0, encInt24, 0x7F, 0xFF, 0xFF}, 0, 1, 2, 3, "8388607"},
+		{"int32", []byte{0, encInt32, 0x7F, 0xFF, 0xFF, 0xFF}, 0, 1, 2, 4, "2147483647"},
+		{"int64", []byte{0, encInt64, 0x80, 0, 0, 0, 0, 0, 0, 0}, 0, 1, 2, 8, "-9223372036854775808"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// 后面的字节属于下一个 entry, 不影响解码
+			data := append(append([]byte{}, c.data...), 0x00, zlEnd)
+			e, err := decodeEntry(data, 0)
+			require.NoError(t, err)
+			assert.Equal(t, c.prevLen, e.prevLen)
+			assert.Equal(t, c.prevLenSize, e.prevLenSize)
+			assert.Equal(t, c.headerSize, e.headerSize)
+			assert.Equal(t, c.payloadSize, e.payloadSize)
+			assert.Equal(t, len(c.data), e.entrySize())
+			assert.Equal(t, c.value, string(e.value()))
+		})
+	}
+}
+
+func TestDecodeEntryCorrupted(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		pos  int
+	}{
+		{"out of bounds", []byte{0, 0x01, 'a'}, 3},
+		{"negative position", []byte{0, 0x01, 'a'}, -1},
+		{"end marker", []byte{zlEnd}, 0},
+		{"truncated prevlen", []byte{254, 0x00, 0x01}, 0},
+		{"missing encoding", []byte{0}, 0},
+		{"truncated 14 bit length", []byte{0, 0x41}, 0},
+		{"truncated 32 bit length", []byte{0, 0x80, 0x00, 0x00}, 0},
+		{"raw payload", []byte{0, 0x05, 'a', 'b'}, 0},
+		{"huge 32 bit length", []byte{0, 0xBF, 0xFF, 0xFF, 0xFF, 0xFF}, 0},
+		{"int payload", []byte{0, encInt64, 0x01, 0x02}, 0},
+		{"invalid int encoding", []byte{0, 0xC1, 0x00, 0x00}, 0},
+		{"invalid embed encoding", []byte{0, zlEnd}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := decodeEntry(c.data, c.pos)
+			var corruptedErr *CorruptedError
+			require.True(t, errors.As(err, &corruptedErr), "%v", err)
+			assert.Equal(t, c.pos, corruptedErr.Pos)
+		})
+	}
+}
+
+func TestIndexCorrupted(t *testing.T) {
+	zl := NewZipList()
+	zl.PushBack([]byte("a"))
+	zl.PushBack([]byte("b"))
+	// 截断第二个 entry, zllen 仍然是 2
+	zl.buff.Truncate(zl.buff.Len() - 2)
+	value, err := zl.Index(0)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(value))
+	_, err = zl.Index(1)
+	var corruptedErr *CorruptedError
+	assert.True(t, errors.As(err, &corruptedErr), "%v", err)
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"math"
 	"strconv"
 )
@@ -93,105 +92,17 @@ func (zl *ZipList) Index(index int) ([]byte, error) {
 		return nil, ErrorOutOfRange
 	}
 	b := zl.buff.Bytes()
-	datas := b[10:]
-	pos := 0
-	for i := 0; i <= index; i++ {
-		prevLen := int(datas[pos])
-		if prevLen == 0 || prevLen < 254 {
-			pos++
-		} else {
-			pos++
-			if pos+4 < len(datas) {
-				prevLen = int(binary.LittleEndian.Uint32(datas[pos : pos+4]))
-				pos += 4
-			}
+	pos := zlHeaderSize
+	for i := 0; ; i++ {
+		e, err := decodeEntry(b, pos)
+		if err != nil {
+			return nil, err
 		}
-		reqLen := datas[pos]
-		if (reqLen >> 4) == 0x00 {
-			reqLen = reqLen & 0x3f
-			pos++
-			if i == index {
-				return append([]byte{}, datas[pos:pos+int(reqLen)]...), nil
-			}
-			pos += int(reqLen)
-		} else if reqLen == encInt8 {
-			pos++
-			if i == index {
-				byteValue := datas[pos]
-				return []byte(fmt.Sprintf("%d", int8(byteValue))), nil
-			}
-			pos++
-		} else if reqLen>>4 == 0x0F && reqLen<<4 != 0 {
-			if i == index {
-				reqLen = reqLen & 0x0F
-				return []byte(fmt.Sprintf("%d", reqLen)), nil
-			}
-			pos++
-		} else if reqLen == encInt16 {
-			pos++
-			if i == index {
-				dataInt16 := int16(datas[pos])<<8 | int16(datas[pos+1])
-				return []byte(fmt.Sprintf("%d", dataInt16)), nil
-			}
-			pos += 2
-		} else if reqLen == encInt24 {
-			pos++
-			if i == index {
-				dataInt24 := int32(datas[pos])<<16 | int32(datas[pos+1])<<8 | int32(datas[pos+2])
-				// 检查符号位（第 23 位）
-				if dataInt24&0x800000 != 0 {
-					// 如果符号位为 1，则进行符号扩展
-					dataInt24 |= ^0xFFFFFF
-				}
-				return []byte(fmt.Sprintf("%d", dataInt24)), nil
-			}
-			pos += 3
-		} else if reqLen == encInt32 {
-			pos++
-			if i == index {
-				dataInt32 := int32(datas[pos])<<24 | int32(datas[pos+1])<<16 | int32(datas[pos+2])<<8 | int32(datas[pos+3])
-				return []byte(fmt.Sprintf("%d", dataInt32)), nil
-			}
-			pos += 4
-		} else if reqLen == encInt64 {
-			pos++
-			if i == index {
-				dataInt64 := int64(datas[pos])<<56 | int64(datas[pos+1])<<48 |
-					int64(datas[pos+2])<<40 | int64(datas[pos+3])<<32 |
-					int64(datas[pos+4])<<24 | int64(datas[pos+5])<<16 |
-					int64(datas[pos+6])<<8 | int64(datas[pos+7])
-				return []byte(fmt.Sprintf("%d", dataInt64)), nil
-			}
-			pos += 8
-		} else if reqLen>>6 == 0x01 {
-			high, low := datas[pos]&0x3F, datas[pos+1]
-			length := int16(high)<<8 | int16(low)
-			pos += 2
-			if i == index {
-				byteb := datas[pos : pos+int(length)]
-				return append([]byte{}, byteb...), nil
-			}
-			pos += int(length)
-		} else if reqLen>>7 == 0x01 {
-			firstByte := datas[pos] & 0x7F
-			secondByte := datas[pos+1]
-			thirdByte := datas[pos+2]
-			fourthByte := datas[pos+3]
-			fifthByte := datas[pos+4]
-			pos += 5
-			length := int(firstByte)<<32 |
-				int(secondByte)<<24 |
-				int(thirdByte)<<16 |
-				int(fourthByte)<<8 |
-				int(fifthByte)
-			if i == index {
-				byteb := datas[pos : pos+int(length)]
-				return append([]byte{}, byteb...), nil
-			}
-			pos += length
+		if i == index {
+			return e.value(), nil
 		}
+		pos += e.entrySize()
 	}
-	return nil, nil
 }
 
 func (zl *ZipList) Len() int {
@@ -230,7 +141,8 @@ func encodePrevLen(prevLen int, buff *bytes.Buffer) error {
 func encodeInt(value int, buff *bytes.Buffer) {
 	if value >= math.MinInt8 && value <= math.MaxInt8 {
 		if value >= 0 && value <= 12 {
-			buff.WriteByte(encInt8Embed | byte(value))
+			// 0xF0 是 int24, 立即数从 0xF1 开始
+			buff.WriteByte(encInt8Embed | byte(value+1))
 		} else {
 			buff.WriteByte(encInt8)
 			buff.WriteByte(byte(value))
@@ -96,6 +96,20 @@ func TestPushBack_Raw(t *testing.T) {
 	}
 }
 
+func TestPushBack_Boundaries(t *testing.T) {
+	// 0 不能和 int24 的编码混在一起, 16 到 63 字节的字符串也是 6 位长度
+	values := []string{"0", "12", "13", "-1", buildStr(16), buildStr(62), buildStr(63), buildStr(64), "0"}
+	zllist := NewZipList()
+	for _, value := range values {
+		assert.NoError(t, zllist.PushBack([]byte(value)))
+	}
+	for i, expected := range values {
+		actual, err := zllist.Index(i)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(actual))
+	}
+}
+
 func buildStr(n int) string {
 	sbd := strings.Builder{}
 	for i := 0; i < n; i++ {
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	// Disabled 不输出日志
+	Disabled
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "disabled"}
+
+func (l Level) String() string {
+	if l >= DebugLevel && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+var level = int32(InfoLevel)
+
+// SetLevel 修改所有 logger 的级别, 可以在运行时调用
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// Enabled 这个级别的日志是否输出
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+// ParseLevel 与 redis 的 loglevel 一致: debug, verbose, notice, warning, nothing, 也接受 info, warn 和 error
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug", "verbose":
+		return DebugLevel, nil
+	case "notice", "info":
+		return InfoLevel, nil
+	case "warning", "warn":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	case "nothing":
+		return Disabled, nil
+	default:
+		return InfoLevel, fmt.Errorf("invalid log level %q", name)
+	}
+}
@@ -4,30 +4,92 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
-var globalLogger *zap.Logger
+// holder atomic.Value 要求每次存入相同的具体类型
+type holder struct {
+	lg Logger
+}
+
+var global atomic.Value
+
+func init() {
+	global.Store(holder{lg: NewStd(os.Stderr)})
+}
 
+func current() Logger {
+	return global.Load().(holder).lg
+}
+
+// InitLogger 使用 zap 输出到 stderr
 func InitLogger() {
 	lgCfg := DefaultZapLoggerConfig
-	logger, err := lgCfg.Build()
+	lg, err := lgCfg.Build()
 	if err != nil {
 		panic(fmt.Errorf("init logger failed: %w", err))
 	}
-	zap.ReplaceGlobals(logger)
-	globalLogger = logger
+	zap.ReplaceGlobals(lg)
+	SetLogger(Zap(lg))
 }
 
+// SetLogger 使用调用方的 logger, 之后 Named 创建的 logger 都输出到它. 没有设置时使用 NewStd(os.Stderr)
+func SetLogger(lg Logger) {
+	global.Store(holder{lg: lg})
+}
+
+// namer 可以按照名字区分模块的 logger, 比如 zap, 其他的实现使用 logger 字段
+type namer interface {
+	Named(name string) Logger
+}
+
+// Named 模块使用的 logger, 按照 SetLevel 的级别过滤
 func Named(name string) Logger {
-	sugar := globalLogger.Named(name).Sugar()
-	return sugar
+	lg := current()
+	if n, ok := lg.(namer); ok {
+		return leveled{lg: n.Named(name)}
+	}
+	return leveled{lg: lg.With("logger", name)}
+}
+
+// leveled 在调用实现之前按照级别过滤
+type leveled struct {
+	lg Logger
 }
 
-var DefaultLevel = zap.InfoLevel
+func (l leveled) Debugf(format string, args ...interface{}) {
+	if Enabled(DebugLevel) {
+		l.lg.Debugf(format, args...)
+	}
+}
+
+func (l leveled) Infof(format string, args ...interface{}) {
+	if Enabled(InfoLevel) {
+		l.lg.Infof(format, args...)
+	}
+}
+
+func (l leveled) Warnf(format string, args ...interface{}) {
+	if Enabled(WarnLevel) {
+		l.lg.Warnf(format, args...)
+	}
+}
+
+func (l leveled) Errorf(format string, args ...interface{}) {
+	if Enabled(ErrorLevel) {
+		l.lg.Errorf(format, args...)
+	}
+}
+
+func (l leveled) With(keysAndValues ...interface{}) Logger {
+	return leveled{lg: l.lg.With(keysAndValues...)}
+}
 
+// DefaultZapLoggerConfig InitLogger 使用的配置, 输出所有级别, 由 SetLevel 过滤
 var DefaultZapLoggerConfig = zap.Config{
-	Level:       zap.NewAtomicLevelAt(DefaultLevel),
+	Level:       zap.NewAtomicLevelAt(zap.DebugLevel),
 	Development: true,
 	Sampling: &zap.SamplingConfig{
 		Initial:    100,
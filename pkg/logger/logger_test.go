@@ -0,0 +1,42 @@
+package logger
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestNamedLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetLogger(NewStd(buf))
+	defer SetLogger(NewStd(&bytes.Buffer{}))
+	defer SetLevel(GetLevel())
+
+	lg := Named("test").With("addr", "127.0.0.1:6379")
+	SetLevel(InfoLevel)
+	lg.Debugf("hidden")
+	lg.Infof("hello %s", "world")
+	SetLevel(DebugLevel)
+	lg.Debugf("shown")
+	SetLevel(Disabled)
+	lg.Errorf("hidden")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], "\tinfo\thello world\tlogger=test\taddr=127.0.0.1:6379"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "\tdebug\tshown\tlogger=test\taddr=127.0.0.1:6379"), lines[1])
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{
+		"debug": DebugLevel, "verbose": DebugLevel, "notice": InfoLevel, "WARNING": WarnLevel, "nothing": Disabled,
+	} {
+		level, err := ParseLevel(name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, level, name)
+	}
+	_, err := ParseLevel("loud")
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stdLogger 没有依赖的默认实现, 每条日志一行: 时间 级别 模块 内容 key=value...
+type stdLogger struct {
+	mux    *sync.Mutex
+	w      io.Writer
+	fields string
+}
+
+// NewStd 把日志写到 w, 比如 os.Stderr
+func NewStd(w io.Writer) Logger {
+	return &stdLogger{mux: &sync.Mutex{}, w: w}
+}
+
+func (l *stdLogger) log(level Level, format string, args []interface{}) {
+	line := time.Now().Format("2006-01-02 15:04:05.000") + "\t" + level.String() + "\t" + fmt.Sprintf(format, args...) +
+		l.fields + "\n"
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	_, _ = io.WriteString(l.w, line)
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.log(DebugLevel, format, args)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.log(InfoLevel, format, args)
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.log(WarnLevel, format, args)
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args)
+}
+
+func (l *stdLogger) With(keysAndValues ...interface{}) Logger {
+	builder := strings.Builder{}
+	builder.WriteString(l.fields)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		builder.WriteByte('\t')
+		if i+1 == len(keysAndValues) {
+			// 缺少 value 的 key 与 zap 一样单独输出
+			fmt.Fprintf(&builder, "%v", keysAndValues[i])
+			break
+		}
+		fmt.Fprintf(&builder, "%v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	return &stdLogger{mux: l.mux, w: l.w, fields: builder.String()}
+}
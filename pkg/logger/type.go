@@ -1,58 +1,61 @@
 package logger
 
+import "os"
+
+// Logger 服务使用的日志接口, 可以通过 SetLogger 替换成调用方的实现.
+// 级别由 SetLevel 统一控制, 实现不需要自己过滤
 type Logger interface {
 	// Debugf logs messages at DEBUG level.
 	Debugf(format string, args ...interface{})
 	// Infof logs messages at INFO level.
 	Infof(format string, args ...interface{})
-	// Info logs messages at INFO level.
-	Info(args ...interface{})
 	// Warnf logs messages at WARN level.
 	Warnf(format string, args ...interface{})
 	// Errorf logs messages at ERROR level.
 	Errorf(format string, args ...interface{})
-	// Error logs messages at ERROR level.
-	Error(args ...interface{})
-	// Fatalf logs messages at FATAL level.
-	Fatalf(format string, args ...interface{})
-	// Sync sync
-	Sync() error
+	// With 返回带有字段的 logger, keysAndValues 按照 key, value 依次排列, 比如 With("addr", "127.0.0.1:6379")
+	With(keysAndValues ...interface{}) Logger
 }
 
 // Debugf logs messages at DEBUG level.
 func Debugf(format string, args ...interface{}) {
-	globalLogger.Sugar().Debugf(format, args)
+	if Enabled(DebugLevel) {
+		current().Debugf(format, args...)
+	}
 }
 
 // Infof logs messages at INFO level.
 func Infof(format string, args ...interface{}) {
-	globalLogger.Sugar().Infof(format, args)
-}
-
-func Info(args ...interface{}) {
-	globalLogger.Sugar().Info(args)
+	if Enabled(InfoLevel) {
+		current().Infof(format, args...)
+	}
 }
 
 // Warnf logs messages at WARN level.
 func Warnf(format string, args ...interface{}) {
-	globalLogger.Sugar().Warnf(format, args)
+	if Enabled(WarnLevel) {
+		current().Warnf(format, args...)
+	}
 }
 
 // Errorf logs messages at ERROR level.
 func Errorf(format string, args ...interface{}) {
-	globalLogger.Sugar().Errorf(format, args)
-}
-
-func Error(args ...interface{}) {
-	globalLogger.Sugar().Error(args)
+	if Enabled(ErrorLevel) {
+		current().Errorf(format, args...)
+	}
 }
 
-// Fatalf logs messages at FATAL level.
+// Fatalf 记录错误之后退出进程
 func Fatalf(format string, args ...interface{}) {
-	globalLogger.Sugar().Fatalf(format, args)
+	current().Errorf(format, args...)
+	_ = Sync()
+	os.Exit(1)
 }
 
-// Sync sync
+// Sync 写入缓冲的日志, 只对实现了 Sync 的 logger 有效
 func Sync() error {
-	return globalLogger.Sugar().Sync()
+	if syncer, ok := current().(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
 }
@@ -0,0 +1,42 @@
+package logger
+
+import "go.uber.org/zap"
+
+// zapLogger 把 Logger 转换成 zap 的调用, 模块的名字使用 zap 的 Named
+type zapLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+// Zap 使用 zap 输出日志, 比如 SetLogger(Zap(zap.NewExample()))
+func Zap(lg *zap.Logger) Logger {
+	// 跳过 leveled 和 zapLogger, caller 是调用 logger 的位置
+	return &zapLogger{sugar: lg.WithOptions(zap.AddCallerSkip(2)).Sugar()}
+}
+
+func (l *zapLogger) Debugf(format string, args ...interface{}) {
+	l.sugar.Debugf(format, args...)
+}
+
+func (l *zapLogger) Infof(format string, args ...interface{}) {
+	l.sugar.Infof(format, args...)
+}
+
+func (l *zapLogger) Warnf(format string, args ...interface{}) {
+	l.sugar.Warnf(format, args...)
+}
+
+func (l *zapLogger) Errorf(format string, args ...interface{}) {
+	l.sugar.Errorf(format, args...)
+}
+
+func (l *zapLogger) With(keysAndValues ...interface{}) Logger {
+	return &zapLogger{sugar: l.sugar.With(keysAndValues...)}
+}
+
+func (l *zapLogger) Named(name string) Logger {
+	return &zapLogger{sugar: l.sugar.Named(name)}
+}
+
+func (l *zapLogger) Sync() error {
+	return l.sugar.Sync()
+}
@@ -0,0 +1,167 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"io"
+	"sort"
+)
+
+// CmdLine 重建一个key需要执行的一条命令
+type CmdLine = [][]byte
+
+// typeCodec 一种数据类型的序列化方式. RDB 的写入和加载, aof 重写以及 DUMP/RESTORE 都通过注册的 codec 处理,
+// 新的数据类型只需要注册一次
+type typeCodec struct {
+	objType obj.ObjectType
+	// rdbTypes 可以加载的 rdb 对象类型, 第一个是写入时默认的类型
+	rdbTypes []byte
+	// rdbType 写入时使用的 rdb 对象类型, 为空时使用 rdbTypes[0]
+	rdbType func(value *obj.RedisObject) byte
+	// encode 写入对象的值, 不包括对象类型
+	encode func(e *Encoder, value *obj.RedisObject) error
+	// decode 读取 rdb 对象类型为 typ 的值
+	decode func(d *decoder, typ byte) (*obj.RedisObject, error)
+	// rewrite 按照顺序生成重建 key 的命令
+	rewrite func(key string, value *obj.RedisObject, emit func(CmdLine))
+}
+
+var (
+	codecsByObjType = make(map[obj.ObjectType]*typeCodec)
+	codecsByRdbType = make(map[byte]*typeCodec)
+)
+
+// unsupportedTypes 可以识别但是还不支持的 rdb 对象类型
+var unsupportedTypes = map[byte]string{
+	typeZSet:            "zset",
+	typeZSet2:           "zset",
+	typeZSetZiplist:     "zset",
+	typeZSetListpack:    "zset",
+	typeHashZipmap:      "zipmap",
+	typeStreamListpacks: "stream",
+	typeModule:          "module",
+	typeModule2:         "module",
+}
+
+func registerCodec(c *typeCodec) {
+	if _, ok := codecsByObjType[c.objType]; ok {
+		panic("rdb: duplicate codec for " + obj.ObjectTypeName(c.objType))
+	}
+	codecsByObjType[c.objType] = c
+	for _, typ := range c.rdbTypes {
+		if _, ok := codecsByRdbType[typ]; ok {
+			panic(fmt.Sprintf("rdb: duplicate codec for object type opcode %d", typ))
+		}
+		codecsByRdbType[typ] = c
+	}
+}
+
+// ObjectTypes 注册了 codec 的对象类型
+func ObjectTypes() []obj.ObjectType {
+	types := make([]obj.ObjectType, 0, len(codecsByObjType))
+	for objType := range codecsByObjType {
+		types = append(types, objType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types
+}
+
+func objCodec(value *obj.RedisObject) (*typeCodec, error) {
+	c, ok := codecsByObjType[value.ObjType]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnsupported, obj.ObjectTypeName(value.ObjType))
+	}
+	return c, nil
+}
+
+func rdbCodec(typ byte) (*typeCodec, error) {
+	c, ok := codecsByRdbType[typ]
+	if ok {
+		return c, nil
+	}
+	if name, ok := unsupportedTypes[typ]; ok {
+		return nil, fmt.Errorf("%w %s (opcode %d)", ErrUnsupported, name, typ)
+	}
+	return nil, fmt.Errorf("%w: unknown object type opcode %d", ErrUnsupported, typ)
+}
+
+func (c *typeCodec) typeOf(value *obj.RedisObject) byte {
+	if c.rdbType != nil {
+		return c.rdbType(value)
+	}
+	return c.rdbTypes[0]
+}
+
+// RewriteCommands aof 重写时重建 key 需要的命令, 不包括过期时间
+func RewriteCommands(key string, value *obj.RedisObject, emit func(CmdLine)) error {
+	c, err := objCodec(value)
+	if err != nil {
+		return err
+	}
+	c.rewrite(key, value, emit)
+	return nil
+}
+
+// ErrDumpPayload RESTORE 的数据版本太高或者校验和错误
+var ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// DumpValue DUMP 的格式, 对象类型和值之后是2个字节的 rdb 版本和8个字节的 crc64
+func DumpValue(value *obj.RedisObject) ([]byte, error) {
+	c, err := objCodec(value)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	e := NewEncoder(buf)
+	if err = e.writeByte(c.typeOf(value)); err != nil {
+		return nil, err
+	}
+	if err = c.encode(e, value); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint16(e.buf[:2], Version)
+	if err = e.write(e.buf[:2]); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(e.buf[:8], e.crc)
+	buf.Write(e.buf[:8])
+	return buf.Bytes(), nil
+}
+
+// RestoreValue 校验 DUMP 数据的版本和 crc64, 然后解析出对象
+func RestoreValue(payload []byte) (*obj.RedisObject, error) {
+	if len(payload) < 10 {
+		return nil, ErrDumpPayload
+	}
+	footer := payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(footer)
+	sum := binary.LittleEndian.Uint64(footer[2:])
+	// 和 rdb 文件不同, DUMP 的校验和不能为0
+	if version > maxVersion || sum != crc64(0, payload[:len(payload)-8]) {
+		return nil, ErrDumpPayload
+	}
+	d := &decoder{r: bufio.NewReader(bytes.NewReader(payload[:len(payload)-10])), version: int(version)}
+	typ, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	c, err := rdbCodec(typ)
+	if err != nil {
+		return nil, err
+	}
+	value, err := c.decode(d, typ)
+	if err != nil {
+		return nil, err
+	}
+	// 值后面不能有多余的数据
+	if _, err = d.r.ReadByte(); err != io.EOF {
+		return nil, ErrCorrupted
+	}
+	return value, nil
+}
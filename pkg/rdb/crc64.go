@@ -0,0 +1,28 @@
+package rdb
+
+// redis 使用的 crc64 (Jones 多项式, 输入输出反转, 初始值为0)
+// go 标准库的 crc64 在计算前后会取反, 结果和 redis 不一致
+const crc64Poly = 0x95ac9329ac4bc9b5
+
+var crc64Table = func() *[256]uint64 {
+	table := &[256]uint64{}
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ crc64Poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
@@ -0,0 +1,378 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Handler 接收 Decode 解析出来的数据
+type Handler interface {
+	// Aux 辅助字段
+	Aux(key, value []byte)
+	// Function FUNCTION LOAD 加载的函数库
+	Function(code []byte) error
+	// Entry 解析出来的key, expireAt 为nil表示没有过期时间, 已经过期的key也会返回
+	Entry(db int, key string, value *obj.RedisObject, expireAt *time.Time) error
+}
+
+type decoder struct {
+	r       *bufio.Reader
+	crc     uint64
+	version int
+	buf     [8]byte
+}
+
+// Decode 解析 RDB 文件, 支持 redis-server 写入的 string, list, set, hash 类型
+func Decode(r io.Reader, h Handler) error {
+	d := &decoder{r: bufio.NewReader(r)}
+	header := make([]byte, 9)
+	if err := d.readFull(header); err != nil {
+		return err
+	}
+	if string(header[:5]) != magic {
+		return ErrBadMagic
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > maxVersion {
+		return fmt.Errorf("rdb: can't handle RDB format version %s", header[5:])
+	}
+	d.version = version
+	db := 0
+	var expireAt *time.Time
+	for {
+		opcode, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case opExpireTime:
+			if err = d.readFull(d.buf[:4]); err != nil {
+				return err
+			}
+			t := time.Unix(int64(int32(binary.LittleEndian.Uint32(d.buf[:4]))), 0)
+			expireAt = &t
+			continue
+		case opExpireTimeMs:
+			if err = d.readFull(d.buf[:8]); err != nil {
+				return err
+			}
+			t := time.UnixMilli(int64(binary.LittleEndian.Uint64(d.buf[:8])))
+			expireAt = &t
+			continue
+		case opFreq:
+			// LFU 计数, 不使用
+			if _, err = d.readByte(); err != nil {
+				return err
+			}
+			continue
+		case opIdle:
+			// LRU 空闲时间, 不使用
+			if _, err = d.readLength(); err != nil {
+				return err
+			}
+			continue
+		case opSelectDB:
+			index, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			db = int(index)
+			continue
+		case opResizeDB:
+			if _, err = d.readLength(); err != nil {
+				return err
+			}
+			if _, err = d.readLength(); err != nil {
+				return err
+			}
+			continue
+		case opSlotInfo:
+			// 集群模式下每个slot的key的数量
+			for i := 0; i < 3; i++ {
+				if _, err = d.readLength(); err != nil {
+					return err
+				}
+			}
+			continue
+		case opAux:
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			h.Aux(key, value)
+			continue
+		case opFunction2:
+			code, err := d.readString()
+			if err != nil {
+				return err
+			}
+			if err = h.Function(code); err != nil {
+				return err
+			}
+			continue
+		case opFunctionPreGA, opModuleAux:
+			return fmt.Errorf("%w opcode %d", ErrUnsupported, opcode)
+		case opEOF:
+			return d.readChecksum()
+		}
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		value, err := d.readObject(opcode)
+		if err != nil {
+			return fmt.Errorf("rdb: load key %q failed: %w", key, err)
+		}
+		if err = h.Entry(db, string(key), value, expireAt); err != nil {
+			return err
+		}
+		expireAt = nil
+	}
+}
+
+// readChecksum 版本5之后 EOF 后面是8个字节的校验和, 0表示写入时关闭了校验
+func (d *decoder) readChecksum() error {
+	if d.version < 5 {
+		return nil
+	}
+	expected := d.crc
+	if _, err := io.ReadFull(d.r, d.buf[:8]); err != nil {
+		return err
+	}
+	sum := binary.LittleEndian.Uint64(d.buf[:8])
+	if sum != 0 && sum != expected {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func (d *decoder) readFull(p []byte) error {
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	d.crc = crc64(d.crc, p)
+	return nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	if err := d.readFull(d.buf[:1]); err != nil {
+		return 0, err
+	}
+	return d.buf[0], nil
+}
+
+// readLengthWithEncoding 返回长度, 或者 encoded 为 true 时返回字符串的特殊编码
+func (d *decoder) readLengthWithEncoding() (uint64, bool, error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case b>>6 == len6Bit:
+		return uint64(b & 0x3f), false, nil
+	case b>>6 == len14Bit:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case b == len32Bit:
+		if err = d.readFull(d.buf[:4]); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(d.buf[:4])), false, nil
+	case b == len64Bit:
+		if err = d.readFull(d.buf[:8]); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(d.buf[:8]), false, nil
+	case b>>6 == lenEncVal:
+		return uint64(b & 0x3f), true, nil
+	default:
+		return 0, false, ErrCorrupted
+	}
+}
+
+func (d *decoder) readLength() (uint64, error) {
+	length, encoded, err := d.readLengthWithEncoding()
+	if err == nil && encoded {
+		err = ErrCorrupted
+	}
+	return length, err
+}
+
+func (d *decoder) readString() ([]byte, error) {
+	length, encoded, err := d.readLengthWithEncoding()
+	if err != nil {
+		return nil, err
+	}
+	if encoded {
+		switch length {
+		case encInt8:
+			b, err := d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(nil, int64(int8(b)), 10), nil
+		case encInt16:
+			if err = d.readFull(d.buf[:2]); err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(d.buf[:2]))), 10), nil
+		case encInt32:
+			if err = d.readFull(d.buf[:4]); err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(d.buf[:4]))), 10), nil
+		case encLZF:
+			compressed, err := d.readLength()
+			if err != nil {
+				return nil, err
+			}
+			size, err := d.readLength()
+			if err != nil {
+				return nil, err
+			}
+			data, err := d.readBytes(compressed)
+			if err != nil {
+				return nil, err
+			}
+			return lzfDecompress(data, int(size))
+		default:
+			return nil, ErrCorrupted
+		}
+	}
+	return d.readBytes(length)
+}
+
+func (d *decoder) readBytes(length uint64) ([]byte, error) {
+	// 长度损坏的时候不要一次分配太多内存
+	if length > 1<<32 {
+		return nil, ErrCorrupted
+	}
+	p := make([]byte, length)
+	if err := d.readFull(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readStrings 读取长度和 n 个字符串
+func (d *decoder) readStrings(n int) ([][]byte, error) {
+	length, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	total := length * uint64(n)
+	items := make([][]byte, 0, minCap(total))
+	for i := uint64(0); i < total; i++ {
+		item, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// minCap 长度可能是损坏的, 预分配的空间不超过1024
+func minCap(length uint64) int {
+	if length > 1024 {
+		return 1024
+	}
+	return int(length)
+}
+
+// readObject 按照注册的 codec 读取对象类型为 typ 的值
+func (d *decoder) readObject(typ byte) (*obj.RedisObject, error) {
+	c, err := rdbCodec(typ)
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(d, typ)
+}
+
+// readPacked 读取一个字符串, 按照 ziplist, listpack 或者 intset 的格式解析
+func (d *decoder) readPacked(parse func([]byte) ([][]byte, error)) ([][]byte, error) {
+	data, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+// readQuicklist quicklist 的每个节点是一个 ziplist, quicklist2 的每个节点是 listpack 或者单个元素
+func (d *decoder) readQuicklist(typ byte) ([][]byte, error) {
+	nodes, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	items := make([][]byte, 0)
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(quicklistNodePacked)
+		if typ == typeListQuicklist2 {
+			if container, err = d.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		data, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if container == quicklistNodePlain {
+			items = append(items, data)
+			continue
+		}
+		var entries [][]byte
+		if typ == typeListQuicklist2 {
+			entries, err = parseListpack(data)
+		} else {
+			entries, err = parseZiplist(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, entries...)
+	}
+	return items, nil
+}
+
+func newList(items [][]byte) (*obj.RedisObject, error) {
+	redisObj := obj.NewListObject()
+	deque, _ := redisObj.AsList()
+	for _, item := range items {
+		if err := deque.AddLast(item); err != nil {
+			return nil, err
+		}
+	}
+	return redisObj, nil
+}
+
+func newSet(members [][]byte) *obj.RedisObject {
+	redisObj, _ := obj.NewSetObject(members)
+	return redisObj
+}
+
+func newHash(items [][]byte) (*obj.RedisObject, error) {
+	if len(items)%2 != 0 {
+		return nil, ErrCorrupted
+	}
+	redisObj := obj.NewHashObject()
+	hash, _ := redisObj.AsHash()
+	for i := 0; i < len(items); i += 2 {
+		hash.Put(string(items[i]), items[i+1])
+	}
+	return redisObj, nil
+}
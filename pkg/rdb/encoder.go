@@ -0,0 +1,195 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Encoder 按照 RDB 格式写入数据, 最后由 WriteEOF 写入校验和
+type Encoder struct {
+	w   io.Writer
+	crc uint64
+	buf [9]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) write(p []byte) error {
+	e.crc = crc64(e.crc, p)
+	_, err := e.w.Write(p)
+	return err
+}
+
+func (e *Encoder) writeByte(b byte) error {
+	e.buf[0] = b
+	return e.write(e.buf[:1])
+}
+
+// WriteHeader 写入 REDIS 和版本号
+func (e *Encoder) WriteHeader() error {
+	return e.write([]byte(fmt.Sprintf("%s%04d", magic, Version)))
+}
+
+// WriteAux 写入辅助字段, 比如 redis-ver, ctime
+func (e *Encoder) WriteAux(key, value string) error {
+	if err := e.writeByte(opAux); err != nil {
+		return err
+	}
+	if err := e.writeString([]byte(key)); err != nil {
+		return err
+	}
+	return e.writeString([]byte(value))
+}
+
+// WriteFunction 写入 FUNCTION LOAD 加载的函数库
+func (e *Encoder) WriteFunction(code []byte) error {
+	if err := e.writeByte(opFunction2); err != nil {
+		return err
+	}
+	return e.writeString(code)
+}
+
+// WriteSelectDB 之后写入的key都属于这个db
+func (e *Encoder) WriteSelectDB(index int) error {
+	if err := e.writeByte(opSelectDB); err != nil {
+		return err
+	}
+	return e.writeLength(uint64(index))
+}
+
+// WriteResizeDB db中key的数量和设置了过期时间的key的数量, 加载时用来预分配空间
+func (e *Encoder) WriteResizeDB(size, expires int) error {
+	if err := e.writeByte(opResizeDB); err != nil {
+		return err
+	}
+	if err := e.writeLength(uint64(size)); err != nil {
+		return err
+	}
+	return e.writeLength(uint64(expires))
+}
+
+// WriteEntry 写入一个key, expireAt 为nil表示没有过期时间
+func (e *Encoder) WriteEntry(key string, value *obj.RedisObject, expireAt *time.Time) error {
+	if expireAt != nil {
+		if err := e.writeByte(opExpireTimeMs); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(e.buf[:8], uint64(expireAt.UnixMilli()))
+		if err := e.write(e.buf[:8]); err != nil {
+			return err
+		}
+	}
+	c, err := objCodec(value)
+	if err != nil {
+		return err
+	}
+	if err = e.writeKey(c.typeOf(value), key); err != nil {
+		return err
+	}
+	return c.encode(e, value)
+}
+
+// WriteEOF 写入结束标记和 crc64 校验和
+func (e *Encoder) WriteEOF() error {
+	if err := e.writeByte(opEOF); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(e.buf[:8], e.crc)
+	_, err := e.w.Write(e.buf[:8])
+	return err
+}
+
+func (e *Encoder) writeKey(typ byte, key string) error {
+	if err := e.writeByte(typ); err != nil {
+		return err
+	}
+	return e.writeString([]byte(key))
+}
+
+// encodeIntSet 按照 redis 的 intset 格式编码, 元素必须是有序的
+func encodeIntSet(values []int64) []byte {
+	width := 2
+	for _, v := range values {
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			width = 8
+			break
+		}
+		if v < math.MinInt16 || v > math.MaxInt16 {
+			width = 4
+		}
+	}
+	buf := make([]byte, 8+width*len(values))
+	binary.LittleEndian.PutUint32(buf, uint32(width))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(values)))
+	for i, v := range values {
+		p := buf[8+i*width:]
+		switch width {
+		case 2:
+			binary.LittleEndian.PutUint16(p, uint16(v))
+		case 4:
+			binary.LittleEndian.PutUint32(p, uint32(v))
+		default:
+			binary.LittleEndian.PutUint64(p, uint64(v))
+		}
+	}
+	return buf
+}
+
+func (e *Encoder) writeLength(length uint64) error {
+	switch {
+	case length < 1<<6:
+		return e.writeByte(byte(length))
+	case length < 1<<14:
+		e.buf[0] = byte(length>>8) | len14Bit<<6
+		e.buf[1] = byte(length)
+		return e.write(e.buf[:2])
+	case length <= math.MaxUint32:
+		e.buf[0] = len32Bit
+		binary.BigEndian.PutUint32(e.buf[1:], uint32(length))
+		return e.write(e.buf[:5])
+	default:
+		e.buf[0] = len64Bit
+		binary.BigEndian.PutUint64(e.buf[1:], length)
+		return e.write(e.buf[:9])
+	}
+}
+
+// writeString 可以表示为32位整数的字符串按照整数编码
+func (e *Encoder) writeString(p []byte) error {
+	if len(p) > 0 && len(p) <= 11 {
+		if v, err := strconv.ParseInt(string(p), 10, 32); err == nil && strconv.FormatInt(v, 10) == string(p) {
+			return e.writeInt(v)
+		}
+	}
+	if err := e.writeLength(uint64(len(p))); err != nil {
+		return err
+	}
+	return e.write(p)
+}
+
+func (e *Encoder) writeInt(v int64) error {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		e.buf[0] = lenEncVal<<6 | encInt8
+		e.buf[1] = byte(v)
+		return e.write(e.buf[:2])
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		e.buf[0] = lenEncVal<<6 | encInt16
+		binary.LittleEndian.PutUint16(e.buf[1:], uint16(v))
+		return e.write(e.buf[:3])
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		e.buf[0] = lenEncVal<<6 | encInt32
+		binary.LittleEndian.PutUint32(e.buf[1:], uint32(v))
+		return e.write(e.buf[:5])
+	default:
+		return errors.New("rdb: integer out of range")
+	}
+}
@@ -0,0 +1,46 @@
+package rdb
+
+// lzfDecompress 解压 redis 使用 lzf 压缩的字符串, size 是解压之后的长度
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 32 {
+			// 长度为 ctrl+1 的字面量
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > size {
+				return nil, ErrCorrupted
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+		// 引用前面已经解压的数据
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, ErrCorrupted
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, ErrCorrupted
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		n += 2
+		if ref < 0 || len(out)+n > size {
+			return nil, ErrCorrupted
+		}
+		// 引用的区域可能和输出重叠, 逐个字节复制
+		for i := 0; i < n; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != size {
+		return nil, ErrCorrupted
+	}
+	return out, nil
+}
@@ -0,0 +1,179 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// parseIntSet redis intset: encoding(4字节) length(4字节) 小端的整数
+func parseIntSet(data []byte) ([][]byte, error) {
+	if len(data) < 8 {
+		return nil, ErrCorrupted
+	}
+	width := int(binary.LittleEndian.Uint32(data))
+	length := int(binary.LittleEndian.Uint32(data[4:]))
+	if width != 2 && width != 4 && width != 8 || len(data) != 8+width*length {
+		return nil, ErrCorrupted
+	}
+	items := make([][]byte, 0, length)
+	for i := 0; i < length; i++ {
+		p := data[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		default:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		items = append(items, strconv.AppendInt(nil, v, 10))
+	}
+	return items, nil
+}
+
+// signExtend 把 bits 位的补码转换为 int64
+func signExtend(v uint64, bits uint) int64 {
+	shift := 64 - bits
+	return int64(v<<shift) >> shift
+}
+
+// parseZiplist zlbytes(4) zltail(4) zllen(2) entry... 0xFF
+// entry: prevlen(1或5字节) encoding data
+func parseZiplist(data []byte) ([][]byte, error) {
+	if len(data) < 11 || int(binary.LittleEndian.Uint32(data)) != len(data) || data[len(data)-1] != 0xFF {
+		return nil, ErrCorrupted
+	}
+	items := make([][]byte, 0, binary.LittleEndian.Uint16(data[8:]))
+	pos := 10
+	for data[pos] != 0xFF {
+		// 跳过 prevlen
+		if data[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(data)-1 {
+			return nil, ErrCorrupted
+		}
+		enc := data[pos]
+		var item []byte
+		var size, header int
+		switch {
+		case enc>>6 == 0:
+			header, size = 1, int(enc&0x3f)
+		case enc>>6 == 1:
+			if pos+2 > len(data) {
+				return nil, ErrCorrupted
+			}
+			header, size = 2, int(enc&0x3f)<<8|int(data[pos+1])
+		case enc>>6 == 2:
+			if pos+5 > len(data) {
+				return nil, ErrCorrupted
+			}
+			header, size = 5, int(binary.BigEndian.Uint32(data[pos+1:]))
+		default:
+			var v int64
+			header = 1
+			p := data[pos+1:]
+			switch {
+			case enc == 0xC0 && len(p) >= 2:
+				v, size = int64(int16(binary.LittleEndian.Uint16(p))), 2
+			case enc == 0xD0 && len(p) >= 4:
+				v, size = int64(int32(binary.LittleEndian.Uint32(p))), 4
+			case enc == 0xE0 && len(p) >= 8:
+				v, size = int64(binary.LittleEndian.Uint64(p)), 8
+			case enc == 0xF0 && len(p) >= 3:
+				v, size = signExtend(uint64(p[0])|uint64(p[1])<<8|uint64(p[2])<<16, 24), 3
+			case enc == 0xFE && len(p) >= 1:
+				v, size = int64(int8(p[0])), 1
+			case enc >= 0xF1 && enc <= 0xFD:
+				// 4位的立即数, 表示 0 到 12
+				v, size = int64(enc&0x0f)-1, 0
+			default:
+				return nil, ErrCorrupted
+			}
+			item = strconv.AppendInt(nil, v, 10)
+		}
+		if size < 0 || pos+header+size >= len(data) {
+			return nil, ErrCorrupted
+		}
+		if item == nil {
+			item = append([]byte{}, data[pos+header:pos+header+size]...)
+		}
+		items = append(items, item)
+		pos += header + size
+	}
+	return items, nil
+}
+
+// parseListpack total_bytes(4) num_elements(2) entry... 0xFF
+// entry: encoding data backlen, backlen 是 encoding+data 的长度
+func parseListpack(data []byte) ([][]byte, error) {
+	if len(data) < 7 || int(binary.LittleEndian.Uint32(data)) != len(data) || data[len(data)-1] != 0xFF {
+		return nil, ErrCorrupted
+	}
+	items := make([][]byte, 0, binary.LittleEndian.Uint16(data[4:]))
+	pos := 6
+	for data[pos] != 0xFF {
+		enc := data[pos]
+		p := data[pos+1:]
+		var item []byte
+		var header, size int
+		var v int64
+		isInt := true
+		switch {
+		case enc&0x80 == 0:
+			v, header = int64(enc&0x7f), 1
+		case enc&0xC0 == 0x80:
+			header, size, isInt = 1, int(enc&0x3f), false
+		case enc&0xE0 == 0xC0 && len(p) >= 1:
+			v, header = signExtend(uint64(enc&0x1f)<<8|uint64(p[0]), 13), 2
+		case enc&0xF0 == 0xE0 && len(p) >= 1:
+			header, size, isInt = 2, int(enc&0x0f)<<8|int(p[0]), false
+		case enc == 0xF0 && len(p) >= 4:
+			header, size, isInt = 5, int(binary.LittleEndian.Uint32(p)), false
+		case enc == 0xF1 && len(p) >= 2:
+			v, header = int64(int16(binary.LittleEndian.Uint16(p))), 3
+		case enc == 0xF2 && len(p) >= 3:
+			v, header = signExtend(uint64(p[0])|uint64(p[1])<<8|uint64(p[2])<<16, 24), 4
+		case enc == 0xF3 && len(p) >= 4:
+			v, header = int64(int32(binary.LittleEndian.Uint32(p))), 5
+		case enc == 0xF4 && len(p) >= 8:
+			v, header = int64(binary.LittleEndian.Uint64(p)), 9
+		default:
+			return nil, ErrCorrupted
+		}
+		entryLen := header + size
+		if size < 0 || pos+entryLen >= len(data) {
+			return nil, ErrCorrupted
+		}
+		if isInt {
+			item = strconv.AppendInt(nil, v, 10)
+		} else {
+			item = append([]byte{}, data[pos+header:pos+entryLen]...)
+		}
+		items = append(items, item)
+		pos += entryLen + backlenSize(entryLen)
+		if pos >= len(data) {
+			return nil, ErrCorrupted
+		}
+	}
+	return items, nil
+}
+
+// backlenSize listpack 中记录 entry 长度的字节数
+func backlenSize(entryLen int) int {
+	switch {
+	case entryLen <= 127:
+		return 1
+	case entryLen < 16383:
+		return 2
+	case entryLen < 2097151:
+		return 3
+	case entryLen < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
@@ -0,0 +1,77 @@
+// Package rdb 读写和 redis-server 兼容的 RDB 文件
+package rdb
+
+import "errors"
+
+// Version 写入的 RDB 版本, 和 redis 7.0 一致
+const Version = 10
+
+// maxVersion 可以加载的最高版本
+const maxVersion = 12
+
+const magic = "REDIS"
+
+// 对象类型
+const (
+	typeString          = 0
+	typeList            = 1
+	typeSet             = 2
+	typeZSet            = 3
+	typeHash            = 4
+	typeZSet2           = 5
+	typeModule          = 6
+	typeModule2         = 7
+	typeHashZipmap      = 9
+	typeListZiplist     = 10
+	typeSetIntset       = 11
+	typeZSetZiplist     = 12
+	typeHashZiplist     = 13
+	typeListQuicklist   = 14
+	typeStreamListpacks = 15
+	typeHashListpack    = 16
+	typeZSetListpack    = 17
+	typeListQuicklist2  = 18
+	typeSetListpack     = 20
+)
+
+// 操作码
+const (
+	opSlotInfo      = 244
+	opFunction2     = 245
+	opFunctionPreGA = 246
+	opModuleAux     = 247
+	opIdle          = 248
+	opFreq          = 249
+	opAux           = 250
+	opResizeDB      = 251
+	opExpireTimeMs  = 252
+	opExpireTime    = 253
+	opSelectDB      = 254
+	opEOF           = 255
+)
+
+// 长度编码, 最高的两位表示长度占用的位数
+const (
+	len6Bit   = 0
+	len14Bit  = 1
+	len32Bit  = 0x80
+	len64Bit  = 0x81
+	lenEncVal = 3
+	encInt8   = 0
+	encInt16  = 1
+	encInt32  = 2
+	encLZF    = 3
+)
+
+// quicklist 节点的格式
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+var (
+	ErrBadMagic    = errors.New("rdb: wrong signature trying to load DB from file")
+	ErrChecksum    = errors.New("rdb: wrong RDB checksum")
+	ErrCorrupted   = errors.New("rdb: corrupted payload")
+	ErrUnsupported = errors.New("rdb: unsupported object type")
+)
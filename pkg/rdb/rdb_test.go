@@ -0,0 +1,365 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/intset"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/list"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redis-server 7.2 写入的文件, 包括 listpack, quicklist2, intset 编码和 lzf 压缩的字符串
+const redis7Dump = "52 45 44 49 53 30 30 31 31 fa 09 72 65 64 69 73" +
+	"2d 76 65 72 05 37 2e 32 2e 34 fa 0a 72 65 64 69" +
+	"73 2d 62 69 74 73 c0 40 fa 05 63 74 69 6d 65 c2" +
+	"00 f1 53 65 fe 00 fb 08 01 00 03 66 6f 6f 03 62" +
+	"61 72 00 01 6e c1 39 30 00 01 7a c3 05 18 00 61" +
+	"e0 0e 00 12 01 6c 01 02 0f 0f 00 00 00 03 00 81" +
+	"61 02 81 62 02 01 01 ff 14 01 73 0d 0d 00 00 00" +
+	"02 00 81 78 02 81 79 02 ff 0b 02 69 73 0e 02 00" +
+	"00 00 03 00 00 00 01 00 02 00 03 00 10 01 68 0d" +
+	"0d 00 00 00 02 00 81 66 02 81 76 02 ff fc 00 d8" +
+	"c3 2c bb 03 00 00 00 03 74 74 6c 01 76 fe 01 fb" +
+	"01 00 00 03 64 62 31 c0 ff ff c0 07 4a 10 9f 2a" +
+	"4c 11"
+
+// redis-server 6.2 写入的文件, 包括 quicklist, ziplist 编码和秒级的过期时间
+const redis6Dump = "52 45 44 49 53 30 30 30 39 fa 09 72 65 64 69 73" +
+	"2d 76 65 72 06 36 2e 32 2e 31 34 fe 00 fb 03 01" +
+	"0e 01 6c 01 12 12 00 00 00 0d 00 00 00 02 00 00" +
+	"01 61 03 c0 00 04 ff 0d 01 68 10 10 00 00 00 0d" +
+	"00 00 00 02 00 00 01 66 03 f8 ff fd 01 00 00 00" +
+	"00 03 6f 6c 64 01 76 ff 8a 1f c0 e6 36 f8 9f c1"
+
+// encodedDump Encoder 写入的文件, 和 redis-server 的格式一致
+const encodedDump = "52 45 44 49 53 30 30 31 30 fa 09 72 65 64 69 73" +
+	"2d 76 65 72 05 37 2e 30 2e 30 fa 0a 72 65 64 69" +
+	"73 2d 62 69 74 73 c0 40 fe 00 fb 04 01 00 03 66" +
+	"6f 6f 03 62 61 72 00 01 6e c1 39 30 01 01 6c 02" +
+	"01 61 c0 01 fc 00 d8 c3 2c bb 03 00 00 0b 01 73" +
+	"0e 02 00 00 00 03 00 00 00 01 00 02 00 03 00 ff" +
+	"bd 8e b4 43 cb 99 9e b5"
+
+// 2100-01-01 00:00:00 UTC
+const expireAtMs = 4102444800000
+
+func fromHex(t *testing.T, dump string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(dump, " ", ""))
+	assert.Nil(t, err)
+	return data
+}
+
+// dumpHandler 把解析出来的数据转换为字符串, set 和 hash 的元素排序
+type dumpHandler struct {
+	aux       map[string]string
+	functions []string
+	entries   []string
+}
+
+func (h *dumpHandler) Aux(key, value []byte) {
+	if h.aux == nil {
+		h.aux = make(map[string]string)
+	}
+	h.aux[string(key)] = string(value)
+}
+
+func (h *dumpHandler) Function(code []byte) error {
+	h.functions = append(h.functions, string(code))
+	return nil
+}
+
+func (h *dumpHandler) Entry(db int, key string, value *obj.RedisObject, expireAt *time.Time) error {
+	items := make([]string, 0)
+	switch value.ObjType {
+	case obj.RedisString:
+		s, _ := obj.StringObjEncoding(value)
+		items = append(items, string(s))
+	case obj.RedisList:
+		value.Ptr.(list.Dequeue).ForEach(func(v interface{}, index int) bool {
+			items = append(items, string(v.([]byte)))
+			return true
+		})
+	case obj.RedisSet:
+		if value.Encoding == obj.EncIntSet {
+			value.Ptr.(*intset.IntSet).Range(func(index int, v int64) bool {
+				items = append(items, fmt.Sprintf("%d", v))
+				return true
+			})
+		} else {
+			value.Ptr.(*dict.SimpleDict).ForEach(func(member string, v interface{}) bool {
+				items = append(items, member)
+				return true
+			})
+			sort.Strings(items)
+		}
+	case obj.RedisHash:
+		value.Ptr.(*dict.SimpleDict).ForEach(func(field string, v interface{}) bool {
+			items = append(items, field+"="+string(v.([]byte)))
+			return true
+		})
+		sort.Strings(items)
+	}
+	entry := fmt.Sprintf("%d %s %s [%s]", db, obj.ObjectTypeName(value.ObjType), key, strings.Join(items, " "))
+	if expireAt != nil {
+		entry += fmt.Sprintf(" @%d", expireAt.UnixMilli())
+	}
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+func TestCrc64(t *testing.T) {
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), crc64(0, []byte("123456789")))
+}
+
+func TestLzfDecompress(t *testing.T) {
+	out, err := lzfDecompress(fromHex(t, "00 61 e0 0e 00"), 24)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("a", 24), string(out))
+	// 引用的位置超出已经解压的数据
+	_, err = lzfDecompress(fromHex(t, "00 61 e0 0e 01"), 24)
+	assert.ErrorIs(t, err, ErrCorrupted)
+	_, err = lzfDecompress(fromHex(t, "00 61 e0 0e 00"), 23)
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestDecodeRedisDump(t *testing.T) {
+	testCases := []struct {
+		name    string
+		dump    string
+		aux     map[string]string
+		entries []string
+	}{
+		{"redis 7.2", redis7Dump, map[string]string{"redis-ver": "7.2.4", "redis-bits": "64", "ctime": "1700000000"}, []string{
+			"0 string foo [bar]",
+			"0 string n [12345]",
+			"0 string z [" + strings.Repeat("a", 24) + "]",
+			"0 list l [a b 1]",
+			"0 set s [x y]",
+			"0 set is [1 2 3]",
+			"0 hash h [f=v]",
+			fmt.Sprintf("0 string ttl [v] @%d", int64(expireAtMs)),
+			"1 string db1 [-1]",
+		}},
+		{"redis 6.2", redis6Dump, map[string]string{"redis-ver": "6.2.14"}, []string{
+			"0 list l [a 1024]",
+			"0 hash h [f=7]",
+			"0 string old [v] @1000",
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &dumpHandler{}
+			assert.Nil(t, Decode(bytes.NewReader(fromHex(t, tc.dump)), h))
+			assert.Equal(t, tc.aux, h.aux)
+			assert.Equal(t, tc.entries, h.entries)
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	data := fromHex(t, redis7Dump)
+	// 修改一个字节之后校验和不一致
+	corrupted := append([]byte{}, data...)
+	corrupted[len("REDIS0011")+12] ^= 0xff
+	assert.ErrorIs(t, Decode(bytes.NewReader(corrupted), &dumpHandler{}), ErrChecksum)
+	// 校验和为0表示没有开启校验
+	noChecksum := append(append([]byte{}, data[:len(data)-8]...), make([]byte, 8)...)
+	assert.Nil(t, Decode(bytes.NewReader(noChecksum), &dumpHandler{}))
+
+	assert.ErrorIs(t, Decode(bytes.NewReader([]byte("RADIS0011\xff")), &dumpHandler{}), ErrBadMagic)
+	assert.NotNil(t, Decode(bytes.NewReader([]byte("REDIS0099\xff")), &dumpHandler{}))
+	for i := 9; i < len(data); i++ {
+		assert.NotNil(t, Decode(bytes.NewReader(data[:i]), &dumpHandler{}), "truncated at %d", i)
+	}
+	// zset 还不支持
+	zset := append([]byte("REDIS0011\x11\x01z"), data[len(data)-8:]...)
+	err := Decode(bytes.NewReader(zset), &dumpHandler{})
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.Contains(t, err.Error(), "zset (opcode 17)")
+	// 不认识的对象类型
+	unknown := append([]byte("REDIS0011\x1e\x01u"), data[len(data)-8:]...)
+	err = Decode(bytes.NewReader(unknown), &dumpHandler{})
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.Contains(t, err.Error(), "unknown object type opcode 30")
+}
+
+func TestDumpRestore(t *testing.T) {
+	payload, err := DumpValue(obj.NewStringObject([]byte("bar")))
+	assert.Nil(t, err)
+	// 对象类型, 值, rdb 版本和 crc64
+	assert.Equal(t, []byte("\x00\x03bar\x0a\x00"), payload[:len(payload)-8])
+	assert.Equal(t, crc64(0, payload[:len(payload)-8]), binary.LittleEndian.Uint64(payload[len(payload)-8:]))
+
+	l := obj.NewListObject()
+	_ = l.Ptr.(list.Dequeue).AddLast([]byte("a"))
+	_ = l.Ptr.(list.Dequeue).AddLast([]byte("1"))
+	ints, _ := obj.NewSetObject([][]byte{[]byte("3"), []byte("1")})
+	set, _ := obj.NewSetObject([][]byte{[]byte("x"), []byte("1")})
+	hash := obj.NewHashObject()
+	hash.Ptr.(*dict.SimpleDict).Put("f", []byte("v"))
+	for _, value := range []*obj.RedisObject{obj.NewStringObject([]byte("12345")), l, ints, set, hash} {
+		payload, err = DumpValue(value)
+		assert.Nil(t, err)
+		restored, err := RestoreValue(payload)
+		assert.Nil(t, err)
+		assert.Equal(t, value.ObjType, restored.ObjType)
+		expected, actual := &dumpHandler{}, &dumpHandler{}
+		_ = expected.Entry(0, "k", value, nil)
+		_ = actual.Entry(0, "k", restored, nil)
+		assert.Equal(t, expected.entries, actual.entries)
+	}
+
+	// 校验和错误, 版本太高, 值后面有多余的数据
+	corrupted := append([]byte{}, payload...)
+	corrupted[1] ^= 0xff
+	_, err = RestoreValue(corrupted)
+	assert.ErrorIs(t, err, ErrDumpPayload)
+	_, err = RestoreValue(withChecksum("\x00\x01a\x63\x00"))
+	assert.ErrorIs(t, err, ErrDumpPayload)
+	_, err = RestoreValue(append([]byte("\x00\x01a\x0a\x00"), make([]byte, 8)...))
+	assert.ErrorIs(t, err, ErrDumpPayload)
+	_, err = RestoreValue([]byte("short"))
+	assert.ErrorIs(t, err, ErrDumpPayload)
+	_, err = RestoreValue(withChecksum("\x00\x01ab\x0a\x00"))
+	assert.ErrorIs(t, err, ErrCorrupted)
+	_, err = RestoreValue(withChecksum("\x1e\x01a\x0a\x00"))
+	assert.ErrorIs(t, err, ErrUnsupported)
+	value, err := RestoreValue(withChecksum("\x00\x01a\x0a\x00"))
+	assert.Nil(t, err)
+	raw, _ := obj.StringObjEncoding(value)
+	assert.Equal(t, []byte("a"), raw)
+}
+
+// withChecksum 在 DUMP 数据后面加上 crc64
+func withChecksum(body string) []byte {
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, crc64(0, []byte(body)))
+	return append([]byte(body), sum...)
+}
+
+func TestRewriteCommands(t *testing.T) {
+	l := obj.NewListObject()
+	for i := 0; i < rewriteItemsPerCmd+1; i++ {
+		_ = l.Ptr.(list.Dequeue).AddLast([]byte(fmt.Sprintf("%d", i)))
+	}
+	cmds := make([]string, 0)
+	assert.Nil(t, RewriteCommands("l", l, func(cmdLine CmdLine) {
+		cmds = append(cmds, fmt.Sprintf("%s %s %d", cmdLine[0], cmdLine[1], len(cmdLine)-2))
+	}))
+	// 每条命令最多 rewriteItemsPerCmd 个元素
+	assert.Equal(t, []string{"rpush l 64", "rpush l 1"}, cmds)
+	err := RewriteCommands("z", obj.NewObject(obj.RedisZSet, nil), func(cmdLine CmdLine) {})
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.Equal(t, []obj.ObjectType{obj.RedisString, obj.RedisList, obj.RedisSet, obj.RedisHash}, ObjectTypes())
+}
+
+func TestEncode(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := NewEncoder(buf)
+	assert.Nil(t, e.WriteHeader())
+	assert.Nil(t, e.WriteAux("redis-ver", "7.0.0"))
+	assert.Nil(t, e.WriteAux("redis-bits", "64"))
+	assert.Nil(t, e.WriteSelectDB(0))
+	assert.Nil(t, e.WriteResizeDB(4, 1))
+	assert.Nil(t, e.WriteEntry("foo", obj.NewStringObject([]byte("bar")), nil))
+	assert.Nil(t, e.WriteEntry("n", obj.NewStringObject([]byte("12345")), nil))
+	l := obj.NewListObject()
+	_ = l.Ptr.(list.Dequeue).AddLast([]byte("a"))
+	_ = l.Ptr.(list.Dequeue).AddLast([]byte("1"))
+	assert.Nil(t, e.WriteEntry("l", l, nil))
+	s, _ := obj.NewSetObject([][]byte{[]byte("3"), []byte("1"), []byte("2")})
+	expireAt := time.UnixMilli(expireAtMs)
+	assert.Nil(t, e.WriteEntry("s", s, &expireAt))
+	assert.Nil(t, e.WriteEOF())
+	assert.Equal(t, fromHex(t, encodedDump), buf.Bytes())
+}
+
+func TestEncodeDecode(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := NewEncoder(buf)
+	assert.Nil(t, e.WriteHeader())
+	assert.Nil(t, e.WriteFunction([]byte("#!lua name=lib\n")))
+	assert.Nil(t, e.WriteSelectDB(3))
+	long := strings.Repeat("x", 100)
+	assert.Nil(t, e.WriteEntry("long", obj.NewStringObject([]byte(long)), nil))
+	assert.Nil(t, e.WriteEntry("big", obj.NewStringObject([]byte("12345678901")), nil))
+	l := obj.NewListObject()
+	items := make([]string, 0)
+	for i := 0; i < 300; i++ {
+		items = append(items, fmt.Sprintf("item%d", i))
+		_ = l.Ptr.(list.Dequeue).AddLast([]byte(items[i]))
+	}
+	assert.Nil(t, e.WriteEntry("list", l, nil))
+	members := [][]byte{[]byte("-70000"), []byte("5"), []byte("1")}
+	ints, _ := obj.NewSetObject(members)
+	assert.Nil(t, e.WriteEntry("ints", ints, nil))
+	members = append(members, []byte("m"))
+	set, _ := obj.NewSetObject(members)
+	assert.Nil(t, e.WriteEntry("set", set, nil))
+	hash := obj.NewHashObject()
+	hash.Ptr.(*dict.SimpleDict).Put("a", []byte("1"))
+	hash.Ptr.(*dict.SimpleDict).Put("b", []byte(long))
+	assert.Nil(t, e.WriteEntry("hash", hash, nil))
+	assert.Nil(t, e.WriteEOF())
+
+	h := &dumpHandler{}
+	assert.Nil(t, Decode(bytes.NewReader(buf.Bytes()), h))
+	assert.Equal(t, []string{"#!lua name=lib\n"}, h.functions)
+	assert.Equal(t, []string{
+		"3 string long [" + long + "]",
+		"3 string big [12345678901]",
+		"3 list list [" + strings.Join(items, " ") + "]",
+		"3 set ints [-70000 1 5]",
+		"3 set set [-70000 1 5 m]",
+		"3 hash hash [a=1 b=" + long + "]",
+	}, h.entries)
+}
+
+func TestParsePacked(t *testing.T) {
+	// listpack 中的各种整数编码
+	lp := fromHex(t, "00000000 0600"+
+		"7f01"+ // 127
+		"df ff 02"+ // 13位 -1
+		"f1 00 80 03"+ // int16 -32768
+		"f2 ff ff 7f 04"+ // int24 8388607
+		"f3 00 00 00 80 05"+ // int32
+		"f4 ff ff ff ff ff ff ff ff 09"+ // int64 -1
+		"ff")
+	lp[0] = byte(len(lp))
+	items, err := parseListpack(lp)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127", "-1", "-32768", "8388607", "-2147483648", "-1"}, toStrings(items))
+	_, err = parseListpack(lp[:len(lp)-1])
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	// ziplist 中的各种整数编码
+	zl := fromHex(t, "00000000 00000000 0500"+
+		"00 fe 80"+ // int8 -128
+		"03 f0 00 00 80"+ // int24 -8388608
+		"05 d0 01 00 00 00"+ // int32 1
+		"06 e0 02 00 00 00 00 00 00 00"+ // int64 2
+		"0a f1"+ // 立即数 0
+		"ff")
+	zl[0] = byte(len(zl))
+	items, err = parseZiplist(zl)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-128", "-8388608", "1", "2", "0"}, toStrings(items))
+	_, err = parseZiplist(zl[:len(zl)-2])
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func toStrings(items [][]byte) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, string(item))
+	}
+	return result
+}
@@ -0,0 +1,257 @@
+package rdb
+
+import (
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"strconv"
+)
+
+// rewriteItemsPerCmd 重写 list, set, hash 时每条命令最多包含的元素个数
+const rewriteItemsPerCmd = 64
+
+func init() {
+	registerCodec(&typeCodec{
+		objType:  obj.RedisString,
+		rdbTypes: []byte{typeString},
+		encode:   encodeString,
+		decode:   decodeString,
+		rewrite:  rewriteString,
+	})
+	registerCodec(&typeCodec{
+		objType:  obj.RedisList,
+		rdbTypes: []byte{typeList, typeListZiplist, typeListQuicklist, typeListQuicklist2},
+		encode:   encodeList,
+		decode:   decodeList,
+		rewrite:  rewriteList,
+	})
+	registerCodec(&typeCodec{
+		objType:  obj.RedisSet,
+		rdbTypes: []byte{typeSet, typeSetIntset, typeSetListpack},
+		rdbType: func(value *obj.RedisObject) byte {
+			if value.Encoding == obj.EncIntSet {
+				return typeSetIntset
+			}
+			return typeSet
+		},
+		encode:  encodeSet,
+		decode:  decodeSet,
+		rewrite: rewriteSet,
+	})
+	registerCodec(&typeCodec{
+		objType:  obj.RedisHash,
+		rdbTypes: []byte{typeHash, typeHashZiplist, typeHashListpack},
+		encode:   encodeHash,
+		decode:   decodeHash,
+		rewrite:  rewriteHash,
+	})
+}
+
+/* ---- string ---- */
+
+func encodeString(e *Encoder, value *obj.RedisObject) error {
+	bytes, err := obj.StringObjEncoding(value)
+	if err != nil {
+		return err
+	}
+	return e.writeString(bytes)
+}
+
+func decodeString(d *decoder, typ byte) (*obj.RedisObject, error) {
+	value, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	return obj.NewStringObject(value), nil
+}
+
+func rewriteString(key string, value *obj.RedisObject, emit func(CmdLine)) {
+	bytes, _ := obj.StringObjEncoding(value)
+	emit(CmdLine{[]byte("set"), []byte(key), bytes})
+}
+
+/* ---- list ---- */
+
+func encodeList(e *Encoder, value *obj.RedisObject) error {
+	deque, ok := value.AsList()
+	if !ok {
+		return obj.ErrorEncodingType
+	}
+	if err := e.writeLength(uint64(deque.Len())); err != nil {
+		return err
+	}
+	var err error
+	deque.ForEach(func(value interface{}, index int) bool {
+		bytes, _ := value.([]byte)
+		err = e.writeString(bytes)
+		return err == nil
+	})
+	return err
+}
+
+func decodeList(d *decoder, typ byte) (*obj.RedisObject, error) {
+	var items [][]byte
+	var err error
+	switch typ {
+	case typeListZiplist:
+		items, err = d.readPacked(parseZiplist)
+	case typeListQuicklist, typeListQuicklist2:
+		items, err = d.readQuicklist(typ)
+	default:
+		items, err = d.readStrings(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newList(items)
+}
+
+func rewriteList(key string, value *obj.RedisObject, emit func(CmdLine)) {
+	deque, ok := value.AsList()
+	if !ok {
+		return
+	}
+	batch := newBatchCmd("rpush", key, 1, emit)
+	deque.ForEach(func(value interface{}, index int) bool {
+		bytes, _ := value.([]byte)
+		batch.add(bytes)
+		return true
+	})
+	batch.done()
+}
+
+/* ---- set ---- */
+
+func encodeSet(e *Encoder, value *obj.RedisObject) error {
+	if intSet, ok := value.AsIntSet(); ok {
+		return e.writeString(encodeIntSet(intSet.Elements()))
+	}
+	members, ok := value.AsSetDict()
+	if !ok {
+		return obj.ErrorEncodingType
+	}
+	if err := e.writeLength(uint64(members.Len())); err != nil {
+		return err
+	}
+	var err error
+	members.SortedForEach(func(member string, val interface{}) bool {
+		err = e.writeString([]byte(member))
+		return err == nil
+	})
+	return err
+}
+
+func decodeSet(d *decoder, typ byte) (*obj.RedisObject, error) {
+	var items [][]byte
+	var err error
+	switch typ {
+	case typeSetIntset:
+		items, err = d.readPacked(parseIntSet)
+	case typeSetListpack:
+		items, err = d.readPacked(parseListpack)
+	default:
+		items, err = d.readStrings(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSet(items), nil
+}
+
+func rewriteSet(key string, value *obj.RedisObject, emit func(CmdLine)) {
+	batch := newBatchCmd("sadd", key, 1, emit)
+	if intSet, ok := value.AsIntSet(); ok {
+		intSet.Range(func(index int, value int64) bool {
+			batch.add(strconv.AppendInt(nil, value, 10))
+			return true
+		})
+	} else if members, ok := value.AsSetDict(); ok {
+		members.SortedForEach(func(member string, val interface{}) bool {
+			batch.add([]byte(member))
+			return true
+		})
+	}
+	batch.done()
+}
+
+/* ---- hash ---- */
+
+func encodeHash(e *Encoder, value *obj.RedisObject) error {
+	hash, ok := value.AsHash()
+	if !ok {
+		return obj.ErrorEncodingType
+	}
+	if err := e.writeLength(uint64(hash.Len())); err != nil {
+		return err
+	}
+	var err error
+	hash.SortedForEach(func(field string, val interface{}) bool {
+		if err = e.writeString([]byte(field)); err != nil {
+			return false
+		}
+		value, _ := val.([]byte)
+		err = e.writeString(value)
+		return err == nil
+	})
+	return err
+}
+
+func decodeHash(d *decoder, typ byte) (*obj.RedisObject, error) {
+	var items [][]byte
+	var err error
+	switch typ {
+	case typeHashZiplist:
+		items, err = d.readPacked(parseZiplist)
+	case typeHashListpack:
+		items, err = d.readPacked(parseListpack)
+	default:
+		items, err = d.readStrings(2)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newHash(items)
+}
+
+func rewriteHash(key string, value *obj.RedisObject, emit func(CmdLine)) {
+	hash, ok := value.AsHash()
+	if !ok {
+		return
+	}
+	batch := newBatchCmd("hset", key, 2, emit)
+	hash.SortedForEach(func(field string, val interface{}) bool {
+		value, _ := val.([]byte)
+		batch.add([]byte(field), value)
+		return true
+	})
+	batch.done()
+}
+
+// batchCmd 把元素按照 rewriteItemsPerCmd 分成多条命令, 每个元素占 width 个参数
+type batchCmd struct {
+	name  []byte
+	key   []byte
+	width int
+	args  CmdLine
+	emit  func(CmdLine)
+}
+
+func newBatchCmd(name string, key string, width int, emit func(CmdLine)) *batchCmd {
+	return &batchCmd{name: []byte(name), key: []byte(key), width: width, emit: emit}
+}
+
+func (b *batchCmd) add(item ...[]byte) {
+	if b.args == nil {
+		b.args = make(CmdLine, 0, 2+rewriteItemsPerCmd*b.width)
+		b.args = append(b.args, b.name, b.key)
+	}
+	b.args = append(b.args, item...)
+	if len(b.args) == cap(b.args) {
+		b.done()
+	}
+}
+
+func (b *batchCmd) done() {
+	if b.args != nil {
+		b.emit(b.args)
+		b.args = nil
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FormatFloat 与 redis 的 d2string 一致, 分数和 RESP3 的 double 都使用这种格式.
+// 使用能够还原的最短的数字, 按照 %.17g 的规则在指数小于 -4 或者不小于 17 时使用科学计数法,
+// eg: 1 -> "1", 1.5 -> "1.5", 1e17 -> "1e+17", 0.00001 -> "1e-05"; 无穷大是 inf 和 -inf, 保留 -0
+func FormatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	case f == 0:
+		if math.Signbit(f) {
+			return "-0"
+		}
+		return "0"
+	}
+	scientific := strconv.FormatFloat(f, 'e', -1, 64)
+	exp, _ := strconv.Atoi(scientific[strings.IndexByte(scientific, 'e')+1:])
+	if exp < -4 || exp >= 17 {
+		return scientific
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// FormatFloatHuman 与 redis 的 ld2string(LD_STR_HUMAN) 一致, INCRBYFLOAT 的结果使用这种格式.
+// 不使用科学计数法, -0 写成 0, 调用方已经拒绝了无穷大和 NaN
+func FormatFloatHuman(f float64) string {
+	if f == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// ParseFloat 与 redis 的 getDoubleFromObject 一致, 必须完整地解析, 接受 inf, +inf 和 -inf,
+// 拒绝 NaN, 空白和超出 float64 范围的值
+func ParseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
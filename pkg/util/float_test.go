@@ -0,0 +1,82 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestFormatFloat(t *testing.T) {
+	// redis-server 7.2 ZSCORE 和 RESP3 double 的回复
+	testCases := []struct {
+		value float64
+		want  string
+	}{
+		{1, "1"},
+		{1.5, "1.5"},
+		{-1.5, "-1.5"},
+		{0.1, "0.1"},
+		{0.30000000000000004, "0.30000000000000004"},
+		{math.Nextafter(3, 4), "3.0000000000000004"},
+		{1.0 / 3, "0.3333333333333333"},
+		{123456789, "123456789"},
+		{1e16, "10000000000000000"},
+		{1e17, "1e+17"},
+		{1.2345678901234568e17, "1.2345678901234568e+17"},
+		{1e100, "1e+100"},
+		{0.0001, "0.0001"},
+		{0.00001, "1e-05"},
+		{-2.5e-10, "-2.5e-10"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{5e-324, "5e-324"},
+		{0, "0"},
+		{math.Copysign(0, -1), "-0"},
+		{math.Inf(1), "inf"},
+		{math.Inf(-1), "-inf"},
+	}
+	for _, c := range testCases {
+		assert.Equal(t, c.want, FormatFloat(c.value), c.want)
+		if parsed, ok := ParseFloat(c.want); assert.True(t, ok, c.want) {
+			assert.Equal(t, c.value, parsed, c.want)
+		}
+	}
+}
+
+func TestFormatFloatHuman(t *testing.T) {
+	// INCRBYFLOAT 的回复不使用科学计数法
+	testCases := []struct {
+		value float64
+		want  string
+	}{
+		{10.6, "10.6"},
+		{5e3, "5000"},
+		{1e20, "100000000000000000000"},
+		{0.00001, "0.00001"},
+		{-3.25, "-3.25"},
+		{math.Copysign(0, -1), "0"},
+	}
+	for _, c := range testCases {
+		assert.Equal(t, c.want, FormatFloatHuman(c.value), c.want)
+	}
+}
+
+func TestParseFloat(t *testing.T) {
+	accepted := map[string]float64{
+		"1.5e3": 1500,
+		"-0.5":  -0.5,
+		"inf":   math.Inf(1),
+		"+inf":  math.Inf(1),
+		"-inf":  math.Inf(-1),
+		"Inf":   math.Inf(1),
+	}
+	for s, want := range accepted {
+		value, ok := ParseFloat(s)
+		assert.True(t, ok, s)
+		assert.Equal(t, want, value, s)
+	}
+	// 与 redis 一样拒绝 NaN, 空白和超出范围的值
+	for _, s := range []string{"nan", "NaN", "", " 1", "1 ", "1.5x", "1e400", "-1e400"} {
+		_, ok := ParseFloat(s)
+		assert.False(t, ok, s)
+	}
+}
@@ -0,0 +1,110 @@
+package util
+
+// GlobMatch redis风格的glob匹配, 参考redis util.c 中的 stringmatchlen
+// 支持 * ? [abc] [^a-z] 以及 \ 转义, 与 path.Match 不同, '/' 没有特殊含义
+func GlobMatch(pattern, str string) bool {
+	return globMatch(pattern, str, false)
+}
+
+// GlobMatchNoCase 忽略大小写的glob匹配
+func GlobMatchNoCase(pattern, str string) bool {
+	return globMatch(pattern, str, true)
+}
+
+func globMatch(pattern, str string, nocase bool) bool {
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := s; i < len(str); i++ {
+				if globMatch(pattern[p+1:], str[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p >= len(pattern) {
+					// 没有闭合的 '[', 与redis一致, 回退一个字符当作结尾处理
+					p--
+					break
+				}
+				if pattern[p] == '\\' && p+2 < len(pattern) {
+					p++
+					if equalByte(pattern[p], str[s], nocase) {
+						match = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if !equalByte(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	if s == len(str) {
+		for p < len(pattern) && pattern[p] == '*' {
+			p++
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
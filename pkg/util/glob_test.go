@@ -0,0 +1,37 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything/with/slash", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"__keyevent@*__:expired", "__keyevent@0__:expired", true},
+		{"__keyevent@*__:expired", "__keyevent@0__:set", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "acb", false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, GlobMatch(tc.pattern, tc.str), "pattern: %s, str: %s", tc.pattern, tc.str)
+	}
+	assert.True(t, GlobMatchNoCase("NOTIFY-*", "notify-keyspace-events"))
+	assert.False(t, GlobMatch("NOTIFY-*", "notify-keyspace-events"))
+}
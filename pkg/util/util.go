@@ -1,6 +1,8 @@
 package util
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"io"
 	"log"
 	"math/rand"
@@ -16,6 +18,14 @@ func MinInt64(a, b int64) int64 {
 	return b
 }
 
+// MaxInt64 输入两个数，返回他们较大的那个
+func MaxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func ToCmdLine(key string, args ...string) [][]byte {
 	var capp = 1 + len(args)
 	cmdLine := make([][]byte, 0, capp)
@@ -34,13 +44,14 @@ func ToCmdLine2(key string, args [][]byte) [][]byte {
 	return cmdLine
 }
 
-var expireat = []byte("expireat")
+var pexpireat = []byte("pexpireat")
 
+// MakeExpireCmd 相对的过期时间转换为毫秒精度的 pexpireat, 重放时不受加载时间的影响
 func MakeExpireCmd(key string, expireAt time.Time) [][]byte {
 	args := make([][]byte, 3)
-	args[0] = expireat
+	args[0] = pexpireat
 	args[1] = []byte(key)
-	args[2] = []byte(strconv.FormatInt(expireAt.Unix(), 10))
+	args[2] = []byte(strconv.FormatInt(expireAt.UnixMilli(), 10))
 	return args
 }
 
@@ -61,3 +72,12 @@ func Close(closer io.Closer) {
 		log.Printf("close faild with error: %v\n", err)
 	}
 }
+
+// RandHex 与 redis 的 run_id 和节点ID一样, length 个随机的十六进制字符
+func RandHex(length int) string {
+	b := make([]byte, (length+1)/2)
+	if _, err := crand.Read(b); err != nil {
+		return RandStr(length)
+	}
+	return hex.EncodeToString(b)[:length]
+}
@@ -0,0 +1,337 @@
+package redis
+
+import (
+	"container/heap"
+	"container/list"
+	"math"
+	"time"
+
+	"github.com/xuning888/godis-tiny/pkg/clock"
+	listx "github.com/xuning888/godis-tiny/pkg/datastruct/list"
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+// 阻塞命令(BLPOP, BRPOP, BLMOVE, BRPOPLPUSH, WAIT): 没有可以返回的数据时客户端被阻塞, 这条命令已经从队列中取出, 之后的命令留在队列中等待.
+// 所有阻塞的客户端按照截止时间放在同一个最小堆中, 由 OnTick 检查超时, 不为每个客户端创建 timer 或者协程.
+// OnTick 最多每秒一次, 堆顶的截止时间比下一次 OnTick 早时由一个共用的 timer 在截止时间检查.
+// 被唤醒, 超时, 断开连接或者被 CLIENT KILL 时 O(log n) 从堆中删除
+
+type blockKind int
+
+const (
+	// blockedList BLPOP, BRPOP, BLMOVE, BRPOPLPUSH 等待 list 中写入元素
+	blockedList blockKind = iota
+	// blockedWait WAIT 等待从节点确认偏移量
+	blockedWait
+	// blockedDelPattern DELPATTERN 等待定时任务分批删除完匹配的 key
+	blockedDelPattern
+)
+
+// blockState 客户端被阻塞的原因和截止时间, 持有锁时读写
+type blockState struct {
+	kind blockKind
+	// deadline 超时的时间, 为零时一直等待, 不放入堆中
+	deadline time.Time
+	// index 在 timeouts 中的位置, -1 表示不在堆中
+	index int
+	// onTimeout 超时之后回复给客户端的内容, 比如 BLPOP 的空数组, WAIT 已经确认的从节点个数
+	onTimeout func() Reply
+	// skipReply 阻塞的命令执行时是 CLIENT REPLY OFF 或者 SKIP, 唤醒时不回复
+	skipReply bool
+	// dbIndex, keys 等待的 key, elems 是客户端在每个 key 的等待队列中的位置
+	dbIndex int
+	keys    []string
+	elems   []*list.Element
+	// serve key 中有元素时为这个客户端取出元素并返回回复: BLPOP, BRPOP 弹出元素, BLMOVE 推入 destination.
+	// 返回 false 表示 list 中没有元素, 客户端继续等待
+	serve func(db *DB, key string, dequeue listx.Dequeue) (Reply, bool)
+	// numReplicas, offset WAIT 等待的从节点个数和偏移量
+	numReplicas int
+	offset      int64
+	// job DELPATTERN 还没有检查完的 key
+	job *delPatternJob
+}
+
+// dbKey db 中的一个 key, 阻塞的客户端和 WATCH 按照它查找
+type dbKey struct {
+	dbIndex int
+	key     string
+}
+
+// timeoutHeap 按照截止时间排列的阻塞客户端
+type timeoutHeap []*Client
+
+func (h timeoutHeap) Len() int {
+	return len(h)
+}
+
+func (h timeoutHeap) Less(i, j int) bool {
+	return h[i].blocked.deadline.Before(h[j].blocked.deadline)
+}
+
+func (h timeoutHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].blocked.index = i
+	h[j].blocked.index = j
+}
+
+func (h *timeoutHeap) Push(x interface{}) {
+	conn := x.(*Client)
+	conn.blocked.index = len(*h)
+	*h = append(*h, conn)
+}
+
+func (h *timeoutHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	conn := old[n-1]
+	old[n-1] = nil
+	conn.blocked.index = -1
+	*h = old[:n-1]
+	return conn
+}
+
+// blockingState server 上所有被阻塞的客户端, 持有锁时读写
+type blockingState struct {
+	timeouts timeoutHeap
+	// keys 每个 key 上等待的客户端, 不同的阻塞命令在同一个队列中, 按照阻塞的先后顺序唤醒
+	keys map[dbKey]*list.List
+	// ready 当前命令写入的有客户端等待的 key, 命令执行完之后处理
+	ready []dbKey
+	// waiting 执行 WAIT 的客户端
+	waiting map[*Client]struct{}
+	// acked 收到了从节点的 ACK, 命令执行完之后检查 WAIT 的客户端
+	acked bool
+	// deleting 执行 DELPATTERN 的客户端
+	deleting map[*Client]struct{}
+	// timer 在 timerAt 检查超时, 为 nil 时没有等待中的 timer
+	timer   *time.Timer
+	timerAt time.Time
+}
+
+// blockClient 阻塞正在执行命令的客户端, 命令返回之后不再执行队列中的命令.
+// 事务中不阻塞, 和超时一样立即回复. 调用方持有锁
+func (r *RedisServer) blockClient(conn *Client, state *blockState) {
+	if conn.inExec {
+		_ = state.onTimeout().WriteTo(conn)
+		return
+	}
+	b := &r.blocking
+	state.index = -1
+	state.skipReply = conn.replyMode == replyOff || conn.skipReply
+	conn.blocked = state
+	if !state.deadline.IsZero() {
+		heap.Push(&b.timeouts, conn)
+		if state.index == 0 {
+			r.armBlockedTimer(state.deadline)
+		}
+	}
+	switch state.kind {
+	case blockedList:
+		if b.keys == nil {
+			b.keys = make(map[dbKey]*list.List)
+		}
+		for _, key := range state.keys {
+			bk := dbKey{dbIndex: state.dbIndex, key: key}
+			queue := b.keys[bk]
+			if queue == nil {
+				queue = list.New()
+				b.keys[bk] = queue
+			}
+			state.elems = append(state.elems, queue.PushBack(conn))
+		}
+	case blockedWait:
+		if b.waiting == nil {
+			b.waiting = make(map[*Client]struct{})
+		}
+		b.waiting[conn] = struct{}{}
+	case blockedDelPattern:
+		if b.deleting == nil {
+			b.deleting = make(map[*Client]struct{})
+		}
+		b.deleting[conn] = struct{}{}
+	}
+}
+
+// removeBlocked 取消客户端的阻塞, 不回复. 调用方持有锁
+func (r *RedisServer) removeBlocked(conn *Client) {
+	state := conn.blocked
+	if state == nil {
+		return
+	}
+	b := &r.blocking
+	if state.index >= 0 {
+		heap.Remove(&b.timeouts, state.index)
+	}
+	for i, key := range state.keys {
+		bk := dbKey{dbIndex: state.dbIndex, key: key}
+		if queue := b.keys[bk]; queue != nil {
+			queue.Remove(state.elems[i])
+			if queue.Len() == 0 {
+				delete(b.keys, bk)
+			}
+		}
+	}
+	delete(b.waiting, conn)
+	delete(b.deleting, conn)
+	conn.blocked = nil
+}
+
+// unblockClient 回复被阻塞的命令, 然后唤醒客户端继续执行队列中的命令. 调用方持有锁
+func (r *RedisServer) unblockClient(conn *Client, reply Reply) {
+	state := conn.blocked
+	if state == nil {
+		return
+	}
+	r.removeBlocked(conn)
+	if !state.skipReply {
+		_ = conn.replyUnblocked(reply)
+	}
+	if conn.conn != nil {
+		_ = conn.conn.Wake(nil)
+	}
+}
+
+// signalKeyReady key 写入了 list, 有客户端在等待时当前命令执行完之后唤醒. 调用方持有锁
+func (r *RedisServer) signalKeyReady(dbIndex int, key string) {
+	bk := dbKey{dbIndex: dbIndex, key: key}
+	if _, ok := r.blocking.keys[bk]; ok {
+		r.blocking.ready = append(r.blocking.ready, bk)
+	}
+}
+
+// ackReceived 收到了从节点的 ACK. 调用方持有锁
+func (r *RedisServer) ackReceived() {
+	r.blocking.acked = true
+}
+
+// handleBlocked 每条命令执行完之后唤醒可以继续执行的客户端: 写入了 list 的 key 按照阻塞的先后顺序弹出元素,
+// 收到 ACK 之后检查 WAIT 的客户端. 调用方持有锁
+func (r *RedisServer) handleBlocked() {
+	b := &r.blocking
+	for len(b.ready) > 0 {
+		ready := b.ready
+		b.ready = nil
+		for _, bk := range ready {
+			r.serveBlockedKey(bk)
+		}
+	}
+	if b.acked {
+		b.acked = false
+		for conn := range b.waiting {
+			state := conn.blocked
+			if acked := r.repl.ackedReplicas(state.offset); acked >= state.numReplicas {
+				r.unblockClient(conn, MakeIntReply(int64(acked)))
+			}
+		}
+	}
+	r.propagatePending()
+}
+
+// serveBlockedKey 按照阻塞的先后顺序为等待的客户端取出元素, 直到没有等待的客户端或者 list 为空.
+// 弹出的元素传播为 LPOP/RPOP, 移动的元素传播为 LMOVE
+func (r *RedisServer) serveBlockedKey(bk dbKey) {
+	queue := r.blocking.keys[bk]
+	if queue == nil {
+		return
+	}
+	db := r.dbs[bk.dbIndex]
+	for queue.Len() > 0 {
+		// 读取值失败时客户端继续等待, 之后的命令读取这个 key 时回复错误
+		redisObj, exists, err := db.lookupKeyWrite(bk.key)
+		if err != nil || !exists {
+			return
+		}
+		dequeue, isList := redisObj.AsList()
+		if !isList {
+			return
+		}
+		conn := queue.Front().Value.(*Client)
+		reply, ok := conn.blocked.serve(db, bk.key, dequeue)
+		if !ok {
+			return
+		}
+		// 每个客户端取出的元素单独传播, 不和其他客户端的放在一个事务中
+		r.propagatePending()
+		r.unblockClient(conn, reply)
+	}
+}
+
+// popBlocked BLPOP, BRPOP 从 list 的头部或者尾部弹出一个元素, 和 LPOP, RPOP 一样传播和通知, 为空之后删除 key
+func popBlocked(db *DB, key string, dequeue listx.Dequeue, left bool) ([]byte, bool) {
+	event := "rpop"
+	var value interface{}
+	var err error
+	if left {
+		event = "lpop"
+		value, err = dequeue.RemoveFirst()
+	} else {
+		value, err = dequeue.RemoveLast()
+	}
+	if err != nil {
+		return nil, false
+	}
+	db.Propagate(util.ToCmdLine(event, key))
+	db.Notify(notifyList, event, key)
+	if dequeue.Len() == 0 {
+		db.Remove(key)
+		db.Notify(notifyGeneric, "del", key)
+	}
+	return value.([]byte), true
+}
+
+// parseBlockTimeout 阻塞命令以秒为单位的超时时间, 可以是小数, 0 表示一直等待
+func parseBlockTimeout(arg []byte) (time.Duration, Reply) {
+	seconds, ok := util.ParseFloat(string(arg))
+	if !ok || math.IsInf(seconds, 0) || seconds*float64(time.Second) > math.MaxInt64 {
+		return 0, MakeStandardErrReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, MakeStandardErrReply("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// blockedCron 回复已经超时的阻塞命令, 返回距离下一个截止时间的间隔, 最多 maxDelay
+func (r *RedisServer) blockedCron(maxDelay time.Duration) time.Duration {
+	lock.Lock()
+	defer lock.Unlock()
+	timeouts := &r.blocking.timeouts
+	now := dbClock.Now()
+	for timeouts.Len() > 0 {
+		state := (*timeouts)[0].blocked
+		if wait := state.deadline.Sub(now); wait > 0 {
+			r.armBlockedTimer(state.deadline)
+			if wait < maxDelay {
+				return wait
+			}
+			return maxDelay
+		}
+		r.unblockClient((*timeouts)[0], state.onTimeout())
+	}
+	return maxDelay
+}
+
+// armBlockedTimer 在 deadline 检查超时, 不用等到下一次 OnTick. 已经有更早的 timer 时不变.
+// 手动的时钟不会随着 timer 前进, 由测试调用 blockedCron. 调用方持有锁
+func (r *RedisServer) armBlockedTimer(deadline time.Time) {
+	if dbClock != clock.Real {
+		return
+	}
+	b := &r.blocking
+	if b.timer != nil {
+		if !b.timerAt.After(deadline) {
+			return
+		}
+		b.timer.Stop()
+	}
+	b.timerAt = deadline
+	b.timer = time.AfterFunc(deadline.Sub(dbClock.Now()), func() {
+		lock.Lock()
+		if b.timerAt.Equal(deadline) {
+			b.timer = nil
+		}
+		lock.Unlock()
+		r.blockedCron(time.Second)
+	})
+}
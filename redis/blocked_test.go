@@ -0,0 +1,333 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockingPop(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	waiter, waiterConn := server.newClient()
+	other, otherConn := server.newClient()
+
+	// 有元素时和 LPOP 一样立即返回
+	server.exec(t, client, "rpush", "list", "a", "b")
+	takeAof(server, file)
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\na\r\n", server.exec(t, client, "blpop", "missing", "list", "0"))
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\nb\r\n", server.exec(t, client, "brpop", "list", "0"))
+	assert.Equal(t, resp([]string{"lpop", "list"}, []string{"rpop", "list"}), takeAof(server, file))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "list"))
+
+	// 都为空时阻塞, 之后的命令留在队列中
+	assert.Equal(t, "", server.exec(t, waiter, "blpop", "list", "other", "0"))
+	assert.Equal(t, "", server.exec(t, other, "brpop", "list", "0"))
+	assert.Equal(t, "", server.exec(t, waiter, "ping"))
+	assert.True(t, waiter.HasRemaining())
+	assert.Contains(t, server.exec(t, client, "client", "list"), fmt.Sprintf("id=%d addr=%s ", waiter.id, waiter.RemoteAddr()))
+	assert.Contains(t, clientInfoString(waiter), " flags=b ")
+
+	// 按照阻塞的先后顺序唤醒, 弹出的元素传播为 LPOP/RPOP
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "rpush", "list", "x", "y", "z"))
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\nx\r\n", waiterConn.take())
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\nz\r\n", otherConn.take())
+	assert.Equal(t, 1, waiterConn.woken)
+	assert.Equal(t, resp([]string{"rpush", "list", "x", "y", "z"}, []string{"lpop", "list"}, []string{"rpop", "list"}),
+		takeAof(server, file))
+	assert.Equal(t, "*1\r\n$1\r\ny\r\n", server.exec(t, client, "lrange", "list", "0", "-1"))
+
+	// 唤醒之后继续执行队列中的命令
+	assert.Nil(t, server.process(context.Background(), waiter))
+	assert.Equal(t, "+PONG\r\n", waiterConn.take())
+
+	// 写入之后为空时删除 key
+	assert.Equal(t, "", server.exec(t, waiter, "blpop", "other", "0"))
+	server.exec(t, client, "lpush", "other", "v")
+	assert.Equal(t, "*2\r\n$5\r\nother\r\n$1\r\nv\r\n", waiterConn.take())
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "other"))
+
+	// 不同的 db 中的同名 key 不会唤醒
+	server.exec(t, waiter, "select", "1")
+	assert.Equal(t, "", server.exec(t, waiter, "blpop", "other", "0"))
+	server.exec(t, client, "rpush", "other", "v")
+	assert.Equal(t, "", waiterConn.take())
+	server.exec(t, other, "select", "1")
+	server.exec(t, other, "rpush", "other", "v1")
+	assert.Equal(t, "*2\r\n$5\r\nother\r\n$2\r\nv1\r\n", waiterConn.take())
+}
+
+// TestBlockingMixedWaiters 同一个 key 上不同的阻塞命令按照阻塞的先后顺序唤醒, BLMOVE 把元素推入自己的 destination
+func TestBlockingMixedWaiters(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	mover, moverConn := server.newClient()
+	popper, popperConn := server.newClient()
+	third, thirdConn := server.newClient()
+
+	assert.Equal(t, "", server.exec(t, mover, "blmove", "list", "dst", "left", "right", "0"))
+	assert.Equal(t, "", server.exec(t, popper, "brpop", "list", "0"))
+	assert.Equal(t, "", server.exec(t, third, "brpoplpush", "list", "dst", "0"))
+	takeAof(server, file)
+
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "rpush", "list", "a", "b"))
+	assert.Equal(t, "$1\r\na\r\n", moverConn.take())
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\nb\r\n", popperConn.take())
+	assert.Equal(t, "", thirdConn.take())
+	assert.NotNil(t, third.blocked)
+	assert.Equal(t, resp([]string{"rpush", "list", "a", "b"}, []string{"lmove", "list", "dst", "left", "right"},
+		[]string{"rpop", "list"}), takeAof(server, file))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "list"))
+
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "lpush", "list", "c"))
+	assert.Equal(t, "$1\r\nc\r\n", thirdConn.take())
+	assert.Equal(t, "*2\r\n$1\r\nc\r\n$1\r\na\r\n", server.exec(t, client, "lrange", "dst", "0", "-1"))
+	assert.Equal(t, resp([]string{"lpush", "list", "c"}, []string{"lmove", "list", "dst", "right", "left"}), takeAof(server, file))
+
+	// 推入 destination 时唤醒等待 destination 的客户端
+	server.exec(t, client, "del", "dst")
+	assert.Equal(t, "", server.exec(t, popper, "blpop", "dst", "0"))
+	assert.Equal(t, "", server.exec(t, mover, "blmove", "list", "dst", "right", "left", "0"))
+	server.exec(t, client, "rpush", "list", "x")
+	assert.Equal(t, "$1\r\nx\r\n", moverConn.take())
+	assert.Equal(t, "*2\r\n$3\r\ndst\r\n$1\r\nx\r\n", popperConn.take())
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "dst"))
+
+	// destination 不是 list 时回复 WRONGTYPE, 元素留给下一个客户端
+	server.exec(t, client, "set", "str", "v")
+	assert.Equal(t, "", server.exec(t, mover, "blmove", "list", "str", "left", "left", "0"))
+	assert.Equal(t, "", server.exec(t, popper, "blpop", "list", "0"))
+	server.exec(t, client, "rpush", "list", "y")
+	assert.Equal(t, wrongTypeReply, moverConn.take())
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\ny\r\n", popperConn.take())
+}
+
+func TestBlockingPopErrors(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "str", "v")
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		server.exec(t, client, "blpop", "missing", "str", "0"))
+	assert.Equal(t, "-ERR timeout is negative\r\n", server.exec(t, client, "blpop", "list", "-1"))
+	assert.Equal(t, "-ERR timeout is not a float or out of range\r\n", server.exec(t, client, "brpop", "list", "abc"))
+	assert.Equal(t, "-ERR timeout is not a float or out of range\r\n", server.exec(t, client, "brpop", "list", "inf"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'blpop' command\r\n", server.exec(t, client, "blpop", "list"))
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", server.exec(t, client, "command", "getkeys", "blpop", "a", "b", "0"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "blmove", "list", "dst", "up", "left", "0"))
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		server.exec(t, client, "brpoplpush", "str", "dst", "0"))
+	assert.Equal(t, "-ERR timeout is negative\r\n", server.exec(t, client, "brpoplpush", "list", "dst", "-1"))
+	assert.Nil(t, client.blocked)
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, conn := server.newClient()
+	resp3, resp3Conn := server.newClient()
+	server.exec(t, resp3, "hello", "3")
+
+	assert.Equal(t, "", server.exec(t, client, "blpop", "list", "0.5"))
+	assert.Equal(t, "", server.exec(t, resp3, "brpop", "list", "1"))
+	clk.Advance(400 * time.Millisecond)
+	// 下一次检查的时间是最近的截止时间
+	assert.Equal(t, 100*time.Millisecond, server.blockedCron(time.Second))
+	assert.Equal(t, "", conn.take())
+	clk.Advance(100 * time.Millisecond)
+	assert.Equal(t, 500*time.Millisecond, server.blockedCron(time.Second))
+	assert.Equal(t, "*-1\r\n", conn.take())
+	assert.Nil(t, client.blocked)
+	clk.Advance(500 * time.Millisecond)
+	assert.Equal(t, 300*time.Millisecond, server.blockedCron(300*time.Millisecond))
+	assert.Equal(t, "_\r\n", resp3Conn.take())
+
+	// BLMOVE 超时回复空的 bulk string
+	assert.Equal(t, "", server.exec(t, client, "blmove", "list", "dst", "left", "left", "0.5"))
+	clk.Advance(500 * time.Millisecond)
+	server.blockedCron(time.Second)
+	assert.Equal(t, "$-1\r\n", conn.take())
+
+	// 超时为 0 时一直等待, 不放入堆中
+	assert.Equal(t, "", server.exec(t, client, "blpop", "list", "0"))
+	assert.Equal(t, 0, server.blocking.timeouts.Len())
+	clk.Advance(time.Hour)
+	server.blockedCron(time.Second)
+	assert.Equal(t, "", conn.take())
+	assert.NotNil(t, client.blocked)
+
+	// CLIENT REPLY OFF 时超时之后也不回复
+	other, otherConn := server.newClient()
+	server.exec(t, other, "client", "reply", "off")
+	server.exec(t, other, "blpop", "list", "1")
+	clk.Advance(time.Second)
+	server.blockedCron(time.Second)
+	assert.Nil(t, other.blocked)
+	assert.Equal(t, "", otherConn.take())
+}
+
+func TestBlockedDisconnect(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	waiter, _ := server.newClient()
+	killed, killedConn := server.newClient()
+	other, otherConn := server.newClient()
+
+	server.exec(t, waiter, "blpop", "list", "1")
+	server.exec(t, killed, "blpop", "list", "1")
+	server.exec(t, other, "blpop", "list", "2")
+	assert.Equal(t, 3, server.blocking.timeouts.Len())
+
+	// 断开连接和 CLIENT KILL 都从堆和等待队列中删除
+	server.freeClient(waiter)
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "client", "kill", "id", fmt.Sprint(killed.id)))
+	assert.True(t, killedConn.closed)
+	assert.Nil(t, killed.blocked)
+	assert.Equal(t, 1, server.blocking.timeouts.Len())
+	assert.Equal(t, 1, server.blocking.keys[dbKey{key: "list"}].Len())
+
+	server.exec(t, client, "rpush", "list", "a")
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\na\r\n", otherConn.take())
+	assert.Equal(t, 0, server.blocking.timeouts.Len())
+	assert.Empty(t, server.blocking.keys)
+	clk.Advance(time.Minute)
+	server.blockedCron(time.Second)
+	assert.Equal(t, "", otherConn.take())
+
+	// 旧的格式和过滤器
+	assert.Equal(t, "-ERR No such client\r\n", server.exec(t, client, "client", "kill", "127.0.0.1:1"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "client", "kill", other.RemoteAddr().String()))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "client", "kill", "addr", client.RemoteAddr().String()))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "client", "kill", "id", "1", "skipme"))
+	assert.Equal(t, "-ERR client-id should be greater than 0\r\n", server.exec(t, client, "client", "kill", "id", "0"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "client", "kill", "addr", client.RemoteAddr().String(), "skipme", "no"))
+	assert.True(t, client.closeAfterReply)
+}
+
+func TestWait(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, conn := server.newClient()
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "wait", "0", "0"))
+	assert.Equal(t, "-ERR timeout is negative\r\n", server.exec(t, client, "wait", "1", "-1"))
+
+	// 没有从节点时等到超时
+	assert.Equal(t, "", server.exec(t, client, "wait", "1", "100"))
+	clk.Advance(100 * time.Millisecond)
+	server.blockedCron(time.Second)
+	assert.Equal(t, ":0\r\n", conn.take())
+
+	replica, replicaConn := server.newClient()
+	assert.True(t, strings.HasPrefix(server.exec(t, replica, "psync", "?", "-1"), "+FULLRESYNC "))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(infoField(t, server, client, "slave0"), "state=online")
+	}, 5*time.Second, 10*time.Millisecond)
+	server.exec(t, client, "set", "foo", "bar")
+	offset := infoField(t, server, client, "master_repl_offset")
+	replicaConn.take()
+
+	// 阻塞之后请求从节点立即发送 ACK, 确认的偏移量追上之后唤醒
+	assert.Equal(t, "", server.exec(t, client, "wait", "1", "0"))
+	assert.Equal(t, "*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n", replicaConn.take())
+	server.exec(t, replica, "replconf", "ack", "1")
+	assert.Equal(t, "", conn.take())
+	server.exec(t, replica, "replconf", "ack", offset)
+	assert.Equal(t, ":1\r\n", conn.take())
+	assert.Nil(t, client.blocked)
+}
+
+// TestBlockedTimeoutsStress 1万个客户端的超时错开, 每次 cron 都回复所有到期的客户端, 没有为每个客户端创建协程
+func TestBlockedTimeoutsStress(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	const clients = 10000
+	const tick = 10 * time.Millisecond
+	goroutines := runtime.NumGoroutine()
+	conns := make([]*fakeConn, clients)
+	deadlines := make([]time.Time, clients)
+	for i := 0; i < clients; i++ {
+		client, conn := server.newClient()
+		timeout := fmt.Sprintf("%.3f", float64(i%100+1)*0.0073)
+		require.Equal(t, "", server.exec(t, client, "blpop", fmt.Sprintf("key:%d", i), timeout))
+		conns[i], deadlines[i] = conn, client.blocked.deadline
+	}
+	assert.Equal(t, clients, server.blocking.timeouts.Len())
+	assert.Less(t, runtime.NumGoroutine(), goroutines+10)
+
+	fired := make([]bool, clients)
+	for server.blocking.timeouts.Len() > 0 {
+		clk.Advance(tick)
+		server.blockedCron(time.Second)
+		now := clk.Now()
+		for i, conn := range conns {
+			if fired[i] {
+				continue
+			}
+			out := conn.take()
+			if deadlines[i].After(now) {
+				require.Equal(t, "", out, "client %d fired before its deadline", i)
+				continue
+			}
+			// 截止时间在这次 cron 之前, 最多晚一个 tick
+			require.Equal(t, "*-1\r\n", out, "client %d missed its deadline", i)
+			require.True(t, now.Sub(deadlines[i]) < tick)
+			fired[i] = true
+		}
+	}
+	for i := range fired {
+		assert.True(t, fired[i])
+	}
+	assert.Empty(t, server.blocking.keys)
+}
+
+// TestBlockingTimeoutLatency 截止时间比下一次 OnTick 早时不需要等到 OnTick, 超时之后很快回复
+func TestBlockingTimeoutLatency(t *testing.T) {
+	server := newTestServer()
+	port := serve(t, server)
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	conn, reader := dial()
+	roundTrip := func(args ...string) (string, time.Duration) {
+		start := time.Now()
+		_, err := conn.Write([]byte(resp(args)))
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		return line, time.Since(start)
+	}
+	// 多次阻塞, 截止时间落在 OnTick 周期中的不同位置
+	for i := 0; i < 5; i++ {
+		line, elapsed := roundTrip("blpop", "nolist", "0.1")
+		assert.Equal(t, "*-1\r\n", line)
+		assert.GreaterOrEqual(t, int64(elapsed), int64(100*time.Millisecond), elapsed.String())
+		assert.Less(t, int64(elapsed), int64(150*time.Millisecond), elapsed.String())
+	}
+
+	// 更早的截止时间代替已经设置的 timer, 之后再检查较晚的截止时间
+	other, otherReader := dial()
+	start := time.Now()
+	_, err := other.Write([]byte(resp([]string{"blpop", "nolist", "0.3"})))
+	require.NoError(t, err)
+	line, elapsed := roundTrip("wait", "2", "100")
+	assert.Equal(t, ":0\r\n", line)
+	assert.Less(t, int64(elapsed), int64(150*time.Millisecond), elapsed.String())
+	line, err = otherReader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "*-1\r\n", line)
+	assert.Less(t, int64(time.Since(start)), int64(350*time.Millisecond), time.Since(start).String())
+}
@@ -2,34 +2,221 @@ package redis
 
 import (
 	"bufio"
+	"bytes"
 	"container/list"
+	"context"
 	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/config"
 	"go.uber.org/zap"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// 客户端使用的协议版本
+const (
+	resp2 = 2
+	resp3 = 3
+)
+
+// 客户端 CLIENT TRACKING 的状态, 与redis server.h 中的 CLIENT_TRACKING_* 对应
+const (
+	trackingEnabled = 1 << iota
+	trackingBcast
+	trackingOptin
+	trackingOptout
+	trackingNoloop
+	// trackingCaching CLIENT CACHING yes|no, 只对下一条命令生效
+	trackingCaching
+)
+
+// replyFlushThreshold 流水线中缓存的回复超过这个大小时不等队列中的命令执行完就先发送
+const replyFlushThreshold = 16 * 1024
+
+// maxCommandsPerEvent 一次 OnTraffic 最多连续执行一个客户端的多少条命令, 剩下的命令留在队列中,
+// 释放锁之后通过 Wake 再次触发 OnTraffic, 流水线很长的客户端不会一直占用锁和 event loop
+const maxCommandsPerEvent = 64
+
+// replyWriterPool 回复的缓冲区只在执行命令期间持有, 发送之后放回去, 空闲的连接不占用
+var replyWriterPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, 1<<16) // 64KB
+	},
+}
+
+// nextClientId 客户端ID, 单调递增, 不会复用
+var nextClientId int64 = 0
+
 type DBRangeCheck func(index int) error
 
 type Rewrite func() error
 
 type ClearDatabase func()
 
+// FlushAll FLUSHALL 清空所有的 db, lazy 时旧的数据在后台释放
+type FlushAll func(lazy bool)
+
+// ResetStats CONFIG RESETSTAT 清零 INFO 中的统计
+type ResetStats func()
+
+// RequestShutdown SHUTDOWN 命令开始关闭, flags 是 SHUTDOWN 的参数
+type RequestShutdown func(flags int)
+
+// BlockClient 阻塞命令没有数据可以返回时阻塞客户端, 见 blockClient
+type BlockClient func(conn *Client, state *blockState)
+
+// KillClient CLIENT KILL 断开客户端, 取消订阅和阻塞
+type KillClient func(target *Client)
+
+// ExecTransaction EXEC 执行事务中排队的命令
+type ExecTransaction func(ctx context.Context, conn *Client) error
+
+// Persister SAVE, BGSAVE, LASTSAVE, DEBUG RELOAD, DEBUG LOADAOF 和 INFO persistence 使用的持久化接口
+type Persister interface {
+	SaveRdb() error
+	BgSaveRdb() error
+	LastSave() int64
+	ReloadRdb() error
+	ReloadAof() error
+	InfoPersistence() string
+}
+
+// MemoryReporter INFO memory
+type MemoryReporter interface {
+	InfoMemory() string
+}
+
+// KeyspaceReporter INFO keyspace
+type KeyspaceReporter interface {
+	InfoKeyspace() string
+}
+
 type Client struct {
 	Fd              int
+	id              int64
+	name            string
+	libName         string // CLIENT SETINFO 设置的客户端库的名字, CLIENT LIST 的 lib-name
+	libVer          string // CLIENT SETINFO 设置的客户端库的版本, CLIENT LIST 的 lib-ver
+	protocol        int
 	dbId            int
 	db              *DB
 	RangeCheck      DBRangeCheck
 	Rewrite         Rewrite
 	ClearDatabase   ClearDatabase
+	FlushAll        FlushAll
+	ResetStats      ResetStats
+	RequestShutdown RequestShutdown
+	Block           BlockClient
+	KillClient      KillClient
+	ExecTransaction ExecTransaction
+	Persister       Persister
+	Memory          MemoryReporter
+	Keyspace        KeyspaceReporter
+	PubSub          *PubSub
+	Tracking        *Tracking
+	Watches         *Watches
+	Clients         *Manager
+	Scripting       *Scripting
+	Replication     *Replication
 	inner           bool
 	totalReplyBytes int
 	conn            gnet.Conn
-	writeBuffer     *bufio.Writer
-	codec           *Codec
-	curCommand      [][]byte
-	queryBuffer     *list.List
-	lg              *zap.Logger
+	// replySink 没有网络连接的客户端(比如lua脚本)把回复写到这里, pushSink 接收这样的客户端的推送
+	replySink *bytes.Buffer
+	pushSink  func(data []byte)
+	// capture 注册了 hook 时记录执行命令期间写入的回复
+	capture     *bytes.Buffer
+	writeBuffer *bufio.Writer
+	codec       *Codec
+	curCommand  [][]byte
+	queryBuffer *list.List
+	subChannels map[string]struct{}
+	subPatterns map[string]struct{}
+	// CLIENT TRACKING
+	trackingFlags    int
+	trackingRedirect int64
+	trackingPrefixes map[string]struct{}
+	// master 从节点上主节点的复制连接, 可以执行写命令, 回复不会发送给主节点
+	master bool
+	// repl 主节点上从节点的复制连接, 执行 REPLCONF 之后创建
+	repl *replica
+	// readOnly READONLY 之后为 true, 集群模式下这个连接可以从从节点读取, READWRITE 和 RESET 清除
+	readOnly bool
+	// authenticated 通过了 AUTH, 没有配置 requirepass 时创建的客户端不需要认证
+	authenticated bool
+	// paused 暂停写命令期间下一条命令需要等待, 恢复之后继续执行队列中的命令
+	paused bool
+	// blocked 被阻塞命令阻塞, 唤醒之前不执行队列中的命令. 持有锁时读写
+	blocked *blockState
+	// multi MULTI 之后排队的命令, 不在事务中时为 nil. inExec 正在执行 EXEC 中的命令
+	multi  *multiState
+	inExec bool
+	// watchedKeys WATCH 的 key, dirtyCAS 其中有 key 被修改了, EXEC 失败
+	watchedKeys []dbKey
+	dirtyCAS    bool
+	// executing 正在持有锁执行这个客户端的命令
+	executing bool
+	// closeAfterReply QUIT 之后发送完回复关闭连接
+	closeAfterReply bool
+	// ctime 创建的时间, lastInteraction 最近一次执行命令的时间, 持有锁时读写
+	ctime           time.Time
+	lastInteraction time.Time
+	// deferFlush 执行队列中的命令期间先缓存回复, 队列中的命令都执行完或者缓存超过 replyFlushThreshold 时才发送.
+	// 写命令的效果写入 aof 之后才会发送, appendfsync always 在回复之前 fsync
+	deferFlush bool
+	// streaming 正在写入流式回复, 推送不能写入缓冲区, 在 event loop 中排在回复之后
+	streaming bool
+	// asyncOutput 已经交给 event loop 还没有写入的推送, outputBytes 最近一次计算的输出缓冲区大小
+	asyncOutput atomic.Int64
+	outputBytes atomic.Int64
+	// softLimitSince 开始超过软限制的时间, 只在 event loop 中读写
+	softLimitSince time.Time
+	// socket 回复写入 gnet 连接时经过这里. queuedBytes 交给连接的字节数, 减去 gnet 还没有写出的就是已经写入 socket 的字节数.
+	// lastSent writeStalledSince 最近一次检查时写出的字节数和从什么时候开始没有写出数据, 见 checkWriteTimeout. 只在 event loop 中读写
+	socket            socketWriter
+	queuedBytes       int64
+	lastSent          int64
+	writeStalledSince time.Time
+	// closeAsap 超过了输出缓冲区的限制, 正在关闭, 不再写入
+	closeAsap atomic.Bool
+	// noEvict CLIENT NO-EVICT on, 不受输出缓冲区限制
+	noEvict atomic.Bool
+	// replyMode CLIENT REPLY ON|OFF|SKIP, skipReply 当前命令的回复不发送
+	replyMode int
+	skipReply bool
+	// replyFailed 当前命令回复了错误, INFO commandstats 的 failed_calls
+	replyFailed bool
+	// history 最近收到的命令, lastCmd 最近一条存在的命令的名字, CLIENT LIST 的 cmd. 持有锁时读写
+	history cmdHistory
+	lastCmd string
+	// lastLookup 最近一次查找到的命令, 连接重复发送同一个命令时不再查找 commandRouter
+	lastLookup *Command
+	// boundTo 已经通过 bindClient 注入了依赖的 server
+	boundTo *RedisServer
+	// stats 回复的字节数计入 total_net_output_bytes, 由 server 绑定
+	stats *serverStats
+	// proxyPending 打开了 enable-proxy-protocol, 还没有收到 PROXY 头部.
+	// proxySrc 和 proxyDst 是头部中的地址, 代替连接本身的地址
+	proxyPending bool
+	proxySrc     net.Addr
+	proxyDst     net.Addr
+	// localAddr 连接实际的本地地址(见 acceptedLocalAddr), 为 nil 时使用连接的 LocalAddr
+	localAddr net.Addr
+	lg        *zap.Logger
+}
+
+func (c *Client) GetId() int64 {
+	return c.id
+}
+
+func (c *Client) Protocol() int {
+	return c.protocol
+}
+
+func (c *Client) IsTracking() bool {
+	return c.trackingFlags&trackingEnabled != 0
 }
 
 func (c *Client) GetDbIndex() int {
@@ -57,28 +244,155 @@ func (c *Client) Decode() error {
 }
 
 func (c *Client) RemoteAddr() net.Addr {
+	if c.proxySrc != nil {
+		return c.proxySrc
+	}
 	return c.conn.RemoteAddr()
 }
 
+func (c *Client) LocalAddr() net.Addr {
+	if c.proxyDst != nil {
+		return c.proxyDst
+	}
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.conn.LocalAddr()
+}
+
+// CLIENT REPLY 的三种模式
+const (
+	replyOn = iota
+	replyOff
+	// replySkip 跳过下一条命令的回复
+	replySkip
+)
+
+// 发送给客户端的数据只在客户端所在的 event loop 中写入连接, 每次写入的都是完整的消息, 推送只会出现在两条消息之间:
+// 执行自己的命令期间(持有锁)回复和推送按照产生的顺序写入 writeBuffer, 队列中的命令执行完之后在 event loop 中发送;
+// 其他时候的推送(其他客户端的 PUBLISH, 失效消息, 唤醒阻塞的命令)通过 asyncWrite 把完整的消息交给 event loop,
+// 流式回复期间的推送同样排在回复之后. 输出缓冲区的限制在 checkOutputLimit 中统一计算这两部分
+
+// Write 写入命令的回复, CLIENT REPLY OFF 或者 SKIP 时直接丢弃
 func (c *Client) Write(bytes []byte) (int, error) {
+	if c.replyMode != replyOn || c.skipReply {
+		return len(bytes), nil
+	}
+	return c.write(bytes)
+}
+
+// writeError 写入错误回复, 并记录当前命令失败了
+func (c *Client) writeError(bytes []byte) (int, error) {
+	c.replyFailed = true
+	return c.Write(bytes)
+}
+
+// write 写入客户端的缓冲区, 推送不受 CLIENT REPLY 影响
+func (c *Client) write(bytes []byte) (int, error) {
+	if c.capture != nil {
+		c.capture.Write(bytes)
+	}
 	if c.conn == nil {
+		if c.replySink != nil {
+			return c.replySink.Write(bytes)
+		}
 		return 0, nil
 	}
+	if c.writeBuffer == nil {
+		c.writeBuffer = replyWriterPool.Get().(*bufio.Writer)
+		c.socket.client = c
+		c.writeBuffer.Reset(&c.socket)
+	}
 	n, err := c.writeBuffer.Write(bytes)
 	if err != nil {
 		return 0, err
 	}
 	c.totalReplyBytes += n
+	if c.stats != nil {
+		c.stats.netOutputBytes.Add(int64(n))
+	}
+	return n, err
+}
+
+// socketWriter 把缓存的回复交给 gnet 连接并记录字节数. gnet 的写入不会阻塞, socket 写不完的部分留在连接的输出缓冲区,
+// 之后可写时由 event loop 继续写入
+type socketWriter struct {
+	client *Client
+}
+
+func (w *socketWriter) Write(p []byte) (int, error) {
+	n, err := w.client.conn.Write(p)
+	w.client.queuedBytes += int64(n)
 	return n, err
 }
 
+// bufferedReplies 还没有发送的回复的字节数
+func (c *Client) bufferedReplies() int {
+	if c.writeBuffer == nil {
+		return 0
+	}
+	return c.writeBuffer.Buffered()
+}
+
 func (c *Client) Flush() error {
-	if c.writeBuffer.Buffered() > 0 {
-		if err := c.writeBuffer.Flush(); err != nil {
+	if c.deferFlush {
+		return nil
+	}
+	return c.flushReplies()
+}
+
+// flushReplies 发送缓存的回复, 只能在 event loop 中调用; event loop 之外的推送使用 Push
+func (c *Client) flushReplies() error {
+	if c.conn == nil || c.writeBuffer == nil {
+		return nil
+	}
+	w := c.writeBuffer
+	c.writeBuffer = nil
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.Reset(nil)
+	replyWriterPool.Put(w)
+	return nil
+}
+
+// Push 向客户端推送消息(pub/sub), 按照客户端的协议版本编码. 调用方持有锁.
+// 客户端正在执行自己的命令时推送和回复一起缓存, 保持顺序; 否则在客户端的 event loop 中写入, 并检查输出缓冲区的限制
+func (c *Client) Push(reply Reply) error {
+	if c.conn == nil {
+		if c.pushSink != nil {
+			c.pushSink(encodeReply(reply, c.protocol))
+		}
+		return nil
+	}
+	data := encodeReply(reply, c.protocol)
+	if c.deferFlush && !c.streaming {
+		_, err := c.write(data)
+		return err
+	}
+	return c.asyncWrite(data, c.obufClass())
+}
+
+// replyUnblocked 回复被唤醒或者超时的阻塞命令. 客户端没有在执行自己的命令, 和推送一样在客户端的 event loop 中写入. 调用方持有锁
+func (c *Client) replyUnblocked(reply Reply) error {
+	data := encodeReply(reply, c.protocol)
+	if c.conn == nil {
+		if c.replySink != nil {
+			_, err := c.replySink.Write(data)
 			return err
 		}
+		return nil
 	}
-	return nil
+	if c.deferFlush && !c.streaming {
+		_, err := c.write(data)
+		return err
+	}
+	return c.asyncWrite(data, c.obufClass())
+}
+
+// SubscriptionCount 客户端订阅的channel和pattern的总数
+func (c *Client) SubscriptionCount() int {
+	return len(c.subChannels) + len(c.subPatterns)
 }
 
 func (c *Client) PollCmd() [][]byte {
@@ -104,13 +418,46 @@ func (c *Client) ResetQueryBuffer() {
 	c.queryBuffer.Init()
 }
 
+// resetState 取消订阅, tracking 和事务, RESET 和连接关闭时共用
+func (c *Client) resetState() {
+	c.multi = nil
+	if c.Watches != nil {
+		c.Watches.UnwatchAll(c)
+	}
+	if c.PubSub != nil {
+		c.PubSub.UnsubscribeAll(c)
+	}
+	if c.Tracking != nil && c.IsTracking() {
+		c.Tracking.Disable(c)
+	}
+}
+
+// GetCmdName, GetArgs, GetArgNum 和 GetCmdLine 返回的是正在执行的命令, 只在命令执行期间有效:
+// 命令返回之后 curCommand 会被清空或者换成下一条命令, 需要在之后使用(脚本, 后台任务)的要先保存 GetCmdLine 的结果.
+// 每条命令的参数都是解码时新分配的, 不会复用, 保存的切片不会被后面的命令改写
 func (c *Client) GetCmdName() string {
 	if len(c.curCommand) == 0 {
 		return ""
 	}
+	// 存在的命令返回注册的名字, 不分配内存
+	if cmd := c.resolveCommand(c.curCommand[0]); cmd != nil {
+		return cmd.name
+	}
 	return strings.ToLower(string(c.curCommand[0]))
 }
 
+// resolveCommand 不区分大小写查找命令, 先检查这个连接上一次查找到的命令
+func (c *Client) resolveCommand(name []byte) *Command {
+	if cmd := c.lastLookup; cmd != nil && equalFoldASCII(name, cmd.name) {
+		return cmd
+	}
+	cmd := lookupCommand(name)
+	if cmd != nil {
+		c.lastLookup = cmd
+	}
+	return cmd
+}
+
 func (c *Client) GetArgs() [][]byte {
 	if len(c.curCommand) <= 1 {
 		return nil
@@ -132,11 +479,17 @@ func (c *Client) GetCmdLine() [][]byte {
 func NewClient(Fd int, conn gnet.Conn, inner bool) *Client {
 	client := &Client{}
 	client.Fd = Fd
+	client.id = atomic.AddInt64(&nextClientId, 1)
+	client.protocol = resp2
 	client.dbId = 0
 	client.conn = conn
-	client.writeBuffer = bufio.NewWriterSize(conn, 1<<16) // 64KB
+	client.ctime = time.Now()
+	client.lastInteraction = client.ctime
 	client.codec = NewCodec()
 	client.inner = inner
+	client.authenticated = config.Properties.RequirePass == ""
 	client.queryBuffer = list.New()
+	client.subChannels = make(map[string]struct{})
+	client.subPatterns = make(map[string]struct{})
 	return client
 }
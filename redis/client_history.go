@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 每个客户端记录最近收到的命令, 命令执行时 panic 的话和 CLIENT INFO 一起写入日志, 可以知道是哪个客户端发送了什么.
+// 参数截断之后写入每个位置复用的缓冲区, 不持有命令的参数, 预热之后记录不分配内存
+
+const (
+	// cmdHistorySize 每个客户端记录的命令条数
+	cmdHistorySize = 8
+	// cmdHistoryArgs 每条命令最多记录的参数个数, 包括命令名
+	cmdHistoryArgs = 8
+	// cmdHistoryArgLen 每个参数最多记录的字节数
+	cmdHistoryArgLen = 32
+)
+
+// cmdHistory 最近的命令组成的环, 持有锁时读写
+type cmdHistory struct {
+	entries [cmdHistorySize][]byte
+	// next 下一条命令写入的位置, count 已经记录的条数
+	next  int
+	count int
+}
+
+// record 记录一条命令, 参数加上引号, 超过长度的参数和超过个数的参数只记录长度和个数
+func (h *cmdHistory) record(cmdLine [][]byte) {
+	entry := h.entries[h.next][:0]
+	for i, arg := range cmdLine {
+		if i == cmdHistoryArgs {
+			entry = append(entry, " ...("...)
+			entry = strconv.AppendInt(entry, int64(len(cmdLine)-i), 10)
+			entry = append(entry, " more arguments)"...)
+			break
+		}
+		if i > 0 {
+			entry = append(entry, ' ')
+		}
+		if len(arg) <= cmdHistoryArgLen {
+			entry = strconv.AppendQuote(entry, string(arg))
+			continue
+		}
+		entry = strconv.AppendQuote(entry, string(arg[:cmdHistoryArgLen]))
+		entry = append(entry, "...("...)
+		entry = strconv.AppendInt(entry, int64(len(arg)), 10)
+		entry = append(entry, " bytes)"...)
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % cmdHistorySize
+	if h.count < cmdHistorySize {
+		h.count++
+	}
+}
+
+// String 从旧到新每行一条命令
+func (h *cmdHistory) String() string {
+	builder := &strings.Builder{}
+	for i := 0; i < h.count; i++ {
+		index := (h.next - h.count + i + cmdHistorySize) % cmdHistorySize
+		builder.Write(h.entries[index])
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+func TestCmdHistory(t *testing.T) {
+	h := &cmdHistory{}
+	assert.Equal(t, "", h.String())
+	h.record(util.ToCmdLine("set", "k", strings.Repeat("v", 100)))
+	h.record(util.ToCmdLine("del", "a", "b", "c", "d", "e", "f", "g", "h", "i"))
+	assert.Equal(t, `"set" "k" "`+strings.Repeat("v", cmdHistoryArgLen)+`"...(100 bytes)`+"\n"+
+		`"del" "a" "b" "c" "d" "e" "f" "g" ...(2 more arguments)`+"\n", h.String())
+
+	// 超过容量之后覆盖最旧的
+	for i := 0; i < cmdHistorySize+3; i++ {
+		h.record(util.ToCmdLine("get", strconv.Itoa(i)))
+	}
+	lines := strings.Split(strings.TrimSuffix(h.String(), "\n"), "\n")
+	assert.Len(t, lines, cmdHistorySize)
+	assert.Equal(t, `"get" "3"`, lines[0])
+	assert.Equal(t, `"get" "10"`, lines[cmdHistorySize-1])
+}
+
+func TestCommandPanic(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger.SetLogger(logger.NewStd(buf))
+	defer logger.SetLogger(logger.NewStd(os.Stderr))
+	register("testpanic", func(c context.Context, conn *Client) error {
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		panic("boom")
+	}, withArity(-1), withFlags(flagWrite))
+	defer delete(commandRouter, "testpanic")
+
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	other, _ := server.newClient()
+	assert.Contains(t, clientInfoString(client), " cmd=NULL ")
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "nosuchcmd", "x")
+	assert.Contains(t, clientInfoString(client), " cmd=set ")
+	takeAof(server, file)
+
+	assert.Equal(t, "-ERR internal error\r\n", server.exec(t, client, "testpanic", "arg"))
+	// server 继续运行, panic 之前的修改照常传播
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, other, "get", "foo"))
+	assert.Equal(t, resp([]string{"testpanic", "arg"}), takeAof(server, file))
+	assert.Contains(t, server.exec(t, client, "client", "info"), " cmd=client ")
+	assert.Contains(t, server.exec(t, other, "info", "commandstats"), "cmdstat_testpanic:calls=1,")
+
+	log := buf.String()
+	assert.Contains(t, log, "panic executing command 'testpanic': boom")
+	assert.Contains(t, log, "id="+strconv.FormatInt(client.id, 10)+" ")
+	assert.Contains(t, log, " cmd=testpanic ")
+	assert.Contains(t, log, "recent commands:\n\"set\" \"foo\" \"bar\"\n\"nosuchcmd\" \"x\"\n\"testpanic\" \"arg\"\n")
+	assert.Contains(t, log, "client_history_test.go")
+}
@@ -1,44 +1,128 @@
 package redis
 
-var ConnCounter ConnCount = nil
-
-type ConnCount interface {
-
-	// CountConnections connected_clients
-	CountConnections() int
-}
+import (
+	"strings"
+	"sync"
+)
 
+// Manager 连接由 event loop 注册和移除, 但是定时任务也会读取, 所以需要加锁
 type Manager struct {
+	mux   sync.RWMutex
 	conns map[int]*Client
+	ids   map[int64]*Client
+	// rejected 达到 maxclients 之后拒绝的连接数量, INFO 的 rejected_connections
+	rejected int64
 }
 
+// CountConnections connected_clients
 func (s *Manager) CountConnections() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	return len(s.conns)
 }
 
+// RejectedConnections rejected_connections
+func (s *Manager) RejectedConnections() int64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.rejected
+}
+
+// ResetRejected CONFIG RESETSTAT
+func (s *Manager) ResetRejected() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.rejected = 0
+}
+
+// TryRegisterConn 连接数没有达到 maxClients 时注册连接. 检查和注册在同一把锁内,
+// 多个 event loop 同时接受连接时也不会超过上限
+func (s *Manager) TryRegisterConn(fd int, client *Client, maxClients int) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.conns) >= maxClients {
+		s.rejected++
+		return false
+	}
+	s.conns[fd] = client
+	s.ids[client.id] = client
+	return true
+}
+
 func (s *Manager) RegisterConn(fd int, client *Client) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	s.conns[fd] = client
+	s.ids[client.id] = client
 }
 
 func (s *Manager) RemoveConnByKey(fd int) {
-	_, exists := s.conns[fd]
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	client, exists := s.conns[fd]
 	if exists {
 		delete(s.conns, fd)
+		delete(s.ids, client.id)
 		return
 	}
 }
 
 func (s *Manager) Get(fd int) *Client {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	c := s.conns[fd]
 	return c
 }
 
+// GetById 按照 CLIENT ID 查找客户端
+func (s *Manager) GetById(id int64) *Client {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.ids[id]
+}
+
+// LibraryCounts 每个客户端库的连接数, INFO clients 的 client_libs. 库名是 lib-name 中 '(' 之前的部分,
+// go-redis 在括号中附加了 go 的版本等信息. 没有 CLIENT SETINFO 的连接不统计. 调用方持有全局锁, lib-name 不会被修改
+func (s *Manager) LibraryCounts() map[string]int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	counts := make(map[string]int)
+	for _, client := range s.conns {
+		if client.libName == "" {
+			continue
+		}
+		name := client.libName
+		if i := strings.IndexByte(name, '('); i > 0 {
+			name = name[:i]
+		}
+		counts[name]++
+	}
+	return counts
+}
+
+// ForEach 遍历所有的客户端, 回调在锁外执行
+func (s *Manager) ForEach(fn func(client *Client)) {
+	s.mux.RLock()
+	clients := make([]*Client, 0, len(s.conns))
+	for _, client := range s.conns {
+		clients = append(clients, client)
+	}
+	s.mux.RUnlock()
+	for _, client := range clients {
+		fn(client)
+	}
+}
+
 func (s *Manager) RemoveConn(conn *Client) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	delete(s.conns, conn.Fd)
+	delete(s.ids, conn.id)
 }
 
 func NewManager() *Manager {
 	return &Manager{
 		conns: make(map[int]*Client),
+		ids:   make(map[int64]*Client),
 	}
 }
@@ -0,0 +1,207 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 客户端输出缓冲区的限制, 与 redis 的 client-output-buffer-limit 一致: 不读取数据的客户端(比如订阅了频道但是不读的客户端)
+// 超过硬限制时立即断开, 超过软限制持续 soft-seconds 秒之后断开. CLIENT NO-EVICT on 的客户端不受限制
+
+// 输出缓冲区限制的三类客户端
+const (
+	obufNormal = iota
+	obufReplica
+	obufPubSub
+	obufClasses
+)
+
+var obufClassNames = [obufClasses]string{"normal", "replica", "pubsub"}
+
+// defaultOutputBufferLimit 与 redis 的默认值一致
+const defaultOutputBufferLimit = "normal 0 0 0 replica 268435456 67108864 60 pubsub 33554432 8388608 60"
+
+// obufLimit 一类客户端的限制, 0 表示不限制
+type obufLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int64
+}
+
+type obufLimits [obufClasses]obufLimit
+
+func (l obufLimits) String() string {
+	fields := make([]string, 0, obufClasses*4)
+	for class, limit := range l {
+		fields = append(fields, obufClassNames[class], strconv.FormatInt(limit.hard, 10),
+			strconv.FormatInt(limit.soft, 10), strconv.FormatInt(limit.softSeconds, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// parseOutputBufferLimits 解析 <class> <hard> <soft> <soft seconds> [<class> ...], 没有出现的类别保留 base 中的值
+func parseOutputBufferLimits(value string, base obufLimits) (obufLimits, error) {
+	fields := strings.Fields(value)
+	if len(fields)%4 != 0 {
+		return base, errors.New("Wrong number of arguments in buffer limit configuration.")
+	}
+	limits := base
+	for i := 0; i < len(fields); i += 4 {
+		class := -1
+		switch strings.ToLower(fields[i]) {
+		case "normal":
+			class = obufNormal
+		// slave 是 replica 原来的名字
+		case "replica", "slave":
+			class = obufReplica
+		case "pubsub":
+			class = obufPubSub
+		default:
+			return base, fmt.Errorf("Invalid client class specified in buffer limit configuration.")
+		}
+		hard, err1 := config.ParseMemory(fields[i+1])
+		soft, err2 := config.ParseMemory(fields[i+2])
+		softSeconds, err3 := strconv.ParseInt(fields[i+3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || softSeconds < 0 {
+			return base, errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		limits[class] = obufLimit{hard: hard, soft: soft, softSeconds: softSeconds}
+	}
+	return limits, nil
+}
+
+type parsedOutputBufferLimits struct {
+	raw    string
+	limits obufLimits
+}
+
+// outputBufferLimits 缓存了解析的结果, 配置没有变化时不再解析
+var outputBufferLimits atomic.Value
+
+// currentOutputBufferLimits 当前生效的限制, 没有配置或者配置错误时使用默认值
+func currentOutputBufferLimits() obufLimits {
+	raw := config.Properties.ClientOutputBufferLimit
+	if cached, ok := outputBufferLimits.Load().(parsedOutputBufferLimits); ok && cached.raw == raw {
+		return cached.limits
+	}
+	defaults, _ := parseOutputBufferLimits(defaultOutputBufferLimit, obufLimits{})
+	limits, err := parseOutputBufferLimits(raw, defaults)
+	if err != nil {
+		logger.Named("networking").Warnf("invalid client-output-buffer-limit '%s': %v", raw, err)
+		limits = defaults
+	}
+	outputBufferLimits.Store(parsedOutputBufferLimits{raw: raw, limits: limits})
+	return limits
+}
+
+// setOutputBufferLimit CONFIG SET client-output-buffer-limit, 只修改指定的类别, 写入配置的是三类完整的限制
+func setOutputBufferLimit(value string) (string, error) {
+	limits, err := parseOutputBufferLimits(value, currentOutputBufferLimits())
+	if err != nil {
+		return "", err
+	}
+	return limits.String(), nil
+}
+
+// obufClass 客户端属于哪一类, 在客户端的 event loop 中或者持有锁时调用
+func (c *Client) obufClass() int {
+	if c.repl != nil {
+		return obufReplica
+	}
+	if c.SubscriptionCount() > 0 {
+		return obufPubSub
+	}
+	return obufNormal
+}
+
+// OutputBytes 最近一次写入时输出缓冲区的大小, CLIENT LIST 的 omem
+func (c *Client) OutputBytes() int64 {
+	return c.outputBytes.Load()
+}
+
+// asyncWrite 在客户端的 event loop 中写入并检查输出缓冲区的限制, 可以在任意 goroutine 中调用.
+// 还没有写入的数据同样计入输出缓冲区, event loop 来不及写入时也会按照硬限制断开, 已经断开的客户端不再写入
+func (c *Client) asyncWrite(data []byte, class int) error {
+	if c.closeAsap.Load() {
+		return nil
+	}
+	n := int64(len(data))
+	pending := c.asyncOutput.Add(n)
+	if limit := currentOutputBufferLimits()[class]; !c.noEvict.Load() && limit.hard > 0 &&
+		c.outputBytes.Load()+pending >= limit.hard {
+		c.closeForOutputLimit(class, c.outputBytes.Load()+pending)
+		c.asyncOutput.Add(-n)
+		return nil
+	}
+	return c.conn.AsyncWrite(nil, func(gc gnet.Conn, err error) error {
+		c.asyncOutput.Add(-n)
+		if err != nil || c.closeAsap.Load() {
+			return nil
+		}
+		if _, err = gc.Write(data); err != nil {
+			return err
+		}
+		c.queuedBytes += n
+		if class != obufReplica && c.stats != nil {
+			c.stats.netOutputBytes.Add(n)
+		}
+		c.checkOutputLimit(gc, class)
+		return nil
+	})
+}
+
+// checkOutputLimit 写入之后计算输出缓冲区的大小, 超过限制或者写超时的时候断开. 在客户端的 event loop 中调用
+func (c *Client) checkOutputLimit(gc gnet.Conn, class int) {
+	used := c.asyncOutput.Load() + int64(gc.OutboundBuffered()) + int64(c.bufferedReplies())
+	c.outputBytes.Store(used)
+	if c.noEvict.Load() {
+		return
+	}
+	if c.checkWriteTimeout(gc, class, time.Now()) {
+		return
+	}
+	limit := currentOutputBufferLimits()[class]
+	if limit.hard > 0 && used >= limit.hard {
+		c.closeForOutputLimit(class, used)
+		return
+	}
+	if limit.soft == 0 || used < limit.soft {
+		c.softLimitSince = time.Time{}
+		return
+	}
+	now := time.Now()
+	if c.softLimitSince.IsZero() {
+		c.softLimitSince = now
+		return
+	}
+	if int64(now.Sub(c.softLimitSince)/time.Second) > limit.softSeconds {
+		c.closeForOutputLimit(class, used)
+	}
+}
+
+// closeForOutputLimit 不再写入这个客户端, 在它的 event loop 中记录日志之后关闭连接
+func (c *Client) closeForOutputLimit(class int, used int64) {
+	c.closeAsync(fmt.Sprintf("Client id=%d addr=%s closed for overcoming of output buffer limits (%s class, omem=%d).",
+		c.id, c.RemoteAddr(), obufClassNames[class], used))
+}
+
+// closeAsync 不再写入这个客户端, 在它的 event loop 中记录 reason 之后关闭连接. 已经在关闭时不再记录
+func (c *Client) closeAsync(reason string) {
+	if !c.closeAsap.CompareAndSwap(false, true) {
+		return
+	}
+	_ = c.conn.AsyncWrite(nil, func(gc gnet.Conn, err error) error {
+		if err != nil {
+			return nil
+		}
+		logger.Named("networking").Warnf("%s", reason)
+		return gc.Close()
+	})
+}
@@ -0,0 +1,146 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useOutputBufferLimit(t *testing.T) {
+	limit := config.Properties.ClientOutputBufferLimit
+	t.Cleanup(func() {
+		config.Properties.ClientOutputBufferLimit = limit
+	})
+}
+
+func TestOutputBufferLimitConfig(t *testing.T) {
+	useOutputBufferLimit(t)
+	config.Properties.ClientOutputBufferLimit = ""
+	server := newTestServer()
+	client, _ := server.newClient()
+	// 只修改指定的类别, 单位换算成字节
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "client-output-buffer-limit", "pubsub 1mb 256kb 10"))
+	expected := "normal 0 0 0 replica 268435456 67108864 60 pubsub 1048576 262144 10"
+	assert.Equal(t, fmt.Sprintf("*2\r\n$26\r\nclient-output-buffer-limit\r\n$%d\r\n%s\r\n", len(expected), expected),
+		server.exec(t, client, "config", "get", "client-output-buffer-limit"))
+	assert.Equal(t, obufLimit{hard: 1 << 20, soft: 256 << 10, softSeconds: 10}, currentOutputBufferLimits()[obufPubSub])
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "client-output-buffer-limit", "slave 0 0 0 normal 1gb 0 0"))
+	assert.Equal(t, "normal 1073741824 0 0 replica 0 0 0 pubsub 1048576 262144 10", config.Properties.ClientOutputBufferLimit)
+
+	for value, reason := range map[string]string{
+		"pubsub 1mb 256kb":    "Wrong number of arguments in buffer limit configuration.",
+		"master 1mb 256kb 60": "Invalid client class specified in buffer limit configuration.",
+		"pubsub 1xb 256kb 60": "Error in hard, soft or soft_seconds setting in buffer limit configuration.",
+		"pubsub 1mb 256kb -1": "Error in hard, soft or soft_seconds setting in buffer limit configuration.",
+	} {
+		assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'client-output-buffer-limit') - "+
+			reason+"\r\n", server.exec(t, client, "config", "set", "client-output-buffer-limit", value))
+	}
+}
+
+func TestOutputBufferSoftLimit(t *testing.T) {
+	useOutputBufferLimit(t)
+	config.Properties.ClientOutputBufferLimit = "pubsub 1mb 256kb 1"
+	server := newTestServer()
+	client, conn := server.newClient()
+
+	// 超过软限制之后开始计时, 回到软限制以下时重新计时
+	client.asyncOutput.Store(300 << 10)
+	client.checkOutputLimit(conn, obufPubSub)
+	assert.False(t, client.softLimitSince.IsZero())
+	assert.Equal(t, int64(300<<10), client.OutputBytes())
+	client.asyncOutput.Store(0)
+	client.checkOutputLimit(conn, obufPubSub)
+	assert.True(t, client.softLimitSince.IsZero())
+
+	client.asyncOutput.Store(300 << 10)
+	client.checkOutputLimit(conn, obufPubSub)
+	client.softLimitSince = time.Now().Add(-2 * time.Second)
+	// CLIENT NO-EVICT on 的客户端不会断开
+	client.noEvict.Store(true)
+	client.checkOutputLimit(conn, obufPubSub)
+	assert.False(t, conn.closed)
+	client.noEvict.Store(false)
+	client.checkOutputLimit(conn, obufPubSub)
+	assert.True(t, conn.closed)
+	assert.True(t, client.closeAsap.Load())
+	// 正在关闭的客户端不再写入
+	assert.Nil(t, client.asyncWrite([]byte("+PONG\r\n"), obufPubSub))
+	assert.Equal(t, "", conn.take())
+}
+
+func TestClientNoEvict(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "client", "no-evict", "on"))
+	assert.Contains(t, server.exec(t, client, "client", "info"), " flags=e ")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "client", "no-evict", "OFF"))
+	assert.Contains(t, server.exec(t, client, "client", "info"), " flags=N ")
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "client", "no-evict", "maybe"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'client|no-evict' command\r\n",
+		server.exec(t, client, "client", "no-evict"))
+}
+
+func TestOutputBufferHardLimit(t *testing.T) {
+	useOutputBufferLimit(t)
+	config.Properties.ClientOutputBufferLimit = "pubsub 1mb 256kb 60"
+	server := newTestServer()
+	port := serve(t, server)
+
+	subscribe := func(noEvict bool) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		reader := bufio.NewReader(conn)
+		if noEvict {
+			_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("client", "no-evict", "on")).ToBytes())
+			line, _ := reader.ReadString('\n')
+			assert.Equal(t, "+OK\r\n", line)
+		}
+		_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("subscribe", "ch")).ToBytes())
+		subscribed := make([]byte, len("*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"))
+		_, _ = io.ReadFull(reader, subscribed)
+		return conn, reader
+	}
+	slow, _ := subscribe(false)
+	publisher, _ := server.newClient()
+
+	// 订阅的客户端一直不读取, 推送的消息远远超过 socket 的缓冲区和硬限制
+	message := strings.Repeat("m", 64<<10)
+	for i := 0; i < 400; i++ {
+		server.exec(t, publisher, "publish", "ch", message)
+	}
+	assert.Eventually(t, func() bool {
+		return server.exec(t, publisher, "publish", "ch", "ping") == ":0\r\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	_ = slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, slow)
+	assert.Nil(t, err)
+
+	// CLIENT NO-EVICT on 的客户端不受限制
+	_, reader := subscribe(true)
+	const batch = 64
+	for i := 0; i < batch; i++ {
+		assert.Equal(t, ":1\r\n", server.exec(t, publisher, "publish", "ch", message))
+	}
+	push := fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$%d\r\n%s\r\n", len(message), message)
+	buf := make([]byte, len(push))
+	for i := 0; i < batch; i++ {
+		_, err = io.ReadFull(reader, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, push, string(buf))
+	}
+}
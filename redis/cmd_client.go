@@ -0,0 +1,493 @@
+package redis
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execHello hello [protover [AUTH username password] [SETNAME clientname]]
+func execHello(ctx context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	protocol := conn.protocol
+	if len(args) > 0 {
+		version, err := strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil {
+			return MakeStandardErrReply("ERR Protocol version is not an integer or out of range").WriteTo(conn)
+		}
+		if version != resp2 && version != resp3 {
+			return MakeStandardErrReply("NOPROTO unsupported protocol version").WriteTo(conn)
+		}
+		protocol = int(version)
+	}
+	name, authenticated := conn.name, !authRequired(conn)
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		moreArgs := len(args) - 1 - i
+		if option == "auth" && moreArgs >= 2 {
+			if !checkPassword(string(args[i+1]), string(args[i+2])) {
+				return wrongPassReply.WriteTo(conn)
+			}
+			authenticated = true
+			i += 2
+		} else if option == "setname" && moreArgs >= 1 {
+			if !validClientName(args[i+1]) {
+				return MakeStandardErrReply("ERR Client names cannot contain spaces, newlines or special characters.").WriteTo(conn)
+			}
+			name = string(args[i+1])
+			i++
+		} else {
+			return MakeStandardErrReply("ERR Syntax error in HELLO option '" + string(args[i]) + "'").WriteTo(conn)
+		}
+	}
+	if !authenticated {
+		return MakeStandardErrReply("NOAUTH HELLO must be called with the client already authenticated, otherwise the " +
+			"HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP " +
+			"protocol version at the same time").WriteTo(conn)
+	}
+	conn.protocol = protocol
+	conn.name = name
+	conn.authenticated = true
+	return MakeMapReply([]Reply{
+		MakeBulkReply([]byte("server")), MakeBulkReply([]byte("redis")),
+		MakeBulkReply([]byte("version")), MakeBulkReply([]byte(redisVersion)),
+		MakeBulkReply([]byte("proto")), MakeIntReply(int64(protocol)),
+		MakeBulkReply([]byte("id")), MakeIntReply(conn.id),
+		MakeBulkReply([]byte("mode")), MakeBulkReply([]byte("standalone")),
+		MakeBulkReply([]byte("role")), MakeBulkReply([]byte("master")),
+		MakeBulkReply([]byte("modules")), MakeEmptyMultiBulkReply(),
+	}).WriteTo(conn)
+}
+
+var wrongPassReply = MakeStandardErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+
+// execAuth auth [username] password, 没有实现ACL, 只有 default 用户, 密码是 requirepass
+func execAuth(ctx context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	if len(args) == 0 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	username, password := "default", ""
+	switch len(args) {
+	case 1:
+		if config.Properties.RequirePass == "" {
+			return MakeStandardErrReply("ERR AUTH <password> called without any password configured for the " +
+				"default user. Are you sure your configuration is correct?").WriteTo(conn)
+		}
+		password = string(args[0])
+	case 2:
+		username, password = string(args[0]), string(args[1])
+	default:
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	if !checkPassword(username, password) {
+		return wrongPassReply.WriteTo(conn)
+	}
+	conn.authenticated = true
+	return MakeOkReply().WriteTo(conn)
+}
+
+// checkPassword 没有配置 requirepass 时 default 用户不需要密码
+func checkPassword(username, password string) bool {
+	if username != "default" {
+		return false
+	}
+	requirePass := config.Properties.RequirePass
+	return requirePass == "" || subtle.ConstantTimeCompare([]byte(password), []byte(requirePass)) == 1
+}
+
+// validClientName 客户端名称只能包含可见的ASCII字符, 不能有空格
+func validClientName(name []byte) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// execClient client id | info | list | getname | setname name | setinfo lib-name|lib-ver value | getredir | tracking ... | caching yes|no | no-evict on|off | reply on|off|skip | kill ...
+func execClient(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "id":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("client|id").WriteTo(conn)
+		}
+		return MakeIntReply(conn.id).WriteTo(conn)
+	case "info":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("client|info").WriteTo(conn)
+		}
+		return MakeVerbatimReply([]byte(clientInfoString(conn) + "\n")).WriteTo(conn)
+	case "list":
+		if argNum != 1 {
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+		return clientList(conn)
+	case "getname":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("client|getname").WriteTo(conn)
+		}
+		if conn.name == "" {
+			return MakeNullBulkReply().WriteTo(conn)
+		}
+		return MakeBulkReply([]byte(conn.name)).WriteTo(conn)
+	case "setname":
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("client|setname").WriteTo(conn)
+		}
+		if !validClientName(args[1]) {
+			return MakeStandardErrReply("ERR Client names cannot contain spaces, newlines or special characters.").WriteTo(conn)
+		}
+		conn.name = string(args[1])
+		return MakeOkReply().WriteTo(conn)
+	case "setinfo":
+		if argNum != 3 {
+			return MakeNumberOfArgsErrReply("client|setinfo").WriteTo(conn)
+		}
+		return clientSetInfo(conn, args[1], args[2])
+	case "getredir":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("client|getredir").WriteTo(conn)
+		}
+		if !conn.IsTracking() {
+			return MakeIntReply(-1).WriteTo(conn)
+		}
+		return MakeIntReply(conn.trackingRedirect).WriteTo(conn)
+	case "tracking":
+		return clientTracking(conn, args[1:])
+	case "caching":
+		return clientCaching(conn, args[1:])
+	case "reply":
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("client|reply").WriteTo(conn)
+		}
+		// OFF 和 SKIP 自己也没有回复
+		switch strings.ToLower(string(args[1])) {
+		case "on":
+			conn.replyMode = replyOn
+			return MakeOkReply().WriteTo(conn)
+		case "off":
+			conn.replyMode = replyOff
+		case "skip":
+			if conn.replyMode != replyOff {
+				conn.replyMode = replySkip
+			}
+		default:
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+		return MakeOkReply().WriteTo(conn)
+	case "no-evict":
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("client|no-evict").WriteTo(conn)
+		}
+		switch strings.ToLower(string(args[1])) {
+		case "on":
+			conn.noEvict.Store(true)
+		case "off":
+			conn.noEvict.Store(false)
+		default:
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+		return MakeOkReply().WriteTo(conn)
+	case "kill":
+		if argNum < 2 {
+			return MakeNumberOfArgsErrReply("client|kill").WriteTo(conn)
+		}
+		return clientKill(conn, args[1:])
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "CLIENT").WriteTo(conn)
+	}
+}
+
+// clientSetInfo client setinfo lib-name|lib-ver value, 与客户端名称一样不能有空格和换行, 空字符串表示清除
+func clientSetInfo(conn *Client, attr, value []byte) error {
+	var dest *string
+	switch strings.ToLower(string(attr)) {
+	case "lib-name":
+		dest = &conn.libName
+	case "lib-ver":
+		dest = &conn.libVer
+	default:
+		return MakeStandardErrReply("ERR Unrecognized option '" + string(attr) + "'").WriteTo(conn)
+	}
+	if !validClientName(value) {
+		return MakeStandardErrReply("ERR " + strings.ToLower(string(attr)) +
+			" cannot contain spaces, newlines or special characters.").WriteTo(conn)
+	}
+	*dest = string(value)
+	return MakeOkReply().WriteTo(conn)
+}
+
+// clientKill client kill ip:port | client kill [ID id] [ADDR ip:port] [SKIPME yes|no].
+// 旧的格式回复 OK, 过滤器的格式回复断开的客户端个数, 默认不断开自己
+func clientKill(conn *Client, args [][]byte) error {
+	var id int64
+	addr, skipMe, legacy := "", true, len(args) == 1
+	if legacy {
+		addr = string(args[0])
+	} else {
+		if len(args)%2 != 0 {
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+		for i := 0; i < len(args); i += 2 {
+			value := string(args[i+1])
+			switch strings.ToLower(string(args[i])) {
+			case "id":
+				parsed, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || parsed <= 0 {
+					return MakeStandardErrReply("ERR client-id should be greater than 0").WriteTo(conn)
+				}
+				id = parsed
+			case "addr":
+				addr = value
+			case "skipme":
+				switch strings.ToLower(value) {
+				case "yes":
+					skipMe = true
+				case "no":
+					skipMe = false
+				default:
+					return MakeSyntaxErr().WriteTo(conn)
+				}
+			default:
+				return MakeSyntaxErr().WriteTo(conn)
+			}
+		}
+	}
+	targets := make([]*Client, 0)
+	conn.Clients.ForEach(func(client *Client) {
+		if client.conn == nil || (id != 0 && client.id != id) || (addr != "" && client.RemoteAddr().String() != addr) {
+			return
+		}
+		if client == conn && skipMe && !legacy {
+			return
+		}
+		targets = append(targets, client)
+	})
+	for _, target := range targets {
+		// 断开自己时先发送回复
+		if target == conn {
+			conn.closeAfterReply = true
+			continue
+		}
+		conn.KillClient(target)
+	}
+	if !legacy {
+		return MakeIntReply(int64(len(targets))).WriteTo(conn)
+	}
+	if len(targets) == 0 {
+		return MakeStandardErrReply("ERR No such client").WriteTo(conn)
+	}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// clientList client list, 按照客户端ID排序, 每行一个客户端
+func clientList(conn *Client) error {
+	clients := make([]*Client, 0)
+	conn.Clients.ForEach(func(client *Client) {
+		clients = append(clients, client)
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	builder := &strings.Builder{}
+	for _, client := range clients {
+		builder.WriteString(clientInfoString(client))
+		builder.WriteString("\n")
+	}
+	return MakeVerbatimReply([]byte(builder.String())).WriteTo(conn)
+}
+
+// clientInfoString CLIENT INFO 和 CLIENT LIST 中的一行, 与 redis networking.c 中的 catClientInfoString 一致
+func clientInfoString(client *Client) string {
+	flags := ""
+	if client.master {
+		flags += "M"
+	}
+	if client.repl != nil {
+		flags += "S"
+	}
+	if client.SubscriptionCount() > 0 {
+		flags += "P"
+	}
+	if client.multi != nil {
+		flags += "x"
+	}
+	if client.blocked != nil {
+		flags += "b"
+	}
+	if client.IsTracking() {
+		flags += "t"
+	}
+	if client.dirtyCAS {
+		flags += "d"
+	}
+	if client.noEvict.Load() {
+		flags += "e"
+	}
+	if client.readOnly {
+		flags += "r"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	redirect := int64(-1)
+	if client.IsTracking() {
+		redirect = client.trackingRedirect
+	}
+	addr, laddr := "", ""
+	if client.conn != nil && isUnixConn(client.conn) {
+		// 与 redis 一致, unix socket 的客户端显示 socket 的路径
+		addr = config.Properties.UnixSocket + ":0"
+		laddr = addr
+	} else if client.conn != nil {
+		addr, laddr = client.RemoteAddr().String(), client.LocalAddr().String()
+	}
+	lastCmd := client.lastCmd
+	if lastCmd == "" {
+		lastCmd = "NULL"
+	}
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d omem=%d cmd=%s redir=%d resp=%d lib-name=%s lib-ver=%s",
+		client.id, addr, laddr, client.Fd, client.name, int64(now.Sub(client.ctime).Seconds()),
+		int64(now.Sub(client.lastInteraction).Seconds()), flags, client.dbId,
+		len(client.subChannels), len(client.subPatterns), client.OutputBytes(), lastCmd, redirect, client.protocol,
+		client.libName, client.libVer)
+}
+
+// clientTracking client tracking on|off [REDIRECT id] [PREFIX p [PREFIX p ...]] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func clientTracking(conn *Client, args [][]byte) error {
+	if len(args) < 1 {
+		return MakeNumberOfArgsErrReply("client|tracking").WriteTo(conn)
+	}
+	var redirect int64 = 0
+	options := 0
+	prefixes := make([]string, 0)
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		moreArgs := len(args) - 1 - i
+		switch {
+		case option == "redirect" && moreArgs >= 1:
+			if redirect != 0 {
+				return MakeStandardErrReply("ERR A client can only redirect to a single other client").WriteTo(conn)
+			}
+			id, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return MakeNotIntegerErr().WriteTo(conn)
+			}
+			redirect = id
+			i++
+		case option == "bcast":
+			options |= trackingBcast
+		case option == "optin":
+			options |= trackingOptin
+		case option == "optout":
+			options |= trackingOptout
+		case option == "noloop":
+			options |= trackingNoloop
+		case option == "prefix" && moreArgs >= 1:
+			prefixes = append(prefixes, string(args[i+1]))
+			i++
+		default:
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+	}
+
+	switch strings.ToLower(string(args[0])) {
+	case "on":
+		if options&trackingBcast == 0 && len(prefixes) > 0 {
+			return MakeStandardErrReply("ERR PREFIX option requires BCAST mode to be enabled").WriteTo(conn)
+		}
+		if conn.IsTracking() && (conn.trackingFlags&trackingBcast) != (options&trackingBcast) {
+			return MakeStandardErrReply("ERR You can't switch BCAST mode on/off before disabling tracking " +
+				"for this client, and then re-enabling it with a different mode.").WriteTo(conn)
+		}
+		if options&trackingOptin != 0 && options&trackingOptout != 0 {
+			return MakeStandardErrReply("ERR You can't use both OPTIN and OPTOUT").WriteTo(conn)
+		}
+		if options&trackingBcast != 0 && options&(trackingOptin|trackingOptout) != 0 {
+			return MakeStandardErrReply("ERR OPTIN and OPTOUT are not compatible with BCAST").WriteTo(conn)
+		}
+		if redirect != 0 && conn.Tracking.clients.GetById(redirect) == nil {
+			return MakeStandardErrReply("ERR The client ID you want redirect to does not exist").WriteTo(conn)
+		}
+		if err := checkPrefixCollisions(conn, prefixes); err != nil {
+			return err.WriteTo(conn)
+		}
+		conn.Tracking.Enable(conn, redirect, prefixes, options)
+	case "off":
+		conn.Tracking.Disable(conn)
+	default:
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// checkPrefixCollisions 同一个客户端的prefix不能互相包含, 否则同一个key会收到多次失效消息
+func checkPrefixCollisions(conn *Client, prefixes []string) Reply {
+	for i, prefix := range prefixes {
+		for existing := range conn.trackingPrefixes {
+			if strings.HasPrefix(prefix, existing) || strings.HasPrefix(existing, prefix) {
+				return MakeStandardErrReply("ERR Prefix '" + prefix + "' overlaps with an existing prefix '" +
+					existing + "'. Prefixes for a single client must not overlap.")
+			}
+		}
+		for j := i + 1; j < len(prefixes); j++ {
+			other := prefixes[j]
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return MakeStandardErrReply("ERR Prefix '" + prefix + "' overlaps with another provided prefix '" +
+					other + "'. Prefixes for a single client must not overlap.")
+			}
+		}
+	}
+	return nil
+}
+
+// clientCaching client caching yes|no
+func clientCaching(conn *Client, args [][]byte) error {
+	if len(args) != 1 {
+		return MakeNumberOfArgsErrReply("client|caching").WriteTo(conn)
+	}
+	if !conn.IsTracking() || conn.trackingFlags&(trackingOptin|trackingOptout) == 0 {
+		return MakeStandardErrReply("ERR CLIENT CACHING can be called only when the client is in tracking " +
+			"mode with OPTIN or OPTOUT mode enabled").WriteTo(conn)
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "yes":
+		if conn.trackingFlags&trackingOptin == 0 {
+			return MakeStandardErrReply("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.").WriteTo(conn)
+		}
+	case "no":
+		if conn.trackingFlags&trackingOptout == 0 {
+			return MakeStandardErrReply("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.").WriteTo(conn)
+		}
+	default:
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	conn.trackingFlags |= trackingCaching
+	return MakeOkReply().WriteTo(conn)
+}
+
+// isClientCaching 当前命令是否是 CLIENT CACHING, 它设置的标记需要保留到下一条命令
+func isClientCaching(cmdLine [][]byte) bool {
+	return len(cmdLine) > 1 && strings.ToLower(string(cmdLine[0])) == "client" &&
+		strings.ToLower(string(cmdLine[1])) == "caching"
+}
+
+func init() {
+	register("hello", execHello, withArity(-1), withFlags(flagNoScript|flagLoading|flagStale))
+	register("auth", execAuth, withArity(-2), withFlags(flagNoScript|flagLoading|flagStale))
+	register("client", execClient, withArity(-2), withFlags(flagNoScript|flagLoading|flagStale))
+}
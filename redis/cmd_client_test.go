@@ -0,0 +1,68 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+func TestClientSetInfo(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	other, _ := server.newClient()
+	assert.Contains(t, clientInfoString(client), " lib-name= lib-ver=")
+	assert.Equal(t, "client_libs:", "client_libs:"+infoAll(t, server, client, "client_libs"))
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "client", "setinfo", "LIB-NAME", "go-redis(,go1.21.0)"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "client", "setinfo", "lib-ver", "9.5.1"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, other, "client", "setinfo", "lib-name", "go-redis(cache,go1.22.0)"))
+	assert.Contains(t, clientInfoString(client), " lib-name=go-redis(,go1.21.0) lib-ver=9.5.1")
+	assert.Contains(t, server.exec(t, client, "client", "list"), " lib-name=go-redis(cache,go1.22.0) lib-ver=\n")
+	// 按照括号之前的库名统计
+	assert.Equal(t, "go-redis=2", infoAll(t, server, client, "client_libs"))
+
+	assert.Equal(t, "-ERR lib-name cannot contain spaces, newlines or special characters.\r\n",
+		server.exec(t, client, "client", "setinfo", "lib-name", "go redis"))
+	assert.Equal(t, "-ERR lib-ver cannot contain spaces, newlines or special characters.\r\n",
+		server.exec(t, client, "client", "setinfo", "LIB-VER", "1\n2"))
+	assert.Equal(t, "-ERR Unrecognized option 'lib-os'\r\n", server.exec(t, client, "client", "setinfo", "lib-os", "linux"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'client|setinfo' command\r\n",
+		server.exec(t, client, "client", "setinfo", "lib-name"))
+	assert.Contains(t, clientInfoString(client), " lib-name=go-redis(,go1.21.0) lib-ver=9.5.1")
+
+	// 空字符串清除, RESET 清除两个字段
+	assert.Equal(t, "+OK\r\n", server.exec(t, other, "client", "setinfo", "lib-name", ""))
+	assert.Equal(t, "go-redis=1", infoAll(t, server, client, "client_libs"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, other, "client", "setinfo", "lib-name", "redis-py"))
+	assert.Equal(t, "go-redis=1,redis-py=1", infoAll(t, server, client, "client_libs"))
+	assert.Equal(t, "+RESET\r\n", server.exec(t, client, "reset"))
+	assert.Contains(t, clientInfoString(client), " lib-name= lib-ver=")
+	assert.Equal(t, "redis-py=1", infoAll(t, server, client, "client_libs"))
+}
+
+// 监听 0.0.0.0 时 laddr 是客户端连接的地址, 不是 listener 的地址
+func TestClientListLocalAddr(t *testing.T) {
+	server := newTestServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	serveAddrs(t, server, []string{fmt.Sprintf("tcp://0.0.0.0:%d", port)})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("client", "info")).ToBytes())
+	info := readBulk(t, bufio.NewReader(conn))
+	assert.Contains(t, info, fmt.Sprintf(" addr=%s laddr=%s ", conn.LocalAddr(), conn.RemoteAddr()))
+}
@@ -0,0 +1,136 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/cluster"
+	"net"
+	"strings"
+)
+
+// 还没有实现 cluster 模式, 单个节点负责所有的哈希槽. CLUSTER SLOTS 和 CLUSTER SHARDS 返回只有这个节点的拓扑,
+// go-redis 的 ClusterClient 和 Lettuce 这样的客户端在单节点上也可以正常启动. 节点ID使用 run_id
+
+// clusterAnnounceAddr 返回给客户端的节点地址, 没有配置 cluster-announce-ip 和 cluster-announce-port 时使用客户端连接的地址,
+// unix socket 和脚本中使用 127.0.0.1 和 port
+func clusterAnnounceAddr(conn *Client) (string, int) {
+	ip, port := config.Properties.ClusterAnnounceIp, config.Properties.ClusterAnnouncePort
+	if conn.conn != nil {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			if ip == "" {
+				ip = addr.IP.String()
+			}
+			if port == 0 {
+				port = addr.Port
+			}
+		}
+	}
+	if ip == "" {
+		ip = "127.0.0.1"
+	}
+	if port == 0 {
+		port = config.Properties.Port
+	}
+	return ip, port
+}
+
+func clusterInfo() string {
+	return fmt.Sprintf("cluster_enabled:0\r\n"+
+		"cluster_state:ok\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:0\r\n"+
+		"cluster_slots_fail:0\r\n"+
+		"cluster_known_nodes:1\r\n"+
+		"cluster_size:1\r\n"+
+		"cluster_current_epoch:0\r\n"+
+		"cluster_my_epoch:0\r\n",
+		cluster.Slots, cluster.Slots)
+}
+
+// clusterSlots 与 redis 6 一致, 节点是 ip, port 和节点ID三个元素, go-redis v8 不接受 redis 7 增加的第四个元素
+func clusterSlots(conn *Client) Reply {
+	ip, port := clusterAnnounceAddr(conn)
+	node := MakeMultiRowReply([]Reply{
+		MakeBulkReply([]byte(ip)),
+		MakeIntReply(int64(port)),
+		MakeBulkReply([]byte(config.Properties.RunID)),
+	})
+	return MakeMultiRowReply([]Reply{
+		MakeMultiRowReply([]Reply{MakeIntReply(0), MakeIntReply(cluster.Slots - 1), node}),
+	})
+}
+
+// clusterShards 与 redis 7 的 CLUSTER SHARDS 一致, 只有一个分片, 主节点就是这个节点
+func clusterShards(conn *Client) Reply {
+	ip, port := clusterAnnounceAddr(conn)
+	node := MakeMapReply([]Reply{
+		MakeBulkReply([]byte("id")), MakeBulkReply([]byte(config.Properties.RunID)),
+		MakeBulkReply([]byte("port")), MakeIntReply(int64(port)),
+		MakeBulkReply([]byte("ip")), MakeBulkReply([]byte(ip)),
+		MakeBulkReply([]byte("endpoint")), MakeBulkReply([]byte(ip)),
+		MakeBulkReply([]byte("role")), MakeBulkReply([]byte("master")),
+		MakeBulkReply([]byte("replication-offset")), MakeIntReply(conn.Replication.Offset()),
+		MakeBulkReply([]byte("health")), MakeBulkReply([]byte("online")),
+	})
+	shard := MakeMapReply([]Reply{
+		MakeBulkReply([]byte("slots")), MakeMultiRowReply([]Reply{MakeIntReply(0), MakeIntReply(cluster.Slots - 1)}),
+		MakeBulkReply([]byte("nodes")), MakeMultiRowReply([]Reply{node}),
+	})
+	return MakeMultiRowReply([]Reply{shard})
+}
+
+// execCluster cluster info|myid|slots|shards|keyslot key
+func execCluster(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	subCommand := strings.ToLower(string(args[0]))
+	if subCommand == "keyslot" {
+		if len(args) != 2 {
+			return MakeNumberOfArgsErrReply("cluster|keyslot").WriteTo(conn)
+		}
+		return MakeIntReply(int64(cluster.KeyHashSlot(args[1]))).WriteTo(conn)
+	}
+	if len(args) != 1 {
+		switch subCommand {
+		case "info", "myid", "slots", "shards":
+			return MakeNumberOfArgsErrReply("cluster|" + subCommand).WriteTo(conn)
+		}
+	}
+	switch subCommand {
+	case "info":
+		return MakeVerbatimReply([]byte(clusterInfo())).WriteTo(conn)
+	case "myid":
+		return MakeBulkReply([]byte(config.Properties.RunID)).WriteTo(conn)
+	case "slots":
+		return clusterSlots(conn).WriteTo(conn)
+	case "shards":
+		return clusterShards(conn).WriteTo(conn)
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "CLUSTER").WriteTo(conn)
+	}
+}
+
+// execReadonly READONLY, 集群的客户端表示这个连接可以从从节点读取. 还没有实现集群模式, 从节点总是处理读命令,
+// 写命令仍然回复 -READONLY, 这里只记录连接的标记, 使无条件发送这个命令的客户端可以正常使用
+func execReadonly(c context.Context, conn *Client) error {
+	conn.readOnly = true
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execReadwrite READWRITE, 清除 READONLY 的标记
+func execReadwrite(c context.Context, conn *Client) error {
+	conn.readOnly = false
+	return MakeOkReply().WriteTo(conn)
+}
+
+// infoCluster INFO cluster
+func infoCluster() string {
+	return "# Cluster\r\ncluster_enabled:0\r\n"
+}
+
+func init() {
+	register("cluster", execCluster, withArity(-2))
+	register("readonly", execReadonly, withArity(1), withFlags(flagLoading|flagStale))
+	register("readwrite", execReadwrite, withArity(1), withFlags(flagLoading|flagStale))
+}
@@ -0,0 +1,117 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"regexp"
+	"testing"
+)
+
+func TestClusterCommands(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	myId := server.exec(t, client, "cluster", "myid")
+	assert.Regexp(t, regexp.MustCompile(`^\$40\r\n[0-9a-f]{40}\r\n$`), myId)
+	assert.Equal(t, myId, server.exec(t, client, "cluster", "myid"))
+	id := myId[5:45]
+
+	assert.Contains(t, server.exec(t, client, "cluster", "info"), "cluster_enabled:0\r\ncluster_state:ok\r\n")
+	assert.Contains(t, server.exec(t, client, "info", "cluster"), "cluster_enabled:0\r\n")
+	// fakeConn 的本地地址是 127.0.0.1:6379
+	assert.Equal(t, "*1\r\n*3\r\n:0\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:6379\r\n$40\r\n"+id+"\r\n",
+		server.exec(t, client, "cluster", "slots"))
+	shards := server.exec(t, client, "cluster", "shards")
+	assert.Contains(t, shards, "$5\r\nslots\r\n*2\r\n:0\r\n:16383\r\n")
+	assert.Contains(t, shards, "$2\r\nid\r\n$40\r\n"+id+"\r\n$4\r\nport\r\n:6379\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n")
+
+	assert.Equal(t, ":12182\r\n", server.exec(t, client, "cluster", "keyslot", "foo"))
+	assert.Equal(t, ":2515\r\n", server.exec(t, client, "cluster", "keyslot", "foo{hash_tag}"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'cluster|keyslot' command\r\n", server.exec(t, client, "cluster", "keyslot"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'cluster|slots' command\r\n", server.exec(t, client, "cluster", "slots", "x"))
+	assert.Equal(t, "-ERR unknown subcommand 'nosuch'. Try CLUSTER HELP.\r\n", server.exec(t, client, "cluster", "nosuch"))
+
+	saved := *config.Properties
+	t.Cleanup(func() {
+		config.Properties.ClusterAnnounceIp, config.Properties.ClusterAnnouncePort = saved.ClusterAnnounceIp, saved.ClusterAnnouncePort
+	})
+	server.exec(t, client, "config", "set", "cluster-announce-ip", "10.0.0.1", "cluster-announce-port", "7000")
+	assert.Contains(t, server.exec(t, client, "cluster", "slots"), "$8\r\n10.0.0.1\r\n:7000\r\n")
+}
+
+func TestReadonlyConnection(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	master, _ := server.newClient()
+	master.master = true
+	server.repl.masterHost, server.repl.masterPort = "127.0.0.1", 6379
+	defer func() {
+		server.repl.masterHost, server.repl.masterPort = "", 0
+	}()
+	server.exec(t, master, "set", "foo", "bar")
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "readonly"))
+	assert.True(t, client.readOnly)
+	assert.Contains(t, clientInfoString(client), " flags=r ")
+	// 从节点处理 READONLY 的连接的读命令, 写命令仍然被拒绝
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", server.exec(t, client, "set", "foo", "baz"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "readwrite"))
+	assert.False(t, client.readOnly)
+	assert.Contains(t, clientInfoString(client), " flags=N ")
+	server.exec(t, client, "readonly")
+	assert.Equal(t, "+RESET\r\n", server.exec(t, client, "reset"))
+	assert.False(t, client.readOnly)
+	assert.Equal(t, "-ERR wrong number of arguments for 'readonly' command\r\n", server.exec(t, client, "readonly", "x"))
+
+	// 不读写数据, 没有 readonly 和 write 的标记; 加载期间和从节点断开时可以执行
+	assert.Equal(t, "*2\r\n*7\r\n$8\r\nreadonly\r\n:1\r\n*2\r\n+loading\r\n+stale\r\n:0\r\n:0\r\n:0\r\n*0\r\n"+
+		"*7\r\n$9\r\nreadwrite\r\n:1\r\n*2\r\n+loading\r\n+stale\r\n:0\r\n:0\r\n:0\r\n*0\r\n",
+		server.exec(t, client, "command", "info", "readonly", "readwrite"))
+
+	// 主节点上 READONLY 的连接照常写入
+	server.repl.masterHost, server.repl.masterPort = "", 0
+	server.exec(t, client, "readonly")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "baz"))
+	assert.Equal(t, "$3\r\nbaz\r\n", server.exec(t, client, "get", "foo"))
+}
+
+// TestClusterClient go-redis 的 ClusterClient 连接单个节点
+func TestClusterClient(t *testing.T) {
+	server := newTestServer()
+	port := serve(t, server)
+	rdb := goredis.NewClusterClient(&goredis.ClusterOptions{Addrs: []string{fmt.Sprintf("127.0.0.1:%d", port)}})
+	defer rdb.Close()
+	ctx := context.Background()
+
+	slots, err := rdb.ClusterSlots(ctx).Result()
+	if assert.Nil(t, err) && assert.Len(t, slots, 1) {
+		assert.Equal(t, 0, slots[0].Start)
+		assert.Equal(t, 16383, slots[0].End)
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), slots[0].Nodes[0].Addr)
+		assert.Equal(t, config.Properties.RunID, slots[0].Nodes[0].ID)
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		assert.Nil(t, rdb.Set(ctx, key, i, 0).Err())
+		value, err := rdb.Get(ctx, key).Int()
+		assert.Nil(t, err)
+		assert.Equal(t, i, value)
+	}
+	assert.Nil(t, rdb.ForEachMaster(ctx, func(ctx context.Context, master *goredis.Client) error {
+		// 所有的 key 都在这个节点上
+		count, err := master.Exists(ctx, "key:0", "key:5", "key:9").Result()
+		assert.Equal(t, int64(3), count)
+		return err
+	}))
+	slot, err := rdb.ClusterKeySlot(ctx, "foo{hash_tag}").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2515), slot)
+	info, err := rdb.ClusterInfo(ctx).Result()
+	assert.Nil(t, err)
+	assert.Contains(t, info, "cluster_enabled:0")
+}
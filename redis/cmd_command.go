@@ -0,0 +1,181 @@
+package redis
+
+import (
+	"context"
+	"strings"
+)
+
+// execCommand COMMAND [COUNT | LIST | INFO [command ...] | DOCS [command ...] | GETKEYS command [arg ...] | GETKEYSANDFLAGS command [arg ...]]
+func execCommand(ctx context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	if len(args) == 0 {
+		return commandInfos(sortedCommands()).WriteTo(conn)
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "count":
+		if len(args) != 1 {
+			return MakeNumberOfArgsErrReply("command|count").WriteTo(conn)
+		}
+		return MakeIntReply(int64(len(commandRouter))).WriteTo(conn)
+	case "list":
+		if len(args) != 1 {
+			return MakeNumberOfArgsErrReply("command|list").WriteTo(conn)
+		}
+		commands := sortedCommands()
+		names := make([][]byte, 0, len(commands))
+		for _, cmd := range commands {
+			names = append(names, []byte(cmd.name))
+		}
+		return MakeMultiBulkReply(names).WriteTo(conn)
+	case "info":
+		if len(args) == 1 {
+			return commandInfos(sortedCommands()).WriteTo(conn)
+		}
+		// 不存在的命令回复 nil
+		replies := make([]Reply, 0, len(args)-1)
+		for _, name := range args[1:] {
+			if cmd, err := router(string(name)); err == nil {
+				replies = append(replies, commandInfo(cmd))
+			} else {
+				replies = append(replies, MakeNullBulkReply())
+			}
+		}
+		return MakeMultiRowReply(replies).WriteTo(conn)
+	case "docs":
+		commands := sortedCommands()
+		if len(args) > 1 {
+			// 不存在的命令不出现在回复中
+			commands = commands[:0:0]
+			for _, name := range args[1:] {
+				if cmd, err := router(string(name)); err == nil {
+					commands = append(commands, cmd)
+				}
+			}
+		}
+		pairs := make([]Reply, 0, 2*len(commands))
+		for _, cmd := range commands {
+			pairs = append(pairs, MakeBulkReply([]byte(cmd.name)), commandDocs(cmd))
+		}
+		return MakeMapReply(pairs).WriteTo(conn)
+	case "getkeys", "getkeysandflags":
+		withFlags := strings.ToLower(string(args[0])) == "getkeysandflags"
+		if len(args) < 2 {
+			return MakeNumberOfArgsErrReply("command|" + strings.ToLower(string(args[0]))).WriteTo(conn)
+		}
+		return commandGetKeys(args[1:], withFlags).WriteTo(conn)
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "COMMAND").WriteTo(conn)
+	}
+}
+
+// commandGetKeys 与 redis 的 COMMAND GETKEYS 一致, 按照命令表取出 cmdLine 中的key, 不执行命令
+func commandGetKeys(cmdLine [][]byte, withFlags bool) Reply {
+	cmd, err := router(string(cmdLine[0]))
+	if err != nil {
+		return MakeStandardErrReply("ERR Invalid command specified")
+	}
+	if !cmd.checkArity(len(cmdLine)) {
+		return MakeStandardErrReply("ERR Invalid number of arguments specified for command")
+	}
+	positions, err := cmd.KeyPositions(cmdLine)
+	if err != nil {
+		return MakeStandardErrReply("ERR Invalid arguments specified for command")
+	}
+	if len(positions) == 0 {
+		return MakeStandardErrReply("ERR The command has no key arguments")
+	}
+	replies := make([]Reply, 0, len(positions))
+	for _, position := range positions {
+		key := MakeBulkReply(cmdLine[position])
+		if !withFlags {
+			replies = append(replies, key)
+			continue
+		}
+		replies = append(replies, MakeMultiRowReply([]Reply{key, MakeSetReply(keyFlags(cmd))}))
+	}
+	return MakeMultiRowReply(replies)
+}
+
+// keyFlags GETKEYSANDFLAGS 中key的标记. 命令表中没有 redis 7 的 key specs, 按照命令的标记推断:
+// 只读的命令是 RO access, 写命令是 RW update, 脚本这样不确定的命令是 RW access update
+func keyFlags(cmd *Command) []Reply {
+	var flags []string
+	switch {
+	case cmd.IsReadonly():
+		flags = []string{"RO", "access"}
+	case cmd.IsWrite():
+		flags = []string{"RW", "update"}
+	default:
+		flags = []string{"RW", "access", "update"}
+	}
+	replies := make([]Reply, 0, len(flags))
+	for _, flag := range flags {
+		replies = append(replies, MakeSimpleReply([]byte(flag)))
+	}
+	return replies
+}
+
+func commandInfos(commands []*Command) Reply {
+	replies := make([]Reply, 0, len(commands))
+	for _, cmd := range commands {
+		replies = append(replies, commandInfo(cmd))
+	}
+	return MakeMultiRowReply(replies)
+}
+
+// commandInfo 与 redis 6 的 COMMAND INFO 一致: 名字, 参数个数, 标记, 第一个 key, 最后一个 key, key 的间隔和 ACL 分类
+func commandInfo(cmd *Command) Reply {
+	arity := cmd.arity
+	if arity == 0 {
+		// 没有设置 arity 的命令自己检查参数
+		arity = -1
+	}
+	var flags, categories []Reply
+	addFlag := func(set bool, flag string) {
+		if set {
+			flags = append(flags, MakeSimpleReply([]byte(flag)))
+		}
+	}
+	addFlag(cmd.IsWrite(), "write")
+	addFlag(cmd.IsReadonly(), "readonly")
+	addFlag(cmd.IsDenyOOM(), "denyoom")
+	addFlag(cmd.IsAdmin(), "admin")
+	addFlag(cmd.IsNoScript(), "noscript")
+	addFlag(cmd.IsLoading(), "loading")
+	addFlag(cmd.IsStale(), "stale")
+	addFlag(cmd.MayReplicate(), "may_replicate")
+	addFlag(cmd.MovableKeys(), "movablekeys")
+	if cmd.IsWrite() {
+		categories = append(categories, MakeSimpleReply([]byte("@write")))
+	}
+	if cmd.IsReadonly() {
+		categories = append(categories, MakeSimpleReply([]byte("@read")))
+	}
+	if cmd.IsAdmin() {
+		categories = append(categories, MakeSimpleReply([]byte("@admin")), MakeSimpleReply([]byte("@dangerous")))
+	}
+	return MakeMultiRowReply([]Reply{
+		MakeBulkReply([]byte(cmd.name)),
+		MakeIntReply(int64(arity)),
+		MakeSetReply(flags),
+		MakeIntReply(int64(cmd.firstKey)),
+		MakeIntReply(int64(cmd.lastKey)),
+		MakeIntReply(int64(cmd.keyStep)),
+		MakeSetReply(categories),
+	})
+}
+
+// commandDocs COMMAND DOCS 中一个命令的文档, 只有废弃的命令有内容
+func commandDocs(cmd *Command) Reply {
+	if cmd.replacedBy == "" {
+		return MakeMapReply(nil)
+	}
+	return MakeMapReply([]Reply{
+		MakeBulkReply([]byte("doc_flags")), MakeSetReply([]Reply{MakeSimpleReply([]byte("deprecated"))}),
+		MakeBulkReply([]byte("replaced_by")), MakeBulkReply([]byte("`" + strings.ToUpper(cmd.replacedBy) + "`")),
+	})
+}
+
+func init() {
+	register("command", execCommand, withArity(-1), withFlags(flagLoading|flagStale))
+}
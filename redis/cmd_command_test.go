@@ -0,0 +1,92 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestCommandInfo(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	getrange := "*7\r\n$8\r\ngetrange\r\n:4\r\n*1\r\n+readonly\r\n:1\r\n:1\r\n:1\r\n*1\r\n+@read\r\n"
+	substr := "*7\r\n$6\r\nsubstr\r\n:4\r\n*1\r\n+readonly\r\n:1\r\n:1\r\n:1\r\n*1\r\n+@read\r\n"
+	assert.Equal(t, "*3\r\n"+getrange+substr+"$-1\r\n", server.exec(t, client, "command", "info", "getrange", "SUBSTR", "nosuch"))
+	assert.Equal(t, "*1\r\n*7\r\n$4\r\nmset\r\n:-3\r\n*2\r\n+write\r\n+denyoom\r\n:1\r\n:-1\r\n:2\r\n*1\r\n+@write\r\n",
+		server.exec(t, client, "command", "info", "mset"))
+
+	assert.Equal(t, ":"+strconv.Itoa(len(commandRouter))+"\r\n", server.exec(t, client, "command", "count"))
+	assert.Contains(t, server.exec(t, client, "command", "list"), "$6\r\nsubstr\r\n")
+	assert.Contains(t, server.exec(t, client, "command"), substr)
+
+	// 废弃的命令在 COMMAND DOCS 中指向替代的命令
+	assert.Equal(t, "*4\r\n$6\r\nsubstr\r\n*4\r\n$9\r\ndoc_flags\r\n*1\r\n+deprecated\r\n$11\r\nreplaced_by\r\n$10\r\n`GETRANGE`\r\n$8\r\ngetrange\r\n*0\r\n",
+		server.exec(t, client, "command", "docs", "substr", "getrange", "nosuch"))
+	assert.Equal(t, "-ERR unknown subcommand 'foo'. Try COMMAND HELP.\r\n", server.exec(t, client, "command", "foo"))
+}
+
+func TestKeyPositions(t *testing.T) {
+	cmdLine := func(args ...string) [][]byte {
+		result := make([][]byte, 0, len(args))
+		for _, arg := range args {
+			result = append(result, []byte(arg))
+		}
+		return result
+	}
+	cases := []struct {
+		cmdLine   [][]byte
+		positions []int
+		err       error
+	}{
+		// 参数中的 key 按照 first last step 取出
+		{cmdLine("get", "a"), []int{1}, nil},
+		{cmdLine("mset", "a", "1", "b", "2", "c", "3"), []int{1, 3, 5}, nil},
+		{cmdLine("del", "a", "b", "c"), []int{1, 2, 3}, nil},
+		{cmdLine("ping"), nil, nil},
+		// SORT 的 STORE, BY 和 GET 的 pattern 不是 key
+		{cmdLine("sort", "mylist", "by", "weight_*", "get", "object_*", "store", "dest"), []int{1, 7}, nil},
+		{cmdLine("sort", "mylist", "limit", "0", "5", "get", "store", "alpha"), []int{1}, nil},
+		{cmdLine("sort_ro", "mylist", "by", "weight_*"), []int{1}, nil},
+		// EVAL 和 FCALL 的 numkeys
+		{cmdLine("eval", "not consulted", "3", "key1", "key2", "key3", "arg1", "arg2"), []int{3, 4, 5}, nil},
+		{cmdLine("evalsha", "sha", "1", "key1", "arg1"), []int{3}, nil},
+		{cmdLine("eval", "return 1", "0"), []int{}, nil},
+		{cmdLine("fcall", "myfunc", "2", "key1", "key2"), []int{3, 4}, nil},
+		{cmdLine("fcall_ro", "myfunc", "1", "key1"), []int{3}, nil},
+		{cmdLine("eval", "return 1", "-1"), nil, ErrorInvalidKeyArgs},
+		{cmdLine("eval", "return 1", "2", "key1"), nil, ErrorInvalidKeyArgs},
+		{cmdLine("fcall", "myfunc", "x", "key1"), nil, ErrorInvalidKeyArgs},
+	}
+	for _, c := range cases {
+		cmd, err := router(string(c.cmdLine[0]))
+		assert.Nil(t, err)
+		positions, err := cmd.KeyPositions(c.cmdLine)
+		assert.Equal(t, c.err, err, string(c.cmdLine[0]))
+		assert.Equal(t, c.positions, positions, string(c.cmdLine[0]))
+	}
+	assert.Nil(t, commandRouter["eval"].GetKeys(cmdLine("eval", "return 1", "2", "key1")))
+	assert.True(t, commandRouter["eval"].MovableKeys())
+	assert.False(t, commandRouter["mset"].MovableKeys())
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nc\r\n", server.exec(t, client, "command", "getkeys", "mset", "a", "b", "c", "d"))
+	assert.Equal(t, "*3\r\n$4\r\nkey1\r\n$4\r\nkey2\r\n$4\r\nkey3\r\n",
+		server.exec(t, client, "command", "getkeys", "eval", "not consulted", "3", "key1", "key2", "key3", "arg1", "arg2", "arg3"))
+	assert.Equal(t, "*2\r\n$3\r\nabc\r\n$3\r\ndef\r\n", server.exec(t, client, "command", "getkeys", "SORT", "abc", "STORE", "def"))
+	assert.Equal(t, "*1\r\n*2\r\n$1\r\na\r\n*2\r\n+RO\r\n+access\r\n", server.exec(t, client, "command", "getkeysandflags", "get", "a"))
+	assert.Equal(t, "*1\r\n*2\r\n$1\r\na\r\n*2\r\n+RW\r\n+update\r\n", server.exec(t, client, "command", "getkeysandflags", "set", "a", "b"))
+	assert.Equal(t, "*1\r\n*2\r\n$1\r\nk\r\n*3\r\n+RW\r\n+access\r\n+update\r\n",
+		server.exec(t, client, "command", "getkeysandflags", "fcall", "f", "1", "k"))
+
+	assert.Equal(t, "-ERR Invalid command specified\r\n", server.exec(t, client, "command", "getkeys", "nosuch", "a"))
+	assert.Equal(t, "-ERR Invalid number of arguments specified for command\r\n", server.exec(t, client, "command", "getkeys", "get"))
+	assert.Equal(t, "-ERR Invalid arguments specified for command\r\n", server.exec(t, client, "command", "getkeys", "eval", "return 1", "5", "a"))
+	assert.Equal(t, "-ERR The command has no key arguments\r\n", server.exec(t, client, "command", "getkeys", "ping"))
+	assert.Equal(t, "-ERR The command has no key arguments\r\n", server.exec(t, client, "command", "getkeys", "eval", "return 1", "0"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'command|getkeys' command\r\n", server.exec(t, client, "command", "getkeys"))
+	// 脚本的 key 的位置取决于参数
+	assert.Contains(t, server.exec(t, client, "command", "info", "eval"), "+movablekeys\r\n")
+}
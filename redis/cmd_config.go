@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"strconv"
+	"strings"
+)
+
+// ConfigSetter 校验并应用 CONFIG SET 的值, 返回最终写入配置的值
+type ConfigSetter func(value string) (string, error)
+
+// configSetters 允许在运行时通过 CONFIG SET 修改的配置项, 其他的配置项在配置中标记为 immutable
+var configSetters = map[string]ConfigSetter{
+	"notify-keyspace-events": setKeyspaceEvents,
+	// 超出的key在下一次记录时淘汰
+	"tracking-table-max-keys": setNonNegativeInt,
+	"busy-reply-threshold":    setNonNegativeInt,
+	// 自动重写的阈值在下一次 serverCron 时生效
+	"auto-aof-rewrite-percentage": setNonNegativeInt,
+	"auto-aof-rewrite-min-size":   setMemory,
+	// 积压缓冲区在下一次写入复制流时调整大小
+	"repl-backlog-size": setMemory,
+	"replica-read-only": setYesNo,
+	// 在下一次 replicationCron 时生效
+	"repl-ping-replica-period": setPositiveInt,
+	"repl-timeout":             setPositiveInt,
+	// 新的上限对下一个参数生效
+	"proto-max-bulk-len":        setMemory,
+	"client-query-buffer-limit": setMemory,
+	// timeout 在下一次 serverCron 时生效, tcp-keepalive 对新的连接生效
+	"timeout":       setNonNegativeInt,
+	"tcp-keepalive": setNonNegativeInt,
+	// 下一次写入或者 clientsCron 时生效
+	"client-write-timeout": setNonNegativeInt,
+	// 已经建立的连接不受影响, 只拒绝新的连接
+	"maxclients": setPositiveInt,
+	// 对下一次关闭生效
+	"shutdown-timeout": setNonNegativeInt,
+	// 对新的连接生效, 已经认证的客户端不受影响
+	"protected-mode": setYesNo,
+	"requirepass":    setString,
+	// 下一次连接主节点时生效
+	"masterauth": setString,
+	// 下一次写入客户端时生效
+	"client-output-buffer-limit": setOutputBufferLimit,
+	// 在下一条命令执行之前生效
+	"maxmemory":         setMemory,
+	"maxmemory-policy":  setMaxMemoryPolicy,
+	"maxmemory-samples": setPositiveInt,
+	"lfu-log-factor":    setNonNegativeInt,
+	"lfu-decay-time":    setNonNegativeInt,
+	// 对下一次删除生效
+	"lazyfree-lazy-eviction":   setYesNo,
+	"lazyfree-lazy-expire":     setYesNo,
+	"lazyfree-lazy-user-del":   setYesNo,
+	"lazyfree-lazy-user-flush": setYesNo,
+	// 在下一次 serverCron 时生效
+	"activedefrag":            setYesNo,
+	"active-defrag-cycle-max": setPercent,
+	// 对之后的写入生效, 已经转换为 hashtable 的集合不会变回 intset
+	"set-max-intset-entries": setMaxIntsetEntries,
+	// 下一次 CLUSTER SLOTS 和 CLUSTER SHARDS 时生效
+	"cluster-announce-ip":   setString,
+	"cluster-announce-port": setNonNegativeInt,
+	// 立即生效
+	"loglevel": setLogLevel,
+	// 对下一条命令生效
+	"command-timeout":  setNonNegativeInt,
+	"suggest-commands": setYesNo,
+}
+
+// setMemory 校验内存大小的配置项, 写入配置的是字节数
+func setMemory(value string) (string, error) {
+	num, err := config.ParseMemory(value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(num, 10), nil
+}
+
+// setNonNegativeInt 校验非负整数的配置项
+func setNonNegativeInt(value string) (string, error) {
+	num, err := strconv.Atoi(value)
+	if err != nil || num < 0 {
+		return "", errors.New("argument couldn't be parsed into an integer")
+	}
+	return strconv.Itoa(num), nil
+}
+
+// setPositiveInt 校验正整数的配置项
+func setPositiveInt(value string) (string, error) {
+	num, err := strconv.Atoi(value)
+	if err != nil || num <= 0 {
+		return "", errors.New("argument must be greater than 0")
+	}
+	return strconv.Itoa(num), nil
+}
+
+// setPercent 校验 1 到 99 的百分比
+func setPercent(value string) (string, error) {
+	num, err := strconv.Atoi(value)
+	if err != nil || num < 1 || num > 99 {
+		return "", errors.New("argument must be between 1 and 99 inclusive")
+	}
+	return strconv.Itoa(num), nil
+}
+
+// setString 不需要校验的字符串配置项
+func setString(value string) (string, error) {
+	return value, nil
+}
+
+// setYesNo 校验 yes/no 的配置项
+func setYesNo(value string) (string, error) {
+	lower := strings.ToLower(value)
+	if lower != "yes" && lower != "no" {
+		return "", errors.New("argument must be 'yes' or 'no'")
+	}
+	return lower, nil
+}
+
+// setLogLevel 校验并修改日志的级别
+func setLogLevel(value string) (string, error) {
+	level, err := logger.ParseLevel(value)
+	if err != nil {
+		return "", errors.New("argument(s) must be one of the following: debug, verbose, notice, warning, nothing")
+	}
+	logger.SetLevel(level)
+	return strings.ToLower(value), nil
+}
+
+// setMaxIntsetEntries 校验并修改 intset 编码的元素上限
+func setMaxIntsetEntries(value string) (string, error) {
+	value, err := setNonNegativeInt(value)
+	if err != nil {
+		return "", err
+	}
+	entries, _ := strconv.Atoi(value)
+	obj.SetMaxIntsetEntries(entries)
+	return value, nil
+}
+
+func registerConfigSetter(name string, setter ConfigSetter) {
+	configSetters[strings.ToLower(name)] = setter
+}
+
+// execConfig config get parameter [parameter ...] | config set parameter value [parameter value ...]
+func execConfig(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "get":
+		return configGet(conn, args[1:])
+	case "set":
+		return configSet(conn, args[1:])
+	case "rewrite":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("config|rewrite").WriteTo(conn)
+		}
+		return configRewrite(conn)
+	case "resetstat":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("config|resetstat").WriteTo(conn)
+		}
+		conn.ResetStats()
+		return MakeOkReply().WriteTo(conn)
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "CONFIG").WriteTo(conn)
+	}
+}
+
+func configGet(conn *Client, patterns [][]byte) error {
+	if len(patterns) < 1 {
+		return MakeNumberOfArgsErrReply("config|get").WriteTo(conn)
+	}
+	result := make([]Reply, 0)
+	matched := make(map[string]struct{})
+	for _, pattern := range patterns {
+		for _, name := range config.Names() {
+			if _, ok := matched[name]; ok {
+				continue
+			}
+			if !util.GlobMatchNoCase(string(pattern), name) {
+				continue
+			}
+			value, _ := config.Get(name)
+			matched[name] = struct{}{}
+			result = append(result, MakeBulkReply([]byte(name)), MakeBulkReply([]byte(value)))
+		}
+	}
+	return MakeMapReply(result).WriteTo(conn)
+}
+
+func configSet(conn *Client, pairs [][]byte) error {
+	if len(pairs) < 2 || len(pairs)%2 != 0 {
+		return MakeNumberOfArgsErrReply("config|set").WriteTo(conn)
+	}
+	// 先全部校验, 有一个失败就都不生效
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(string(pairs[i]))
+		param, ok := config.LookupParam(name)
+		if !ok {
+			return MakeStandardErrReply("ERR Unknown option or number of arguments for CONFIG SET - '" +
+				string(pairs[i]) + "'").WriteTo(conn)
+		}
+		if _, ok = configSetters[name]; !ok || param.Immutable {
+			return MakeStandardErrReply("ERR CONFIG SET failed (possibly related to argument '" +
+				name + "') - can't set immutable config").WriteTo(conn)
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(string(pairs[i]))
+		value, err := configSetters[name](string(pairs[i+1]))
+		if err == nil {
+			err = config.Set(name, value)
+		}
+		if err != nil {
+			return MakeStandardErrReply("ERR CONFIG SET failed (possibly related to argument '" +
+				name + "') - " + err.Error()).WriteTo(conn)
+		}
+	}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// configRewrite 把当前的配置写回启动时使用的配置文件
+func configRewrite(conn *Client) error {
+	if err := config.Rewrite(); err != nil {
+		if errors.Is(err, config.ErrNoConfigFile) {
+			return MakeStandardErrReply("ERR " + err.Error()).WriteTo(conn)
+		}
+		logger.Named("config").Warnf("CONFIG REWRITE failed: %v", err)
+		return MakeStandardErrReply("ERR Rewriting config file: " + err.Error()).WriteTo(conn)
+	}
+	logger.Named("config").Infof("CONFIG REWRITE executed with success.")
+	return MakeOkReply().WriteTo(conn)
+}
+
+func init() {
+	register("config", execConfig, withArity(-2), withFlags(flagNoScript|flagAdmin|flagLoading|flagStale))
+}
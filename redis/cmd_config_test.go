@@ -0,0 +1,44 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+)
+
+// TestConfigSetters 可以修改的配置项都有 setter, 不能修改的配置项标记为 immutable
+func TestConfigSetters(t *testing.T) {
+	for _, p := range config.Params() {
+		_, ok := configSetters[p.Name]
+		assert.Equal(t, !p.Immutable, ok, p.Name)
+	}
+}
+
+func TestConfigSetImmutable(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'databases') - can't set immutable config\r\n",
+		server.exec(t, client, "config", "set", "DATABASES", "4"))
+	// 有一个不能修改时都不生效
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'runid') - can't set immutable config\r\n",
+		server.exec(t, client, "config", "set", "timeout", "5", "runid", "abc"))
+	assert.Equal(t, resp([]string{"timeout", "0"}), server.exec(t, client, "config", "get", "timeout"))
+	assert.Equal(t, "-ERR Unknown option or number of arguments for CONFIG SET - 'no-such-option'\r\n",
+		server.exec(t, client, "config", "set", "no-such-option", "1"))
+}
+
+func TestConfigGetAll(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	reply := server.exec(t, client, "config", "get", "*")
+	assert.True(t, strings.HasPrefix(reply, "*"+strconv.Itoa(2*len(config.Params()))+"\r\n"), reply)
+	for _, p := range config.Params() {
+		value, _ := config.Get(p.Name)
+		assert.Contains(t, reply, resp([]string{p.Name, value})[len("*2\r\n"):], p.Name)
+	}
+	assert.Contains(t, reply, "$17\r\nreplica-read-only\r\n$3\r\nyes\r\n")
+	assert.Contains(t, reply, "$11\r\nrequirepass\r\n$0\r\n\r\n")
+}
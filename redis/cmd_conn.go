@@ -2,17 +2,28 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/xuning888/godis-tiny/config"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
-	"log"
+	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+// ping ping [message]. 与 redis 一样, RESP2 的订阅模式下回复 ["pong", message], 客户端可以和消息一样从推送中读取;
+// RESP3 可以区分推送和回复, 回复不变
 func ping(ctx context.Context, conn *Client) error {
 	args := conn.GetArgs()
+	if conn.SubscriptionCount() > 0 && conn.Protocol() != resp3 && len(args) <= 1 {
+		payload := []byte{}
+		if len(args) == 1 {
+			payload = args[0]
+		}
+		return MakeMultiBulkReply([][]byte{[]byte("pong"), payload}).WriteTo(conn)
+	}
 	if len(args) == 0 {
 		return MakePongReply().WriteTo(conn)
 	} else if len(args) == 1 {
@@ -22,6 +33,11 @@ func ping(ctx context.Context, conn *Client) error {
 	}
 }
 
+// execEcho echo message, 原样返回参数
+func execEcho(ctx context.Context, conn *Client) error {
+	return MakeBulkReply(conn.GetArgs()[0]).WriteTo(conn)
+}
+
 func selectDb(ctx context.Context, conn *Client) error {
 	argNum := conn.GetArgNum()
 	if argNum < 1 || argNum > 1 {
@@ -30,7 +46,7 @@ func selectDb(ctx context.Context, conn *Client) error {
 	cmdData := conn.GetArgs()
 	index, err := strconv.Atoi(string(cmdData[0]))
 	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
 	err = conn.RangeCheck(index)
 	if err != nil {
@@ -46,7 +62,7 @@ func execType(ctx context.Context, conn *Client) error {
 		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 	}
 	key := string(conn.GetArgs()[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
 	if !exists {
 		return MakeBulkReply([]byte("none")).WriteTo(conn)
 	}
@@ -63,36 +79,49 @@ func gc(c context.Context, conn *Client) error {
 	return MakeOkReply().WriteTo(conn)
 }
 
-const (
-	flushAsync = iota
-	flushSync
-)
-
-func flushDb(c context.Context, conn *Client) error {
+// flushMode 解析 FLUSHDB/FLUSHALL 的 [ASYNC|SYNC], 没有指定时按照 lazyfree-lazy-user-flush
+func flushMode(conn *Client) (lazy bool, errReply Reply) {
 	argNum := conn.GetArgNum()
-	var policy int
-	// 默认同步刷新
 	if argNum == 0 {
-		policy = flushSync
-	} else if argNum == 1 {
-		args := strings.ToUpper(string(conn.GetArgs()[0]))
-		if args == "ASYNC" {
-			policy = flushAsync
-		} else if args == "SYNC" {
-			policy = flushSync
-		} else {
-			return MakeSyntaxReply().WriteTo(conn)
-		}
-	} else {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+		return config.Properties.LazyfreeLazyUserFlush, nil
+	}
+	if argNum > 1 {
+		return false, MakeNumberOfArgsErrReply(conn.GetCmdName())
+	}
+	switch strings.ToUpper(string(conn.GetArgs()[0])) {
+	case "ASYNC":
+		return true, nil
+	case "SYNC":
+		return false, nil
+	default:
+		return false, MakeSyntaxErr()
+	}
+}
+
+// flushDb flushdb [ASYNC|SYNC], ASYNC 时旧的数据在后台释放
+func flushDb(c context.Context, conn *Client) error {
+	lazy, errReply := flushMode(conn)
+	if errReply != nil {
+		return errReply.WriteTo(conn)
 	}
 	db := conn.GetDb()
-	cmdLine := conn.GetCmdLine()
-	// 这里不管是sync 还是 async 都走同一个逻辑, 因为有gc, 开一个协程没有啥意义
-	if policy == flushSync || policy == flushAsync {
+	if lazy {
+		db.FlushLazy()
+	} else {
 		db.Flush()
-		db.AddAof(cmdLine)
 	}
+	db.Propagate(conn.GetCmdLine())
+	return MakeOkReply().WriteTo(conn)
+}
+
+// flushAll flushall [ASYNC|SYNC] 清空所有的 db
+func flushAll(c context.Context, conn *Client) error {
+	lazy, errReply := flushMode(conn)
+	if errReply != nil {
+		return errReply.WriteTo(conn)
+	}
+	conn.FlushAll(lazy)
+	conn.GetDb().Propagate(conn.GetCmdLine())
 	return MakeOkReply().WriteTo(conn)
 }
 
@@ -116,24 +145,68 @@ func execRewriteAof(c context.Context, conn *Client) error {
 		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 	}
 	if config.Properties.AppendOnly {
-		go func() {
-			err := conn.Rewrite()
-			if err != nil {
-				log.Printf("start rewrite failed with err: %v", err)
+		if err := conn.Rewrite(); err != nil {
+			if errors.Is(err, ErrAofRewriteIsRunning) {
+				return MakeStandardErrReply("ERR Background append only file rewriting already in progress").WriteTo(conn)
 			}
-		}()
+			return MakeStandardErrReply("ERR " + err.Error()).WriteTo(conn)
+		}
 	}
 	return MakeSimpleReply([]byte("Background append only file rewriting started")).WriteTo(conn)
 }
 
+// execQuit quit, 回复 OK 之后关闭连接, 之前的流水线中的回复都会先发送, 之后的命令不再执行
 func execQuit(c context.Context, conn *Client) error {
 	argNum := conn.GetArgNum()
 	if argNum != 0 {
 		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 	}
+	conn.closeAfterReply = true
 	return MakeOkReply().WriteTo(conn)
 }
 
+// execReset reset, 恢复连接刚建立时的状态: 取消订阅和 tracking, 选择0号库, 使用 RESP2, 打开回复.
+// 与 redis 一致, 客户端的名称不变, 配置了 requirepass 时需要重新认证
+func execReset(c context.Context, conn *Client) error {
+	if conn.GetArgNum() != 0 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	conn.resetState()
+	conn.SetDbIndex(0)
+	conn.protocol = resp2
+	conn.replyMode, conn.skipReply = replyOn, false
+	conn.noEvict.Store(false)
+	conn.libName, conn.libVer = "", ""
+	conn.readOnly = false
+	conn.authenticated = config.Properties.RequirePass == ""
+	return MakeSimpleReply([]byte("RESET")).WriteTo(conn)
+}
+
+// execShutdown shutdown [nosave|save] [now], 成功时没有回复, 客户端在关闭的过程中被断开
+func execShutdown(c context.Context, conn *Client) error {
+	flags, save, noSave := 0, false, false
+	for _, arg := range conn.GetArgs() {
+		switch strings.ToLower(string(arg)) {
+		case "save":
+			save = true
+		case "nosave":
+			noSave = true
+		case "now":
+			flags |= shutdownNow
+		default:
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+	}
+	if save && noSave {
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	if save {
+		flags |= shutdownSave
+	}
+	conn.RequestShutdown(flags)
+	return nil
+}
+
 func execMemory(c context.Context, conn *Client) error {
 	argNum := conn.GetArgNum()
 	if argNum < 2 || argNum > 2 {
@@ -143,67 +216,116 @@ func execMemory(c context.Context, conn *Client) error {
 	option := strings.ToLower(string(args[0]))
 	key := string(args[1])
 	if option == "usage" {
-		redisObject, exists := conn.GetDb().GetEntity(key)
+		redisObject, exists := conn.GetDb().LookupKeyRead(key)
 		if !exists {
 			return MakeNullBulkReply().WriteTo(conn)
 		}
-		var mem = int64(len(args[1]))
-		var err error
-		switch redisObject.ObjType {
-		case obj.RedisString:
-			mem, err = obj.StringObjMem(redisObject)
-			if err != nil {
-				return MakeNullBulkReply().WriteTo(conn)
-			}
-			break
-		case obj.RedisList:
-			mem, err = obj.ListObjMem(redisObject)
-			if err != nil {
-				return MakeNullBulkReply().WriteTo(conn)
-			}
-			break
-		default:
-			// todo
-			return MakeNullBulkReply().WriteTo(conn)
-		}
-		return MakeIntReply(mem).WriteTo(conn)
+		return MakeIntReply(obj.ObjectMemory(redisObject)).WriteTo(conn)
 	}
 	return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 }
 
-// execInfo
+// execInfo info [section]
 func execInfo(c context.Context, conn *Client) error {
 	argNum := conn.GetArgNum()
 	if argNum > 1 {
 		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 	}
-	// todo
-	cmdData := conn.GetArgs()
-	var logStr string
-	for _, data := range cmdData {
-		logStr += string(data)
+	section := "default"
+	if argNum == 1 {
+		section = strings.ToLower(string(conn.GetArgs()[0]))
+	}
+	var info string
+	switch section {
+	case "default", "all", "everything":
+		info = infoServer() + "\r\n" + infoClients(conn.Clients) + "\r\n" + conn.Memory.InfoMemory() + "\r\n" +
+			conn.Persister.InfoPersistence() + "\r\n" + infoServerStats(conn) + "\r\n" + conn.Replication.Info() + "\r\n" +
+			infoCluster()
+		// 与 redis 一致, 命令的统计只在 all 和 everything 中输出
+		if section != "default" {
+			info += "\r\n" + infoCommandStats() + "\r\n" + infoLatencyStats()
+		}
+		info += "\r\n" + conn.Keyspace.InfoKeyspace()
+	case "commandstats":
+		info = infoCommandStats()
+	case "latencystats":
+		info = infoLatencyStats()
+	case "server":
+		info = infoServer()
+	case "clients":
+		info = infoClients(conn.Clients)
+	case "memory":
+		info = conn.Memory.InfoMemory()
+	case "persistence":
+		info = conn.Persister.InfoPersistence()
+	case "stats":
+		info = infoServerStats(conn)
+	case "replication":
+		info = conn.Replication.Info()
+	case "cluster":
+		info = infoCluster()
+	case "keyspace":
+		info = conn.Keyspace.InfoKeyspace()
 	}
-	return MakeBulkReply([]byte(infoClients())).WriteTo(conn)
+	return MakeVerbatimReply([]byte(info)).WriteTo(conn)
 }
 
-func infoClients() string {
+func infoServer() string {
+	return fmt.Sprintf("# Server\r\n"+
+		"redis_version:%s\r\n"+
+		"redis_mode:standalone\r\n"+
+		"process_id:%d\r\n"+
+		"run_id:%s\r\n"+
+		"tcp_port:%d\r\n"+
+		"unix_socket:%s\r\n"+
+		"config_file:%s\r\n",
+		redisVersion,
+		os.Getpid(),
+		config.Properties.RunID,
+		config.Properties.Port,
+		config.Properties.UnixSocket,
+		config.Properties.CfPath,
+	)
+}
+
+// infoServerStats 同步的次数, 网络流量, 过期和淘汰的key的个数以及命中率
+func infoServerStats(conn *Client) string {
+	return conn.Replication.InfoStats() + conn.stats.info()
+}
+
+// infoClients client_libs 是每个客户端库的连接数, 按照库名排序, 比如 go-redis=2,redis-py=1
+func infoClients(clients *Manager) string {
+	counts := clients.LibraryCounts()
+	libs := make([]string, 0, len(counts))
+	for name, count := range counts {
+		libs = append(libs, name+"="+strconv.Itoa(count))
+	}
+	sort.Strings(libs)
 	return fmt.Sprintf("# Clients\r\n"+
 		"connected_clients:%d\r\n"+
-		"maxclients:%d\r\n",
-		ConnCounter.CountConnections(),
+		"maxclients:%d\r\n"+
+		"rejected_connections:%d\r\n"+
+		"client_libs:%s\r\n",
+		clients.CountConnections(),
 		config.Properties.MaxClients,
+		clients.RejectedConnections(),
+		strings.Join(libs, ","),
 	)
 }
 
 func init() {
-	register("ping", ping)
-	register("select", selectDb)
-	register("type", execType)
-	register("ttlops", clearTTL)
-	register("bgrewriteaof", execRewriteAof)
-	register("flushdb", flushDb)
-	register("quit", execQuit)
-	register("memory", execMemory)
-	register("info", execInfo)
-	register("gc", gc)
+	register("ping", ping, withArity(-1))
+	register("echo", execEcho, withArity(2))
+	register("select", selectDb, withArity(2), withFlags(flagLoading|flagStale))
+	register("type", execType, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("ttlops", clearTTL, withArity(-1), withFlags(flagNoScript))
+	register("bgrewriteaof", execRewriteAof, withArity(1), withFlags(flagNoScript|flagAdmin))
+	register("flushdb", flushDb, withArity(-1), withFlags(flagWrite))
+	register("flushall", flushAll, withArity(-1), withFlags(flagWrite))
+	register("quit", execQuit, withArity(-1), withFlags(flagNoScript|flagLoading|flagStale))
+	register("shutdown", execShutdown, withArity(-1), withFlags(flagNoScript|flagAdmin|flagLoading|flagStale))
+	register("reset", execReset, withArity(1), withFlags(flagNoScript|flagLoading|flagStale))
+	register("memory", execMemory, withArity(-2), withFlags(flagReadonly), withKeys(2, 2, 1))
+	register("info", execInfo, withArity(-1), withFlags(flagLoading|flagStale))
+	register("gc", gc, withArity(-1))
 }
@@ -0,0 +1,40 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPing(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "+PONG\r\n", server.exec(t, client, "ping"))
+	assert.Equal(t, "$5\r\nhello\r\n", server.exec(t, client, "ping", "hello"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'ping' command\r\n", server.exec(t, client, "ping", "a", "b"))
+
+	// RESP2 的订阅模式下和消息一样是数组
+	server.exec(t, client, "subscribe", "ch")
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", server.exec(t, client, "ping"))
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$5\r\nhello\r\n", server.exec(t, client, "ping", "hello"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'ping' command\r\n", server.exec(t, client, "ping", "a", "b"))
+	assert.Equal(t, "$2\r\nhi\r\n", server.exec(t, client, "echo", "hi"))
+	server.exec(t, client, "unsubscribe")
+	assert.Equal(t, "+PONG\r\n", server.exec(t, client, "ping"))
+
+	// RESP3 可以区分推送, 订阅之后回复不变
+	resp3, _ := server.newClient()
+	server.exec(t, resp3, "hello", "3")
+	server.exec(t, resp3, "psubscribe", "*")
+	assert.Equal(t, "+PONG\r\n", server.exec(t, resp3, "ping"))
+	assert.Equal(t, "$5\r\nhello\r\n", server.exec(t, resp3, "ping", "hello"))
+}
+
+func TestEcho(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	binary := string([]byte{0, 1, '\r', '\n', 0xff, 0xfe, 'x'})
+	assert.Equal(t, "$7\r\n"+binary+"\r\n", server.exec(t, client, "echo", binary))
+	assert.Equal(t, "$0\r\n\r\n", server.exec(t, client, "echo", ""))
+	assert.Equal(t, "-ERR wrong number of arguments for 'echo' command\r\n", server.exec(t, client, "echo"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'echo' command\r\n", server.exec(t, client, "echo", "a", "b"))
+}
@@ -0,0 +1,100 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugEncodingErrs DEBUG ZIPLIST|LISTPACK|QUICKLIST 的值不是这种编码时的错误, 与 redis 一致
+var debugEncodingErrs = map[string]string{
+	"ziplist":   "ERR Not a ziplist encoded object.",
+	"listpack":  "ERR Not a listpack encoded object.",
+	"quicklist": "ERR Not a quicklist encoded object.",
+}
+
+// execDebug debug reload | debug loadaof | debug log message | debug sleep seconds | debug ziplist|listpack|quicklist key | debug setalgebra | debug change-repl-id
+func execDebug(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	switch strings.ToLower(string(args[0])) {
+	case "reload":
+		if err := conn.Persister.ReloadRdb(); err != nil {
+			return reloadErrReply(err).WriteTo(conn)
+		}
+		return MakeOkReply().WriteTo(conn)
+	case "loadaof":
+		// 没有打开 appendonly 时什么都不做
+		if err := conn.Persister.ReloadAof(); err != nil {
+			return reloadErrReply(err).WriteTo(conn)
+		}
+		return MakeOkReply().WriteTo(conn)
+	case "log":
+		// 与 redis 一致写一行标记, 测试用来在日志中定位
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("debug|log").WriteTo(conn)
+		}
+		logger.Named("debug").Warnf("DEBUG LOG: %s", args[1])
+		return MakeOkReply().WriteTo(conn)
+	case "sleep":
+		// 持有锁等待, 与 redis 一样用来模拟执行时间很长的命令
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("debug|sleep").WriteTo(conn)
+		}
+		seconds, err := strconv.ParseFloat(string(args[1]), 64)
+		if err != nil || seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return MakeNotFloatErr().WriteTo(conn)
+		}
+		timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return MakeOkReply().WriteTo(conn)
+		case <-ctx.Done():
+			return interruptedReply(ctx).WriteTo(conn)
+		}
+	case "ziplist", "listpack", "quicklist":
+		// 列表在内存中总是 linkedlist 编码, RDB 中的 ziplist, listpack 和 quicklist 加载时就转换了,
+		// 没有可以展示的结构, 和 redis 中不是这种编码的值一样回复错误
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("debug|" + strings.ToLower(string(args[0]))).WriteTo(conn)
+		}
+		if _, exists := conn.GetDb().PeekEntity(string(args[1])); !exists {
+			return MakeNoSuchKeyErr().WriteTo(conn)
+		}
+		return MakeStandardErrReply(debugEncodingErrs[strings.ToLower(string(args[0]))]).WriteTo(conn)
+	case "setalgebra":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("debug|setalgebra").WriteTo(conn)
+		}
+		return MakeSimpleReply([]byte(setAlgebraDebugInfo(conn.GetDb().stats))).WriteTo(conn)
+	case "change-repl-id":
+		// 测试用来让从节点只能全量同步
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("debug|change-repl-id").WriteTo(conn)
+		}
+		conn.Replication.ChangeReplId()
+		return MakeOkReply().WriteTo(conn)
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "DEBUG").WriteTo(conn)
+	}
+}
+
+func init() {
+	register("debug", execDebug, withArity(-2), withFlags(flagNoScript|flagAdmin))
+}
+
+// reloadErrReply DEBUG RELOAD 和 DEBUG LOADAOF 的错误, 正在执行 BGSAVE 或者 aof 重写时与 BGSAVE 和 BGREWRITEAOF 的错误一致
+func reloadErrReply(err error) Reply {
+	if errors.Is(err, ErrAofRewriteIsRunning) {
+		return MakeStandardErrReply("ERR Background append only file rewriting already in progress")
+	}
+	return saveErrReply(err)
+}
@@ -0,0 +1,145 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+// DELPATTERN 删除匹配 pattern 的 key, 代替 KEYS + DEL. dict 没有 SCAN 的游标, 开始时复制一次 db 中所有的 key 的名字,
+// 之后每一步只检查其中 delPatternChunk 个, 删除的 key 作为一条 DEL(ASYNC 时 UNLINK) 传播, 重放的结果与执行时一致.
+// 第一步在命令中执行, 没有检查完时客户端被阻塞, 之后的步骤由定时任务每 delPatternInterval 执行一次, 步骤之间执行其他客户端的命令.
+// 开始之后新写入的 key 不会被删除
+
+const (
+	// delPatternChunk 每一步检查的 key 的个数
+	delPatternChunk = 1000
+	// delPatternInterval 有 DELPATTERN 在执行时定时任务的间隔
+	delPatternInterval = time.Millisecond
+)
+
+// delPatternJob 一个 DELPATTERN 的进度, 持有锁时读写
+type delPatternJob struct {
+	pattern string
+	lazy    bool
+	// limit 最多删除的个数, 0 表示不限制
+	limit int64
+	// keys 开始时 db 中的 key, 检查过的位置会被清空, 不再持有 key
+	keys    []string
+	pos     int
+	deleted int64
+}
+
+// done 检查完了所有的 key 或者达到了 limit
+func (job *delPatternJob) done() bool {
+	return job.pos >= len(job.keys) || (job.limit > 0 && job.deleted >= job.limit)
+}
+
+// step 检查下一批 key, 和 DEL 一样删除没有过期的匹配的 key, 返回是否完成
+func (job *delPatternJob) step(db *DB) bool {
+	end := job.pos + delPatternChunk
+	if end > len(job.keys) {
+		end = len(job.keys)
+	}
+	var deleted [][]byte
+	for ; job.pos < end && !job.done(); job.pos++ {
+		key := job.keys[job.pos]
+		job.keys[job.pos] = ""
+		if !util.GlobMatch(job.pattern, key) {
+			continue
+		}
+		if _, exists := db.PeekEntity(key); !exists {
+			continue
+		}
+		if db.Delete(key, job.lazy) > 0 {
+			db.Notify(notifyGeneric, "del", key)
+			deleted = append(deleted, []byte(key))
+			job.deleted++
+		}
+	}
+	if len(deleted) > 0 {
+		cmdName := "del"
+		if job.lazy {
+			cmdName = "unlink"
+		}
+		db.Propagate(util.ToCmdLine2(cmdName, deleted))
+	}
+	if job.done() {
+		job.keys = nil
+		return true
+	}
+	return false
+}
+
+// execDelPattern delpattern pattern [SYNC|ASYNC] [LIMIT count], 回复删除的个数.
+// 没有指定 SYNC 或者 ASYNC 时和 DEL 一样按照 lazyfree-lazy-user-del 释放
+func execDelPattern(ctx context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	job := &delPatternJob{pattern: string(args[0]), lazy: config.Properties.LazyfreeLazyUserDel}
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToLower(string(args[i])); {
+		case option == "sync":
+			job.lazy = false
+		case option == "async":
+			job.lazy = true
+		case option == "limit" && i+1 < len(args):
+			limit, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || limit < 0 {
+				return MakeStandardErrReply("ERR LIMIT must be a non-negative integer").WriteTo(conn)
+			}
+			job.limit = limit
+			i++
+		default:
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+	}
+	db := conn.GetDb()
+	job.keys = db.Keys()
+	// 事务中不能阻塞, 一次删除完
+	for !job.step(db) {
+		if !conn.inExec {
+			conn.Block(conn, &blockState{
+				kind:      blockedDelPattern,
+				dbIndex:   db.Index,
+				job:       job,
+				onTimeout: func() Reply { return MakeIntReply(job.deleted) },
+			})
+			return nil
+		}
+	}
+	return MakeIntReply(job.deleted).WriteTo(conn)
+}
+
+// delPatternCron 为每个执行 DELPATTERN 的客户端删除下一批 key, 完成之后回复删除的个数.
+// 暂停写命令期间等待, 变成从节点之后停止并回复已经删除的个数. 返回是否还有没有完成的 DELPATTERN
+func (r *RedisServer) delPatternCron() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	b := &r.blocking
+	if len(b.deleting) == 0 || r.writesPaused || r.loading.Load() {
+		return len(b.deleting) > 0
+	}
+	for conn := range b.deleting {
+		job := conn.blocked.job
+		if r.isReplica() {
+			r.unblockClient(conn, MakeIntReply(job.deleted))
+			continue
+		}
+		// 失效消息的 NOLOOP 按照执行命令的客户端判断
+		r.currentClient = conn
+		done := job.step(r.dbs[conn.blocked.dbIndex])
+		r.propagatePending()
+		if done {
+			r.unblockClient(conn, MakeIntReply(job.deleted))
+		}
+	}
+	return len(b.deleting) > 0
+}
+
+func init() {
+	register("delpattern", execDelPattern, withArity(-2), withFlags(flagWrite|flagNoScript|flagAdmin))
+}
@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fillKeys 写入 prefix0 到 prefix(n-1) 这些 string
+func fillKeys(t *testing.T, server *testServer, prefix string, n int) {
+	client, _ := server.newClient()
+	const batch = 1000
+	for i := 0; i < n; i += batch {
+		args := []string{"mset"}
+		for j := i; j < i+batch && j < n; j++ {
+			args = append(args, prefix+strconv.Itoa(j), "v")
+		}
+		server.exec(t, client, args...)
+	}
+}
+
+func TestDelPattern(t *testing.T) {
+	clk := useManualClock(t)
+	server, file := newAofTestServer(t, FsyncNo)
+	client, conn := server.newClient()
+	other, _ := server.newClient()
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "delpattern", "*", "now"))
+	assert.Equal(t, "-ERR LIMIT must be a non-negative integer\r\n", server.exec(t, client, "delpattern", "*", "limit", "-1"))
+	assert.Contains(t, server.exec(t, client, "command", "info", "delpattern"), "+admin\r\n")
+	// key 不多时在命令中删除完
+	server.exec(t, other, "mset", "a:1", "v", "a:2", "v", "b:1", "v")
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "delpattern", "a:*"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "delpattern", "nomatch:*"))
+	server.exec(t, other, "del", "b:1")
+
+	fillKeys(t, server, "session:", 2500)
+	fillKeys(t, server, "user:", 100)
+	server.exec(t, other, "set", "session:expired", "v", "px", "10")
+	clk.Advance(20 * time.Millisecond)
+	takeAof(server, file)
+
+	// 没有检查完时阻塞, 之后的步骤由定时任务执行, 期间其他客户端可以执行命令
+	assert.Equal(t, "", server.exec(t, client, "delpattern", "session:*"))
+	assert.Contains(t, clientInfoString(client), " flags=b ")
+	server.exec(t, other, "set", "session:new", "v")
+	steps := 0
+	for server.delPatternCron() {
+		steps++
+		assert.Equal(t, "", conn.take())
+	}
+	assert.GreaterOrEqual(t, steps, 1)
+	assert.Equal(t, ":2500\r\n", conn.take())
+	assert.Nil(t, client.blocked)
+	assert.Equal(t, 101, server.dbs[0].Len())
+	// 开始之后写入的 key 不删除
+	assert.Equal(t, ":1\r\n", server.exec(t, other, "exists", "session:new", "session:1"))
+
+	// 每一步删除的 key 作为一条 DEL 传播, 过期的 key 按照过期删除
+	deleted := 0
+	for _, record := range parseCompatValues(t, takeAof(server, file)) {
+		args := strings.Fields(record.args())
+		if args[0] == "set" || args[0] == "MULTI" || args[0] == "EXEC" || args[0] == "pexpireat" {
+			continue
+		}
+		assert.Equal(t, "del", args[0])
+		if len(args) == 2 && args[1] == "session:expired" {
+			continue
+		}
+		assert.LessOrEqual(t, len(args)-1, delPatternChunk)
+		deleted += len(args) - 1
+	}
+	assert.Equal(t, 2500, deleted)
+
+	// LIMIT, ASYNC 传播为 UNLINK
+	assert.Equal(t, ":10\r\n", server.exec(t, client, "delpattern", "user:*", "async", "limit", "10"))
+	assert.Equal(t, 91, server.dbs[0].Len())
+	assert.True(t, strings.HasPrefix(takeAof(server, file), "*11\r\n$6\r\nunlink\r\n"))
+
+	// 事务中不阻塞, 一次删除完
+	fillKeys(t, server, "tx:", 2500)
+	server.exec(t, client, "multi")
+	server.exec(t, client, "delpattern", "tx:*")
+	assert.Equal(t, "*1\r\n:2500\r\n", server.exec(t, client, "exec"))
+
+	// 断开连接之后停止
+	fillKeys(t, server, "kill:", 2500)
+	assert.Equal(t, "", server.exec(t, client, "delpattern", "kill:*"))
+	remaining := server.dbs[0].Len()
+	assert.Less(t, remaining, 91+2500)
+	server.freeClient(client)
+	assert.False(t, server.delPatternCron())
+	assert.Equal(t, remaining, server.dbs[0].Len())
+}
+
+func TestDelPatternReplica(t *testing.T) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	fillKeys(t, server, "k:", 2500)
+	assert.Equal(t, "", server.exec(t, client, "delpattern", "k:*"))
+	// 暂停写命令期间等待
+	server.pauseWrites()
+	assert.True(t, server.delPatternCron())
+	assert.Equal(t, "", conn.take())
+	server.unpauseWrites()
+	assert.True(t, server.delPatternCron())
+	assert.Equal(t, "", conn.take())
+	// 变成从节点之后回复已经删除的个数
+	server.repl.masterHost = "127.0.0.1"
+	defer func() { server.repl.masterHost = "" }()
+	assert.False(t, server.delPatternCron())
+	assert.Equal(t, ":"+strconv.Itoa(2500-server.dbs[0].Len())+"\r\n", conn.take())
+	assert.Equal(t, 500, server.dbs[0].Len())
+}
+
+// TestDelPatternLiveTraffic 删除 100k 个 key 期间其他客户端的 GET 不会等待整个删除完成
+func TestDelPatternLiveTraffic(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("slow")
+	}
+	server := newTestServer()
+	port := serve(t, server)
+	const n = 100000
+	fillKeys(t, server, "session:", n)
+	fillKeys(t, server, "user:", 10000)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	deleter, deleterReader := dial()
+	reader, readerReader := dial()
+
+	start := time.Now()
+	_, _ = deleter.Write([]byte(resp([]string{"delpattern", "session:*"})))
+	done := make(chan string)
+	go func() {
+		line, _ := deleterReader.ReadString('\n')
+		done <- line
+	}()
+	var maxLatency time.Duration
+	gets := 0
+	for {
+		select {
+		case line := <-done:
+			assert.Equal(t, ":100000\r\n", line)
+			t.Logf("deleted %d keys in %v, %d concurrent GETs, max latency %v", n, time.Since(start), gets, maxLatency)
+			assert.Greater(t, gets, 0)
+			assert.Less(t, maxLatency, 100*time.Millisecond)
+			assert.Equal(t, 10000, server.dbs[0].Len())
+			return
+		default:
+		}
+		key := "user:" + strconv.Itoa(gets%10000)
+		begin := time.Now()
+		_, _ = reader.Write([]byte(resp([]string{"get", key})))
+		header, err := readerReader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "$1\r\n", header)
+		_, _ = readerReader.ReadString('\n')
+		if latency := time.Since(begin); latency > maxLatency {
+			maxLatency = latency
+		}
+		gets++
+	}
+}
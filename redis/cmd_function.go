@@ -0,0 +1,210 @@
+package redis
+
+import (
+	"context"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"strings"
+)
+
+// execFCall fcall function numkeys [key [key ...]] [arg [arg ...]]
+func execFCall(ctx context.Context, conn *Client) error {
+	return fcall(conn, false)
+}
+
+// execFCallRo fcall_ro function numkeys [key [key ...]] [arg [arg ...]]
+func execFCallRo(ctx context.Context, conn *Client) error {
+	return fcall(conn, true)
+}
+
+func fcall(conn *Client, readonly bool) error {
+	argNum := conn.GetArgNum()
+	if argNum < 2 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	f, ok := conn.Scripting.LookupFunction(string(conn.GetArgs()[0]))
+	if !ok {
+		return MakeStandardErrReply("ERR Function not found").WriteTo(conn)
+	}
+	keys, args, errReply := evalArgs(conn)
+	if errReply != nil {
+		return errReply.WriteTo(conn)
+	}
+	if readonly && f.flags&functionNoWrites == 0 {
+		return MakeStandardErrReply("ERR Can not execute a script with write flag using *_ro command.").WriteTo(conn)
+	}
+	return conn.Scripting.Call(conn, f, keys, args, readonly).WriteTo(conn)
+}
+
+// execFunction function load [REPLACE] code | delete library | flush [ASYNC|SYNC] | list [LIBRARYNAME pattern] [WITHCODE]
+// | dump | restore payload [FLUSH|APPEND|REPLACE] | stats | kill
+func execFunction(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "load":
+		if argNum != 2 && argNum != 3 {
+			return MakeNumberOfArgsErrReply("function|load").WriteTo(conn)
+		}
+		replace := false
+		if argNum == 3 {
+			if strings.ToLower(string(args[1])) != "replace" {
+				return MakeStandardErrReply("ERR Unknown option given: " + string(args[1])).WriteTo(conn)
+			}
+			replace = true
+		}
+		name, err := conn.Scripting.LoadLibrary(args[argNum-1], replace)
+		if err != nil {
+			return MakeStandardErrReply(err.Error()).WriteTo(conn)
+		}
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		return MakeBulkReply([]byte(name)).WriteTo(conn)
+	case "delete":
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("function|delete").WriteTo(conn)
+		}
+		if !conn.Scripting.DeleteLibrary(string(args[1])) {
+			return MakeStandardErrReply("ERR Library not found").WriteTo(conn)
+		}
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		return MakeOkReply().WriteTo(conn)
+	case "flush":
+		if argNum > 2 {
+			return MakeNumberOfArgsErrReply("function|flush").WriteTo(conn)
+		}
+		if argNum == 2 {
+			mode := strings.ToLower(string(args[1]))
+			if mode != "async" && mode != "sync" {
+				return MakeStandardErrReply("ERR FUNCTION FLUSH only supports SYNC|ASYNC option").WriteTo(conn)
+			}
+		}
+		conn.Scripting.FlushFunctions()
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		return MakeOkReply().WriteTo(conn)
+	case "list":
+		return functionList(conn, args[1:])
+	case "dump":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("function|dump").WriteTo(conn)
+		}
+		return MakeBulkReply(conn.Scripting.DumpFunctions()).WriteTo(conn)
+	case "restore":
+		if argNum != 2 && argNum != 3 {
+			return MakeNumberOfArgsErrReply("function|restore").WriteTo(conn)
+		}
+		policy := "append"
+		if argNum == 3 {
+			policy = strings.ToLower(string(args[2]))
+			if policy != "flush" && policy != "append" && policy != "replace" {
+				return MakeStandardErrReply("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.").WriteTo(conn)
+			}
+		}
+		if err := conn.Scripting.RestoreFunctions(args[1], policy); err != nil {
+			return MakeStandardErrReply(err.Error()).WriteTo(conn)
+		}
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		return MakeOkReply().WriteTo(conn)
+	case "stats":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("function|stats").WriteTo(conn)
+		}
+		return functionStats(conn.Scripting).WriteTo(conn)
+	case "kill":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("function|kill").WriteTo(conn)
+		}
+		return conn.Scripting.Kill().WriteTo(conn)
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "FUNCTION").WriteTo(conn)
+	}
+}
+
+// functionList function list [LIBRARYNAME pattern] [WITHCODE]
+func functionList(conn *Client, args [][]byte) error {
+	withCode := false
+	pattern := ""
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		if option == "withcode" && !withCode {
+			withCode = true
+		} else if option == "libraryname" && pattern == "" && i+1 < len(args) {
+			pattern = string(args[i+1])
+			i++
+		} else {
+			return MakeStandardErrReply("ERR Unknown argument " + string(args[i])).WriteTo(conn)
+		}
+	}
+	libraries := make([]Reply, 0)
+	for _, library := range conn.Scripting.Libraries() {
+		if pattern != "" && !util.GlobMatch(pattern, library.name) {
+			continue
+		}
+		libraries = append(libraries, libraryReply(library, withCode))
+	}
+	return MakeMultiRowReply(libraries).WriteTo(conn)
+}
+
+func libraryReply(library *functionLibrary, withCode bool) Reply {
+	functions := make([]Reply, 0, len(library.functions))
+	for _, f := range sortedFunctions(library) {
+		flags := make([]Reply, 0)
+		for _, item := range functionFlagNames {
+			if f.flags&item.flag != 0 {
+				flags = append(flags, MakeBulkReply([]byte(item.name)))
+			}
+		}
+		var description Reply = MakeNullBulkReply()
+		if f.description != "" {
+			description = MakeBulkReply([]byte(f.description))
+		}
+		functions = append(functions, MakeMapReply([]Reply{
+			MakeBulkReply([]byte("name")), MakeBulkReply([]byte(f.name)),
+			MakeBulkReply([]byte("description")), description,
+			MakeBulkReply([]byte("flags")), MakeMultiRowReply(flags),
+		}))
+	}
+	fields := []Reply{
+		MakeBulkReply([]byte("library_name")), MakeBulkReply([]byte(library.name)),
+		MakeBulkReply([]byte("engine")), MakeBulkReply([]byte("LUA")),
+		MakeBulkReply([]byte("functions")), MakeMultiRowReply(functions),
+	}
+	if withCode {
+		fields = append(fields, MakeBulkReply([]byte("library_code")), MakeBulkReply(library.code))
+	}
+	return MakeMapReply(fields)
+}
+
+// functionStats function stats
+func functionStats(s *Scripting) Reply {
+	var running Reply = MakeNullBulkReply()
+	if name, cmdLine, duration, ok := s.RunningScript(); ok {
+		running = MakeMapReply([]Reply{
+			MakeBulkReply([]byte("name")), MakeBulkReply([]byte(name)),
+			MakeBulkReply([]byte("command")), MakeMultiBulkReply(cmdLine),
+			MakeBulkReply([]byte("duration_ms")), MakeIntReply(duration),
+		})
+	}
+	libraries := s.Libraries()
+	functions := 0
+	for _, library := range libraries {
+		functions += len(library.functions)
+	}
+	return MakeMapReply([]Reply{
+		MakeBulkReply([]byte("running_script")), running,
+		MakeBulkReply([]byte("engines")), MakeMapReply([]Reply{
+			MakeBulkReply([]byte("LUA")), MakeMapReply([]Reply{
+				MakeBulkReply([]byte("libraries_count")), MakeIntReply(int64(len(libraries))),
+				MakeBulkReply([]byte("functions_count")), MakeIntReply(int64(functions)),
+			}),
+		}),
+	})
+}
+
+func init() {
+	register("fcall", execFCall, withArity(-3), withFlags(flagNoScript|flagMayReplicate), withKeyExtractor(numKeysExtractor(2)))
+	register("fcall_ro", execFCallRo, withArity(-3), withFlags(flagNoScript), withKeyExtractor(numKeysExtractor(2)))
+	register("function", execFunction, withArity(-2), withFlags(flagNoScript|flagMayReplicate))
+}
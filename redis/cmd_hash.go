@@ -2,7 +2,6 @@ package redis
 
 import (
 	"context"
-	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
 )
 
@@ -14,27 +13,31 @@ func hset(c context.Context, conn *Client) error {
 	args := conn.GetArgs()
 	key := string(args[0])
 	pairs := args[1:]
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if exists {
-		if redisObj.ObjType != obj.RedisHash {
-			return MakeWrongTypeErrReply().WriteTo(conn)
+		simpleDict, ok := redisObj.AsHash()
+		if !ok {
+			return MakeWrongTypeErr().WriteTo(conn)
 		}
 		var result int64 = 0
-		simpleDict := redisObj.Ptr.(*dict.SimpleDict)
 		for i := 0; i < len(pairs); i += 2 {
 			field, value := string(pairs[i]), pairs[i+1]
 			result += int64(simpleDict.Put(field, value))
 		}
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyHash, "hset", key)
 		return MakeIntReply(result).WriteTo(conn)
 	}
 	redisObj = obj.NewHashObject()
+	simpleDict, _ := redisObj.AsHash()
 	var result int64 = 0
 	for i := 0; i < len(pairs); i += 2 {
 		field, value := string(pairs[i]), pairs[i+1]
-		simpleDict := redisObj.Ptr.(*dict.SimpleDict)
 		result += int64(simpleDict.Put(field, value))
 	}
 	conn.GetDb().PutEntity(key, redisObj)
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyHash, "hset", key)
 	return MakeIntReply(result).WriteTo(conn)
 }
 
@@ -45,19 +48,52 @@ func hget(c context.Context, conn *Client) error {
 	}
 	args := conn.GetArgs()
 	key := string(args[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
 	if !exists {
 		return MakeNullBulkReply().WriteTo(conn)
 	}
+	simpleDict, ok := redisObj.AsHash()
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
 	field := string(args[1])
-	simpleDict := redisObj.Ptr.(*dict.SimpleDict)
 	if value, exists2 := simpleDict.Get(field); exists2 {
 		return MakeBulkReply(value.([]byte)).WriteTo(conn)
 	}
 	return MakeNullBulkReply().WriteTo(conn)
 }
 
+func hgetall(c context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum != 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	key := string(conn.GetArgs()[0])
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
+	if !exists {
+		return MakeMapReply(nil).WriteTo(conn)
+	}
+	simpleDict, ok := redisObj.AsHash()
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	if simpleDict.Len() > streamReplyThreshold {
+		return MakeStreamingMapReply(simpleDict.Len(), func(w *StreamWriter) {
+			simpleDict.ForEach(func(field string, value interface{}) bool {
+				return w.BulkString(field) && w.Bulk(value.([]byte))
+			})
+		}).WriteTo(conn)
+	}
+	pairs := make([]Reply, 0, simpleDict.Len()*2)
+	simpleDict.ForEach(func(field string, value interface{}) bool {
+		pairs = append(pairs, MakeBulkReply([]byte(field)), MakeBulkReply(value.([]byte)))
+		return true
+	})
+	return MakeMapReply(pairs).WriteTo(conn)
+}
+
 func init() {
-	register("hset", hset)
-	register("hget", hget)
+	register("hset", hset, withArity(-4, pairArgs(2)), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("hget", hget, withArity(3), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("hgetall", hgetall, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
 }
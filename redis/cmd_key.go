@@ -2,170 +2,210 @@ package redis
 
 import (
 	"context"
+	"errors"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/rdb"
 	"github.com/xuning888/godis-tiny/pkg/util"
 	"math"
-	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func execDel(ctx context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 {
-		// 错误参数
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
-	var deleted = 0
 	db := conn.GetDb()
-	for i := 0; i < len(cmdData); i++ {
-		result := db.Remove(string(cmdData[i]))
-		deleted += result
+	// UNLINK 总是在后台释放值, DEL 按照 lazyfree-lazy-user-del
+	lazy := conn.GetCmdName() == "unlink" || config.Properties.LazyfreeLazyUserDel
+	deleted := make([][]byte, 0, len(cmdData))
+	for _, arg := range cmdData {
+		key := string(arg)
+		// 过期的key按照过期删除(expired 事件和单独的 DEL), 不计入删除的个数.
+		// 从节点执行主节点的 DEL 和 UNLINK 时过期的key仍然可见(expireKeep), 总是删除. 读不出来的值同样删除
+		if _, exists, err := db.lookupKeyWrite(key); !exists && err == nil {
+			continue
+		}
+		if db.Delete(key, lazy) > 0 {
+			db.Notify(notifyGeneric, "del", key)
+			deleted = append(deleted, arg)
+		}
 	}
-	if deleted > 0 {
-		conn.GetDb().AddAof(conn.GetCmdLine())
-		return MakeIntReply(int64(deleted)).WriteTo(conn)
+	if len(deleted) > 0 {
+		// 只传播实际删除的key, 重放时删除的个数相同
+		db.Propagate(util.ToCmdLine2(string(conn.GetCmdLine()[0]), deleted))
 	}
-	return MakeIntReply(0).WriteTo(conn)
+	return MakeIntReply(int64(len(deleted))).WriteTo(conn)
 }
 
 func execKeys(ctx context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	args := conn.GetArgs()
 	pattern := string(args[0])
-	_, err := path.Match(pattern, "")
-	if err != nil {
-		return MakeStandardErrReply("ERR invalid pattern").WriteTo(conn)
-	}
-	keys := conn.GetDb().Keys()
-	var matchedKeys [][]byte
+	db := conn.GetDb()
+	keys := db.Keys()
+	// 只记录匹配的 key 在 keys 中的下标, 不复制 key
+	var matched []int
 	if pattern == "*" {
-		matchedKeys = make([][]byte, 0, len(keys))
-	} else {
-		matchedKeys = make([][]byte, 0)
-	}
-	for _, key := range keys {
-		matched, _ := path.Match(pattern, key)
-		if matched {
-			matchedKeys = append(matchedKeys, []byte(key))
+		matched = make([]int, 0, len(keys))
+	}
+	for i, key := range keys {
+		if interrupted(ctx, i) {
+			return interruptedReply(ctx).WriteTo(conn)
+		}
+		// 与 redis 一样按字节匹配, key 中可以有 '/' 和任意字节
+		if !util.GlobMatch(pattern, key) {
+			continue
+		}
+		// 已经过期还没有被清理的key不返回
+		if _, exists := db.PeekEntity(key); exists {
+			matched = append(matched, i)
 		}
 	}
-	if len(matchedKeys) == 0 {
+	if len(matched) == 0 {
 		return MakeEmptyMultiBulkReply().WriteTo(conn)
 	}
-	return MakeMultiBulkReply(matchedKeys).WriteTo(conn)
+	return MakeStreamingArrayReply(len(matched), func(w *StreamWriter) {
+		for _, i := range matched {
+			if !w.BulkString(keys[i]) {
+				return
+			}
+		}
+	}).WriteTo(conn)
 }
 
-func execExists(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
-	keys := make([]string, argNum)
-	args := conn.GetArgs()
-	for i := 0; i < argNum; i++ {
-		keys[i] = string(args[i])
+// execRandomKey randomkey, db 为空时返回 nil
+func execRandomKey(ctx context.Context, conn *Client) error {
+	key, exists := conn.GetDb().RandomKey()
+	if !exists {
+		return MakeNullBulkReply().WriteTo(conn)
 	}
-	result := conn.GetDb().Exists(keys)
-	return MakeIntReply(result).WriteTo(conn)
+	return MakeBulkReply([]byte(key)).WriteTo(conn)
 }
 
-// execTTL ttl key
-func execTTL(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
-	cmdData := conn.GetArgs()
-	key := string(cmdData[0])
+// execExists exists key [key ...]
+func execExists(c context.Context, conn *Client) error {
 	db := conn.GetDb()
-	// key 不存在返回-2
-	_, ok := db.GetEntity(key)
-	if !ok {
-		return MakeIntReply(-2).WriteTo(conn)
-	}
-	// 没有设置过期时间返回-1
-	expired, exists := db.IsExpiredV1(key)
-	if !exists {
-		return MakeIntReply(-1).WriteTo(conn)
+	var result int64 = 0
+	// 与 redis 一样按参数计数, 重复的key出现几次计几次; 过期的key在查找时删除, 不计入
+	for _, arg := range conn.GetArgs() {
+		if _, ok := db.LookupKeyRead(string(arg)); ok {
+			result++
+		}
 	}
+	return MakeIntReply(result).WriteTo(conn)
+}
 
-	// 如果过期了，删除key,并且返回-2
-	if expired {
-		db.Remove(key)
-		return MakeIntReply(-2).WriteTo(conn)
+// 过期时间参数的单位
+const (
+	unitSeconds = iota
+	unitMilliseconds
+)
+
+// expireMillis 把过期时间参数转换为毫秒时间戳, basetime 是相对时间的起点(毫秒), 绝对时间为 0.
+// 与 redis 一样只检查换算成毫秒和加上 basetime 时是否溢出, 可以是负数和过去的时间
+func expireMillis(value int64, unit int, basetime int64) (int64, bool) {
+	if unit == unitSeconds {
+		if value > math.MaxInt64/1000 || value < math.MinInt64/1000 {
+			return 0, false
+		}
+		value *= 1000
+	}
+	if value > math.MaxInt64-basetime {
+		return 0, false
 	}
-	// 如果没有过期，计算ttl时间
-	expireTime := db.ExpiredAt(key)
-	// ttl
-	remainingTime := expireTime.Sub(time.Now())
-	seconds := remainingTime.Seconds()
-	return MakeIntReply(int64(math.Round(seconds))).WriteTo(conn)
+	return value + basetime, true
 }
 
-func execPTTL(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+// remainingTTL key 剩余的毫秒数, key 不存在时返回 -2, 没有过期时间返回 -1.
+// 与 redis 一样按照毫秒计算, 过期时间就是当前这一毫秒的 key 仍然存在, 剩余 0
+func remainingTTL(db *DB, key string) int64 {
+	if _, ok := db.LookupKeyRead(key); !ok {
+		return -2
 	}
-	cmdData := conn.GetArgs()
-	key := string(cmdData[0])
-	db := conn.GetDb()
-	// key 不存在返回-2
-	_, ok := db.GetEntity(key)
-	if !ok {
-		return MakeIntReply(-2).WriteTo(conn)
-	}
-	// 没有设置过期时间返回-1
 	expired, exists := db.IsExpiredV1(key)
 	if !exists {
-		return MakeIntReply(-1).WriteTo(conn)
+		return -1
 	}
-
-	// 如果过期了，删除key,并且返回-2
+	// 过期的key已经在 LookupKeyRead 中处理, 这里只会是从节点上还没有删除的key
 	if expired {
-		db.Remove(key)
-		return MakeIntReply(-2).WriteTo(conn)
+		return -2
 	}
-
-	expireTime := db.ExpiredAt(key)
-	remainingTime := expireTime.Sub(time.Now())
-	microseconds := remainingTime.Milliseconds()
-	return MakeIntReply(int64(math.Round(float64(microseconds)))).WriteTo(conn)
+	ttl := db.ExpiredAt(key).UnixMilli() - db.clock.Now().UnixMilli()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl
 }
 
-// execExpire expire key ttl
-func execExpire(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 2 || argNum > 2 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+// execTTL ttl key, 剩余的秒数四舍五入
+func execTTL(c context.Context, conn *Client) error {
+	ttl := remainingTTL(conn.GetDb(), string(conn.GetArgs()[0]))
+	if ttl < 0 {
+		return MakeIntReply(ttl).WriteTo(conn)
 	}
-	cmdData := conn.GetArgs()
-	key := string(cmdData[0])
-	ttl, err := strconv.ParseInt(string(cmdData[1]), 10, 64)
-	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+	return MakeIntReply((ttl + 500) / 1000).WriteTo(conn)
+}
+
+// execPTTL pttl key
+func execPTTL(c context.Context, conn *Client) error {
+	return MakeIntReply(remainingTTL(conn.GetDb(), string(conn.GetArgs()[0]))).WriteTo(conn)
+}
+
+// expireGeneric EXPIRE, PEXPIRE, EXPIREAT, PEXPIREAT. 过期时间不晚于当前时间时主节点立即删除key并回复1,
+// 传播为 DEL(lazyfree-lazy-expire 时 UNLINK); 加载数据和从节点执行主节点的命令时照常设置过期时间.
+// 其他情况传播为 PEXPIREAT, 重放时不受执行时间的影响
+func expireGeneric(conn *Client, unit int, relative bool) error {
+	args := conn.GetArgs()
+	key := string(args[0])
+	value, _ := strconv.ParseInt(string(args[1]), 10, 64)
+	db := conn.GetDb()
+	var basetime int64
+	if relative {
+		basetime = db.clock.Now().UnixMilli()
 	}
-	_, ok := conn.GetDb().GetEntity(key)
+	when, ok := expireMillis(value, unit, basetime)
 	if !ok {
-		// key 不存在返回0
+		return MakeInvalidExpireTimeErr(conn.GetCmdName()).WriteTo(conn)
+	}
+	if _, exists := db.LookupKeyWrite(key); !exists {
 		return MakeIntReply(0).WriteTo(conn)
 	}
-	expireTime := time.Now().Add(time.Duration(ttl) * time.Second)
-	conn.GetDb().ExpireV1(key, expireTime)
-	conn.GetDb().AddAof(util.MakeExpireCmd(key, expireTime))
+	if when <= db.clock.Now().UnixMilli() && db.ExpirePolicy() == expireDelete {
+		lazy := config.Properties.LazyfreeLazyExpire
+		db.Delete(key, lazy)
+		db.propagateDeletion(key, lazy)
+		db.Notify(notifyGeneric, "del", key)
+		return MakeIntReply(1).WriteTo(conn)
+	}
+	expireTime := time.UnixMilli(when)
+	db.ExpireV1(key, expireTime)
+	db.Propagate(util.MakeExpireCmd(key, expireTime))
+	db.Notify(notifyGeneric, "expire", key)
 	return MakeIntReply(1).WriteTo(conn)
 }
 
+// execExpire expire key seconds
+func execExpire(c context.Context, conn *Client) error {
+	return expireGeneric(conn, unitSeconds, true)
+}
+
+// execPExpire pexpire key milliseconds
+func execPExpire(c context.Context, conn *Client) error {
+	return expireGeneric(conn, unitMilliseconds, true)
+}
+
+// execExpireAt expireat key unix-time-seconds
+func execExpireAt(c context.Context, conn *Client) error {
+	return expireGeneric(conn, unitSeconds, false)
+}
+
+// execPExpireAt pexpireat key unix-time-milliseconds
+func execPExpireAt(c context.Context, conn *Client) error {
+	return expireGeneric(conn, unitMilliseconds, false)
+}
+
 // execPersist persist key 移除key的过期时间
 func execPersist(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
 	expired, exists := conn.GetDb().IsExpiredV1(key)
@@ -180,40 +220,159 @@ func execPersist(c context.Context, conn *Client) error {
 	// key 存在，并且没有过期，就移除他的ttl
 	conn.GetDb().RemoveTTLV1(key)
 	// add aof
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyGeneric, "persist", key)
 	return MakeIntReply(1).WriteTo(conn)
 }
 
-// execExpireAt expireat key unix-time-seconds
-func execExpireAt(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 2 || argNum > 2 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+// execDump dump key, 返回和 redis 兼容的序列化格式
+func execDump(c context.Context, conn *Client) error {
+	entity, exists := conn.GetDb().LookupKeyRead(string(conn.GetArgs()[0]))
+	if !exists {
+		return MakeNullBulkReply().WriteTo(conn)
 	}
-	cmdData := conn.GetArgs()
-	key := string(cmdData[0])
-	timestamp, err := strconv.ParseInt(string(cmdData[1]), 10, 64)
+	payload, err := rdb.DumpValue(entity)
+	if err != nil {
+		return MakeStandardErrReply("ERR " + err.Error()).WriteTo(conn)
+	}
+	return MakeBulkReply(payload).WriteTo(conn)
+}
+
+// execRestore restore key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func execRestore(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	key := string(args[0])
+	replace, absTTL := false, false
+	var idleTime, freq int64 = -1, -1
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			if i+1 >= len(args) {
+				return MakeSyntaxErr().WriteTo(conn)
+			}
+			value, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if option == "IDLETIME" && (err != nil || value < 0) {
+				return MakeStandardErrReply("ERR Invalid IDLETIME value, must be >= 0").WriteTo(conn)
+			}
+			if option == "FREQ" && (err != nil || value < 0 || value > 255) {
+				return MakeStandardErrReply("ERR Invalid FREQ value, must be >= 0 and <= 255").WriteTo(conn)
+			}
+			if option == "IDLETIME" {
+				idleTime = value
+			} else {
+				freq = value
+			}
+			i++
+		default:
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+	}
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+		return MakeNotIntegerErr().WriteTo(conn)
+	}
+	if ttl < 0 {
+		return MakeStandardErrReply("ERR Invalid TTL value, must be >= 0").WriteTo(conn)
+	}
+	db := conn.GetDb()
+	if _, exists := db.LookupKeyWrite(key); exists && !replace {
+		return MakeBusyKeyErr().WriteTo(conn)
+	}
+	value, err := rdb.RestoreValue(args[2])
+	if err != nil {
+		if errors.Is(err, rdb.ErrDumpPayload) {
+			return MakeStandardErrReply("ERR " + err.Error()).WriteTo(conn)
+		}
+		return MakeStandardErrReply("ERR Bad data format").WriteTo(conn)
+	}
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.UnixMilli(ttl)
+		} else {
+			expireAt = db.clock.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		// 已经过期的时候只删除原来的key
+		if !expireAt.After(db.clock.Now()) {
+			if db.Remove(key) > 0 {
+				db.Propagate(util.ToCmdLine("del", key))
+				db.Notify(notifyGeneric, "del", key)
+			}
+			return MakeOkReply().WriteTo(conn)
+		}
+	}
+	// 与 redis 一致, 只使用和当前策略对应的一个
+	if idleTime >= 0 && !obj.LFUEnabled() {
+		value.LRU = uint32(int64(obj.LRUClock())-idleTime) & obj.LRUClockMax
+	}
+	if freq >= 0 && obj.LFUEnabled() {
+		obj.SetLFUFreq(value, uint8(freq))
+	}
+	db.Remove(key)
+	db.PutEntity(key, value)
+	// 过期时间转换为 pexpireat 写入aof, 重放时不受加载时间的影响
+	db.Propagate([][]byte{[]byte("restore"), args[0], []byte("0"), args[2], []byte("REPLACE")})
+	if ttl > 0 {
+		db.ExpireV1(key, expireAt)
+		db.Propagate(util.MakeExpireCmd(key, expireAt))
 	}
-	_, exists := conn.GetDb().GetEntity(key)
+	db.Notify(notifyGeneric, "restore", key)
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execObject object freq|idletime|refcount key, 不更新key的访问信息
+func execObject(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	subCommand := strings.ToLower(string(args[0]))
+	if subCommand != "freq" && subCommand != "idletime" && subCommand != "refcount" && subCommand != "encoding" {
+		return MakeUnknownSubcommandErr(string(args[0]), "OBJECT").WriteTo(conn)
+	}
+	value, exists := conn.GetDb().PeekEntity(string(args[1]))
 	if !exists {
-		return MakeIntReply(0).WriteTo(conn)
+		return MakeNullBulkReply().WriteTo(conn)
 	}
-	expireTime := time.Unix(timestamp, 0)
-	conn.GetDb().ExpireV1(key, expireTime)
-	// add aof
-	conn.GetDb().AddAof(conn.GetCmdLine())
-	return MakeIntReply(1).WriteTo(conn)
+	if subCommand == "encoding" {
+		return MakeBulkReply([]byte(obj.EncodingTypeName(value.Encoding))).WriteTo(conn)
+	}
+	if subCommand == "refcount" {
+		if obj.IsShared(value) {
+			return MakeIntReply(sharedObjectRefCount).WriteTo(conn)
+		}
+		return MakeIntReply(1).WriteTo(conn)
+	}
+	if subCommand == "freq" {
+		if !obj.LFUEnabled() {
+			return MakeStandardErrReply("ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.").WriteTo(conn)
+		}
+		return MakeIntReply(int64(obj.LFUFreq(value, config.Properties.LfuDecayTime))).WriteTo(conn)
+	}
+	if obj.LFUEnabled() {
+		return MakeStandardErrReply("ERR An LFU maxmemory policy is selected, idle time not tracked. " +
+			"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.").WriteTo(conn)
+	}
+	return MakeIntReply(obj.IdleTime(value)).WriteTo(conn)
 }
 
 func init() {
-	register("del", execDel)
-	register("keys", execKeys)
-	register("exists", execExists)
-	register("ttl", execTTL)
-	register("pttl", execPTTL)
-	register("expire", execExpire)
-	register("persist", execPersist)
-	register("expireat", execExpireAt)
+	register("del", execDel, withArity(-2), withFlags(flagWrite|flagNoLoad), withKeys(1, -1, 1))
+	register("unlink", execDel, withArity(-2), withFlags(flagWrite|flagNoLoad), withKeys(1, -1, 1))
+	register("keys", execKeys, withArity(2), withFlags(flagReadonly))
+	register("randomkey", execRandomKey, withArity(1), withFlags(flagReadonly))
+	register("exists", execExists, withArity(-2), withFlags(flagReadonly), withKeys(1, -1, 1))
+	register("ttl", execTTL, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("pttl", execPTTL, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("expire", execExpire, withArity(3, intArgs(2)), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("pexpire", execPExpire, withArity(3, intArgs(2)), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("persist", execPersist, withArity(2), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("expireat", execExpireAt, withArity(3, intArgs(2)), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("pexpireat", execPExpireAt, withArity(3, intArgs(2)), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("dump", execDump, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("restore", execRestore, withArity(-4), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("object", execObject, withArity(3), withFlags(flagReadonly), withKeys(2, 2, 1))
 }
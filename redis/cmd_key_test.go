@@ -0,0 +1,170 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeysPattern(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	for _, key := range []string{"a/b", "a\x00b", "a\r\nb", "a\xffb", "abc"} {
+		assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", key, "v"))
+	}
+	// 按字节匹配, '/', NUL 和不是 utf-8 的字节都是普通的字符
+	assert.Equal(t, "*1\r\n$3\r\na/b\r\n", server.exec(t, client, "keys", "a/*"))
+	assert.Equal(t, "*1\r\n$3\r\na\x00b\r\n", server.exec(t, client, "keys", "a\x00?"))
+	assert.Equal(t, "*1\r\n$4\r\na\r\nb\r\n", server.exec(t, client, "keys", "a\r\n*"))
+	assert.Equal(t, "*1\r\n$3\r\na\xffb\r\n", server.exec(t, client, "keys", "a[\xfe-\xff]b"))
+	// 与 redis 一样不完整的模式不是错误
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "keys", "a[b"))
+}
+
+func TestUnknownCommandArgs(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	// 错误中的换行替换为空格, 过长的参数被截断
+	long := string(make([]byte, 200))
+	reply := server.exec(t, client, "no\r\nsuch", "x\ny", long)
+	assert.Equal(t, "-ERR unknown command 'no  such', with args beginning with: 'x y', '"+long[:maxErrorArgLen]+"'\r\n", reply)
+}
+
+func TestDel(t *testing.T) {
+	clk := useManualClock(t)
+	server, file := newAofTestServer(t, FsyncNo)
+	defer setKeyspaceEvents("")
+	client, _ := server.newClient()
+	watcher, _ := server.newClient()
+	subscriber, subConn := server.newClient()
+	server.exec(t, client, "config", "set", "notify-keyspace-events", "gxE")
+	server.exec(t, subscriber, "subscribe", "__keyevent@0__:del", "__keyevent@0__:expired")
+	server.exec(t, watcher, "hello", "3")
+	server.exec(t, watcher, "client", "tracking", "on")
+
+	server.exec(t, client, "set", "str", "v")
+	server.exec(t, client, "rpush", "list", "a", "b")
+	server.exec(t, client, "sadd", "set", "a")
+	server.exec(t, client, "set", "expired", "v", "px", "1")
+	server.exec(t, watcher, "get", "str")
+	clk.Advance(5 * time.Millisecond)
+	takeAof(server, file)
+	subConn.take()
+
+	// 存在的不同类型的key都被删除, 不存在的, 过期的和重复的key不计入
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "del", "str", "missing", "expired", "list", "set", "str"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "keys", "*"))
+	// 过期的key单独传播 DEL, 之后的 DEL 只有实际删除的key
+	assert.Equal(t, resp([]string{"del", "expired"}, []string{"del", "str", "list", "set"}), takeAof(server, file))
+	message := func(channel, key string) string {
+		return "*3\r\n$7\r\nmessage\r\n$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"
+	}
+	assert.Equal(t, message("__keyevent@0__:expired", "expired")+message("__keyevent@0__:del", "str")+
+		message("__keyevent@0__:del", "list")+message("__keyevent@0__:del", "set"), subConn.take())
+	// 读取过的key被删除之后缓存失效
+	assert.Equal(t, invalidatePush("str")+"_\r\n", server.exec(t, watcher, "get", "str"))
+
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "del", "missing"))
+	assert.Equal(t, "", takeAof(server, file))
+}
+
+func TestExists(t *testing.T) {
+	clk := useManualClock(t)
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "k", "v")
+	server.exec(t, client, "set", "expired", "v", "px", "1")
+	clk.Advance(5 * time.Millisecond)
+	takeAof(server, file)
+
+	// 重复的key按出现的次数计数
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "exists", "k", "k", "k"))
+	// 同一个key出现在不存在的key前后都计数
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "exists", "k", "missing", "k"))
+	// 过期的key不计入, 查找时被删除
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "exists", "expired", "k", "expired"))
+	assert.Equal(t, "*1\r\n$1\r\nk\r\n", server.exec(t, client, "keys", "*"))
+	assert.Equal(t, resp([]string{"del", "expired"}), takeAof(server, file))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "missing"))
+}
+
+// bulkStrings 解析 KEYS 这样的回复中的所有元素
+func bulkStrings(t *testing.T, reply string) []string {
+	payload := <-DecodeInStream(strings.NewReader(reply))
+	assert.Nil(t, payload.Error)
+	result := make([]string, 0)
+	if multi, ok := payload.Data.(*MultiBulkReply); ok {
+		for _, arg := range multi.Args {
+			result = append(result, string(arg))
+		}
+	}
+	return result
+}
+
+func TestIterationSkipsExpired(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "randomkey"))
+	server.exec(t, client, "set", "live", "v")
+	server.exec(t, client, "set", "expired", "v", "px", "1")
+	clk.Advance(5 * time.Millisecond)
+	// 过期的key还在 db 中, KEYS 和 RANDOMKEY 都不返回
+	assert.Equal(t, "*1\r\n$4\r\nlive\r\n", server.exec(t, client, "keys", "*"))
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "$4\r\nlive\r\n", server.exec(t, client, "randomkey"))
+	}
+	server.exec(t, client, "del", "live")
+	server.exec(t, client, "set", "expired", "v", "px", "1")
+	clk.Advance(5 * time.Millisecond)
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "randomkey"))
+	assert.Equal(t, 0, server.dbs[0].Len())
+}
+
+// TestIterationStress 一个协程不停的写入, 删除和设置过期时间, 同时执行 KEYS 和 RANDOMKEY,
+// 同一次 KEYS 中的key不重复, 返回的都是写入过的key. 使用 -race 运行时检查数据竞争
+func TestIterationStress(t *testing.T) {
+	const keys = 50
+	server := newTestServer()
+	writer, _ := server.newClient()
+	reader, _ := server.newClient()
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 20; round++ {
+			for i := 0; i < keys; i++ {
+				n := strconv.Itoa(i)
+				server.exec(t, writer, "set", "str:"+n, strconv.Itoa(round))
+				server.exec(t, writer, "rpush", "list:"+n, n)
+				server.exec(t, writer, "set", "volatile:"+n, "v", "px", "1")
+				server.exec(t, writer, "del", "list:"+n)
+				server.exec(t, writer, "unlink", "str:"+strconv.Itoa((i+keys/2)%keys))
+			}
+		}
+		close(done)
+	}()
+	valid := regexp.MustCompile(`^(str|list|volatile):\d+$`)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		seen := make(map[string]bool)
+		for _, key := range bulkStrings(t, server.exec(t, reader, "keys", "*")) {
+			assert.False(t, seen[key], key)
+			seen[key] = true
+			assert.Regexp(t, valid, key)
+		}
+		if reply := server.exec(t, reader, "randomkey"); reply != "$-1\r\n" {
+			assert.Regexp(t, valid, bulkStrings(t, "*1\r\n"+reply)[0])
+		}
+	}
+	wg.Wait()
+}
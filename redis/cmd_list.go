@@ -7,6 +7,7 @@ import (
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
 	"github.com/xuning888/godis-tiny/pkg/util"
 	"strconv"
+	"strings"
 )
 
 func execLLen(c context.Context, conn *Client) error {
@@ -16,14 +17,14 @@ func execLLen(c context.Context, conn *Client) error {
 	}
 	args := conn.GetArgs()
 	key := string(args[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
 	if !exists {
 		return MakeIntReply(0).WriteTo(conn)
 	}
-	if redisObj.ObjType != obj.RedisList {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	dequeue, ok := redisObj.AsList()
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
-	dequeue := redisObj.Ptr.(list.Dequeue)
 	return MakeIntReply(int64(dequeue.Len())).WriteTo(conn)
 }
 
@@ -34,18 +35,18 @@ func execLIndex(c context.Context, conn *Client) error {
 	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
 	if !exists {
 		return MakeNullBulkReply().WriteTo(conn)
 	}
 
-	dequeue, ok := redisObj.Ptr.(list.Dequeue)
+	dequeue, ok := redisObj.AsList()
 	if !ok {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	index, err := strconv.ParseInt(string(cmdData[1]), 10, 64)
 	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
 	if index < 0 {
 		index = int64(dequeue.Len()) + index
@@ -64,12 +65,12 @@ func execLPush(c context.Context, conn *Client) error {
 	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if exists {
-		if redisObj.ObjType != obj.RedisList {
-			return MakeWrongTypeErrReply().WriteTo(conn)
+		dequeue, ok := redisObj.AsList()
+		if !ok {
+			return MakeWrongTypeErr().WriteTo(conn)
 		}
-		dequeue := redisObj.Ptr.(list.Dequeue)
 		var err error
 		var curIdx = 0
 		for idx, value := range cmdData[1:] {
@@ -80,15 +81,17 @@ func execLPush(c context.Context, conn *Client) error {
 			curIdx = idx
 		}
 		if err != nil && errors.Is(err, list.ErrorOutOfCapacity) {
-			conn.GetDb().AddAof(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+			conn.GetDb().Propagate(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+			conn.GetDb().Notify(notifyList, "lpush", key)
 			return MakeStandardErrReply("ERR list is full").WriteTo(conn)
 		}
-		conn.GetDb().AddAof(conn.GetCmdLine())
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyList, "lpush", key)
 		length := dequeue.Len()
 		return MakeIntReply(int64(length)).WriteTo(conn)
 	}
 	redisObj = obj.NewListObject()
-	dequeue := redisObj.Ptr.(list.Dequeue)
+	dequeue, _ := redisObj.AsList()
 	var err error
 	var curIdx = 0
 	for idx, value := range cmdData[1:] {
@@ -100,10 +103,12 @@ func execLPush(c context.Context, conn *Client) error {
 	}
 	conn.GetDb().PutEntity(key, redisObj)
 	if err != nil && errors.Is(err, list.ErrorOutOfCapacity) {
-		conn.GetDb().AddAof(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+		conn.GetDb().Propagate(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+		conn.GetDb().Notify(notifyList, "lpush", key)
 		return MakeStandardErrReply("ERR list is full").WriteTo(conn)
 	}
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyList, "lpush", key)
 	length := dequeue.Len()
 	return MakeIntReply(int64(length)).WriteTo(conn)
 }
@@ -116,7 +121,7 @@ func execLPop(c context.Context, conn *Client) error {
 	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if !exists {
 		return MakeNullBulkReply().WriteTo(conn)
 	}
@@ -125,12 +130,12 @@ func execLPop(c context.Context, conn *Client) error {
 	if argNum > 1 {
 		count, err = strconv.ParseInt(string(cmdData[1]), 10, 64)
 		if err != nil {
-			return MakeOutOfRangeOrNotInt().WriteTo(conn)
+			return MakeNotIntegerErr().WriteTo(conn)
 		}
 	}
-	dequeue, ok := redisObj.Ptr.(list.Dequeue)
+	dequeue, ok := redisObj.AsList()
 	if !ok {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	if count > 0 {
 		ccap := util.MinInt64(int64(dequeue.Len()), count)
@@ -147,11 +152,13 @@ func execLPop(c context.Context, conn *Client) error {
 				return err4
 			}
 		}
+		// aof
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyList, "lpop", key)
 		if dequeue.Len() == 0 {
 			conn.GetDb().Remove(key)
+			conn.GetDb().Notify(notifyGeneric, "del", key)
 		}
-		// aof
-		conn.GetDb().AddAof(conn.GetCmdLine())
 		return conn.Flush()
 	} else if count == 0 {
 		return MakeEmptyMultiBulkReply().WriteTo(conn)
@@ -161,10 +168,12 @@ func execLPop(c context.Context, conn *Client) error {
 		conn.GetDb().Remove(key)
 		return MakeNullBulkReply().WriteTo(conn)
 	}
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyList, "lpop", key)
 	if dequeue.Len() == 0 {
 		conn.GetDb().Remove(key)
+		conn.GetDb().Notify(notifyGeneric, "del", key)
 	}
-	conn.GetDb().AddAof(conn.GetCmdLine())
 	return MakeBulkReply(pop.([]byte)).WriteTo(conn)
 }
 
@@ -178,20 +187,20 @@ func execLRange(c context.Context, conn *Client) error {
 	key := string(cmdData[0])
 	start, err := strconv.ParseInt(string(cmdData[1]), 10, 64)
 	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
 	end, err := strconv.ParseInt(string(cmdData[2]), 10, 64)
 	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
 	if !exists {
 		return MakeEmptyMultiBulkReply().WriteTo(conn)
 	}
 
-	dequeue, ok := redisObj.Ptr.(list.Dequeue)
+	dequeue, ok := redisObj.AsList()
 	if !ok {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	length := int64(dequeue.Len())
 	if start < 0 {
@@ -210,28 +219,17 @@ func execLRange(c context.Context, conn *Client) error {
 		return MakeEmptyMultiBulkReply().WriteTo(conn)
 	}
 
-	if err2 := MakeMultiBulkHeaderReply(end - start + 1).WriteTo(conn); err2 != nil {
-		return err2
-	}
-
-	var err3 error = nil
-	dequeue.ForEach(func(value interface{}, index int) bool {
-		if int64(index) < start {
-			return true
-		} else if int64(index) > end {
-			return false
-		}
-		if _, err3 = conn.Write(MakeBulkReply(value.([]byte)).ToBytes()); err3 != nil {
-			return false
-		}
-		return true
-	})
-
-	if err3 != nil {
-		_ = conn.Flush()
-		return err3
-	}
-	return conn.Flush()
+	// 元素逐个编码写入, 不拼接出完整的回复
+	return MakeStreamingArrayReply(int(end-start+1), func(w *StreamWriter) {
+		dequeue.ForEach(func(value interface{}, index int) bool {
+			if int64(index) < start {
+				return true
+			} else if int64(index) > end {
+				return false
+			}
+			return w.Bulk(value.([]byte))
+		})
+	}).WriteTo(conn)
 }
 
 func execRPush(c context.Context, conn *Client) error {
@@ -241,11 +239,11 @@ func execRPush(c context.Context, conn *Client) error {
 	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if exists {
-		dequeue, ok := redisObj.Ptr.(list.Dequeue)
+		dequeue, ok := redisObj.AsList()
 		if !ok {
-			return MakeWrongTypeErrReply().WriteTo(conn)
+			return MakeWrongTypeErr().WriteTo(conn)
 		}
 		var err error
 		var curIdx = 0
@@ -257,17 +255,19 @@ func execRPush(c context.Context, conn *Client) error {
 			curIdx = idx
 		}
 		if err != nil && errors.Is(err, list.ErrorOutOfCapacity) {
-			conn.GetDb().AddAof(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+			conn.GetDb().Propagate(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+			conn.GetDb().Notify(notifyList, "rpush", key)
 			return MakeStandardErrReply("ERR list is full").WriteTo(conn)
 		}
 		length := dequeue.Len()
 		// aof
-		conn.GetDb().AddAof(conn.GetCmdLine())
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyList, "rpush", key)
 		return MakeIntReply(int64(length)).WriteTo(conn)
 	}
 
 	redisObj = obj.NewListObject()
-	dequeue := redisObj.Ptr.(list.Dequeue)
+	dequeue, _ := redisObj.AsList()
 	var err error
 	var curIdx = 0
 	for idx, value := range cmdData[1:] {
@@ -279,12 +279,14 @@ func execRPush(c context.Context, conn *Client) error {
 	}
 	conn.GetDb().PutEntity(key, redisObj)
 	if err != nil && errors.Is(err, list.ErrorOutOfCapacity) {
-		conn.GetDb().AddAof(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+		conn.GetDb().Propagate(util.ToCmdLine2(key, cmdData[:curIdx+2]))
+		conn.GetDb().Notify(notifyList, "rpush", key)
 		return MakeStandardErrReply("ERR list is full").WriteTo(conn)
 	}
 	length := dequeue.Len()
 	// aof
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyList, "rpush", key)
 	return MakeIntReply(int64(length)).WriteTo(conn)
 }
 
@@ -296,7 +298,7 @@ func execRPop(c context.Context, conn *Client) error {
 	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if !exists {
 		return MakeNullBulkReply().WriteTo(conn)
 	}
@@ -305,12 +307,12 @@ func execRPop(c context.Context, conn *Client) error {
 	if argNum > 1 {
 		count, err = strconv.ParseInt(string(cmdData[1]), 10, 64)
 		if err != nil {
-			return MakeOutOfRangeOrNotInt().WriteTo(conn)
+			return MakeNotIntegerErr().WriteTo(conn)
 		}
 	}
-	dequeue, ok := redisObj.Ptr.(list.Dequeue)
+	dequeue, ok := redisObj.AsList()
 	if !ok {
-		return MakeWrongTypeErrReply()
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	if count > 0 {
 		ccap := util.MinInt64(count, int64(dequeue.Len()))
@@ -327,10 +329,12 @@ func execRPop(c context.Context, conn *Client) error {
 				return err4
 			}
 		}
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyList, "rpop", key)
 		if dequeue.Len() == 0 {
 			conn.GetDb().Remove(key)
+			conn.GetDb().Notify(notifyGeneric, "del", key)
 		}
-		conn.GetDb().AddAof(conn.GetCmdLine())
 		return conn.Flush()
 	}
 
@@ -339,19 +343,230 @@ func execRPop(c context.Context, conn *Client) error {
 		conn.GetDb().Remove(key)
 		return MakeNullBulkReply().WriteTo(conn)
 	}
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyList, "rpop", key)
 	if dequeue.Len() == 0 {
 		conn.GetDb().Remove(key)
+		conn.GetDb().Notify(notifyGeneric, "del", key)
 	}
-	conn.GetDb().AddAof(conn.GetCmdLine())
 	return MakeBulkReply(pop.([]byte)).WriteTo(conn)
 }
 
+// execBLPop blpop key [key ...] timeout
+func execBLPop(c context.Context, conn *Client) error {
+	return blockingPop(conn, true)
+}
+
+// execBRPop brpop key [key ...] timeout
+func execBRPop(c context.Context, conn *Client) error {
+	return blockingPop(conn, false)
+}
+
+// blockingPop 从第一个非空的 list 中弹出元素, 回复 key 和元素. 都为空时阻塞, 直到其中一个 key 写入了元素或者超时
+func blockingPop(conn *Client, left bool) error {
+	args := conn.GetArgs()
+	timeout, errReply := parseBlockTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply.WriteTo(conn)
+	}
+	db := conn.GetDb()
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		key := string(arg)
+		keys = append(keys, key)
+		redisObj, exists := db.LookupKeyWrite(key)
+		if !exists {
+			continue
+		}
+		dequeue, ok := redisObj.AsList()
+		if !ok {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		if value, popped := popBlocked(db, key, dequeue, left); popped {
+			return MakeMultiBulkReply([][]byte{arg, value}).WriteTo(conn)
+		}
+	}
+	state := &blockState{
+		kind:    blockedList,
+		dbIndex: db.Index,
+		keys:    keys,
+		serve: func(db *DB, key string, dequeue list.Dequeue) (Reply, bool) {
+			value, ok := popBlocked(db, key, dequeue, left)
+			if !ok {
+				return nil, false
+			}
+			return MakeMultiBulkReply([][]byte{[]byte(key), value}), true
+		},
+		onTimeout: func() Reply { return MakeNullMultiBulkReply() },
+	}
+	if timeout > 0 {
+		state.deadline = db.clock.Now().Add(timeout)
+	}
+	conn.Block(conn, state)
+	return nil
+}
+
+// parseListDirection LMOVE, BLMOVE 的 LEFT 或者 RIGHT
+func parseListDirection(arg []byte) (left bool, ok bool) {
+	switch strings.ToLower(string(arg)) {
+	case "left":
+		return true, true
+	case "right":
+		return false, true
+	}
+	return false, false
+}
+
+func listDirection(left bool) string {
+	if left {
+		return "left"
+	}
+	return "right"
+}
+
+// listMove 从 source 的一端弹出元素推入 destination 的一端, 回复移动的元素, 传播为 LMOVE.
+// destination 不是 list 时回复 WRONGTYPE, 不弹出元素. source 为空时返回 false
+func listMove(db *DB, src string, dequeue list.Dequeue, dst string, fromLeft, toLeft bool) (Reply, bool) {
+	if dstObj, exists := db.LookupKeyWrite(dst); exists {
+		if _, isList := dstObj.AsList(); !isList {
+			return MakeWrongTypeErr(), true
+		}
+	}
+	event := "rpop"
+	var value interface{}
+	var err error
+	if fromLeft {
+		event = "lpop"
+		value, err = dequeue.RemoveFirst()
+	} else {
+		value, err = dequeue.RemoveLast()
+	}
+	if err != nil {
+		return nil, false
+	}
+	db.Notify(notifyList, event, src)
+	if dequeue.Len() == 0 {
+		db.Remove(src)
+		db.Notify(notifyGeneric, "del", src)
+	}
+	// source 和 destination 相同并且弹出之后为空时 key 已经删除, 重新查找
+	dstObj, exists := db.LookupKeyWrite(dst)
+	if !exists {
+		dstObj = obj.NewListObject()
+	}
+	target, _ := dstObj.AsList()
+	event = "rpush"
+	if toLeft {
+		event = "lpush"
+		_ = target.AddFirst(value)
+	} else {
+		_ = target.AddLast(value)
+	}
+	if !exists {
+		db.PutEntity(dst, dstObj)
+	}
+	db.Notify(notifyList, event, dst)
+	db.Propagate(util.ToCmdLine("lmove", src, dst, listDirection(fromLeft), listDirection(toLeft)))
+	return MakeBulkReply(value.([]byte)), true
+}
+
+// moveGeneric 从 source 移动一个元素到 destination, source 不存在时回复空
+func moveGeneric(conn *Client, src, dst string, fromLeft, toLeft bool) error {
+	redisObj, exists := conn.GetDb().LookupKeyWrite(src)
+	if !exists {
+		return MakeNullBulkReply().WriteTo(conn)
+	}
+	dequeue, ok := redisObj.AsList()
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	reply, moved := listMove(conn.GetDb(), src, dequeue, dst, fromLeft, toLeft)
+	if !moved {
+		return MakeNullBulkReply().WriteTo(conn)
+	}
+	return reply.WriteTo(conn)
+}
+
+// execLMove lmove source destination LEFT|RIGHT LEFT|RIGHT
+func execLMove(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	fromLeft, ok := parseListDirection(args[2])
+	toLeft, ok2 := parseListDirection(args[3])
+	if !ok || !ok2 {
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	return moveGeneric(conn, string(args[0]), string(args[1]), fromLeft, toLeft)
+}
+
+// execRPopLPush rpoplpush source destination, 与 LMOVE source destination RIGHT LEFT 相同
+func execRPopLPush(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	return moveGeneric(conn, string(args[0]), string(args[1]), false, true)
+}
+
+// execBLMove blmove source destination LEFT|RIGHT LEFT|RIGHT timeout
+func execBLMove(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	fromLeft, ok := parseListDirection(args[2])
+	toLeft, ok2 := parseListDirection(args[3])
+	if !ok || !ok2 {
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	return blockingMove(conn, string(args[0]), string(args[1]), fromLeft, toLeft, args[4])
+}
+
+// execBRPopLPush brpoplpush source destination timeout
+func execBRPopLPush(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	return blockingMove(conn, string(args[0]), string(args[1]), false, true, args[2])
+}
+
+// blockingMove source 不为空时和 LMOVE 一样立即移动, 为空时阻塞, 直到 source 写入了元素或者超时(回复空).
+// 和 BLPOP 在 source 的同一个队列中按照阻塞的先后顺序唤醒
+func blockingMove(conn *Client, src, dst string, fromLeft, toLeft bool, timeoutArg []byte) error {
+	timeout, errReply := parseBlockTimeout(timeoutArg)
+	if errReply != nil {
+		return errReply.WriteTo(conn)
+	}
+	db := conn.GetDb()
+	if redisObj, exists := db.LookupKeyWrite(src); exists {
+		dequeue, ok := redisObj.AsList()
+		if !ok {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		if reply, moved := listMove(db, src, dequeue, dst, fromLeft, toLeft); moved {
+			return reply.WriteTo(conn)
+		}
+	}
+	state := &blockState{
+		kind:    blockedList,
+		dbIndex: db.Index,
+		keys:    []string{src},
+		serve: func(db *DB, key string, dequeue list.Dequeue) (Reply, bool) {
+			db.prepareKeys([]byte(dst))
+			return listMove(db, key, dequeue, dst, fromLeft, toLeft)
+		},
+		onTimeout: func() Reply { return MakeNullBulkReply() },
+	}
+	if timeout > 0 {
+		state.deadline = db.clock.Now().Add(timeout)
+	}
+	conn.Block(conn, state)
+	return nil
+}
+
 func init() {
-	register("lpush", execLPush)
-	register("lpop", execLPop)
-	register("lrange", execLRange)
-	register("rpush", execRPush)
-	register("llen", execLLen)
-	register("lindex", execLIndex)
-	register("rpop", execRPop)
+	register("lpush", execLPush, withArity(-3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("lpop", execLPop, withArity(-2), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("lrange", execLRange, withArity(4), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("rpush", execRPush, withArity(-3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("llen", execLLen, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("lindex", execLIndex, withArity(3), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("rpop", execRPop, withArity(-2), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("blpop", execBLPop, withArity(-3), withFlags(flagWrite|flagNoScript), withKeys(1, -2, 1))
+	register("brpop", execBRPop, withArity(-3), withFlags(flagWrite|flagNoScript), withKeys(1, -2, 1))
+	register("lmove", execLMove, withArity(5), withFlags(flagWrite|flagDenyOOM), withKeys(1, 2, 1))
+	register("rpoplpush", execRPopLPush, withArity(3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 2, 1))
+	register("blmove", execBLMove, withArity(6), withFlags(flagWrite|flagDenyOOM|flagNoScript), withKeys(1, 2, 1))
+	register("brpoplpush", execBRPopLPush, withArity(4), withFlags(flagWrite|flagDenyOOM|flagNoScript), withKeys(1, 2, 1))
 }
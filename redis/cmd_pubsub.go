@@ -0,0 +1,158 @@
+package redis
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// subscribeReply 订阅和取消订阅的回复, RESP3 中是push类型
+func subscribeReply(kind []byte, name []byte, count int) Reply {
+	return MakePushReply([]Reply{
+		MakeBulkReply(kind),
+		MakeBulkReply(name),
+		MakeIntReply(int64(count)),
+	})
+}
+
+// execSubscribe subscribe channel [channel ...]
+func execSubscribe(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	for _, channel := range conn.GetArgs() {
+		conn.PubSub.Subscribe(conn, string(channel))
+		if err := subscribeReply(subscribeBytes, channel, conn.SubscriptionCount()).WriteTo(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execUnsubscribe unsubscribe [channel [channel ...]]
+func execUnsubscribe(ctx context.Context, conn *Client) error {
+	channels := conn.GetArgs()
+	if len(channels) == 0 {
+		channels = sortedNames(conn.subChannels)
+	}
+	if len(channels) == 0 {
+		return subscribeReply(unsubscribeBytes, nil, conn.SubscriptionCount()).WriteTo(conn)
+	}
+	for _, channel := range channels {
+		conn.PubSub.Unsubscribe(conn, string(channel))
+		if err := subscribeReply(unsubscribeBytes, channel, conn.SubscriptionCount()).WriteTo(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execPSubscribe psubscribe pattern [pattern ...]
+func execPSubscribe(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	for _, pattern := range conn.GetArgs() {
+		conn.PubSub.PSubscribe(conn, string(pattern))
+		if err := subscribeReply(psubscribeBytes, pattern, conn.SubscriptionCount()).WriteTo(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execPUnsubscribe punsubscribe [pattern [pattern ...]]
+func execPUnsubscribe(ctx context.Context, conn *Client) error {
+	patterns := conn.GetArgs()
+	if len(patterns) == 0 {
+		patterns = sortedNames(conn.subPatterns)
+	}
+	if len(patterns) == 0 {
+		return subscribeReply(punsubscribeBytes, nil, conn.SubscriptionCount()).WriteTo(conn)
+	}
+	for _, pattern := range patterns {
+		conn.PubSub.PUnsubscribe(conn, string(pattern))
+		if err := subscribeReply(punsubscribeBytes, pattern, conn.SubscriptionCount()).WriteTo(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execPublish publish channel message
+func execPublish(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum != 2 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	receivers := conn.PubSub.Publish(string(args[0]), args[1])
+	return MakeIntReply(receivers).WriteTo(conn)
+}
+
+// execPubSub pubsub channels [pattern] | numsub [channel ...] | numpat
+func execPubSub(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "channels":
+		if argNum > 2 {
+			return MakeNumberOfArgsErrReply("pubsub|channels").WriteTo(conn)
+		}
+		pattern := ""
+		if argNum == 2 {
+			pattern = string(args[1])
+		}
+		channels := conn.PubSub.Channels(pattern)
+		sort.Strings(channels)
+		result := make([][]byte, 0, len(channels))
+		for _, channel := range channels {
+			result = append(result, []byte(channel))
+		}
+		if len(result) == 0 {
+			return MakeEmptyMultiBulkReply().WriteTo(conn)
+		}
+		return MakeMultiBulkReply(result).WriteTo(conn)
+	case "numsub":
+		replies := make([]Reply, 0, 2*(argNum-1))
+		for _, channel := range args[1:] {
+			replies = append(replies, MakeBulkReply(channel), MakeIntReply(int64(conn.PubSub.NumSub(string(channel)))))
+		}
+		return MakeMultiRowReply(replies).WriteTo(conn)
+	case "numpat":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("pubsub|numpat").WriteTo(conn)
+		}
+		return MakeIntReply(int64(conn.PubSub.NumPat())).WriteTo(conn)
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "PUBSUB").WriteTo(conn)
+	}
+}
+
+func sortedNames(names map[string]struct{}) [][]byte {
+	keys := make([]string, 0, len(names))
+	for name := range names {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, []byte(key))
+	}
+	return result
+}
+
+func init() {
+	register("subscribe", execSubscribe, withArity(-2), withFlags(flagNoScript))
+	register("unsubscribe", execUnsubscribe, withArity(-1), withFlags(flagNoScript))
+	register("psubscribe", execPSubscribe, withArity(-2), withFlags(flagNoScript))
+	register("punsubscribe", execPUnsubscribe, withArity(-1), withFlags(flagNoScript))
+	register("publish", execPublish, withArity(3))
+	register("pubsub", execPubSub, withArity(-2))
+}
@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// execSave save
+func execSave(ctx context.Context, conn *Client) error {
+	if conn.GetArgNum() != 0 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	if err := conn.Persister.SaveRdb(); err != nil {
+		return saveErrReply(err).WriteTo(conn)
+	}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execBgSave bgsave [schedule]
+func execBgSave(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum > 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	if argNum == 1 && strings.ToLower(string(conn.GetArgs()[0])) != "schedule" {
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	if err := conn.Persister.BgSaveRdb(); err != nil {
+		return saveErrReply(err).WriteTo(conn)
+	}
+	return MakeSimpleReply([]byte("Background saving started")).WriteTo(conn)
+}
+
+func saveErrReply(err error) Reply {
+	if errors.Is(err, ErrBgSaveInProgress) {
+		return MakeStandardErrReply(err.Error())
+	}
+	return MakeStandardErrReply("ERR " + err.Error())
+}
+
+// execLastSave lastsave
+func execLastSave(ctx context.Context, conn *Client) error {
+	if conn.GetArgNum() != 0 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	return MakeIntReply(conn.Persister.LastSave()).WriteTo(conn)
+}
+
+func init() {
+	register("save", execSave, withArity(1), withFlags(flagNoScript|flagAdmin))
+	register("bgsave", execBgSave, withArity(-1), withFlags(flagNoScript|flagAdmin))
+	register("lastsave", execLastSave, withArity(1))
+}
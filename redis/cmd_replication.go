@@ -0,0 +1,206 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execReplicaOf replicaof host port | replicaof no one
+func execReplicaOf(ctx context.Context, conn *Client) error {
+	if conn.GetArgNum() != 2 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	// 从节点的复制连接不能修改主节点
+	if conn.repl != nil {
+		return MakeStandardErrReply("ERR Command is not valid when client is a replica.").WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	host := string(args[0])
+	if strings.ToLower(host) == "no" && strings.ToLower(string(args[1])) == "one" {
+		conn.Replication.ReplicaOfNoOne()
+		return MakeOkReply().WriteTo(conn)
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port < 0 || port > 65535 {
+		return MakeStandardErrReply("ERR Invalid master port").WriteTo(conn)
+	}
+	if !conn.Replication.ReplicaOf(host, port) {
+		return MakeSimpleReply([]byte("OK Already connected to specified master")).WriteTo(conn)
+	}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execReplConf replconf listening-port port | capa capability | ack offset | getack *
+func execReplConf(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum == 0 || argNum%2 != 0 {
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	for i := 0; i < argNum; i += 2 {
+		option, value := strings.ToLower(string(args[i])), string(args[i+1])
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return MakeNotIntegerErr().WriteTo(conn)
+			}
+			conn.Replication.replicaFor(conn).listeningPort = port
+		case "capa":
+			// 只支持带长度的 rdb, 忽略从节点的能力
+		case "ack":
+			// ACK 不需要回复
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				conn.Replication.ack(conn, offset)
+				conn.Replication.updateFailover()
+			}
+			return nil
+		case "getack":
+			// 主节点要求立即发送 ACK, 回复通过复制连接发送
+			if conn.master {
+				conn.Replication.ackMaster()
+			}
+			return nil
+		default:
+			return MakeStandardErrReply("ERR Unrecognized REPLCONF option: " + string(args[i])).WriteTo(conn)
+		}
+	}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execPsync psync replicationid offset [failover], offset 是从节点需要的下一个字节的偏移量.
+// 执行 FAILOVER 的主节点发送 PSYNC FAILOVER, 当前节点先提升为主节点, 然后和原来的主节点部分重同步
+func execPsync(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum != 2 && argNum != 3 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return MakeNotIntegerErr().WriteTo(conn)
+	}
+	replId := string(args[0])
+	if argNum == 3 {
+		if strings.ToLower(string(args[2])) != "failover" {
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+		if !conn.Replication.promoteForFailover(conn, replId) {
+			return MakeStandardErrReply("ERR PSYNC FAILOVER replid must match my replid.").WriteTo(conn)
+		}
+	}
+	return conn.Replication.sync(conn, true, replId, offset)
+}
+
+// execFailover failover [to host port [force]] [abort] [timeout milliseconds]
+func execFailover(ctx context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	var host string
+	var port int
+	var timeout int64
+	force, abort := false, false
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		moreArgs := len(args) - 1 - i
+		switch {
+		case option == "to" && moreArgs >= 2 && host == "":
+			value, err := strconv.Atoi(string(args[i+2]))
+			if err != nil || value < 0 || value > 65535 {
+				return MakeNotIntegerErr().WriteTo(conn)
+			}
+			host, port = string(args[i+1]), value
+			i += 2
+		case option == "timeout" && moreArgs >= 1 && timeout == 0:
+			value, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return MakeNotIntegerErr().WriteTo(conn)
+			}
+			if value <= 0 {
+				return MakeStandardErrReply("ERR FAILOVER timeout must be greater than 0").WriteTo(conn)
+			}
+			timeout = value
+			i++
+		case option == "force" && !force:
+			force = true
+		case option == "abort" && !abort:
+			abort = true
+		default:
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+	}
+	if abort {
+		if len(args) != 1 {
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+		if !conn.Replication.AbortFailover("Failover manually aborted") {
+			return MakeStandardErrReply("ERR No failover in progress.").WriteTo(conn)
+		}
+		return MakeOkReply().WriteTo(conn)
+	}
+	if force && (timeout == 0 || host == "") {
+		return MakeStandardErrReply("ERR FAILOVER with force option requires both a timeout and target HOST and IP.").WriteTo(conn)
+	}
+	return conn.Replication.Failover(host, port, force, time.Duration(timeout)*time.Millisecond).WriteTo(conn)
+}
+
+// execSync sync, 老版本的从节点使用, 不回复 FULLRESYNC
+func execSync(ctx context.Context, conn *Client) error {
+	if conn.GetArgNum() != 0 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	return conn.Replication.sync(conn, false, "?", -1)
+}
+
+// execWait wait numreplicas timeout, 等待之前的写命令被 numreplicas 个从节点确认, timeout 毫秒之后回复已经确认的个数, 0 表示一直等待
+func execWait(ctx context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return MakeNotIntegerErr().WriteTo(conn)
+	}
+	timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return MakeStandardErrReply("ERR timeout is not an integer or out of range").WriteTo(conn)
+	}
+	if timeout < 0 {
+		return MakeStandardErrReply("ERR timeout is negative").WriteTo(conn)
+	}
+	rp := conn.Replication
+	if rp.IsReplica() {
+		return MakeStandardErrReply("ERR WAIT cannot be used with replica instances. Please also note that since " +
+			"Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are " +
+			"just local and are not propagated.").WriteTo(conn)
+	}
+	offset := rp.Offset()
+	if acked := rp.ackedReplicas(offset); acked >= numReplicas {
+		return MakeIntReply(int64(acked)).WriteTo(conn)
+	}
+	state := &blockState{
+		kind:        blockedWait,
+		numReplicas: numReplicas,
+		offset:      offset,
+		onTimeout: func() Reply {
+			return MakeIntReply(int64(rp.ackedReplicas(offset)))
+		},
+	}
+	if timeout > 0 {
+		state.deadline = conn.GetDb().clock.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	conn.Block(conn, state)
+	// 从节点收到 GETACK 之后立即回复 ACK, 不用等待每秒一次的 ACK
+	rp.RequestAcks()
+	return nil
+}
+
+func init() {
+	register("replicaof", execReplicaOf, withArity(3), withFlags(flagNoScript|flagAdmin))
+	register("slaveof", execReplicaOf, withArity(3), withFlags(flagNoScript))
+	register("replconf", execReplConf, withArity(-3), withFlags(flagNoScript|flagAdmin))
+	register("psync", execPsync, withArity(-3), withFlags(flagNoScript|flagAdmin))
+	register("sync", execSync, withArity(1), withFlags(flagNoScript|flagAdmin))
+	register("failover", execFailover, withArity(-1), withFlags(flagNoScript|flagAdmin))
+	register("wait", execWait, withArity(3), withFlags(flagNoScript))
+}
@@ -0,0 +1,118 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// evalArgs 解析 numkeys key [key ...] arg [arg ...]
+func evalArgs(conn *Client) (keys [][]byte, args [][]byte, errReply Reply) {
+	cmdArgs := conn.GetArgs()
+	numKeys, err := strconv.Atoi(string(cmdArgs[1]))
+	if err != nil {
+		return nil, nil, MakeNotIntegerErr()
+	}
+	if numKeys < 0 {
+		return nil, nil, MakeStandardErrReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(cmdArgs)-2 {
+		return nil, nil, MakeStandardErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	return cmdArgs[2 : 2+numKeys], cmdArgs[2+numKeys:], nil
+}
+
+// execEval eval script numkeys [key [key ...]] [arg [arg ...]]
+func execEval(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 2 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	keys, args, errReply := evalArgs(conn)
+	if errReply != nil {
+		return errReply.WriteTo(conn)
+	}
+	sha, fn, err := conn.Scripting.Load(conn.GetArgs()[0])
+	if err != nil {
+		return MakeStandardErrReply(err.Error()).WriteTo(conn)
+	}
+	return conn.Scripting.Run(conn, sha, fn, keys, args).WriteTo(conn)
+}
+
+// execEvalSha evalsha sha1 numkeys [key [key ...]] [arg [arg ...]]
+func execEvalSha(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 2 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	keys, args, errReply := evalArgs(conn)
+	if errReply != nil {
+		return errReply.WriteTo(conn)
+	}
+	sha := string(conn.GetArgs()[0])
+	fn, ok := conn.Scripting.Lookup(sha)
+	if !ok {
+		return MakeNoScriptErr().WriteTo(conn)
+	}
+	return conn.Scripting.Run(conn, sha, fn, keys, args).WriteTo(conn)
+}
+
+// execScript script load script | exists sha1 [sha1 ...] | flush [ASYNC|SYNC] | kill
+func execScript(ctx context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "load":
+		if argNum != 2 {
+			return MakeNumberOfArgsErrReply("script|load").WriteTo(conn)
+		}
+		sha, _, err := conn.Scripting.Load(args[1])
+		if err != nil {
+			return MakeStandardErrReply(err.Error()).WriteTo(conn)
+		}
+		return MakeBulkReply([]byte(sha)).WriteTo(conn)
+	case "exists":
+		if argNum < 2 {
+			return MakeNumberOfArgsErrReply("script|exists").WriteTo(conn)
+		}
+		replies := make([]Reply, 0, argNum-1)
+		for _, sha := range args[1:] {
+			if _, ok := conn.Scripting.Lookup(string(sha)); ok {
+				replies = append(replies, MakeIntReply(1))
+			} else {
+				replies = append(replies, MakeIntReply(0))
+			}
+		}
+		return MakeMultiRowReply(replies).WriteTo(conn)
+	case "flush":
+		if argNum > 2 {
+			return MakeNumberOfArgsErrReply("script|flush").WriteTo(conn)
+		}
+		if argNum == 2 {
+			mode := strings.ToLower(string(args[1]))
+			if mode != "async" && mode != "sync" {
+				return MakeStandardErrReply("ERR SCRIPT FLUSH only support SYNC|ASYNC option").WriteTo(conn)
+			}
+		}
+		conn.Scripting.Flush()
+		return MakeOkReply().WriteTo(conn)
+	case "kill":
+		if argNum != 1 {
+			return MakeNumberOfArgsErrReply("script|kill").WriteTo(conn)
+		}
+		// 能够执行到这里说明当前没有脚本在执行, 执行中的脚本由 replyBusy 终止
+		return conn.Scripting.Kill().WriteTo(conn)
+	default:
+		return MakeUnknownSubcommandErr(string(args[0]), "SCRIPT").WriteTo(conn)
+	}
+}
+
+func init() {
+	register("eval", execEval, withArity(-3), withFlags(flagNoScript|flagMayReplicate), withKeyExtractor(numKeysExtractor(2)))
+	register("evalsha", execEvalSha, withArity(-3), withFlags(flagNoScript|flagMayReplicate), withKeyExtractor(numKeysExtractor(2)))
+	register("script", execScript, withArity(-2), withFlags(flagNoScript))
+}
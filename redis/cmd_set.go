@@ -2,10 +2,10 @@ package redis
 
 import (
 	"context"
-	"fmt"
-	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
-	"github.com/xuning888/godis-tiny/pkg/datastruct/intset"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"math"
+	"math/rand"
 	"strconv"
 )
 
@@ -15,43 +15,26 @@ func sadd(c context.Context, conn *Client) error {
 		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 	}
 	key := string(conn.GetArgs()[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if exists {
 		var result int64 = 0
-		if redisObj.ObjType != obj.RedisSet {
-			return MakeWrongTypeErrReply().WriteTo(conn)
-		}
-		members := conn.GetArgs()[1:]
-		for idx, member := range members {
-			if redisObj.Encoding == obj.EncIntSet {
-				intSet := redisObj.Ptr.(*intset.IntSet)
-				number, err := strconv.ParseInt(string(member), 10, 64)
-				if err == nil {
-					result += intSet.Add(number)
-				} else {
-					// 转换编码格式
-					simpleDict := dict.MakeSimpleDict()
-					intSet.Range(func(index int, value int64) bool {
-						simpleDict.Put(fmt.Sprintf("%d", value), struct{}{})
-						return true
-					})
-					for _, mem := range members[idx:] {
-						result += int64(simpleDict.Put(string(mem), struct{}{}))
-					}
-					redisObj.Encoding = obj.EncHT
-					redisObj.Ptr = simpleDict
-					break
-				}
-			} else {
-				simpleDict := redisObj.Ptr.(*dict.SimpleDict)
-				result += int64(simpleDict.Put(string(member), struct{}{}))
-			}
+		if !isSet(redisObj) {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		for _, member := range conn.GetArgs()[1:] {
+			result += setAdd(conn.GetDb(), redisObj, member)
+		}
+		if result > 0 {
+			conn.GetDb().Propagate(conn.GetCmdLine())
+			conn.GetDb().Notify(notifySet, "sadd", key)
 		}
 		return MakeIntReply(result).WriteTo(conn)
 	}
 	var result int64
 	redisObj, result = obj.NewSetObject(conn.GetArgs()[1:])
 	conn.GetDb().PutEntity(key, redisObj)
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifySet, "sadd", key)
 	return MakeIntReply(result).WriteTo(conn)
 }
 
@@ -61,74 +44,293 @@ func smembers(c context.Context, conn *Client) error {
 		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 	}
 	key := string(conn.GetArgs()[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
 	if !exists {
-		return MakeEmptyMultiBulkReply().WriteTo(conn)
+		return MakeBulkSetReply(nil).WriteTo(conn)
 	}
-	if redisObj.ObjType != obj.RedisSet {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isSet(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
-	if redisObj.Encoding == obj.EncIntSet {
-		intSet := redisObj.Ptr.(*intset.IntSet)
-		if err := MakeMultiBulkHeaderReply(int64(intSet.Len())).WriteTo(conn); err != nil {
-			return err
-		}
-		var err error
-		intSet.Range(func(index int, value int64) bool {
-			err = MakeBulkReply([]byte(fmt.Sprintf("%d", value))).WriteTo(conn)
-			if err != nil {
-				return false
+	if size := setLen(redisObj); size > streamReplyThreshold {
+		return MakeStreamingSetReply(size, func(w *StreamWriter) {
+			setForEach(redisObj, w.BulkString)
+		}).WriteTo(conn)
+	}
+	members := make([][]byte, 0)
+	setForEach(redisObj, func(member string) bool {
+		members = append(members, []byte(member))
+		return true
+	})
+	return MakeBulkSetReply(members).WriteTo(conn)
+}
+
+func scard(c context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum != 1 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	key := string(conn.GetArgs()[0])
+	redisObj, exists := conn.GetDb().LookupKeyRead(key)
+	if !exists {
+		return MakeIntReply(0).WriteTo(conn)
+	}
+
+	if !isSet(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	return MakeIntReply(int64(setLen(redisObj))).WriteTo(conn)
+}
+
+// setAdd 向集合中添加一个元素, 添加了非整数或者元素个数超过 set-max-intset-entries 时 intset 转换为 hashtable.
+// 转换是单向的, 计入 INFO stats 的 encoding_conversions
+func setAdd(db *DB, redisObj *obj.RedisObject, member []byte) int64 {
+	if intSet, ok := redisObj.AsIntSet(); ok {
+		if number, ok := obj.ParseStringInt(member); ok {
+			added := intSet.Add(number)
+			if intSet.Len() > obj.MaxIntsetEntries() && obj.SetConvertToDict(redisObj) {
+				db.stats.encodingConverted(obj.RedisSet)
 			}
-			return true
-		})
-		if err != nil {
-			return err
+			return added
 		}
-	} else {
-		simpleDic := redisObj.Ptr.(*dict.SimpleDict)
-		if err := MakeMultiBulkHeaderReply(int64(simpleDic.Len())).WriteTo(conn); err != nil {
-			return err
-		}
-		var err error
-		simpleDic.ForEach(func(key string, val interface{}) bool {
-			err = MakeBulkReply([]byte(key)).WriteTo(conn)
-			if err != nil {
-				return false
-			}
-			return true
+		if obj.SetConvertToDict(redisObj) {
+			db.stats.encodingConverted(obj.RedisSet)
+		}
+	}
+	simpleDict, ok := redisObj.AsSetDict()
+	if !ok {
+		return 0
+	}
+	return int64(simpleDict.Put(string(member), struct{}{}))
+}
+
+// isSet 类型是集合, 并且值是 intset 或者 hashtable 编码
+func isSet(redisObj *obj.RedisObject) bool {
+	_, isIntSet := redisObj.AsIntSet()
+	_, isDict := redisObj.AsSetDict()
+	return isIntSet || isDict
+}
+
+// setRemove 删除集合中的一个元素
+func setRemove(redisObj *obj.RedisObject, member string) bool {
+	if intSet, ok := redisObj.AsIntSet(); ok {
+		number, ok := obj.ParseStringInt([]byte(member))
+		return ok && intSet.Remove(number)
+	}
+	if simpleDict, ok := redisObj.AsSetDict(); ok {
+		return simpleDict.Remove(member) > 0
+	}
+	return false
+}
+
+func setLen(redisObj *obj.RedisObject) int {
+	if intSet, ok := redisObj.AsIntSet(); ok {
+		return intSet.Len()
+	}
+	if simpleDict, ok := redisObj.AsSetDict(); ok {
+		return simpleDict.Len()
+	}
+	return 0
+}
+
+// setRandomMembers 随机选择 count 个不重复的元素
+func setRandomMembers(redisObj *obj.RedisObject, count int) []string {
+	if intSet, ok := redisObj.AsIntSet(); ok {
+		elements := intSet.Elements()
+		rand.Shuffle(len(elements), func(i, j int) {
+			elements[i], elements[j] = elements[j], elements[i]
 		})
-		if err != nil {
-			return err
+		if count > len(elements) {
+			count = len(elements)
+		}
+		members := make([]string, 0, count)
+		for _, value := range elements[:count] {
+			members = append(members, strconv.FormatInt(value, 10))
 		}
+		return members
+	}
+	if simpleDict, ok := redisObj.AsSetDict(); ok {
+		return simpleDict.RandomDistinctKeys(count)
 	}
 	return nil
 }
 
-func scard(c context.Context, conn *Client) error {
+// setRandomMembersWithReplacement 均匀地随机选择 count 个元素, 可能重复. intset 和哈希表都按照下标选择,
+// 每个元素 O(1), 哈希表第一次抽样时遍历一次建立下标, 见 SimpleDict.RandomKeysWithReplacement
+func setRandomMembersWithReplacement(redisObj *obj.RedisObject, count int) []string {
+	if intSet, ok := redisObj.AsIntSet(); ok {
+		members := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			value, _ := intSet.Get(rand.Intn(intSet.Len()))
+			members = append(members, strconv.FormatInt(value, 10))
+		}
+		return members
+	}
+	if simpleDict, ok := redisObj.AsSetDict(); ok {
+		return simpleDict.RandomKeysWithReplacement(count)
+	}
+	return nil
+}
+
+// srandmemberBatch 负数的 count 每次选择这么多个元素, 内存中最多只有这么多个还没有发送的元素
+const srandmemberBatch = 1024
+
+// srandmember key [count], count 为正数时返回不重复的元素, 负数时返回 -count 个可能重复的元素
+func srandmember(c context.Context, conn *Client) error {
 	argNum := conn.GetArgNum()
-	if argNum != 1 {
+	if argNum > 2 {
+		return MakeSyntaxErr().WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	redisObj, exists := conn.GetDb().LookupKeyRead(string(args[0]))
+	if exists && !isSet(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	if argNum == 1 {
+		if !exists {
+			return MakeNullBulkReply().WriteTo(conn)
+		}
+		return MakeBulkReply([]byte(setRandomMembers(redisObj, 1)[0])).WriteTo(conn)
+	}
+	count, _ := strconv.ParseInt(string(args[1]), 10, 64)
+	// 和 redis 一样限制负数的范围, 避免 -count 溢出
+	if count < -math.MaxInt64/2 {
+		return MakeStandardErrReply("ERR value is out of range").WriteTo(conn)
+	}
+	if !exists || count == 0 {
+		return MakeEmptyMultiBulkReply().WriteTo(conn)
+	}
+	if count > 0 {
+		members := setRandomMembers(redisObj, int(count))
+		result := make([][]byte, 0, len(members))
+		for _, member := range members {
+			result = append(result, []byte(member))
+		}
+		return MakeMultiBulkReply(result).WriteTo(conn)
+	}
+	total := int(-count)
+	if total <= streamReplyThreshold {
+		members := setRandomMembersWithReplacement(redisObj, total)
+		result := make([][]byte, 0, len(members))
+		for _, member := range members {
+			result = append(result, []byte(member))
+		}
+		return MakeMultiBulkReply(result).WriteTo(conn)
+	}
+	return MakeStreamingArrayReply(total, func(w *StreamWriter) {
+		for remaining := total; remaining > 0; {
+			n := srandmemberBatch
+			if n > remaining {
+				n = remaining
+			}
+			for _, member := range setRandomMembersWithReplacement(redisObj, n) {
+				if !w.BulkString(member) {
+					return
+				}
+			}
+			remaining -= n
+		}
+	}).WriteTo(conn)
+}
+
+// srem key member [member ...]
+func srem(c context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 2 {
 		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
 	}
+	db := conn.GetDb()
 	key := string(conn.GetArgs()[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := db.LookupKeyWrite(key)
 	if !exists {
 		return MakeIntReply(0).WriteTo(conn)
 	}
-
-	if redisObj.ObjType != obj.RedisSet {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isSet(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
+	var removed int64 = 0
+	for _, member := range conn.GetArgs()[1:] {
+		if setRemove(redisObj, string(member)) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		db.Propagate(conn.GetCmdLine())
+		db.Notify(notifySet, "srem", key)
+		if setLen(redisObj) == 0 {
+			db.Remove(key)
+			db.Notify(notifyGeneric, "del", key)
+		}
+	}
+	return MakeIntReply(removed).WriteTo(conn)
+}
+
+// spopBatchSize 和 redis 一样, SPOP count 每次最多用一条 SREM 删除这么多元素
+const spopBatchSize = 1024
 
-	if redisObj.Encoding == obj.EncIntSet {
-		intSet := redisObj.Ptr.(*intset.IntSet)
-		return MakeIntReply(int64(intSet.Len())).WriteTo(conn)
+// spop key [count], 随机的结果不能直接重放, 转换为 SREM 写入 aof 和复制流
+func spop(c context.Context, conn *Client) error {
+	argNum := conn.GetArgNum()
+	if argNum < 1 || argNum > 2 {
+		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
+	}
+	args := conn.GetArgs()
+	key := string(args[0])
+	count, withCount := 1, argNum == 2
+	if withCount {
+		num, err := strconv.Atoi(string(args[1]))
+		if err != nil || num < 0 {
+			return MakeStandardErrReply("ERR value is out of range, must be positive").WriteTo(conn)
+		}
+		count = num
+	}
+	db := conn.GetDb()
+	redisObj, exists := db.LookupKeyWrite(key)
+	if !exists {
+		if withCount {
+			return MakeEmptyMultiBulkReply().WriteTo(conn)
+		}
+		return MakeNullBulkReply().WriteTo(conn)
+	}
+	if !isSet(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	if count == 0 {
+		return MakeEmptyMultiBulkReply().WriteTo(conn)
+	}
+	members := setRandomMembers(redisObj, count)
+	for _, member := range members {
+		setRemove(redisObj, member)
+	}
+	db.Notify(notifySet, "spop", key)
+	if setLen(redisObj) == 0 {
+		// 弹出了所有的元素, 直接删除key
+		db.Remove(key)
+		db.Propagate(util.ToCmdLine("del", key))
+		db.Notify(notifyGeneric, "del", key)
+	} else {
+		for i := 0; i < len(members); i += spopBatchSize {
+			batch := members[i:]
+			if len(batch) > spopBatchSize {
+				batch = batch[:spopBatchSize]
+			}
+			db.Propagate(util.ToCmdLine("srem", append([]string{key}, batch...)...))
+		}
+	}
+	if !withCount {
+		return MakeBulkReply([]byte(members[0])).WriteTo(conn)
+	}
+	result := make([][]byte, 0, len(members))
+	for _, member := range members {
+		result = append(result, []byte(member))
 	}
-	simpleDict := redisObj.Ptr.(*dict.SimpleDict)
-	return MakeIntReply(int64(simpleDict.Len())).WriteTo(conn)
+	return MakeMultiBulkReply(result).WriteTo(conn)
 }
 
 func init() {
-	register("sadd", sadd)
-	register("smembers", smembers)
-	register("scard", scard)
+	register("sadd", sadd, withArity(-3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("smembers", smembers, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("scard", scard, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("srem", srem, withArity(-3), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("srandmember", srandmember, withArity(-2, intArgs(2)), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("spop", spop, withArity(-2), withFlags(flagWrite), withKeys(1, 1, 1))
 }
@@ -0,0 +1,278 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+)
+
+// setPresizeLimit SUNION 按照输入的基数之和预先分配结果, 输入有很多重复的元素时不分配超过这个大小
+const setPresizeLimit = 1 << 16
+
+// setScratchMaxLen 用完之后超过这个大小的临时 map 不再保留, 一次很大的 SUNIONSTORE 之后不会一直占用内存
+const setScratchMaxLen = 1 << 16
+
+// setScratch SUNIONSTORE 去重用的临时 map, 命令都在全局锁中执行, 只需要保留一个
+var setScratch map[string]struct{}
+
+func acquireSetScratch(stats *serverStats) map[string]struct{} {
+	if scratch := setScratch; scratch != nil {
+		setScratch = nil
+		stats.setScratchReuses.Add(1)
+		return scratch
+	}
+	return make(map[string]struct{})
+}
+
+func releaseSetScratch(scratch map[string]struct{}) {
+	if len(scratch) > setScratchMaxLen {
+		return
+	}
+	for member := range scratch {
+		delete(scratch, member)
+	}
+	setScratch = scratch
+}
+
+func setContains(redisObj *obj.RedisObject, member string) bool {
+	if intSet, ok := redisObj.AsIntSet(); ok {
+		number, ok := obj.ParseStringInt([]byte(member))
+		return ok && intSet.Contains(number)
+	}
+	if simpleDict, ok := redisObj.AsSetDict(); ok {
+		_, exists := simpleDict.Get(member)
+		return exists
+	}
+	return false
+}
+
+// setForEach 遍历集合的元素, fn 返回 false 时停止
+func setForEach(redisObj *obj.RedisObject, fn func(member string) bool) {
+	if intSet, ok := redisObj.AsIntSet(); ok {
+		intSet.Range(func(index int, value int64) bool {
+			return fn(strconv.FormatInt(value, 10))
+		})
+		return
+	}
+	if simpleDict, ok := redisObj.AsSetDict(); ok {
+		simpleDict.ForEach(func(key string, val interface{}) bool {
+			return fn(key)
+		})
+	}
+}
+
+// lookupSets 读取 keys 对应的集合, 不存在的 key 是 nil, 有不是集合的 key 时返回 false
+func lookupSets(db *DB, keys [][]byte) ([]*obj.RedisObject, bool) {
+	sets := make([]*obj.RedisObject, len(keys))
+	for i, key := range keys {
+		redisObj, exists := db.LookupKeyRead(string(key))
+		if !exists {
+			continue
+		}
+		if !isSet(redisObj) {
+			return nil, false
+		}
+		sets[i] = redisObj
+	}
+	return sets, true
+}
+
+// planIntersection 有空的输入时交集一定为空, 返回 false; 否则按照基数从小到大排列,
+// 遍历最小的集合, 在其他集合中查找, 第一个集合很大第二个很小时不需要遍历大的集合
+func planIntersection(sets []*obj.RedisObject, stats *serverStats) bool {
+	for _, set := range sets {
+		if set == nil || setLen(set) == 0 {
+			stats.setShortCircuits.Add(1)
+			return false
+		}
+	}
+	if !sort.SliceIsSorted(sets, func(i, j int) bool { return setLen(sets[i]) < setLen(sets[j]) }) {
+		sort.SliceStable(sets, func(i, j int) bool { return setLen(sets[i]) < setLen(sets[j]) })
+		stats.setReordered.Add(1)
+	}
+	return true
+}
+
+// intersectSets 遍历第一个集合, 在其他集合中都存在的元素传给 fn, fn 返回 false 时停止
+func intersectSets(sets []*obj.RedisObject, fn func(member string) bool) {
+	setForEach(sets[0], func(member string) bool {
+		for _, other := range sets[1:] {
+			if !setContains(other, member) {
+				return true
+			}
+		}
+		return fn(member)
+	})
+}
+
+// unionSets 所有集合的元素写入 result 去重
+func unionSets(sets []*obj.RedisObject, result map[string]struct{}) {
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		setForEach(set, func(member string) bool {
+			result[member] = struct{}{}
+			return true
+		})
+	}
+}
+
+// unionPresize SUNION 结果的预分配大小: 输入的基数之和, 最多 setPresizeLimit
+func unionPresize(sets []*obj.RedisObject) int {
+	hint := 0
+	for _, set := range sets {
+		if set != nil {
+			hint += setLen(set)
+		}
+	}
+	if hint > setPresizeLimit {
+		hint = setPresizeLimit
+	}
+	return hint
+}
+
+// setStore 结果写入集合 dest 覆盖原来的值, 结果为空时删除 dest
+func setStore(conn *Client, dest string, members [][]byte, event string) Reply {
+	db := conn.GetDb()
+	if len(members) == 0 {
+		if db.Delete(dest, false) > 0 {
+			db.Propagate(conn.GetCmdLine())
+			db.Notify(notifyGeneric, "del", dest)
+		}
+		return MakeIntReply(0)
+	}
+	redisObj, size := obj.NewSetObject(members)
+	db.RemoveTTLV1(dest)
+	db.PutEntity(dest, redisObj)
+	db.Propagate(conn.GetCmdLine())
+	db.Notify(notifySet, event, dest)
+	return MakeIntReply(size)
+}
+
+// sinter key [key ...]
+func sinter(c context.Context, conn *Client) error {
+	db := conn.GetDb()
+	sets, ok := lookupSets(db, conn.GetArgs())
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	members := make([][]byte, 0)
+	if planIntersection(sets, db.stats) {
+		intersectSets(sets, func(member string) bool {
+			members = append(members, []byte(member))
+			return true
+		})
+	}
+	return MakeBulkSetReply(members).WriteTo(conn)
+}
+
+// sinterstore destination key [key ...]
+func sinterstore(c context.Context, conn *Client) error {
+	db := conn.GetDb()
+	args := conn.GetArgs()
+	sets, ok := lookupSets(db, args[1:])
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	members := make([][]byte, 0)
+	if planIntersection(sets, db.stats) {
+		intersectSets(sets, func(member string) bool {
+			members = append(members, []byte(member))
+			return true
+		})
+	}
+	return setStore(conn, string(args[0]), members, "sinterstore").WriteTo(conn)
+}
+
+// sintercard numkeys key [key ...] [LIMIT limit], limit 为 0 时不限制
+func sintercard(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numKeys <= 0 {
+		return MakeStandardErrReply("ERR numkeys should be greater than 0").WriteTo(conn)
+	}
+	if numKeys > len(args)-1 {
+		return MakeStandardErrReply("ERR Number of keys can't be greater than number of args").WriteTo(conn)
+	}
+	limit := 0
+	for i := numKeys + 1; i < len(args); i += 2 {
+		if strings.ToLower(string(args[i])) != "limit" || i+1 >= len(args) {
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+		limit, err = strconv.Atoi(string(args[i+1]))
+		if err != nil || limit < 0 {
+			return MakeStandardErrReply("ERR LIMIT can't be negative").WriteTo(conn)
+		}
+	}
+	db := conn.GetDb()
+	sets, ok := lookupSets(db, args[1:numKeys+1])
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	var cardinality int64
+	if planIntersection(sets, db.stats) {
+		intersectSets(sets, func(member string) bool {
+			cardinality++
+			return limit == 0 || cardinality < int64(limit)
+		})
+	}
+	return MakeIntReply(cardinality).WriteTo(conn)
+}
+
+// sunion key [key ...]
+func sunion(c context.Context, conn *Client) error {
+	db := conn.GetDb()
+	sets, ok := lookupSets(db, conn.GetArgs())
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	hint := unionPresize(sets)
+	if hint > 0 {
+		db.stats.setPresized.Add(1)
+	}
+	result := make(map[string]struct{}, hint)
+	unionSets(sets, result)
+	members := make([][]byte, 0, len(result))
+	for member := range result {
+		members = append(members, []byte(member))
+	}
+	return MakeBulkSetReply(members).WriteTo(conn)
+}
+
+// sunionstore destination key [key ...]
+func sunionstore(c context.Context, conn *Client) error {
+	db := conn.GetDb()
+	args := conn.GetArgs()
+	sets, ok := lookupSets(db, args[1:])
+	if !ok {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	scratch := acquireSetScratch(db.stats)
+	defer releaseSetScratch(scratch)
+	unionSets(sets, scratch)
+	members := make([][]byte, 0, len(scratch))
+	for member := range scratch {
+		members = append(members, []byte(member))
+	}
+	return setStore(conn, string(args[0]), members, "sunionstore").WriteTo(conn)
+}
+
+// setAlgebraDebugInfo DEBUG SETALGEBRA 的回复, 集合运算选择计划的次数, 测试用来检查计划
+func setAlgebraDebugInfo(stats *serverStats) string {
+	return fmt.Sprintf("reordered:%d short_circuits:%d presized:%d scratch_reuses:%d",
+		stats.setReordered.Load(), stats.setShortCircuits.Load(),
+		stats.setPresized.Load(), stats.setScratchReuses.Load())
+}
+
+func init() {
+	register("sinter", sinter, withArity(-2), withFlags(flagReadonly), withKeys(1, -1, 1))
+	register("sinterstore", sinterstore, withArity(-3), withFlags(flagWrite|flagDenyOOM), withKeys(1, -1, 1))
+	register("sintercard", sintercard, withArity(-3), withFlags(flagReadonly), withKeyExtractor(numKeysExtractor(1)))
+	register("sunion", sunion, withArity(-2), withFlags(flagReadonly), withKeys(1, -1, 1))
+	register("sunionstore", sunionstore, withArity(-3), withFlags(flagWrite|flagDenyOOM), withKeys(1, -1, 1))
+}
@@ -0,0 +1,215 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+)
+
+func TestSetAlgebra(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "sadd", "s1", "1", "2", "3", "4")
+	server.exec(t, client, "sadd", "s2", "5", "3", "2")
+	// 整数集合按照大小遍历
+	assert.Equal(t, "*2\r\n$1\r\n2\r\n$1\r\n3\r\n", server.exec(t, client, "sinter", "s1", "s2"))
+	assert.Equal(t, "*4\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n$1\r\n4\r\n", server.exec(t, client, "sinter", "s1"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "sinter", "s1", "missing"))
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "sintercard", "2", "s1", "s2"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "sintercard", "2", "s1", "s2", "limit", "1"))
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "sintercard", "2", "s1", "s2", "limit", "0"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "sintercard", "2", "s1", "missing"))
+
+	assert.Equal(t, ":5\r\n", server.exec(t, client, "sunionstore", "dest", "s1", "s2", "missing"))
+	assert.Equal(t, "*5\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n$1\r\n4\r\n$1\r\n5\r\n", server.exec(t, client, "smembers", "dest"))
+	assert.Equal(t, ":5\r\n", server.exec(t, client, "scard", "dest"))
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "sinterstore", "dest", "s1", "s2"))
+	assert.Equal(t, "*2\r\n$1\r\n2\r\n$1\r\n3\r\n", server.exec(t, client, "smembers", "dest"))
+	// 结果为空时删除 dest
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "sinterstore", "dest", "s1", "missing"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "dest"))
+
+	// 字符串的元素
+	server.exec(t, client, "sadd", "a", "x", "y")
+	server.exec(t, client, "sadd", "b", "y", "z")
+	assert.Equal(t, "*1\r\n$1\r\ny\r\n", server.exec(t, client, "sinter", "a", "b"))
+	assert.Equal(t, "*1\r\n$1\r\ny\r\n", server.exec(t, client, "sinter", "b", "a"))
+	assert.Equal(t, "*3\r\n", server.exec(t, client, "sunion", "a", "b")[:4])
+	assert.Equal(t, ":5\r\n", server.exec(t, client, "sunionstore", "a", "a", "s2"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "sintercard", "2", "a", "b", "limit", "1"))
+}
+
+func TestSetAlgebraErrors(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "sadd", "s", "1")
+	server.exec(t, client, "set", "str", "v")
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	// 不存在的 key 在前面也要检查类型
+	assert.Equal(t, wrongType, server.exec(t, client, "sinter", "missing", "str"))
+	assert.Equal(t, wrongType, server.exec(t, client, "sunion", "s", "str"))
+	assert.Equal(t, wrongType, server.exec(t, client, "sinterstore", "dest", "s", "str"))
+	assert.Equal(t, wrongType, server.exec(t, client, "sunionstore", "dest", "s", "str"))
+	assert.Equal(t, wrongType, server.exec(t, client, "sintercard", "2", "missing", "str"))
+	// dest 不需要是集合
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "sunionstore", "str", "s"))
+
+	assert.Equal(t, "-ERR numkeys should be greater than 0\r\n", server.exec(t, client, "sintercard", "0", "s"))
+	assert.Equal(t, "-ERR numkeys should be greater than 0\r\n", server.exec(t, client, "sintercard", "a", "s"))
+	assert.Equal(t, "-ERR Number of keys can't be greater than number of args\r\n", server.exec(t, client, "sintercard", "2", "s"))
+	assert.Equal(t, "-ERR LIMIT can't be negative\r\n", server.exec(t, client, "sintercard", "1", "s", "limit", "-1"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "sintercard", "1", "s", "limit"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "sintercard", "1", "s", "nosuch", "1"))
+	assert.Equal(t, "*1\r\n$1\r\ns\r\n", server.exec(t, client, "command", "getkeys", "sintercard", "1", "s", "limit", "1"))
+}
+
+// setAlgebraCounters DEBUG SETALGEBRA 中的计数
+func setAlgebraCounters(t *testing.T, server *testServer, client *Client) map[string]int64 {
+	reply := server.exec(t, client, "debug", "setalgebra")
+	require.True(t, strings.HasPrefix(reply, "+"), reply)
+	counters := make(map[string]int64)
+	for _, field := range strings.Fields(strings.TrimSpace(reply[1:])) {
+		pair := strings.SplitN(field, ":", 2)
+		require.Len(t, pair, 2, reply)
+		counters[pair[0]], _ = strconv.ParseInt(pair[1], 10, 64)
+	}
+	return counters
+}
+
+func TestSetAlgebraPlan(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "sadd", "big", "a", "b", "c", "d")
+	server.exec(t, client, "sadd", "small", "b")
+
+	before := setAlgebraCounters(t, server, client)
+	server.exec(t, client, "sinter", "small", "big")
+	assert.Equal(t, before, setAlgebraCounters(t, server, client))
+	// 大的集合在前面时先遍历小的
+	assert.Equal(t, "*1\r\n$1\r\nb\r\n", server.exec(t, client, "sinter", "big", "small"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "sintercard", "2", "big", "small"))
+	after := setAlgebraCounters(t, server, client)
+	assert.Equal(t, before["reordered"]+2, after["reordered"])
+
+	// 有空的输入时不遍历任何集合
+	server.exec(t, client, "sinter", "big", "missing")
+	server.exec(t, client, "sinterstore", "dest", "missing", "big")
+	assert.Equal(t, after["short_circuits"]+2, setAlgebraCounters(t, server, client)["short_circuits"])
+
+	before = setAlgebraCounters(t, server, client)
+	server.exec(t, client, "sunion", "big", "small")
+	server.exec(t, client, "sunion", "missing")
+	after = setAlgebraCounters(t, server, client)
+	assert.Equal(t, before["presized"]+1, after["presized"])
+
+	// 第二次 SUNIONSTORE 复用第一次的临时 map
+	server.exec(t, client, "sunionstore", "dest", "big", "small")
+	before = setAlgebraCounters(t, server, client)
+	assert.Equal(t, ":4\r\n", server.exec(t, client, "sunionstore", "dest", "small", "big"))
+	assert.Equal(t, before["scratch_reuses"]+1, setAlgebraCounters(t, server, client)["scratch_reuses"])
+
+	server.exec(t, client, "config", "resetstat")
+	assert.Equal(t, map[string]int64{"reordered": 0, "short_circuits": 0, "presized": 0, "scratch_reuses": 0},
+		setAlgebraCounters(t, server, client))
+}
+
+func benchSet(prefix string, n int) *obj.RedisObject {
+	members := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		members = append(members, []byte(fmt.Sprintf("%s:%d", prefix, i)))
+	}
+	set, _ := obj.NewSetObject(members)
+	return set
+}
+
+// BenchmarkSetIntersect 按照基数排列之后与按照参数的顺序遍历比较
+func BenchmarkSetIntersect(b *testing.B) {
+	big, small := benchSet("member", 1000000), benchSet("member", 10)
+	cases := []struct {
+		name string
+		sets []*obj.RedisObject
+	}{
+		{"1M∩10", []*obj.RedisObject{big, small}},
+		{"10∩1M", []*obj.RedisObject{small, big}},
+	}
+	stats := &serverStats{}
+	for _, c := range cases {
+		b.Run(c.name+"/planned", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sets := append([]*obj.RedisObject{}, c.sets...)
+				planIntersection(sets, stats)
+				intersectSets(sets, func(member string) bool { return true })
+			}
+		})
+		b.Run(c.name+"/argument_order", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				intersectSets(c.sets, func(member string) bool { return true })
+			}
+		})
+	}
+}
+
+// BenchmarkSetUnion 5个不相交的集合的并集, 预先分配结果与从空的 map 开始比较
+func BenchmarkSetUnion(b *testing.B) {
+	sets := make([]*obj.RedisObject, 0, 5)
+	for i := 0; i < 5; i++ {
+		sets = append(sets, benchSet(strconv.Itoa(i), 10000))
+	}
+	b.Run("presized", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			unionSets(sets, make(map[string]struct{}, unionPresize(sets)))
+		}
+	})
+	b.Run("unsized", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			unionSets(sets, make(map[string]struct{}))
+		}
+	})
+}
+
+func TestSetEncodingConversion(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	entries := config.Properties.SetMaxIntsetEntries
+	defer func() {
+		config.Properties.SetMaxIntsetEntries = entries
+		obj.SetMaxIntsetEntries(entries)
+	}()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "set-max-intset-entries", "3"))
+	assert.Equal(t, "encoding_conversions:list=0,set=0,hash=0", "encoding_conversions:"+infoAll(t, server, client, "encoding_conversions"))
+
+	server.exec(t, client, "sadd", "ints", "1", "2", "3")
+	assert.Equal(t, "$6\r\nintset\r\n", server.exec(t, client, "object", "encoding", "ints"))
+	members := server.exec(t, client, "smembers", "ints")
+	// 重复的元素不会超过上限
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "sadd", "ints", "3"))
+	assert.Equal(t, "$6\r\nintset\r\n", server.exec(t, client, "object", "encoding", "ints"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "sadd", "ints", "4"))
+	assert.Equal(t, "$9\r\nhashtable\r\n", server.exec(t, client, "object", "encoding", "ints"))
+	// 删除到阈值以下之后仍然是 hashtable
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "srem", "ints", "4"))
+	assert.Equal(t, "$9\r\nhashtable\r\n", server.exec(t, client, "object", "encoding", "ints"))
+	assert.ElementsMatch(t, strings.Split(members, "\r\n"), strings.Split(server.exec(t, client, "smembers", "ints"), "\r\n"))
+
+	// 非整数的元素
+	server.exec(t, client, "sadd", "mixed", "1")
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "sadd", "mixed", "01"))
+	assert.Equal(t, "$9\r\nhashtable\r\n", server.exec(t, client, "object", "encoding", "mixed"))
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "scard", "mixed"))
+	assert.Equal(t, "encoding_conversions:list=0,set=2,hash=0", "encoding_conversions:"+infoAll(t, server, client, "encoding_conversions"))
+
+	// 新建的集合直接使用 hashtable, 不计入转换
+	server.exec(t, client, "sadd", "big", "1", "2", "3", "4")
+	assert.Equal(t, "$9\r\nhashtable\r\n", server.exec(t, client, "object", "encoding", "big"))
+	assert.Equal(t, ":4\r\n", server.exec(t, client, "scard", "big"))
+	assert.Equal(t, "set=2", strings.Split(infoAll(t, server, client, "encoding_conversions"), ",")[1])
+
+	server.exec(t, client, "config", "resetstat")
+	assert.Equal(t, "list=0,set=0,hash=0", infoAll(t, server, client, "encoding_conversions"))
+}
@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSrandmember(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "srandmember", "missing"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "srandmember", "missing", "-3"))
+	server.exec(t, client, "set", "str", "v")
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", server.exec(t, client, "srandmember", "str", "1"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", server.exec(t, client, "srandmember", "s", "x"))
+	assert.Equal(t, "-ERR value is out of range\r\n", server.exec(t, client, "srandmember", "s", "-9223372036854775807"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "srandmember", "s", "1", "2"))
+
+	server.exec(t, client, "sadd", "s", "1", "2", "3")
+	assert.Contains(t, []string{"$1\r\n1\r\n", "$1\r\n2\r\n", "$1\r\n3\r\n"}, server.exec(t, client, "srandmember", "s"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "srandmember", "s", "0"))
+	// 正数不重复, 超过集合的大小时返回所有的元素
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, bulkStrings(t, server.exec(t, client, "srandmember", "s", "10")))
+	assert.Len(t, bulkStrings(t, server.exec(t, client, "srandmember", "s", "2")), 2)
+	// 负数可能重复
+	assert.Len(t, bulkStrings(t, server.exec(t, client, "srandmember", "s", "-10")), 10)
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "scard", "s"))
+}
+
+func TestSrandmemberUniform(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	for i := 0; i < 100; i++ {
+		server.exec(t, client, "sadd", "ints", strconv.Itoa(i))
+		server.exec(t, client, "sadd", "strs", "m"+strconv.Itoa(i))
+	}
+	assert.Equal(t, "$6\r\nintset\r\n", server.exec(t, client, "object", "encoding", "ints"))
+	assert.Equal(t, "$9\r\nhashtable\r\n", server.exec(t, client, "object", "encoding", "strs"))
+
+	for _, key := range []string{"ints", "strs"} {
+		// 超过 streamReplyThreshold 分批流式返回, 每个元素期望被选中 500 次, 标准差大约 22
+		members := bulkStrings(t, server.exec(t, client, "srandmember", key, "-50000"))
+		assert.Len(t, members, 50000)
+		counts := make(map[string]int)
+		for _, member := range members {
+			counts[member]++
+		}
+		assert.Len(t, counts, 100, key)
+		for member, count := range counts {
+			assert.InDelta(t, 500, count, 150, member)
+		}
+	}
+}
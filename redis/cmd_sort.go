@@ -0,0 +1,370 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortOptions SORT 的参数, 与 redis sort.c 中的 sortCommandGeneric 一致
+type sortOptions struct {
+	desc  bool
+	alpha bool
+	// by BY 的 pattern, dontSort 是 pattern 中没有 * 时(比如 BY nosort)不排序
+	by       []byte
+	dontSort bool
+	gets     [][]byte
+	// offset count LIMIT, count 小于0表示到末尾
+	limited bool
+	offset  int64
+	count   int64
+	store   []byte
+}
+
+// sortElement 排序的元素和它的权重, ALPHA 时比较 cmp, 否则比较 score
+type sortElement struct {
+	value []byte
+	score float64
+	cmp   []byte
+}
+
+var errSortScore = MakeStandardErrReply("ERR One or more scores can't be converted into double")
+
+// parseSortOptions 解析 key 之后的参数, readonly 是 SORT_RO, 不允许 STORE
+func parseSortOptions(args [][]byte, readonly bool) (*sortOptions, Reply) {
+	opts := &sortOptions{count: -1}
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch strings.ToLower(string(args[i])) {
+		case "asc":
+			opts.desc = false
+		case "desc":
+			opts.desc = true
+		case "alpha":
+			opts.alpha = true
+		case "limit":
+			if left < 2 {
+				return nil, MakeSyntaxErr()
+			}
+			offset, err1 := strconv.ParseInt(string(args[i+1]), 10, 64)
+			count, err2 := strconv.ParseInt(string(args[i+2]), 10, 64)
+			if err1 != nil || err2 != nil {
+				return nil, MakeNotIntegerErr()
+			}
+			opts.limited, opts.offset, opts.count = true, offset, count
+			i += 2
+		case "store":
+			if left < 1 || readonly {
+				return nil, MakeSyntaxErr()
+			}
+			opts.store = args[i+1]
+			i++
+		case "by":
+			if left < 1 {
+				return nil, MakeSyntaxErr()
+			}
+			opts.by = args[i+1]
+			// 没有 * 的 pattern 对所有元素都一样, 不需要排序
+			opts.dontSort = bytes.IndexByte(opts.by, '*') < 0
+			i++
+		case "get":
+			if left < 1 {
+				return nil, MakeSyntaxErr()
+			}
+			opts.gets = append(opts.gets, args[i+1])
+			i++
+		default:
+			return nil, MakeSyntaxErr()
+		}
+	}
+	return opts, nil
+}
+
+// sortKeyPositions SORT 的 key 和 STORE 的目标 key. BY 和 GET 的 pattern 读取的 key 要在执行时才知道, 和 redis 一样不在这里声明
+func sortKeyPositions(cmdLine [][]byte) ([]int, error) {
+	if len(cmdLine) < 2 {
+		return nil, ErrorInvalidKeyArgs
+	}
+	positions := []int{1}
+	for i := 2; i < len(cmdLine); i++ {
+		switch strings.ToLower(string(cmdLine[i])) {
+		case "limit":
+			i += 2
+		case "by", "get":
+			i++
+		case "store":
+			if i+1 < len(cmdLine) {
+				positions = append(positions, i+1)
+			}
+			i++
+		}
+	}
+	return positions, nil
+}
+
+// sortStores 只有带 STORE 的 SORT 写入数据
+func sortStores(cmdLine [][]byte) bool {
+	positions, err := sortKeyPositions(cmdLine)
+	return err == nil && len(positions) > 1
+}
+
+// lookupKeyByPattern 把 pattern 中第一个 * 换成 subst 之后读取 key 的值, pattern->field 读取哈希表的字段.
+// pattern 是 # 时返回元素本身, key 不存在, 类型不对或者 pattern 中没有 * 时返回 nil
+func lookupKeyByPattern(db *DB, pattern, subst []byte) []byte {
+	if len(pattern) == 1 && pattern[0] == '#' {
+		return subst
+	}
+	star := bytes.IndexByte(pattern, '*')
+	if star < 0 {
+		return nil
+	}
+	keyPattern, field := pattern, []byte(nil)
+	if arrow := bytes.Index(pattern[star+1:], []byte("->")); arrow >= 0 && star+1+arrow+2 < len(pattern) {
+		keyPattern, field = pattern[:star+1+arrow], pattern[star+1+arrow+2:]
+	}
+	key := make([]byte, 0, len(keyPattern)+len(subst))
+	key = append(key, keyPattern[:star]...)
+	key = append(key, subst...)
+	key = append(key, keyPattern[star+1:]...)
+	redisObj, exists := db.LookupKeyRead(string(key))
+	if !exists {
+		return nil
+	}
+	if field != nil {
+		simpleDict, ok := redisObj.AsHash()
+		if !ok {
+			return nil
+		}
+		if value, ok := simpleDict.Get(string(field)); ok {
+			return value.([]byte)
+		}
+		return nil
+	}
+	if !isString(redisObj) {
+		return nil
+	}
+	value, err := obj.StringObjEncoding(redisObj)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// sortValues 列表按照顺序, 集合按照遍历的顺序取出所有的元素
+func sortValues(redisObj *obj.RedisObject) [][]byte {
+	var values [][]byte
+	if dequeue, ok := redisObj.AsList(); ok {
+		values = make([][]byte, 0, dequeue.Len())
+		dequeue.ForEach(func(value interface{}, index int) bool {
+			values = append(values, value.([]byte))
+			return true
+		})
+	} else if isSet(redisObj) {
+		values = make([][]byte, 0, setLen(redisObj))
+		setForEach(redisObj, func(member string) bool {
+			values = append(values, []byte(member))
+			return true
+		})
+	}
+	return values
+}
+
+// parseSortScore 与 redis 一样按照 strtod 解析, 不能完整解析或者是 NaN 时报错
+func parseSortScore(value []byte) (float64, bool) {
+	return util.ParseFloat(string(value))
+}
+
+// sortElements 计算每个元素的权重之后排序, 权重不能转换为浮点数时返回 false, ctx 结束时返回 ctx 的错误
+func sortElements(ctx context.Context, db *DB, elements []sortElement, opts *sortOptions) (bool, error) {
+	for i := range elements {
+		if interrupted(ctx, i) {
+			return false, ctx.Err()
+		}
+		weight := elements[i].value
+		if opts.by != nil {
+			// BY 的 key 不存在时权重是0, ALPHA 时排在最前面
+			weight = lookupKeyByPattern(db, opts.by, elements[i].value)
+			if weight == nil {
+				continue
+			}
+		}
+		if opts.alpha {
+			elements[i].cmp = weight
+			continue
+		}
+		score, ok := parseSortScore(weight)
+		if !ok {
+			return false, nil
+		}
+		elements[i].score = score
+	}
+	// 比较函数不能中断排序, ctx 结束之后所有的比较都返回 false, 排序很快结束
+	compared, stopped := 0, false
+	sort.SliceStable(elements, func(i, j int) bool {
+		compared++
+		if stopped || interrupted(ctx, compared) {
+			stopped = true
+			return false
+		}
+		a, b := &elements[i], &elements[j]
+		var cmp int
+		if opts.alpha {
+			if opts.by != nil {
+				switch {
+				case a.cmp == nil && b.cmp == nil:
+					cmp = 0
+				case a.cmp == nil:
+					cmp = -1
+				case b.cmp == nil:
+					cmp = 1
+				default:
+					cmp = bytes.Compare(a.cmp, b.cmp)
+				}
+			} else {
+				cmp = bytes.Compare(a.value, b.value)
+			}
+		} else if a.score < b.score {
+			cmp = -1
+		} else if a.score > b.score {
+			cmp = 1
+		} else {
+			// 权重相同时按照元素本身比较, 结果是确定的
+			cmp = bytes.Compare(a.value, b.value)
+		}
+		if opts.desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	if stopped {
+		return false, ctx.Err()
+	}
+	return true, nil
+}
+
+// sortRange LIMIT 对应的下标范围 [start, end], 与 redis 一致, offset 超出范围时结果为空
+func sortRange(opts *sortOptions, length int64) (start, end int64) {
+	start, end = 0, length-1
+	if !opts.limited {
+		return
+	}
+	start = opts.offset
+	if start < 0 {
+		start = 0
+	}
+	if opts.count < 0 {
+		end = length - 1
+	} else {
+		end = start + opts.count - 1
+	}
+	if start >= length {
+		start, end = length-1, length-2
+	}
+	if end >= length {
+		end = length - 1
+	}
+	return
+}
+
+// execSort sort key [BY pattern] [LIMIT offset count] [GET pattern [GET pattern ...]] [ASC|DESC] [ALPHA] [STORE destination]
+func execSort(ctx context.Context, conn *Client) error {
+	return sortGeneric(ctx, conn, false)
+}
+
+// execSortRO sort_ro key [BY pattern] [LIMIT offset count] [GET pattern [GET pattern ...]] [ASC|DESC] [ALPHA]
+func execSortRO(ctx context.Context, conn *Client) error {
+	return sortGeneric(ctx, conn, true)
+}
+
+func sortGeneric(ctx context.Context, conn *Client, readonly bool) error {
+	args := conn.GetArgs()
+	opts, errReply := parseSortOptions(args[1:], readonly)
+	if errReply != nil {
+		return errReply.WriteTo(conn)
+	}
+	db := conn.GetDb()
+	var values [][]byte
+	redisObj, exists := db.LookupKeyRead(string(args[0]))
+	if exists {
+		if _, isList := redisObj.AsList(); !isList && !isSet(redisObj) {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		// 集合的遍历顺序是不确定的, 和 redis 一样 STORE 时即使指定了 BY nosort 也按照字典序排序
+		if opts.dontSort && opts.store != nil && redisObj.ObjType == obj.RedisSet {
+			opts.dontSort, opts.alpha, opts.by = false, true, nil
+		}
+		values = sortValues(redisObj)
+	}
+
+	elements := make([]sortElement, len(values))
+	for i, value := range values {
+		elements[i].value = value
+	}
+	if !opts.dontSort {
+		if ok, err := sortElements(ctx, db, elements, opts); err != nil {
+			return interruptedReply(ctx).WriteTo(conn)
+		} else if !ok {
+			return errSortScore.WriteTo(conn)
+		}
+	}
+	start, end := sortRange(opts, int64(len(elements)))
+
+	output := make([][]byte, 0)
+	for i := start; i <= end; i++ {
+		if interrupted(ctx, int(i-start)) {
+			return interruptedReply(ctx).WriteTo(conn)
+		}
+		if len(opts.gets) == 0 {
+			output = append(output, elements[i].value)
+			continue
+		}
+		for _, pattern := range opts.gets {
+			output = append(output, lookupKeyByPattern(db, pattern, elements[i].value))
+		}
+	}
+	if opts.store == nil {
+		return MakeMultiBulkReply(output).WriteTo(conn)
+	}
+	return sortStore(db, string(opts.store), output).WriteTo(conn)
+}
+
+// sortStore 结果写入列表 dest 覆盖原来的值, 结果为空时删除 dest. 和 redis 一样 GET 不存在的 key 写入空字符串.
+// 传播的是 DEL 和 RPUSH, 从节点和重放 aof 时不需要重新排序
+func sortStore(db *DB, dest string, output [][]byte) Reply {
+	if len(output) == 0 {
+		if db.Delete(dest, false) > 0 {
+			db.Propagate(util.ToCmdLine("del", dest))
+			db.Notify(notifyGeneric, "del", dest)
+		}
+		return MakeIntReply(0)
+	}
+	redisObj := obj.NewListObject()
+	dequeue, _ := redisObj.AsList()
+	for _, value := range output {
+		if value == nil {
+			value = []byte{}
+		}
+		_ = dequeue.AddLast(value)
+	}
+	db.RemoveTTLV1(dest)
+	db.PutEntity(dest, redisObj)
+	db.Propagate(util.ToCmdLine("del", dest))
+	rpush := make([][]byte, 0, len(output)+1)
+	rpush = append(rpush, []byte(dest))
+	dequeue.ForEach(func(value interface{}, index int) bool {
+		rpush = append(rpush, value.([]byte))
+		return true
+	})
+	db.Propagate(util.ToCmdLine2("rpush", rpush))
+	db.Notify(notifyList, "sortstore", dest)
+	return MakeIntReply(int64(len(output)))
+}
+
+func init() {
+	register("sort", execSort, withArity(-2), withFlags(flagWrite|flagDenyOOM), withKeyExtractor(sortKeyPositions), withWriteIf(sortStores))
+	register("sort_ro", execSortRO, withArity(-2), withFlags(flagReadonly), withKeys(1, 1, 1))
+}
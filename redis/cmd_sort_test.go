@@ -0,0 +1,97 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// TestSort redis 文档中 SORT 的例子
+func TestSort(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "rpush", "mylist", "3", "1", "2", "10")
+	assert.Equal(t, "*4\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n$2\r\n10\r\n", server.exec(t, client, "sort", "mylist"))
+	assert.Equal(t, "*4\r\n$2\r\n10\r\n$1\r\n3\r\n$1\r\n2\r\n$1\r\n1\r\n", server.exec(t, client, "sort", "mylist", "desc"))
+	// ALPHA 按照字典序
+	assert.Equal(t, "*4\r\n$1\r\n1\r\n$2\r\n10\r\n$1\r\n2\r\n$1\r\n3\r\n", server.exec(t, client, "sort", "mylist", "alpha"))
+	assert.Equal(t, "*2\r\n$1\r\n2\r\n$1\r\n3\r\n", server.exec(t, client, "sort", "mylist", "limit", "1", "2"))
+	assert.Equal(t, "*2\r\n$1\r\n3\r\n$1\r\n2\r\n", server.exec(t, client, "sort", "mylist", "limit", "1", "2", "desc"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "sort", "mylist", "limit", "10", "2"))
+	assert.Equal(t, "*3\r\n$1\r\n2\r\n$1\r\n3\r\n$2\r\n10\r\n", server.exec(t, client, "sort", "mylist", "limit", "1", "-1"))
+
+	server.exec(t, client, "rpush", "words", "banana", "apple", "cherry")
+	assert.Equal(t, "-ERR One or more scores can't be converted into double\r\n", server.exec(t, client, "sort", "words"))
+	assert.Equal(t, "*3\r\n$5\r\napple\r\n$6\r\nbanana\r\n$6\r\ncherry\r\n", server.exec(t, client, "sort", "words", "alpha"))
+
+	server.exec(t, client, "sadd", "myset", "5", "-1", "3")
+	assert.Equal(t, "*3\r\n$2\r\n-1\r\n$1\r\n3\r\n$1\r\n5\r\n", server.exec(t, client, "sort", "myset"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "sort", "nosuchkey"))
+	server.exec(t, client, "set", "str", "v")
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", server.exec(t, client, "sort", "str"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "sort", "mylist", "limit", "1"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "sort", "mylist", "nosuch"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", server.exec(t, client, "sort", "mylist", "limit", "a", "1"))
+}
+
+// TestSortByGet SORT mylist BY weight_* GET # GET object_*, 以及哈希表的 pattern->field
+func TestSortByGet(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "rpush", "mylist", "1", "2", "3")
+	server.exec(t, client, "mset", "weight_1", "30", "weight_2", "10", "weight_3", "20")
+	server.exec(t, client, "mset", "object_1", "one", "object_2", "two")
+	assert.Equal(t, "*3\r\n$1\r\n2\r\n$1\r\n3\r\n$1\r\n1\r\n", server.exec(t, client, "sort", "mylist", "by", "weight_*"))
+	assert.Equal(t, "*6\r\n$1\r\n2\r\n$3\r\ntwo\r\n$1\r\n3\r\n$-1\r\n$1\r\n1\r\n$3\r\none\r\n",
+		server.exec(t, client, "sort", "mylist", "by", "weight_*", "get", "#", "get", "object_*"))
+	assert.Equal(t, "*2\r\n$3\r\ntwo\r\n$-1\r\n",
+		server.exec(t, client, "sort", "mylist", "by", "weight_*", "get", "object_*", "limit", "0", "2"))
+	// BY nosort 不排序, 保持列表的顺序
+	assert.Equal(t, "*3\r\n$3\r\none\r\n$3\r\ntwo\r\n$-1\r\n", server.exec(t, client, "sort", "mylist", "by", "nosort", "get", "object_*"))
+	// BY 的 key 不存在时权重是0
+	server.exec(t, client, "del", "weight_2")
+	assert.Equal(t, "*3\r\n$1\r\n2\r\n$1\r\n3\r\n$1\r\n1\r\n", server.exec(t, client, "sort", "mylist", "by", "weight_*"))
+
+	// 哈希表的字段
+	server.exec(t, client, "hset", "weight_h_1", "w", "3", "name", "a")
+	server.exec(t, client, "hset", "weight_h_2", "w", "1", "name", "b")
+	server.exec(t, client, "hset", "weight_h_3", "w", "2", "name", "c")
+	assert.Equal(t, "*3\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\na\r\n",
+		server.exec(t, client, "sort", "mylist", "by", "weight_h_*->w", "get", "weight_h_*->name"))
+	assert.Equal(t, "*3\r\n$1\r\n3\r\n$1\r\n2\r\n$1\r\n1\r\n",
+		server.exec(t, client, "sort", "mylist", "by", "weight_h_*->name", "alpha", "desc"))
+	// 字段不存在或者 key 的类型不对时是 nil
+	assert.Equal(t, "*3\r\n$-1\r\n$-1\r\n$-1\r\n", server.exec(t, client, "sort", "mylist", "get", "weight_h_*->nosuch"))
+	assert.Equal(t, "*3\r\n$-1\r\n$-1\r\n$-1\r\n", server.exec(t, client, "sort", "mylist", "get", "weight_h_*"))
+	server.exec(t, client, "set", "bad_1", "x")
+	assert.Equal(t, "-ERR One or more scores can't be converted into double\r\n", server.exec(t, client, "sort", "mylist", "by", "bad_*"))
+}
+
+func TestSortStore(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "rpush", "mylist", "3", "1", "2")
+	server.exec(t, client, "set", "dest", "old")
+	server.exec(t, client, "expire", "dest", "100")
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "sort", "mylist", "store", "dest"))
+	assert.Equal(t, "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n", server.exec(t, client, "lrange", "dest", "0", "-1"))
+	assert.Equal(t, ":-1\r\n", server.exec(t, client, "ttl", "dest"))
+	// GET 不存在的 key 写入空字符串
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "sort", "mylist", "get", "nosuch_*", "store", "dest"))
+	assert.Equal(t, "*3\r\n$0\r\n\r\n$0\r\n\r\n$0\r\n\r\n", server.exec(t, client, "lrange", "dest", "0", "-1"))
+	// 结果为空时删除 dest
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "sort", "nosuchkey", "store", "dest"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "dest"))
+	// STORE 集合时即使 BY nosort 也按照字典序排序
+	server.exec(t, client, "sadd", "myset", "c", "a", "b")
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "sort", "myset", "by", "nosort", "store", "dest"))
+	assert.Equal(t, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", server.exec(t, client, "lrange", "dest", "0", "-1"))
+
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "sort_ro", "mylist", "store", "dest"))
+	assert.Equal(t, "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n", server.exec(t, client, "sort_ro", "mylist"))
+
+	assert.Equal(t, [][]byte{[]byte("mylist"), []byte("dest")},
+		commandRouter["sort"].GetKeys([][]byte{[]byte("sort"), []byte("mylist"), []byte("by"), []byte("store"),
+			[]byte("limit"), []byte("0"), []byte("1"), []byte("store"), []byte("dest")}))
+	assert.Equal(t, [][]byte{[]byte("mylist")}, commandRouter["sort_ro"].GetKeys([][]byte{[]byte("sort_ro"), []byte("mylist")}))
+	assert.True(t, commandRouter["sort_ro"].IsReadonly())
+}
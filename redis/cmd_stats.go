@@ -0,0 +1,185 @@
+package redis
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 与 redis 的 INFO commandstats 和 INFO latencystats 一致, 每个命令记录执行的次数, 总耗时, 执行之前被拒绝的次数(参数个数,
+// 认证, OOM 等)和执行之后回复了错误的次数, 以及一个按照对数分桶的耗时直方图, 用来估算 p50/p99/p99.9.
+// 记录一次命令只有几次原子加法, 不需要加锁
+
+// latencySubBuckets 每个2的幂的区间再分成8个桶, 估算的百分位数误差不超过 1/8
+const latencySubBuckets = 8
+
+// latencyMaxShift 超过 2^40ns(大约18分钟)的耗时都记在最后一个桶中
+const latencyMaxShift = 40
+
+// latencyBuckets 0..7 各一个桶, 之后 [2^3, 2^4) 到 [2^40, 2^41) 每个区间 latencySubBuckets 个桶
+const latencyBuckets = (latencyMaxShift - 1) * latencySubBuckets
+
+// latencyPercentiles INFO latencystats 输出的百分位数, 与 redis 的默认值 latency-tracking-info-percentiles 一致
+var latencyPercentiles = []float64{50, 99, 99.9}
+
+type commandStats struct {
+	calls    atomic.Int64
+	usec     atomic.Int64
+	rejected atomic.Int64
+	failed   atomic.Int64
+	latency  [latencyBuckets]atomic.Int64
+}
+
+// latencyBucket 耗时(纳秒)所在的桶: 小于8ns的每个值一个桶, 之后每个2的幂的区间分成 latencySubBuckets 个桶
+func latencyBucket(nanos int64) int {
+	if nanos < latencySubBuckets {
+		if nanos < 0 {
+			return 0
+		}
+		return int(nanos)
+	}
+	shift := bits.Len64(uint64(nanos)) - 1
+	if shift > latencyMaxShift {
+		return latencyBuckets - 1
+	}
+	sub := int(nanos>>(shift-3)) & (latencySubBuckets - 1)
+	return (shift-2)*latencySubBuckets + sub
+}
+
+// latencyBucketUpper 桶中最大的耗时(纳秒)
+func latencyBucketUpper(bucket int) int64 {
+	if bucket < latencySubBuckets {
+		return int64(bucket)
+	}
+	shift := bucket/latencySubBuckets + 2
+	width := int64(1) << (shift - 3)
+	return int64(1)<<shift + int64(bucket%latencySubBuckets)*width + width - 1
+}
+
+// record 记录一次执行完成的命令
+func (s *commandStats) record(duration time.Duration, failed bool) {
+	s.calls.Add(1)
+	s.usec.Add(duration.Microseconds())
+	s.latency[latencyBucket(int64(duration))].Add(1)
+	if failed {
+		s.failed.Add(1)
+	}
+}
+
+func (s *commandStats) reject() {
+	s.rejected.Add(1)
+}
+
+func (s *commandStats) reset() {
+	s.calls.Store(0)
+	s.usec.Store(0)
+	s.rejected.Store(0)
+	s.failed.Store(0)
+	for i := range s.latency {
+		s.latency[i].Store(0)
+	}
+}
+
+// percentiles 按照直方图估算的百分位数(微秒), 直方图为空时返回 nil
+func (s *commandStats) percentiles(quantiles []float64) []float64 {
+	var counts [latencyBuckets]int64
+	var total int64
+	for i := range s.latency {
+		counts[i] = s.latency[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return nil
+	}
+	result := make([]float64, 0, len(quantiles))
+	var seen int64
+	bucket := 0
+	for _, quantile := range quantiles {
+		// 第 rank 个耗时所在的桶, rank 从1开始
+		rank := int64(float64(total)*quantile/100 + 0.999999)
+		if rank < 1 {
+			rank = 1
+		}
+		for bucket < latencyBuckets-1 && seen+counts[bucket] < rank {
+			seen += counts[bucket]
+			bucket++
+		}
+		result = append(result, float64(latencyBucketUpper(bucket))/1000)
+	}
+	return result
+}
+
+// sortedCommands 按照名字排序的命令, INFO 的输出是稳定的
+func sortedCommands() []*Command {
+	commands := make([]*Command, 0, len(commandRouter))
+	for _, cmd := range commandRouter {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].name < commands[j].name
+	})
+	return commands
+}
+
+// infoCommandStats INFO commandstats, 只输出执行过或者被拒绝过的命令
+func infoCommandStats() string {
+	builder := strings.Builder{}
+	builder.WriteString("# Commandstats\r\n")
+	for _, cmd := range sortedCommands() {
+		calls, usec := cmd.stats.calls.Load(), cmd.stats.usec.Load()
+		rejected, failed := cmd.stats.rejected.Load(), cmd.stats.failed.Load()
+		if calls == 0 && rejected == 0 && failed == 0 {
+			continue
+		}
+		var perCall float64
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		builder.WriteString(fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			cmd.name, calls, usec, perCall, rejected, failed))
+	}
+	return builder.String()
+}
+
+// infoLatencyStats INFO latencystats
+func infoLatencyStats() string {
+	builder := strings.Builder{}
+	builder.WriteString("# Latencystats\r\n")
+	for _, cmd := range sortedCommands() {
+		values := cmd.stats.percentiles(latencyPercentiles)
+		if values == nil {
+			continue
+		}
+		builder.WriteString("latency_percentiles_usec_" + cmd.name + ":")
+		for i, value := range values {
+			if i > 0 {
+				builder.WriteByte(',')
+			}
+			builder.WriteString(fmt.Sprintf("p%s=%.3f", formatPercentile(latencyPercentiles[i]), value))
+		}
+		builder.WriteString("\r\n")
+	}
+	return builder.String()
+}
+
+// formatPercentile 与 redis 一致, 50 -> "50", 99.9 -> "99.9"
+func formatPercentile(percentile float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%f", percentile), "0"), ".")
+}
+
+// resetCommandStats CONFIG RESETSTAT
+func resetCommandStats() {
+	for _, cmd := range commandRouter {
+		cmd.stats.reset()
+	}
+}
+
+// resetStats CONFIG RESETSTAT 清零命令的统计, INFO stats 中的计数和 rejected_connections. 调用方持有锁
+func (r *RedisServer) resetStats() {
+	resetCommandStats()
+	r.stats.reset()
+	r.connManager.ResetRejected()
+}
@@ -0,0 +1,100 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// infoLine INFO section 中以 prefix 开头的一行
+func infoLine(t *testing.T, server *testServer, client *Client, section, prefix string) string {
+	for _, line := range strings.Split(server.exec(t, client, "info", section), "\r\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestCommandStats(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "resetstat"))
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "get", "foo")
+	server.exec(t, client, "get", "foo")
+	server.exec(t, client, "rpush", "list", "a")
+	// 参数个数错误是拒绝, WRONGTYPE 是执行之后失败
+	server.exec(t, client, "get")
+	server.exec(t, client, "get", "list")
+
+	line := infoLine(t, server, client, "commandstats", "cmdstat_get:")
+	assert.Regexp(t, `^cmdstat_get:calls=3,usec=\d+,usec_per_call=\d+\.\d\d,rejected_calls=1,failed_calls=1$`, line)
+	assert.Regexp(t, `^cmdstat_set:calls=1,`, infoLine(t, server, client, "commandstats", "cmdstat_set:"))
+	assert.Equal(t, "", infoLine(t, server, client, "commandstats", "cmdstat_hget:"))
+	assert.Regexp(t, `^latency_percentiles_usec_get:p50=\d+\.\d{3},p99=\d+\.\d{3},p99\.9=\d+\.\d{3}$`,
+		infoLine(t, server, client, "latencystats", "latency_percentiles_usec_get:"))
+
+	// 脚本中的命令同样计入
+	server.exec(t, client, "eval", "return redis.call('get', 'foo')", "0")
+	assert.Regexp(t, `^cmdstat_get:calls=4,`, infoLine(t, server, client, "commandstats", "cmdstat_get:"))
+	assert.Regexp(t, `^cmdstat_get:`, infoLine(t, server, client, "all", "cmdstat_get:"))
+	assert.Equal(t, "", infoLine(t, server, client, "default", "cmdstat_get:"))
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "resetstat"))
+	assert.Equal(t, "", infoLine(t, server, client, "commandstats", "cmdstat_get:"))
+	assert.Equal(t, "", infoLine(t, server, client, "latencystats", "latency_percentiles_usec_get:"))
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	previous := -1
+	for _, nanos := range []int64{0, 1, 7, 8, 9, 15, 16, 100, 1000, 1234567, 1 << 30, 1<<40 + 5} {
+		bucket := latencyBucket(nanos)
+		assert.GreaterOrEqual(t, bucket, previous)
+		assert.Less(t, bucket, latencyBuckets)
+		upper := latencyBucketUpper(bucket)
+		// 桶的上界不小于耗时, 误差不超过 1/8
+		assert.GreaterOrEqual(t, upper, nanos)
+		assert.LessOrEqual(t, float64(upper-nanos), float64(nanos)/latencySubBuckets+1)
+		previous = bucket
+	}
+	assert.Equal(t, latencyBuckets-1, latencyBucket(1<<62))
+
+	stats := &commandStats{}
+	assert.Nil(t, stats.percentiles(latencyPercentiles))
+	for i := 0; i < 990; i++ {
+		stats.record(10*time.Microsecond, false)
+	}
+	for i := 0; i < 10; i++ {
+		stats.record(10*time.Millisecond, true)
+	}
+	values := stats.percentiles(latencyPercentiles)
+	assert.InDelta(t, 10, values[0], 10.0/latencySubBuckets)
+	assert.InDelta(t, 10, values[1], 10.0/latencySubBuckets)
+	assert.InDelta(t, 10000, values[2], 10000.0/latencySubBuckets)
+	assert.Equal(t, int64(1000), stats.calls.Load())
+	assert.Equal(t, int64(10), stats.failed.Load())
+	assert.Equal(t, "99.9", formatPercentile(99.9))
+	assert.Equal(t, "50", formatPercentile(50))
+	assert.Equal(t, "99", formatPercentile(99))
+}
+
+// TestCommandStatsOverhead 记录一次命令只是几次原子加法
+func TestCommandStatsOverhead(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("skipping in short mode or with -race")
+	}
+	result := testing.Benchmark(BenchmarkCommandStats)
+	t.Logf("%d ns/op", result.NsPerOp())
+	assert.Less(t, result.NsPerOp(), int64(100))
+	assert.Zero(t, result.AllocsPerOp())
+}
+
+func BenchmarkCommandStats(b *testing.B) {
+	stats := &commandStats{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stats.record(time.Duration(i&0xffff), false)
+	}
+}
@@ -2,7 +2,9 @@ package redis
 
 import (
 	"context"
+	"github.com/xuning888/godis-tiny/config"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/sds"
 	"github.com/xuning888/godis-tiny/pkg/util"
 	"math"
 	"strconv"
@@ -11,20 +13,16 @@ import (
 )
 
 func execGet(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	args := conn.GetArgs()
 	key := string(args[0])
 	db := conn.GetDb()
-	redisObj, exists := db.GetEntity(key)
+	redisObj, exists := db.LookupKeyRead(key)
 	if !exists {
 		return MakeNullBulkReply().WriteTo(conn)
 	}
 	result, err := obj.StringObjEncoding(redisObj)
 	if err != nil {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	if result == nil {
 		return MakeNullBulkReply().WriteTo(conn)
@@ -46,15 +44,12 @@ const (
 
 func execSet(c context.Context, conn *Client) error {
 	argNum := conn.GetArgNum()
-	if argNum < 2 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	args := conn.GetArgs()
 	key := string(args[0])
 	value := args[1]
 	// 默认是 update 和 add, 如果 key 已经存在，就覆盖它，如果不在就创建它
 	policy := addOrUpdatePolicy
-	// 过期时间
+	// 过期的毫秒时间戳
 	var ttl = unlimitedTTL
 	if argNum > 2 {
 		for i := 2; i < len(args); i++ {
@@ -62,67 +57,59 @@ func execSet(c context.Context, conn *Client) error {
 			if "NX" == upper {
 				// set key value nx 仅当key不存在时插入
 				if policy == updatePolicy {
-					return MakeSyntaxReply().WriteTo(conn)
+					return MakeSyntaxErr().WriteTo(conn)
 				}
 				policy = addPolicy
 			} else if "XX" == upper {
 				// set key value xx 仅当key存在时插入
 				if policy == addPolicy {
-					return MakeSyntaxReply().WriteTo(conn)
+					return MakeSyntaxErr().WriteTo(conn)
 				}
 				policy = updatePolicy
-			} else if "EX" == upper {
-				// 秒级过期时间
+			} else if "EX" == upper || "PX" == upper || "EXAT" == upper || "PXAT" == upper {
+				// EX, PX 相对的过期时间, EXAT, PXAT 绝对的时间戳, 统一转换为毫秒时间戳
 				if ttl != unlimitedTTL {
-					return MakeSyntaxReply().WriteTo(conn)
+					return MakeSyntaxErr().WriteTo(conn)
 				}
 				if i+1 >= len(args) {
-					return MakeSyntaxReply().WriteTo(conn)
+					return MakeSyntaxErr().WriteTo(conn)
 				}
 				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
 				if err != nil {
-					return MakeSyntaxReply().WriteTo(conn)
+					return MakeNotIntegerErr().WriteTo(conn)
 				}
-				if ttlArg <= 0 {
-					return MakeStandardErrReply("ERR invalid expire time in set").WriteTo(conn)
+				unit, basetime := unitSeconds, int64(0)
+				if upper[0] == 'P' {
+					unit = unitMilliseconds
 				}
-				ttl = ttlArg * 1000
-				i++
-			} else if "PX" == upper {
-				// 毫秒级过期时间
-				if ttl != unlimitedTTL {
-					return MakeSyntaxReply().WriteTo(conn)
-				}
-				if i+1 >= len(args) {
-					return MakeSyntaxReply().WriteTo(conn)
-				}
-				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-				if err != nil {
-					return MakeSyntaxReply().WriteTo(conn)
+				if len(upper) == 2 {
+					basetime = conn.GetDb().clock.Now().UnixMilli()
 				}
-				if ttlArg <= 0 {
-					return MakeStandardErrReply("ERR invalid expire time in set").WriteTo(conn)
+				when, ok := expireMillis(ttlArg, unit, basetime)
+				if ttlArg <= 0 || !ok {
+					return MakeInvalidExpireTimeErr("set").WriteTo(conn)
 				}
-				ttl = ttlArg
+				ttl = when
 				i++
 			} else if "KEEPTTL" == upper {
 				if ttl != unlimitedTTL {
-					return MakeSyntaxReply().WriteTo(conn)
+					return MakeSyntaxErr().WriteTo(conn)
 				}
 				ttl = keepTTL
 			} else {
-				return MakeSyntaxReply().WriteTo(conn)
+				return MakeSyntaxErr().WriteTo(conn)
 			}
 		}
 	}
 	db := conn.GetDb()
-	redisObj, exists := db.GetEntity(key)
-	if exists {
+	redisObj, exists := db.LookupKeyWrite(key)
+	if exists && !obj.IsShared(redisObj) {
 		redisObj.ObjType = obj.RedisString
 		obj.StringObjSetValue(redisObj, value)
 	} else {
 		redisObj = obj.NewStringObject(value)
 	}
+	redisObj = shareString(redisObj)
 	var result int
 	switch policy {
 	case addOrUpdatePolicy:
@@ -136,18 +123,21 @@ func execSet(c context.Context, conn *Client) error {
 	if result > 0 {
 		if ttl != unlimitedTTL {
 			if ttl == keepTTL {
-				db.AddAof(conn.GetCmdLine())
+				db.Propagate(conn.GetCmdLine())
+				db.Notify(notifyString, "set", key)
 			} else {
-				expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+				expireTime := time.UnixMilli(ttl)
 				db.ExpireV1(key, expireTime)
-				db.AddAof(conn.GetCmdLine())
-				// convert to expireat
-				expireAtCmd := util.MakeExpireCmd(key, expireTime)
-				db.AddAof(expireAtCmd)
+				// 过期时间转换为 pexpireat, 和 set 一起放在 MULTI/EXEC 中
+				db.Propagate(util.ToCmdLine2("set", args[:2]))
+				db.Propagate(util.MakeExpireCmd(key, expireTime))
+				db.Notify(notifyString, "set", key)
+				db.Notify(notifyGeneric, "expire", key)
 			}
 		} else {
 			db.RemoveTTLV1(key)
-			db.AddAof(conn.GetCmdLine())
+			db.Propagate(conn.GetCmdLine())
+			db.Notify(notifyString, "set", key)
 		}
 		return MakeOkReply().WriteTo(conn)
 	}
@@ -156,160 +146,164 @@ func execSet(c context.Context, conn *Client) error {
 
 // execSetNx setnx key value
 func execSetNx(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 2 || argNum > 2 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
 	value := cmdData[1]
 	db := conn.GetDb()
-	redisObj := obj.NewStringObject(value)
-	res := db.PutEntity(key, redisObj)
-	conn.GetDb().AddAof(conn.GetCmdLine())
-	return MakeIntReply(int64(res)).WriteTo(conn)
+	if _, exists := db.LookupKeyWrite(key); exists {
+		return MakeIntReply(0).WriteTo(conn)
+	}
+	db.PutEntity(key, shareString(obj.NewStringObject(value)))
+	db.Propagate(conn.GetCmdLine())
+	db.Notify(notifyString, "set", key)
+	return MakeIntReply(1).WriteTo(conn)
+}
+
+// setExGeneric SETEX, PSETEX 设置值和相对的过期时间, 过期时间必须是正数. 和 SET EX 一样传播为 set 和 pexpireat
+func setExGeneric(conn *Client, unit int) error {
+	args := conn.GetArgs()
+	key := string(args[0])
+	value, _ := strconv.ParseInt(string(args[1]), 10, 64)
+	db := conn.GetDb()
+	when, ok := expireMillis(value, unit, db.clock.Now().UnixMilli())
+	if value <= 0 || !ok {
+		return MakeInvalidExpireTimeErr(conn.GetCmdName()).WriteTo(conn)
+	}
+	db.PutEntity(key, shareString(obj.NewStringObject(args[2])))
+	expireTime := time.UnixMilli(when)
+	db.ExpireV1(key, expireTime)
+	db.Propagate(util.ToCmdLine2("set", [][]byte{args[0], args[2]}))
+	db.Propagate(util.MakeExpireCmd(key, expireTime))
+	db.Notify(notifyString, "set", key)
+	db.Notify(notifyGeneric, "expire", key)
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execSetEx setex key seconds value
+func execSetEx(c context.Context, conn *Client) error {
+	return setExGeneric(conn, unitSeconds)
+}
+
+// execPSetEx psetex key milliseconds value
+func execPSetEx(c context.Context, conn *Client) error {
+	return setExGeneric(conn, unitMilliseconds)
+}
+
+// isString 类型是字符串, 并且值是 sds 或者 int 编码
+func isString(redisObj *obj.RedisObject) bool {
+	_, isSds := redisObj.AsSds()
+	_, isInt := redisObj.AsInt()
+	return isSds || isInt
 }
 
 // execStrLen strlen key
 func execStrLen(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
 	db := conn.GetDb()
-	redisObj, exists := db.GetEntity(key)
+	redisObj, exists := db.LookupKeyRead(key)
 	if !exists {
 		return MakeIntReply(0).WriteTo(conn)
 	}
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	result, _ := obj.StringObjEncoding(redisObj)
 	str := string(result)
 	return MakeIntReply(int64(len(str))).WriteTo(conn)
 }
 
-// execGetSet getset key value
+// execGetSet getset key value, 返回原来的值并且与 SET 一样清除过期时间
 func execGetSet(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 2 || argNum > 2 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	value := cmdData[1]
 	db := conn.GetDb()
-	redisObj, exists := db.GetEntity(key)
-	if !exists {
-		return MakeIntReply(0).WriteTo(conn)
-	}
-
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply().WriteTo(conn)
-	}
-
-	db.PutEntity(key, obj.NewStringObject(value))
-	conn.GetDb().AddAof(conn.GetCmdLine())
-	if redisObj.Ptr != nil {
+	var old Reply = MakeNullBulkReply()
+	if redisObj, exists := db.LookupKeyWrite(key); exists {
+		if !isString(redisObj) {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
 		result, _ := obj.StringObjEncoding(redisObj)
-		return MakeBulkReply(result).WriteTo(conn)
+		old = MakeBulkReply(result)
 	}
-	return MakeNullBulkReply().WriteTo(conn)
+	db.PutEntity(key, shareString(obj.NewStringObject(cmdData[1])))
+	db.RemoveTTLV1(key)
+	db.Propagate(conn.GetCmdLine())
+	db.Notify(notifyString, "set", key)
+	return old.WriteTo(conn)
 }
 
 // execIncr incr key
 // incr 命令存在对内存的读写操作，此处没有使用锁来保证线程安全, 而是在dbEngin中使用队列来保证命令排队执行
 func execIncr(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
 	db := conn.GetDb()
-	redisObj, exists := db.GetEntity(key)
+	redisObj, exists := db.LookupKeyWrite(key)
 	if !exists {
-		redisObj = obj.NewStringEmptyObj()
-		redisObj.Ptr = int64(1)
-		redisObj.Encoding = obj.EncInt
-		db.PutEntity(key, redisObj)
-		db.AddAof(conn.GetCmdLine())
+		db.PutEntity(key, newIntObject(1))
+		db.Propagate(conn.GetCmdLine())
+		db.Notify(notifyString, "incrby", key)
 		return MakeIntReply(1).WriteTo(conn)
 	}
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
-	if redisObj.Encoding != obj.EncInt {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+	value, ok := obj.StringObjInt64(redisObj)
+	if !ok {
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
-	value := redisObj.Ptr.(int64)
 	if math.MaxInt64-1 < value {
-		return MakeStandardErrReply("ERR increment or decrement would overflow").WriteTo(conn)
+		return MakeOverflowErr().WriteTo(conn)
 	}
 	value++
-	redisObj.Ptr = value
-	db.AddAof(conn.GetCmdLine())
+	db.setInteger(key, redisObj, value)
+	db.Propagate(conn.GetCmdLine())
+	db.Notify(notifyString, "incrby", key)
 	return MakeIntReply(value).WriteTo(conn)
 }
 
 // execDecr decr key
 func execDecr(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if !exists {
-		redisObj = obj.NewStringEmptyObj()
-		redisObj.Ptr = int64(-1)
-		redisObj.Encoding = obj.EncInt
-		conn.GetDb().PutEntity(key, redisObj)
-		conn.GetDb().AddAof(conn.GetCmdLine())
+		conn.GetDb().PutEntity(key, newIntObject(-1))
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyString, "incrby", key)
 		return MakeIntReply(-1).WriteTo(conn)
 	}
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
-	if redisObj.Encoding != obj.EncInt {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+	value, ok := obj.StringObjInt64(redisObj)
+	if !ok {
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
-	value := redisObj.Ptr.(int64)
 	if math.MinInt64+1 > value {
-		return MakeStandardErrReply("ERR increment or decrement would overflow").WriteTo(conn)
+		return MakeOverflowErr().WriteTo(conn)
 	}
 	value--
-	redisObj.Ptr = value
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	conn.GetDb().setInteger(key, redisObj, value)
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyString, "incrby", key)
 	return MakeIntReply(value).WriteTo(conn)
 }
 
 // execGetRange getrange key start end
 func execGetRange(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 3 || argNum > 3 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	start, err := strconv.ParseInt(string(cmdData[1]), 10, 64)
-	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
-	}
-	end, err := strconv.ParseInt(string(cmdData[2]), 10, 64)
-	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
-	}
+	start, _ := strconv.ParseInt(string(cmdData[1]), 10, 64)
+	end, _ := strconv.ParseInt(string(cmdData[2]), 10, 64)
 	db := conn.GetDb()
-	redisObj, exists := db.GetEntity(key)
+	redisObj, exists := db.LookupKeyRead(key)
 	if !exists {
-		return MakeBulkReply([]byte("")).WriteTo(conn)
+		return MakeEmptyBulkReply().WriteTo(conn)
 	}
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	bytes, _ := obj.StringObjEncoding(redisObj)
 	value := string(bytes)
@@ -327,7 +321,7 @@ func execGetRange(c context.Context, conn *Client) error {
 	// 计算边界
 	// 如果 start > end 或者 start 超过了数组的范围, 就返回空字符串
 	if start > end || start >= length {
-		return MakeBulkReply([]byte("")).WriteTo(conn)
+		return MakeEmptyBulkReply().WriteTo(conn)
 	}
 	// end 和 length - 1 求一个最小值作为end
 	end = util.MinInt64(end, length-1)
@@ -337,10 +331,6 @@ func execGetRange(c context.Context, conn *Client) error {
 
 // execMGet mget key[key...]
 func execMGet(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	length := len(cmdData)
 	db := conn.GetDb()
@@ -349,13 +339,13 @@ func execMGet(c context.Context, conn *Client) error {
 	}
 	for _, keyBytes := range cmdData {
 		key := string(keyBytes)
-		redisObj, exists := db.GetEntity(key)
+		redisObj, exists := db.LookupKeyRead(key)
 		if !exists {
 			if err := MakeNullBulkReply().WriteTo(conn); err != nil {
 				return err
 			}
 		} else {
-			if redisObj.ObjType != obj.RedisString {
+			if !isString(redisObj) {
 				if err := MakeNullBulkReply().WriteTo(conn); err != nil {
 					return err
 				}
@@ -373,78 +363,141 @@ func execMGet(c context.Context, conn *Client) error {
 // execMSet
 func execMSet(c context.Context, conn *Client) error {
 	argNum := conn.GetArgNum()
-	if argNum == 0 || argNum%2 != 0 {
-		return MakeUnknownCommand(conn.GetCmdName()).WriteTo(conn)
-	}
 	args := conn.GetArgs()
 	db := conn.GetDb()
 	for i := 1; i < argNum; i += 2 {
 		key := string(args[i-1])
 		value := args[i]
-		redisObj, exists := db.GetEntity(key)
-		if exists {
+		redisObj, exists := db.LookupKeyWrite(key)
+		if exists && !obj.IsShared(redisObj) {
 			redisObj.ObjType = obj.RedisString
 			obj.StringObjSetValue(redisObj, value)
+			if shared := shareString(redisObj); shared != redisObj {
+				db.PutIfExists(key, shared)
+			}
 		} else {
-			db.PutEntity(key, obj.NewStringObject(value))
+			db.PutEntity(key, shareString(obj.NewStringObject(value)))
 		}
+		db.Notify(notifyString, "set", key)
 	}
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	conn.GetDb().Propagate(conn.GetCmdLine())
 	return MakeOkReply().WriteTo(conn)
 }
 
 // execGetDel getdel
 func execGetDel(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 1 || argNum > 1 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if !exists {
 		return MakeNullBulkReply().WriteTo(conn)
 	}
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 	conn.GetDb().Remove(key)
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	// 与 redis 一样传播 DEL, 从节点和 AOF 不需要读取的值
+	conn.GetDb().propagateDeletion(key, false)
+	conn.GetDb().Notify(notifyGeneric, "del", key)
 	valueBytes, _ := obj.StringObjEncoding(redisObj)
 	return MakeBulkReply(valueBytes).WriteTo(conn)
 }
 
+// execGetEx getex key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+// 读取 key 的同时设置或者移除过期时间. 只有修改了过期时间才传播, 过期时间转换为 pexpireat, 已经过去的时间传播删除
+func execGetEx(c context.Context, conn *Client) error {
+	args := conn.GetArgs()
+	key := string(args[0])
+	db := conn.GetDb()
+	when, persist := unlimitedTTL, false
+	for i := 1; i < len(args); i++ {
+		upper := strings.ToUpper(string(args[i]))
+		if "EX" == upper || "PX" == upper || "EXAT" == upper || "PXAT" == upper {
+			if when != unlimitedTTL || persist || i+1 >= len(args) {
+				return MakeSyntaxErr().WriteTo(conn)
+			}
+			ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return MakeNotIntegerErr().WriteTo(conn)
+			}
+			unit, basetime := unitSeconds, int64(0)
+			if upper[0] == 'P' {
+				unit = unitMilliseconds
+			}
+			if len(upper) == 2 {
+				basetime = db.clock.Now().UnixMilli()
+			}
+			millis, ok := expireMillis(ttlArg, unit, basetime)
+			if ttlArg <= 0 || !ok {
+				return MakeInvalidExpireTimeErr("getex").WriteTo(conn)
+			}
+			when = millis
+			i++
+		} else if "PERSIST" == upper {
+			if when != unlimitedTTL || persist {
+				return MakeSyntaxErr().WriteTo(conn)
+			}
+			persist = true
+		} else {
+			return MakeSyntaxErr().WriteTo(conn)
+		}
+	}
+	redisObj, exists := db.LookupKeyRead(key)
+	if !exists {
+		return MakeNullBulkReply().WriteTo(conn)
+	}
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
+	}
+	valueBytes, _ := obj.StringObjEncoding(redisObj)
+	if when != unlimitedTTL {
+		if when <= db.clock.Now().UnixMilli() && db.ExpirePolicy() == expireDelete {
+			lazy := config.Properties.LazyfreeLazyExpire
+			db.Delete(key, lazy)
+			db.propagateDeletion(key, lazy)
+			db.Notify(notifyGeneric, "del", key)
+		} else {
+			expireTime := time.UnixMilli(when)
+			db.ExpireV1(key, expireTime)
+			db.Propagate(util.MakeExpireCmd(key, expireTime))
+			db.Notify(notifyGeneric, "expire", key)
+		}
+	} else if persist {
+		if _, hasTTL := db.IsExpiredV1(key); hasTTL {
+			db.RemoveTTLV1(key)
+			db.Propagate(util.ToCmdLine("persist", key))
+			db.Notify(notifyGeneric, "persist", key)
+		}
+	}
+	return MakeBulkReply(valueBytes).WriteTo(conn)
+}
+
+// getExWrites 只有带了选项的 GETEX 修改过期时间
+func getExWrites(cmdLine [][]byte) bool {
+	return len(cmdLine) > 2
+}
+
 // execIncrBy incrby key increment
 func execIncrBy(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 2 || argNum > 2 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	increment, err := strconv.ParseInt(string(cmdData[1]), 10, 64)
-	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
-	}
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	increment, _ := strconv.ParseInt(string(cmdData[1]), 10, 64)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if !exists {
-		redisObj = obj.NewStringEmptyObj()
-		redisObj.Ptr = increment
-		redisObj.Encoding = obj.EncInt
-		conn.GetDb().PutEntity(key, redisObj)
-		conn.GetDb().AddAof(conn.GetCmdLine())
+		conn.GetDb().PutEntity(key, newIntObject(increment))
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyString, "incrby", key)
 		return MakeIntReply(increment).WriteTo(conn)
 	}
 
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply()
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
 
-	if redisObj.Encoding != obj.EncInt {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+	value, ok := obj.StringObjInt64(redisObj)
+	if !ok {
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
-
-	value := redisObj.Ptr.(int64)
 	if (increment > 0 && math.MaxInt64-increment < value) ||
 		(increment < 0 && math.MinInt64-increment > value) {
 		return MakeStandardErrReply(
@@ -452,43 +505,35 @@ func execIncrBy(c context.Context, conn *Client) error {
 		).WriteTo(conn)
 	}
 	value += increment
-	redisObj.Ptr = value
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	conn.GetDb().setInteger(key, redisObj, value)
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyString, "incrby", key)
 	return MakeIntReply(value).WriteTo(conn)
 }
 
 func execDecrBy(c context.Context, conn *Client) error {
-	argNum := conn.GetArgNum()
-	if argNum < 2 || argNum > 2 {
-		return MakeNumberOfArgsErrReply(conn.GetCmdName()).WriteTo(conn)
-	}
 	cmdData := conn.GetArgs()
 	key := string(cmdData[0])
-	decrement, err := strconv.ParseInt(string(cmdData[1]), 10, 64)
-	if err != nil {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
-	}
+	decrement, _ := strconv.ParseInt(string(cmdData[1]), 10, 64)
 	if decrement == math.MinInt64 {
 		return MakeStandardErrReply("ERR decrement would overflow").WriteTo(conn)
 	}
-	redisObj, exists := conn.GetDb().GetEntity(key)
+	redisObj, exists := conn.GetDb().LookupKeyWrite(key)
 	if !exists {
 		value := 0 - decrement
-		redisObj = obj.NewStringEmptyObj()
-		redisObj.Encoding = obj.EncInt
-		redisObj.Ptr = value
-		conn.GetDb().PutEntity(key, redisObj)
-		conn.GetDb().AddAof(conn.GetCmdLine())
+		conn.GetDb().PutEntity(key, newIntObject(value))
+		conn.GetDb().Propagate(conn.GetCmdLine())
+		conn.GetDb().Notify(notifyString, "incrby", key)
 		return MakeIntReply(value).WriteTo(conn)
 	}
 
-	if redisObj.ObjType != obj.RedisString {
-		return MakeWrongTypeErrReply().WriteTo(conn)
+	if !isString(redisObj) {
+		return MakeWrongTypeErr().WriteTo(conn)
 	}
-	if redisObj.Encoding != obj.EncInt {
-		return MakeOutOfRangeOrNotInt().WriteTo(conn)
+	value, ok := obj.StringObjInt64(redisObj)
+	if !ok {
+		return MakeNotIntegerErr().WriteTo(conn)
 	}
-	value := redisObj.Ptr.(int64)
 	if (decrement > 0 && math.MinInt64+decrement > value) ||
 		(decrement < 0 && (math.MaxInt64+decrement < value)) {
 		return MakeStandardErrReply(
@@ -496,23 +541,153 @@ func execDecrBy(c context.Context, conn *Client) error {
 		).WriteTo(conn)
 	}
 	value -= decrement
-	redisObj.Ptr = value
-	conn.GetDb().AddAof(conn.GetCmdLine())
+	conn.GetDb().setInteger(key, redisObj, value)
+	conn.GetDb().Propagate(conn.GetCmdLine())
+	conn.GetDb().Notify(notifyString, "incrby", key)
 	return MakeIntReply(value).WriteTo(conn)
 }
 
+// execIncrByFloat incrbyfloat key increment, 浮点数的结果转换为 SET KEEPTTL 写入 aof 和复制流, 重放时不受精度的影响
+func execIncrByFloat(c context.Context, conn *Client) error {
+	cmdData := conn.GetArgs()
+	key := string(cmdData[0])
+	increment, ok := util.ParseFloat(string(cmdData[1]))
+	if !ok {
+		return MakeNotFloatErr().WriteTo(conn)
+	}
+	db := conn.GetDb()
+	var value float64 = 0
+	redisObj, exists := db.LookupKeyWrite(key)
+	if exists {
+		if !isString(redisObj) {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		valueBytes, _ := obj.StringObjEncoding(redisObj)
+		if value, ok = util.ParseFloat(string(valueBytes)); !ok {
+			return MakeNotFloatErr().WriteTo(conn)
+		}
+	}
+	value += increment
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return MakeStandardErrReply("ERR increment would produce NaN or Infinity").WriteTo(conn)
+	}
+	result := []byte(util.FormatFloatHuman(value))
+	if exists {
+		redisObj = db.unshareString(key, redisObj)
+		obj.StringObjSetValue(redisObj, result)
+		if shared := shareString(redisObj); shared != redisObj {
+			db.PutIfExists(key, shared)
+		}
+	} else {
+		db.PutEntity(key, shareString(obj.NewStringObject(result)))
+	}
+	db.Propagate([][]byte{[]byte("set"), cmdData[0], result, []byte("KEEPTTL")})
+	db.Notify(notifyString, "incrbyfloat", key)
+	return MakeBulkReply(result).WriteTo(conn)
+}
+
+// checkStringLength APPEND/SETRANGE 之后的长度不能超过 proto-max-bulk-len
+func checkStringLength(conn *Client, length int64) bool {
+	if length > protoMaxBulkLen() {
+		_ = MakeStandardErrReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)").WriteTo(conn)
+		return false
+	}
+	return true
+}
+
+// execAppend append key value, 返回追加之后的长度
+func execAppend(c context.Context, conn *Client) error {
+	cmdData := conn.GetArgs()
+	key := string(cmdData[0])
+	value := cmdData[1]
+	db := conn.GetDb()
+	redisObj, exists := db.LookupKeyWrite(key)
+	var length int
+	if !exists {
+		db.PutEntity(key, shareString(obj.NewStringObject(value)))
+		length = len(value)
+	} else {
+		if !isString(redisObj) {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		current, _ := obj.StringObjEncoding(redisObj)
+		if !checkStringLength(conn, int64(len(current)+len(value))) {
+			return nil
+		}
+		redisObj = db.getDecodedForWrite(key, redisObj)
+		str, ok := redisObj.AsSds()
+		if !ok {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		str.SdsCat(value)
+		length = str.Len()
+	}
+	db.Propagate(conn.GetCmdLine())
+	db.Notify(notifyString, "append", key)
+	return MakeIntReply(int64(length)).WriteTo(conn)
+}
+
+// execSetRange setrange key offset value, 从 offset 开始覆盖, 超出原来长度的部分用0填充
+func execSetRange(c context.Context, conn *Client) error {
+	cmdData := conn.GetArgs()
+	key := string(cmdData[0])
+	offset, _ := strconv.ParseInt(string(cmdData[1]), 10, 64)
+	if offset < 0 {
+		return MakeStandardErrReply("ERR offset is out of range").WriteTo(conn)
+	}
+	value := cmdData[2]
+	db := conn.GetDb()
+	redisObj, exists := db.LookupKeyWrite(key)
+	var current []byte
+	if exists {
+		if !isString(redisObj) {
+			return MakeWrongTypeErr().WriteTo(conn)
+		}
+		current, _ = obj.StringObjEncoding(redisObj)
+	}
+	// 与 redis 一致, value 为空时不修改也不创建key
+	if len(value) == 0 {
+		return MakeIntReply(int64(len(current))).WriteTo(conn)
+	}
+	if !checkStringLength(conn, offset+int64(len(value))) {
+		return nil
+	}
+	// 总是写入新的 []byte, 原来的值可能还被命令参数或者复制流引用
+	length := util.MaxInt64(int64(len(current)), offset+int64(len(value)))
+	result := make([]byte, length)
+	copy(result, current)
+	copy(result[offset:], value)
+	if exists {
+		// 与 redis 一致, 修改之后是 raw 编码, 不重新转换为整数或者共享的对象
+		redisObj = db.getDecodedForWrite(key, redisObj)
+		redisObj.Ptr = sds.NewWithBytes(result)
+	} else {
+		db.PutEntity(key, obj.NewObject(obj.RedisString, sds.NewWithBytes(result)))
+	}
+	db.Propagate(conn.GetCmdLine())
+	db.Notify(notifyString, "setrange", key)
+	return MakeIntReply(length).WriteTo(conn)
+}
+
 func init() {
-	register("set", execSet)
-	register("get", execGet)
-	register("setnx", execSetNx)
-	register("strlen", execStrLen)
-	register("incr", execIncr)
-	register("decr", execDecr)
-	register("getset", execGetSet)
-	register("getrange", execGetRange)
-	register("mget", execMGet)
-	register("mset", execMSet)
-	register("getdel", execGetDel)
-	register("incrby", execIncrBy)
-	register("decrby", execDecrBy)
+	register("set", execSet, withArity(-3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("get", execGet, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("setex", execSetEx, withArity(4, intArgs(2)), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("psetex", execPSetEx, withArity(4, intArgs(2)), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("setnx", execSetNx, withArity(3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("strlen", execStrLen, withArity(2), withFlags(flagReadonly), withKeys(1, 1, 1))
+	register("incr", execIncr, withArity(2), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("decr", execDecr, withArity(2), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("getset", execGetSet, withArity(3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("getrange", execGetRange, withArity(4, intArgs(2, 3)), withFlags(flagReadonly), withKeys(1, 1, 1))
+	registerAlias("substr", "getrange")
+	register("mget", execMGet, withArity(-2), withFlags(flagReadonly), withKeys(1, -1, 1))
+	register("mset", execMSet, withArity(-3, pairArgs(1)), withFlags(flagWrite|flagDenyOOM), withKeys(1, -1, 2))
+	register("getdel", execGetDel, withArity(2), withFlags(flagWrite), withKeys(1, 1, 1))
+	register("getex", execGetEx, withArity(-2), withFlags(flagWrite), withKeys(1, 1, 1), withWriteIf(getExWrites))
+	register("incrby", execIncrBy, withArity(3, intArgs(2)), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("decrby", execDecrBy, withArity(3, intArgs(2)), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("incrbyfloat", execIncrByFloat, withArity(3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("append", execAppend, withArity(3), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
+	register("setrange", execSetRange, withArity(4, intArgs(2)), withFlags(flagWrite|flagDenyOOM), withKeys(1, 1, 1))
 }
@@ -0,0 +1,212 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetSet(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "getset", "foo", "a"))
+	assert.Equal(t, "$1\r\na\r\n", server.exec(t, client, "get", "foo"))
+
+	// 与 SET 一样清除过期时间
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "b", "ex", "100"))
+	assert.Equal(t, ":100\r\n", server.exec(t, client, "ttl", "foo"))
+	assert.Equal(t, "$1\r\nb\r\n", server.exec(t, client, "getset", "foo", "c"))
+	assert.Equal(t, ":-1\r\n", server.exec(t, client, "ttl", "foo"))
+	assert.Equal(t, "$1\r\nc\r\n", server.exec(t, client, "get", "foo"))
+
+	server.exec(t, client, "rpush", "list", "a")
+	assert.Equal(t, wrongTypeStr, server.exec(t, client, "getset", "list", "a"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'getset' command\r\n", server.exec(t, client, "getset", "foo"))
+}
+
+func TestSubstr(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "hello world")
+	assert.Equal(t, "$5\r\nworld\r\n", server.exec(t, client, "substr", "foo", "6", "-1"))
+	// 别名的错误中使用别名本身的名字
+	assert.Equal(t, "-ERR wrong number of arguments for 'substr' command\r\n", server.exec(t, client, "substr", "foo", "0"))
+}
+
+// stringModel 字符串命令的参考实现, key 不存在时 exists 为 false
+type stringModel struct {
+	value  []byte
+	exists bool
+}
+
+func (m *stringModel) incr() (int64, bool) {
+	value, err := strconv.ParseInt(string(m.value), 10, 64)
+	if m.exists && (err != nil || value == math.MaxInt64) {
+		return 0, false
+	}
+	m.value, m.exists = []byte(strconv.FormatInt(value+1, 10)), true
+	return value + 1, true
+}
+
+func (m *stringModel) append(value []byte) int {
+	m.value, m.exists = append(m.value, value...), true
+	return len(m.value)
+}
+
+func (m *stringModel) setRange(offset int, value []byte) int {
+	if len(value) == 0 {
+		return len(m.value)
+	}
+	for len(m.value) < offset+len(value) {
+		m.value = append(m.value, 0)
+	}
+	copy(m.value[offset:], value)
+	m.exists = true
+	return len(m.value)
+}
+
+func (m *stringModel) getRange(start, end int) []byte {
+	length := len(m.value)
+	if start < 0 {
+		start = length + start
+		if start < 0 {
+			start = 0
+		}
+	}
+	if end < 0 {
+		end = length + end
+	}
+	if start > end || start >= length {
+		return nil
+	}
+	if end >= length {
+		end = length - 1
+	}
+	return m.value[start : end+1]
+}
+
+func TestStringWriteInterleaved(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	rnd := rand.New(rand.NewSource(1210))
+	// 只使用 1-9 和 x, 整数的文本形式是唯一的
+	alphabet := []byte("123456789x")
+	randomValue := func() []byte {
+		value := make([]byte, rnd.Intn(3))
+		for i := range value {
+			value[i] = alphabet[rnd.Intn(len(alphabet))]
+		}
+		return value
+	}
+	for round := 0; round < 20; round++ {
+		server.exec(t, client, "del", "k")
+		// 另一个 key 引用同一个共享的对象, 修改 k 不能影响它
+		server.exec(t, client, "set", "other", "5")
+		model := &stringModel{}
+		if rnd.Intn(2) == 0 {
+			server.exec(t, client, "set", "k", "5")
+			model.value, model.exists = []byte("5"), true
+		}
+		for i := 0; i < 200; i++ {
+			switch rnd.Intn(4) {
+			case 0:
+				if value, ok := model.incr(); ok {
+					assert.Equal(t, ":"+strconv.FormatInt(value, 10)+"\r\n", server.exec(t, client, "incr", "k"))
+				} else {
+					assert.Equal(t, string(MakeNotIntegerErr().ToBytes()), server.exec(t, client, "incr", "k"))
+				}
+			case 1:
+				value := randomValue()
+				length := model.append(value)
+				assert.Equal(t, ":"+strconv.Itoa(length)+"\r\n", server.exec(t, client, "append", "k", string(value)))
+			case 2:
+				offset, value := rnd.Intn(8), randomValue()
+				length := model.setRange(offset, value)
+				assert.Equal(t, ":"+strconv.Itoa(length)+"\r\n",
+					server.exec(t, client, "setrange", "k", strconv.Itoa(offset), string(value)))
+			case 3:
+				start, end := rnd.Intn(12)-6, rnd.Intn(12)-6
+				expected := model.getRange(start, end)
+				assert.Equal(t, "$"+strconv.Itoa(len(expected))+"\r\n"+string(expected)+"\r\n",
+					server.exec(t, client, "getrange", "k", strconv.Itoa(start), strconv.Itoa(end)))
+			}
+			if model.exists {
+				assert.Equal(t, "$"+strconv.Itoa(len(model.value))+"\r\n"+string(model.value)+"\r\n", server.exec(t, client, "get", "k"))
+			}
+			assert.Equal(t, "$1\r\n5\r\n", server.exec(t, client, "get", "other"))
+		}
+	}
+	for i := int64(0); i < obj.SharedIntegers; i++ {
+		shared, _ := obj.SharedInteger(i)
+		assert.Equal(t, i, shared.Ptr)
+	}
+}
+
+func TestGetRangeAfterIncr(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "k", "12345")
+	assert.Equal(t, "$3\r\n234\r\n", server.exec(t, client, "getrange", "k", "1", "3"))
+	// int 编码的值每次读取时重新转换, 不会读到 INCR 之前的结果
+	assert.Equal(t, ":12346\r\n", server.exec(t, client, "incr", "k"))
+	assert.Equal(t, "$3\r\n346\r\n", server.exec(t, client, "getrange", "k", "2", "-1"))
+	// APPEND 之后是 raw 编码, 仍然可以 INCR
+	assert.Equal(t, ":6\r\n", server.exec(t, client, "append", "k", "5"))
+	assert.Equal(t, ":123466\r\n", server.exec(t, client, "incr", "k"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "setrange", "new", "0", "7"))
+	assert.Equal(t, ":8\r\n", server.exec(t, client, "incr", "new"))
+	assert.Equal(t, "$1\r\n8\r\n", server.exec(t, client, "getrange", "new", "0", "-1"))
+
+	// 不是标准形式的整数按照字符串保存
+	server.exec(t, client, "set", "zero", "04")
+	assert.Equal(t, "$2\r\n04\r\n", server.exec(t, client, "get", "zero"))
+	assert.Equal(t, string(MakeNotIntegerErr().ToBytes()), server.exec(t, client, "incr", "zero"))
+}
+
+func TestIncrByFloatFormat(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	// 与 redis 一样结果不使用科学计数法
+	server.exec(t, client, "set", "big", "1e19")
+	assert.Equal(t, "$20\r\n20000000000000000000\r\n", server.exec(t, client, "incrbyfloat", "big", "1e19"))
+	server.exec(t, client, "set", "exp", "5.0e3")
+	assert.Equal(t, "$4\r\n5000\r\n", server.exec(t, client, "incrbyfloat", "exp", "0"))
+	server.exec(t, client, "set", "zero", "-0")
+	assert.Equal(t, "$1\r\n0\r\n", server.exec(t, client, "incrbyfloat", "zero", "0"))
+	// NaN 不是合法的浮点数, 无穷大可以解析但是不能保存
+	assert.Equal(t, string(MakeNotFloatErr().ToBytes()), server.exec(t, client, "incrbyfloat", "exp", "nan"))
+	assert.Equal(t, "-ERR increment would produce NaN or Infinity\r\n", server.exec(t, client, "incrbyfloat", "exp", "+inf"))
+	assert.Equal(t, "$4\r\n5000\r\n", server.exec(t, client, "get", "exp"))
+}
+
+func TestGetEx(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "getex", "foo", "ex", "100"))
+	server.exec(t, client, "set", "foo", "bar")
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "getex", "foo"))
+	assert.Equal(t, ":-1\r\n", server.exec(t, client, "ttl", "foo"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "getex", "foo", "EX", "100"))
+	assert.Equal(t, ":100\r\n", server.exec(t, client, "ttl", "foo"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "getex", "foo", "persist"))
+	assert.Equal(t, ":-1\r\n", server.exec(t, client, "ttl", "foo"))
+	at := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "getex", "foo", "pxat", at))
+	assert.Equal(t, ":3600\r\n", server.exec(t, client, "ttl", "foo"))
+
+	// 已经过去的时间删除 key
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "getex", "foo", "exat", "1"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "foo"))
+
+	server.exec(t, client, "set", "foo", "bar")
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "getex", "foo", "ex", "10", "persist"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "getex", "foo", "ex"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "getex", "foo", "keepttl"))
+	assert.Equal(t, "-ERR invalid expire time in 'getex' command\r\n", server.exec(t, client, "getex", "foo", "px", "0"))
+	assert.Equal(t, string(MakeNotIntegerErr().ToBytes()), server.exec(t, client, "getex", "foo", "ex", "a"))
+	assert.Equal(t, ":-1\r\n", server.exec(t, client, "ttl", "foo"))
+}
@@ -3,33 +3,427 @@ package redis
 import (
 	"context"
 	"errors"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 var (
 	ErrorCommandNotFund = errors.New("command not found")
+	// ErrorInvalidKeyArgs 参数不能确定key的位置, 比如 EVAL 的 numkeys 不是整数或者超过了参数的个数
+	ErrorInvalidKeyArgs = errors.New("invalid arguments specified for command")
 	commandRouter       = make(map[string]*Command)
 )
 
+// 命令的标记, 与redis server.h 中的 CMD_* 对应
+const (
+	flagWrite        = 1 << iota // 会修改数据
+	flagReadonly                 // 只读取数据
+	flagNoScript                 // 不允许在lua脚本中执行
+	flagMayReplicate             // 可能产生写入, 比如脚本. 暂停写命令时同样暂停
+	flagDenyOOM                  // 可能增加内存, 超过 maxmemory 并且不能淘汰时拒绝执行
+	flagAdmin                    // 管理命令, COMMAND INFO 中属于 @admin 和 @dangerous 分类
+	flagLoading                  // 启动加载数据期间可以执行, 都不读写数据
+	flagStale                    // 从节点和主节点断开时可以执行. 还没有 replica-serve-stale-data, 只在 COMMAND INFO 中显示
+	flagNoLoad                   // 不读取 key 的值(与 redis key-spec 的 RM 对应), 执行之前不从 storage-backend 读取, 见 processCommand
+)
+
 type Process func(ctx context.Context, conn *Client) error
 
 type Command struct {
 	name    string
 	process Process
+	flags   int
+	// arity 与 redis 一致, 包括命令名本身的参数个数: 正数表示必须正好这么多个, 负数表示至少 -arity 个
+	arity int
+	// validators 参数个数正确之后执行命令之前的检查, 比如整数参数和成对的参数
+	validators []argValidator
+	// firstKey lastKey keyStep 描述命令行中key的位置, lastKey为负数表示从末尾倒数
+	firstKey int
+	lastKey  int
+	keyStep  int
+	// keyExtractor key的位置取决于参数的命令(比如 SORT 的 STORE, EVAL 的 numkeys)返回key在命令行中的下标, 设置之后代替 firstKey lastKey keyStep
+	keyExtractor func(cmdLine [][]byte) ([]int, error)
+	// writeIf 带有 flagWrite 的命令只有部分参数会修改数据时(比如 GETEX 的 EX, SORT 的 STORE)判断这次调用是不是写入
+	writeIf func(cmdLine [][]byte) bool
+	// stats INFO commandstats 和 INFO latencystats 的统计
+	stats *commandStats
+	// replacedBy 废弃的命令名替代它的命令, 见 registerAlias
+	replacedBy string
+}
+
+type cmdOption func(cmd *Command)
+
+// argValidator 检查命令行的参数, 不通过时返回错误回复. 检查过的参数命令中可以直接解析, 不需要再处理错误
+type argValidator func(cmd *Command, cmdLine [][]byte) Reply
+
+// withArity 设置参数个数, 执行命令之前统一检查, 不满足时回复 wrong number of arguments
+func withArity(arity int, validators ...argValidator) cmdOption {
+	return func(cmd *Command) {
+		cmd.arity = arity
+		cmd.validators = validators
+	}
 }
 
-func register(name string, process Process) {
+// intArgs 命令行中指定位置的参数必须是64位整数
+func intArgs(positions ...int) argValidator {
+	return func(cmd *Command, cmdLine [][]byte) Reply {
+		for _, position := range positions {
+			if position >= len(cmdLine) {
+				continue
+			}
+			if _, err := strconv.ParseInt(string(cmdLine[position]), 10, 64); err != nil {
+				return MakeNotIntegerErr()
+			}
+		}
+		return nil
+	}
+}
+
+// pairArgs 从 first 开始的参数必须成对出现, 比如 MSET 的 key value 和 HSET 的 field value
+func pairArgs(first int) argValidator {
+	return func(cmd *Command, cmdLine [][]byte) Reply {
+		if len(cmdLine) <= first || (len(cmdLine)-first)%2 != 0 {
+			return MakeNumberOfArgsErrReply(cmd.name)
+		}
+		return nil
+	}
+}
+
+// withFlags 设置命令的标记
+func withFlags(flags int) cmdOption {
+	return func(cmd *Command) {
+		cmd.flags |= flags
+	}
+}
+
+// withKeys 设置命令中key的位置
+func withKeys(first, last, step int) cmdOption {
+	return func(cmd *Command) {
+		cmd.firstKey = first
+		cmd.lastKey = last
+		cmd.keyStep = step
+	}
+}
+
+// withKeyExtractor 设置取出命令中的key的下标的方法, 与 redis 的 getkeys_proc 一致
+func withKeyExtractor(keyExtractor func(cmdLine [][]byte) ([]int, error)) cmdOption {
+	return func(cmd *Command) {
+		cmd.keyExtractor = keyExtractor
+	}
+}
+
+// withWriteIf 设置判断一次调用是否写入的方法. COMMAND INFO 中命令仍然是 write,
+// 只读的从节点, 只读的脚本和暂停写命令时按照这次调用的参数判断
+func withWriteIf(writeIf func(cmdLine [][]byte) bool) cmdOption {
+	return func(cmd *Command) {
+		cmd.writeIf = writeIf
+	}
+}
+
+func register(name string, process Process, opts ...cmdOption) {
+	if len(name) > maxCommandNameLen {
+		panic("command name too long: " + name)
+	}
 	cmd := &Command{
 		name:    strings.ToLower(name),
 		process: process,
+		stats:   &commandStats{},
+	}
+	for _, opt := range opts {
+		opt(cmd)
 	}
-	commandRouter[name] = cmd
+	commandRouter[cmd.name] = cmd
+}
+
+// registerAlias 把废弃的命令名 alias 注册为 canonical 的别名, 共用实现, 参数个数, 标记和 key 的位置.
+// 别名有自己的名字和统计, 错误, COMMAND INFO 和 INFO commandstats 中使用别名本身的名字
+func registerAlias(alias, canonical string) {
+	target, ok := commandRouter[canonical]
+	if !ok {
+		panic("alias " + alias + " of unknown command " + canonical)
+	}
+	cmd := *target
+	cmd.name = strings.ToLower(alias)
+	cmd.stats = &commandStats{}
+	cmd.replacedBy = target.name
+	commandRouter[cmd.name] = &cmd
 }
 
 func router(name string) (*Command, error) {
+	if cmd, ok := commandRouter[name]; ok {
+		return cmd, nil
+	}
 	lowerName := strings.ToLower(name)
 	if cmd, ok := commandRouter[lowerName]; ok {
 		return cmd, nil
 	}
 	return nil, ErrorCommandNotFund
 }
+
+// maxCommandNameLen 最长的命令名, 超过的一定不是注册的命令
+const maxCommandNameLen = 32
+
+// lookupCommand 不区分大小写查找命令, 不存在时返回 nil. 执行命令时调用, 不分配内存:
+// map 的下标是 string(name) 时不会复制, 有大写字母时在栈上的缓冲区中转换成小写
+func lookupCommand(name []byte) *Command {
+	if cmd, ok := commandRouter[string(name)]; ok {
+		return cmd
+	}
+	if len(name) > maxCommandNameLen {
+		return nil
+	}
+	var buf [maxCommandNameLen]byte
+	lower := buf[:len(name)]
+	changed := false
+	for i, b := range name {
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+			changed = true
+		}
+		lower[i] = b
+	}
+	if !changed {
+		return nil
+	}
+	return commandRouter[string(lower)]
+}
+
+// equalFoldASCII name 是不是 lowerName 的大写或者小写形式, lowerName 都是小写
+func equalFoldASCII(name []byte, lowerName string) bool {
+	if len(name) != len(lowerName) {
+		return false
+	}
+	for i, b := range name {
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		if b != lowerName[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkArity 命令行的参数个数是否满足 arity, 没有设置 arity 的命令由命令自己检查
+func (c *Command) checkArity(argc int) bool {
+	if c.arity > 0 {
+		return argc == c.arity
+	}
+	return argc >= -c.arity
+}
+
+// validate 执行命令之前检查参数个数和参数的格式, 返回 nil 表示可以执行
+func (c *Command) validate(cmdLine [][]byte) Reply {
+	if !c.checkArity(len(cmdLine)) {
+		return MakeNumberOfArgsErrReply(c.name)
+	}
+	for _, validator := range c.validators {
+		if reply := validator(c, cmdLine); reply != nil {
+			return reply
+		}
+	}
+	return nil
+}
+
+func (c *Command) IsWrite() bool {
+	return c.flags&flagWrite != 0
+}
+
+// IsWriteFor 这次调用是否会修改数据, 没有设置 writeIf 时与 IsWrite 一致
+func (c *Command) IsWriteFor(cmdLine [][]byte) bool {
+	if !c.IsWrite() {
+		return false
+	}
+	return c.writeIf == nil || c.writeIf(cmdLine)
+}
+
+func (c *Command) IsReadonly() bool {
+	return c.flags&flagReadonly != 0
+}
+
+func (c *Command) IsNoScript() bool {
+	return c.flags&flagNoScript != 0
+}
+
+func (c *Command) MayReplicate() bool {
+	return c.flags&flagMayReplicate != 0
+}
+
+func (c *Command) IsDenyOOM() bool {
+	return c.flags&flagDenyOOM != 0
+}
+
+func (c *Command) IsAdmin() bool {
+	return c.flags&flagAdmin != 0
+}
+
+func (c *Command) IsLoading() bool {
+	return c.flags&flagLoading != 0
+}
+
+func (c *Command) IsStale() bool {
+	return c.flags&flagStale != 0
+}
+
+func (c *Command) IsNoLoad() bool {
+	return c.flags&flagNoLoad != 0
+}
+
+// MovableKeys key的位置是否取决于参数, 与 redis 的 CMD_MOVABLE_KEYS 一致
+func (c *Command) MovableKeys() bool {
+	return c.keyExtractor != nil
+}
+
+// KeyPositions 按照key的位置返回命令行中每个key的下标, 参数不能确定key的位置时返回 ErrorInvalidKeyArgs
+func (c *Command) KeyPositions(cmdLine [][]byte) ([]int, error) {
+	if c.keyExtractor != nil {
+		return c.keyExtractor(cmdLine)
+	}
+	if c.firstKey <= 0 || c.firstKey >= len(cmdLine) {
+		return nil, nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last = len(cmdLine) + last
+	}
+	if last >= len(cmdLine) {
+		last = len(cmdLine) - 1
+	}
+	step := c.keyStep
+	if step <= 0 {
+		step = 1
+	}
+	positions := make([]int, 0, (last-c.firstKey)/step+1)
+	for i := c.firstKey; i <= last; i += step {
+		positions = append(positions, i)
+	}
+	return positions, nil
+}
+
+// GetKeys 按照key的位置从命令行中取出所有的key, 参数不能确定key的位置时返回 nil
+func (c *Command) GetKeys(cmdLine [][]byte) [][]byte {
+	positions, err := c.KeyPositions(cmdLine)
+	if err != nil || len(positions) == 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, len(positions))
+	for _, position := range positions {
+		keys = append(keys, cmdLine[position])
+	}
+	return keys
+}
+
+// numKeysExtractor numkeys 在命令行下标 numKeysIndex 处, 后面紧跟着 numkeys 个 key, 比如 EVAL 和 FCALL
+func numKeysExtractor(numKeysIndex int) func(cmdLine [][]byte) ([]int, error) {
+	return func(cmdLine [][]byte) ([]int, error) {
+		if numKeysIndex >= len(cmdLine) {
+			return nil, ErrorInvalidKeyArgs
+		}
+		numKeys, err := strconv.Atoi(string(cmdLine[numKeysIndex]))
+		if err != nil || numKeys < 0 || numKeys > len(cmdLine)-numKeysIndex-1 {
+			return nil, ErrorInvalidKeyArgs
+		}
+		positions := make([]int, 0, numKeys)
+		for i := 0; i < numKeys; i++ {
+			positions = append(positions, numKeysIndex+1+i)
+		}
+		return positions, nil
+	}
+}
+
+// maxSuggestions 未知命令的错误回复中最多附带的相近命令个数
+const maxSuggestions = 3
+
+// suggestCommands 与 name 相近的已注册命令, 用于未知命令的错误回复. 编辑距离不超过
+// suggestDistance 或者 name 是命令名的前缀, 按照距离和名字排序, 返回大写的命令名.
+// 不包括废弃的别名和内部命令, name 不短于 maxCommandNameLen 时不计算
+func suggestCommands(name string) []string {
+	if name == "" || len(name) >= maxCommandNameLen {
+		return nil
+	}
+	name = strings.ToLower(name)
+	limit := suggestDistance(len(name))
+	type candidate struct {
+		name     string
+		distance int
+	}
+	candidates := make([]candidate, 0, maxSuggestions)
+	for cmdName, cmd := range commandRouter {
+		if cmd.replacedBy != "" || cmdName == "ttlops" {
+			continue
+		}
+		distance := levenshtein(name, cmdName, limit)
+		if distance > limit {
+			if len(name) < 3 || !strings.HasPrefix(cmdName, name) {
+				continue
+			}
+			// 前缀排在编辑距离之后
+			distance = limit + 1
+		}
+		candidates = append(candidates, candidate{name: cmdName, distance: distance})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	if len(candidates) > maxSuggestions {
+		candidates = candidates[:maxSuggestions]
+	}
+	suggestions := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		suggestions = append(suggestions, strings.ToUpper(c.name))
+	}
+	return suggestions
+}
+
+// suggestDistance 允许的编辑距离, 很短的名字只允许差一个字符, 避免任意的输入都有建议
+func suggestDistance(n int) int {
+	if n <= 4 {
+		return 1
+	}
+	return 2
+}
+
+// levenshtein a 和 b 的编辑距离, 超过 limit 时返回 limit+1
+func levenshtein(a, b string, limit int) int {
+	if diff := len(a) - len(b); diff > limit || -diff > limit {
+		return limit + 1
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			cur[j] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	if prev[len(b)] > limit {
+		return limit + 1
+	}
+	return prev[len(b)]
+}
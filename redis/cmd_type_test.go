@@ -0,0 +1,176 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/list"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+)
+
+func TestCommandArity(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	for name, cmd := range commandRouter {
+		assert.NotZero(t, cmd.arity, "%s has no arity", name)
+		// 没有参数也可以执行的命令(SHUTDOWN, FLUSHALL 等)不在这里执行
+		if cmd.checkArity(1) {
+			continue
+		}
+		assert.NotPanics(t, func() {
+			assert.Equal(t, "-ERR wrong number of arguments for '"+name+"' command\r\n", server.exec(t, client, name))
+		}, name)
+	}
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", server.exec(t, client, "GET", "a", "b"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'mset' command\r\n", server.exec(t, client, "mset", "a", "1", "b"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'hset' command\r\n", server.exec(t, client, "hset", "h", "f", "v", "f2"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", server.exec(t, client, "incrby", "a", "x"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", server.exec(t, client, "getrange", "a", "0", "x"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "a"))
+}
+
+func TestLookupCommand(t *testing.T) {
+	get := commandRouter["get"]
+	assert.Same(t, get, lookupCommand([]byte("get")))
+	assert.Same(t, get, lookupCommand([]byte("GeT")))
+	assert.Same(t, commandRouter["getrange"], lookupCommand([]byte("GETRANGE")))
+	assert.Nil(t, lookupCommand([]byte("nosuchcmd")))
+	assert.Nil(t, lookupCommand([]byte("")))
+	assert.Nil(t, lookupCommand([]byte(strings.Repeat("G", maxCommandNameLen+1))))
+	for _, name := range []string{"get", "GET"} {
+		cmdName := []byte(name)
+		assert.Zero(t, testing.AllocsPerRun(100, func() { lookupCommand(cmdName) }), name)
+	}
+
+	// 连接重复发送同一个命令时使用上一次的结果, 大小写不同也可以命中
+	client := NewClient(0, nil, true)
+	assert.Same(t, get, client.resolveCommand([]byte("GET")))
+	assert.Same(t, get, client.lastLookup)
+	assert.Same(t, get, client.resolveCommand([]byte("get")))
+	assert.Nil(t, client.resolveCommand([]byte("gets")))
+	assert.Same(t, get, client.lastLookup)
+	client.curCommand = [][]byte{[]byte("GET"), []byte("foo")}
+	assert.Equal(t, "get", client.GetCmdName())
+	assert.Zero(t, testing.AllocsPerRun(100, func() { client.GetCmdName() }))
+	client.curCommand = [][]byte{[]byte("NoSuchCmd")}
+	assert.Equal(t, "nosuchcmd", client.GetCmdName())
+
+	server := newTestServer()
+	conn, _ := server.newClient()
+	assert.Equal(t, "-ERR unknown command 'nosuchcmd', with args beginning with: 'a'\r\n", server.exec(t, conn, "NoSuchCmd", "a"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, conn, "SeT", "foo", "bar"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, conn, "GET", "foo"))
+	assert.Contains(t, clientInfoString(conn), " cmd=get ")
+}
+
+func TestSuggestCommands(t *testing.T) {
+	server := newTestServer()
+	conn, _ := server.newClient()
+	reply := server.exec(t, conn, "HGETAL", "h")
+	assert.True(t, strings.HasPrefix(reply, "-ERR unknown command 'hgetal', with args beginning with: 'h'. Did you mean HGETALL"), reply)
+	assert.Equal(t, "HGETALL", suggestCommands("hgetal")[0])
+	assert.LessOrEqual(t, len(suggestCommands("hgetal")), maxSuggestions)
+	// 前缀
+	assert.Equal(t, []string{"INCRBY", "INCRBYFLOAT"}, suggestCommands("incrbyf"))
+	// 相差很远的名字没有建议
+	reply = server.exec(t, conn, "\x8f\x01zq\xfe")
+	assert.True(t, strings.HasPrefix(reply, "-ERR unknown command"), reply)
+	assert.NotContains(t, reply, "Did you mean")
+	assert.Empty(t, suggestCommands("qwxzkvbn"))
+	assert.Empty(t, suggestCommands(strings.Repeat("g", maxCommandNameLen)))
+	// 废弃的别名和内部命令不作为建议
+	assert.NotContains(t, suggestCommands("ttlop"), "TTLOPS")
+
+	config.Properties.SuggestCommands = false
+	defer func() { config.Properties.SuggestCommands = true }()
+	assert.Equal(t, "-ERR unknown command 'hgetal', with args beginning with: 'h'\r\n", server.exec(t, conn, "HGETAL", "h"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, conn, "config", "set", "suggest-commands", "yes"))
+	assert.Contains(t, server.exec(t, conn, "HGETAL"), "Did you mean HGETALL")
+}
+
+func TestCommandArityFromScript(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "-ERR Wrong number of args calling Redis command from script\r\n",
+		server.exec(t, client, "eval", "return redis.pcall('get')", "0"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n",
+		server.exec(t, client, "eval", "return redis.pcall('incrby', 'a', 'x')", "0"))
+}
+
+// wrongTypeFamilies 每一类命令中有代表性的命令, key 的位置是 $key
+var wrongTypeFamilies = map[string][][]string{
+	"string": {{"get", "$key"}, {"strlen", "$key"}, {"append", "$key", "x"}, {"incr", "$key"}, {"incrbyfloat", "$key", "1.5"},
+		{"getrange", "$key", "0", "-1"}, {"setrange", "$key", "0", "x"}, {"getset", "$key", "x"}, {"getdel", "$key"},
+		{"getex", "$key"}, {"getex", "$key", "ex", "100"}},
+	"list": {{"lpush", "$key", "x"}, {"rpush", "$key", "x"}, {"lpop", "$key"}, {"rpop", "$key", "2"}, {"lrange", "$key", "0", "-1"},
+		{"llen", "$key"}, {"lindex", "$key", "0"}, {"blpop", "$key", "0.01"}, {"brpop", "$key", "0.01"}},
+	"set": {{"sadd", "$key", "x"}, {"smembers", "$key"}, {"scard", "$key"}, {"srem", "$key", "x"}, {"spop", "$key"},
+		{"sinter", "$key"}, {"sunion", "$key"}, {"sinterstore", "dst", "$key"}, {"sunionstore", "dst", "$key"}},
+	"hash": {{"hset", "$key", "f", "v"}, {"hget", "$key", "f"}, {"hgetall", "$key"}},
+}
+
+const wrongTypeReply = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+// wrongTypeCmd 把 $key 替换成 key
+func wrongTypeCmd(cmd []string, key string) []string {
+	cmdLine := make([]string, len(cmd))
+	for i, arg := range cmd {
+		cmdLine[i] = strings.ReplaceAll(arg, "$key", key)
+	}
+	return cmdLine
+}
+
+// TestWrongTypeMatrix 每种类型(和编码)的 key 执行其他类型的命令时回复 WRONGTYPE, 不会 panic, 也不修改 key
+func TestWrongTypeMatrix(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	keys := map[string][][]string{
+		"string": {{"set", "embstr", "hello"}, {"set", "int", "10"}, {"set", "raw", strings.Repeat("x", 64)}},
+		"list":   {{"rpush", "list", "a", "b"}},
+		"set":    {{"sadd", "intset", "1", "2"}, {"sadd", "hashtable", "a"}},
+		"hash":   {{"hset", "hash", "f", "v"}},
+	}
+	for typeName, creates := range keys {
+		for _, create := range creates {
+			server.exec(t, client, create...)
+			key := create[1]
+			dump := server.exec(t, client, "dump", key)
+			for family, cmds := range wrongTypeFamilies {
+				if family == typeName {
+					continue
+				}
+				for _, cmd := range cmds {
+					cmdLine := wrongTypeCmd(cmd, key)
+					assert.NotPanics(t, func() {
+						assert.Equal(t, wrongTypeReply, server.exec(t, client, cmdLine...), "%v", cmdLine)
+					})
+				}
+			}
+			if typeName == "string" || typeName == "hash" {
+				assert.Equal(t, wrongTypeReply, server.exec(t, client, "sort", key), key)
+			}
+			assert.Equal(t, "+"+typeName+"\r\n", server.exec(t, client, "type", key))
+			assert.Equal(t, dump, server.exec(t, client, "dump", key), key)
+		}
+	}
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "dst"))
+
+	// 类型和值不一致的对象(比如加载了还不支持的编码)执行这个类型的命令也只回复 WRONGTYPE
+	broken := map[string]*obj.RedisObject{
+		"string": {ObjType: obj.RedisString, Encoding: obj.EncRaw},
+		"list":   {ObjType: obj.RedisList, Encoding: obj.EncZipList, Ptr: []byte("ziplist")},
+		"set":    {ObjType: obj.RedisSet, Encoding: obj.EncIntSet, Ptr: list.NewLinked()},
+		"hash":   {ObjType: obj.RedisHash, Encoding: obj.EncZipList, Ptr: []byte("ziplist")},
+	}
+	for typeName, value := range broken {
+		server.dbs[0].PutEntity("broken", value)
+		for _, cmd := range wrongTypeFamilies[typeName] {
+			cmdLine := wrongTypeCmd(cmd, "broken")
+			assert.NotPanics(t, func() {
+				assert.Equal(t, wrongTypeReply, server.exec(t, client, cmdLine...), "%v", cmdLine)
+			})
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"bytes"
 	"container/list"
 	"errors"
 	"fmt"
@@ -28,6 +29,8 @@ type Codec struct {
 	decodeForArray bool
 	// argsBuf 缓存已经解码的数据
 	argsBuf [][]byte
+	// commandSize 当前命令已经解码的参数的字节数
+	commandSize int
 }
 
 func (c *Codec) Decode(conn gnet.Conn, commands *list.List) error {
@@ -59,12 +62,15 @@ func appendReply(reply []byte, commands *list.List, c *Codec) {
 		if c.remainingBulkCount <= 0 {
 			c.decodeForArray = false
 			commands.PushBack(c.argsBuf)
-			c.argsBuf = make([][]byte, 0)
+			c.argsBuf = nil
+			c.commandSize = 0
 		}
 	} else {
 		commands.PushBack([][]byte{reply})
 	}
 }
+
+// handleDecodeError 协议错误之后流已经无法同步, 调用方回复错误之后需要关闭连接
 func handleDecodeError(err error, c *Codec) error {
 	// 如果err是 黏包/半包 就直接返回，否则就把接收到的包丢弃
 	if errors.Is(err, ErrIncompletePacket) {
@@ -132,14 +138,32 @@ func (c *Codec) decodeLength(conn gnet.Conn) ([]byte, error) {
 	}
 	switch c.messageType {
 	case ArrayHeader:
+		if length > maxMultiBulkLength {
+			return nil, NewErrProtocol("invalid multibulk length")
+		}
+		c.resetDecoder()
+		if length <= 0 {
+			// 与 redis 一致, 空的数组直接忽略
+			c.decodeForArray = false
+			return nil, nil
+		}
 		// 记录下这个array需要解码的bulk
 		c.remainingBulkCount = int(length)
-		c.resetDecoder()
+		// 参数的切片一次分配好, 数据到达之前最多预先分配 maxPreallocArgs 个
+		if length > maxPreallocArgs {
+			length = maxPreallocArgs
+		}
+		c.argsBuf = make([][]byte, 0, length)
 		return nil, nil
 	case BulkString:
-		if length > RedisMessageMaxLength {
+		if length < 0 || length > protoMaxBulkLen() {
 			return nil, NewErrProtocol("invalid bulk length")
 		}
+		// 数据到达之前不分配内存, 这里只检查整条命令的大小
+		if c.commandSize+int(length) > queryBufferLimit() {
+			return nil, NewErrProtocol("command exceeds client-query-buffer-limit")
+		}
+		c.commandSize += int(length)
 		c.remainingBulkLength = int(length)
 		bulkLine, err := c.decodeBulkString(conn)
 		return bulkLine, err
@@ -194,6 +218,19 @@ func (c *Codec) readLine(conn gnet.Conn) ([]byte, error) {
 		// 没有读取到有效的line
 		return nil, ErrIncompletePacket
 	}
+	if index < 0 {
+		// 一直没有换行的数据不能无限缓存
+		if len(buff) > maxInlineSize {
+			return nil, c.tooBigLine()
+		}
+		return nil, ErrIncompletePacket
+	}
+	if index > maxInlineSize {
+		return nil, c.tooBigLine()
+	}
+	if index == 0 || buff[index-1] != '\r' {
+		return nil, NewErrProtocol("line without CRLF")
+	}
 
 	crIndex := index - 1
 	data := make([]byte, crIndex)
@@ -207,21 +244,25 @@ func (c *Codec) readLine(conn gnet.Conn) ([]byte, error) {
 	return data, nil
 }
 
-func peekBytes(conn gnet.Conn, b byte) ([]byte, int, error) {
-	offset := 0
-	for {
-		buf, err := conn.Peek(offset + 1) // 从偏移位置读取切片并增加长度
-		if err != nil {
-			return nil, 0, err
-		}
-
-		// 检查我们刚刚读取的最后一个字节
-		if buf[offset] == b {
-			return buf, offset, nil
-		}
+// tooBigLine 超过 maxInlineSize 还没有读到换行, 与 redis 的错误信息一致
+func (c *Codec) tooBigLine() error {
+	switch c.messageType {
+	case ArrayHeader:
+		return NewErrProtocol("too big mbulk count string")
+	case BulkString:
+		return NewErrProtocol("too big bulk count string")
+	default:
+		return NewErrProtocol("too big inline request")
+	}
+}
 
-		offset++ // 如果不是要找的字节，则继续增加偏移量
+// peekBytes 查找已经接收的数据中第一个 b 的位置, 没有找到时 index 是 -1
+func peekBytes(conn gnet.Conn, b byte) ([]byte, int, error) {
+	buf, err := conn.Peek(-1)
+	if err != nil {
+		return nil, 0, err
 	}
+	return buf, bytes.IndexByte(buf, b), nil
 }
 
 func (c *Codec) readEndOfLine(conn gnet.Conn) error {
@@ -251,9 +292,17 @@ func (c *Codec) resetDecoder() {
 
 func (c *Codec) Reset() {
 	c.resetDecoder()
+	c.decodeForArray = false
+	c.remainingBulkCount = 0
+	c.commandSize = 0
 	c.argsBuf = make([][]byte, 0)
 }
 
+// Pending 是否有一条命令只解码了一部分
+func (c *Codec) Pending() bool {
+	return c.state != DecodeType || c.decodeForArray
+}
+
 func NewCodec() *Codec {
 	return &Codec{
 		argsBuf: make([][]byte, 0),
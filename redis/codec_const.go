@@ -3,13 +3,30 @@ package redis
 import (
 	"errors"
 	"fmt"
+	"github.com/xuning888/godis-tiny/config"
 )
 
-var (
-	ErrIncompletePacket         = errors.New("incomplete packet")
-	RedisMessageMaxLength int64 = 512 * 1024 * 1024
+var ErrIncompletePacket = errors.New("incomplete packet")
+
+const (
+	// maxMultiBulkLength 一条命令最多的参数数量
+	maxMultiBulkLength = 1024 * 1024
+	// maxPreallocArgs 收到数组的长度时最多预先分配的参数个数, 更多的参数随着数据到达增长
+	maxPreallocArgs = 1024
+	// maxInlineSize 一行(inline 命令和 * $ 的长度)最多的字节数, 与 redis 的 PROTO_INLINE_MAX_SIZE 一致
+	maxInlineSize = 64 * 1024
 )
 
+// protoMaxBulkLen 单个参数的上限 proto-max-bulk-len
+func protoMaxBulkLen() int64 {
+	return int64(config.Properties.ProtoMaxBulkLen)
+}
+
+// queryBufferLimit 一条命令所有参数加起来的上限 client-query-buffer-limit
+func queryBufferLimit() int {
+	return config.Properties.QueryBufferLimit
+}
+
 type State int
 
 const (
@@ -14,6 +14,39 @@ import (
 type Payload struct {
 	Data  Reply
 	Error error
+	// Offset 读取完这个 payload 之后在流中的位置
+	Offset int64
+}
+
+// offsetReader 记录已经读取的字节数, 用于定位aof中出错的位置
+type offsetReader struct {
+	*bufio.Reader
+	offset int64
+}
+
+func (r *offsetReader) ReadBytes(delim byte) ([]byte, error) {
+	line, err := r.Reader.ReadBytes(delim)
+	r.offset += int64(len(line))
+	// 读到一半遇到EOF说明数据被截断了
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return line, err
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// readFull 读取bulk string的内容, 这时候遇到EOF都是数据被截断了
+func (r *offsetReader) readFull(buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 func makePayload(data Reply, err error) *Payload {
@@ -34,19 +67,28 @@ func DecodeInStream(r io.Reader) chan *Payload {
 func decodeStream(r io.Reader, ch chan<- *Payload) {
 	defer func() {
 		if err := recover(); err != nil {
-			logger.Error(err, string(debug.Stack()))
+			logger.Errorf("decode stream panic: %v\n%s", err, debug.Stack())
 		}
 	}()
-	reader := bufio.NewReader(r)
+	reader := &offsetReader{Reader: bufio.NewReader(r)}
+	send := func(data Reply, err error) {
+		payload := makePayload(data, err)
+		payload.Offset = reader.offset
+		ch <- payload
+	}
 	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			ch <- makePayload(nil, err)
+			send(nil, err)
 			close(ch)
 			return
 		}
 		length := len(line)
-		if length <= 2 || line[length-2] != '\r' {
+		if length <= 2 {
+			continue
+		}
+		if line[length-2] != '\r' {
+			send(nil, errors.New("protocol error: line without CRLF"))
 			continue
 		}
 		copyLine := make([]byte, length)
@@ -55,81 +97,88 @@ func decodeStream(r io.Reader, ch chan<- *Payload) {
 		cmd := copyLine[0]
 		switch cmd {
 		case '+':
-			ch <- makePayload(MakeSimpleReply(copyLine[1:]), nil)
+			send(MakeSimpleReply(copyLine[1:]), nil)
 		case '-':
-			ch <- makePayload(MakeStandardErrReply(string(copyLine[1:])), nil)
+			send(MakeStandardErrReply(string(copyLine[1:])), nil)
 		case ':':
 			value, err := strconv.ParseInt(string(copyLine[1:]), 10, 64)
 			if err != nil {
-				ch <- protocolErrPayload("illegal number " + string(copyLine[1:]))
+				send(nil, protocolErr("illegal number "+string(copyLine[1:])))
 			} else {
-				ch <- makePayload(MakeIntReply(value), nil)
+				send(MakeIntReply(value), nil)
 			}
 		case '$':
 			strLen, err := strconv.ParseInt(string(copyLine[1:]), 10, 64)
 			if err != nil || strLen < -1 {
-				ch <- protocolErrPayload("illegal bulk string header: " + string(copyLine))
+				send(nil, protocolErr("illegal bulk string header: "+string(copyLine)))
+			} else if strLen > protoMaxBulkLen() {
+				send(nil, protocolErr("invalid bulk length"))
 			} else if strLen == -1 {
-				ch <- makePayload(MakeNullBulkReply(), nil)
+				send(MakeNullBulkReply(), nil)
 			} else {
 				body := make([]byte, strLen+2)
-				_, err = io.ReadFull(reader, body)
-				if err != nil {
-					ch <- makePayload(nil, err)
+				if err = reader.readFull(body); err != nil {
+					send(nil, err)
 				} else {
-					ch <- makePayload(MakeBulkReply(body[:len(body)-2]), nil)
+					send(MakeBulkReply(body[:len(body)-2]), nil)
 				}
 			}
 		case '*':
-			decodeInStreamArray(copyLine[1:], reader, ch)
+			reply, err := decodeInStreamArray(copyLine[1:], reader)
+			send(reply, err)
 		default:
-			args := bytes.Split(line, []byte{' '})
-			ch <- makePayload(MakeMultiBulkReply(args), nil)
+			send(nil, protocolErr("unexpected line "+strconv.Quote(string(copyLine))))
 		}
 	}
 }
 
-func decodeInStreamArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) {
+func decodeInStreamArray(header []byte, reader *offsetReader) (Reply, error) {
 	nStrs, err := strconv.ParseInt(string(header), 10, 64)
 	if err != nil || nStrs < 0 {
-		ch <- protocolErrPayload("illegal number " + string(header[1:]))
-		return
+		return nil, protocolErr("illegal number " + string(header))
+	} else if nStrs > maxMultiBulkLength {
+		return nil, protocolErr("invalid multibulk length")
 	} else if nStrs == 0 {
-		ch <- makePayload(MakeEmptyMultiBulkReply(), nil)
-		return
+		return MakeEmptyMultiBulkReply(), nil
 	}
-	lines := make([][]byte, 0, nStrs)
+	// 参数到达之前只预先分配一小部分
+	capacity := nStrs
+	if capacity > 1024 {
+		capacity = 1024
+	}
+	lines := make([][]byte, 0, capacity)
 	for i := int64(0); i < nStrs; i++ {
 		var line []byte
 		line, err = reader.ReadBytes('\n')
 		if err != nil {
-			ch <- makePayload(nil, err)
-			return
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
 		}
 		length := len(line)
 		if length < 4 || line[length-2] != '\r' || line[0] != '$' {
-			ch <- protocolErrPayload("illegal bulk string header " + string(line))
-			return
+			return nil, protocolErr("illegal bulk string header " + string(line))
 		}
-		copyLine := make([]byte, length)
-		copy(copyLine, line)
 		strLen, err := strconv.ParseInt(string(line[1:length-2]), 10, 64)
 		if err != nil || strLen < -1 {
-			ch <- protocolErrPayload("illegal number " + string(line))
-			return
+			return nil, protocolErr("illegal number " + string(line))
+		} else if strLen > protoMaxBulkLen() {
+			return nil, protocolErr("invalid bulk length")
 		} else if strLen == -1 {
 			lines = append(lines, []byte{})
 		} else {
 			body := make([]byte, strLen+2)
-			_, err := io.ReadFull(reader, body)
-			if err != nil {
-				ch <- makePayload(nil, err)
-				return
+			if err = reader.readFull(body); err != nil {
+				return nil, err
+			}
+			if body[strLen] != '\r' || body[strLen+1] != '\n' {
+				return nil, protocolErr("bulk string is not terminated by CRLF")
 			}
 			lines = append(lines, body[:len(body)-2:len(body)-2])
 		}
 	}
-	ch <- makePayload(MakeMultiBulkReply(lines), nil)
+	return MakeMultiBulkReply(lines), nil
 }
 
 func parseArray(header []byte, reader *bufio.Reader) (*Payload, error) {
@@ -176,5 +225,9 @@ func parseArray(header []byte, reader *bufio.Reader) (*Payload, error) {
 }
 
 func protocolErrPayload(errMsg string) *Payload {
-	return makePayload(nil, errors.New("protocol error: "+errMsg))
+	return makePayload(nil, protocolErr(errMsg))
+}
+
+func protocolErr(errMsg string) error {
+	return errors.New("protocol error: " + errMsg)
 }
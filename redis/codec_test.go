@@ -0,0 +1,99 @@
+package redis
+
+import (
+	"github.com/panjf2000/gnet/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// traffic 模拟客户端发送数据之后触发的 OnTraffic
+func traffic(server *testServer, conn *fakeConn, data string) (gnet.Action, string) {
+	conn.in.WriteString(data)
+	woken := conn.woken
+	action := server.OnTraffic(conn)
+	// 和 event loop 一样, 让出之后再次触发 OnTraffic 执行队列中剩下的命令
+	for action == gnet.None && conn.woken > woken {
+		woken = conn.woken
+		action = server.OnTraffic(conn)
+	}
+	return action, conn.take()
+}
+
+func TestCodecHostileInput(t *testing.T) {
+	server := newTestServer()
+	cases := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"huge multibulk", "*4294967295\r\n", "invalid multibulk length"},
+		{"multibulk over limit", "*1048577\r\n", "invalid multibulk length"},
+		{"huge bulk", "*1\r\n$10737418240\r\n", "invalid bulk length"},
+		{"negative bulk", "*1\r\n$-5\r\n", "invalid bulk length"},
+		{"endless multibulk count", "*" + strings.Repeat("1", maxInlineSize+1), "too big mbulk count string"},
+		{"endless bulk count", "*1\r\n$" + strings.Repeat("1", maxInlineSize+1), "too big bulk count string"},
+		{"endless inline", strings.Repeat("a", maxInlineSize+1), "too big inline request"},
+		{"bulk without crlf", "*1\r\n$3\r\nfoobar\r\n", "Protocol error"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, conn := server.newClient()
+			action, out := traffic(server, conn, c.input)
+			// 流已经无法同步, 回复错误之后关闭连接
+			assert.Equal(t, gnet.Close, action)
+			assert.True(t, strings.HasPrefix(out, "-ERR Protocol error: "), out)
+			assert.Contains(t, out, c.err)
+		})
+	}
+}
+
+func TestCodecBoundedMemory(t *testing.T) {
+	server := newTestServer()
+	_, conn := server.newClient()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	// 长度合法但是数据还没有到达, 不能提前分配
+	action, out := traffic(server, conn, "*2\r\n$536870000\r\nabc")
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, "", out)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestCodecQueryBufferLimit(t *testing.T) {
+	defer func(limit int) {
+		config.Properties.QueryBufferLimit = limit
+	}(config.Properties.QueryBufferLimit)
+	server := newTestServer()
+	client, conn := server.newClient()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "client-query-buffer-limit", "10"))
+	// 单个参数没有超过限制, 整条命令超过了
+	action, out := traffic(server, conn, "*3\r\n$3\r\nset\r\n$4\r\nfoo1\r\n$6\r\nfoobar\r\n")
+	assert.Equal(t, gnet.Close, action)
+	assert.Equal(t, "-ERR Protocol error: command exceeds client-query-buffer-limit\r\n", out)
+}
+
+func TestCodecPipeline(t *testing.T) {
+	server := newTestServer()
+	_, conn := server.newClient()
+	// 空的数组被忽略, 之后的命令正常执行; 一条命令分多次到达
+	action, out := traffic(server, conn, "*0\r\n*1\r\n$4\r\nping\r\n*2\r\n$4\r\nping")
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, "+PONG\r\n", out)
+	action, out = traffic(server, conn, "\r\n$2\r\nhi\r\n")
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, "$2\r\nhi\r\n", out)
+}
+
+func TestDecodeStreamLimits(t *testing.T) {
+	// aof 和复制流使用的解码器同样不能按照对方声明的长度分配内存
+	for _, input := range []string{"*1\r\n$10737418240\r\n", "$10737418240\r\n", "*4294967295\r\n"} {
+		payload := <-DecodeInStream(strings.NewReader(input))
+		assert.NotNil(t, payload.Error, input)
+		assert.Contains(t, payload.Error.Error(), "invalid", input)
+	}
+}
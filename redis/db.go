@@ -1,28 +1,85 @@
 package redis
 
 import (
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/clock"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/ttl"
 	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/pkg/util"
 	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 访问已经过期的key时的处理方式
+const (
+	// expireDelete 主节点删除过期的key, 并且把 DEL 追加到 aof 和复制流
+	expireDelete = iota
+	// expireHide 从节点不删除过期的key, 普通客户端读取时当作不存在, 等待主节点的 DEL
+	expireHide
+	// expireKeep 从节点执行主节点的命令时不检查过期时间
+	expireKeep
+)
+
+// dbClock 之后创建的 db 使用的时钟, 与配置一样是进程级别的, 在创建 server 之前通过 SetClock 修改
+var dbClock = clock.Real
+
+// SetClock 修改过期时间, TTL 和 LRU/LFU 访问时间使用的时钟, 测试中可以用 clock.Manual 控制 key 的过期. c 为 nil 时使用系统时钟
+func SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real
+	}
+	dbClock = c
+	obj.SetClock(c)
+}
+
 type DB struct {
 	Index    int
 	data     dict.Dict
 	ttlCache ttl.Cache
-	AddAof   func(cmdline [][]byte)
+	// clock 计算过期时间和剩余的 TTL, 应该和 ttlCache 使用同一个时钟
+	clock clock.Clock
+	// Propagate 记录写命令的效果, 命令执行完成之后写入 aof 和复制流, 由 server 绑定
+	Propagate func(cmdline [][]byte)
+	// Notify 发布 keyspace event, 由 server 绑定
+	Notify func(class int, event string, key string)
+	// SignalFlushed db 被清空之后调用, 由 server 绑定
+	SignalFlushed func()
+	// SignalReady 写入了 list, 唤醒等待这个 key 的 BLPOP/BRPOP, 由 server 绑定
+	SignalReady func(key string)
+	// ExpirePolicy 访问过期的key时的处理方式, 由 server 绑定
+	ExpirePolicy func() int
+	// stats keyspace_hits, keyspace_misses 和 expired_keys, 由 server 绑定为所有 db 共用的统计
+	stats *serverStats
+	lg    logger.Logger
+	// keys key 的个数, 每次修改 data 之后更新, /metrics 不持有锁读取
+	keys atomic.Int64
+	// cow 有快照的时候为 true, 写命令修改快照引用的对象之前先复制
+	cow       atomic.Bool
+	snapMux   sync.Mutex
+	snapshots []*dbSnapshot
 }
 
-func NewDB(index int, data dict.Dict, cache ttl.Cache) *DB {
+func NewDB(index int, data dict.Dict, cache ttl.Cache, c clock.Clock) *DB {
 	db := &DB{
-		Index:    index,
-		data:     data,
-		ttlCache: cache,
-		AddAof:   func(cmdline [][]byte) {},
+		Index:         index,
+		data:          data,
+		ttlCache:      cache,
+		clock:         c,
+		Propagate:     func(cmdline [][]byte) {},
+		Notify:        func(class int, event string, key string) {},
+		SignalFlushed: func() {},
+		SignalReady:   func(key string) {},
+		ExpirePolicy:  func() int { return expireDelete },
+		stats:         &serverStats{},
+		lg:            logger.Named("db"),
 	}
+	db.updateKeys()
 	return db
 }
 
@@ -32,12 +89,33 @@ func (db *DB) Keys() []string {
 	return db.data.Keys()
 }
 
+// randomKeyMaxTries 从节点不删除过期的key, 与 redis 一样尝试这么多次还没有找到没有过期的key时返回过期的key
+const randomKeyMaxTries = 100
+
+// RandomKey 随机返回一个没有过期的key, 选中的过期key按照 PeekEntity 处理之后重新选择
+func (db *DB) RandomKey() (string, bool) {
+	for tries := 1; db.data.Len() > 0; tries++ {
+		key := db.data.RandomKeys(1)[0]
+		if _, exists := db.PeekEntity(key); exists {
+			return key, true
+		}
+		if db.ExpirePolicy() != expireDelete && tries >= randomKeyMaxTries {
+			return key, true
+		}
+	}
+	return "", false
+}
+
 func (db *DB) ForEach(cb func(key string, data *obj.RedisObject, expiration *time.Time) bool) {
 	db.data.ForEach(func(key string, val interface{}) bool {
 		entity, _ := val.(*obj.RedisObject)
 		var expiration *time.Time = nil
 		expired, exists := db.ttlCache.IsExpired(key)
-		if exists && !expired {
+		if exists && expired {
+			// 已经过期还没有被清理的key
+			return true
+		}
+		if exists {
 			expireTime := db.ttlCache.ExpireAt(key)
 			expiration = &expireTime
 		}
@@ -45,18 +123,116 @@ func (db *DB) ForEach(cb func(key string, data *obj.RedisObject, expiration *tim
 	})
 }
 
-// GetEntity getData
+// swap 用 other 中的数据替换当前db的数据, 用于加载 rdb
+func (db *DB) swap(other *DB) {
+	db.data, other.data = other.data, db.data
+	db.ttlCache, other.ttlCache = other.ttlCache, db.ttlCache
+	db.updateKeys()
+	other.updateKeys()
+	db.SignalFlushed()
+}
+
+// GetEntity 更新访问信息, 不计入命中率. 命令查找key使用 LookupKeyRead 和 LookupKeyWrite, 这里只用于命令内部的查找
 func (db *DB) GetEntity(key string) (*obj.RedisObject, bool) {
-	row, exists := db.data.Get(key)
+	entity, exists := db.PeekEntity(key)
+	if exists {
+		touchEntity(entity)
+	}
+	return entity, exists
+}
+
+// LookupKeyRead 读命令查找key, 和 GetEntity 一样更新访问信息, 并计入 keyspace_hits/keyspace_misses.
+// 从节点不删除过期的key, 只是当作不存在, 等待主节点的 DEL. 读取值失败时 panic storageError, 见 processCommand
+func (db *DB) LookupKeyRead(key string) (*obj.RedisObject, bool) {
+	entity, exists, err := db.peekEntity(key)
+	if err != nil {
+		panic(&storageError{key: key, err: err})
+	}
+	if exists {
+		touchEntity(entity)
+		db.stats.keyspaceHits.Add(1)
+	} else {
+		db.stats.keyspaceMisses.Add(1)
+	}
+	return entity, exists
+}
+
+// LookupKeyWrite 写命令查找key, 不计入命中率. 过期的key当作不存在, 并且删除值和过期时间, 之后的写入从空的值开始,
+// 过期的数据和过期时间不会复活. 与 redis 一样, 可写的从节点(replica-read-only no)执行客户端的写命令时不等待主节点的 DEL,
+// 在本地删除; 执行主节点的命令时(expireKeep)不检查过期时间. 读取值失败时和 LookupKeyRead 一样 panic
+func (db *DB) LookupKeyWrite(key string) (*obj.RedisObject, bool) {
+	entity, exists, err := db.lookupKeyWrite(key)
+	if err != nil {
+		panic(&storageError{key: key, err: err})
+	}
+	return entity, exists
+}
+
+// lookupKeyWrite 同 LookupKeyWrite, 读取值失败时返回错误, 用于不在命令中的查找(比如唤醒阻塞的客户端)
+func (db *DB) lookupKeyWrite(key string) (*obj.RedisObject, bool, error) {
+	if db.ExpirePolicy() == expireHide {
+		if expired, _ := db.ttlCache.IsExpired(key); expired {
+			db.RemoveExpired(key)
+			return nil, false, nil
+		}
+	}
+	entity, exists, err := db.peekEntity(key)
+	if exists {
+		touchEntity(entity)
+	}
+	return entity, exists, err
+}
+
+// PeekEntity 和 GetEntity 一样处理过期的key, 但是不更新访问信息. 读取值失败的key当作不存在
+func (db *DB) PeekEntity(key string) (*obj.RedisObject, bool) {
+	entity, exists, _ := db.peekEntity(key)
+	return entity, exists
+}
+
+// peekEntity 同 PeekEntity, storage-backend 读取值失败时返回错误
+func (db *DB) peekEntity(key string) (*obj.RedisObject, bool, error) {
+	row, exists, err := db.load(key)
 	if !exists {
-		return nil, false
+		return nil, false, err
+	}
+	if expired, _ := db.ttlCache.IsExpired(key); expired {
+		switch db.ExpirePolicy() {
+		case expireDelete:
+			db.expire(key)
+			return nil, false, nil
+		case expireHide:
+			return nil, false, nil
+		}
 	}
 	entity, _ := row.(*obj.RedisObject)
-	return entity, true
+	return entity, true, nil
 }
 
-func (db *DB) PutEntity(key string, obj *obj.RedisObject) int {
-	return db.data.Put(key, obj)
+// load 读取 key 的值, 实现了 dict.Loader 的 storage-backend 读取失败时返回错误
+func (db *DB) load(key string) (interface{}, bool, error) {
+	if loader, ok := db.data.(dict.Loader); ok {
+		return loader.Load(key)
+	}
+	row, exists := db.data.Get(key)
+	return row, exists, nil
+}
+
+func (db *DB) PutEntity(key string, entity *obj.RedisObject) int {
+	// 与 redis 一致, 覆盖写入时保留原来的访问频率, 频繁写入的key不会因为每次重新计数而被淘汰
+	if obj.LFUEnabled() {
+		if old, exists := db.data.Get(key); exists && old.(*obj.RedisObject) != entity && !obj.IsShared(entity) {
+			entity.LRU = old.(*obj.RedisObject).LRU
+		}
+	}
+	result := db.data.Put(key, entity)
+	if result > 0 {
+		db.updateKeys()
+		db.Notify(notifyNew, "new", key)
+	}
+	if entity.ObjType == obj.RedisList {
+		db.SignalReady(key)
+	}
+	return result
 }
 
 func (db *DB) PutIfExists(key string, entity *obj.RedisObject) int {
@@ -64,7 +240,12 @@ func (db *DB) PutIfExists(key string, entity *obj.RedisObject) int {
 }
 
 func (db *DB) PutIfAbsent(key string, entity *obj.RedisObject) int {
-	return db.data.PutIfAbsent(key, entity)
+	result := db.data.PutIfAbsent(key, entity)
+	if result > 0 {
+		db.updateKeys()
+		db.Notify(notifyNew, "new", key)
+	}
+	return result
 }
 
 // Remove 删除数据
@@ -72,10 +253,35 @@ func (db *DB) Remove(key string) int {
 	result := db.data.Remove(key)
 	if result > 0 {
 		db.ttlCache.Remove(key)
+		db.updateKeys()
 	}
 	return result
 }
 
+// RemoveExpired 删除已经过期的key, 并发布 expired 事件
+func (db *DB) RemoveExpired(key string) {
+	if db.Delete(key, config.Properties.LazyfreeLazyExpire) > 0 {
+		db.stats.expiredKeys.Add(1)
+		db.Notify(notifyExpired, "expired", key)
+	}
+}
+
+// expire 主节点删除过期的key, 和 redis 一样追加 DEL, 从节点收到之后才删除
+func (db *DB) expire(key string) {
+	db.RemoveExpired(key)
+	db.propagateDeletion(key, config.Properties.LazyfreeLazyExpire)
+}
+
+// propagateDeletion 过期和淘汰删除key之后追加到 aof 和复制流, 与 redis 的 propagateDeletion 一致:
+// lazy 时追加 UNLINK, 从节点同样在后台释放值, 否则追加 DEL. 从节点执行时不检查过期时间, 总是删除
+func (db *DB) propagateDeletion(key string, lazy bool) {
+	if lazy {
+		db.Propagate(util.ToCmdLine("unlink", key))
+		return
+	}
+	db.Propagate(util.ToCmdLine("del", key))
+}
+
 func (db *DB) Removes(keys ...string) (deleted int) {
 	deleted = 0
 	for _, key := range keys {
@@ -92,17 +298,9 @@ func (db *DB) Len() int {
 	return db.data.Len()
 }
 
-// Exists 返回一组key是否存在
-// eg: k1 -> v1, k2 -> v2。 input: k1 k2 return 2
-func (db *DB) Exists(keys []string) int64 {
-	var result int64 = 0
-	for _, key := range keys {
-		_, ok := db.data.Get(key)
-		if ok {
-			result++
-		}
-	}
-	return result
+// updateKeys 修改 data 之后调用, 调用方持有锁
+func (db *DB) updateKeys() {
+	db.keys.Store(int64(db.data.Len()))
 }
 
 func (db *DB) Flush() {
@@ -110,11 +308,24 @@ func (db *DB) Flush() {
 	if length > 0 {
 		db.data.Clear()
 		db.ttlCache.Clear()
+		db.updateKeys()
 	}
+	db.SignalFlushed()
 }
 
 /* ---- Data TTL ----- */
 
+// RemoveAllExpired 删除所有已经过期的key, 用于aof加载完成之后
+func (db *DB) RemoveAllExpired() (removed int) {
+	for _, key := range db.data.Keys() {
+		if expired, _ := db.ttlCache.IsExpired(key); expired {
+			db.RemoveExpired(key)
+			removed++
+		}
+	}
+	return removed
+}
+
 // ExpireV1 为key设置过期时间
 func (db *DB) ExpireV1(key string, expireTime time.Time) {
 	db.ttlCache.Expire(key, expireTime)
@@ -136,7 +347,7 @@ func (db *DB) ExpiredAt(key string) time.Time {
 
 // RandomCheckTTLAndClear 随机检查一组key的过期时间，如果key已经过期了，那么清理key
 func (db *DB) RandomCheckTTLAndClear() {
-	if db.data.Len() == 0 {
+	if db.data.Len() == 0 || db.ExpirePolicy() != expireDelete {
 		return
 	}
 	randLimit := rand.Intn(db.data.Len() + 1)
@@ -147,12 +358,12 @@ func (db *DB) RandomCheckTTLAndClear() {
 	for _, key := range keys {
 		expired, exists := db.ttlCache.IsExpired(key)
 		if !exists {
-			logger.Debugf("ttl check, db%d key: %s, 没有设置过期时间", db.Index, key)
+			db.lg.Debugf("ttl check, db%d key: %q, 没有设置过期时间", db.Index, key)
 			continue
 		}
 		if expired {
-			logger.Debugf("ttl check, db%d key: %s, 过期了", db.Index, key)
-			db.Remove(key)
+			db.lg.Debugf("ttl check, db%d key: %q, 过期了", db.Index, key)
+			db.expire(key)
 		}
 	}
 }
@@ -161,10 +372,12 @@ func (db *DB) RandomCheckTTLAndClear() {
 // ttlCache按照key的过期时间组织了一个小根堆, Peek方法可以查看堆顶元素。随机检查几个堆定元元素,直到遇到没有过期的key
 // 优点: 清理的更加及时 缺点: 使用了Peek方法，暴露了底层的实现细节是PQ
 func (db *DB) RandomCheckTTLAndClearV1() {
-	if db.data.Len() == 0 {
+	// 从节点不主动删除过期的key
+	if db.data.Len() == 0 || db.ExpirePolicy() != expireDelete {
 		return
 	}
-	randLimit := rand.Intn(db.data.Len() + 1)
+	// 至少检查一次堆顶, 保证过期的key能够被及时清理
+	randLimit := rand.Intn(db.data.Len()) + 1
 	for i := 0; i < randLimit; i++ {
 		item := db.ttlCache.Peek()
 		if item == nil {
@@ -172,10 +385,29 @@ func (db *DB) RandomCheckTTLAndClearV1() {
 		}
 		expired, _ := db.ttlCache.IsExpired(item.Key)
 		if expired {
-			logger.Debugf("ttl check, db%d key: %s, 过期了", db.Index, item.Key)
-			db.Remove(item.Key)
+			db.lg.Debugf("ttl check, db%d key: %q, 过期了", db.Index, item.Key)
+			db.expire(item.Key)
 		} else {
 			break
 		}
 	}
 }
+
+// avgTTLSamples INFO keyspace 估算 avg_ttl 时每个 db 最多抽取的key的个数, 不遍历所有设置了过期时间的key
+const avgTTLSamples = 100
+
+// InfoKeyspace 与 redis 一致只输出有key的 db, expires 是设置了过期时间的key的个数, avg_ttl 是抽样估算的平均剩余时间(毫秒).
+// 在执行命令时调用, 持有锁
+func (r *RedisServer) InfoKeyspace() string {
+	var builder strings.Builder
+	builder.WriteString("# Keyspace\r\n")
+	for _, mdb := range r.dbs {
+		keys := mdb.data.Len()
+		if keys == 0 {
+			continue
+		}
+		fmt.Fprintf(&builder, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n",
+			mdb.Index, keys, mdb.ttlCache.Len(), mdb.ttlCache.AvgTTL(avgTTLSamples).Milliseconds())
+	}
+	return builder.String()
+}
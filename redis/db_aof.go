@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
 	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/pkg/rdb"
 	"github.com/xuning888/godis-tiny/pkg/util"
 	"io"
 	"os"
@@ -13,30 +16,55 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	// aofBufferSize aof缓冲区大小16MB
+	// aofBufferSize 缓冲区超过16MB时不再等待写入协程, 直接写入文件
 	aofBufferSize = 1 << 24
-	_             = iota
+	// aofMaxPostpone everysec 模式下后台 fsync 没有完成时, 最多推迟写入2秒
+	aofMaxPostpone = 2 * time.Second
+	_              = iota
 	none
 	rewrite
 )
 
+// aofFile aof 文件, 测试中可以替换为注入错误的文件
+type aofFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// FileBuffer aof 缓冲区, 命令先追加到内存中, 由写入协程写到文件
 type FileBuffer struct {
-	file   *os.File
-	writer *bufio.Writer
+	file  aofFile
+	buf   []byte
+	limit int
 }
 
-// Write
-// 写入缓冲区，如果p的大小大于了缓冲区的可用大小
+// Write 追加到缓冲区, 不会失败
 func (f *FileBuffer) Write(p []byte) (int, error) {
-	return f.writer.Write(p)
+	f.buf = append(f.buf, p...)
+	return len(p), nil
+}
+
+// Flush 把缓冲区写到文件, 写入失败时保留没有写入的数据, 磁盘恢复之后重试
+func (f *FileBuffer) Flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	n, err := f.file.Write(f.buf)
+	if err == nil && n < len(f.buf) {
+		err = io.ErrShortWrite
+	}
+	f.buf = append(f.buf[:0], f.buf[n:]...)
+	return err
 }
 
 func (f *FileBuffer) Sync() error {
-	err := f.writer.Flush()
+	err := f.Flush()
 	if err != nil {
 		return err
 	}
@@ -48,13 +76,18 @@ func (f *FileBuffer) Close() error {
 }
 
 func (f *FileBuffer) Buffered() int {
-	return f.writer.Buffered()
+	return len(f.buf)
+}
+
+// Full 缓冲区超过上限
+func (f *FileBuffer) Full() bool {
+	return len(f.buf) >= f.limit
 }
 
-func NewFileBuffer(f *os.File, bufSize int) *FileBuffer {
+func NewFileBuffer(f aofFile, bufSize int) *FileBuffer {
 	return &FileBuffer{
-		file:   f,
-		writer: bufio.NewWriterSize(f, bufSize),
+		file:  f,
+		limit: bufSize,
 	}
 }
 
@@ -70,14 +103,23 @@ type Exec func(ctx context.Context, conn *Client) error
 
 type ForEach func(i int, fun func(key string, object *obj.RedisObject, expiration *time.Time) bool)
 
+// ForEachLibrary 遍历 FUNCTION LOAD 加载的函数库的代码
+type ForEachLibrary func(fun func(code []byte) bool)
+
 // Aof persistence
 type Aof struct {
-	status      uint32
-	exec        Exec
-	tempDbMaker func() (Exec, ForEach)
-	each        ForEach
-	// aofFilename aof文件名称
-	aofFilename string
+	status uint32
+	exec   Exec
+	// takeSnapshot 重写时创建当前数据的快照, 调用方持有锁
+	takeSnapshot func() *Snapshot
+	// dirname appenddirname 目录
+	dirname string
+	// filename appendfilename, 目录中的文件都以它为前缀
+	filename string
+	// manifest 当前的 base 和 incr 文件, 写入总是追加到最新的 incr 文件
+	manifest *aofManifest
+	// writeManifest 持久化 manifest, 测试中可以模拟更新 manifest 之前宕机
+	writeManifest func(m *aofManifest) error
 	// aofFsync
 	aofFsync string
 	// aofFile
@@ -92,29 +134,75 @@ type Aof struct {
 	lg logger.Logger
 	// mux
 	mux sync.Mutex
-	// lastRewriteAofSize
+	// lastRewriteAofSize 上一次重写之后 base 文件的大小
 	lastRewriteAofSize int64
+	// currentSize base 和所有 incr 文件的大小, 包括缓冲区中还没有写到文件的数据
+	currentSize int64
+	// lastRewriteErr 上一次重写的结果
+	lastRewriteErr error
+	// rewrites 启动以来完成的重写次数
+	rewrites int64
+	// flushCh 通知写入协程把缓冲区写到文件
+	flushCh chan struct{}
+	// writeErr 最近一次写入或者fsync的错误, 不为空时拒绝执行写命令
+	writeErr atomic.Value
+	// fsyncing 后台 fsync 正在执行
+	fsyncing atomic.Bool
+	// progress 加载的进度, 绑定到 server 之后不为空
+	progress *loadingProgress
+	// dirty 上一次 fsync 之后有新的写入
+	dirty bool
+	// postponedAt 因为后台 fsync 没有完成而推迟写入的开始时间
+	postponedAt time.Time
+	// delayedFsync 推迟写入超过 aofMaxPostpone 的次数
+	delayedFsync int64
 }
 
-// CurrentAofSize aof file size
-func (a *Aof) CurrentAofSize() (int64, error) {
-	stat, err := os.Stat(a.aofFilename)
-	if err != nil {
-		return 0, err
+// aofError 包装一下, atomic.Value 不能保存 nil
+type aofError struct {
+	err error
+}
+
+// CurrentAofSize base 和所有 incr 文件的大小
+func (a *Aof) CurrentAofSize() int64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.currentSize
+}
+
+// statFiles 文件实际的大小, 打开和加载 aof 之后用来初始化 currentSize
+func (a *Aof) statFiles() int64 {
+	var size int64 = 0
+	for _, info := range a.manifest.files() {
+		if stat, err := os.Stat(filepath.Join(a.dirname, info.name)); err == nil {
+			size += stat.Size()
+		}
 	}
-	return stat.Size(), nil
+	return size
+}
+
+// LastRewriteError 上一次重写失败的错误, 没有重写过或者重写成功时返回nil
+func (a *Aof) LastRewriteError() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.lastRewriteErr
+}
+
+// Rewrites 启动以来完成的重写次数
+func (a *Aof) Rewrites() int64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.rewrites
 }
 
-// LasAofRewriteSize last aof file size
+// LasAofRewriteSize 上一次重写之后 base 文件的大小
 func (a *Aof) LasAofRewriteSize() int64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
 	return a.lastRewriteAofSize
 }
 
 func (a *Aof) AppendAof(dbIndex int, cmdLine [][]byte) {
-	if a.fileBuffer == nil {
-		return
-	}
-
 	if cmdLine == nil || len(cmdLine) == 0 {
 		return
 	}
@@ -125,115 +213,306 @@ func (a *Aof) AppendAof(dbIndex int, cmdLine [][]byte) {
 func (a *Aof) writeAof(dbIndex int, cmdLine [][]byte) {
 	a.mux.Lock()
 	defer a.mux.Unlock()
+	// 加载aof的时候不写入
+	if a.fileBuffer == nil {
+		return
+	}
 	if dbIndex != a.currentDb {
 		selectCmd := util.ToCmdLine("SELECT", strconv.Itoa(dbIndex))
-		selectData := MakeMultiBulkReply(selectCmd).ToBytes()
-		_, err := a.fileBuffer.Write(selectData)
-		if err != nil {
-			// 切换db失败
-			a.lg.Errorf("write aof file buffer failed with error: %v", err)
-			return
-		}
+		n, _ := a.fileBuffer.Write(MakeMultiBulkReply(selectCmd).ToBytes())
+		a.currentSize += int64(n)
 		a.currentDb = dbIndex
 	}
-	cmdLineData := MakeMultiBulkReply(cmdLine).ToBytes()
-	// 写入文件缓冲区
-	_, err := a.fileBuffer.Write(cmdLineData)
-	if err != nil {
-		a.lg.Errorf("write aof file buffer failed with error: %v", err)
-	}
+	n, _ := a.fileBuffer.Write(MakeMultiBulkReply(cmdLine).ToBytes())
+	a.currentSize += int64(n)
 
-	// 如果模式是always,就将内存中的数据拷贝到磁盘
+	// always 模式在回复客户端之前把数据写到磁盘
 	if a.aofFsync == FsyncAlways {
-		err = a.fileBuffer.Sync()
-		if err != nil {
-			a.lg.Errorf("wirte aof file sync fialed with error: %v", err)
+		a.setWriteErr(a.fileBuffer.Sync())
+		return
+	}
+	if a.fileBuffer.Full() {
+		a.setWriteErr(a.fileBuffer.Flush())
+		a.dirty = true
+		return
+	}
+	select {
+	case a.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// WriteError 最近一次写入aof失败的错误, 磁盘恢复之后返回nil
+func (a *Aof) WriteError() error {
+	if v, ok := a.writeErr.Load().(aofError); ok {
+		return v.err
+	}
+	return nil
+}
+
+func (a *Aof) setWriteErr(err error) {
+	prev := a.WriteError()
+	if err != nil && prev == nil {
+		a.lg.Errorf("write aof file failed with error: %v, commands that may modify the data set are disabled", err)
+	} else if err == nil && prev != nil {
+		a.lg.Infof("AOF write error looks solved, Redis can write again.")
+	}
+	a.writeErr.Store(aofError{err: err})
+}
+
+// flush 写入协程把缓冲区写到文件, 出错之后每次都会重试, 直到磁盘恢复
+func (a *Aof) flush() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.fileBuffer == nil {
+		return
+	}
+	failed := a.WriteError() != nil
+	if a.fileBuffer.Buffered() == 0 && !failed {
+		return
+	}
+	// 后台 fsync 还没有完成时 write 会被阻塞, 先推迟写入
+	if a.aofFsync == FsyncEverySec && a.fsyncing.Load() {
+		now := time.Now()
+		if a.postponedAt.IsZero() {
+			a.postponedAt = now
+			return
 		}
+		if now.Sub(a.postponedAt) < aofMaxPostpone {
+			return
+		}
+		a.delayedFsync++
+		a.lg.Warnf("Asynchronous AOF fsync is taking too long (disk is busy?). " +
+			"Writing the AOF buffer without waiting for fsync to complete, this may slow down Redis.")
 	}
+	a.postponedAt = time.Time{}
+	if a.aofFsync == FsyncAlways || failed {
+		a.setWriteErr(a.fileBuffer.Sync())
+		return
+	}
+	a.setWriteErr(a.fileBuffer.Flush())
+	a.dirty = true
+}
+
+// backgroundFsync everysec 模式下每秒在后台执行一次 fsync, 不阻塞写入
+func (a *Aof) backgroundFsync() {
+	if a.fsyncing.Load() {
+		return
+	}
+	a.mux.Lock()
+	fileBuffer, dirty := a.fileBuffer, a.dirty
+	a.dirty = false
+	a.mux.Unlock()
+	if fileBuffer == nil || !dirty {
+		return
+	}
+	a.fsyncing.Store(true)
+	go func() {
+		defer a.fsyncing.Store(false)
+		err := fileBuffer.file.Sync()
+		if err == nil {
+			return
+		}
+		a.mux.Lock()
+		defer a.mux.Unlock()
+		// aof 重写开始之后写入了新的 incr 文件
+		if a.fileBuffer == fileBuffer {
+			a.setWriteErr(err)
+		}
+	}()
+}
+
+// DelayedFsync everysec 模式下因为 fsync 太慢而没有等待的写入次数
+func (a *Aof) DelayedFsync() int64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.delayedFsync
 }
 
-func (a *Aof) LoadAof(maxBytes int) {
+// LoadAof 按照 manifest 的顺序加载 base 和 incr 文件
+func (a *Aof) LoadAof() error {
+	return a.load(a.exec)
+}
 
+// load 用 exec 执行 aof 中的命令, DEBUG LOADAOF 在持有锁的时候加载, 使用不获取锁的 exec
+// 写入协程在 flush 中读取 fileBuffer, 替换和恢复时持有 mux
+func (a *Aof) load(exec Exec) error {
+	a.mux.Lock()
 	fileBuffer := a.fileBuffer
 	a.fileBuffer = nil
-	defer func(fb *FileBuffer) {
-		a.fileBuffer = fb
-	}(fileBuffer)
+	a.mux.Unlock()
+	defer func() {
+		a.mux.Lock()
+		a.fileBuffer = fileBuffer
+		a.mux.Unlock()
+	}()
 
-	defer a.lg.Sync()
+	if a.progress != nil {
+		a.progress.start(a.statFiles())
+	}
+	files := a.manifest.files()
+	for i, info := range files {
+		if err := a.loadFile(filepath.Join(a.dirname, info.name), i == len(files)-1, exec); err != nil {
+			return err
+		}
+	}
+	// 最后一个文件可能被截断了
+	currentSize, baseSize := a.statFiles(), int64(0)
+	if a.manifest.base != nil {
+		if stat, err := os.Stat(filepath.Join(a.dirname, a.manifest.base.name)); err == nil {
+			baseSize = stat.Size()
+		}
+	}
+	a.mux.Lock()
+	a.currentSize, a.lastRewriteAofSize = currentSize, baseSize
+	a.mux.Unlock()
+	return nil
+}
 
-	file, err := os.Open(a.aofFilename)
+// loadFile 加载一个aof文件, 每个文件都从 db 0 开始
+// 最后一个文件末尾的命令不完整时按照 aof-load-truncated 截断文件, 文件中间的数据损坏时返回错误
+func (a *Aof) loadFile(filename string, last bool, exec Exec) error {
+	file, err := os.Open(filename)
 	if err != nil {
-		a.lg.Errorf("load aof failed with error: %v", err)
-		return
+		if os.IsNotExist(err) && last {
+			// 更新 manifest 之后还没有创建 incr 文件
+			return nil
+		}
+		return err
 	}
 	defer file.Close()
-	var reader io.Reader
-	if maxBytes > 0 {
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
-	}
-	ch := DecodeInStream(reader)
 	conn := NewClient(0, nil, true)
+	a.currentDb = 0
+	// offset 最后一条完整的命令结束的位置
+	var offset int64 = 0
+	// 以 REDIS 开头的是 rdb 格式的 base 文件, 或者 aof-use-rdb-preamble 重写的文件
+	var rd io.Reader = file
+	if a.progress != nil {
+		rd = a.progress.reader(file)
+	}
+	bufReader := bufio.NewReader(rd)
+	if head, _ := bufReader.Peek(len("REDIS")); string(head) == "REDIS" {
+		a.lg.Infof("Reading RDB base file on AOF loading: %s", filepath.Base(filename))
+		if err = rdb.Decode(bufReader, &aofPreambleLoader{aof: a, exec: exec, conn: conn, now: dbClock.Now()}); err != nil {
+			return fmt.Errorf("bad file format reading the append only file: %v", err)
+		}
+		pos, _ := file.Seek(0, io.SeekCurrent)
+		offset = pos - int64(bufReader.Buffered())
+	}
+	base := offset
+	ch := DecodeInStream(bufReader)
+	defer func() {
+		// 提前返回的时候消费掉剩余的数据, 避免解析的协程阻塞
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
 	for p := range ch {
 		if p.Error != nil {
 			if p.Error == io.EOF {
 				break
 			}
-			a.lg.Error("parse error: " + p.Error.Error())
-			continue
-		}
-		if p.Data == nil {
-			a.lg.Error("empty payload")
-			continue
+			if errors.Is(p.Error, io.ErrUnexpectedEOF) {
+				return a.loadTruncated(filename, offset, last)
+			}
+			return fmt.Errorf("bad file format reading the append only file at offset %d: %v", offset, p.Error)
 		}
 		reply, ok := p.Data.(*MultiBulkReply)
-		if !ok {
-			a.lg.Error("require multi bulk protocol")
-			continue
+		if !ok || len(reply.Args) == 0 {
+			return fmt.Errorf("bad file format reading the append only file at offset %d: require multi bulk protocol", offset)
 		}
+		offset = base + p.Offset
 		conn.PushCmd(reply.Args)
-		err2 := a.exec(context.Background(), conn)
+		err2 := exec(context.Background(), conn)
 		if err2 != nil {
-			if !errors.Is(err2, ErrorsShutdown) {
-				a.lg.Warnf("load aof falied with error: %s", err2)
+			// 加载期间收到 SHUTDOWN, 不再读取剩余的数据
+			if errors.Is(err2, ErrorsShutdown) {
+				return err2
 			}
+			a.lg.Warnf("load aof falied with error: %s", err2)
 			continue
 		}
 		if strings.ToLower(string(reply.Args[0])) == "select" {
 			dbIndex, err2 := strconv.Atoi(string(reply.Args[1]))
 			if err2 != nil {
-				a.lg.Error(err2)
+				a.lg.Errorf("%v", err2)
 			}
 			a.currentDb = dbIndex
 		}
 	}
-	stat, _ := os.Stat(a.aofFilename)
-	a.lastRewriteAofSize = stat.Size()
+	return nil
 }
 
-func (a *Aof) fsyncEverySecond() {
-	ticker := time.NewTicker(time.Second)
-	fsyncEverySec := func() {
-		a.mux.Lock()
-		defer a.mux.Unlock()
-		if a.fileBuffer == nil {
-			return
-		}
-		// 尽量减少sync的次数
-		if a.fileBuffer.Buffered() == 0 {
-			return
+// aofPreambleLoader 把 rdb 中的数据转换为命令执行, 和加载 aof 的过程一致
+type aofPreambleLoader struct {
+	aof  *Aof
+	exec Exec
+	conn *Client
+	now  time.Time
+}
+
+func (l *aofPreambleLoader) run(cmdLine [][]byte) error {
+	l.conn.PushCmd(cmdLine)
+	return l.exec(context.Background(), l.conn)
+}
+
+func (l *aofPreambleLoader) Aux(key, value []byte) {}
+
+func (l *aofPreambleLoader) Function(code []byte) error {
+	return l.run([][]byte{[]byte("function"), []byte("load"), code})
+}
+
+func (l *aofPreambleLoader) Entry(db int, key string, value *obj.RedisObject, expireAt *time.Time) error {
+	if expireAt != nil && !expireAt.After(l.now) {
+		return nil
+	}
+	if db != l.aof.currentDb {
+		if err := l.run(util.ToCmdLine("select", strconv.Itoa(db))); err != nil {
+			return err
 		}
-		if err := a.fileBuffer.Sync(); err != nil {
-			a.lg.Errorf("fsync everysec failed: %v", err)
+		l.aof.currentDb = db
+	}
+	for _, cmd := range EntityToCmd(key, value) {
+		if err := l.run(cmd.Args); err != nil {
+			return err
 		}
 	}
+	if expireAt != nil {
+		return l.run(ExpireCmd(key, expireAt).Args)
+	}
+	return nil
+}
+
+// loadTruncated aof 的末尾只写入了一部分命令, 通常是宕机导致的, 只有最后一个文件可以截断
+func (a *Aof) loadTruncated(filename string, offset int64, last bool) error {
+	if !last || !config.Properties.AofLoadTruncated {
+		return fmt.Errorf("unexpected end of file reading the append only file at offset %d, "+
+			"use checkaof --fix or set aof-load-truncated to yes", offset)
+	}
+	a.lg.Warnf("!!! Warning: short read while loading the AOF file %s !!!", filepath.Base(filename))
+	a.lg.Warnf("!!! Truncating the AOF at offset %d !!!", offset)
+	if err := os.Truncate(filename, offset); err != nil {
+		return fmt.Errorf("truncate the append only file failed: %v", err)
+	}
+	a.lg.Warnf("AOF loaded anyway because aof-load-truncated is enabled")
+	return nil
+}
+
+// startWriter 启动写入协程, 收到通知或者每秒把缓冲区写到文件
+func (a *Aof) startWriter() {
+	ticker := time.NewTicker(time.Second)
 	go func() {
+		defer ticker.Stop()
 		for {
 			select {
+			case <-a.flushCh:
+				a.flush()
 			case <-ticker.C:
-				fsyncEverySec()
+				a.flush()
+				if a.aofFsync == FsyncEverySec {
+					a.backgroundFsync()
+				}
 			case <-a.ctx.Done():
 				return
 			}
@@ -242,7 +521,6 @@ func (a *Aof) fsyncEverySecond() {
 }
 
 func (a *Aof) Shutdown(ctx context.Context) (err error) {
-	defer a.lg.Sync()
 	// 调用cancel, 关闭其他的goroutine
 	defer func() {
 		a.cancel()
@@ -250,20 +528,22 @@ func (a *Aof) Shutdown(ctx context.Context) (err error) {
 		if err = a.fileBuffer.Close(); err != nil {
 			a.lg.Errorf("close aof file failed with error: %v", err)
 		}
-		a.lg.Info("shutdown aof complete...")
+		a.lg.Infof("shutdown aof complete...")
 	}()
 	a.lg.Infof("shutdown aof begin...")
 	ticker := time.NewTicker(time.Millisecond * 10)
 	defer ticker.Stop()
 	for {
 		// 尝试把文件数据都落盘
-		a.lg.Info("Calling fsync() on the Aof file.")
+		a.lg.Infof("Calling fsync() on the Aof file.")
+		a.mux.Lock()
 		err = a.fileBuffer.Sync()
+		buffered := a.fileBuffer.Buffered()
+		a.mux.Unlock()
 		if err != nil {
 			return
 		}
-		var buffered int
-		if buffered = a.fileBuffer.Buffered(); buffered == 0 {
+		if buffered == 0 {
 			break
 		}
 		a.lg.Infof("Shutdown aof buffered: %v", buffered)
@@ -278,42 +558,34 @@ func (a *Aof) Shutdown(ctx context.Context) (err error) {
 	return
 }
 
-func NewAof(exec Exec, filename string, fsync string, tempDbMaker func() (Exec, ForEach)) (*Aof, error) {
+// NewAof 打开 dirname 中最新的 incr 文件, 没有 manifest 时创建
+func NewAof(exec Exec, dirname, filename string, fsync string, takeSnapshot func() *Snapshot) (*Aof, error) {
+	persister := newAof(exec, dirname, filename, fsync, takeSnapshot)
+	if err := persister.openAofDir(); err != nil {
+		return nil, err
+	}
+	persister.startWriter()
+	return persister, nil
+}
+
+func newAof(exec Exec, dirname, filename string, fsync string, takeSnapshot func() *Snapshot) *Aof {
 	persister := &Aof{}
 	persister.status = none
 	persister.exec = exec
-	// aof 的文件名称
-	persister.aofFilename = filename
+	// aof 的目录和文件名称
+	persister.dirname = dirname
+	persister.filename = filename
+	persister.manifest = &aofManifest{}
+	persister.writeManifest = persister.persistManifest
 	// aof 的模式
 	persister.aofFsync = strings.ToLower(fsync)
 
-	persister.tempDbMaker = tempDbMaker
-	// 创建aof文件
-	aofFile, err := initFile(persister.aofFilename)
-	if err != nil {
-		return nil, err
-	}
-	persister.fileBuffer = NewFileBuffer(aofFile, aofBufferSize)
+	persister.takeSnapshot = takeSnapshot
+	persister.flushCh = make(chan struct{}, 1)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	persister.ctx = ctx
 	persister.cancel = cancel
 	persister.lg = logger.Named("aof-persister")
-
-	if persister.aofFsync == FsyncEverySec {
-		persister.fsyncEverySecond()
-	}
-	return persister, nil
-}
-
-func initFile(path string) (file *os.File, err error) {
-	dir := filepath.Dir(path)
-	err = os.Mkdir(dir, 0755)
-	if err != nil {
-		if !errors.Is(err, os.ErrExist) {
-			return nil, err
-		}
-	}
-	file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	return
+	return persister
 }
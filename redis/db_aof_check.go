@@ -0,0 +1,193 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/rdb"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AofFileReport checkaof 检查一个aof文件的结果
+type AofFileReport struct {
+	Filename string
+	Size     int64
+	// RdbPreamble 文件以 rdb 格式开头
+	RdbPreamble bool
+	// Commands 完整的命令数量, 不包括 rdb 部分的数据
+	Commands int
+	// ValidOffset 最后一条完整的命令结束的位置
+	ValidOffset int64
+	// Err 文件的结构错误, nil 表示文件是完整的
+	Err error
+	// Fixable 截断到 ValidOffset 之后可以加载, rdb 部分损坏或者不是最后一个文件时不能修复
+	Fixable bool
+}
+
+// AofReport 按照加载顺序检查的所有文件
+type AofReport struct {
+	Files []*AofFileReport
+}
+
+// Ok 所有文件都是完整的
+func (r *AofReport) Ok() bool {
+	for _, file := range r.Files {
+		if file.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Fix 把损坏的文件截断到最后一条完整的命令, 有不能修复的文件时不做任何修改
+func (r *AofReport) Fix() error {
+	for _, file := range r.Files {
+		if file.Err != nil && !file.Fixable {
+			return fmt.Errorf("%s can not be fixed: %v", file.Filename, file.Err)
+		}
+	}
+	for _, file := range r.Files {
+		if file.Err == nil {
+			continue
+		}
+		if err := os.Truncate(file.Filename, file.ValidOffset); err != nil {
+			return err
+		}
+		file.Size, file.Err, file.Fixable = file.ValidOffset, nil, false
+	}
+	return nil
+}
+
+// VerifyAof 检查 appenddirname 目录, manifest 文件或者单个aof文件, 按照加载的顺序检查 manifest 中的每个文件
+// 文件内容的错误记录在 report 中, 返回的 error 是打开文件或者 manifest 格式的错误
+func VerifyAof(path string) (*AofReport, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	manifestPath := ""
+	switch {
+	case stat.IsDir():
+		if manifestPath, err = findManifest(path); err != nil {
+			return nil, err
+		}
+	case strings.HasSuffix(path, aofManifestSuffix):
+		manifestPath = path
+	default:
+		file, err := verifyAofFile(path, true)
+		if err != nil {
+			return nil, err
+		}
+		return &AofReport{Files: []*AofFileReport{file}}, nil
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	report := &AofReport{}
+	files := m.files()
+	for i, info := range files {
+		file, err := verifyAofFile(filepath.Join(filepath.Dir(manifestPath), info.name), i == len(files)-1)
+		if err != nil {
+			return nil, err
+		}
+		report.Files = append(report.Files, file)
+	}
+	return report, nil
+}
+
+// findManifest 目录中的 manifest 文件, 忽略写入时的临时文件
+func findManifest(dirname string) (string, error) {
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasSuffix(name, aofManifestSuffix) && !strings.HasPrefix(name, aofTempPrefix) {
+			return filepath.Join(dirname, name), nil
+		}
+	}
+	return "", fmt.Errorf("can not find the AOF manifest file in %s", dirname)
+}
+
+// verifyAofFile 和加载aof的过程一致, 先解析 rdb 部分, 然后逐条解析命令
+func verifyAofFile(filename string, last bool) (*AofFileReport, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report := &AofFileReport{Filename: filename, Size: stat.Size()}
+	bufReader := bufio.NewReader(file)
+	if head, _ := bufReader.Peek(len("REDIS")); string(head) == "REDIS" {
+		report.RdbPreamble = true
+		if err = rdb.Decode(bufReader, discardRdb{}); err != nil {
+			report.Err = fmt.Errorf("bad RDB preamble: %v", err)
+			return report, nil
+		}
+		pos, _ := file.Seek(0, io.SeekCurrent)
+		report.ValidOffset = pos - int64(bufReader.Buffered())
+	}
+	base := report.ValidOffset
+	ch := DecodeInStream(bufReader)
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	for p := range ch {
+		if p.Error != nil {
+			if p.Error == io.EOF {
+				break
+			}
+			if errors.Is(p.Error, io.ErrUnexpectedEOF) {
+				report.Err = fmt.Errorf("unexpected end of file at offset %d", report.ValidOffset)
+			} else {
+				report.Err = fmt.Errorf("bad file format at offset %d: %v", report.ValidOffset, p.Error)
+			}
+			break
+		}
+		reply, ok := p.Data.(*MultiBulkReply)
+		if !ok || len(reply.Args) == 0 {
+			report.Err = fmt.Errorf("bad file format at offset %d: require multi bulk protocol", report.ValidOffset)
+			break
+		}
+		report.Commands++
+		report.ValidOffset = base + p.Offset
+	}
+	// 末尾没有换行的不完整的行
+	if report.Err == nil && report.ValidOffset < report.Size {
+		report.Err = fmt.Errorf("unexpected end of file at offset %d", report.ValidOffset)
+	}
+	report.Fixable = report.Err != nil && last
+	return report, nil
+}
+
+// discardRdb 只检查 rdb 的格式和校验和
+type discardRdb struct{}
+
+func (discardRdb) Aux(key, value []byte) {}
+
+func (discardRdb) Function(code []byte) error {
+	return nil
+}
+
+func (discardRdb) Entry(db int, key string, value *obj.RedisObject, expireAt *time.Time) error {
+	return nil
+}
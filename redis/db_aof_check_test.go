@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestVerifyAof(t *testing.T) {
+	data, ends := aofWorkload()
+	dirname, filename := writeAofDir(t, data)
+	for _, path := range []string{dirname, filepath.Join(dirname, "appendonly.aof.manifest"), filename} {
+		report, err := VerifyAof(path)
+		assert.Nil(t, err)
+		assert.True(t, report.Ok())
+		assert.Len(t, report.Files, 1)
+		assert.Equal(t, len(ends), report.Files[0].Commands)
+		assert.Equal(t, int64(len(data)), report.Files[0].ValidOffset)
+	}
+	_, err := VerifyAof(filepath.Join(dirname, "nosuch.aof"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVerifyAofCorrupted(t *testing.T) {
+	data, ends := aofWorkload()
+	testCases := []struct {
+		name    string
+		content []byte
+		offset  int
+		err     string
+	}{
+		{"garbage in the middle", append(append(append([]byte{}, data[:ends[1]]...), "garbage\r\n"...), data[ends[1]:]...),
+			ends[1], "bad file format at offset " + strconv.Itoa(ends[1])},
+		{"partial multibulk", append(append([]byte{}, data...), "*3\r\n$3\r\nset\r\n$1\r\n"...),
+			len(data), "unexpected end of file at offset " + strconv.Itoa(len(data))},
+		{"partial line", append(append([]byte{}, data...), "*3"...),
+			len(data), "unexpected end of file at offset " + strconv.Itoa(len(data))},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dirname, filename := writeAofDir(t, tc.content)
+			report, err := VerifyAof(dirname)
+			assert.Nil(t, err)
+			assert.False(t, report.Ok())
+			file := report.Files[0]
+			assert.Equal(t, int64(tc.offset), file.ValidOffset)
+			assert.Contains(t, file.Err.Error(), tc.err)
+			assert.True(t, file.Fixable)
+
+			// 截断之后可以正常加载
+			assert.Nil(t, report.Fix())
+			content, _ := os.ReadFile(filename)
+			assert.Equal(t, tc.content[:tc.offset], content)
+			report, err = VerifyAof(dirname)
+			assert.Nil(t, err)
+			assert.True(t, report.Ok())
+			_, err = loadAofDir(t, dirname)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestVerifyAofRdbPreamble(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "rpush", "list", "a", "b")
+	buf := &bytes.Buffer{}
+	assert.Nil(t, encodeRdb(buf, server.ForEach, server.scripting.ForEachLibrary))
+
+	dirname := t.TempDir()
+	base := filepath.Join(dirname, "appendonly.aof.1.base.rdb")
+	incr := filepath.Join(dirname, "appendonly.aof.1.incr.aof")
+	assert.Nil(t, os.WriteFile(base, buf.Bytes(), 0600))
+	assert.Nil(t, os.WriteFile(incr, []byte(setFooBar), 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dirname, "appendonly.aof.manifest"),
+		[]byte("file appendonly.aof.1.base.rdb seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n"), 0600))
+	report, err := VerifyAof(dirname)
+	assert.Nil(t, err)
+	assert.True(t, report.Ok())
+	assert.True(t, report.Files[0].RdbPreamble)
+	assert.Equal(t, int64(buf.Len()), report.Files[0].ValidOffset)
+	assert.Equal(t, 1, report.Files[1].Commands)
+
+	// 校验和错误的 rdb 不能通过截断修复
+	corrupted := append([]byte{}, buf.Bytes()...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(base, corrupted, 0600))
+	report, err = VerifyAof(dirname)
+	assert.Nil(t, err)
+	assert.False(t, report.Ok())
+	assert.Contains(t, report.Files[0].Err.Error(), "bad RDB preamble")
+	assert.False(t, report.Files[0].Fixable)
+	assert.NotNil(t, report.Fix())
+	content, _ := os.ReadFile(base)
+	assert.Equal(t, corrupted, content)
+
+	// 只有最后一个文件可以截断
+	assert.Nil(t, os.WriteFile(base, append(append([]byte{}, setFooBar...), "*1\r\n"...), 0600))
+	report, err = VerifyAof(dirname)
+	assert.Nil(t, err)
+	assert.False(t, report.Files[0].Fixable)
+	assert.True(t, report.Files[1].Err == nil)
+}
@@ -0,0 +1,285 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	aofManifestSuffix = ".manifest"
+	aofTempPrefix     = "temp-"
+	aofBaseSuffix     = ".base"
+	aofIncrSuffix     = ".incr"
+	aofRdbExt         = ".rdb"
+	aofAofExt         = ".aof"
+
+	aofBaseType    = 'b'
+	aofHistoryType = 'h'
+	aofIncrType    = 'i'
+)
+
+var errAofManifestFormat = errors.New("invalid AOF manifest file format")
+
+// aofFileInfo manifest 中记录的一个aof文件
+type aofFileInfo struct {
+	name string
+	seq  int64
+	typ  byte
+}
+
+// aofManifest appenddirname 目录中的 manifest, 记录一个 base 文件和按照顺序追加的 incr 文件
+// 加载时先加载 base 文件, 然后按照顺序加载 incr 文件, history 是重写之后等待删除的文件
+type aofManifest struct {
+	base    *aofFileInfo
+	incrs   []*aofFileInfo
+	history []*aofFileInfo
+	baseSeq int64
+	incrSeq int64
+}
+
+// files 需要按照顺序加载的文件
+func (m *aofManifest) files() []*aofFileInfo {
+	files := make([]*aofFileInfo, 0, len(m.incrs)+1)
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *aofManifest) clone() *aofManifest {
+	c := *m
+	c.incrs = append([]*aofFileInfo{}, m.incrs...)
+	c.history = append([]*aofFileInfo{}, m.history...)
+	return &c
+}
+
+// nextIncr 添加一个新的 incr 文件, 之后的写入都追加到这个文件
+func (m *aofManifest) nextIncr(filename string) *aofFileInfo {
+	m.incrSeq++
+	info := &aofFileInfo{
+		name: filename + "." + strconv.FormatInt(m.incrSeq, 10) + aofIncrSuffix + aofAofExt,
+		seq:  m.incrSeq,
+		typ:  aofIncrType,
+	}
+	m.incrs = append(m.incrs, info)
+	return info
+}
+
+// nextBase 重写生成的 base 文件名
+func (m *aofManifest) nextBase(filename string, rdbFormat bool) *aofFileInfo {
+	ext := aofAofExt
+	if rdbFormat {
+		ext = aofRdbExt
+	}
+	return &aofFileInfo{
+		name: filename + "." + strconv.FormatInt(m.baseSeq+1, 10) + aofBaseSuffix + ext,
+		seq:  m.baseSeq + 1,
+		typ:  aofBaseType,
+	}
+}
+
+// rewritten 重写完成之后的 manifest, 原来的 base 和 seq 小于 incrSeq 的 incr 文件都变成 history
+func (m *aofManifest) rewritten(base *aofFileInfo, incrSeq int64) *aofManifest {
+	c := m.clone()
+	if m.base != nil {
+		c.history = append(c.history, &aofFileInfo{name: m.base.name, seq: m.base.seq, typ: aofHistoryType})
+	}
+	c.incrs = c.incrs[:0]
+	for _, info := range m.incrs {
+		if info.seq >= incrSeq {
+			c.incrs = append(c.incrs, info)
+			continue
+		}
+		c.history = append(c.history, &aofFileInfo{name: info.name, seq: info.seq, typ: aofHistoryType})
+	}
+	c.base = base
+	c.baseSeq = base.seq
+	return c
+}
+
+// encode file <name> seq <seq> type <b|h|i>, 每个文件一行
+func (m *aofManifest) encode() []byte {
+	buf := &bytes.Buffer{}
+	for _, info := range append(m.files(), m.history...) {
+		_, _ = fmt.Fprintf(buf, "file %s seq %d type %c\n", info.name, info.seq, info.typ)
+	}
+	return buf.Bytes()
+}
+
+func parseManifest(data []byte) (*aofManifest, error) {
+	m := &aofManifest{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, errAofManifestFormat
+		}
+		info := &aofFileInfo{seq: -1}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil || seq < 0 {
+					return nil, errAofManifestFormat
+				}
+				info.seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, errAofManifestFormat
+				}
+				info.typ = fields[i+1][0]
+			}
+		}
+		if info.name == "" || info.seq < 0 || strings.ContainsRune(info.name, filepath.Separator) {
+			return nil, errAofManifestFormat
+		}
+		switch info.typ {
+		case aofBaseType:
+			if m.base != nil {
+				return nil, fmt.Errorf("%w: found duplicate base file information", errAofManifestFormat)
+			}
+			m.base = info
+			m.baseSeq = info.seq
+		case aofIncrType:
+			if info.seq <= m.incrSeq {
+				return nil, fmt.Errorf("%w: found a non-monotonic sequence number", errAofManifestFormat)
+			}
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = info.seq
+		case aofHistoryType:
+			m.history = append(m.history, info)
+		default:
+			return nil, errAofManifestFormat
+		}
+	}
+	return m, nil
+}
+
+// aofDirname appenddirname 在 dir 目录中
+func aofDirname() string {
+	return filepath.Join(config.Properties.Dir, config.Properties.AppendDirname)
+}
+
+func (a *Aof) manifestPath() string {
+	return filepath.Join(a.dirname, a.filename+aofManifestSuffix)
+}
+
+// persistManifest 先写临时文件再 rename, 保证 manifest 总是完整的
+func (a *Aof) persistManifest(m *aofManifest) error {
+	tmpName := filepath.Join(a.dirname, aofTempPrefix+a.filename+aofManifestSuffix)
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(m.encode()); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, a.manifestPath())
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	// fsync 目录, 保证 rename 落盘
+	if dir, err := os.Open(a.dirname); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// openAofDir 加载 manifest, 打开最新的 incr 文件用于写入
+func (a *Aof) openAofDir() error {
+	if err := os.MkdirAll(a.dirname, 0755); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.manifestPath())
+	switch {
+	case err == nil:
+		if a.manifest, err = parseManifest(data); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		if a.manifest, err = a.upgradeLegacyAof(); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	a.deleteHistory()
+	if len(a.manifest.incrs) == 0 {
+		m := a.manifest.clone()
+		m.nextIncr(a.filename)
+		if err = a.writeManifest(m); err != nil {
+			return err
+		}
+		a.manifest = m
+	}
+	incr := a.manifest.incrs[len(a.manifest.incrs)-1]
+	file, err := os.OpenFile(filepath.Join(a.dirname, incr.name), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	a.fileBuffer = NewFileBuffer(file, aofBufferSize)
+	a.currentSize = a.statFiles()
+	return nil
+}
+
+// upgradeLegacyAof 把老版本的单个aof文件移动到 appenddirname 中作为 base 文件
+func (a *Aof) upgradeLegacyAof() (*aofManifest, error) {
+	m := &aofManifest{}
+	legacy := filepath.Join(filepath.Dir(a.dirname), a.filename)
+	if stat, err := os.Stat(legacy); err != nil || stat.IsDir() {
+		return m, nil
+	}
+	a.lg.Infof("Creating AOF base file %s in %s from the legacy append only file", a.filename, a.dirname)
+	basePath := filepath.Join(a.dirname, a.filename)
+	if err := os.Rename(legacy, basePath); err != nil {
+		return nil, err
+	}
+	m.base = &aofFileInfo{name: a.filename, seq: 1, typ: aofBaseType}
+	m.baseSeq = 1
+	m.nextIncr(a.filename)
+	// manifest 写入失败时把文件移回原来的位置, 下次启动重新升级
+	if err := a.writeManifest(m); err != nil {
+		_ = os.Rename(basePath, legacy)
+		return nil, err
+	}
+	return m, nil
+}
+
+// deleteHistory 删除重写之前的文件, 然后把它们从 manifest 中移除
+func (a *Aof) deleteHistory() {
+	if len(a.manifest.history) == 0 {
+		return
+	}
+	m := a.manifest.clone()
+	for _, info := range m.history {
+		if err := os.Remove(filepath.Join(a.dirname, info.name)); err != nil && !os.IsNotExist(err) {
+			a.lg.Warnf("remove history AOF file %s failed with error: %v", info.name, err)
+			return
+		}
+		a.lg.Infof("Removing the history file %s", info.name)
+	}
+	m.history = nil
+	if err := a.writeManifest(m); err != nil {
+		a.lg.Warnf("persist AOF manifest failed with error: %v", err)
+		return
+	}
+	a.manifest = m
+}
@@ -4,280 +4,299 @@ import (
 	"bufio"
 	"errors"
 	"github.com/xuning888/godis-tiny/config"
-	"github.com/xuning888/godis-tiny/pkg/datastruct/list"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
-	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/pkg/rdb"
 	"github.com/xuning888/godis-tiny/pkg/util"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"time"
 )
 
 type RewriteCtx struct {
-	tmpFile     *os.File
-	fileSize    int64
-	dbIdx       int
-	writtenSize int64
+	tmpFile *os.File
+	// incrSeq 重写开始时创建的 incr 文件, 重写完成之后从这个文件开始保留
+	incrSeq int64
+	// rdbBase base 文件使用 rdb 格式
+	rdbBase bool
+	// rewrittenSize 重写开始之前的文件大小, 这些文件在重写完成之后删除
+	rewrittenSize int64
+	writtenSize   int64
 }
 
 var (
 	ErrAofRewriteIsRunning = errors.New("aof rewrite is running")
 )
 
-func (a *Aof) Rewrite() error {
+// Rewriting aof 重写正在执行
+func (a *Aof) Rewriting() bool {
+	return atomic.LoadUint32(&a.status) == rewrite
+}
 
-	if atomic.LoadUint32(&a.status) != none {
+func (a *Aof) Rewrite() error {
+	if !atomic.CompareAndSwapUint32(&a.status, none, rewrite) {
 		return ErrAofRewriteIsRunning
 	}
+	defer atomic.CompareAndSwapUint32(&a.status, rewrite, none)
+	return a.doRewrite()
+}
 
+// BgRewrite 在后台执行重写, 返回之前已经修改了状态, serverCron 不会重复触发
+func (a *Aof) BgRewrite() error {
 	if !atomic.CompareAndSwapUint32(&a.status, none, rewrite) {
 		return ErrAofRewriteIsRunning
 	}
+	go func() {
+		defer atomic.CompareAndSwapUint32(&a.status, rewrite, none)
+		if err := a.doRewrite(); err != nil {
+			a.lg.Errorf("aof rewrite failed with error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Aof) doRewrite() (err error) {
+	defer func() {
+		a.mux.Lock()
+		defer a.mux.Unlock()
+		a.lastRewriteErr = err
+		if err == nil {
+			a.rewrites++
+		}
+	}()
 
-	// 准备重写时需要的信息, 这个时候会暂停aof的写入
+	// 持有命令的锁创建快照并切换到新的 incr 文件, 快照之后执行的命令都写入新的 incr 文件
+	lock.Lock()
+	snapshot := a.takeSnapshot()
 	ctx, err := a.StartRewrite()
+	lock.Unlock()
+	defer snapshot.Release()
 	if err != nil {
 		return err
 	}
 
-	// 把aof重写前的数据拷贝到内存,然后使用命令替换的方式重写到tmpFile, 这个时候是允许 aof 继续写入的
-	err = a.DoRewrite(ctx)
+	// 把快照写到新的 base 文件, 这个时候是允许 aof 继续写入新的 incr 文件的
+	err = a.DoRewrite(ctx, snapshot)
+	if err == nil {
+		// 加锁更新 manifest
+		err = a.FinishRewrite(ctx)
+	}
 	if err != nil {
+		_ = ctx.tmpFile.Close()
+		_ = os.Remove(ctx.tmpFile.Name())
 		return err
 	}
-
-	// 加锁禁止aof写入，直到aof数据整合完毕
-	a.FinishRewrite(ctx)
-	a.lg.Info("rewrite aof completed")
-	atomic.CompareAndSwapUint32(&a.status, rewrite, none)
+	a.lg.Infof("rewrite aof completed")
 	return nil
 }
 
-func (a *Aof) DoRewrite(ctx *RewriteCtx) (err error) {
+func (a *Aof) DoRewrite(ctx *RewriteCtx, snapshot *Snapshot) (err error) {
 
 	// 临时文件
 	tmpFile := ctx.tmpFile
 	buffer := bufio.NewWriterSize(tmpFile, 1<<16)
 	defer func() {
-		err = buffer.Flush()
-		if err != nil {
-			a.lg.Errorf("DoRewrite flush aof file failed with error: %v", err)
+		if flushErr := buffer.Flush(); flushErr != nil {
+			a.lg.Errorf("DoRewrite flush aof file failed with error: %v", flushErr)
+			if err == nil {
+				err = flushErr
+			}
 		}
 	}()
 
-	// 将重写开始前的数据加载到内存
-	tmpAof := a.newRewriteHandler()
-	tmpAof.LoadAof(int(ctx.fileSize))
+	// aof-use-rdb-preamble 打开时 base 文件使用 rdb 格式
+	if ctx.rdbBase {
+		counter := &countWriter{w: buffer}
+		err = encodeRdb(counter, a.interruptible(snapshot.ForEach), snapshot.ForEachLibrary)
+		ctx.writtenSize += counter.n
+		if err == nil {
+			err = a.ctx.Err()
+		}
+		return err
+	}
 
-	// 将内存中的数据写到临时文件
+	write := func(cmd *MultiBulkReply) error {
+		written, err := buffer.Write(cmd.ToBytes())
+		ctx.writtenSize += int64(written)
+		return err
+	}
+
+	// 函数库不属于任何db, 写在所有数据之前
+	snapshot.ForEachLibrary(func(code []byte) bool {
+		err = write(MakeMultiBulkReply([][]byte{[]byte("function"), []byte("load"), code}))
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 将快照中的数据写到临时文件
 	// 遍历DB, 获取其中的每一个数据，根据其数据类型将其转换为命令写入tmpFile
 	// string类型: incr a 会被重写为  set a 1 命令
-	// list 类型: 遍历list中的所有数据, 重写为 rpush ele1 ele2 ele3
+	// list, set, hash 类型: 每64个元素重写为一条 rpush, sadd, hset 命令
+	// 过期时间重写为 pexpireat 命令
 	for i := 0; i < config.Properties.Databases; i++ {
 		// select db
-		data := MakeMultiBulkReply(util.ToCmdLine("select", strconv.Itoa(i))).ToBytes()
-		written1, err := buffer.Write(data)
-		if err != nil {
+		if err = write(MakeMultiBulkReply(util.ToCmdLine("select", strconv.Itoa(i)))); err != nil {
 			return err
 		}
-		ctx.writtenSize += int64(written1)
-		// 将内存中的数据写入临时文件
-		tmpAof.each(i, func(key string, redisObj *obj.RedisObject, expiration *time.Time) bool {
-			cmd := EntityToCmd(key, redisObj)
-			if cmd != nil {
-				written2, _ := buffer.Write(cmd.ToBytes())
-				ctx.writtenSize += int64(written2)
+		a.interruptible(snapshot.ForEach)(i, func(key string, redisObj *obj.RedisObject, expiration *time.Time) bool {
+			for _, cmd := range EntityToCmd(key, redisObj) {
+				if err = write(cmd); err != nil {
+					return false
+				}
 			}
 			if expiration != nil {
-				expireCmd := ExpireCmd(key, expiration)
-				if expireCmd != nil {
-					written3, _ := buffer.Write(expireCmd.ToBytes())
-					ctx.writtenSize += int64(written3)
-				}
+				err = write(ExpireCmd(key, expiration))
 			}
-			return true
+			return err == nil
 		})
-	}
-	return nil
-}
-
-func (a *Aof) FinishRewrite(ctx *RewriteCtx) {
-	// 暂停aof写入
-	a.mux.Lock()
-	defer a.mux.Unlock()
-
-	tmpFile := ctx.tmpFile
-	errOccurs := func() bool {
-
-		// 尝试打开重写前的 aof文件
-		src, err := os.Open(a.aofFilename)
 		if err != nil {
-			a.lg.Errorf("open aofFilname %v fialed with error: %v", a.aofFilename, err)
-			return true
+			return err
 		}
+	}
+	return a.ctx.Err()
+}
 
-		buffer := bufio.NewWriter(tmpFile)
-		defer func() {
-			_ = buffer.Flush()
-			_ = src.Close()
-			_ = tmpFile.Close()
-		}()
-
-		// 跳转到重写前的末尾
-		_, err = src.Seek(ctx.fileSize, io.SeekStart)
-		if err != nil {
-			a.lg.Warnf("seek failed with error: %v", err)
-			return true
-		}
+// interruptible 关闭 aof 之后停止遍历快照, 没有写完的临时文件被删除
+func (a *Aof) interruptible(each ForEach) ForEach {
+	return func(i int, fun func(key string, object *obj.RedisObject, expiration *time.Time) bool) {
+		visited := 0
+		each(i, func(key string, object *obj.RedisObject, expiration *time.Time) bool {
+			if interrupted(a.ctx, visited) {
+				return false
+			}
+			visited++
+			return fun(key, object, expiration)
+		})
+	}
+}
 
-		// 插入一个aof重写前aof写入时使用的db
-		selectDbBytes := MakeMultiBulkReply(util.ToCmdLine("select", strconv.Itoa(ctx.dbIdx))).ToBytes()
+// countWriter 记录写入的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
 
-		written1, err := buffer.Write(selectDbBytes)
-		if err != nil {
-			a.lg.Errorf("tmp file rewrite failed with error: %v", err)
-			return true
-		}
-		ctx.writtenSize += int64(written1)
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
 
-		// 把重写时可能写入到原来aof文件中命令拷贝到tmp文件中
-		written2, err := io.Copy(buffer, src)
-		if err != nil {
-			a.lg.Errorf("copy aof file failed with error: %v", err)
-			return true
-		}
-		ctx.writtenSize += written2
-		return false
+// FinishRewrite 把临时文件重命名为新的 base 文件, 然后更新 manifest, 删除重写之前的文件
+func (a *Aof) FinishRewrite(ctx *RewriteCtx) error {
+	tmpFile := ctx.tmpFile
+	if err := tmpFile.Sync(); err != nil {
+		a.lg.Errorf("fsync tmp file failed with error: %v", err)
+		return err
 	}
-
-	// 把DoRewrite期间的产生的数据落盘
-	err2 := a.fileBuffer.Sync()
-	if err2 != nil {
-		a.lg.Errorf("last sync aoffile fialed error %v", err2)
-		return
+	if err := tmpFile.Close(); err != nil {
+		return err
 	}
 
-	if errOccurs() {
-		return
-	}
+	// 暂停aof写入
+	a.mux.Lock()
+	defer a.mux.Unlock()
 
-	// 关闭原来的aofFile
-	err := a.fileBuffer.Close()
-	if err != nil {
-		a.lg.Errorf("close aofFile failed with error: %v", err)
-	}
-	// 使用 mv 命令把 原来的 aofFile 替换为 重写后的 tmpFile
-	if err = os.Rename(tmpFile.Name(), a.aofFilename); err != nil {
+	base := a.manifest.nextBase(a.filename, ctx.rdbBase)
+	basePath := filepath.Join(a.dirname, base.name)
+	if err := os.Rename(tmpFile.Name(), basePath); err != nil {
 		a.lg.Errorf("rename aof file failed with error: %v", err)
+		return err
+	}
+	// manifest 更新之前宕机时, 原来的 manifest 引用的文件都还在
+	m := a.manifest.rewritten(base, ctx.incrSeq)
+	if err := a.writeManifest(m); err != nil {
+		a.lg.Errorf("persist AOF manifest failed with error: %v", err)
+		_ = os.Remove(basePath)
+		return err
 	}
+	a.manifest = m
 
 	// 记录aof重写完成后的文件大小
 	a.lastRewriteAofSize = ctx.writtenSize
-
-	// 重新打开 aofFile
-	aofFile, err := os.OpenFile(a.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-	// 替换aofFile
-	a.fileBuffer = NewFileBuffer(aofFile, aofBufferSize)
-	// 插入一个aof当前记录的db的命令 select curDbIndex
-	selectBytes := MakeMultiBulkReply(util.ToCmdLine("select", strconv.Itoa(a.currentDb))).ToBytes()
-	_, err = a.fileBuffer.Write(selectBytes)
-	if err != nil {
-		panic(err)
-	}
+	a.currentSize += ctx.writtenSize - ctx.rewrittenSize
+	a.deleteHistory()
+	return nil
 }
 
+// StartRewrite 把之后的写入切换到新的 incr 文件, 重写期间不需要缓存写入的命令
 func (a *Aof) StartRewrite() (*RewriteCtx, error) {
 	// 加锁暂停主流程的aof写入
 	a.mux.Lock()
 	defer a.mux.Unlock()
 
-	// fsync 将缓冲区中的数据落盘，防止aof文件不完整造成数据错误
+	// fsync 将缓冲区中的数据落盘, 之后不会再写入这些文件
 	err := a.fileBuffer.Sync()
 	if err != nil {
 		a.lg.Warnf("fsync failed, err: %v", err)
 		return nil, err
 	}
 
-	// 获取当前aof文件大小, 用于判断哪些数据是 aof 重写过程中产生的
-	// 因为前边已经暂停了aof的落盘, 可以确定当前aof文件的大小
-	fileInfo, _ := os.Stat(a.aofFilename)
-	filesize := fileInfo.Size()
-
-	// 创建临时文件供重写使用
-	file, err := os.CreateTemp("", "*.aof")
+	// 在aof目录创建临时文件供重写使用, 保证 rename 是原子的
+	file, err := os.CreateTemp(a.dirname, aofTempPrefix+"rewriteaof-*"+aofAofExt)
 	if err != nil {
 		a.lg.Warnf("tmp file create failed, err: %v", err)
 		return nil, err
 	}
 
+	m := a.manifest.clone()
+	incr := m.nextIncr(a.filename)
+	incrPath := filepath.Join(a.dirname, incr.name)
+	incrFile, err := os.OpenFile(incrPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err == nil {
+		if err = a.writeManifest(m); err != nil {
+			_ = incrFile.Close()
+			_ = os.Remove(incrPath)
+		}
+	}
+	if err != nil {
+		a.lg.Warnf("open new AOF incr file failed, err: %v", err)
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+
+	// 关闭原来的 incr 文件, 缓冲区中的数据都已经落盘了
+	if err = a.fileBuffer.Close(); err != nil {
+		a.lg.Errorf("close aofFile failed with error: %v", err)
+	}
+	a.manifest = m
+	a.fileBuffer = NewFileBuffer(incrFile, aofBufferSize)
+	// 每个文件都从 db 0 开始加载
+	a.currentDb = 0
+	a.dirty = false
+
 	ctx := &RewriteCtx{
-		// tmpFile 临时文件
-		tmpFile: file,
-		// fileSize aof文件的大小
-		fileSize: filesize,
-		// aof记录的dbIndex
-		dbIdx:       a.currentDb,
-		writtenSize: 0,
+		tmpFile:       file,
+		incrSeq:       incr.seq,
+		rdbBase:       config.Properties.AofUseRdbPreamble,
+		rewrittenSize: a.currentSize,
 	}
 	return ctx, nil
 }
 
-func EntityToCmd(key string, redisObj *obj.RedisObject) *MultiBulkReply {
+// EntityToCmd 把一个key转换为重建它需要的命令, 命令由 rdb 中注册的 codec 生成
+func EntityToCmd(key string, redisObj *obj.RedisObject) []*MultiBulkReply {
 	if redisObj == nil {
 		return nil
 	}
-	switch redisObj.ObjType {
-	case obj.RedisString:
-		result, _ := obj.StringObjEncoding(redisObj)
-		return stringToCmd(key, result)
-	case obj.RedisList:
-		dequeue := redisObj.Ptr.(list.Dequeue)
-		return listToCmd(key, dequeue)
-	default:
-		return nil
-	}
-}
-
-func ExpireCmd(key string, expiration *time.Time) *MultiBulkReply {
-	cmdLine := util.MakeExpireCmd(key, *expiration)
-	return MakeMultiBulkReply(cmdLine)
+	cmds := make([]*MultiBulkReply, 0, 1)
+	_ = rdb.RewriteCommands(key, redisObj, func(cmdLine rdb.CmdLine) {
+		cmds = append(cmds, MakeMultiBulkReply(cmdLine))
+	})
+	return cmds
 }
 
-var setCmd = []byte("set")
+var pexpireatCmd = []byte("pexpireat")
 
-func stringToCmd(key string, bytes []byte) *MultiBulkReply {
+func ExpireCmd(key string, expiration *time.Time) *MultiBulkReply {
 	args := make([][]byte, 3)
-	args[0] = setCmd
-	args[1] = []byte(key)
-	args[2] = bytes
-	return MakeMultiBulkReply(args)
-}
-
-var pushCmd = []byte("rpush")
-
-func listToCmd(key string, deque list.Dequeue) *MultiBulkReply {
-	args := make([][]byte, 2+deque.Len())
-	args[0] = pushCmd
+	args[0] = pexpireatCmd
 	args[1] = []byte(key)
-	i := 0
-	deque.ForEach(func(value interface{}, index int) bool {
-		bytes, _ := value.([]byte)
-		args[i+2] = bytes
-		i++
-		return true
-	})
+	args[2] = []byte(strconv.FormatInt(expiration.UnixMilli(), 10))
 	return MakeMultiBulkReply(args)
 }
-
-func (a *Aof) newRewriteHandler() *Aof {
-	h := &Aof{}
-	h.aofFilename = a.aofFilename
-	h.exec, h.each = a.tempDbMaker()
-	h.lg = logger.Named("aof-rewrite")
-	return h
-}
@@ -0,0 +1,772 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAofFile 可以注入写入和fsync错误的aof文件
+type fakeAofFile struct {
+	mux      sync.Mutex
+	data     bytes.Buffer
+	synced   int
+	writeErr error
+	syncErr  error
+	onSync   func()
+}
+
+func (f *fakeAofFile) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
+	return f.data.Write(p)
+}
+
+func (f *fakeAofFile) Sync() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.onSync != nil {
+		f.onSync()
+	}
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	f.synced = f.data.Len()
+	return nil
+}
+
+func (f *fakeAofFile) Close() error {
+	return nil
+}
+
+func (f *fakeAofFile) inject(writeErr, syncErr error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.writeErr, f.syncErr = writeErr, syncErr
+}
+
+func (f *fakeAofFile) String() string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.data.String()
+}
+
+func newAofTestServer(t *testing.T, fsync string) (*testServer, *fakeAofFile) {
+	appendOnly := config.Properties.AppendOnly
+	config.Properties.AppendOnly = true
+	t.Cleanup(func() {
+		config.Properties.AppendOnly = appendOnly
+	})
+	server := newTestServer()
+	file := &fakeAofFile{}
+	aof := newAof(server.process, t.TempDir(), "test.aof", fsync, nil)
+	aof.fileBuffer = NewFileBuffer(file, aofBufferSize)
+	server.bindPersister(aof)
+	return server, file
+}
+
+const setFooBar = "*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+
+func TestAofAlwaysFsyncBeforeReply(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncAlways)
+	client, conn := server.newClient()
+	pending := -1
+	file.onSync = func() {
+		// fsync 的时候还没有回复客户端
+		pending = conn.out.Len()
+	}
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "bar"))
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, setFooBar, file.String())
+	assert.Equal(t, len(setFooBar), file.synced)
+}
+
+func TestAofMisconf(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fsync    string
+		writeErr error
+		syncErr  error
+	}{
+		{"always write error", FsyncAlways, errors.New("no space left on device"), nil},
+		{"always fsync error", FsyncAlways, nil, errors.New("input/output error")},
+		{"everysec write error", FsyncEverySec, errors.New("no space left on device"), nil},
+		{"no write error", FsyncNo, errors.New("no space left on device"), nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, file := newAofTestServer(t, tc.fsync)
+			client, _ := server.newClient()
+			file.inject(tc.writeErr, tc.syncErr)
+			// 已经执行的命令正常回复, 写入失败之后的写命令被拒绝
+			assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "bar"))
+			server.aof.flush()
+			reply := server.exec(t, client, "set", "foo", "baz")
+			assert.Contains(t, reply, "-MISCONF Errors writing to the AOF file")
+			assert.Contains(t, reply, "Commands that may modify the data set are disabled")
+			assert.Contains(t, server.exec(t, client, "eval", "return redis.call('del', 'foo')", "0"), "-MISCONF")
+			// 读命令不受影响
+			assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+
+			// 磁盘恢复之后重试写入, 没有写入的数据不会丢失
+			file.inject(nil, nil)
+			server.aof.flush()
+			assert.Nil(t, server.aof.WriteError())
+			assert.Equal(t, setFooBar, file.String())
+			assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "baz"))
+		})
+	}
+}
+
+func TestAofEverySecPostponeWrite(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncEverySec)
+	client, _ := server.newClient()
+	aof := server.aof
+
+	server.exec(t, client, "set", "foo", "bar")
+	aof.flush()
+	assert.Equal(t, setFooBar, file.String())
+	// 后台 fsync 把数据落盘
+	aof.backgroundFsync()
+	for aof.fsyncing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, len(setFooBar), file.synced)
+
+	// 上一次 fsync 还没有完成, 推迟写入
+	aof.fsyncing.Store(true)
+	server.exec(t, client, "set", "foo", "bar")
+	aof.flush()
+	aof.flush()
+	assert.Equal(t, setFooBar, file.String())
+	assert.Equal(t, int64(0), aof.DelayedFsync())
+	// 推迟超过2秒之后不再等待
+	aof.mux.Lock()
+	aof.postponedAt = time.Now().Add(-aofMaxPostpone)
+	aof.mux.Unlock()
+	aof.flush()
+	assert.Equal(t, setFooBar+setFooBar, file.String())
+	assert.Equal(t, int64(1), aof.DelayedFsync())
+	aof.fsyncing.Store(false)
+}
+
+// aofWorkload 返回aof的内容和每条命令结束的位置
+func aofWorkload() ([]byte, []int) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	workload := [][]string{
+		{"set", "a", "1"},
+		{"rpush", "l", "x", "y"},
+		{"select", "1"},
+		{"set", "b", "2"},
+		// 加载期间不会清理过期的key, incr 的结果是确定的, 加载完成之后才被删除
+		{"set", "gone", "1"},
+		{"pexpireat", "gone", "1"},
+		{"incr", "gone"},
+		{"set", "live", "1"},
+		{"pexpireat", "live", future},
+		{"select", "0"},
+		{"set", "c", "3"},
+	}
+	data := make([]byte, 0)
+	ends := make([]int, 0, len(workload))
+	for _, cmd := range workload {
+		data = append(data, MakeMultiBulkReply(util.ToCmdLine(cmd[0], cmd[1:]...)).ToBytes()...)
+		ends = append(ends, len(data))
+	}
+	return data, ends
+}
+
+// openAofDir 打开 dirname 中的aof, 测试结束时关闭
+func openAofDir(t *testing.T, server *testServer, dirname string) (*Aof, error) {
+	appendOnly := config.Properties.AppendOnly
+	config.Properties.AppendOnly = true
+	t.Cleanup(func() {
+		config.Properties.AppendOnly = appendOnly
+	})
+	aof, err := NewAof(server.process, dirname, "appendonly.aof", FsyncNo, server.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() {
+		_ = aof.Shutdown(context.Background())
+	})
+	server.bindPersister(aof)
+	return aof, nil
+}
+
+// loadAofDir 在新的 server 中加载 dirname 中的aof
+func loadAofDir(t *testing.T, dirname string) (*testServer, error) {
+	server := newTestServer()
+	if _, err := openAofDir(t, server, dirname); err != nil {
+		return nil, err
+	}
+	return server, server.loadAof()
+}
+
+// writeAofDir 把 data 写入只有一个 incr 文件的aof目录, 返回目录和 incr 文件
+func writeAofDir(t *testing.T, data []byte) (string, string) {
+	dirname := t.TempDir()
+	incr := filepath.Join(dirname, "appendonly.aof.1.incr.aof")
+	assert.Nil(t, os.WriteFile(incr, data, 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dirname, "appendonly.aof.manifest"),
+		[]byte("file appendonly.aof.1.incr.aof seq 1 type i\n"), 0600))
+	return dirname, incr
+}
+
+func TestLoadAof(t *testing.T) {
+	data, ends := aofWorkload()
+	dirname, filename := writeAofDir(t, data)
+	server, err := loadAofDir(t, dirname)
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+	assert.Equal(t, "$1\r\n1\r\n", server.exec(t, client, "get", "a"))
+	assert.Equal(t, "$1\r\n3\r\n", server.exec(t, client, "get", "c"))
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "llen", "l"))
+	server.exec(t, client, "select", "1")
+	assert.Equal(t, "$1\r\n2\r\n", server.exec(t, client, "get", "b"))
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "get", "gone"))
+	assert.Equal(t, "$1\r\n1\r\n", server.exec(t, client, "get", "live"))
+
+	// 加载期间执行的命令不会再写入aof, 加载之后的命令追加在文件末尾
+	server.exec(t, client, "set", "after", "load")
+	server.aof.flush()
+	content, _ := os.ReadFile(filename)
+	assert.Equal(t, string(data), string(content[:ends[len(ends)-1]]))
+	assert.Equal(t, "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n*3\r\n$3\r\nset\r\n$5\r\nafter\r\n$4\r\nload\r\n",
+		string(content[ends[len(ends)-1]:]))
+}
+
+func TestDebugLoadAof(t *testing.T) {
+	server := newTestServer()
+	aof, err := openAofDir(t, server, t.TempDir())
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomWorkload(t, server, client, rnd, 500)
+	server.exec(t, client, "function", "load", testLibrary)
+	dump, expected := keyspaceDump(t, server, client), snapshot(server.RedisServer)
+	offset := server.repl.Offset()
+
+	// 缓冲区中的命令先写入文件, 重放之后数据不变, 加载的命令不再写入 aof 和复制流
+	size := aof.CurrentAofSize()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "loadaof"))
+	assert.Equal(t, dump, keyspaceDump(t, server, client))
+	assert.Equal(t, expected, snapshot(server.RedisServer))
+	assert.Equal(t, size, aof.CurrentAofSize())
+	assert.Equal(t, offset, server.repl.Offset())
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "fcall", "setget", "1", "foo", "bar"))
+
+	// 之后的写入继续追加到 aof
+	server.exec(t, client, "set", "after", "v")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "loadaof"))
+	assert.Equal(t, "$1\r\nv\r\n", server.exec(t, client, "get", "after"))
+
+	atomic.StoreUint32(&aof.status, rewrite)
+	assert.Equal(t, "-ERR Background append only file rewriting already in progress\r\n", server.exec(t, client, "debug", "loadaof"))
+	assert.Equal(t, "-ERR Background append only file rewriting already in progress\r\n", server.exec(t, client, "debug", "reload"))
+	atomic.StoreUint32(&aof.status, none)
+}
+
+func TestLoadTruncatedAof(t *testing.T) {
+	data, ends := aofWorkload()
+	defer func(loadTruncated bool) {
+		config.Properties.AofLoadTruncated = loadTruncated
+	}(config.Properties.AofLoadTruncated)
+
+	// 在每条命令的中间和结尾截断
+	for i, end := range ends {
+		start := 0
+		if i > 0 {
+			start = ends[i-1]
+		}
+		for _, cut := range []int{start + 1, (start + end) / 2, end - 1, end} {
+			dirname, filename := writeAofDir(t, data[:cut])
+
+			config.Properties.AofLoadTruncated = false
+			_, err := loadAofDir(t, dirname)
+			if cut == end {
+				assert.Nil(t, err, "cut at %d", cut)
+				continue
+			}
+			assert.NotNil(t, err, "cut at %d", cut)
+			assert.Contains(t, err.Error(), "unexpected end of file reading the append only file at offset "+strconv.Itoa(start))
+
+			// 截断不完整的命令之后正常启动
+			config.Properties.AofLoadTruncated = true
+			server, err := loadAofDir(t, dirname)
+			assert.Nil(t, err, "cut at %d", cut)
+			content, _ := os.ReadFile(filename)
+			assert.Equal(t, string(data[:start]), string(content), "cut at %d", cut)
+			if i > 0 {
+				client, _ := server.newClient()
+				assert.Equal(t, "$1\r\n1\r\n", server.exec(t, client, "get", "a"))
+			}
+		}
+	}
+}
+
+func TestLoadCorruptedAof(t *testing.T) {
+	data, ends := aofWorkload()
+	corrupted := append([]byte{}, data...)
+	// 第三条命令的 *2 改成 ?2
+	corrupted[ends[1]] = '?'
+	dirname, filename := writeAofDir(t, corrupted)
+	_, err := loadAofDir(t, dirname)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad file format reading the append only file at offset "+strconv.Itoa(ends[1]))
+	// 中间的数据损坏不会截断文件
+	content, _ := os.ReadFile(filename)
+	assert.Equal(t, corrupted, content)
+}
+
+// snapshot 每个db中的数据, set 和 hash 的元素排序之后再比较
+func snapshot(server *RedisServer) []map[string]string {
+	return dumpEach(len(server.dbs), server.ForEach)
+}
+
+// dumpEach 把 each 遍历到的每个db的数据转换成字符串, 方便比较
+func dumpEach(dbs int, each ForEach) []map[string]string {
+	result := make([]map[string]string, 0, dbs)
+	for i := 0; i < dbs; i++ {
+		data := make(map[string]string)
+		each(i, func(key string, entity *obj.RedisObject, expiration *time.Time) bool {
+			items := make([]string, 0)
+			for _, cmd := range EntityToCmd(key, entity) {
+				for _, arg := range cmd.Args[2:] {
+					items = append(items, string(arg))
+				}
+			}
+			switch entity.ObjType {
+			case obj.RedisSet:
+				sort.Strings(items)
+			case obj.RedisHash:
+				pairs := make([]string, 0, len(items)/2)
+				for j := 0; j < len(items); j += 2 {
+					pairs = append(pairs, items[j]+"="+items[j+1])
+				}
+				sort.Strings(pairs)
+				items = pairs
+			}
+			value := obj.ObjectTypeName(entity.ObjType) + " " + strings.Join(items, ",")
+			if expiration != nil {
+				value += " @" + strconv.FormatInt(expiration.UnixMilli(), 10)
+			}
+			data[key] = value
+			return true
+		})
+		result = append(result, data)
+	}
+	return result
+}
+
+// readAofFiles 读取 manifest 中的 base 文件和最新的 incr 文件
+func readAofFiles(aof *Aof) (string, string) {
+	aof.mux.Lock()
+	defer aof.mux.Unlock()
+	base, _ := os.ReadFile(filepath.Join(aof.dirname, aof.manifest.base.name))
+	incr, _ := os.ReadFile(filepath.Join(aof.dirname, aof.manifest.incrs[len(aof.manifest.incrs)-1].name))
+	return string(base), string(incr)
+}
+
+// listAofDir 目录中的文件名
+func listAofDir(dirname string) []string {
+	entries, _ := os.ReadDir(dirname)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestAofRewrite(t *testing.T) {
+	preamble := config.Properties.AofUseRdbPreamble
+	config.Properties.AofUseRdbPreamble = false
+	t.Cleanup(func() {
+		config.Properties.AofUseRdbPreamble = preamble
+	})
+	dirname := t.TempDir()
+	server := newTestServer()
+	aof, err := openAofDir(t, server, dirname)
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	for i := 0; i < 200; i++ {
+		server.exec(t, client, "rpush", "list", strconv.Itoa(i))
+		server.exec(t, client, "hset", "hash", "f"+strconv.Itoa(i), strconv.Itoa(i))
+		server.exec(t, client, "sadd", "ints", strconv.Itoa(i))
+		server.exec(t, client, "incr", "counter")
+	}
+	server.exec(t, client, "sadd", "members", "a", "b", "c")
+	server.exec(t, client, "function", "load", testLibrary)
+	server.exec(t, client, "select", "1")
+	server.exec(t, client, "set", "ttl", "v")
+	server.exec(t, client, "pexpireat", "ttl", future)
+	server.exec(t, client, "set", "gone", "v")
+	server.exec(t, client, "pexpireat", "gone", "1")
+
+	// 重写的同时继续写入
+	done := make(chan error, 1)
+	go func() {
+		done <- aof.Rewrite()
+	}()
+	writer, _ := server.newClient()
+	for i := 0; ; i++ {
+		server.exec(t, writer, "select", strconv.Itoa(i%3))
+		server.exec(t, writer, "incr", "counter")
+		server.exec(t, writer, "rpush", "list", "during"+strconv.Itoa(i))
+		server.exec(t, writer, "hset", "hash", "during", strconv.Itoa(i))
+		select {
+		case err = <-done:
+		default:
+			continue
+		}
+		break
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Background append only file rewriting already in progress\r\n", func() string {
+		aof.status = rewrite
+		defer func() { aof.status = none }()
+		return server.exec(t, client, "bgrewriteaof")
+	}())
+	// 重写完成之后的写入追加到新的 incr 文件
+	server.exec(t, writer, "select", "0")
+	server.exec(t, writer, "set", "after", "rewrite")
+	aof.flush()
+
+	base, incr := readAofFiles(aof)
+	assert.NotContains(t, base, "gone")
+	assert.Contains(t, base, "*3\r\n$9\r\npexpireat\r\n$3\r\nttl\r\n$13\r\n"+future+"\r\n")
+	// 200个元素的 list 重写为4条 rpush
+	assert.Equal(t, 4, strings.Count(base, "$5\r\nrpush\r\n$4\r\nlist\r\n$1\r\n0\r\n")+
+		strings.Count(base, "$5\r\nrpush\r\n$4\r\nlist\r\n$2\r\n64\r\n")+
+		strings.Count(base, "$5\r\nrpush\r\n$4\r\nlist\r\n$3\r\n128\r\n")+
+		strings.Count(base, "$5\r\nrpush\r\n$4\r\nlist\r\n$3\r\n192\r\n"))
+	assert.Equal(t, int64(len(base)), aof.LasAofRewriteSize())
+	assert.Contains(t, incr, "*3\r\n$3\r\nset\r\n$5\r\nafter\r\n$7\r\nrewrite\r\n")
+	// 重写之前的文件已经被删除
+	assert.Equal(t, []string{"appendonly.aof.1.base.aof", "appendonly.aof.2.incr.aof", "appendonly.aof.manifest"},
+		listAofDir(dirname))
+
+	// 在复制的目录中加载, 加载之后的写入不影响原来的目录
+	reloaded, err := loadAofDir(t, copyAofDir(t, dirname))
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot(server.RedisServer), snapshot(reloaded.RedisServer))
+	other, _ := reloaded.newClient()
+	assert.Equal(t, "$3\r\nbar\r\n", reloaded.exec(t, other, "fcall", "setget", "1", "foo", "bar"))
+}
+
+func TestAofRewriteRdbPreamble(t *testing.T) {
+	preamble := config.Properties.AofUseRdbPreamble
+	config.Properties.AofUseRdbPreamble = true
+	t.Cleanup(func() {
+		config.Properties.AofUseRdbPreamble = preamble
+	})
+	dirname := t.TempDir()
+	server := newTestServer()
+	aof, err := openAofDir(t, server, dirname)
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	for i := 0; i < 100; i++ {
+		server.exec(t, client, "rpush", "list", strconv.Itoa(i))
+		server.exec(t, client, "hset", "hash", "f"+strconv.Itoa(i), strconv.Itoa(i))
+		server.exec(t, client, "sadd", "ints", strconv.Itoa(i))
+		server.exec(t, client, "set", "key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	server.exec(t, client, "sadd", "members", "a", "b", "c")
+	server.exec(t, client, "function", "load", testLibrary)
+	server.exec(t, client, "select", "2")
+	server.exec(t, client, "set", "ttl", "v")
+	server.exec(t, client, "pexpireat", "ttl", future)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- aof.Rewrite()
+	}()
+	writer, _ := server.newClient()
+	for i := 0; ; i++ {
+		server.exec(t, writer, "select", strconv.Itoa(i%3))
+		server.exec(t, writer, "incr", "counter")
+		server.exec(t, writer, "rpush", "list", "during"+strconv.Itoa(i))
+		select {
+		case err = <-done:
+		default:
+			continue
+		}
+		break
+	}
+	assert.Nil(t, err)
+	server.exec(t, writer, "select", "0")
+	server.exec(t, writer, "set", "after", "rewrite")
+	aof.flush()
+
+	// base 文件是 rdb 格式, 后面的 incr 文件是 aof 格式的增量命令
+	base, incr := readAofFiles(aof)
+	assert.True(t, strings.HasPrefix(base, "REDIS"))
+	assert.Equal(t, "appendonly.aof.1.base.rdb", aof.manifest.base.name)
+	assert.Contains(t, incr, "*3\r\n$3\r\nset\r\n$5\r\nafter\r\n$7\r\nrewrite\r\n")
+	// 在复制的目录中加载, 加载之后的写入不影响原来的目录
+	reloaded, err := loadAofDir(t, copyAofDir(t, dirname))
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot(server.RedisServer), snapshot(reloaded.RedisServer))
+	other, _ := reloaded.newClient()
+	assert.Equal(t, "$3\r\nbar\r\n", reloaded.exec(t, other, "fcall", "setget", "1", "foo", "bar"))
+	reloaded.exec(t, other, "select", "2")
+	assert.Equal(t, ":1\r\n", reloaded.exec(t, other, "exists", "ttl"))
+
+	// 关闭之后重写为纯 aof 格式, 仍然可以加载
+	config.Properties.AofUseRdbPreamble = false
+	assert.Nil(t, aof.Rewrite())
+	base, _ = readAofFiles(aof)
+	assert.True(t, strings.HasPrefix(base, "*"))
+	assert.Equal(t, "appendonly.aof.2.base.aof", aof.manifest.base.name)
+	reloaded, err = loadAofDir(t, dirname)
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot(server.RedisServer), snapshot(reloaded.RedisServer))
+}
+
+// TestAofRewriteDeterministic 同样的数据重写出的 base 文件相同, 与写入的顺序和 map 的遍历顺序无关
+func TestAofRewriteDeterministic(t *testing.T) {
+	preamble := config.Properties.AofUseRdbPreamble
+	t.Cleanup(func() {
+		config.Properties.AofUseRdbPreamble = preamble
+	})
+	clk := useManualClock(t)
+	future := strconv.FormatInt(clk.Now().Add(time.Hour).UnixMilli(), 10)
+	// fill 写入同样的数据, reverse 时按照相反的顺序
+	fill := func(server *testServer, reverse bool) {
+		client, _ := server.newClient()
+		for n := 0; n < 200; n++ {
+			i := n
+			if reverse {
+				i = 199 - n
+			}
+			server.exec(t, client, "select", strconv.Itoa(i%2))
+			server.exec(t, client, "set", "key"+strconv.Itoa(i), strconv.Itoa(i))
+			server.exec(t, client, "hset", "hash", "f"+strconv.Itoa(i), strconv.Itoa(i))
+			server.exec(t, client, "sadd", "members", "m"+strconv.Itoa(i))
+			server.exec(t, client, "sadd", "ints", strconv.Itoa(i))
+		}
+		server.exec(t, client, "select", "0")
+		for i := 0; i < 100; i++ {
+			server.exec(t, client, "rpush", "list", strconv.Itoa(i))
+		}
+		server.exec(t, client, "set", "ttl", "v", "pxat", future)
+	}
+	rewrite := func(server *testServer, aof *Aof) string {
+		assert.Nil(t, aof.Rewrite())
+		base, _ := readAofFiles(aof)
+		return base
+	}
+	for _, usePreamble := range []bool{false, true} {
+		config.Properties.AofUseRdbPreamble = usePreamble
+		first, second := newTestServer(), newTestServer()
+		firstAof, err := openAofDir(t, first, t.TempDir())
+		assert.Nil(t, err)
+		secondAof, err := openAofDir(t, second, t.TempDir())
+		assert.Nil(t, err)
+		fill(first, false)
+		fill(second, true)
+
+		base := rewrite(first, firstAof)
+		assert.Equal(t, base, rewrite(first, firstAof), "preamble %v", usePreamble)
+		assert.Equal(t, base, rewrite(second, secondAof), "preamble %v", usePreamble)
+		// DUMP 也与写入的顺序无关
+		client, _ := first.newClient()
+		other, _ := second.newClient()
+		for _, key := range []string{"hash", "members", "ints"} {
+			assert.Equal(t, first.exec(t, client, "dump", key), second.exec(t, other, "dump", key), key)
+		}
+	}
+}
+
+func TestAofManifest(t *testing.T) {
+	data := "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+		"file appendonly.aof.4.incr.aof seq 4 type i\n" +
+		"file appendonly.aof.1.base.aof seq 1 type h\n"
+	m, err := parseManifest([]byte("# comment\n" + data))
+	assert.Nil(t, err)
+	assert.Equal(t, data, string(m.encode()))
+	assert.Equal(t, int64(2), m.baseSeq)
+	assert.Equal(t, int64(4), m.incrSeq)
+	assert.Equal(t, "appendonly.aof.5.incr.aof", m.clone().nextIncr("appendonly.aof").name)
+	assert.Equal(t, "appendonly.aof.3.base.rdb", m.nextBase("appendonly.aof", true).name)
+
+	// 重写完成之后只保留重写开始时创建的 incr 文件
+	rewritten := m.rewritten(m.nextBase("appendonly.aof", false), 4)
+	assert.Equal(t, "file appendonly.aof.3.base.aof seq 3 type b\n"+
+		"file appendonly.aof.4.incr.aof seq 4 type i\n"+
+		"file appendonly.aof.1.base.aof seq 1 type h\n"+
+		"file appendonly.aof.2.base.rdb seq 2 type h\n"+
+		"file appendonly.aof.3.incr.aof seq 3 type h\n", string(rewritten.encode()))
+
+	for _, bad := range []string{
+		"file a seq 1",
+		"file a seq x type i",
+		"file a seq 1 type x",
+		"file a/b seq 1 type i",
+		"file a seq 1 type b\nfile b seq 2 type b",
+		"file a seq 2 type i\nfile b seq 1 type i",
+	} {
+		_, err = parseManifest([]byte(bad))
+		assert.ErrorIs(t, err, errAofManifestFormat, bad)
+	}
+}
+
+func TestUpgradeLegacyAof(t *testing.T) {
+	data, _ := aofWorkload()
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "appendonly.aof"), data, 0600))
+	dirname := filepath.Join(dir, "appendonlydir")
+	server, err := loadAofDir(t, dirname)
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+	assert.Equal(t, "$1\r\n3\r\n", server.exec(t, client, "get", "c"))
+	// 原来的文件作为 base 文件移动到目录中
+	assert.NoFileExists(t, filepath.Join(dir, "appendonly.aof"))
+	manifest, _ := os.ReadFile(filepath.Join(dirname, "appendonly.aof.manifest"))
+	assert.Equal(t, "file appendonly.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n", string(manifest))
+	assert.Equal(t, int64(len(data)), server.aof.LasAofRewriteSize())
+}
+
+// copyAofDir 复制目录中的文件, 模拟宕机时磁盘上的状态
+func copyAofDir(t *testing.T, dirname string) string {
+	dst := t.TempDir()
+	for _, name := range listAofDir(dirname) {
+		data, err := os.ReadFile(filepath.Join(dirname, name))
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(dst, name), data, 0600))
+	}
+	return dst
+}
+
+func TestAofRewriteCrashBeforeManifest(t *testing.T) {
+	dirname := t.TempDir()
+	server := newTestServer()
+	aof, err := openAofDir(t, server, dirname)
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+	for i := 0; i < 100; i++ {
+		server.exec(t, client, "set", "key"+strconv.Itoa(i), strconv.Itoa(i))
+		server.exec(t, client, "rpush", "list", strconv.Itoa(i))
+	}
+	assert.Nil(t, aof.Rewrite())
+	server.exec(t, client, "incr", "counter")
+
+	// 新的 base 和 incr 文件已经写入, 更新 manifest 之前宕机
+	var crashed string
+	aof.writeManifest = func(m *aofManifest) error {
+		if m.base != nil && m.base != aof.manifest.base {
+			crashed = copyAofDir(t, dirname)
+			return errors.New("crashed")
+		}
+		return aof.persistManifest(m)
+	}
+	assert.EqualError(t, aof.Rewrite(), "crashed")
+	assert.Contains(t, listAofDir(crashed), "appendonly.aof.2.base.rdb")
+	reloaded, err := loadAofDir(t, crashed)
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot(server.RedisServer), snapshot(reloaded.RedisServer))
+
+	// 重写失败之后继续写入新的 incr 文件, 下一次重写正常完成
+	aof.writeManifest = aof.persistManifest
+	assert.NotContains(t, listAofDir(dirname), "appendonly.aof.2.base.rdb")
+	server.exec(t, client, "incr", "counter")
+	aof.flush()
+	reloaded, err = loadAofDir(t, dirname)
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot(server.RedisServer), snapshot(reloaded.RedisServer))
+	assert.Nil(t, aof.Rewrite())
+	assert.Equal(t, []string{"appendonly.aof.2.base.rdb", "appendonly.aof.4.incr.aof", "appendonly.aof.manifest"},
+		listAofDir(dirname))
+	reloaded, err = loadAofDir(t, dirname)
+	assert.Nil(t, err)
+	assert.Equal(t, snapshot(server.RedisServer), snapshot(reloaded.RedisServer))
+}
+
+func TestInfoPersistence(t *testing.T) {
+	dirname := t.TempDir()
+	server := newTestServer()
+	aof, err := openAofDir(t, server, dirname)
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	aof.flush()
+	info := server.exec(t, client, "info", "persistence")
+	assert.Contains(t, info, "aof_enabled:1\r\n")
+	assert.Contains(t, info, "aof_base_size:0\r\n")
+	assert.Contains(t, info, "aof_current_size:"+strconv.Itoa(len(setFooBar))+"\r\n")
+
+	assert.Nil(t, aof.Rewrite())
+	server.exec(t, client, "set", "foo", "baz")
+	aof.flush()
+	base, incr := readAofFiles(aof)
+	info = server.exec(t, client, "info", "persistence")
+	assert.Contains(t, info, "aof_base_size:"+strconv.Itoa(len(base))+"\r\n")
+	assert.Contains(t, info, "aof_current_size:"+strconv.Itoa(len(base)+len(incr))+"\r\n")
+	assert.NotContains(t, info, "# Clients")
+}
+
+func TestAutoAofRewrite(t *testing.T) {
+	percentage, minSize := config.Properties.AofRewritePercentage, config.Properties.AofRewriteMinSize
+	t.Cleanup(func() {
+		config.Properties.AofRewritePercentage, config.Properties.AofRewriteMinSize = percentage, minSize
+	})
+	server := newTestServer()
+	aof, err := openAofDir(t, server, t.TempDir())
+	assert.Nil(t, err)
+	client, _ := server.newClient()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set",
+		"auto-aof-rewrite-percentage", "100", "auto-aof-rewrite-min-size", "4kb"))
+	assert.Equal(t, "*2\r\n$25\r\nauto-aof-rewrite-min-size\r\n$4\r\n4096\r\n",
+		server.exec(t, client, "config", "get", "auto-aof-rewrite-min-size"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'auto-aof-rewrite-min-size') - "+
+		"argument must be a memory value\r\n", server.exec(t, client, "config", "set", "auto-aof-rewrite-min-size", "4xb"))
+
+	// 每条命令之后都执行一次 serverCron 的检查, 超过 min-size 之后触发一次重写,
+	// 重写之后的增长没有超过 base 文件的 100%, 不会再次触发
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 45; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), value)
+		server.doAofRewrite()
+	}
+	for aof.Rewriting() {
+		time.Sleep(time.Millisecond)
+	}
+	server.doAofRewrite()
+	for aof.Rewriting() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(1), aof.Rewrites())
+	info := server.exec(t, client, "info", "persistence")
+	assert.Contains(t, info, "aof_rewrites:1\r\n")
+	assert.Contains(t, info, "aof_last_bgrewrite_status:ok\r\n")
+	assert.Contains(t, info, "aof_base_size:"+strconv.FormatInt(aof.LasAofRewriteSize(), 10)+"\r\n")
+
+	// BGSAVE 正在执行时不触发
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "auto-aof-rewrite-percentage", "1"))
+	server.rdbSaving.Store(true)
+	server.doAofRewrite()
+	assert.False(t, aof.Rewriting())
+	server.rdbSaving.Store(false)
+}
@@ -0,0 +1,231 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"math"
+	"runtime/metrics"
+	"strings"
+)
+
+// 超过 maxmemory 时按照 maxmemory-policy 淘汰key, 与 redis 的 evict.c 一致: 从每个 db 中采样 maxmemory-samples 个key,
+// 淘汰其中最合适的一个, 直到释放的内存足够或者没有可以淘汰的key. 淘汰之后仍然超过 maxmemory 时拒绝可能增加内存的命令.
+// 使用的内存是 go 堆上的对象(包括还没有回收的垃圾), 释放的内存按照对象的估算大小计算, 不需要等待 GC
+
+// 淘汰策略
+const (
+	evictNoEviction = iota
+	evictAllKeysLRU
+	evictVolatileLRU
+	evictAllKeysRandom
+	evictVolatileRandom
+	evictVolatileTTL
+	evictAllKeysLFU
+	evictVolatileLFU
+)
+
+var evictionPolicies = map[string]int{
+	"noeviction":      evictNoEviction,
+	"allkeys-lru":     evictAllKeysLRU,
+	"volatile-lru":    evictVolatileLRU,
+	"allkeys-random":  evictAllKeysRandom,
+	"volatile-random": evictVolatileRandom,
+	"volatile-ttl":    evictVolatileTTL,
+	"allkeys-lfu":     evictAllKeysLFU,
+	"volatile-lfu":    evictVolatileLFU,
+}
+
+// setMaxMemoryPolicy CONFIG SET maxmemory-policy, 下一条命令按照新的策略淘汰
+func setMaxMemoryPolicy(value string) (string, error) {
+	lower := strings.ToLower(value)
+	if _, ok := evictionPolicies[lower]; !ok {
+		return "", errors.New("argument(s) must be one of the following: volatile-lru, allkeys-lru, " +
+			"volatile-lfu, allkeys-lfu, volatile-random, allkeys-random, volatile-ttl, noeviction")
+	}
+	return lower, nil
+}
+
+func isLFUPolicy(policy int) bool {
+	return policy == evictAllKeysLFU || policy == evictVolatileLFU
+}
+
+// syncObjectClock 策略在 LRU 和 LFU 之间切换之后, 所有对象的 LRU 字段按照新的含义重新初始化,
+// 之后创建和访问的对象也按照新的含义记录. 调用方持有锁
+func (r *RedisServer) syncObjectClock() {
+	lfu := isLFUPolicy(evictionPolicies[config.Properties.MaxMemoryPolicy])
+	if lfu == obj.LFUEnabled() {
+		return
+	}
+	obj.SetLFU(lfu)
+	for _, mdb := range r.dbs {
+		mdb.data.ForEach(func(key string, val interface{}) bool {
+			if value := val.(*obj.RedisObject); !obj.IsShared(value) {
+				obj.InitLRU(value)
+			}
+			return true
+		})
+	}
+}
+
+// heapInUse go 堆上的对象占用的内存
+func heapInUse() int64 {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64())
+}
+
+func (r *RedisServer) memoryUsed() int64 {
+	if r.usedMemory != nil {
+		return r.usedMemory()
+	}
+	return heapInUse()
+}
+
+// overMaxMemory 是否超过了 maxmemory. 从节点和主节点的数据保持一致, 不受 maxmemory 限制
+func (r *RedisServer) overMaxMemory() (used int64, over bool) {
+	maxmemory := int64(config.Properties.MaxMemory)
+	if maxmemory <= 0 || r.isReplica() || r.loading.Load() {
+		return 0, false
+	}
+	used = r.memoryUsed()
+	return used, used > maxmemory
+}
+
+// performEvictions 淘汰key直到不超过 maxmemory, 返回 false 表示没有可以淘汰的key, 仍然超过 maxmemory. 调用方持有锁
+func (r *RedisServer) performEvictions() bool {
+	r.syncObjectClock()
+	used, over := r.overMaxMemory()
+	if !over {
+		return true
+	}
+	policy := evictionPolicies[config.Properties.MaxMemoryPolicy]
+	if policy == evictNoEviction {
+		return false
+	}
+	// 之前的效果先写入, 每个淘汰的key单独追加 DEL
+	r.propagatePending()
+	toFree := used - int64(config.Properties.MaxMemory)
+	for freed := int64(0); freed < toFree; {
+		mdb, key := r.evictionCandidate(policy)
+		if mdb == nil {
+			return false
+		}
+		freed += mdb.evict(key)
+		r.stats.evictedKeys.Add(1)
+		r.propagatePending()
+	}
+	return true
+}
+
+// evictionCandidate 按照策略选出下一个淘汰的key, 没有可以淘汰的key时返回 nil
+func (r *RedisServer) evictionCandidate(policy int) (*DB, string) {
+	volatile := policy == evictVolatileLRU || policy == evictVolatileLFU || policy == evictVolatileRandom ||
+		policy == evictVolatileTTL
+	random := policy == evictAllKeysRandom || policy == evictVolatileRandom
+	samples := config.Properties.MaxMemorySamples
+	if samples <= 0 || random {
+		samples = 1
+	}
+	var bestDb *DB
+	var bestKey string
+	var bestScore int64
+	for i := range r.dbs {
+		// 随机淘汰时每次从下一个 db 开始, 所有的 db 轮流淘汰
+		index := (r.nextEvictDb + i) % len(r.dbs)
+		mdb := r.dbs[index]
+		keys := mdb.sampleKeys(volatile, samples)
+		if len(keys) == 0 {
+			continue
+		}
+		if random {
+			r.nextEvictDb = (index + 1) % len(r.dbs)
+			return mdb, keys[0]
+		}
+		for _, key := range keys {
+			score := mdb.evictionScore(key, policy)
+			if bestDb == nil || score > bestScore {
+				bestDb, bestKey, bestScore = mdb, key, score
+			}
+		}
+	}
+	return bestDb, bestKey
+}
+
+// touchEntity 访问key时更新 LRU 时钟或者 LFU 计数
+func touchEntity(entity *obj.RedisObject) {
+	// 共享的对象没有自己的访问信息
+	if obj.IsShared(entity) {
+		return
+	}
+	if obj.LFUEnabled() {
+		obj.LFUTouch(entity, config.Properties.LfuLogFactor, config.Properties.LfuDecayTime)
+	} else {
+		entity.LRU = obj.LRUClock()
+	}
+}
+
+// sampleKeys 随机取 count 个key, 可能重复. volatile 时只从设置了过期时间的key中取
+func (db *DB) sampleKeys(volatile bool, count int) []string {
+	if volatile {
+		return db.ttlCache.RandomKeys(count)
+	}
+	if db.data.Len() == 0 {
+		return nil
+	}
+	return db.data.RandomKeys(count)
+}
+
+// evictionScore 越大越应该被淘汰: LRU 是空闲的秒数, LFU 是访问频率越低越大, TTL 是过期时间越早越大. 不更新key的访问信息
+func (db *DB) evictionScore(key string, policy int) int64 {
+	if policy == evictVolatileTTL {
+		return math.MaxInt64 - db.ttlCache.ExpireAtTimestamp(key)
+	}
+	row, exists := db.data.Get(key)
+	if !exists {
+		return 0
+	}
+	if isLFUPolicy(policy) {
+		return 255 - int64(obj.LFUFreq(row.(*obj.RedisObject), config.Properties.LfuDecayTime))
+	}
+	return obj.IdleTime(row.(*obj.RedisObject))
+}
+
+// evict 淘汰key, 和过期一样追加 DEL 或者 UNLINK 并发布 evicted 事件, 返回估算释放的内存. 共享的对象不会被释放, 只计算key
+func (db *DB) evict(key string) int64 {
+	row, exists := db.data.Get(key)
+	if !exists {
+		return 0
+	}
+	mem := int64(len(key))
+	if value := row.(*obj.RedisObject); !obj.IsShared(value) {
+		mem += obj.ObjectMemory(value)
+	}
+	db.Delete(key, config.Properties.LazyfreeLazyEviction)
+	db.Notify(notifyEvicted, "evicted", key)
+	db.propagateDeletion(key, config.Properties.LazyfreeLazyEviction)
+	return mem
+}
+
+// InfoMemory INFO memory
+func (r *RedisServer) InfoMemory() string {
+	return fmt.Sprintf("# Memory\r\n"+
+		"used_memory:%d\r\n"+
+		"maxmemory:%d\r\n"+
+		"maxmemory_policy:%s\r\n"+
+		"lazyfree_pending_objects:%d\r\n"+
+		"lazyfreed_objects:%d\r\n"+
+		"active_defrag_hits:%d\r\n"+
+		"active_defrag_misses:%d\r\n"+
+		"active_defrag_reclaimed_bytes:%d\r\n",
+		r.memoryUsed(),
+		config.Properties.MaxMemory,
+		config.Properties.MaxMemoryPolicy,
+		lazyfree.pending.Load(),
+		lazyfree.freed.Load(),
+		r.stats.defragHits.Load(),
+		r.stats.defragMisses.Load(),
+		r.stats.defragReclaimed.Load(),
+	)
+}
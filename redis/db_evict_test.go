@@ -0,0 +1,295 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useMaxMemory 打开 maxmemory, 使用的内存按照数据的估算大小计算, 测试结束时恢复配置
+func useMaxMemory(t *testing.T, server *testServer, maxmemory int64, policy string) {
+	maxMemory, maxMemoryPolicy, samples := config.Properties.MaxMemory, config.Properties.MaxMemoryPolicy,
+		config.Properties.MaxMemorySamples
+	t.Cleanup(func() {
+		config.Properties.MaxMemory = maxMemory
+		config.Properties.MaxMemoryPolicy = maxMemoryPolicy
+		config.Properties.MaxMemorySamples = samples
+		obj.SetLFU(isLFUPolicy(evictionPolicies[maxMemoryPolicy]))
+	})
+	config.Properties.MaxMemory = int(maxmemory)
+	config.Properties.MaxMemoryPolicy = policy
+	server.usedMemory = func() int64 {
+		return datasetMemory(server)
+	}
+}
+
+func datasetMemory(server *testServer) int64 {
+	var used int64
+	for _, mdb := range server.dbs {
+		mdb.data.ForEach(func(key string, val interface{}) bool {
+			used += int64(len(key))
+			// 共享的对象不属于任何一个key
+			if value := val.(*obj.RedisObject); !obj.IsShared(value) {
+				used += obj.ObjectMemory(value)
+			}
+			return true
+		})
+	}
+	return used
+}
+
+// infoAll INFO all 中的一个字段
+func infoAll(t *testing.T, server *testServer, client *Client, field string) string {
+	for _, line := range strings.Split(server.exec(t, client, "info", "all"), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return line[len(field)+1:]
+		}
+	}
+	return ""
+}
+
+// makeIdle 所有的key都已经一段时间没有访问
+func makeIdle(server *testServer, seconds int64) {
+	for _, mdb := range server.dbs {
+		mdb.data.ForEach(func(key string, val interface{}) bool {
+			val.(*obj.RedisObject).LRU = uint32(int64(obj.LRUClock())-seconds) & obj.LRUClockMax
+			return true
+		})
+	}
+}
+
+func TestMaxMemoryNoEviction(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 10; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), value)
+	}
+	useMaxMemory(t, server, datasetMemory(server)-1, "noeviction")
+
+	// 超过 maxmemory 时拒绝可能增加内存的命令, 读取和删除不受影响
+	oom := "-OOM command not allowed when used memory > 'maxmemory'.\r\n"
+	assert.Equal(t, oom, server.exec(t, client, "set", "foo", "bar"))
+	assert.Equal(t, oom, server.exec(t, client, "rpush", "list", "a"))
+	assert.Equal(t, "$100\r\n"+value+"\r\n", server.exec(t, client, "get", "key:0"))
+	assert.Equal(t, oom, server.exec(t, client, "eval", "return redis.call('set', 'foo', 'bar')", "0"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "eval", "return redis.call('del', 'key:1')", "0"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "bar"))
+	assert.Equal(t, "0", infoAll(t, server, client, "evicted_keys"))
+	assert.Equal(t, "noeviction", infoAll(t, server, client, "maxmemory_policy"))
+	assert.Equal(t, 10, server.dbs[0].Len())
+}
+
+func TestMaxMemoryLRU(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	defer setKeyspaceEvents("")
+	client, _ := server.newClient()
+	subscriber, subConn := server.newClient()
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 200; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), value)
+	}
+	// 前20个key最近被访问过
+	makeIdle(server, 1000)
+	for i := 0; i < 20; i++ {
+		server.exec(t, client, "get", "key:"+strconv.Itoa(i))
+	}
+	server.exec(t, client, "config", "set", "notify-keyspace-events", "Ee")
+	server.exec(t, subscriber, "subscribe", "__keyevent@0__:evicted")
+	subConn.take()
+	takeAof(server, file)
+	useMaxMemory(t, server, datasetMemory(server)-1, "allkeys-lru")
+	config.Properties.MaxMemorySamples = 10
+
+	// 执行命令之前淘汰, 淘汰的key和过期一样追加 DEL, 并且发布 evicted 事件
+	server.exec(t, client, "set", "new:0", value)
+	out := strings.Split(takeAof(server, file), "\r\n")
+	assert.Equal(t, []string{"*2", "$3", "del"}, out[:3])
+	victim := out[4]
+	assert.True(t, strings.HasPrefix(victim, "key:"), victim)
+	assert.Equal(t, resp([]string{"set", "new:0", value}), strings.Join(out[5:], "\r\n"))
+	assert.Equal(t, resp([]string{"message", "__keyevent@0__:evicted", victim}), subConn.take())
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", victim))
+	for i := 1; i < 100; i++ {
+		assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "new:"+strconv.Itoa(i), value))
+	}
+
+	// 淘汰的是很久没有访问的key, 最近访问过的key和新写入的key保留下来
+	evicted, _ := strconv.Atoi(infoAll(t, server, client, "evicted_keys"))
+	assert.True(t, evicted >= 95 && evicted <= 105, evicted)
+	survived := 0
+	for i := 0; i < 20; i++ {
+		if server.exec(t, client, "get", "key:"+strconv.Itoa(i)) == "$100\r\n"+value+"\r\n" {
+			survived++
+		}
+	}
+	assert.True(t, survived >= 18, survived)
+	assert.Equal(t, "$100\r\n"+value+"\r\n", server.exec(t, client, "get", "new:99"))
+}
+
+func TestEvictionPropagatesUnlink(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	lazyEviction := config.Properties.LazyfreeLazyEviction
+	t.Cleanup(func() { config.Properties.LazyfreeLazyEviction = lazyEviction })
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 10; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), value)
+	}
+	server.exec(t, client, "config", "set", "lazyfree-lazy-eviction", "yes")
+	takeAof(server, file)
+	useMaxMemory(t, server, datasetMemory(server)-1, "allkeys-random")
+
+	// lazyfree-lazy-eviction 打开时淘汰的key追加 UNLINK
+	server.exec(t, client, "set", "new", value)
+	out := strings.Split(takeAof(server, file), "\r\n")
+	assert.Equal(t, []string{"*2", "$6", "unlink"}, out[:3])
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", out[4]))
+}
+
+func TestMaxMemoryVolatile(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 10; i++ {
+		server.exec(t, client, "set", "persistent:"+strconv.Itoa(i), value)
+		server.exec(t, client, "set", "volatile:"+strconv.Itoa(i), value, "ex", strconv.Itoa(1000+i))
+	}
+	useMaxMemory(t, server, datasetMemory(server), "volatile-ttl")
+	config.Properties.MaxMemorySamples = 100
+
+	// 最先过期的key先淘汰
+	server.exec(t, client, "set", "foo", "bar")
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "volatile:0"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "exists", "volatile:1"))
+
+	// 只淘汰设置了过期时间的key, 没有可以淘汰的key时拒绝写入
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "maxmemory-policy", "volatile-random"))
+	for i := 0; i < 20; i++ {
+		server.exec(t, client, "set", "small:"+strconv.Itoa(i), value)
+	}
+	assert.Equal(t, "-OOM command not allowed when used memory > 'maxmemory'.\r\n",
+		server.exec(t, client, "set", "foo", value))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, ":1\r\n", server.exec(t, client, "exists", "persistent:"+strconv.Itoa(i)))
+		assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "volatile:"+strconv.Itoa(i)))
+	}
+	assert.Equal(t, "10", infoAll(t, server, client, "evicted_keys"))
+}
+
+func TestMaxMemoryConfig(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	useMaxMemory(t, server, 0, "noeviction")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "maxmemory", "1mb", "maxmemory-policy", "ALLKEYS-LRU"))
+	assert.Equal(t, "1048576", infoAll(t, server, client, "maxmemory"))
+	assert.Equal(t, "allkeys-lru", infoAll(t, server, client, "maxmemory_policy"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'maxmemory-policy') - argument(s) must be "+
+		"one of the following: volatile-lru, allkeys-lru, volatile-lfu, allkeys-lfu, volatile-random, allkeys-random, volatile-ttl, noeviction\r\n",
+		server.exec(t, client, "config", "set", "maxmemory-policy", "lru"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'maxmemory-samples') - argument must be "+
+		"greater than 0\r\n", server.exec(t, client, "config", "set", "maxmemory-samples", "0"))
+
+	// 数据的大小
+	server.exec(t, client, "hset", "hash", "field", "value")
+	server.exec(t, client, "sadd", "set", "1", "2")
+	assert.NotEqual(t, "$-1\r\n", server.exec(t, client, "memory", "usage", "hash"))
+	assert.NotEqual(t, "$-1\r\n", server.exec(t, client, "memory", "usage", "set"))
+}
+
+func TestObjectFreq(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	useMaxMemory(t, server, 0, "allkeys-lru")
+	server.exec(t, client, "set", "foo", "bar")
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "object", "idletime", "foo"))
+	assert.Equal(t, "-ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that "+
+		"when switching between policies at runtime LRU and LFU data will take some time to adjust.\r\n",
+		server.exec(t, client, "object", "freq", "foo"))
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "object", "idletime", "missing"))
+
+	// lfu-log-factor 为0时每次访问计数都加一, 不衰减, 结果是确定的
+	defer func() {
+		config.Properties.LfuLogFactor, config.Properties.LfuDecayTime = 10, 1
+	}()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "lfu-log-factor", "0", "lfu-decay-time", "0"))
+	// 切换到 LFU 之后所有的key从初始的计数开始, OBJECT 不算一次访问
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "maxmemory-policy", "allkeys-lfu"))
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", obj.LFUInitVal), server.exec(t, client, "object", "freq", "foo"))
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", obj.LFUInitVal), server.exec(t, client, "object", "freq", "foo"))
+	server.exec(t, client, "get", "foo")
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", obj.LFUInitVal+1), server.exec(t, client, "object", "freq", "foo"))
+	// 覆盖写入保留访问频率, SET 本身也算一次访问
+	server.exec(t, client, "set", "foo", "baz")
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", obj.LFUInitVal+2), server.exec(t, client, "object", "freq", "foo"))
+	assert.True(t, strings.HasPrefix(server.exec(t, client, "object", "idletime", "foo"),
+		"-ERR An LFU maxmemory policy is selected, idle time not tracked."))
+
+	// RESTORE 只使用和当前策略对应的选项
+	payload := server.exec(t, client, "dump", "foo")
+	payload = payload[strings.Index(payload, "\r\n")+2 : len(payload)-2]
+	server.exec(t, client, "restore", "lfu", "0", payload, "FREQ", "100", "IDLETIME", "1000")
+	assert.Equal(t, ":100\r\n", server.exec(t, client, "object", "freq", "lfu"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "maxmemory-policy", "volatile-lru"))
+	server.exec(t, client, "restore", "lru", "0", payload, "FREQ", "100", "IDLETIME", "1000")
+	assert.Equal(t, ":1000\r\n", server.exec(t, client, "object", "idletime", "lru"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "object", "idletime", "lfu"))
+
+	assert.Equal(t, "-ERR unknown subcommand 'foo'. Try OBJECT HELP.\r\n", server.exec(t, client, "object", "foo", "bar"))
+	assert.Equal(t, resp([]string{"lfu-log-factor", "0"}), server.exec(t, client, "config", "get", "lfu-log-factor"))
+}
+
+// hotKeysSurvived 90% 的访问集中在前10%的key上, 写满 maxmemory 之后继续写入新的key, 返回保留下来的热点key的个数
+func hotKeysSurvived(t *testing.T, policy string) int {
+	server := newTestServer()
+	client, _ := server.newClient()
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 1000; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), value)
+	}
+	useMaxMemory(t, server, 0, policy)
+	config.Properties.MaxMemorySamples = 10
+	rng := rand.New(rand.NewSource(1))
+	access := func() {
+		if rng.Intn(10) < 9 {
+			server.exec(t, client, "get", "key:"+strconv.Itoa(rng.Intn(100)))
+		} else {
+			server.exec(t, client, "get", "key:"+strconv.Itoa(100+rng.Intn(900)))
+		}
+	}
+	// 切换策略之后先积累访问频率
+	for i := 0; i < 1000; i++ {
+		access()
+	}
+	config.Properties.MaxMemory = int(datasetMemory(server))
+	for i := 0; i < 500; i++ {
+		access()
+		access()
+		server.exec(t, client, "set", "new:"+strconv.Itoa(i), value)
+	}
+	survived := 0
+	for i := 0; i < 100; i++ {
+		if _, exists := server.dbs[0].data.Get("key:" + strconv.Itoa(i)); exists {
+			survived++
+		}
+	}
+	return survived
+}
+
+func TestMaxMemoryLFU(t *testing.T) {
+	var lfu, random int
+	t.Run("allkeys-lfu", func(t *testing.T) {
+		lfu = hotKeysSurvived(t, "allkeys-lfu")
+	})
+	t.Run("allkeys-random", func(t *testing.T) {
+		random = hotKeysSurvived(t, "allkeys-random")
+	})
+	t.Logf("hot keys survived: lfu %d, random %d", lfu, random)
+	assert.True(t, lfu >= 95, lfu)
+	assert.True(t, lfu-random >= 30, random)
+}
@@ -0,0 +1,76 @@
+package redis
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// 与 redis 一样, 启动时网络服务先开始监听, 在后台加载 aof 或者 rdb. 加载期间 loading 为 true,
+// 只允许执行带有 flagLoading 的命令(COMMAND INFO 中的 loading), 其他的命令(包括 PING)回复 -LOADING, INFO persistence 中可以看到加载的进度
+
+// loadingProgress 加载的进度, 加载的协程更新, INFO 在其他客户端的命令中读取
+type loadingProgress struct {
+	// startTime 开始加载的时间, unix 纳秒
+	startTime   atomic.Int64
+	loadedBytes atomic.Int64
+	totalBytes  atomic.Int64
+	// throttle 每次读取文件之前调用, 测试中替换, 模拟很慢的磁盘
+	throttle func()
+}
+
+// start 开始加载 total 个字节
+func (p *loadingProgress) start(total int64) {
+	p.startTime.Store(time.Now().UnixNano())
+	p.loadedBytes.Store(0)
+	p.totalBytes.Store(total)
+}
+
+// reader 统计从 rd 读取的字节数
+func (p *loadingProgress) reader(rd io.Reader) io.Reader {
+	return &loadingReader{Reader: rd, progress: p}
+}
+
+// eta 按照已经加载的速度估计剩余的秒数, 与 redis 一样还没有读取数据时是1
+func (p *loadingProgress) eta() int64 {
+	elapsed := time.Duration(time.Now().UnixNano() - p.startTime.Load())
+	loaded := p.loadedBytes.Load()
+	if elapsed <= 0 || loaded <= 0 {
+		return 1
+	}
+	remaining := p.totalBytes.Load() - loaded
+	if remaining <= 0 {
+		return 0
+	}
+	return int64(elapsed.Seconds() * float64(remaining) / float64(loaded))
+}
+
+// percent 已经加载的百分比
+func (p *loadingProgress) percent() float64 {
+	total := p.totalBytes.Load()
+	if total <= 0 {
+		return 0
+	}
+	return float64(p.loadedBytes.Load()) * 100 / float64(total)
+}
+
+type loadingReader struct {
+	io.Reader
+	progress *loadingProgress
+}
+
+func (l *loadingReader) Read(b []byte) (int, error) {
+	if l.progress.throttle != nil {
+		l.progress.throttle()
+	}
+	n, err := l.Reader.Read(b)
+	l.progress.loadedBytes.Add(int64(n))
+	return n, err
+}
+
+// finishLoading 在锁内清除 loading, 之后执行的命令看到的是完整的数据
+func (r *RedisServer) finishLoading() {
+	lock.Lock()
+	defer lock.Unlock()
+	r.loading.Store(false)
+}
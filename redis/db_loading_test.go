@@ -0,0 +1,94 @@
+package redis
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadingReplies(t *testing.T) {
+	data, _ := aofWorkload()
+	dirname, _ := writeAofDir(t, data)
+	server := newTestServer()
+	_, err := openAofDir(t, server, dirname)
+	assert.Nil(t, err)
+	// 第一次读取文件之前一直等待, 模拟很慢的磁盘
+	release := make(chan struct{})
+	server.loadingProgress.throttle = func() {
+		<-release
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	serveLoading(t, server, []string{"tcp://" + addr})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	send := func(cmd string, args ...string) {
+		_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine(cmd, args...)).ToBytes())
+	}
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	info := func() string {
+		send("info", "persistence")
+		return readBulk(t, reader)
+	}
+
+	loadingErr := "-LOADING Redis is loading the dataset in memory\r\n"
+	send("ping")
+	assert.Equal(t, loadingErr, readLine())
+	send("get", "a")
+	assert.Equal(t, loadingErr, readLine())
+	send("set", "a", "2")
+	assert.Equal(t, loadingErr, readLine())
+	send("client", "setname", "loader")
+	assert.Equal(t, "+OK\r\n", readLine())
+	persistence := info()
+	assert.Contains(t, persistence, "loading:1\r\n")
+	assert.Contains(t, persistence, "loading_total_bytes:"+strconv.Itoa(len(data))+"\r\n")
+	assert.Contains(t, persistence, "loading_loaded_bytes:0\r\n")
+	assert.Contains(t, persistence, "loading_eta_seconds:1\r\n")
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		send("ping")
+		return readLine() == "+PONG\r\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	send("get", "a")
+	assert.Equal(t, "1", readBulk(t, reader))
+	persistence = info()
+	assert.Contains(t, persistence, "loading:0\r\n")
+	assert.False(t, strings.Contains(persistence, "loading_total_bytes"))
+	assert.Equal(t, int64(len(data)), server.loadingProgress.loadedBytes.Load())
+}
+
+func TestLoadingProgressEta(t *testing.T) {
+	progress := &loadingProgress{}
+	progress.start(1000)
+	assert.Equal(t, int64(1), progress.eta())
+	// 10 秒读取了四分之一
+	progress.startTime.Store(time.Now().Add(-10 * time.Second).UnixNano())
+	progress.loadedBytes.Store(250)
+	assert.Equal(t, int64(30), progress.eta())
+	assert.Equal(t, 25.0, progress.percent())
+	progress.loadedBytes.Store(1000)
+	assert.Equal(t, int64(0), progress.eta())
+}
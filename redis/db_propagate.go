@@ -0,0 +1,70 @@
+package redis
+
+import (
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"strings"
+)
+
+var (
+	multiCmdLine = util.ToCmdLine("MULTI")
+	execCmdLine  = util.ToCmdLine("EXEC")
+)
+
+// propagation 写命令产生的一条写入效果
+type propagation struct {
+	dbIndex int
+	cmdLine [][]byte
+}
+
+// bindPropagator 写命令通过 DB.Propagate 记录写入的效果, 命令执行完成之后由 propagatePending 统一写入 aof 和复制流
+func (r *RedisServer) bindPropagator() {
+	for _, ddb := range r.dbs {
+		mDb := ddb
+		mDb.ExpirePolicy = r.expirePolicy
+		mDb.Propagate = func(cmdLine [][]byte) {
+			r.pending = append(r.pending, propagation{dbIndex: mDb.Index, cmdLine: cmdLine})
+			r.dirty.Add(1)
+		}
+	}
+}
+
+// propagatePending 写入当前命令产生的效果, 有多个效果时用 MULTI/EXEC 包起来, 重放 aof 和从节点执行时也是原子的. 调用方持有锁.
+// EXEC 中排队的命令的效果(包括 SPOP 转换的 SREM, 带过期时间的 SET 产生的两条)都留在 pending 中, EXEC 结束之后只包一层;
+// 只读的事务和 WATCH 失败的 EXEC 没有效果, 不写入任何内容
+func (r *RedisServer) propagatePending() {
+	pending := r.pending
+	if len(pending) == 0 {
+		return
+	}
+	r.pending = nil
+	if len(pending) > 1 {
+		r.propagate(pending[0].dbIndex, multiCmdLine)
+	}
+	for _, p := range pending {
+		r.propagate(p.dbIndex, p.cmdLine)
+	}
+	if len(pending) > 1 {
+		r.propagate(pending[len(pending)-1].dbIndex, execCmdLine)
+	}
+}
+
+// propagate 追加到 aof 和复制流, 与 redis 一样加载数据时执行的命令不传播
+func (r *RedisServer) propagate(dbIndex int, cmdLine [][]byte) {
+	if r.loading.Load() {
+		return
+	}
+	if config.Properties.AppendOnly && r.aof != nil {
+		r.aof.AppendAof(dbIndex, cmdLine)
+	}
+	r.repl.feed(dbIndex, cmdLine, r.currentClient != nil && r.currentClient.master)
+}
+
+// isTxMarker 重放 aof 和执行主节点的复制流时, MULTI 和 EXEC 只是一组效果的边界
+func isTxMarker(cmdLine [][]byte) bool {
+	if len(cmdLine) != 1 {
+		return false
+	}
+	name := strings.ToLower(string(cmdLine[0]))
+	return name == "multi" || name == "exec"
+}
@@ -0,0 +1,166 @@
+package redis
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resp 把命令编码成 aof 和复制流中的格式
+func resp(cmdLines ...[]string) string {
+	builder := &strings.Builder{}
+	for _, cmdLine := range cmdLines {
+		builder.Write(MakeMultiBulkReply(util.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+	return builder.String()
+}
+
+// takeAof 取出目前为止写入aof的数据
+func takeAof(server *testServer, file *fakeAofFile) string {
+	server.aof.flush()
+	file.mux.Lock()
+	defer file.mux.Unlock()
+	result := file.data.String()
+	file.data.Reset()
+	return result
+}
+
+func TestPropagateRewrites(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	server.exec(t, client, "sadd", "set", "a", "b", "c")
+	takeAof(server, file)
+
+	// 随机的 SPOP 转换为 SREM, 弹出所有的元素时转换为 DEL
+	member := bulkPayload(server.exec(t, client, "spop", "set"))
+	assert.Equal(t, resp([]string{"srem", "set", member}), takeAof(server, file))
+	reply := server.exec(t, client, "spop", "set", "1")
+	member = reply[strings.LastIndex(reply[:len(reply)-2], "\r\n")+2 : len(reply)-2]
+	assert.Equal(t, resp([]string{"srem", "set", member}), takeAof(server, file))
+	server.exec(t, client, "spop", "set", "10")
+	assert.Equal(t, resp([]string{"del", "set"}), takeAof(server, file))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "spop", "set", "0"))
+	assert.Equal(t, "", takeAof(server, file))
+
+	// 相对的过期时间转换为毫秒精度的 PEXPIREAT
+	server.exec(t, client, "set", "foo", "bar")
+	takeAof(server, file)
+	before := time.Now().Add(100 * time.Second).UnixMilli()
+	server.exec(t, client, "expire", "foo", "100")
+	out := takeAof(server, file)
+	prefix := "*3\r\n$9\r\npexpireat\r\n$3\r\nfoo\r\n$13\r\n"
+	assert.True(t, strings.HasPrefix(out, prefix), out)
+	at, err := strconv.ParseInt(strings.TrimSuffix(out[len(prefix):], "\r\n"), 10, 64)
+	assert.Nil(t, err)
+	assert.True(t, at >= before && at <= time.Now().Add(100*time.Second).UnixMilli())
+
+	// INCRBYFLOAT 的结果转换为 SET KEEPTTL
+	server.exec(t, client, "set", "float", "10.5")
+	takeAof(server, file)
+	assert.Equal(t, "$4\r\n10.6\r\n", server.exec(t, client, "incrbyfloat", "float", "0.1"))
+	assert.Equal(t, resp([]string{"set", "float", "10.6", "KEEPTTL"}), takeAof(server, file))
+	assert.Equal(t, "-ERR value is not a valid float\r\n", server.exec(t, client, "incrbyfloat", "float", "abc"))
+	assert.Equal(t, "", takeAof(server, file))
+
+	// 一条命令产生多个效果时用 MULTI/EXEC 包起来
+	server.exec(t, client, "set", "ttl", "v", "px", "100000")
+	out = takeAof(server, file)
+	head := resp([]string{"MULTI"}, []string{"set", "ttl", "v"})
+	assert.True(t, strings.HasPrefix(out, head), out)
+	assert.True(t, strings.HasSuffix(out, resp([]string{"EXEC"})), out)
+	assert.Contains(t, out, "$9\r\npexpireat\r\n$3\r\nttl\r\n")
+	server.exec(t, client, "eval", "redis.call('set', KEYS[1], 'a') redis.call('select', 1) "+
+		"return redis.call('incr', KEYS[1])", "1", "foo")
+	assert.Equal(t, resp([]string{"MULTI"}, []string{"set", "foo", "a"}, []string{"SELECT", "1"},
+		[]string{"incr", "foo"}, []string{"EXEC"}), takeAof(server, file))
+}
+
+// TestPropagateOnlyMutations 只有部分参数写入的命令只在修改了数据时写入aof
+func TestPropagateOnlyMutations(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "rpush", "list", "2", "1")
+	takeAof(server, file)
+
+	server.exec(t, client, "getex", "foo")
+	server.exec(t, client, "getex", "foo", "persist")
+	server.exec(t, client, "getex", "missing", "ex", "100")
+	server.exec(t, client, "sort", "list")
+	server.exec(t, client, "getdel", "missing")
+	assert.Equal(t, "", takeAof(server, file))
+
+	// GETEX 的过期时间转换为 PEXPIREAT, PERSIST 只在有过期时间时传播
+	at := time.Now().Add(time.Hour).UnixMilli()
+	server.exec(t, client, "getex", "foo", "pxat", strconv.FormatInt(at, 10))
+	assert.Equal(t, resp([]string{"pexpireat", "foo", strconv.FormatInt(at, 10)}), takeAof(server, file))
+	server.exec(t, client, "getex", "foo", "persist")
+	assert.Equal(t, resp([]string{"persist", "foo"}), takeAof(server, file))
+	server.exec(t, client, "getex", "foo", "exat", "1")
+	assert.Equal(t, resp([]string{"del", "foo"}), takeAof(server, file))
+
+	server.exec(t, client, "sort", "list", "store", "dst")
+	assert.Equal(t, resp([]string{"MULTI"}, []string{"del", "dst"}, []string{"rpush", "dst", "1", "2"}, []string{"EXEC"}), takeAof(server, file))
+	server.exec(t, client, "set", "foo", "bar")
+	takeAof(server, file)
+	server.exec(t, client, "getdel", "foo")
+	assert.Equal(t, resp([]string{"del", "foo"}), takeAof(server, file))
+}
+
+func TestReplayTxMarkers(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "ttl", "v", "ex", "100")
+	server.exec(t, client, "sadd", "set", "1", "2")
+	server.exec(t, client, "spop", "set")
+	data := takeAof(server, file)
+
+	// 加载aof时 MULTI/EXEC 只是边界, 不是未知的命令
+	dirname, _ := writeAofDir(t, []byte(data))
+	loaded, err := loadAofDir(t, dirname)
+	assert.Nil(t, err)
+	other, _ := loaded.newClient()
+	assert.Equal(t, "$1\r\nv\r\n", loaded.exec(t, other, "get", "ttl"))
+	assert.Contains(t, []string{":99\r\n", ":100\r\n"}, loaded.exec(t, other, "ttl", "ttl"))
+	assert.Equal(t, ":1\r\n", loaded.exec(t, other, "scard", "set"))
+	assert.Equal(t, "0", persistenceField(t, loaded, other, "rdb_changes_since_last_save"))
+
+	// 从节点执行主节点的 MULTI/EXEC, 偏移量包括 MULTI 和 EXEC
+	master, _ := loaded.newClient()
+	master.master = true
+	stream := resp([]string{"MULTI"}, []string{"set", "k", "v"}, []string{"EXEC"})
+	for _, cmdLine := range [][]string{{"MULTI"}, {"set", "k", "v"}, {"EXEC"}} {
+		master.PushCmd(util.ToCmdLine(cmdLine[0], cmdLine[1:]...))
+	}
+	offset, _ := strconv.Atoi(infoField(t, loaded, other, "master_repl_offset"))
+	assert.Nil(t, loaded.process(context.Background(), master))
+	assert.Equal(t, "$1\r\nv\r\n", loaded.exec(t, other, "get", "k"))
+	assert.Equal(t, strconv.Itoa(offset+len(stream)), infoField(t, loaded, other, "master_repl_offset"))
+}
+
+// persistenceField INFO persistence 中的一个字段
+func persistenceField(t *testing.T, server *testServer, client *Client, field string) string {
+	for _, line := range strings.Split(server.exec(t, client, "info", "persistence"), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return line[len(field)+1:]
+		}
+	}
+	return ""
+}
+
+func TestDirtyCounter(t *testing.T) {
+	useTempDir(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "get", "foo")
+	server.exec(t, client, "set", "ttl", "v", "ex", "100")
+	// 读命令不计数, 一条命令的每个效果都计数
+	assert.Equal(t, "3", persistenceField(t, server, client, "rdb_changes_since_last_save"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "save"))
+	assert.Equal(t, "0", persistenceField(t, server, client, "rdb_changes_since_last_save"))
+}
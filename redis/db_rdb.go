@@ -0,0 +1,284 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/rdb"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var ErrBgSaveInProgress = errors.New("ERR Background save already in progress")
+
+// rdbFilename dir 和 dbfilename 组成的 rdb 文件路径
+func rdbFilename() string {
+	return filepath.Join(config.Properties.Dir, config.Properties.DbFilename)
+}
+
+// writeRdb 把所有db和函数库按照 RDB 格式写入 w, 调用方需要持有锁. 和 BGSAVE 一样遍历快照, key 的顺序是确定的
+func (r *RedisServer) writeRdb(w io.Writer) error {
+	snapshot := r.Snapshot()
+	defer snapshot.Release()
+	return encodeRdb(w, snapshot.ForEach, snapshot.ForEachLibrary)
+}
+
+// encodeRdb 按照 RDB 格式写入 each 遍历的数据, aof 重写的 rdb preamble 也使用它. extra 是额外的辅助字段
+func encodeRdb(w io.Writer, each ForEach, eachLibrary ForEachLibrary, extra ...[2]string) error {
+	e := rdb.NewEncoder(w)
+	if err := e.WriteHeader(); err != nil {
+		return err
+	}
+	aofBase := "0"
+	if config.Properties.AppendOnly {
+		aofBase = "1"
+	}
+	aux := [][2]string{
+		{"redis-ver", redisVersion},
+		{"redis-bits", strconv.Itoa(32 << (^uint(0) >> 63))},
+		{"ctime", strconv.FormatInt(dbClock.Now().Unix(), 10)},
+		{"aof-base", aofBase},
+	}
+	aux = append(aux, extra...)
+	for _, field := range aux {
+		if err := e.WriteAux(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	var err error
+	eachLibrary(func(code []byte) bool {
+		err = e.WriteFunction(code)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < config.Properties.Databases; i++ {
+		// 先统计key的数量, 空的db不写入
+		size, expires := 0, 0
+		each(i, func(key string, entity *obj.RedisObject, expiration *time.Time) bool {
+			size++
+			if expiration != nil {
+				expires++
+			}
+			return true
+		})
+		if size == 0 {
+			continue
+		}
+		if err = e.WriteSelectDB(i); err != nil {
+			return err
+		}
+		if err = e.WriteResizeDB(size, expires); err != nil {
+			return err
+		}
+		each(i, func(key string, entity *obj.RedisObject, expiration *time.Time) bool {
+			err = e.WriteEntry(key, entity, expiration)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return e.WriteEOF()
+}
+
+// SaveRdb SAVE, 在当前的协程中写入 rdb 文件
+func (r *RedisServer) SaveRdb() error {
+	if r.rdbSaving.Load() {
+		return ErrBgSaveInProgress
+	}
+	return r.saveRdbFile(r.writeRdb, r.dirty.Load())
+}
+
+// BgSaveRdb BGSAVE, 在持有锁的时候创建快照, 然后在后台把快照写入文件
+func (r *RedisServer) BgSaveRdb() error {
+	if !r.rdbSaving.CompareAndSwap(false, true) {
+		return ErrBgSaveInProgress
+	}
+	snapshot, dirty := r.Snapshot(), r.dirty.Load()
+	r.lg.Infof("Background saving started")
+	go func() {
+		defer r.rdbSaving.Store(false)
+		defer snapshot.Release()
+		err := r.saveRdbFile(func(w io.Writer) error {
+			return encodeRdb(w, snapshot.ForEach, snapshot.ForEachLibrary)
+		}, dirty)
+		if err != nil {
+			r.lg.Errorf("Background saving error: %v", err)
+			return
+		}
+		r.lg.Infof("Background saving terminated with success")
+	}()
+	return nil
+}
+
+// LastSave 最近一次保存rdb成功的时间
+func (r *RedisServer) LastSave() int64 {
+	return r.lastSave.Load()
+}
+
+// ReloadRdb DEBUG RELOAD, 保存rdb之后重新加载
+func (r *RedisServer) ReloadRdb() error {
+	if err := r.checkPersistenceBusy(); err != nil {
+		return err
+	}
+	if err := r.SaveRdb(); err != nil {
+		return fmt.Errorf("Error trying to save the DB: %v", err)
+	}
+	if err := r.LoadRdb(rdbFilename()); err != nil {
+		return fmt.Errorf("Error trying to load the RDB dump: %v", err)
+	}
+	return nil
+}
+
+// saveRdbFile 先写到临时文件, fsync 之后替换原来的文件. dirty 是开始保存时的写入次数, 保存期间的写入不会被清零
+func (r *RedisServer) saveRdbFile(encode func(w io.Writer) error, dirty int64) error {
+	filename := rdbFilename()
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "temp-*.rdb")
+	if err != nil {
+		return fmt.Errorf("failed opening the temp RDB file: %v", err)
+	}
+	err = func() error {
+		writer := bufio.NewWriter(tmpFile)
+		if err := encode(writer); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if err := tmpFile.Sync(); err != nil {
+			return err
+		}
+		return tmpFile.Close()
+	}()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("write error saving DB on disk: %v", err)
+	}
+	r.lastSave.Store(time.Now().Unix())
+	r.dirty.Add(-dirty)
+	r.lg.Infof("DB saved on disk")
+	return nil
+}
+
+// rdbLoader 把 rdb 中的数据加载到新的db, 全部加载成功之后才替换当前的数据
+type rdbLoader struct {
+	dbs       []*DB
+	libraries [][]byte
+	now       time.Time
+	// streamDb 主节点复制流当前选择的db, 没有时为-1
+	streamDb int
+}
+
+func (l *rdbLoader) Aux(key, value []byte) {
+	if string(key) == "repl-stream-db" {
+		if db, err := strconv.Atoi(string(value)); err == nil {
+			l.streamDb = db
+		}
+	}
+}
+
+func (l *rdbLoader) Function(code []byte) error {
+	l.libraries = append(l.libraries, code)
+	return nil
+}
+
+func (l *rdbLoader) Entry(db int, key string, value *obj.RedisObject, expireAt *time.Time) error {
+	if db < 0 || db >= len(l.dbs) {
+		return fmt.Errorf("FATAL: Data file was created with a Redis server configured to handle more than %d databases", len(l.dbs))
+	}
+	// 已经过期的key不再加载
+	if expireAt != nil && !expireAt.After(l.now) {
+		return nil
+	}
+	mdb := l.dbs[db]
+	mdb.PutEntity(key, value)
+	if expireAt != nil {
+		mdb.ExpireV1(key, *expireAt)
+	}
+	return nil
+}
+
+// LoadRdb 加载 rdb 文件替换当前的数据和函数库, 文件不存在时返回 os.ErrNotExist
+func (r *RedisServer) LoadRdb(filename string) error {
+	loader, err := r.decodeRdbFile(filename)
+	if err != nil {
+		return err
+	}
+	return loader.apply(r)
+}
+
+// decodeRdbFile 把 rdb 文件加载到新的db中, 更新加载的进度, 不需要持有锁
+func (r *RedisServer) decodeRdbFile(filename string) (*rdbLoader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var size int64 = 0
+	if stat, err := file.Stat(); err == nil {
+		size = stat.Size()
+	}
+	r.loadingProgress.start(size)
+	return decodeRdb(r.loadingProgress.reader(file))
+}
+
+// decodeRdb 把 rdb 加载到新的db中, 不会修改当前的数据. 从节点全量同步时在锁外加载主节点的 rdb
+func decodeRdb(rd io.Reader) (*rdbLoader, error) {
+	dbs, err := initDbs()
+	if err != nil {
+		return nil, err
+	}
+	loader := &rdbLoader{dbs: dbs, now: dbClock.Now(), streamDb: -1}
+	if err := rdb.Decode(rd, loader); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// apply 用加载的数据和函数库替换 server 当前的数据, 调用方需要持有锁
+func (l *rdbLoader) apply(r *RedisServer) error {
+	if err := r.scripting.restoreLibraries(l.libraries, "flush"); err != nil {
+		return err
+	}
+	for i, mdb := range r.dbs {
+		mdb.swap(l.dbs[i])
+	}
+	return nil
+}
+
+func (r *RedisServer) loadRdb() error {
+	if config.Properties.AppendOnly {
+		return nil
+	}
+	begin := time.Now()
+	// 在锁外读取文件, 加载期间其他客户端可以执行 INFO 查看进度
+	loader, err := r.decodeRdbFile(rdbFilename())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	// 加载期间收到了 SHUTDOWN
+	if r.shutdown.Load() {
+		return ErrorsShutdown
+	}
+	if err = loader.apply(r); err != nil {
+		return err
+	}
+	r.lg.Infof("DB loaded from disk: %.3f seconds", time.Now().Sub(begin).Seconds())
+	return nil
+}
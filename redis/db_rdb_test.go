@@ -0,0 +1,310 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/rdb"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTempDir rdb 文件写到测试的临时目录
+func useTempDir(t *testing.T) {
+	dir, filename := config.Properties.Dir, config.Properties.DbFilename
+	config.Properties.Dir, config.Properties.DbFilename = t.TempDir(), "dump.rdb"
+	t.Cleanup(func() {
+		config.Properties.Dir, config.Properties.DbFilename = dir, filename
+	})
+}
+
+func rdbWorkload(t *testing.T, server *testServer, client *Client) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	server.exec(t, client, "set", "str", "value")
+	server.exec(t, client, "set", "long", strings.Repeat("x", 100))
+	server.exec(t, client, "set", "int", "-12345")
+	for i := 0; i < 100; i++ {
+		server.exec(t, client, "rpush", "list", "item"+strconv.Itoa(i))
+		server.exec(t, client, "hset", "hash", "f"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	server.exec(t, client, "sadd", "ints", "3", "1", "70000")
+	server.exec(t, client, "sadd", "members", "a", "b", "1")
+	server.exec(t, client, "function", "load", testLibrary)
+	server.exec(t, client, "select", "5")
+	server.exec(t, client, "set", "ttl", "v")
+	server.exec(t, client, "pexpireat", "ttl", future)
+	server.exec(t, client, "select", "0")
+}
+
+func TestSaveAndLoadRdb(t *testing.T) {
+	useTempDir(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	rdbWorkload(t, server, client)
+	lastSave := server.exec(t, client, "lastsave")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "save"))
+	assert.True(t, server.exec(t, client, "lastsave") >= lastSave)
+
+	// 启动时 appendonly 关闭的情况下加载rdb
+	loaded := newTestServer()
+	assert.Nil(t, loaded.Init())
+	assert.Equal(t, snapshot(server.RedisServer), snapshot(loaded.RedisServer))
+	other, _ := loaded.newClient()
+	assert.Equal(t, "$3\r\nbar\r\n", loaded.exec(t, other, "fcall", "setget", "1", "foo", "bar"))
+}
+
+func TestBgSave(t *testing.T) {
+	useTempDir(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	rdbWorkload(t, server, client)
+	server.rdbSaving.Store(true)
+	assert.Equal(t, "-ERR Background save already in progress\r\n", server.exec(t, client, "bgsave"))
+	assert.Equal(t, "-ERR Background save already in progress\r\n", server.exec(t, client, "save"))
+	server.rdbSaving.Store(false)
+
+	assert.Equal(t, "+Background saving started\r\n", server.exec(t, client, "bgsave"))
+	// 开始保存之后的修改不会出现在文件中
+	expected := snapshot(server.RedisServer)
+	server.exec(t, client, "set", "after", "bgsave")
+	for server.rdbSaving.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	loaded := newTestServer()
+	assert.Nil(t, loaded.LoadRdb(rdbFilename()))
+	assert.Equal(t, expected, snapshot(loaded.RedisServer))
+}
+
+func TestDebugReload(t *testing.T) {
+	useTempDir(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	rdbWorkload(t, server, client)
+	server.exec(t, client, "set", "gone", "v")
+	server.exec(t, client, "pexpireat", "gone", "1")
+	expected := snapshot(server.RedisServer)
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "reload"))
+	assert.Equal(t, expected, snapshot(server.RedisServer))
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "get", "gone"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "fcall", "setget", "1", "foo", "bar"))
+	assert.Equal(t, "-ERR unknown subcommand 'nosuch'. Try DEBUG HELP.\r\n", server.exec(t, client, "debug", "nosuch"))
+}
+
+// randomWorkloadPrefix randomWorkload 中每种类型的 key 的前缀
+var randomWorkloadPrefix = []string{"str:", "counter:", "list:", "hash:", "set:"}
+
+// randomWorkload 在几个 db 中随机执行写命令, 覆盖每种类型, 过期时间, 覆盖写入和删除
+func randomWorkload(t *testing.T, server *testServer, client *Client, rnd *rand.Rand, ops int) {
+	for i := 0; i < ops; i++ {
+		server.exec(t, client, "select", strconv.Itoa(rnd.Intn(3)))
+		// 每种类型使用自己的 key, 避免 WRONGTYPE
+		id := strconv.Itoa(rnd.Intn(10))
+		member := strconv.Itoa(rnd.Intn(20))
+		switch rnd.Intn(9) {
+		case 0:
+			server.exec(t, client, "set", "str:"+id, strings.Repeat("v", rnd.Intn(64)))
+		case 1:
+			server.exec(t, client, "incrby", "counter:"+id, member)
+		case 2:
+			server.exec(t, client, "append", "str:"+id, member)
+		case 3:
+			server.exec(t, client, "rpush", "list:"+id, member)
+		case 4:
+			server.exec(t, client, "hset", "hash:"+id, "f"+member, member)
+		case 5:
+			server.exec(t, client, "sadd", "set:"+id, member)
+		case 6:
+			server.exec(t, client, "sadd", "set:"+id, "m"+member)
+		case 7:
+			server.exec(t, client, "expire", randomWorkloadPrefix[rnd.Intn(len(randomWorkloadPrefix))]+id, strconv.Itoa(3600+rnd.Intn(3600)))
+		case 8:
+			server.exec(t, client, "del", randomWorkloadPrefix[rnd.Intn(len(randomWorkloadPrefix))]+id)
+		}
+	}
+	server.exec(t, client, "select", "0")
+}
+
+// keyspaceDump 通过命令遍历每个 db 的 key, 记录类型和是否有过期时间
+func keyspaceDump(t *testing.T, server *testServer, client *Client) []string {
+	dump := make([]string, 0)
+	for i := 0; i < len(server.dbs); i++ {
+		server.exec(t, client, "select", strconv.Itoa(i))
+		keys := bulkStrings(t, server.exec(t, client, "keys", "*"))
+		sort.Strings(keys)
+		for _, key := range keys {
+			ttl := server.exec(t, client, "ttl", key) != ":-1\r\n"
+			dump = append(dump, strconv.Itoa(i)+" "+key+" "+server.exec(t, client, "type", key)+" "+strconv.FormatBool(ttl))
+		}
+	}
+	server.exec(t, client, "select", "0")
+	return dump
+}
+
+func TestDebugReloadRandomized(t *testing.T) {
+	useTempDir(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for round := 0; round < 5; round++ {
+		randomWorkload(t, server, client, rnd, 500)
+		dump, expected := keyspaceDump(t, server, client), snapshot(server.RedisServer)
+		assert.NotEmpty(t, dump)
+		assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "reload"))
+		// key, 类型, 过期时间和值都不变
+		assert.Equal(t, dump, keyspaceDump(t, server, client))
+		assert.Equal(t, expected, snapshot(server.RedisServer))
+	}
+}
+
+func TestDebugReloadWhileSaving(t *testing.T) {
+	useTempDir(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.rdbSaving.Store(true)
+	assert.Equal(t, "-ERR Background save already in progress\r\n", server.exec(t, client, "debug", "reload"))
+	assert.Equal(t, "-ERR Background save already in progress\r\n", server.exec(t, client, "debug", "loadaof"))
+	server.rdbSaving.Store(false)
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "reload"))
+	// 没有打开 appendonly 时什么都不做
+	server.exec(t, client, "set", "foo", "bar")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "loadaof"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+}
+
+func TestDebugListEncoding(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "rpush", "small", "a", "b")
+	for i := 0; i < 200; i++ {
+		server.exec(t, client, "rpush", "large", strconv.Itoa(i))
+	}
+	// redis 中超过 list-max-listpack-size 之后转换编码, 这里两边都是 linkedlist, 都不是 listpack 或者 quicklist
+	for _, key := range []string{"small", "large"} {
+		assert.Equal(t, "-ERR Not a listpack encoded object.\r\n", server.exec(t, client, "debug", "listpack", key))
+		assert.Equal(t, "-ERR Not a quicklist encoded object.\r\n", server.exec(t, client, "debug", "quicklist", key))
+		assert.Equal(t, "-ERR Not a ziplist encoded object.\r\n", server.exec(t, client, "debug", "ziplist", key))
+	}
+	assert.Equal(t, ":200\r\n", server.exec(t, client, "llen", "large"))
+	assert.Equal(t, "-ERR no such key\r\n", server.exec(t, client, "debug", "listpack", "missing"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'debug|quicklist' command\r\n", server.exec(t, client, "debug", "quicklist"))
+}
+
+// codecWorkload 覆盖每种注册了 codec 的类型和它们的编码
+func codecWorkload(t *testing.T, server *testServer, client *Client) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	server.exec(t, client, "set", "raw", "value")
+	server.exec(t, client, "set", "int", "12345")
+	server.exec(t, client, "set", "empty", "")
+	for i := 0; i < 100; i++ {
+		server.exec(t, client, "rpush", "list", "item"+strconv.Itoa(i))
+		server.exec(t, client, "hset", "hash", "f"+strconv.Itoa(i), strconv.Itoa(i))
+		server.exec(t, client, "sadd", "ints", strconv.Itoa(i-50))
+		server.exec(t, client, "sadd", "members", "m"+strconv.Itoa(i))
+	}
+	server.exec(t, client, "set", "ttl", "v")
+	server.exec(t, client, "pexpireat", "ttl", future)
+}
+
+// bulkPayload 去掉 bulk reply 的长度和结尾的 CRLF
+func bulkPayload(reply string) string {
+	return reply[strings.Index(reply, "\r\n")+2 : len(reply)-2]
+}
+
+func TestTypeCodecConformance(t *testing.T) {
+	useTempDir(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	codecWorkload(t, server, client)
+	expected := snapshot(server.RedisServer)
+	keys := make([]string, 0)
+	expires := make(map[string]*time.Time)
+	types := make(map[obj.ObjectType]bool)
+	server.ForEach(0, func(key string, entity *obj.RedisObject, expiration *time.Time) bool {
+		keys = append(keys, key)
+		expires[key] = expiration
+		types[entity.ObjType] = true
+		return true
+	})
+	// 新注册的类型需要加到 codecWorkload 中
+	for _, objType := range rdb.ObjectTypes() {
+		assert.True(t, types[objType], "no %s in the workload", obj.ObjectTypeName(objType))
+	}
+
+	t.Run("rdb", func(t *testing.T) {
+		assert.Equal(t, "+OK\r\n", server.exec(t, client, "save"))
+		loaded := newTestServer()
+		assert.Nil(t, loaded.LoadRdb(rdbFilename()))
+		assert.Equal(t, expected, snapshot(loaded.RedisServer))
+	})
+	t.Run("aof rewrite", func(t *testing.T) {
+		replayed := newTestServer()
+		replay, _ := replayed.newClient()
+		for _, key := range keys {
+			entity, _ := server.dbs[0].GetEntity(key)
+			for _, cmd := range EntityToCmd(key, entity) {
+				replay.PushCmd(cmd.Args)
+			}
+			if expires[key] != nil {
+				replay.PushCmd(ExpireCmd(key, expires[key]).Args)
+			}
+		}
+		assert.Nil(t, replayed.process(context.Background(), replay))
+		assert.Equal(t, expected, snapshot(replayed.RedisServer))
+	})
+	t.Run("dump restore", func(t *testing.T) {
+		restored := newTestServer()
+		other, _ := restored.newClient()
+		for _, key := range keys {
+			ttl := "0"
+			if expires[key] != nil {
+				ttl = strconv.FormatInt(expires[key].UnixMilli(), 10)
+			}
+			payload := bulkPayload(server.exec(t, client, "dump", key))
+			assert.Equal(t, "+OK\r\n", restored.exec(t, other, "restore", key, ttl, payload, "absttl"))
+		}
+		assert.Equal(t, expected, snapshot(restored.RedisServer))
+	})
+}
+
+func TestDumpRestore(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	records := make([][][]byte, 0)
+	server.dbs[0].Propagate = func(cmdLine [][]byte) {
+		records = append(records, cmdLine)
+	}
+	server.exec(t, client, "rpush", "list", "a", "b")
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "dump", "nosuch"))
+	payload := bulkPayload(server.exec(t, client, "dump", "list"))
+
+	assert.Equal(t, "-BUSYKEY Target key name already exists.\r\n", server.exec(t, client, "restore", "list", "0", payload))
+	assert.Equal(t, "-ERR Invalid TTL value, must be >= 0\r\n", server.exec(t, client, "restore", "copy", "-1", payload))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "restore", "copy", "0", payload, "nosuch"))
+	assert.Equal(t, "-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n",
+		server.exec(t, client, "restore", "copy", "0", payload, "freq", "256"))
+	assert.Equal(t, "-ERR DUMP payload version or checksum are wrong\r\n",
+		server.exec(t, client, "restore", "copy", "0", payload[:len(payload)-1]+"x"))
+
+	records = records[:0]
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "restore", "copy", "100000", payload, "idletime", "10"))
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", server.exec(t, client, "lrange", "copy", "0", "-1"))
+	assert.Equal(t, ":100\r\n", server.exec(t, client, "ttl", "copy"))
+	// 相对的过期时间转换为 pexpireat 写入aof
+	assert.Len(t, records, 2)
+	assert.Equal(t, "restore copy 0", string(bytes.Join(records[0][:3], []byte(" "))))
+	assert.Equal(t, "REPLACE", string(records[0][4]))
+	assert.Equal(t, "pexpireat", strings.ToLower(string(records[1][0])))
+
+	// REPLACE 覆盖原来的key, 已经过期的 ABSTTL 只删除原来的key
+	server.exec(t, client, "set", "str", "v")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "restore", "str", "0", payload, "replace"))
+	assert.Equal(t, "+list\r\n", server.exec(t, client, "type", "str"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "restore", "str", "1", payload, "replace", "absttl"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "str"))
+}
@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/sds"
+)
+
+// 与 redis 一致, 0..9999 的整数字符串共用 obj 中的共享对象, 计数器和小的 id 不需要为每个key分配一个对象.
+// 共享的对象是只读的: 修改字符串的命令先换成一份复制(unshareString, getDecodedForWrite), INCR 等命令的结果重新指向共享的对象.
+// maxmemory 使用 LRU/LFU 策略时每个key需要自己的访问信息, 这时不使用共享的对象
+
+// sharedObjectRefCount OBJECT REFCOUNT 对于共享对象的返回值, 与 redis 的 OBJ_SHARED_REFCOUNT 一致
+const sharedObjectRefCount = 1<<31 - 1
+
+func sharingIntegers() bool {
+	policy := evictionPolicies[config.Properties.MaxMemoryPolicy]
+	return config.Properties.MaxMemory == 0 ||
+		!(isLFUPolicy(policy) || policy == evictAllKeysLRU || policy == evictVolatileLRU)
+}
+
+// shareString 写入的值是共享范围内的整数时换成共享的对象
+func shareString(value *obj.RedisObject) *obj.RedisObject {
+	number, isInt := value.AsInt()
+	if !isInt || !sharingIntegers() {
+		return value
+	}
+	if shared, ok := obj.SharedInteger(number); ok {
+		return shared
+	}
+	return value
+}
+
+// newIntObject 整数字符串对象, 在共享的范围内时返回共享的对象
+func newIntObject(value int64) *obj.RedisObject {
+	if shared, ok := obj.SharedInteger(value); ok && sharingIntegers() {
+		return shared
+	}
+	return obj.NewIntObject(value)
+}
+
+// setInteger 修改key的整数值, 共享的对象不能原地修改
+func (db *DB) setInteger(key string, entity *obj.RedisObject, value int64) {
+	if shared := newIntObject(value); obj.IsShared(shared) || obj.IsShared(entity) {
+		db.PutIfExists(key, shared)
+		return
+	}
+	// APPEND, SETRANGE 之后是 raw 编码, INCR 之后重新使用 int 编码
+	entity.Ptr = value
+	entity.Encoding = obj.EncInt
+}
+
+// unshareString 原地修改字符串之前调用, 与 redis 的 dbUnshareStringValue 一致, key 引用的是共享的对象时换成一份复制
+func (db *DB) unshareString(key string, entity *obj.RedisObject) *obj.RedisObject {
+	if !obj.IsShared(entity) {
+		return entity
+	}
+	private := obj.DupObject(entity)
+	db.PutIfExists(key, private)
+	return private
+}
+
+// getDecodedForWrite APPEND 和 SETRANGE 修改字符串之前调用, 与 redis 的 dbUnshareStringValue 一致.
+// 共享的对象换成一份复制, int 和 embstr 编码的值复制到新的 sds 中转换为 raw, 返回的对象可以直接修改.
+// raw 编码的 sds 可能还被命令参数或者没有传播的命令引用, 只能追加或者整体替换, 不能覆盖已有的字节
+func (db *DB) getDecodedForWrite(key string, entity *obj.RedisObject) *obj.RedisObject {
+	if entity.Encoding == obj.EncRaw && !obj.IsShared(entity) {
+		return entity
+	}
+	current, _ := obj.StringObjEncoding(entity)
+	value := sds.NewWithBytes(append(make([]byte, 0, len(current)), current...))
+	if obj.IsShared(entity) {
+		private := obj.NewObject(obj.RedisString, value)
+		db.PutIfExists(key, private)
+		return private
+	}
+	entity.Ptr = value
+	entity.Encoding = obj.EncRaw
+	return entity
+}
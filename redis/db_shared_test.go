@@ -0,0 +1,127 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestSharedIntegers(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "a", "5")
+	server.exec(t, client, "set", "b", "5")
+	server.exec(t, client, "incrby", "c", "5")
+	a, _ := server.dbs[0].PeekEntity("a")
+	b, _ := server.dbs[0].PeekEntity("b")
+	c, _ := server.dbs[0].PeekEntity("c")
+	assert.True(t, obj.IsShared(a))
+	assert.Same(t, a, b)
+	assert.Same(t, a, c)
+	assert.Equal(t, ":2147483647\r\n", server.exec(t, client, "object", "refcount", "a"))
+
+	// 超出共享范围和不是整数的值使用自己的对象
+	server.exec(t, client, "set", "big", "9999")
+	assert.Equal(t, ":2147483647\r\n", server.exec(t, client, "object", "refcount", "big"))
+	assert.Equal(t, ":10000\r\n", server.exec(t, client, "incr", "big"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "object", "refcount", "big"))
+	server.exec(t, client, "set", "neg", "-1")
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "object", "refcount", "neg"))
+	server.exec(t, client, "set", "str", "foo")
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "object", "refcount", "str"))
+
+	// 私有的对象回到共享范围时重新共享
+	assert.Equal(t, ":9999\r\n", server.exec(t, client, "decr", "big"))
+	assert.Equal(t, ":2147483647\r\n", server.exec(t, client, "object", "refcount", "big"))
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "object", "refcount", "missing"))
+}
+
+func TestSharedIntegersCopyOnWrite(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	for _, key := range []string{"a", "b", "c"} {
+		server.exec(t, client, "set", key, "5")
+	}
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "append", "a", "00"))
+	assert.Equal(t, "$3\r\n500\r\n", server.exec(t, client, "get", "a"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "object", "refcount", "a"))
+	assert.Equal(t, ":3\r\n", server.exec(t, client, "setrange", "b", "1", "xy"))
+	assert.Equal(t, "$3\r\n5xy\r\n", server.exec(t, client, "get", "b"))
+	assert.Equal(t, "$1\r\n5\r\n", server.exec(t, client, "get", "c"))
+	assert.Equal(t, ":6\r\n", server.exec(t, client, "incr", "c"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "d", "5"))
+	assert.Equal(t, "$1\r\n5\r\n", server.exec(t, client, "get", "d"))
+	shared, _ := obj.SharedInteger(5)
+	assert.Equal(t, int64(5), shared.Ptr)
+
+	// 与 redis 一致, SETRANGE 之后是 raw 编码, INCR 之后重新共享
+	assert.Equal(t, ":4\r\n", server.exec(t, client, "setrange", "d", "1", "000"))
+	assert.Equal(t, "$4\r\n5000\r\n", server.exec(t, client, "get", "d"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "object", "refcount", "d"))
+	assert.Equal(t, ":5001\r\n", server.exec(t, client, "incr", "d"))
+	assert.Equal(t, ":2147483647\r\n", server.exec(t, client, "object", "refcount", "d"))
+}
+
+func TestAppendAndSetRange(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, ":5\r\n", server.exec(t, client, "append", "k", "hello"))
+	assert.Equal(t, ":11\r\n", server.exec(t, client, "append", "k", " world"))
+	assert.Equal(t, "$11\r\nhello world\r\n", server.exec(t, client, "get", "k"))
+	assert.Equal(t, ":11\r\n", server.exec(t, client, "setrange", "k", "6", "redis"))
+	assert.Equal(t, "$11\r\nhello redis\r\n", server.exec(t, client, "get", "k"))
+	assert.Equal(t, ":11\r\n", server.exec(t, client, "setrange", "k", "0", ""))
+
+	// 超出原来长度的部分用0填充
+	assert.Equal(t, ":6\r\n", server.exec(t, client, "setrange", "pad", "3", "abc"))
+	assert.Equal(t, "$6\r\n\x00\x00\x00abc\r\n", server.exec(t, client, "get", "pad"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "setrange", "empty", "3", ""))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "empty"))
+
+	assert.Equal(t, "-ERR offset is out of range\r\n", server.exec(t, client, "setrange", "k", "-1", "a"))
+	assert.Equal(t, "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n",
+		server.exec(t, client, "setrange", "k", "536870912", "a"))
+	server.exec(t, client, "rpush", "list", "a")
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		server.exec(t, client, "append", "list", "a"))
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		server.exec(t, client, "setrange", "list", "0", "a"))
+}
+
+// incrHeapGrowth INCR keys 个不同的key到 0..100 之间的值, 返回增长的堆内存
+func incrHeapGrowth(t *testing.T, server *testServer, keys int) uint64 {
+	client, _ := server.newClient()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := 0; i < keys; i++ {
+		key := "counter:" + strconv.Itoa(i)
+		server.exec(t, client, "incrby", key, strconv.Itoa(i%100))
+		server.exec(t, client, "incr", key)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, keys, server.dbs[0].Len())
+	return after.HeapAlloc - before.HeapAlloc
+}
+
+func TestSharedIntegersMemory(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("skipping in short mode or with -race")
+	}
+	const keys = 1000000
+	shared := incrHeapGrowth(t, newTestServer(), keys)
+	var private uint64
+	t.Run("lru disables sharing", func(t *testing.T) {
+		server := newTestServer()
+		useMaxMemory(t, server, 1<<40, "allkeys-lru")
+		// 按照堆内存判断是否超过 maxmemory, 不需要每条命令都估算一遍
+		server.usedMemory = nil
+		private = incrHeapGrowth(t, server, keys)
+	})
+	// 每个key少一个 RedisObject 和 int64 的装箱
+	t.Logf("shared: %d bytes, private: %d bytes", shared, private)
+	assert.Less(t, shared+keys*32, private)
+}
@@ -0,0 +1,167 @@
+package redis
+
+import (
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dbSnapshot 快照开始时一个db中的key和对象, 快照引用的对象在被修改之前会先复制, 所以不会再变化
+type dbSnapshot struct {
+	data    map[string]*obj.RedisObject
+	expires map[string]time.Time
+	// keys 排序之后的 key, 第一次遍历时生成
+	keys []string
+}
+
+// sortedKeys 按照字典序排序的 key, 同样的数据写出的 rdb 和 aof 相同
+func (s *dbSnapshot) sortedKeys() []string {
+	if s.keys == nil {
+		s.keys = make([]string, 0, len(s.data))
+		for key := range s.data {
+			s.keys = append(s.keys, key)
+		}
+		sort.Strings(s.keys)
+	}
+	return s.keys
+}
+
+// snapshot 复制 dict 中的key和对象指针以及过期时间, 调用方需要持有锁
+func (db *DB) snapshot() *dbSnapshot {
+	s := &dbSnapshot{
+		data:    make(map[string]*obj.RedisObject, db.data.Len()),
+		expires: make(map[string]time.Time, db.ttlCache.Len()),
+	}
+	db.data.ForEach(func(key string, val interface{}) bool {
+		s.data[key], _ = val.(*obj.RedisObject)
+		if _, exists := db.ttlCache.IsExpired(key); exists {
+			s.expires[key] = db.ttlCache.ExpireAt(key)
+		}
+		return true
+	})
+	db.snapMux.Lock()
+	defer db.snapMux.Unlock()
+	db.snapshots = append(db.snapshots, s)
+	db.cow.Store(true)
+	return s
+}
+
+func (db *DB) releaseSnapshot(s *dbSnapshot) {
+	db.snapMux.Lock()
+	defer db.snapMux.Unlock()
+	for i, snapshot := range db.snapshots {
+		if snapshot == s {
+			db.snapshots = append(db.snapshots[:i], db.snapshots[i+1:]...)
+			break
+		}
+	}
+	db.cow.Store(len(db.snapshots) > 0)
+}
+
+// prepareWrite 写命令执行之前调用, 快照引用了命令中的key的对象时先复制一份放回db, 写命令修改的是复制出来的对象
+// 没有快照时只检查一个原子变量
+func (db *DB) prepareWrite(cmd *Command, cmdLine [][]byte) {
+	if !db.cow.Load() {
+		return
+	}
+	db.prepareKeys(cmd.GetKeys(cmdLine)...)
+}
+
+// prepareKeys 同 prepareWrite, 用于不是命令中的key的写入, 比如唤醒的 BLMOVE 推入 destination
+func (db *DB) prepareKeys(keys ...[]byte) {
+	if !db.cow.Load() {
+		return
+	}
+	db.snapMux.Lock()
+	defer db.snapMux.Unlock()
+	for _, k := range keys {
+		key := string(k)
+		entity, exists := db.GetEntity(key)
+		if !exists {
+			continue
+		}
+		for _, s := range db.snapshots {
+			if s.data[key] == entity {
+				db.data.Put(key, obj.DupObject(entity))
+				break
+			}
+		}
+	}
+}
+
+// snapshotted 是否有快照引用了key的这个对象, 调用方需要持有锁
+func (db *DB) snapshotted(key string, entity *obj.RedisObject) bool {
+	if !db.cow.Load() {
+		return false
+	}
+	db.snapMux.Lock()
+	defer db.snapMux.Unlock()
+	for _, s := range db.snapshots {
+		if s.data[key] == entity {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot 不依赖 fork 的一致性快照, 只读的遍历快照开始时所有db的数据和函数库, 用于 BGSAVE 和 aof 重写
+type Snapshot struct {
+	dbs       []*DB
+	snapshots []*dbSnapshot
+	libraries [][]byte
+	now       time.Time
+	release   sync.Once
+}
+
+// Snapshot 冻结所有db复制 dict, 调用方需要持有锁, 使用完之后调用 Release
+func (r *RedisServer) Snapshot() *Snapshot {
+	s := &Snapshot{dbs: r.dbs, now: dbClock.Now()}
+	for _, mdb := range r.dbs {
+		s.snapshots = append(s.snapshots, mdb.snapshot())
+	}
+	r.scripting.ForEachLibrary(func(code []byte) bool {
+		s.libraries = append(s.libraries, code)
+		return true
+	})
+	return s
+}
+
+// ForEach 按照 key 的字典序遍历快照中db i的数据, 跳过快照开始时已经过期的key
+func (s *Snapshot) ForEach(i int, fun func(key string, object *obj.RedisObject, expiration *time.Time) bool) {
+	if i < 0 || i >= len(s.snapshots) {
+		return
+	}
+	snapshot := s.snapshots[i]
+	for _, key := range snapshot.sortedKeys() {
+		entity := snapshot.data[key]
+		var expiration *time.Time = nil
+		if expireAt, ok := snapshot.expires[key]; ok {
+			if s.now.UnixMilli() > expireAt.UnixMilli() {
+				continue
+			}
+			expiration = &expireAt
+		}
+		if !fun(key, entity, expiration) {
+			return
+		}
+	}
+}
+
+// ForEachLibrary 快照开始时的函数库
+func (s *Snapshot) ForEachLibrary(fun func(code []byte) bool) {
+	for _, code := range s.libraries {
+		if !fun(code) {
+			return
+		}
+	}
+}
+
+// Release 释放快照, 之后的写命令不再复制对象
+func (s *Snapshot) Release() {
+	s.release.Do(func() {
+		for i, mdb := range s.dbs {
+			mdb.releaseSnapshot(s.snapshots[i])
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func snapshotWorkload(t *testing.T, server *testServer, client *Client, keys int) {
+	for _, db := range []string{"0", "3"} {
+		server.exec(t, client, "select", db)
+		for i := 0; i < keys; i++ {
+			n := strconv.Itoa(i)
+			server.exec(t, client, "set", "str:"+n, "value"+n)
+			server.exec(t, client, "set", "counter:"+n, n)
+			server.exec(t, client, "rpush", "list:"+n, "a", "b", "c")
+			server.exec(t, client, "hset", "hash:"+n, "f1", "v1", "f2", "v2")
+			server.exec(t, client, "sadd", "ints:"+n, "1", "2", "3")
+			server.exec(t, client, "sadd", "members:"+n, "a", "b")
+			server.exec(t, client, "set", "ttl:"+n, "v")
+			server.exec(t, client, "expire", "ttl:"+n, "3600")
+		}
+	}
+	server.exec(t, client, "select", "0")
+}
+
+func TestSnapshotConsistency(t *testing.T) {
+	const keys = 200
+	server := newTestServer()
+	client, _ := server.newClient()
+	snapshotWorkload(t, server, client, keys)
+	expected := snapshot(server.RedisServer)
+
+	lock.Lock()
+	ss := server.Snapshot()
+	lock.Unlock()
+	defer ss.Release()
+
+	// 写命令和读取快照同时进行
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		writer, _ := server.newClient()
+		for round := 0; round < 5; round++ {
+			for i := 0; i < keys; i++ {
+				n := strconv.Itoa(i)
+				server.exec(t, writer, "rpush", "list:"+n, "x"+strconv.Itoa(round))
+				server.exec(t, writer, "lpop", "list:"+n)
+				server.exec(t, writer, "hset", "hash:"+n, "f1", "changed", "f"+strconv.Itoa(round), "new")
+				server.exec(t, writer, "sadd", "ints:"+n, strconv.Itoa(1000+round))
+				server.exec(t, writer, "sadd", "members:"+n, "m"+strconv.Itoa(round))
+				server.exec(t, writer, "incr", "counter:"+n)
+				server.exec(t, writer, "set", "str:"+n, "overwrite")
+				server.exec(t, writer, "persist", "ttl:"+n)
+				server.exec(t, writer, "set", "new:"+n, "v")
+				server.exec(t, writer, "del", "new:"+n)
+			}
+		}
+		server.exec(t, writer, "select", "3")
+		server.exec(t, writer, "flushdb")
+	}()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, expected, dumpEach(len(server.dbs), ss.ForEach))
+	}
+	wg.Wait()
+
+	// 快照的内容是开始时的数据, 不是写完之后的数据
+	assert.Equal(t, expected, dumpEach(len(server.dbs), ss.ForEach))
+	assert.NotEqual(t, expected, snapshot(server.RedisServer))
+	assert.Equal(t, 0, server.dbs[3].Len())
+}
+
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "rpush", "list", "a")
+	mdb := server.dbs[0]
+	origin, _ := mdb.GetEntity("list")
+
+	// 没有快照的时候直接修改原来的对象
+	server.exec(t, client, "rpush", "list", "b")
+	entity, _ := mdb.GetEntity("list")
+	assert.Same(t, origin, entity)
+	assert.False(t, mdb.cow.Load())
+
+	lock.Lock()
+	ss := server.Snapshot()
+	lock.Unlock()
+	assert.True(t, mdb.cow.Load())
+	server.exec(t, client, "rpush", "list", "c")
+	copied, _ := mdb.GetEntity("list")
+	assert.NotSame(t, origin, copied)
+	// 只在第一次修改的时候复制
+	server.exec(t, client, "rpush", "list", "d")
+	entity, _ = mdb.GetEntity("list")
+	assert.Same(t, copied, entity)
+	assert.Equal(t, []map[string]string{{"list": "list a,b"}}, dumpEach(1, ss.ForEach))
+
+	ss.Release()
+	ss.Release()
+	assert.False(t, mdb.cow.Load())
+	assert.Equal(t, "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n", server.exec(t, client, "lrange", "list", "0", "-1"))
+}
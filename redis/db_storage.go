@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict/tiered"
+	"io"
+)
+
+func init() {
+	// 换出的值写到 dir 中的临时文件, 每个 db 一个文件
+	dict.Register("tiered", func(index int) (dict.Dict, error) {
+		return tiered.New(config.Properties.Dir, config.Properties.StorageHotKeys, tiered.RdbCodec)
+	})
+}
+
+// newDbDict 按照 storage-backend 创建第 index 个 db 的 dict
+func newDbDict(index int) (dict.Dict, error) {
+	data, err := dict.New(config.Properties.StorageBackend, index)
+	if err != nil {
+		return nil, fmt.Errorf("storage-backend %s: %w", config.Properties.StorageBackend, err)
+	}
+	return data, nil
+}
+
+// closeDict 释放 dict 持有的文件等资源
+func closeDict(data dict.Dict) {
+	if closer, ok := data.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// storageError 从 storage-backend 读取值失败(见 dict.Loader), 不能当作 key 不存在: 之后的写入会覆盖读不出来的值
+type storageError struct {
+	key string
+	err error
+}
+
+func (e *storageError) Error() string {
+	return fmt.Sprintf("ERR error loading key '%s' from storage: %v", e.key, e.err)
+}
+
+// processCommand 执行命令. 命令行中的 key 在执行之前读取, 读取失败时回复错误, 不执行命令, 没有回复了一半的数据;
+// 不读取值的命令(flagNoLoad, 比如 DEL)不读取, 读不出来的 key 仍然可以删除.
+// 执行中查找其他的 key(比如 SORT 的 BY 和 GET)读取失败时 LookupKeyRead/LookupKeyWrite panic storageError, 在这里回复错误.
+// 其他的 panic 交给调用方
+func processCommand(ctx context.Context, conn *Client, cmd *Command) (err error) {
+	if !cmd.IsNoLoad() {
+		if storageErr := conn.GetDb().loadKeys(cmd.GetKeys(conn.GetCmdLine())); storageErr != nil {
+			return MakeStandardErrReply(storageErr.Error()).WriteTo(conn)
+		}
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			storageErr, ok := p.(*storageError)
+			if !ok {
+				panic(p)
+			}
+			conn.streaming = false
+			err = MakeStandardErrReply(storageErr.Error()).WriteTo(conn)
+		}
+	}()
+	return cmd.process(ctx, conn)
+}
+
+// loadKeys storage-backend 实现了 dict.Loader 时读取 keys 的值, 之后命令中的查找不需要再读取
+func (db *DB) loadKeys(keys [][]byte) *storageError {
+	loader, ok := db.data.(dict.Loader)
+	if !ok {
+		return nil
+	}
+	for _, key := range keys {
+		if _, _, err := loader.Load(string(key)); err != nil {
+			return &storageError{key: string(key), err: err}
+		}
+	}
+	return nil
+}
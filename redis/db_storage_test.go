@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"testing"
+)
+
+// failingDict 读取 key 的值总是失败的 dict.Loader, 模拟 tiered 的文件损坏
+type failingDict struct {
+	dict.Dict
+	key string
+}
+
+func (d *failingDict) Load(key string) (interface{}, bool, error) {
+	value, exists := d.Get(key)
+	if exists && key == d.key {
+		return nil, false, errors.New("checksum mismatch")
+	}
+	return value, exists, nil
+}
+
+func TestStorageLoadError(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "bad", "v")
+	server.exec(t, client, "set", "good", "v")
+	server.exec(t, client, "rpush", "list", "a")
+	server.dbs[0].data = &failingDict{Dict: server.dbs[0].data, key: "bad"}
+
+	// 读不出来的值回复错误, 不是当作不存在, 写命令也不会从空的值开始覆盖
+	errReply := "-ERR error loading key 'bad' from storage: checksum mismatch\r\n"
+	assert.Equal(t, errReply, server.exec(t, client, "get", "bad"))
+	assert.Equal(t, errReply, server.exec(t, client, "append", "bad", "x"))
+	assert.Equal(t, errReply, server.exec(t, client, "mget", "good", "bad"))
+	assert.Equal(t, "$1\r\nv\r\n", server.exec(t, client, "get", "good"))
+
+	// 事务和脚本中每条命令单独回复错误
+	server.exec(t, client, "multi")
+	server.exec(t, client, "get", "bad")
+	server.exec(t, client, "get", "good")
+	assert.Equal(t, "*2\r\n"+errReply+"$1\r\nv\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, errReply, server.exec(t, client, "eval", "return redis.pcall('get', KEYS[1])", "1", "bad"))
+
+	// 阻塞的客户端不受影响
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\na\r\n", server.exec(t, client, "blpop", "list", "0"))
+
+	// 读不出来的 key 仍然可以删除
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "del", "bad"))
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "get", "bad"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "exists", "good", "bad"))
+}
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLookupKeyWriteExpired 写命令遇到逻辑上已经过期, 但是还没有删除的key时从空的值开始, 旧的数据和过期时间都不保留
+func TestLookupKeyWriteExpired(t *testing.T) {
+	clk := useManualClock(t)
+	for _, tc := range []struct {
+		name  string
+		setup []string
+		write []string
+		read  []string
+		want  string
+	}{
+		{"string", []string{"set", "k", "old"}, []string{"append", "k", "new"}, []string{"get", "k"}, "$3\r\nnew\r\n"},
+		{"setnx", []string{"set", "k", "old"}, []string{"setnx", "k", "new"}, []string{"get", "k"}, "$3\r\nnew\r\n"},
+		{"incr", []string{"set", "k", "10"}, []string{"incr", "k"}, []string{"get", "k"}, "$1\r\n1\r\n"},
+		{"list", []string{"rpush", "k", "a", "b"}, []string{"lpush", "k", "x"}, []string{"lrange", "k", "0", "-1"}, "*1\r\n$1\r\nx\r\n"},
+		{"set", []string{"sadd", "k", "a", "b"}, []string{"sadd", "k", "x"}, []string{"smembers", "k"}, "*1\r\n$1\r\nx\r\n"},
+		{"hash", []string{"hset", "k", "a", "1"}, []string{"hset", "k", "x", "2"}, []string{"hgetall", "k"}, "*2\r\n$1\r\nx\r\n$1\r\n2\r\n"},
+	} {
+		// 可写的从节点不等待主节点的 DEL, 写入时在本地删除
+		for _, replica := range []bool{false, true} {
+			server := newTestServer()
+			client, _ := server.newClient()
+			setup := client
+			if replica {
+				setup, _ = server.newClient()
+				setup.master = true
+				server.repl.masterHost, server.repl.masterPort = "127.0.0.1", 6379
+				server.exec(t, client, "config", "set", "replica-read-only", "no")
+			}
+			server.exec(t, setup, tc.setup...)
+			server.exec(t, setup, "pexpire", "k", "100")
+			clk.Advance(200 * time.Millisecond)
+			assert.Equal(t, 1, server.dbs[0].Len(), tc.name)
+
+			server.exec(t, client, tc.write...)
+			assert.Equal(t, tc.want, server.exec(t, client, tc.read...), "%s replica=%v", tc.name, replica)
+			assert.Equal(t, ":-1\r\n", server.exec(t, client, "ttl", "k"), "%s replica=%v", tc.name, replica)
+			clk.Advance(time.Second)
+			assert.Equal(t, tc.want, server.exec(t, client, tc.read...), "%s replica=%v", tc.name, replica)
+
+			if replica {
+				server.exec(t, client, "config", "set", "replica-read-only", "yes")
+				server.repl.masterHost, server.repl.masterPort = "", 0
+			}
+		}
+	}
+
+	// 没有过期的key不会被覆盖
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "setnx", "live", "v1"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "setnx", "live", "v2"))
+	assert.Equal(t, "$2\r\nv1\r\n", server.exec(t, client, "get", "live"))
+}
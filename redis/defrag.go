@@ -0,0 +1,59 @@
+package redis
+
+import (
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"time"
+)
+
+// 与 redis 的 activedefrag 类似, 打开 activedefrag 之后在 serverCron 中随机检查 key, 重新分配空闲容量很多的值.
+// Go 的分配器不能移动已经分配的内存, 这里只处理容量明显大于内容的值: APPEND 等原地修改之后留下空闲容量的字符串.
+// 列表总是 linkedlist 编码, 没有 ziplist 和 quicklist 节点需要合并
+
+// defragSamples 每次 cron 每个 db 检查的 key 的个数
+const defragSamples = 16
+
+// defragSlackPercent 空闲容量超过内容长度的这个百分比时重新分配
+const defragSlackPercent = 25
+
+// activeDefragCycle 每个 db 检查 defragSamples 个 key, 最多使用 active-defrag-cycle-max 百分比的 cron 周期, 调用方持有锁
+func (r *RedisServer) activeDefragCycle() {
+	if !config.Properties.ActiveDefrag {
+		return
+	}
+	deadline := time.Now().Add(time.Second * time.Duration(config.Properties.ActiveDefragCycleMax) / 100)
+	for _, mdb := range r.dbs {
+		// 快照还在读取 db 中的对象时不修改它们
+		if mdb.Len() == 0 || mdb.cow.Load() {
+			continue
+		}
+		for _, key := range mdb.data.RandomDistinctKeys(defragSamples) {
+			if time.Now().After(deadline) {
+				return
+			}
+			mdb.defragKey(key)
+		}
+	}
+}
+
+// defragKey 重新分配 key 的值, 内容不变, 命中时计入 defrag_hits 和释放的字节数, 不需要重新分配时计入 defrag_misses
+func (db *DB) defragKey(key string) {
+	row, exists := db.data.Get(key)
+	if !exists {
+		return
+	}
+	value, _ := row.(*obj.RedisObject)
+	if value == nil || obj.IsShared(value) {
+		return
+	}
+	reclaimed := 0
+	if str, ok := value.AsSds(); ok && str.Remining()*100 > str.Len()*defragSlackPercent {
+		reclaimed = str.Compact()
+	}
+	if reclaimed == 0 {
+		db.stats.defragMisses.Add(1)
+		return
+	}
+	db.stats.defragHits.Add(1)
+	db.stats.defragReclaimed.Add(int64(reclaimed))
+}
@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/sds"
+	"strings"
+	"testing"
+)
+
+// slackString 把 key 的值换成内容相同, 容量是 capacity 的 sds, 模拟 APPEND 之后留下的空闲容量
+func slackString(mdb *DB, key string, capacity int) *sds.Sds {
+	entity, _ := mdb.GetEntity(key)
+	current := *entity.Ptr.(*sds.Sds)
+	slack := sds.Sds(append(make([]byte, 0, capacity), current...))
+	entity.Ptr = &slack
+	return &slack
+}
+
+func TestActiveDefrag(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	enabled, cycleMax := config.Properties.ActiveDefrag, config.Properties.ActiveDefragCycleMax
+	t.Cleanup(func() {
+		config.Properties.ActiveDefrag, config.Properties.ActiveDefragCycleMax = enabled, cycleMax
+	})
+	value := strings.Repeat("v", 100)
+	server.exec(t, client, "set", "slack", value)
+	server.exec(t, client, "set", "tight", value)
+	server.exec(t, client, "set", "shared", "1")
+	server.exec(t, client, "rpush", "list", "a")
+	str := slackString(server.dbs[0], "slack", 4096)
+	before := obj.ObjectMemory(mustEntity(t, server.dbs[0], "slack"))
+
+	// 没有打开时不检查
+	server.activeDefragCycle()
+	assert.Equal(t, "0", infoAll(t, server, client, "active_defrag_hits"))
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "activedefrag", "yes"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "active-defrag-cycle-max", "99"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'active-defrag-cycle-max') - argument must be between 1 and 99 inclusive\r\n",
+		server.exec(t, client, "config", "set", "active-defrag-cycle-max", "100"))
+	server.activeDefragCycle()
+
+	// 容量缩小到长度, 内容不变
+	assert.Equal(t, len(value), cap(*str))
+	assert.Equal(t, before-int64(4096-len(value)), obj.ObjectMemory(mustEntity(t, server.dbs[0], "slack")))
+	assert.Equal(t, "$100\r\n"+value+"\r\n", server.exec(t, client, "get", "slack"))
+	assert.Equal(t, "$100\r\n"+value+"\r\n", server.exec(t, client, "get", "tight"))
+	assert.Equal(t, "1", infoAll(t, server, client, "active_defrag_hits"))
+	// tight 和 list 不需要重新分配, 共享的整数不检查
+	assert.Equal(t, "2", infoAll(t, server, client, "active_defrag_misses"))
+	assert.Equal(t, "3996", infoAll(t, server, client, "active_defrag_reclaimed_bytes"))
+
+	// 空闲容量没有超过比例时不重新分配
+	slackString(server.dbs[0], "tight", 110)
+	server.activeDefragCycle()
+	assert.Equal(t, "1", infoAll(t, server, client, "active_defrag_hits"))
+}
+
+func mustEntity(t *testing.T, mdb *DB, key string) *obj.RedisObject {
+	entity, exists := mdb.GetEntity(key)
+	assert.True(t, exists)
+	return entity
+}
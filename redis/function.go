@@ -0,0 +1,380 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// functionNoWrites 函数不会执行写命令, 可以通过 FCALL_RO 调用
+	functionNoWrites = 1 << iota
+	functionAllowOom
+	functionAllowStale
+	functionNoCluster
+	functionAllowCrossSlotKeys
+)
+
+var functionFlagNames = []struct {
+	name string
+	flag int
+}{
+	{"no-writes", functionNoWrites},
+	{"allow-oom", functionAllowOom},
+	{"allow-stale", functionAllowStale},
+	{"no-cluster", functionNoCluster},
+	{"allow-cross-slot-keys", functionAllowCrossSlotKeys},
+}
+
+// functionLoadTimeout FUNCTION LOAD 执行库代码的超时时间
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionDumpVersion FUNCTION DUMP 的格式版本
+const functionDumpVersion = 1
+
+var (
+	functionDumpMagic = []byte("GFUN")
+	errFunctionDump   = errors.New("ERR payload version or checksum are wrong")
+)
+
+// luaFunction 通过 redis.register_function 注册的函数
+type luaFunction struct {
+	name        string
+	fn          *lua.LFunction
+	flags       int
+	description string
+	library     *functionLibrary
+}
+
+// functionLibrary FUNCTION LOAD 加载的函数库
+type functionLibrary struct {
+	name      string
+	code      []byte
+	functions map[string]*luaFunction
+}
+
+// parseLibraryMetadata 解析第一行的 #!lua name=<library>
+func parseLibraryMetadata(code []byte) (string, error) {
+	if !bytes.HasPrefix(code, []byte("#!")) {
+		return "", errors.New("ERR Missing library metadata")
+	}
+	line := code[2:]
+	if idx := bytes.IndexByte(line, '\n'); idx >= 0 {
+		line = line[:idx]
+	}
+	parts := strings.Fields(string(line))
+	if len(parts) == 0 {
+		return "", errors.New("ERR Missing library metadata")
+	}
+	if strings.ToLower(parts[0]) != "lua" {
+		return "", errors.New("ERR Engine '" + parts[0] + "' not found")
+	}
+	name := ""
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "name=") {
+			return "", errors.New("ERR Invalid metadata value given: " + part)
+		}
+		name = part[len("name="):]
+	}
+	if name == "" {
+		return "", errors.New("ERR Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) " +
+			"and must be at least one character long")
+	}
+	return name, nil
+}
+
+// validFunctionName 函数名和库名只能包含字母, 数字和下划线
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadLibrary FUNCTION LOAD, 执行库的代码注册函数, 返回库名
+func (s *Scripting) LoadLibrary(code []byte, replace bool) (string, error) {
+	name, err := parseLibraryMetadata(code)
+	if err != nil {
+		return "", err
+	}
+	old, exists := s.libraries[name]
+	if exists && !replace {
+		return "", errors.New("ERR Library '" + name + "' already exists")
+	}
+	// 去掉第一行的元数据, 保留换行使行号不变
+	var body []byte
+	if idx := bytes.IndexByte(code, '\n'); idx >= 0 {
+		body = code[idx:]
+	}
+	chunk, err := parse.Parse(bytes.NewReader(body), "@user_function")
+	if err != nil {
+		return "", errors.New("ERR Error compiling function: " + oneLine(err.Error()))
+	}
+	proto, err := lua.Compile(chunk, "@user_function")
+	if err != nil {
+		return "", errors.New("ERR Error compiling function: " + oneLine(err.Error()))
+	}
+
+	library := &functionLibrary{name: name, code: code, functions: make(map[string]*luaFunction)}
+	L := s.lua
+	// 加载库的时候只注册函数, 不应该执行很久
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	L.SetContext(ctx)
+	s.loading = library
+	L.Push(L.NewFunctionFromProto(proto))
+	err = L.PCall(0, 0, nil)
+	s.loading = nil
+	L.RemoveContext()
+	cancel()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", errors.New("ERR FUNCTION LOAD timeout")
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return "", errors.New("ERR Error registering functions: " + oneLine(apiErr.Object.String()))
+		}
+		return "", errors.New("ERR Error registering functions: " + oneLine(err.Error()))
+	}
+	if len(library.functions) == 0 {
+		return "", errors.New("ERR No functions registered")
+	}
+	for fname := range library.functions {
+		if f, ok := s.functions[fname]; ok && f.library != old {
+			return "", errors.New("ERR Function " + fname + " already exists")
+		}
+	}
+	if exists {
+		s.deleteLibrary(old)
+	}
+	s.libraries[name] = library
+	for fname, f := range library.functions {
+		s.functions[fname] = f
+	}
+	return name, nil
+}
+
+// DeleteLibrary FUNCTION DELETE
+func (s *Scripting) DeleteLibrary(name string) bool {
+	library, ok := s.libraries[name]
+	if !ok {
+		return false
+	}
+	s.deleteLibrary(library)
+	return true
+}
+
+func (s *Scripting) deleteLibrary(library *functionLibrary) {
+	delete(s.libraries, library.name)
+	for fname := range library.functions {
+		delete(s.functions, fname)
+	}
+}
+
+// FlushFunctions FUNCTION FLUSH
+func (s *Scripting) FlushFunctions() {
+	s.libraries = make(map[string]*functionLibrary)
+	s.functions = make(map[string]*luaFunction)
+}
+
+// LookupFunction 按照函数名查找 FCALL 调用的函数
+func (s *Scripting) LookupFunction(name string) (*luaFunction, bool) {
+	f, ok := s.functions[name]
+	return f, ok
+}
+
+// Libraries 按照库名排序的所有函数库
+func (s *Scripting) Libraries() []*functionLibrary {
+	libraries := make([]*functionLibrary, 0, len(s.libraries))
+	for _, library := range s.libraries {
+		libraries = append(libraries, library)
+	}
+	sort.Slice(libraries, func(i, j int) bool {
+		return libraries[i].name < libraries[j].name
+	})
+	return libraries
+}
+
+// ForEachLibrary 按照库名的顺序遍历函数库的代码, 用于aof重写
+func (s *Scripting) ForEachLibrary(fun func(code []byte) bool) {
+	for _, library := range s.Libraries() {
+		if !fun(library.code) {
+			return
+		}
+	}
+}
+
+// sortedFunctions 按照函数名排序的库中的函数
+func sortedFunctions(library *functionLibrary) []*luaFunction {
+	functions := make([]*luaFunction, 0, len(library.functions))
+	for _, f := range library.functions {
+		functions = append(functions, f)
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].name < functions[j].name
+	})
+	return functions
+}
+
+// DumpFunctions FUNCTION DUMP, 格式为 magic version [len code]... crc32
+func (s *Scripting) DumpFunctions() []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(functionDumpMagic)
+	buf.WriteByte(functionDumpVersion)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, library := range s.Libraries() {
+		n := binary.PutUvarint(lenBuf, uint64(len(library.code)))
+		buf.Write(lenBuf[:n])
+		buf.Write(library.code)
+	}
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum)
+	return buf.Bytes()
+}
+
+// parseFunctionDump 解析 FUNCTION DUMP 的数据, 返回每个库的代码
+func parseFunctionDump(payload []byte) ([][]byte, error) {
+	headerLen := len(functionDumpMagic) + 1
+	if len(payload) < headerLen+4 || !bytes.HasPrefix(payload, functionDumpMagic) ||
+		payload[len(functionDumpMagic)] != functionDumpVersion {
+		return nil, errFunctionDump
+	}
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return nil, errFunctionDump
+	}
+	codes := make([][]byte, 0)
+	data := body[headerLen:]
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, errFunctionDump
+		}
+		codes = append(codes, data[n:n+int(size)])
+		data = data[n+int(size):]
+	}
+	return codes, nil
+}
+
+// RestoreFunctions FUNCTION RESTORE, 任何一个库加载失败都会回滚到恢复之前的状态
+func (s *Scripting) RestoreFunctions(payload []byte, policy string) error {
+	codes, err := parseFunctionDump(payload)
+	if err != nil {
+		return err
+	}
+	return s.restoreLibraries(codes, policy)
+}
+
+// restoreLibraries 按照 policy 加载函数库, 失败时回滚
+func (s *Scripting) restoreLibraries(codes [][]byte, policy string) (err error) {
+	libraries, functions := s.libraries, s.functions
+	s.libraries = make(map[string]*functionLibrary, len(libraries))
+	s.functions = make(map[string]*luaFunction, len(functions))
+	if policy != "flush" {
+		for name, library := range libraries {
+			s.libraries[name] = library
+		}
+		for name, f := range functions {
+			s.functions[name] = f
+		}
+	}
+	for _, code := range codes {
+		if _, err = s.LoadLibrary(code, policy == "replace"); err != nil {
+			s.libraries, s.functions = libraries, functions
+			return err
+		}
+	}
+	return nil
+}
+
+// luaRegisterFunction redis.register_function(name, callback) 或者
+// redis.register_function{function_name=name, callback=callback, flags={...}, description=description}
+func (s *Scripting) luaRegisterFunction(L *lua.LState) int {
+	library := s.loading
+	if library == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+		return 0
+	}
+	f := &luaFunction{library: library}
+	if L.GetTop() == 1 {
+		table, ok := L.Get(1).(*lua.LTable)
+		if !ok {
+			L.RaiseError("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+			return 0
+		}
+		var bad string
+		table.ForEach(func(key lua.LValue, value lua.LValue) {
+			switch key.String() {
+			case "function_name":
+				if name, ok := value.(lua.LString); ok {
+					f.name = string(name)
+				}
+			case "callback":
+				if fn, ok := value.(*lua.LFunction); ok {
+					f.fn = fn
+				}
+			case "description":
+				if description, ok := value.(lua.LString); ok {
+					f.description = string(description)
+				}
+			case "flags":
+				flags, ok := value.(*lua.LTable)
+				if !ok {
+					bad = "flags argument to redis.register_function must be a table representing function flags"
+					return
+				}
+				flags.ForEach(func(_ lua.LValue, flag lua.LValue) {
+					found := false
+					for _, item := range functionFlagNames {
+						if item.name == flag.String() {
+							f.flags |= item.flag
+							found = true
+						}
+					}
+					if !found {
+						bad = "unknown flag given"
+					}
+				})
+			default:
+				bad = "unknown argument given to redis.register_function"
+			}
+		})
+		if bad != "" {
+			L.RaiseError("%s", bad)
+			return 0
+		}
+	} else {
+		f.name = L.OptString(1, "")
+		f.fn, _ = L.Get(2).(*lua.LFunction)
+	}
+	if f.name == "" || f.fn == nil {
+		L.RaiseError("redis.register_function must get a function name argument and a callback argument")
+		return 0
+	}
+	if !validFunctionName(f.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+		return 0
+	}
+	if _, ok := library.functions[f.name]; ok {
+		L.RaiseError("Function already exists in the library")
+		return 0
+	}
+	library.functions[f.name] = f
+	return 0
+}
@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const testLibrary = "#!lua name=mylib\n" +
+	"redis.register_function('setget', function(keys, args) redis.call('set', keys[1], args[1]) return redis.call('get', keys[1]) end)\n" +
+	"redis.register_function{function_name='readkey', callback=function(keys) return redis.call('get', keys[1]) end, " +
+	"flags={'no-writes'}, description='read a key'}\n"
+
+func TestFunctionLoadAndCall(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+
+	assert.Equal(t, "$5\r\nmylib\r\n", server.exec(t, client, "function", "load", testLibrary))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "fcall", "setget", "1", "foo", "bar"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "fcall_ro", "readkey", "1", "foo"))
+	assert.Equal(t, "-ERR Can not execute a script with write flag using *_ro command.\r\n",
+		server.exec(t, client, "fcall_ro", "setget", "1", "foo", "bar"))
+	assert.Equal(t, "-ERR Function not found\r\n", server.exec(t, client, "fcall", "nosuchfunction", "0"))
+
+	assert.Equal(t, "-ERR Library 'mylib' already exists\r\n", server.exec(t, client, "function", "load", testLibrary))
+	assert.Equal(t, "$5\r\nmylib\r\n", server.exec(t, client, "function", "load", "replace", testLibrary))
+	assert.Equal(t, "-ERR Function setget already exists\r\n", server.exec(t, client, "function", "load",
+		"#!lua name=other\nredis.register_function('setget', function() return 1 end)"))
+
+	// no-writes 的函数不能执行写命令
+	server.exec(t, client, "function", "load", "#!lua name=bad\n"+
+		"redis.register_function{function_name='sneaky', callback=function(keys) return redis.call('del', keys[1]) end, flags={'no-writes'}}")
+	assert.Equal(t, "-ERR Write commands are not allowed from read-only scripts.\r\n",
+		server.exec(t, client, "fcall", "sneaky", "1", "foo"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+
+	reply := server.exec(t, client, "function", "list")
+	assert.True(t, strings.HasPrefix(reply, "*2\r\n*6\r\n$12\r\nlibrary_name\r\n$3\r\nbad\r\n"), reply)
+	reply = server.exec(t, client, "function", "list", "libraryname", "my*", "withcode")
+	assert.True(t, strings.HasPrefix(reply, "*1\r\n*8\r\n$12\r\nlibrary_name\r\n$5\r\nmylib\r\n"), reply)
+	assert.Contains(t, reply, "$4\r\nname\r\n$7\r\nreadkey\r\n$11\r\ndescription\r\n$10\r\nread a key\r\n"+
+		"$5\r\nflags\r\n*1\r\n$9\r\nno-writes\r\n")
+	assert.Contains(t, reply, "$12\r\nlibrary_code\r\n")
+	assert.Equal(t, "*4\r\n$14\r\nrunning_script\r\n$-1\r\n$7\r\nengines\r\n*2\r\n$3\r\nLUA\r\n"+
+		"*4\r\n$15\r\nlibraries_count\r\n:2\r\n$15\r\nfunctions_count\r\n:3\r\n", server.exec(t, client, "function", "stats"))
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "function", "delete", "bad"))
+	assert.Equal(t, "-ERR Library not found\r\n", server.exec(t, client, "function", "delete", "bad"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "function", "flush"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "function", "list"))
+}
+
+func TestFunctionLoadErrors(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	testCases := []struct {
+		name   string
+		code   string
+		expect string
+	}{
+		{"missing metadata", "return 1", "-ERR Missing library metadata\r\n"},
+		{"unknown engine", "#!js name=lib\n", "-ERR Engine 'js' not found\r\n"},
+		{"invalid metadata", "#!lua foo=bar\n", "-ERR Invalid metadata value given: foo=bar\r\n"},
+		{"no functions", "#!lua name=lib\nlocal a = 1", "-ERR No functions registered\r\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, server.exec(t, client, "function", "load", tc.code))
+		})
+	}
+	reply := server.exec(t, client, "function", "load", "#!lua name=lib\nredis.call('set', 'a', 'b')")
+	assert.True(t, strings.HasPrefix(reply, "-ERR Error registering functions"), reply)
+	reply = server.exec(t, client, "function", "load", "#!lua name=lib\nredis.register_function('a-b', function() end)")
+	assert.Contains(t, reply, "Function names can only contain letters, numbers, or underscores(_)")
+	reply = server.exec(t, client, "function", "load", "#!lua name=lib\nreturn +")
+	assert.True(t, strings.HasPrefix(reply, "-ERR Error compiling function"), reply)
+	// 加载失败不会留下任何函数
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "function", "list"))
+	assert.Contains(t, server.exec(t, client, "eval", "redis.register_function('f', function() end)", "0"),
+		"redis.register_function can only be called on FUNCTION LOAD command")
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "function", "load", testLibrary)
+	dump := server.exec(t, client, "function", "dump")
+	payload := dump[strings.Index(dump, "\r\n")+2 : len(dump)-2]
+
+	// 在新的 server 中恢复
+	restored := newTestServer()
+	other, _ := restored.newClient()
+	assert.Equal(t, "-ERR payload version or checksum are wrong\r\n",
+		restored.exec(t, other, "function", "restore", payload[:len(payload)-1]))
+	assert.Equal(t, "+OK\r\n", restored.exec(t, other, "function", "restore", payload))
+	assert.Equal(t, "$1\r\nv\r\n", restored.exec(t, other, "fcall", "setget", "1", "k", "v"))
+	assert.Equal(t, "$1\r\nv\r\n", restored.exec(t, other, "fcall_ro", "readkey", "1", "k"))
+
+	// APPEND 遇到同名的库失败, 并且不会修改已有的库
+	assert.Equal(t, "-ERR Library 'mylib' already exists\r\n", restored.exec(t, other, "function", "restore", payload))
+	assert.Equal(t, "+OK\r\n", restored.exec(t, other, "function", "restore", payload, "replace"))
+	restored.exec(t, other, "function", "load", "#!lua name=extra\nredis.register_function('extra', function() return 1 end)")
+	assert.Equal(t, "+OK\r\n", restored.exec(t, other, "function", "restore", payload, "flush"))
+	assert.Equal(t, "-ERR Function not found\r\n", restored.exec(t, other, "fcall", "extra", "0"))
+}
+
+func TestFunctionPersistence(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	records := make([][][]byte, 0)
+	for _, mdb := range server.dbs {
+		mdb.Propagate = func(cmdLine [][]byte) {
+			records = append(records, cmdLine)
+		}
+	}
+	server.exec(t, client, "function", "load", testLibrary)
+	server.exec(t, client, "fcall", "setget", "1", "foo", "bar")
+	server.exec(t, client, "function", "load", "#!lua name=tmp\nredis.register_function('tmp', function() return 1 end)")
+	server.exec(t, client, "function", "delete", "tmp")
+
+	// 重放aof之后函数库仍然存在, fcall 本身不写入aof, 只记录函数执行的写命令
+	assert.Len(t, records, 4)
+	reloaded := newTestServer()
+	replay, replayConn := reloaded.newClient()
+	for _, cmdLine := range records {
+		replay.PushCmd(cmdLine)
+		assert.Nil(t, reloaded.process(context.Background(), replay))
+	}
+	assert.Equal(t, "$5\r\nmylib\r\n+OK\r\n$3\r\ntmp\r\n+OK\r\n", replayConn.take())
+	assert.Equal(t, "$3\r\nbar\r\n", reloaded.exec(t, replay, "fcall_ro", "readkey", "1", "foo"))
+	assert.Equal(t, "-ERR Function not found\r\n", reloaded.exec(t, replay, "fcall", "tmp", "0"))
+	assert.Equal(t, []string{testLibrary}, func() []string {
+		codes := make([]string, 0)
+		reloaded.scripting.ForEachLibrary(func(code []byte) bool {
+			codes = append(codes, string(code))
+			return true
+		})
+		return codes
+	}())
+}
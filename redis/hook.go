@@ -0,0 +1,140 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// 命令执行的拦截器, 用来做审计, 访问日志或者限流. 每条客户端命令通过认证和参数检查之后, 按照注册的顺序调用 BeforeCommand,
+// 执行之后按照同样的顺序调用 AfterCommand. 主节点的复制流, 加载 aof 和脚本中 redis.call 执行的命令不经过 hook.
+// hook 在持有全局锁时调用, 不能阻塞, 也不能通过 LocalConn 再执行命令
+
+// CommandContext hook 看到的命令. Args 和 Keys 是执行时参数的副本, hook 修改它们不影响命令的执行
+type CommandContext struct {
+	ClientID int64
+	// Name 小写的命令名称
+	Name string
+	Args [][]byte
+	// Keys 命令声明的 key
+	Keys [][]byte
+	DB   int
+}
+
+// Hook 命令执行的拦截器
+type Hook interface {
+	// BeforeCommand 返回 override 时不执行命令, 把 override 作为回复; 只返回 allow 为 false 时回复 errHookDenied
+	BeforeCommand(ctx context.Context, cmd *CommandContext) (allow bool, override Reply)
+	// AfterCommand reply 是客户端收到的回复(被拦截时是 override), err 是执行命令的错误, dur 是执行的耗时
+	AfterCommand(ctx context.Context, cmd *CommandContext, reply Reply, err error, dur time.Duration)
+}
+
+var errHookDenied = MakeStandardErrReply("ERR command rejected by hook")
+
+// RegisterHook 注册一个 hook, 之后执行的命令按照注册的顺序调用
+func (r *RedisServer) RegisterHook(h Hook) {
+	lock.Lock()
+	defer lock.Unlock()
+	r.hooks = append(r.hooks, h)
+}
+
+// capturedReply 执行命令期间写给客户端的回复, 传给 AfterCommand
+type capturedReply struct {
+	data []byte
+}
+
+func (c *capturedReply) WriteTo(client *Client) error {
+	if _, err := client.Write(c.data); err != nil {
+		return err
+	}
+	return client.Flush()
+}
+
+func (c *capturedReply) ToBytes() []byte {
+	return c.data
+}
+
+// capturedErrReply 错误回复, IsErrorReply 返回 true
+type capturedErrReply struct {
+	capturedReply
+}
+
+func (c *capturedErrReply) Error() string {
+	line := c.data
+	if c.data[0] == '!' {
+		// RESP3 的 blob error: !<len>\r\n<error>\r\n
+		line = line[bytes.IndexByte(line, '\n')+1:]
+	} else {
+		line = line[1:]
+	}
+	return string(bytes.TrimSuffix(line, CRLFBytes))
+}
+
+func makeCapturedReply(data []byte) Reply {
+	if len(data) > 0 && (data[0] == '-' || data[0] == '!') {
+		return &capturedErrReply{capturedReply{data: data}}
+	}
+	return &capturedReply{data: data}
+}
+
+// hookContext 复制一份命令给 hook
+func hookContext(conn *Client, cmd *Command) *CommandContext {
+	cmdLine := conn.GetCmdLine()
+	args := make([][]byte, 0, len(cmdLine)-1)
+	for _, arg := range cmdLine[1:] {
+		args = append(args, append([]byte(nil), arg...))
+	}
+	keys := cmd.GetKeys(cmdLine)
+	copied := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		copied = append(copied, append([]byte(nil), key...))
+	}
+	return &CommandContext{
+		ClientID: conn.GetId(),
+		Name:     conn.GetCmdName(),
+		Args:     args,
+		Keys:     copied,
+		DB:       conn.GetDbIndex(),
+	}
+}
+
+// useHooks 这个客户端的命令是否经过 hook
+func (r *RedisServer) useHooks(conn *Client) bool {
+	return len(r.hooks) > 0 && !conn.master && !conn.inner && !r.loading.Load()
+}
+
+// execWithHooks 调用 hook 并执行命令, 返回 hook 拦截时写给客户端的错误或者 execute 的错误. 调用方持有锁
+func (r *RedisServer) execWithHooks(ctx context.Context, conn *Client, cmd *Command, execute func() error) error {
+	hookCtx := hookContext(conn, cmd)
+	called := 0
+	var override Reply
+	for _, hook := range r.hooks {
+		called++
+		allow, reply := hook.BeforeCommand(ctx, hookCtx)
+		if reply != nil || !allow {
+			override = reply
+			if override == nil {
+				override = errHookDenied
+			}
+			break
+		}
+	}
+	capture := &bytes.Buffer{}
+	conn.capture = capture
+	var err error
+	var dur time.Duration
+	if override != nil {
+		cmd.stats.reject()
+		err = override.WriteTo(conn)
+	} else {
+		start := time.Now()
+		err = execute()
+		dur = time.Since(start)
+	}
+	conn.capture = nil
+	reply := makeCapturedReply(capture.Bytes())
+	for _, hook := range r.hooks[:called] {
+		hook.AfterCommand(ctx, hookCtx, reply, err, dur)
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// protectPrefix 拒绝删除以 prefix 开头的 key
+type protectPrefix struct {
+	prefix  string
+	before  []string
+	replies []string
+	errors  []bool
+}
+
+func (p *protectPrefix) BeforeCommand(ctx context.Context, cmd *CommandContext) (bool, Reply) {
+	p.before = append(p.before, cmd.Name)
+	if cmd.Name == "del" || cmd.Name == "unlink" {
+		for _, key := range cmd.Keys {
+			if bytes.HasPrefix(key, []byte(p.prefix)) {
+				return false, MakeStandardErrReply("ERR key " + string(key) + " is protected")
+			}
+		}
+	}
+	// 修改副本不影响命令的执行
+	for _, arg := range cmd.Args {
+		for i := range arg {
+			arg[i] = 'x'
+		}
+	}
+	return true, nil
+}
+
+func (p *protectPrefix) AfterCommand(ctx context.Context, cmd *CommandContext, reply Reply, err error, dur time.Duration) {
+	p.replies = append(p.replies, string(reply.ToBytes()))
+	p.errors = append(p.errors, IsErrorReply(reply))
+}
+
+// orderHook 记录调用的顺序, deny 时只返回 false
+type orderHook struct {
+	name  string
+	deny  bool
+	calls *[]string
+}
+
+func (o *orderHook) BeforeCommand(ctx context.Context, cmd *CommandContext) (bool, Reply) {
+	*o.calls = append(*o.calls, "before "+o.name)
+	return !o.deny, nil
+}
+
+func (o *orderHook) AfterCommand(ctx context.Context, cmd *CommandContext, reply Reply, err error, dur time.Duration) {
+	*o.calls = append(*o.calls, "after "+o.name)
+}
+
+func TestHookBlocksDel(t *testing.T) {
+	server := newTestServer()
+	hook := &protectPrefix{prefix: "protected:"}
+	server.RegisterHook(hook)
+	client, _ := server.newClient()
+	// 命令的统计是全局的, 比较执行前后的差值
+	del, _ := router("del")
+	rejected := del.stats.rejected.Load()
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "protected:a", "1"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "other", "2"))
+	assert.Equal(t, "-ERR key protected:a is protected\r\n", server.exec(t, client, "del", "other", "protected:a"))
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "exists", "protected:a", "other"))
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "del", "other"))
+	assert.Equal(t, "$1\r\n1\r\n", server.exec(t, client, "get", "protected:a"))
+
+	assert.Equal(t, []string{"set", "set", "del", "exists", "del", "get"}, hook.before)
+	assert.Equal(t, []string{"+OK\r\n", "+OK\r\n", "-ERR key protected:a is protected\r\n", ":2\r\n", ":1\r\n", "$1\r\n1\r\n"}, hook.replies)
+	assert.Equal(t, []bool{false, false, true, false, false, false}, hook.errors)
+	// 被 hook 拦截的命令计入 rejected_calls
+	assert.Equal(t, rejected+1, del.stats.rejected.Load())
+}
+
+func TestHookOrder(t *testing.T) {
+	server := newTestServer()
+	var calls []string
+	server.RegisterHook(&orderHook{name: "first", calls: &calls})
+	server.RegisterHook(&orderHook{name: "second", calls: &calls})
+	client, _ := server.newClient()
+	server.exec(t, client, "ping")
+	assert.Equal(t, []string{"before first", "before second", "after first", "after second"}, calls)
+
+	// 拦截之后后面的 hook 不再调用
+	calls = nil
+	server.RegisterHook(&orderHook{name: "deny", deny: true, calls: &calls})
+	server.RegisterHook(&orderHook{name: "last", calls: &calls})
+	assert.Equal(t, "-ERR command rejected by hook\r\n", server.exec(t, client, "ping"))
+	assert.Equal(t, []string{"before first", "before second", "before deny", "after first", "after second", "after deny"}, calls)
+
+	// 参数检查和认证失败的命令不经过 hook
+	calls = nil
+	server.exec(t, client, "get")
+	assert.Empty(t, calls)
+}
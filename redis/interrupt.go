@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"context"
+	"github.com/xuning888/godis-tiny/config"
+	"time"
+)
+
+// 执行时间很长的命令(KEYS, SORT, DEBUG SLEEP, 脚本)在执行期间检查 ctx, ctx 结束时停止并回复错误.
+// 网络上的客户端的 ctx 来自 server 的根 context, 开始关闭时取消, 正在执行的命令不会拖住关闭;
+// 配置了 command-timeout 时每条命令还有自己的截止时间. 主节点的复制流和加载 aof 不受 command-timeout 限制
+
+// interruptCheckInterval 遍历时每处理这么多个元素检查一次 ctx
+const interruptCheckInterval = 1024
+
+// commandContext 执行一条命令使用的 ctx, 调用方执行完之后调用 cancel
+func (r *RedisServer) commandContext(ctx context.Context, conn *Client) (context.Context, context.CancelFunc) {
+	timeout := config.Properties.CommandTimeout
+	if timeout <= 0 || conn.master || conn.inner || r.loading.Load() {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+}
+
+// rootContext server 开始关闭时取消, 测试中创建的 server 没有根 context
+func (r *RedisServer) rootContext() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// withRoot 调用方的 ctx 结束或者 server 开始关闭时都取消, LocalConn 使用
+func (r *RedisServer) withRoot(ctx context.Context) (context.Context, context.CancelFunc) {
+	root := r.rootContext()
+	if ctx == root {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(root, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// interrupted 遍历到第 i 个元素时 ctx 是否已经结束
+func interrupted(ctx context.Context, i int) bool {
+	return i%interruptCheckInterval == 0 && ctx.Err() != nil
+}
+
+// interruptedReply ctx 结束之后回复给客户端的错误
+func interruptedReply(ctx context.Context) Reply {
+	if ctx.Err() == context.DeadlineExceeded {
+		return MakeStandardErrReply("ERR command interrupted: deadline exceeded")
+	}
+	return MakeStandardErrReply("ERR command interrupted")
+}
@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCommandTimeout(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "sleep", "0.01"))
+	assert.Equal(t, "-ERR value is not a valid float\r\n", server.exec(t, client, "debug", "sleep", "soon"))
+
+	config.Properties.CommandTimeout = 50
+	t.Cleanup(func() {
+		config.Properties.CommandTimeout = 0
+	})
+	begin := time.Now()
+	assert.Equal(t, "-ERR command interrupted: deadline exceeded\r\n", server.exec(t, client, "debug", "sleep", "10"))
+	assert.Less(t, time.Since(begin), 5*time.Second)
+	// 之后的命令不受影响
+	assert.Equal(t, "+PONG\r\n", server.exec(t, client, "ping"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "command-timeout", "0"))
+	assert.Equal(t, 0, config.Properties.CommandTimeout)
+}
+
+func TestCommandInterrupted(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	for i := 0; i < 3*interruptCheckInterval; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), strconv.Itoa(i))
+		server.exec(t, client, "rpush", "list", strconv.Itoa(i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	run := func(args ...string) string {
+		client.PushCmd(util.ToCmdLine(args[0], args[1:]...))
+		if err := server.process(ctx, client); err != nil {
+			t.Fatalf("process %v failed: %v", args, err)
+		}
+		return client.conn.(*fakeConn).take()
+	}
+	assert.Equal(t, "-ERR command interrupted\r\n", run("keys", "*"))
+	assert.Equal(t, "-ERR command interrupted\r\n", run("sort", "list"))
+	assert.Equal(t, "-ERR command interrupted\r\n", run("sort", "list", "by", "nosort", "get", "key:*"))
+	assert.Equal(t, "-ERR command interrupted\r\n", run("debug", "sleep", "10"))
+	// 中断的 SORT STORE 不会写入
+	assert.Equal(t, "-ERR command interrupted\r\n", run("sort", "list", "store", "dest"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "dest"))
+}
@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"sync"
+	"sync/atomic"
+)
+
+// 与 redis 的 lazyfree.c 一致: 删除的key总是立即从 db 中移除, 元素超过 lazyFreeThreshold 个的值交给后台的 goroutine,
+// 在那里逐个移除容器中的元素, 持有锁处理命令时不需要为拆开一个很大的值停下来. 不打开 lazyfree 时和原来一样直接丢弃引用.
+// 快照(BGSAVE, aof 重写, 全量同步)还在读取的对象不能拆开, 只丢弃引用
+
+// lazyFreeThreshold 与 redis 一致, 释放的工作量超过它时才在后台释放
+const lazyFreeThreshold = 64
+
+// lazyFreeQueueSize 队列满的时候直接丢弃引用, 交给 GC 回收
+const lazyFreeQueueSize = 1024
+
+type lazyFreer struct {
+	once sync.Once
+	jobs chan func()
+	// pending 已经提交还没有释放的对象, freed 后台释放过的对象
+	pending atomic.Int64
+	freed   atomic.Int64
+}
+
+// lazyfree 所有 db 共用一个后台 goroutine, 第一次提交时启动
+var lazyfree = &lazyFreer{jobs: make(chan func(), lazyFreeQueueSize)}
+
+func (l *lazyFreer) run() {
+	for job := range l.jobs {
+		job()
+	}
+}
+
+// submit 提交释放 objects 个对象的任务, 队列已满时返回 false
+func (l *lazyFreer) submit(objects int64, job func()) bool {
+	l.once.Do(func() {
+		go l.run()
+	})
+	l.pending.Add(objects)
+	select {
+	case l.jobs <- job:
+		return true
+	default:
+		l.pending.Add(-objects)
+		return false
+	}
+}
+
+func (l *lazyFreer) done(objects int64) {
+	l.pending.Add(-objects)
+	l.freed.Add(objects)
+}
+
+// freeObject 在后台拆开一个已经从 db 中移除的对象
+func (l *lazyFreer) freeObject(value *obj.RedisObject) {
+	l.submit(1, func() {
+		obj.FreeObject(value)
+		l.done(1)
+	})
+}
+
+// freeDict 在后台拆开 FLUSHDB/FLUSHALL 换下来的整个 dict
+func (l *lazyFreer) freeDict(data dict.Dict) {
+	l.submit(int64(data.Len()), func() {
+		var objects int64
+		data.ForEach(func(key string, val interface{}) bool {
+			if value := val.(*obj.RedisObject); obj.FreeEffort(value) > lazyFreeThreshold {
+				obj.FreeObject(value)
+			}
+			data.Remove(key)
+			// 批量更新计数, 让 INFO 看到释放的进度
+			if objects++; objects == 1024 {
+				l.done(objects)
+				objects = 0
+			}
+			return true
+		})
+		closeDict(data)
+		l.done(objects)
+	})
+}
+
+// Delete 删除key, lazy 时元素很多的值在后台释放. 返回删除的key的个数. 读不出来的值(见 dict.Loader)只删除key
+func (db *DB) Delete(key string, lazy bool) int {
+	row, _, _ := db.load(key)
+	if db.Remove(key) == 0 {
+		return 0
+	}
+	if value, ok := row.(*obj.RedisObject); ok && lazy && obj.FreeEffort(value) > lazyFreeThreshold && !db.snapshotted(key, value) {
+		lazyfree.freeObject(value)
+	}
+	return 1
+}
+
+// FlushLazy 和 Flush 一样立即清空 db, 旧的数据在后台释放. 创建新的 dict 失败时和 Flush 一样在原地清空
+func (db *DB) FlushLazy() {
+	if db.data.Len() == 0 {
+		db.Flush()
+		return
+	}
+	data, err := newDbDict(db.Index)
+	if err != nil {
+		db.Flush()
+		return
+	}
+	old := db.data
+	db.data = data
+	db.ttlCache.Clear()
+	db.updateKeys()
+	db.SignalFlushed()
+	if !db.cow.Load() {
+		lazyfree.freeDict(old)
+	} else {
+		// 快照已经复制了对象的指针, 不再需要旧的 dict
+		closeDict(old)
+	}
+}
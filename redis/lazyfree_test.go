@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// bigHash 直接写入一个有 fields 个字段的 hash
+func bigHash(mdb *DB, key string, fields int) *obj.RedisObject {
+	hash := obj.NewHashObject()
+	data := hash.Ptr.(*dict.SimpleDict)
+	for i := 0; i < fields; i++ {
+		data.Put(strconv.Itoa(i), []byte("value"))
+	}
+	mdb.PutEntity(key, hash)
+	return hash
+}
+
+// useLazyFree 打开一个 lazyfree 选项, 测试结束时恢复
+func useLazyFree(t *testing.T, option *bool) {
+	previous := *option
+	*option = true
+	t.Cleanup(func() {
+		*option = previous
+	})
+}
+
+// waitFreed 等待后台队列清空, 返回对象是否被拆开
+func waitFreed(t *testing.T, value *obj.RedisObject) bool {
+	assert.Eventually(t, func() bool {
+		return lazyfree.pending.Load() == 0
+	}, 5*time.Second, time.Millisecond)
+	return value.Ptr == nil
+}
+
+func TestLazyFreeUserDel(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	useLazyFree(t, &config.Properties.LazyfreeLazyUserDel)
+	big := bigHash(server.dbs[0], "big", 1000000)
+	freed := lazyfree.freed.Load()
+
+	// key 立即被删除, 值在后台释放
+	begin := time.Now()
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "del", "big"))
+	assert.Less(t, int64(time.Since(begin)), int64(100*time.Millisecond))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "big"))
+	assert.True(t, waitFreed(t, big))
+	assert.Equal(t, freed+1, lazyfree.freed.Load())
+	assert.Equal(t, "0", infoAll(t, server, client, "lazyfree_pending_objects"))
+
+	// 元素不多的值直接丢弃
+	small := bigHash(server.dbs[0], "small", lazyFreeThreshold)
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "del", "small"))
+	assert.False(t, waitFreed(t, small))
+	assert.Equal(t, freed+1, lazyfree.freed.Load())
+}
+
+func TestLazyFreeUnlink(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	big := bigHash(server.dbs[0], "big", 1000)
+	// 没有打开 lazyfree-lazy-user-del 时 DEL 不在后台释放, UNLINK 总是在后台释放
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "del", "big"))
+	assert.False(t, waitFreed(t, big))
+	big = bigHash(server.dbs[0], "big", 1000)
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "unlink", "big", "missing"))
+	assert.True(t, waitFreed(t, big))
+
+	// 快照还在读取的对象不能拆开
+	big = bigHash(server.dbs[0], "big", 1000)
+	snapshot := server.Snapshot()
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "unlink", "big"))
+	assert.False(t, waitFreed(t, big))
+	snapshot.Release()
+	assert.Equal(t, 1000, big.Ptr.(*dict.SimpleDict).Len())
+}
+
+func TestLazyFreeExpireAndEviction(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	useLazyFree(t, &config.Properties.LazyfreeLazyExpire)
+	useLazyFree(t, &config.Properties.LazyfreeLazyEviction)
+
+	big := bigHash(server.dbs[0], "big", 1000)
+	server.exec(t, client, "pexpireat", "big", strconv.FormatInt(clk.Now().UnixMilli()+1, 10))
+	clk.Advance(5 * time.Millisecond)
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "big"))
+	assert.True(t, waitFreed(t, big))
+
+	big = bigHash(server.dbs[0], "big", 1000)
+	useMaxMemory(t, server, datasetMemory(server)-1, "allkeys-random")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "bar"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "big"))
+	assert.True(t, waitFreed(t, big))
+}
+
+func TestLazyFreeFlush(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	big := bigHash(server.dbs[0], "big", 1000)
+	other := bigHash(server.dbs[1], "other", 1000)
+	for i := 0; i < 100; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), "value")
+	}
+	freed := lazyfree.freed.Load()
+
+	// 队列中的任务还没有执行时可以看到等待释放的对象
+	block := make(chan struct{})
+	lazyfree.submit(1, func() {
+		<-block
+		lazyfree.done(1)
+	})
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "flushall", "async"))
+	assert.Equal(t, 0, server.dbs[0].Len())
+	assert.Equal(t, 0, server.dbs[1].Len())
+	assert.Equal(t, "103", infoAll(t, server, client, "lazyfree_pending_objects"))
+	close(block)
+	assert.True(t, waitFreed(t, big))
+	assert.True(t, waitFreed(t, other))
+	assert.Equal(t, freed+103, lazyfree.freed.Load())
+
+	// 没有指定时按照 lazyfree-lazy-user-flush
+	big = bigHash(server.dbs[0], "big", 1000)
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "flushdb"))
+	assert.False(t, waitFreed(t, big))
+	useLazyFree(t, &config.Properties.LazyfreeLazyUserFlush)
+	big = bigHash(server.dbs[0], "big", 1000)
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "flushdb"))
+	assert.True(t, waitFreed(t, big))
+	big = bigHash(server.dbs[0], "big", 1000)
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "flushdb", "sync"))
+	assert.False(t, waitFreed(t, big))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "flushall", "now"))
+}
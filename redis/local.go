@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LocalConn 不经过网络执行命令的客户端, 嵌入的 server 在同一个进程中使用. 命令和网络上的客户端一样在 process 中执行
+// (认证, SELECT, 淘汰, 传播都相同), 回复按照客户端的协议版本编码之后返回, pub/sub 的消息等推送交给 onPush.
+// onPush 在其他客户端持有锁的时候调用, 不能阻塞
+type LocalConn struct {
+	server *RedisServer
+	client *Client
+	// mux 同一个 LocalConn 上的命令依次执行
+	mux sync.Mutex
+}
+
+func (r *RedisServer) NewLocalConn(onPush func(data []byte)) *LocalConn {
+	client := NewClient(0, nil, false)
+	client.replySink = &bytes.Buffer{}
+	client.pushSink = onPush
+	return &LocalConn{server: r, client: client}
+}
+
+// Exec 执行一条命令, 返回编码之后的回复. 一条命令有多个回复时(比如 SUBSCRIBE 多个 channel)依次连在一起.
+// 暂停写命令期间写命令一直等待, 直到恢复或者 ctx 结束
+func (l *LocalConn) Exec(ctx context.Context, cmdLine [][]byte) ([]byte, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	ctx, cancel := l.server.withRoot(ctx)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if atomic.LoadUint32(&l.server.status) != statusRunning {
+		return nil, ErrNotRunning
+	}
+	client := l.client
+	client.replySink.Reset()
+	client.PushCmd(cmdLine)
+	for {
+		if err := l.server.process(ctx, client); err != nil {
+			client.ResetQueryBuffer()
+			return nil, err
+		}
+		if !client.HasRemaining() && !l.blocked() {
+			break
+		}
+		// 命令还在队列中被暂停了, 或者阻塞命令还没有被唤醒
+		select {
+		case <-ctx.Done():
+			l.cancelPaused()
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return append([]byte(nil), client.replySink.Bytes()...), nil
+}
+
+// blocked 正在等待阻塞命令的回复
+func (l *LocalConn) blocked() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return l.client.blocked != nil
+}
+
+// cancelPaused 放弃被暂停或者阻塞的命令, 恢复写命令或者超时的时候不再唤醒这个客户端
+func (l *LocalConn) cancelPaused() {
+	lock.Lock()
+	defer lock.Unlock()
+	client := l.client
+	l.server.removeBlocked(client)
+	if client.paused {
+		client.paused = false
+		for i, paused := range l.server.pausedClients {
+			if paused == client {
+				l.server.pausedClients = append(l.server.pausedClients[:i], l.server.pausedClients[i+1:]...)
+				break
+			}
+		}
+	}
+	client.ResetQueryBuffer()
+}
+
+// Close 取消订阅和 tracking, 之后不会再收到推送
+func (l *LocalConn) Close() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+	l.client.resetState()
+	l.client.pushSink = nil
+}
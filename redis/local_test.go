@@ -0,0 +1,97 @@
+package redis
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"testing"
+	"time"
+)
+
+func TestLocalConn(t *testing.T) {
+	server := newTestServer()
+	var pushes []string
+	local := server.NewLocalConn(func(data []byte) {
+		pushes = append(pushes, string(data))
+	})
+	ctx := context.Background()
+	// 还没有启动
+	_, err := local.Exec(ctx, util.ToCmdLine("ping"))
+	assert.Equal(t, ErrNotRunning, err)
+
+	server.status = statusRunning
+	reply, err := local.Exec(ctx, util.ToCmdLine("subscribe", "a", "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n", string(reply))
+	client, _ := server.newClient()
+	server.exec(t, client, "publish", "a", "hello")
+	assert.Equal(t, []string{"*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n"}, pushes)
+
+	local.Close()
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "publish", "a", "hello"))
+	assert.Len(t, pushes, 1)
+}
+
+func TestLocalConnPaused(t *testing.T) {
+	server := newTestServer()
+	server.status = statusRunning
+	local := server.NewLocalConn(nil)
+	ctx := context.Background()
+	server.pauseWrites()
+	// 只读命令不受影响
+	reply, err := local.Exec(ctx, util.ToCmdLine("get", "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "$-1\r\n", string(reply))
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = local.Exec(timeout, util.ToCmdLine("set", "foo", "bar"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Empty(t, server.pausedClients)
+
+	// 恢复之前执行的写命令一直等待
+	done := make(chan string, 1)
+	go func() {
+		reply, _ := local.Exec(ctx, util.ToCmdLine("set", "foo", "baz"))
+		done <- string(reply)
+	}()
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(server.pausedClients) == 1
+	}, time.Second, time.Millisecond)
+	lock.Lock()
+	server.unpauseWrites()
+	lock.Unlock()
+	assert.Equal(t, "+OK\r\n", <-done)
+	reply, _ = local.Exec(ctx, util.ToCmdLine("get", "foo"))
+	assert.Equal(t, "$3\r\nbaz\r\n", string(reply))
+}
+
+func TestLocalConnBlocked(t *testing.T) {
+	server := newTestServer()
+	server.status = statusRunning
+	local := server.NewLocalConn(nil)
+	ctx := context.Background()
+
+	// ctx 结束时取消阻塞
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err := local.Exec(timeout, util.ToCmdLine("blpop", "list", "0"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Empty(t, server.blocking.keys)
+
+	done := make(chan string, 1)
+	go func() {
+		reply, _ := local.Exec(ctx, util.ToCmdLine("blpop", "list", "0"))
+		done <- string(reply)
+	}()
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(server.blocking.keys) == 1
+	}, time.Second, time.Millisecond)
+	client, _ := server.newClient()
+	server.exec(t, client, "rpush", "list", "a")
+	assert.Equal(t, "*2\r\n$4\r\nlist\r\n$1\r\na\r\n", <-done)
+}
@@ -0,0 +1,232 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置了 metrics-addr 时在这个地址上提供 Prometheus 的 /metrics, 指标与 INFO 的字段来自同一份计数.
+// 采集时只读取原子变量和各个模块自己的锁(客户端列表, 复制状态), 不获取执行命令的全局锁, 脚本或者慢命令执行期间也可以采集
+
+// metricsNamespace 所有指标名字的前缀
+const metricsNamespace = "godis_"
+
+// latencyHistogramMinShift latencyHistogramMaxShift 命令耗时直方图的边界是 2^10ns(大约1微秒) 到 2^40ns 之间的2的幂,
+// 每个边界是 latencystats 中一组 latencySubBuckets 个桶的上界
+const (
+	latencyHistogramMinShift = 10
+	latencyHistogramMaxShift = latencyMaxShift
+)
+
+// metricsServer metrics-addr 上的 http 服务
+type metricsServer struct {
+	listener net.Listener
+	http     *http.Server
+}
+
+// listenMetrics 按照 metrics-addr 监听, 没有配置时返回 nil
+func (r *RedisServer) listenMetrics() (*metricsServer, error) {
+	addr := config.Properties.MetricsAddr
+	if addr == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics-addr %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		r.WriteMetrics(buf)
+		_ = buf.Flush()
+	})
+	return &metricsServer{
+		listener: listener,
+		http:     &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+	}, nil
+}
+
+// serve 采集失败不影响命令的执行, 只记录日志
+func (m *metricsServer) serve(lg logger.Logger) {
+	if err := m.http.Serve(m.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		lg.Errorf("metrics server stopped: %v", err)
+	}
+}
+
+func (m *metricsServer) close(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	if err := m.http.Shutdown(ctx); err != nil {
+		_ = m.http.Close()
+	}
+	// 还没有开始 Serve 时 Shutdown 不会关闭 listener
+	_ = m.listener.Close()
+}
+
+// MetricsAddr metrics-addr 实际监听的地址, 没有配置时返回 nil
+func (r *RedisServer) MetricsAddr() net.Addr {
+	if r.metrics == nil {
+		return nil
+	}
+	return r.metrics.listener.Addr()
+}
+
+// metricsWriter 按照 Prometheus 的文本格式写入指标, 同一个指标的所有样本写在一起
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsNamespace, name, help, metricsNamespace, name, kind)
+}
+
+// sample labels 按照 name, value 依次排列
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	builder := strings.Builder{}
+	builder.WriteString(metricsNamespace)
+	builder.WriteString(name)
+	if len(labels) > 0 {
+		builder.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				builder.WriteByte(',')
+			}
+			builder.WriteString(labels[i])
+			builder.WriteString("=")
+			builder.WriteString(strconv.Quote(labels[i+1]))
+		}
+		builder.WriteByte('}')
+	}
+	builder.WriteByte(' ')
+	builder.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	builder.WriteByte('\n')
+	_, _ = io.WriteString(m.w, builder.String())
+}
+
+func (m *metricsWriter) single(name, kind, help string, value float64) {
+	m.header(name, kind, help)
+	m.sample(name, value)
+}
+
+// WriteMetrics 写入所有的指标
+func (r *RedisServer) WriteMetrics(w io.Writer) {
+	m := &metricsWriter{w: w}
+	m.single("connected_clients", "gauge", "Number of client connections.", float64(r.connManager.CountConnections()))
+	m.single("rejected_connections_total", "counter", "Connections rejected because of maxclients.",
+		float64(r.connManager.RejectedConnections()))
+	m.single("used_memory_bytes", "gauge", "Memory used by the data set.", float64(r.memoryUsed()))
+	m.single("keyspace_hits_total", "counter", "Successful lookups of keys.", float64(r.stats.keyspaceHits.Load()))
+	m.single("keyspace_misses_total", "counter", "Failed lookups of keys.", float64(r.stats.keyspaceMisses.Load()))
+	m.single("expired_keys_total", "counter", "Keys deleted because they expired.", float64(r.stats.expiredKeys.Load()))
+	m.single("evicted_keys_total", "counter", "Keys evicted because of maxmemory.", float64(r.stats.evictedKeys.Load()))
+	m.single("net_input_bytes_total", "counter", "Bytes read from clients.", float64(r.stats.netInputBytes.Load()))
+	m.single("net_output_bytes_total", "counter", "Bytes written to clients.", float64(r.stats.netOutputBytes.Load()))
+	m.single("rdb_changes_since_last_save", "gauge", "Writes since the last successful save.", float64(r.dirty.Load()))
+	m.single("rdb_last_save_timestamp_seconds", "gauge", "Time of the last successful save.", float64(r.LastSave()))
+	var pendingFsync float64
+	if r.aof != nil && r.aof.fsyncing.Load() {
+		pendingFsync = 1
+	}
+	m.single("aof_pending_fsync", "gauge", "Whether a background fsync of the AOF is in progress.", pendingFsync)
+	r.writeKeyspaceMetrics(m)
+	if r.repl != nil {
+		r.repl.writeMetrics(m)
+	}
+	writeCommandMetrics(m)
+}
+
+// writeKeyspaceMetrics 与 INFO keyspace 一样只输出有key的 db
+func (r *RedisServer) writeKeyspaceMetrics(m *metricsWriter) {
+	m.header("db_keys", "gauge", "Number of keys in each database.")
+	for _, mdb := range r.dbs {
+		if keys := mdb.keys.Load(); keys > 0 {
+			m.sample("db_keys", float64(keys), "db", strconv.Itoa(mdb.Index))
+		}
+	}
+}
+
+// writeMetrics 复制的偏移量, 持有 rp.mux
+func (rp *Replication) writeMetrics(m *metricsWriter) {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	m.single("master_repl_offset", "gauge", "Replication offset of this server.", float64(rp.offset))
+	m.single("connected_slaves", "gauge", "Number of connected replicas.", float64(len(rp.replicas)))
+	m.header("slave_repl_offset", "gauge", "Offset acknowledged by each replica.")
+	replicas := make([]*replica, 0, len(rp.replicas))
+	for _, r := range rp.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].client.id < replicas[j].client.id
+	})
+	for _, r := range replicas {
+		m.sample("slave_repl_offset", float64(r.ackOffset), "slave", net.JoinHostPort(r.ip(), strconv.Itoa(r.listeningPort)))
+	}
+}
+
+// writeCommandMetrics INFO commandstats 和 latencystats, 只输出执行过或者被拒绝过的命令
+func writeCommandMetrics(m *metricsWriter) {
+	commands := sortedCommands()
+	m.header("commands_processed_total", "counter", "Number of calls of each command.")
+	for _, cmd := range commands {
+		if calls := cmd.stats.calls.Load(); calls > 0 {
+			m.sample("commands_processed_total", float64(calls), "cmd", cmd.name)
+		}
+	}
+	m.header("commands_rejected_total", "counter", "Calls rejected before execution (arity, auth, OOM, hooks).")
+	for _, cmd := range commands {
+		if rejected := cmd.stats.rejected.Load(); rejected > 0 {
+			m.sample("commands_rejected_total", float64(rejected), "cmd", cmd.name)
+		}
+	}
+	m.header("commands_failed_total", "counter", "Calls that replied with an error.")
+	for _, cmd := range commands {
+		if failed := cmd.stats.failed.Load(); failed > 0 {
+			m.sample("commands_failed_total", float64(failed), "cmd", cmd.name)
+		}
+	}
+	m.header("command_duration_seconds", "histogram", "Execution time of each command.")
+	for _, cmd := range commands {
+		cmd.stats.writeHistogram(m, cmd.name)
+	}
+}
+
+// writeHistogram 把 latencystats 的桶合并成2的幂的边界, count 是所有桶的和, 与 bucket 的值一致
+func (s *commandStats) writeHistogram(m *metricsWriter, name string) {
+	var counts [latencyBuckets]int64
+	var total int64
+	for i := range s.latency {
+		counts[i] = s.latency[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return
+	}
+	var cumulative int64
+	bucket := 0
+	for shift := latencyHistogramMinShift; shift <= latencyHistogramMaxShift; shift++ {
+		// 上界小于 2^shift 的桶
+		for bucket < latencyBuckets && latencyBucketUpper(bucket) < int64(1)<<shift {
+			cumulative += counts[bucket]
+			bucket++
+		}
+		le := strconv.FormatFloat(float64(int64(1)<<shift)/1e9, 'g', -1, 64)
+		m.sample("command_duration_seconds_bucket", float64(cumulative), "cmd", name, "le", le)
+	}
+	m.sample("command_duration_seconds_bucket", float64(total), "cmd", name, "le", "+Inf")
+	m.sample("command_duration_seconds_sum", float64(s.usec.Load())/1e6, "cmd", name)
+	m.sample("command_duration_seconds_count", float64(total), "cmd", name)
+}
@@ -0,0 +1,57 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetricsWithoutLock 执行命令的锁被占用时(比如慢脚本)也可以采集
+func TestMetricsWithoutLock(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "rpush", "list", "a")
+
+	lock.Lock()
+	done := make(chan string)
+	go func() {
+		buf := &bytes.Buffer{}
+		server.WriteMetrics(buf)
+		done <- buf.String()
+	}()
+	var output string
+	select {
+	case output = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteMetrics blocked on the command lock")
+	}
+	lock.Unlock()
+
+	assert.Contains(t, output, "# TYPE godis_db_keys gauge\n")
+	assert.Contains(t, output, `godis_db_keys{db="0"} 2`+"\n")
+	assert.Contains(t, output, "# TYPE godis_command_duration_seconds histogram\n")
+	assert.Contains(t, output, `godis_command_duration_seconds_bucket{cmd="rpush",le="+Inf"}`)
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	stats := &commandStats{}
+	stats.record(500*time.Nanosecond, false)
+	stats.record(3*time.Microsecond, false)
+	stats.record(2*time.Second, false)
+	buf := &bytes.Buffer{}
+	stats.writeHistogram(&metricsWriter{w: buf}, "get")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, latencyHistogramMaxShift-latencyHistogramMinShift+4)
+	// 三次耗时分别在 2^10ns, 2^12ns 和 2^31ns 以内
+	assert.Equal(t, `godis_command_duration_seconds_bucket{cmd="get",le="1.024e-06"} 1`, lines[0])
+	assert.Equal(t, `godis_command_duration_seconds_bucket{cmd="get",le="2.048e-06"} 1`, lines[1])
+	assert.Equal(t, `godis_command_duration_seconds_bucket{cmd="get",le="4.096e-06"} 2`, lines[2])
+	assert.Equal(t, `godis_command_duration_seconds_bucket{cmd="get",le="1.073741824"} 2`, lines[20])
+	assert.Equal(t, `godis_command_duration_seconds_bucket{cmd="get",le="2.147483648"} 3`, lines[21])
+	assert.Equal(t, `godis_command_duration_seconds_bucket{cmd="get",le="+Inf"} 3`, lines[len(lines)-3])
+	assert.Equal(t, `godis_command_duration_seconds_count{cmd="get"} 3`, lines[len(lines)-1])
+}
@@ -0,0 +1,220 @@
+package redis
+
+import (
+	"context"
+	"time"
+)
+
+// 事务: MULTI 之后的命令不执行, 只是排队并回复 QUEUED, EXEC 依次执行排队的命令, 中间不会执行其他客户端的命令.
+// WATCH 的 key 在 EXEC 之前被修改(包括过期和 FLUSHDB)时 EXEC 不执行任何命令, 回复空数组.
+// 事务中的阻塞命令不阻塞, 和超时一样立即回复
+
+// multiState MULTI 之后排队的命令
+type multiState struct {
+	commands [][][]byte
+	// aborted 排队时有命令被拒绝(未知的命令, 参数个数错误等), EXEC 回复 EXECABORT
+	aborted bool
+}
+
+// Watches WATCH 的 key 和客户端, 持有锁时读写
+type Watches struct {
+	keys map[dbKey]map[*Client]struct{}
+}
+
+func NewWatches() *Watches {
+	return &Watches{keys: make(map[dbKey]map[*Client]struct{})}
+}
+
+// Watch 客户端 WATCH 一个 key
+func (w *Watches) Watch(client *Client, dbIndex int, key string) {
+	wk := dbKey{dbIndex: dbIndex, key: key}
+	clients, ok := w.keys[wk]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		w.keys[wk] = clients
+	}
+	if _, watched := clients[client]; watched {
+		return
+	}
+	clients[client] = struct{}{}
+	client.watchedKeys = append(client.watchedKeys, wk)
+}
+
+// UnwatchAll 取消客户端 WATCH 的所有 key, EXEC, DISCARD, UNWATCH, RESET 和断开连接时调用
+func (w *Watches) UnwatchAll(client *Client) {
+	for _, wk := range client.watchedKeys {
+		if clients, ok := w.keys[wk]; ok {
+			delete(clients, client)
+			if len(clients) == 0 {
+				delete(w.keys, wk)
+			}
+		}
+	}
+	client.watchedKeys = nil
+	client.dirtyCAS = false
+}
+
+// Touch key 被修改了, WATCH 这个 key 的客户端的 EXEC 失败
+func (w *Watches) Touch(dbIndex int, key string) {
+	for client := range w.keys[dbKey{dbIndex: dbIndex, key: key}] {
+		client.dirtyCAS = true
+	}
+}
+
+// TouchDb db 被清空或者交换了, WATCH 这个 db 中的 key 的客户端的 EXEC 都失败
+func (w *Watches) TouchDb(dbIndex int) {
+	for wk, clients := range w.keys {
+		if wk.dbIndex != dbIndex {
+			continue
+		}
+		for client := range clients {
+			client.dirtyCAS = true
+		}
+	}
+}
+
+// abortMulti 事务中排队的命令被拒绝, EXEC 时回复 EXECABORT
+func (c *Client) abortMulti() {
+	if c.multi != nil {
+		c.multi.aborted = true
+	}
+}
+
+// execImmediately 事务中立即执行, 不排队的命令
+func execImmediately(cmdName string) bool {
+	switch cmdName {
+	case "exec", "discard", "multi", "watch", "quit", "reset":
+		return true
+	default:
+		return false
+	}
+}
+
+// queueCommand 事务中的命令排队, 回复 QUEUED
+func queueCommand(conn *Client) error {
+	conn.multi.commands = append(conn.multi.commands, conn.GetCmdLine())
+	return MakeQueuedReply().WriteTo(conn)
+}
+
+// execTransaction EXEC, 依次执行排队的命令, 回复每条命令的回复组成的数组. 调用方持有锁
+func (r *RedisServer) execTransaction(ctx context.Context, conn *Client) error {
+	multi := conn.multi
+	if multi == nil {
+		return MakeStandardErrReply("ERR EXEC without MULTI").WriteTo(conn)
+	}
+	conn.multi = nil
+	// WATCH 之后过期的 key 在这里删除, 和其他的修改一样让事务失败. 删除的 DEL 不属于事务, 每个单独传播,
+	// 之后 pending 中只有排队的命令的效果, EXEC 结束之后由 propagatePending 放在一个 MULTI/EXEC 中
+	for _, wk := range conn.watchedKeys {
+		r.dbs[wk.dbIndex].PeekEntity(wk.key)
+		r.propagatePending()
+	}
+	dirty := conn.dirtyCAS
+	r.watches.UnwatchAll(conn)
+	if multi.aborted {
+		return MakeExecAbortErr().WriteTo(conn)
+	}
+	if dirty {
+		return MakeNullMultiBulkReply().WriteTo(conn)
+	}
+	if _, err := conn.Write(MakeMultiBulkHeaderReply(int64(len(multi.commands))).ToBytes()); err != nil {
+		return err
+	}
+	execCmdLine := conn.curCommand
+	conn.inExec = true
+	defer func() {
+		conn.inExec = false
+		conn.curCommand = execCmdLine
+	}()
+	for _, cmdLine := range multi.commands {
+		// 事务中的 SELECT 对之后的命令生效
+		mdb, err := r.SelectDb(conn.GetDbIndex())
+		if err != nil {
+			return err
+		}
+		conn.SetDb(mdb)
+		conn.curCommand = cmdLine
+		cmd := conn.resolveCommand(cmdLine[0])
+		if cmd == nil {
+			return ErrorCommandNotFund
+		}
+		if cmd.IsWriteFor(cmdLine) {
+			if errReply := r.checkWritable(conn); errReply != nil {
+				cmd.stats.reject()
+				if err = errReply.WriteTo(conn); err != nil {
+					return err
+				}
+				continue
+			}
+			mdb.prepareWrite(cmd, cmdLine)
+		}
+		if _, over := r.overMaxMemory(); over && cmd.IsDenyOOM() && !conn.master {
+			cmd.stats.reject()
+			if err = MakeOOMErr().WriteTo(conn); err != nil {
+				return err
+			}
+			continue
+		}
+		conn.replyFailed = false
+		start := time.Now()
+		err = processCommand(ctx, conn, cmd)
+		cmd.stats.record(time.Since(start), conn.replyFailed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execMulti multi
+func execMulti(ctx context.Context, conn *Client) error {
+	if conn.multi != nil {
+		return MakeStandardErrReply("ERR MULTI calls can not be nested").WriteTo(conn)
+	}
+	conn.multi = &multiState{}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execExec exec
+func execExec(ctx context.Context, conn *Client) error {
+	return conn.ExecTransaction(ctx, conn)
+}
+
+// execDiscard discard, 丢弃排队的命令并取消 WATCH
+func execDiscard(ctx context.Context, conn *Client) error {
+	if conn.multi == nil {
+		return MakeStandardErrReply("ERR DISCARD without MULTI").WriteTo(conn)
+	}
+	conn.multi = nil
+	conn.Watches.UnwatchAll(conn)
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execWatch watch key [key ...]
+func execWatch(ctx context.Context, conn *Client) error {
+	if conn.multi != nil {
+		return MakeStandardErrReply("ERR WATCH inside MULTI is not allowed").WriteTo(conn)
+	}
+	db := conn.GetDb()
+	for _, arg := range conn.GetArgs() {
+		key := string(arg)
+		// 已经过期的 key 先删除, 之后 EXEC 时删除不会让事务失败
+		db.PeekEntity(key)
+		conn.Watches.Watch(conn, db.Index, key)
+	}
+	return MakeOkReply().WriteTo(conn)
+}
+
+// execUnwatch unwatch
+func execUnwatch(ctx context.Context, conn *Client) error {
+	conn.Watches.UnwatchAll(conn)
+	return MakeOkReply().WriteTo(conn)
+}
+
+func init() {
+	register("multi", execMulti, withArity(1), withFlags(flagNoScript))
+	register("exec", execExec, withArity(1), withFlags(flagNoScript|flagMayReplicate))
+	register("discard", execDiscard, withArity(1), withFlags(flagNoScript))
+	register("watch", execWatch, withArity(-2), withFlags(flagNoScript), withKeys(1, -1, 1))
+	register("unwatch", execUnwatch, withArity(1), withFlags(flagNoScript))
+}
@@ -0,0 +1,222 @@
+package redis
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiExec(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+
+	assert.Equal(t, "-ERR EXEC without MULTI\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, "-ERR DISCARD without MULTI\r\n", server.exec(t, client, "discard"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "multi"))
+	assert.Equal(t, "-ERR MULTI calls can not be nested\r\n", server.exec(t, client, "multi"))
+	assert.Equal(t, "-ERR WATCH inside MULTI is not allowed\r\n", server.exec(t, client, "watch", "foo"))
+	assert.Contains(t, clientInfoString(client), " flags=x ")
+	assert.Equal(t, "+QUEUED\r\n", server.exec(t, client, "set", "foo", "bar"))
+	assert.Equal(t, "+QUEUED\r\n", server.exec(t, client, "incr", "foo"))
+	assert.Equal(t, "+QUEUED\r\n", server.exec(t, client, "get", "foo"))
+	assert.Equal(t, "*3\r\n+OK\r\n-ERR value is not an integer or out of range\r\n$3\r\nbar\r\n",
+		server.exec(t, client, "exec"))
+	assert.Nil(t, client.multi)
+	// 事务中多条命令的效果放在 MULTI/EXEC 中传播
+	assert.Equal(t, resp([]string{"set", "foo", "bar"}), takeAof(server, file))
+	server.exec(t, client, "multi")
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "set", "baz", "qux")
+	server.exec(t, client, "exec")
+	assert.Equal(t, resp([]string{"MULTI"}, []string{"set", "foo", "bar"}, []string{"set", "baz", "qux"}, []string{"EXEC"}),
+		takeAof(server, file))
+
+	// 排队时被拒绝的命令让 EXEC 失败
+	server.exec(t, client, "multi")
+	server.exec(t, client, "set", "foo", "baz")
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", server.exec(t, client, "get"))
+	assert.Contains(t, server.exec(t, client, "nosuchcmd"), "-ERR unknown command")
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+
+	server.exec(t, client, "multi")
+	server.exec(t, client, "set", "foo", "baz")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "discard"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+
+	// 事务中的 SELECT 对之后的命令生效
+	server.exec(t, client, "multi")
+	server.exec(t, client, "select", "1")
+	server.exec(t, client, "set", "foo", "db1")
+	assert.Equal(t, "*2\r\n+OK\r\n+OK\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, "$3\r\ndb1\r\n", server.exec(t, client, "get", "foo"))
+
+	// 事务中的阻塞命令立即返回
+	server.exec(t, client, "multi")
+	server.exec(t, client, "blpop", "list", "0")
+	assert.Equal(t, "*1\r\n*-1\r\n", server.exec(t, client, "exec"))
+	assert.Nil(t, client.blocked)
+}
+
+func TestWatch(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	other, _ := server.newClient()
+
+	watchExec := func(modify func()) string {
+		server.exec(t, client, "watch", "foo")
+		modify()
+		server.exec(t, client, "multi")
+		server.exec(t, client, "set", "bar", "1")
+		return server.exec(t, client, "exec")
+	}
+
+	assert.Equal(t, "*1\r\n+OK\r\n", watchExec(func() {}))
+	// 删除不存在的 key 不是修改
+	assert.Equal(t, "*1\r\n+OK\r\n", watchExec(func() { server.exec(t, other, "del", "foo") }))
+	assert.Equal(t, "*-1\r\n", watchExec(func() { server.exec(t, other, "set", "foo", "v") }))
+	assert.Equal(t, "*-1\r\n", watchExec(func() { server.exec(t, other, "getdel", "foo") }))
+	server.exec(t, other, "set", "foo", "v")
+	assert.Equal(t, "*-1\r\n", watchExec(func() { server.exec(t, other, "del", "foo") }))
+	assert.Equal(t, "*-1\r\n", watchExec(func() { server.exec(t, other, "flushdb") }))
+	// 其他 db 中的同名 key 和清空其他 db 都不影响
+	server.exec(t, other, "select", "1")
+	assert.Equal(t, "*1\r\n+OK\r\n", watchExec(func() { server.exec(t, other, "set", "foo", "v") }))
+	assert.Equal(t, "*1\r\n+OK\r\n", watchExec(func() { server.exec(t, other, "flushdb") }))
+
+	// WATCH 之后过期
+	server.exec(t, other, "select", "0")
+	server.exec(t, other, "set", "foo", "v", "px", "10")
+	assert.Equal(t, "*-1\r\n", watchExec(func() {
+		clk.Advance(20 * time.Millisecond)
+		server.exec(t, client, "set", "foo", "x")
+		server.exec(t, client, "pexpire", "foo", "10")
+		clk.Advance(20 * time.Millisecond)
+	}))
+
+	// 自己修改也会让事务失败, UNWATCH 和 DISCARD 取消
+	server.exec(t, client, "watch", "foo")
+	server.exec(t, client, "set", "foo", "v")
+	assert.Contains(t, clientInfoString(client), " flags=d ")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "unwatch"))
+	server.exec(t, client, "multi")
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "exec"))
+	server.exec(t, client, "watch", "foo")
+	server.exec(t, client, "multi")
+	server.exec(t, client, "discard")
+	server.exec(t, other, "set", "foo", "v")
+	server.exec(t, client, "multi")
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "exec"))
+
+	// 断开连接之后不再记录
+	server.exec(t, client, "watch", "foo")
+	server.freeClient(client)
+	assert.Empty(t, server.watches.keys)
+}
+
+// TestModifiedKeyOrder 一次 LPUSH 唤醒 BLPOP 时, 各个观察者看到的顺序
+func TestModifiedKeyOrder(t *testing.T) {
+	server, file := newAofTestServer(t, FsyncNo)
+	defer setKeyspaceEvents("")
+	client, _ := server.newClient()
+	waiter, waiterConn := server.newClient()
+	watcher, _ := server.newClient()
+	observer, observerConn := server.newClient()
+
+	server.exec(t, client, "config", "set", "notify-keyspace-events", "KEA")
+	server.exec(t, observer, "hello", "3")
+	server.exec(t, observer, "client", "tracking", "on")
+	server.exec(t, observer, "get", "q")
+	server.exec(t, observer, "subscribe", "__keyspace@0__:q")
+	assert.Equal(t, "", server.exec(t, waiter, "blpop", "q", "0"))
+	server.exec(t, watcher, "watch", "q")
+	takeAof(server, file)
+
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "lpush", "q", "v"))
+	assert.Equal(t, "*2\r\n$1\r\nq\r\n$1\r\nv\r\n", waiterConn.take())
+	// 缓存只失效一次, 之后每个生效的操作一个事件
+	event := func(name string) string {
+		return ">3\r\n$7\r\nmessage\r\n$16\r\n__keyspace@0__:q\r\n$" + string(rune('0'+len(name))) + "\r\n" + name + "\r\n"
+	}
+	assert.Equal(t, invalidatePush("q")+event("lpush")+event("lpop")+event("del"), observerConn.take())
+	assert.Equal(t, resp([]string{"lpush", "q", "v"}, []string{"lpop", "q"}), takeAof(server, file))
+	server.exec(t, watcher, "multi")
+	assert.Equal(t, "*-1\r\n", server.exec(t, watcher, "exec"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "q"))
+
+	// 事务中写入又删除, 命令执行完时 key 已经不存在, 不唤醒
+	assert.Equal(t, "", server.exec(t, waiter, "blpop", "q", "0"))
+	server.exec(t, client, "multi")
+	server.exec(t, client, "lpush", "q", "v")
+	server.exec(t, client, "del", "q")
+	assert.Equal(t, "*2\r\n:1\r\n:1\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, "", waiterConn.take())
+	assert.NotNil(t, waiter.blocked)
+	assert.Equal(t, event("lpush")+event("del"), observerConn.take())
+}
+
+// TestExecPropagation EXEC 的效果在 aof 中只包一层 MULTI/EXEC, 没有效果时不写入
+func TestExecPropagation(t *testing.T) {
+	clk := useManualClock(t)
+	server, file := newAofTestServer(t, FsyncNo)
+	client, _ := server.newClient()
+	other, _ := server.newClient()
+	server.exec(t, client, "sadd", "s", "a", "b")
+	server.exec(t, client, "set", "str", "v")
+	takeAof(server, file)
+
+	// SPOP 转换为 SREM, 带过期时间的 SET 产生两条效果, 只读和失败的命令没有效果
+	server.exec(t, client, "multi")
+	server.exec(t, client, "spop", "s")
+	server.exec(t, client, "get", "str")
+	server.exec(t, client, "sadd", "str", "x")
+	server.exec(t, client, "set", "k", "v", "px", "100")
+	reply := server.exec(t, client, "exec")
+	assert.Contains(t, reply, "-WRONGTYPE")
+	popped := "b"
+	if server.exec(t, client, "smembers", "s") == "*1\r\n$1\r\nb\r\n" {
+		popped = "a"
+	}
+	expireAt := strconv.FormatInt(clk.Now().Add(100*time.Millisecond).UnixMilli(), 10)
+	assert.Equal(t, resp(
+		[]string{"MULTI"},
+		[]string{"srem", "s", popped},
+		[]string{"set", "k", "v"},
+		[]string{"pexpireat", "k", expireAt},
+		[]string{"EXEC"},
+	), takeAof(server, file))
+
+	// 只读的事务
+	server.exec(t, client, "multi")
+	server.exec(t, client, "get", "str")
+	server.exec(t, client, "smembers", "s")
+	assert.Equal(t, "*2\r\n", server.exec(t, client, "exec")[:4])
+	assert.Equal(t, "", takeAof(server, file))
+
+	// WATCH 失败的 EXEC 不传播排队的命令
+	server.exec(t, client, "watch", "str")
+	server.exec(t, other, "set", "str", "changed")
+	assert.Equal(t, resp([]string{"set", "str", "changed"}), takeAof(server, file))
+	server.exec(t, client, "multi")
+	server.exec(t, client, "set", "a", "1")
+	server.exec(t, client, "set", "b", "2")
+	assert.Equal(t, "*-1\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, "", takeAof(server, file))
+
+	// WATCH 的 key 过期时删除的 DEL 每个单独传播, 不属于事务. key 在 db1 中, 执行 EXEC 的 db0 的定期删除不会先删除它们
+	server.exec(t, other, "select", "1")
+	server.exec(t, other, "set", "e1", "v", "px", "10")
+	server.exec(t, other, "set", "e2", "v", "px", "10")
+	server.exec(t, client, "select", "1")
+	server.exec(t, client, "watch", "e1", "e2")
+	server.exec(t, client, "select", "0")
+	takeAof(server, file)
+	clk.Advance(20 * time.Millisecond)
+	server.exec(t, client, "multi")
+	server.exec(t, client, "set", "a", "1")
+	assert.Equal(t, "*-1\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, resp([]string{"del", "e1"}, []string{"del", "e2"}), takeAof(server, file))
+}
@@ -3,73 +3,137 @@ package redis
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/panjf2000/gnet/v2"
 	"github.com/xuning888/godis-tiny/config"
 	"io"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 func (r *RedisServer) OnBoot(eng gnet.Engine) (action gnet.Action) {
+	// 测试和关闭时在其他 goroutine 中读取
+	lock.Lock()
 	r.engine = eng
-	r.Init()
-	r.lg.Infof("The server is now ready to accept connections on port %v", config.Properties.Port)
+	lock.Unlock()
+	if err := chmodUnixSocket(); err != nil {
+		r.lg.Errorf("Failed setting permissions of Unix socket: %v", err)
+		r.notifyBooted(err)
+		return gnet.Shutdown
+	}
+	// OnBoot 返回之后才开始接受连接, 在后台加载数据, 加载完成之前客户端的命令回复 -LOADING
+	r.loading.Store(true)
+	// 加载完成之后嵌入的程序或者测试可能已经替换了 config.Properties, 日志中的地址先读出来
+	port, unixSocket := config.Properties.Port, config.Properties.UnixSocket
+	go func() {
+		if err := r.Init(); err != nil {
+			r.notifyBooted(err)
+			// 加载期间收到 SHUTDOWN 时由关闭的过程停止网络服务
+			if !errors.Is(err, ErrorsShutdown) {
+				_ = eng.Stop(context.Background())
+			}
+			return
+		}
+		r.lg.Infof("The server is now ready to accept connections on port %v", port)
+		if unixSocket != "" {
+			r.lg.Infof("The server is now ready to accept connections at %s", unixSocket)
+		}
+		r.notifyBooted(nil)
+	}()
 	return
 }
 
 func (r *RedisServer) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	if r.status == statusShutdown {
+	if atomic.LoadUint32(&r.status) >= statusShutdown {
 		return MakeStandardErrReply("ERR Server is shutting down").ToBytes(), gnet.Close
 	}
-	connectedClients := ConnCounter.CountConnections()
+	// 使用 PROXY protocol 时收到头部之后再按照客户端的地址检查
+	proxied := expectProxyHeader(c)
+	if !proxied && protectedModeDenied(c, c.RemoteAddr()) {
+		r.lg.Infof("Denied connection from %v because of protected mode", c.RemoteAddr())
+		return protectedModeReply.ToBytes(), gnet.Close
+	}
+	// 如果连接数达到了最大值, 回复错误之后关闭连接, 客户端可以收到原因而不是 RST
 	maxClients := config.Properties.MaxClients
-
-	// 如果连接数达到了最大值, 就拒绝连接
-	if connectedClients >= maxClients {
-		r.lg.Infof("max number of clients reached. clients_connected: %v, maxclinets: %v",
-			connectedClients, maxClients)
+	client := NewClient(c.Fd(), c, false)
+	client.proxyPending = proxied
+	if !isUnixConn(c) {
+		client.localAddr = acceptedLocalAddr(c.Fd())
+	}
+	if !r.connManager.TryRegisterConn(c.Fd(), client, maxClients) {
+		r.lg.Infof("max number of clients reached. maxclients: %v", maxClients)
 		return MakeStandardErrReply("ERR max number of clients reached").ToBytes(), gnet.Close
 	}
-	r.lg.Debugf("accept conn: %v", c.RemoteAddr())
-	r.connManager.RegisterConn(c.Fd(), NewClient(c.Fd(), c, false))
+	r.lg.With("addr", fmt.Sprint(c.RemoteAddr())).Debugf("Accepted connection")
+	r.setKeepAlive(c)
 	return nil, gnet.None
 }
 
 func (r *RedisServer) OnClose(c gnet.Conn, err error) (action gnet.Action) {
-	remoteAddr := c.RemoteAddr()
-	if err != nil {
-		if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
-			r.lg.Debugf("conn: %v, closed", remoteAddr)
-		} else {
-			r.lg.Errorf("conn: %v closed, error: %v", remoteAddr, err)
-		}
+	lg := r.lg.With("addr", fmt.Sprint(c.RemoteAddr()))
+	if err != nil && !errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		lg.Errorf("Client closed connection with error: %v", err)
 	} else {
-		r.lg.Debugf("conn: %v, closed", remoteAddr)
+		lg.Debugf("Client closed connection")
+	}
+	if client := r.connManager.Get(c.Fd()); client != nil && client.executing {
+		// 执行命令时写入失败, gnet 在当前 goroutine 中关闭连接, 已经持有锁
+		r.unlinkClient(client)
+	} else if client != nil {
+		r.freeClient(client)
 	}
 	r.connManager.RemoveConnByKey(c.Fd())
 	return
 }
 
 func (r *RedisServer) OnTick() (delay time.Duration, action gnet.Action) {
-	r.cron()
-	return time.Second * time.Duration(1), gnet.None
+	// cron 每秒执行一次, 阻塞命令的超时按照最近的截止时间提前触发, 有 DELPATTERN 在执行时每 delPatternInterval 执行一步
+	if now := time.Now(); now.Sub(r.lastCron) >= time.Second {
+		r.lastCron = now
+		r.cron()
+		r.clientsCron()
+	}
+	delay = r.blockedCron(time.Second - time.Since(r.lastCron))
+	if r.delPatternCron() && delay > delPatternInterval {
+		delay = delPatternInterval
+	}
+	return delay, gnet.None
+}
+
+// protocolError 协议错误之后无法再同步命令的边界, 回复错误之后关闭连接
+func (r *RedisServer) protocolError(conn *Client, err error) gnet.Action {
+	r.lg.Infof("Protocol error (%v) from client: %s", err, conn.RemoteAddr())
+	if err2 := MakeStandardErrReply(err.Error()).WriteTo(conn); err2 != nil {
+		r.lg.Errorf("write to peer falied with error: %v", err2)
+	}
+	return gnet.Close
 }
 
 func (r *RedisServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
 	conn := r.connManager.Get(c.Fd())
+	// 解码时从连接中取出的字节数计入 total_net_input_bytes, 还不完整的参数留在连接中, 之后取出时再计入, 每个字节只计一次
+	inbound := c.InboundBuffered()
+	defer func() {
+		r.stats.netInputBytes.Add(int64(inbound - c.InboundBuffered()))
+	}()
+	if conn.proxyPending {
+		if action, next := r.acceptProxyHeader(conn); !next {
+			return action
+		}
+	}
 	err := conn.Decode()
 	if err != nil && !conn.HasRemaining() {
 		if errors.Is(err, ErrIncompletePacket) {
 			return gnet.None
 		}
-		r.lg.Errorf("decode falied with error: %v", err)
-		_, err := conn.Write(MakeStandardErrReply(err.Error()).ToBytes())
-		if err != nil {
-			r.lg.Errorf("write to peer falied with error: %v", err)
-		}
-		return gnet.Close
+		return r.protocolError(conn, err)
 	} else if err != nil && conn.HasRemaining() {
-		err2 := r.process(context.Background(), conn)
+		err2 := r.process(r.rootContext(), conn)
+		// 协议错误之前的命令全部执行完再关闭连接
+		for err2 == nil && !errors.Is(err, ErrIncompletePacket) && conn.HasRemaining() && !conn.paused && conn.blocked == nil {
+			err2 = r.process(r.rootContext(), conn)
+		}
 		if err2 != nil {
 			if errors.Is(err2, ErrorsShutdown) {
 				_ = MakeStandardErrReply("ERR Server is shutting down").WriteTo(conn)
@@ -78,17 +142,15 @@ func (r *RedisServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
 			r.lg.Errorf("process command failed: %v", err)
 			return gnet.Close
 		}
+		if conn.closeAfterReply {
+			return gnet.Close
+		}
 		if errors.Is(err, ErrIncompletePacket) {
 			return gnet.None
 		}
-		r.lg.Errorf("decode falied with error: %v", err)
-		_, err = conn.Write(MakeStandardErrReply(err.Error()).ToBytes())
-		if err != nil {
-			r.lg.Errorf("write to peer falied with error: %v", err)
-		}
-		return gnet.Close
+		return r.protocolError(conn, err)
 	}
-	err2 := r.process(context.Background(), conn)
+	err2 := r.process(r.rootContext(), conn)
 	if err2 != nil {
 		if errors.Is(err2, ErrorsShutdown) {
 			_ = MakeStandardErrReply("ERR Server is shutting down").WriteTo(conn)
@@ -97,5 +159,8 @@ func (r *RedisServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
 		r.lg.Errorf("process command failed: %v", err)
 		return gnet.Close
 	}
+	if conn.closeAfterReply {
+		return gnet.Close
+	}
 	return
 }
@@ -0,0 +1,274 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMaxClients(t *testing.T) {
+	maxClients := config.Properties.MaxClients
+	t.Cleanup(func() {
+		config.Properties.MaxClients = maxClients
+	})
+	config.Properties.MaxClients = 10
+	server := newTestServer()
+	port := serve(t, server)
+	// 等待 serve 探测端口的连接关闭
+	assert.Eventually(t, func() bool {
+		return server.connManager.CountConnections() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	replies := make([]string, 0)
+	for i := 0; i < config.Properties.MaxClients+5; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		reader := bufio.NewReader(conn)
+		_, _ = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		replies = append(replies, line)
+	}
+	rejected := 0
+	for _, reply := range replies {
+		if reply == "-ERR max number of clients reached\r\n" {
+			rejected++
+		} else {
+			assert.Equal(t, "+PONG\r\n", reply)
+		}
+	}
+	// 超出的连接先收到错误再被关闭
+	assert.Equal(t, 5, rejected)
+	assert.Equal(t, int64(5), server.connManager.RejectedConnections())
+	assert.Equal(t, 10, server.connManager.CountConnections())
+
+	client, _ := server.newClient()
+	info := server.exec(t, client, "info", "clients")
+	assert.Contains(t, info, "connected_clients:11\r\n")
+	assert.Contains(t, info, "maxclients:10\r\n")
+	assert.Contains(t, info, "rejected_connections:5\r\n")
+}
+
+// dialIdle 建立 n 个不发送命令的连接, 等到服务端都注册之后返回
+func dialIdle(tb testing.TB, server *testServer, port, n int) {
+	base := server.connManager.CountConnections()
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() {
+			_ = conn.Close()
+		})
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for server.connManager.CountConnections() < base+n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 连接由 gnet 的 event loop 处理, 空闲的连接不占用 goroutine
+func TestIdleConnectionsWithoutGoroutines(t *testing.T) {
+	server := newTestServer()
+	port := serve(t, server)
+	assert.Eventually(t, func() bool {
+		return server.connManager.CountConnections() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	before := runtime.NumGoroutine()
+	dialIdle(t, server, port, 500)
+	assert.Equal(t, 500, server.connManager.CountConnections())
+	assert.Less(t, runtime.NumGoroutine()-before, 10)
+}
+
+// 阻塞的客户端和空闲的连接一样不占用 goroutine, 唤醒时在 event loop 中回复
+func TestBlockedClientsWithoutGoroutines(t *testing.T) {
+	const blocked = 500
+	server := newTestServer()
+	port := serve(t, server)
+	assert.Eventually(t, func() bool {
+		return server.connManager.CountConnections() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	before := runtime.NumGoroutine()
+	readers := make([]*bufio.Reader, 0, blocked)
+	for i := 0; i < blocked; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		_, _ = conn.Write([]byte(resp([]string{"blpop", "queue", "0"})))
+		readers = append(readers, bufio.NewReader(conn))
+	}
+	waiting := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		if queue := server.blocking.keys[dbKey{key: "queue"}]; queue != nil {
+			return queue.Len()
+		}
+		return 0
+	}
+	assert.Eventually(t, func() bool {
+		return waiting() == blocked
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Less(t, runtime.NumGoroutine()-before, 10)
+
+	// 通过网络推入元素: newClient 的 fd 可能和这些真实的连接相同
+	pusher, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pusher.Close()
+	_ = pusher.SetDeadline(time.Now().Add(10 * time.Second))
+	pusherReader := bufio.NewReader(pusher)
+	for i := 0; i < blocked; i++ {
+		_, _ = pusher.Write([]byte(resp([]string{"rpush", "queue", fmt.Sprint(i)})))
+		if _, err = pusherReader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 按照阻塞的先后顺序唤醒, 先连接的客户端不一定先阻塞, 只检查每个客户端都收到了一个元素
+	values := make(map[string]bool, blocked)
+	for _, reader := range readers {
+		lines := make([]string, 5)
+		for j := range lines {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[j] = line
+		}
+		assert.Equal(t, []string{"*2\r\n", "$5\r\n", "queue\r\n"}, lines[:3])
+		values[lines[4]] = true
+	}
+	assert.Len(t, values, blocked)
+	assert.Equal(t, 0, waiting())
+}
+
+// idleClientsEnv 子进程中建立空闲的连接, 值是服务端的地址和连接的个数
+const idleClientsEnv = "GODIS_IDLE_CLIENTS"
+
+// TestIdleClientsHelper 不是测试: dialIdleProcess 在子进程中运行它建立空闲的连接, 直到 stdin 被关闭
+func TestIdleClientsHelper(t *testing.T) {
+	value := os.Getenv(idleClientsEnv)
+	if value == "" {
+		t.Skip("helper process of dialIdleProcess")
+	}
+	var addr string
+	var n int
+	if _, err := fmt.Sscanf(value, "%s %d", &addr, &n); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	fmt.Println("ready")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+}
+
+// dialIdleProcess 同 dialIdle, 连接的客户端一端在子进程中: 同一个进程打开两端时, 10k 个连接需要的文件描述符超过了常见的 ulimit
+func dialIdleProcess(b *testing.B, server *testServer, port, n int) {
+	base := server.connManager.CountConnections()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestIdleClientsHelper$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=127.0.0.1:%d %d", idleClientsEnv, port, n))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	})
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() && scanner.Text() != "ready" {
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, stdout)
+	}()
+	deadline := time.Now().Add(30 * time.Second)
+	for server.connManager.CountConnections() < base+n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := server.connManager.CountConnections(); count < base+n {
+		b.Fatalf("%d of %d idle connections registered", count-base, n)
+	}
+}
+
+// BenchmarkIdleConnections 10k 个空闲的连接和 1k 个执行 PING 的连接, 报告服务端每个空闲连接的内存和 PING 的 p99.
+// 空闲的连接由子进程建立, 内存只包括服务端
+func BenchmarkIdleConnections(b *testing.B) {
+	const idle, active = 10000, 1000
+	maxClients := config.Properties.MaxClients
+	b.Cleanup(func() {
+		config.Properties.MaxClients = maxClients
+	})
+	config.Properties.MaxClients = idle + active + 1
+	server := newTestServer()
+	port := serve(b, server)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	dialIdleProcess(b, server, port, idle)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	inuse := int64(after.HeapInuse+after.StackInuse) - int64(before.HeapInuse+before.StackInuse)
+
+	conns := make([]*bufio.ReadWriter, 0, active)
+	for i := 0; i < active; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() {
+			_ = conn.Close()
+		})
+		conns = append(conns, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)))
+	}
+	ping := MakeMultiBulkReply([][]byte{[]byte("ping")}).ToBytes()
+	latencies := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := conns[i%active]
+		start := time.Now()
+		_, _ = rw.Write(ping)
+		_ = rw.Flush()
+		if _, err := rw.ReadString('\n'); err != nil {
+			b.Fatal(err)
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	b.StopTimer()
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	b.ReportMetric(float64(inuse)/idle, "bytes/idle-conn")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-us")
+}
@@ -0,0 +1,103 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/config"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// protectedModeReply 与 redis 一致, 保护模式下拒绝非本机的连接时回复这个错误
+var protectedModeReply = MakeStandardErrReply("DENIED Redis is running in protected mode because protected " +
+	"mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. " +
+	"If you want to connect from external computers to Redis you " +
+	"may adopt one of the following solutions: " +
+	"1) Just disable protected mode sending the command " +
+	"'CONFIG SET protected-mode no' from the loopback interface " +
+	"by connecting to Redis from the same host the server is " +
+	"running, however MAKE SURE Redis is not publicly accessible " +
+	"from internet if you do so. Use CONFIG REWRITE to make this " +
+	"change permanent. " +
+	"2) Alternatively you can just disable the protected mode by " +
+	"editing the Redis configuration file, and setting the protected " +
+	"mode option to 'no', and then restarting the server. " +
+	"3) If you started the server manually just for testing, restart " +
+	"it with the '--protected-mode no' option. " +
+	"4) Set up an authentication password for the default user. " +
+	"NOTE: You only need to do one of the above things in order for " +
+	"the server to start accepting connections from the outside.")
+
+// listenAddrs 监听的地址, bind 中的每个地址一个 tcp listener, 配置了 unixsocket 时同时监听 unix socket,
+// 所有的连接由同一个 event handler 处理. port 为0时不监听 tcp
+func listenAddrs() ([]string, error) {
+	addrs := make([]string, 0)
+	if port := config.Properties.Port; port != 0 {
+		for _, host := range bindHosts() {
+			addrs = append(addrs, "tcp://"+net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	if path := config.Properties.UnixSocket; path != "" {
+		// gnet 解析地址时会转换成小写, 含有大写字母的路径会监听在另一个文件上
+		if strings.ToLower(path) != path {
+			return nil, fmt.Errorf("unixsocket %s must be lower case", path)
+		}
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, "unix://"+path)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("Configured to not listen anywhere, exiting.")
+	}
+	return addrs, nil
+}
+
+// bindHosts bind 配置的地址, 没有配置时监听所有的 IPv4 地址. 与 redis 一样, * 表示所有的 IPv4 地址, ::* 表示所有的 IPv6 地址,
+// 以 - 开头的地址不可用时跳过
+func bindHosts() []string {
+	fields := strings.Fields(config.Properties.Bind)
+	if len(fields) == 0 {
+		return []string{"0.0.0.0"}
+	}
+	hosts := make([]string, 0, len(fields))
+	for _, host := range fields {
+		optional := strings.HasPrefix(host, "-")
+		host = strings.TrimPrefix(host, "-")
+		switch host {
+		case "*":
+			host = "0.0.0.0"
+		case "::*":
+			host = "::"
+		}
+		if optional && !bindable(host) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// bindable 地址在这台机器上是否可以监听, 比如没有开启 IPv6 时不能监听 ::1
+func bindable(host string) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return false
+	}
+	_ = listener.Close()
+	return true
+}
+
+// protectedModeDenied 打开保护模式, 没有配置 bind 和密码时只接受本机和 unix socket 的连接.
+// remote 是客户端的地址, 使用 PROXY protocol 时是头部中的地址
+func protectedModeDenied(c gnet.Conn, remote net.Addr) bool {
+	if !config.Properties.ProtectedMode || strings.TrimSpace(config.Properties.Bind) != "" ||
+		config.Properties.RequirePass != "" || isUnixConn(c) {
+		return false
+	}
+	addr, ok := remote.(*net.TCPAddr)
+	return ok && !addr.IP.IsLoopback()
+}
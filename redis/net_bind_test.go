@@ -0,0 +1,138 @@
+package redis
+
+import (
+	"github.com/panjf2000/gnet/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useListenConfig 测试结束之后恢复监听和认证相关的配置
+func useListenConfig(t *testing.T) {
+	saved := *config.Properties
+	t.Cleanup(func() {
+		config.Properties.Bind, config.Properties.Port = saved.Bind, saved.Port
+		config.Properties.UnixSocket = saved.UnixSocket
+		config.Properties.ProtectedMode, config.Properties.RequirePass = saved.ProtectedMode, saved.RequirePass
+		config.Properties.TcpKeepAlive = saved.TcpKeepAlive
+		config.Properties.EnableProxyProtocol = saved.EnableProxyProtocol
+	})
+	config.Properties.UnixSocket = ""
+	// fakeConn 不支持 keepalive
+	config.Properties.TcpKeepAlive = 0
+}
+
+func TestListenAddrs(t *testing.T) {
+	useListenConfig(t)
+	config.Properties.Port = 6390
+	cases := []struct {
+		bind     string
+		expected []string
+	}{
+		{"", []string{"tcp://0.0.0.0:6390"}},
+		{"*", []string{"tcp://0.0.0.0:6390"}},
+		{"127.0.0.1  127.0.0.2", []string{"tcp://127.0.0.1:6390", "tcp://127.0.0.2:6390"}},
+		// 以 - 开头的地址不能监听时跳过
+		{"127.0.0.1 -192.0.2.1", []string{"tcp://127.0.0.1:6390"}},
+	}
+	for _, c := range cases {
+		config.Properties.Bind = c.bind
+		addrs, err := listenAddrs()
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, addrs, c.bind)
+	}
+	config.Properties.Bind = "::*"
+	addrs, _ := listenAddrs()
+	assert.Equal(t, []string{"tcp://[::]:6390"}, addrs)
+
+	config.Properties.Port = 0
+	_, err := listenAddrs()
+	assert.EqualError(t, err, "Configured to not listen anywhere, exiting.")
+}
+
+func TestMultipleBind(t *testing.T) {
+	useListenConfig(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Properties.Port = listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	config.Properties.Bind = "127.0.0.1 127.0.0.2"
+	addrs, err := listenAddrs()
+	assert.Nil(t, err)
+
+	server := newTestServer()
+	serveAddrs(t, server, addrs)
+	for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(config.Properties.Port)))
+		if assert.Nil(t, err) {
+			_ = conn.Close()
+		}
+	}
+}
+
+func TestProtectedMode(t *testing.T) {
+	useListenConfig(t)
+	config.Properties.Bind, config.Properties.ProtectedMode, config.Properties.RequirePass = "", true, ""
+	server := newTestServer()
+	open := func(ip string) (*fakeConn, string, gnet.Action) {
+		server.nextFd++
+		conn := &fakeConn{fd: server.nextFd, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}}
+		out, action := server.OnOpen(conn)
+		return conn, string(out), action
+	}
+
+	conn, out, action := open("10.0.0.5")
+	assert.True(t, strings.HasPrefix(out, "-DENIED Redis is running in protected mode"), out)
+	assert.True(t, strings.HasSuffix(out, "the server to start accepting connections from the outside.\r\n"))
+	assert.Equal(t, gnet.Close, action)
+	assert.Nil(t, server.connManager.Get(conn.fd))
+
+	// 本机的连接不受影响
+	_, out, action = open("127.0.0.1")
+	assert.Equal(t, "", out)
+	assert.Equal(t, gnet.None, action)
+
+	// 配置了 bind 或者关闭保护模式之后接受所有的连接
+	config.Properties.Bind = "0.0.0.0"
+	_, _, action = open("10.0.0.5")
+	assert.Equal(t, gnet.None, action)
+	config.Properties.Bind = ""
+	local := server.connManager.Get(server.nextFd - 1)
+	assert.Equal(t, "+OK\r\n", server.exec(t, local, "config", "set", "protected-mode", "no"))
+	_, _, action = open("10.0.0.5")
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, "+OK\r\n", server.exec(t, local, "config", "set", "protected-mode", "yes"))
+
+	// 设置密码之后远程的连接需要认证
+	assert.Equal(t, "+OK\r\n", server.exec(t, local, "config", "set", "requirepass", "secret"))
+	conn, out, action = open("10.0.0.5")
+	assert.Equal(t, "", out)
+	assert.Equal(t, gnet.None, action)
+	client := server.connManager.Get(conn.fd)
+	assert.Equal(t, "-NOAUTH Authentication required.\r\n", server.exec(t, client, "get", "key"))
+	assert.True(t, strings.HasPrefix(server.exec(t, client, "hello", "3"), "-NOAUTH HELLO must be called"))
+	assert.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+		server.exec(t, client, "auth", "wrong"))
+	assert.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+		server.exec(t, client, "auth", "admin", "secret"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "auth", "secret"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "key", "value"))
+	assert.Equal(t, "$5\r\nvalue\r\n", server.exec(t, client, "get", "key"))
+
+	conn, _, _ = open("10.0.0.6")
+	client = server.connManager.Get(conn.fd)
+	assert.True(t, strings.HasPrefix(server.exec(t, client, "hello", "3", "auth", "default", "secret"), "%7\r\n"))
+	assert.Equal(t, "$5\r\nvalue\r\n", server.exec(t, client, "get", "key"))
+
+	// 设置密码之前连接的客户端不需要认证
+	assert.Equal(t, "$5\r\nvalue\r\n", server.exec(t, local, "get", "key"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, local, "config", "set", "requirepass", ""))
+	assert.Equal(t, "-ERR AUTH <password> called without any password configured for the default user. "+
+		"Are you sure your configuration is correct?\r\n", server.exec(t, local, "auth", "secret"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, local, "auth", "default", "anything"))
+}
@@ -0,0 +1,49 @@
+package redis
+
+// 暂停写命令, 与 redis 的 CLIENT PAUSE WRITE 一样: 普通客户端的写命令和可能写入的命令(比如脚本)先不执行,
+// 留在客户端的命令队列中, 这个客户端之后的命令也一起等待. 只读命令、主节点的复制流和从节点的 REPLCONF 不受影响.
+// FAILOVER 期间使用它保证主节点的偏移量不再增长
+
+// pauseWrites 暂停写命令, 调用方持有锁
+func (r *RedisServer) pauseWrites() {
+	r.writesPaused = true
+}
+
+// unpauseWrites 恢复写命令, 唤醒被暂停的客户端继续执行队列中的命令. 调用方持有锁
+func (r *RedisServer) unpauseWrites() {
+	r.writesPaused = false
+	paused := r.pausedClients
+	r.pausedClients = nil
+	for _, conn := range paused {
+		conn.paused = false
+		if conn.conn != nil {
+			// 在客户端所在的 event loop 中触发 OnTraffic, 执行队列中剩下的命令
+			_ = conn.conn.Wake(nil)
+		}
+	}
+}
+
+// pauseIfNeeded 暂停期间客户端的下一条命令需要等待时暂停这个客户端, 返回客户端是否被暂停. 调用方持有锁
+func (r *RedisServer) pauseIfNeeded(conn *Client) bool {
+	if conn.paused {
+		return true
+	}
+	if !r.writesPaused || conn.master || conn.inner || conn.repl != nil || r.loading.Load() {
+		return false
+	}
+	cmdLine := conn.queryBuffer.Front().Value.([][]byte)
+	if len(cmdLine) == 0 {
+		return false
+	}
+	cmd := conn.resolveCommand(cmdLine[0])
+	if cmd == nil || (!cmd.IsWriteFor(cmdLine) && !cmd.MayReplicate()) {
+		return false
+	}
+	// 事务中的命令只是排队, EXEC 时才需要等待
+	if conn.multi != nil && !execImmediately(cmd.name) {
+		return false
+	}
+	conn.paused = true
+	r.pausedClients = append(r.pausedClients, conn)
+	return true
+}
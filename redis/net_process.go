@@ -3,9 +3,12 @@ package redis
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/xuning888/godis-tiny/config"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
 	"github.com/xuning888/godis-tiny/pkg/util"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,38 +16,143 @@ import (
 var (
 	lock           = sync.Mutex{}
 	processWait    = sync.WaitGroup{}
-	systemClient   = NewClient(0, nil, true)
 	ttlOpsCmdLine  = util.ToCmdLine("ttlops")
 	ErrorsShutdown = errors.New("shutdown")
 )
 
-func (r *RedisServer) Init() {
+// Init 加载 aof 或者 rdb. OnBoot 在后台调用, 网络服务已经开始监听, 加载完成(包括失败)之后在锁内清除 loading
+func (r *RedisServer) Init() error {
+	r.loading.Store(true)
+	defer r.finishLoading()
+	// 加载时按照配置的淘汰策略初始化对象的访问信息
+	r.syncObjectClock()
+	if !config.Properties.AppendOnly {
+		if err := r.loadRdb(); err != nil {
+			r.lg.Errorf("load rdb file failed: %v", err)
+			return err
+		}
+		return nil
+	}
 	begin := time.Now()
-	r.loadAof()
+	if err := r.loadAof(); err != nil {
+		r.lg.Errorf("load append only file failed: %v", err)
+		return err
+	}
 	r.lg.Infof("DB loaded from append only file: %.3f seconds", time.Now().Sub(begin).Seconds())
+	return nil
 }
 
-func (r *RedisServer) loadAof() {
+func (r *RedisServer) loadAof() error {
 	processWait.Add(1)
 	defer processWait.Done()
-	if config.Properties.AppendOnly {
-		r.aof.LoadAof(0)
+	if !config.Properties.AppendOnly {
+		return nil
+	}
+	r.loading.Store(true)
+	defer r.finishLoading()
+	if err := r.aof.LoadAof(); err != nil {
+		return err
 	}
+	lock.Lock()
+	defer lock.Unlock()
+	// 加载的数据已经在磁盘上了
+	r.dirty.Store(0)
+	// 加载期间不清理过期的key, 加载完成之后统一清理, 这样结果不依赖加载的快慢
+	for _, mdb := range r.dbs {
+		mdb.RemoveAllExpired()
+	}
+	return nil
 }
 
 func (r *RedisServer) cron() {
-	systemClient.PushCmd(ttlOpsCmdLine)
-	if err := r.process(context.Background(), systemClient); err != nil {
+	// 加载完成之前不清理过期的key, 也不开始重写和复制
+	if r.loading.Load() {
+		return
+	}
+	// 每个 server 使用自己的客户端, 同一个进程中的多个 server 的定时任务互不影响
+	if r.systemClient == nil {
+		r.systemClient = NewClient(0, nil, true)
+	}
+	r.systemClient.PushCmd(ttlOpsCmdLine)
+	if err := r.process(context.Background(), r.systemClient); err != nil {
 		return
 	}
 	// 触发aof重写
-	//r.doAofRewrite()
+	r.doAofRewrite()
+	if r.repl != nil {
+		r.repl.cron()
+		r.repl.updateFailover()
+	}
 }
 
-func (r *RedisServer) process(ctx context.Context, conn *Client) error {
-	lock.Lock()
+// ReloadAof DEBUG LOADAOF, 把缓冲区写入文件之后清空数据, 重新加载 aof. 调用方持有锁
+func (r *RedisServer) ReloadAof() error {
+	if err := r.checkPersistenceBusy(); err != nil {
+		return err
+	}
+	if !config.Properties.AppendOnly || r.aof == nil {
+		return nil
+	}
+	r.aof.flush()
+	if err := r.aof.WriteError(); err != nil {
+		return fmt.Errorf("Error writing the AOF buffer: %v", err)
+	}
+	current := r.currentClient
+	defer func() {
+		r.currentClient = current
+	}()
+	r.flushAll(false)
+	r.scripting.FlushFunctions()
+	r.loading.Store(true)
+	defer r.loading.Store(false)
+	if err := r.aof.load(r.execLoaded); err != nil {
+		return fmt.Errorf("Error loading the AOF: %v", err)
+	}
+	r.dirty.Store(0)
+	for _, mdb := range r.dbs {
+		mdb.RemoveAllExpired()
+	}
+	return nil
+}
+
+// execLoaded 执行加载的一条命令, 和 process 一样处理 SELECT 和 MULTI/EXEC, 调用方已经持有锁
+func (r *RedisServer) execLoaded(ctx context.Context, conn *Client) error {
+	r.bindClient(conn)
+	mdb, err := r.SelectDb(conn.GetDbIndex())
+	if err != nil {
+		conn.ResetQueryBuffer()
+		return err
+	}
+	conn.SetDb(mdb)
+	if isTxMarker(conn.queryBuffer.Front().Value.([][]byte)) {
+		_ = conn.PollCmd()
+		return nil
+	}
+	return r.processCmd(ctx, conn)
+}
+
+// checkPersistenceBusy DEBUG RELOAD 和 DEBUG LOADAOF 在 BGSAVE 和 aof 重写期间不能执行
+func (r *RedisServer) checkPersistenceBusy() error {
+	if r.rdbSaving.Load() {
+		return ErrBgSaveInProgress
+	}
+	if r.aof != nil && r.aof.Rewriting() {
+		return ErrAofRewriteIsRunning
+	}
+	return nil
+}
+
+func (r *RedisServer) process(ctx context.Context, conn *Client) (err error) {
+	// 主节点的命令不能丢弃, 一直等到脚本执行完成
+	if conn.master {
+		lock.Lock()
+	} else if !r.acquire() {
+		return r.replyBusy(conn)
+	}
 	processWait.Add(1)
+	conn.executing = true
 	defer func() {
+		conn.executing = false
 		lock.Unlock()
 		processWait.Done()
 	}()
@@ -52,12 +160,32 @@ func (r *RedisServer) process(ctx context.Context, conn *Client) error {
 	if r.shutdown.Load() {
 		return ErrorsShutdown
 	}
+	// 执行 REPLICAOF 之后不再执行原来的主节点发送的命令
+	if conn.master && ctx.Err() != nil {
+		conn.ResetQueryBuffer()
+		return ctx.Err()
+	}
 
-	conn.Rewrite = r.rewrite
-	conn.RangeCheck = r.RangeCheck
-	conn.ClearDatabase = r.clear
+	r.bindClient(conn)
+	conn.lastInteraction = time.Now()
+	// 队列中的命令(流水线)都执行完之后一起发送回复, 减少系统调用
+	conn.deferFlush = true
+	defer func() {
+		conn.deferFlush = false
+		if flushErr := conn.flushReplies(); err == nil {
+			err = flushErr
+		}
+		if conn.conn != nil {
+			conn.checkOutputLimit(conn.conn, conn.obufClass())
+		}
+	}()
 
-	for conn.HasRemaining() {
+	for executed := 0; conn.HasRemaining() && conn.blocked == nil; executed++ {
+		// 让出锁和 event loop, 其他客户端的命令先执行
+		if executed == maxCommandsPerEvent && conn.conn != nil && !conn.master {
+			_ = conn.conn.Wake(nil)
+			return nil
+		}
 		dbIndex := conn.GetDbIndex()
 		mdb, err := r.SelectDb(dbIndex)
 		if err != nil {
@@ -68,32 +196,307 @@ func (r *RedisServer) process(ctx context.Context, conn *Client) error {
 			return nil
 		}
 		conn.SetDb(mdb)
-		if err = r.processCmd(ctx, conn); err != nil {
+		// 命令留在队列中, 恢复写命令之后再执行
+		if r.pauseIfNeeded(conn) {
+			return nil
+		}
+		var cmdLine [][]byte
+		// 加载期间其他客户端的 MULTI/EXEC 回复 -LOADING, 只有加载 aof 的内部客户端重放事务的边界
+		if conn.master || (conn.inner && r.loading.Load()) {
+			cmdLine = conn.queryBuffer.Front().Value.([][]byte)
+		}
+		if isTxMarker(cmdLine) {
+			// 从节点的 aof 中同样保留主节点的 MULTI/EXEC
+			_ = conn.PollCmd()
+			conn.curCommand = nil
+			r.currentClient = conn
+			r.propagate(dbIndex, cmdLine)
+		} else {
+			err = r.processCmd(ctx, conn)
+		}
+		// 主节点的命令在锁内更新偏移量和积压缓冲区, 不管执行是否成功都已经消费了复制流
+		if conn.master {
+			r.repl.feedRaw(cmdLine)
+		}
+		if err != nil {
 			return err
 		}
+		// QUIT 之后的命令丢弃, 发送回复之后关闭连接
+		if conn.closeAfterReply {
+			conn.ResetQueryBuffer()
+			return nil
+		}
 	}
 	return nil
 }
 
+// acquire 获取全局锁. 有脚本在执行时不会一直等待, 脚本执行超过 busy-reply-threshold 之后返回false
+func (r *RedisServer) acquire() bool {
+	if r.scripting == nil {
+		lock.Lock()
+		return true
+	}
+	for {
+		if lock.TryLock() {
+			return true
+		}
+		if r.scripting.Busy() {
+			return false
+		}
+		if !r.scripting.Running() {
+			lock.Lock()
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// replyBusy 脚本执行超时的时候只允许执行 SCRIPT KILL, FUNCTION KILL 和 FUNCTION STATS, 其他的命令直接回复 BUSY
+func (r *RedisServer) replyBusy(conn *Client) error {
+	defer func() {
+		conn.curCommand = nil
+	}()
+	for conn.HasRemaining() {
+		cmdLine := conn.PollCmd()
+		var reply Reply = MakeBusyErr()
+		if len(cmdLine) == 2 {
+			name, subCommand := strings.ToLower(string(cmdLine[0])), strings.ToLower(string(cmdLine[1]))
+			if (name == "script" || name == "function") && subCommand == "kill" {
+				reply = r.scripting.Kill()
+			} else if name == "function" && subCommand == "stats" {
+				reply = functionStats(r.scripting)
+			}
+		}
+		if err := reply.WriteTo(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindClient 注入命令执行时需要的 server 依赖, 已经绑定过的客户端不再重复创建这些方法值
+func (r *RedisServer) bindClient(conn *Client) {
+	if conn.boundTo == r {
+		return
+	}
+	conn.boundTo = r
+	conn.Rewrite = r.rewrite
+	conn.RangeCheck = r.RangeCheck
+	conn.ClearDatabase = r.clear
+	conn.FlushAll = r.flushAll
+	conn.ResetStats = r.resetStats
+	conn.stats = r.stats
+	conn.RequestShutdown = r.requestShutdown
+	conn.Block = r.blockClient
+	conn.KillClient = r.killClient
+	conn.ExecTransaction = r.execTransaction
+	conn.PubSub = r.pubsub
+	conn.Tracking = r.tracking
+	conn.Watches = r.watches
+	conn.Clients = r.connManager
+	conn.Scripting = r.scripting
+	conn.Replication = r.repl
+	conn.Persister = r
+	conn.Memory = r
+	conn.Keyspace = r
+}
+
 func (r *RedisServer) processCmd(ctx context.Context, conn *Client) error {
 	defer func() {
 		conn.curCommand = nil
+		conn.skipReply = false
 	}()
 	_ = conn.PollCmd()
-	cmdName := conn.GetCmdName()
-	cmd, err := router(cmdName)
-	if err != nil {
+	// 上一条命令是 CLIENT REPLY SKIP, 这条命令的回复(包括错误)不发送
+	if conn.replyMode == replySkip {
+		conn.replyMode, conn.skipReply = replyOn, true
+	}
+	conn.history.record(conn.GetCmdLine())
+	cmd := conn.resolveCommand(conn.curCommand[0])
+	if cmd == nil {
+		cmdName := conn.GetCmdName()
 		args := conn.GetArgs()
 		with := make([]string, 0, len(args))
 		for _, arg := range args {
-			with = append(with, "'"+string(arg)+"'")
+			with = append(with, "'"+truncateArg(arg)+"'")
 		}
-		return MakeUnknownCommand(cmdName, with...).WriteTo(conn)
+		conn.abortMulti()
+		reply := MakeUnknownCommand(truncateArg([]byte(cmdName)), with...)
+		if config.Properties.SuggestCommands {
+			reply.suggestions = suggestCommands(cmdName)
+		}
+		return reply.WriteTo(conn)
+	}
+	cmdName := cmd.name
+	conn.lastCmd = cmdName
+	// 与 redis 一致, 参数个数在认证之前检查
+	if errReply := cmd.validate(conn.GetCmdLine()); errReply != nil {
+		cmd.stats.reject()
+		conn.abortMulti()
+		return errReply.WriteTo(conn)
+	}
+	if authRequired(conn) && !allowedBeforeAuth(cmdName) {
+		cmd.stats.reject()
+		conn.abortMulti()
+		return MakeNoAuthErr().WriteTo(conn)
+	}
+	// RESP2 的订阅模式下只允许执行订阅相关的命令, RESP3 的推送和回复可以区分, 与 redis 一样可以执行所有的命令
+	if conn.protocol == resp2 && conn.SubscriptionCount() > 0 && !allowedInSubscribeContext(cmdName) {
+		cmd.stats.reject()
+		return MakeStandardErrReply(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / "+
+			"(P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", cmdName)).WriteTo(conn)
+	}
+	// 启动时加载数据期间, 除了加载的命令和主节点的命令, 只允许执行不读写数据的命令
+	if r.loading.Load() && !conn.inner && !conn.master && !cmd.IsLoading() {
+		cmd.stats.reject()
+		conn.abortMulti()
+		return MakeLoadingErr().WriteTo(conn)
+	}
+	if cmd.IsWriteFor(conn.GetCmdLine()) {
+		if errReply := r.checkWritable(conn); errReply != nil {
+			cmd.stats.reject()
+			conn.abortMulti()
+			return errReply.WriteTo(conn)
+		}
+	}
+	if conn.multi != nil && !execImmediately(cmdName) {
+		return queueCommand(conn)
 	}
-	if cmdName != "ttlops" {
+	if r.useHooks(conn) {
+		return r.execWithHooks(ctx, conn, cmd, func() error {
+			return r.execCmd(ctx, conn, cmd)
+		})
+	}
+	return r.execCmd(ctx, conn, cmd)
+}
+
+// execCmd 执行已经通过检查的命令
+func (r *RedisServer) execCmd(ctx context.Context, conn *Client, cmd *Command) (err error) {
+	r.currentClient = conn
+	if cmd.name != "ttlops" && !r.loading.Load() {
 		conn.GetDb().RandomCheckTTLAndClearV1()
 	}
-	return cmd.process(ctx, conn)
+	// 超过 maxmemory 时先淘汰key, 主节点的命令不会被拒绝
+	if !r.performEvictions() && cmd.IsDenyOOM() && !conn.master {
+		cmd.stats.reject()
+		return MakeOOMErr().WriteTo(conn)
+	}
+	if cmd.IsWriteFor(conn.GetCmdLine()) {
+		conn.GetDb().prepareWrite(cmd, conn.GetCmdLine())
+	}
+	// 删除过期key的 DEL 不和命令的效果放在一个事务中
+	r.propagatePending()
+	conn.replyFailed = false
+	ctx, cancel := r.commandContext(ctx, conn)
+	defer cancel()
+	start := time.Now()
+	err = r.callCommand(ctx, conn, cmd)
+	cmd.stats.record(time.Since(start), conn.replyFailed)
+	r.propagatePending()
+	r.handleBlocked()
+	if err != nil {
+		return err
+	}
+	// 效果已经写入 aof, 缓存的回复太多时先发送
+	if conn.bufferedReplies() >= replyFlushThreshold {
+		if err = conn.flushReplies(); err != nil {
+			return err
+		}
+	}
+	if conn.IsTracking() {
+		r.afterTrackingCommand(conn, cmd)
+	}
+	return nil
+}
+
+// callCommand 执行命令. 命令 panic 时把客户端的信息和最近的命令写入日志, 回复 -ERR internal error,
+// server 继续运行; panic 之前已经生效的修改照常传播. 读取值失败见 processCommand
+func (r *RedisServer) callCommand(ctx context.Context, conn *Client, cmd *Command) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			conn.streaming = false
+			r.lg.Errorf("panic executing command '%s': %v\nclient: %s\nrecent commands:\n%s%s",
+				cmd.name, p, clientInfoString(conn), conn.history.String(), debug.Stack())
+			conn.replyFailed = true
+			err = MakeStandardErrReply("ERR internal error").WriteTo(conn)
+		}
+	}()
+	return processCommand(ctx, conn, cmd)
+}
+
+// afterTrackingCommand 记录只读命令读取的key, 并清理只对这条命令生效的 CLIENT CACHING
+func (r *RedisServer) afterTrackingCommand(conn *Client, cmd *Command) {
+	cmdLine := conn.GetCmdLine()
+	if cmd.IsReadonly() {
+		r.tracking.RememberKeys(conn, cmd.GetKeys(cmdLine))
+	}
+	if !isClientCaching(cmdLine) {
+		conn.trackingFlags &^= trackingCaching
+	}
+}
+
+// isReplica 当前节点是从节点, 调用方持有锁
+func (r *RedisServer) isReplica() bool {
+	return r.repl != nil && r.repl.IsReplica()
+}
+
+// expirePolicy 主节点删除过期的key; 从节点等待主节点的 DEL, 执行主节点的命令时过期的key仍然可见.
+// 暂停写命令期间和从节点一样只是看不到过期的key.
+// 加载aof期间和执行主节点的命令一样, 按照原来的顺序重放
+func (r *RedisServer) expirePolicy() int {
+	if r.loading.Load() {
+		return expireKeep
+	}
+	// 暂停写命令期间不删除过期的key, 复制流的偏移量保持不变
+	if r.writesPaused {
+		return expireHide
+	}
+	if !r.isReplica() {
+		return expireDelete
+	}
+	if r.currentClient != nil && r.currentClient.master {
+		return expireKeep
+	}
+	return expireHide
+}
+
+// checkWritable replica-read-only 的从节点只执行主节点发送的写命令; aof 写入失败之后拒绝写命令, 直到磁盘恢复.
+// 与 redis 一样, READONLY 只在集群模式中允许从节点处理读命令, 不影响写命令; 还没有集群模式, 这个标记只在 CLIENT LIST 中显示
+func (r *RedisServer) checkWritable(conn *Client) Reply {
+	if r.isReplica() && config.Properties.ReplicaReadOnly && (conn == nil || !conn.master) {
+		return MakeReadonlyErr()
+	}
+	if r.aof == nil || !config.Properties.AppendOnly {
+		return nil
+	}
+	if err := r.aof.WriteError(); err != nil {
+		return MakeStandardErrReply("MISCONF Errors writing to the AOF file: " + oneLine(err.Error()) +
+			". Commands that may modify the data set are disabled until the disk recovers.")
+	}
+	return nil
+}
+
+// authRequired 配置了 requirepass 并且客户端还没有认证. 内部的客户端和主节点的复制连接不需要认证
+func authRequired(conn *Client) bool {
+	return config.Properties.RequirePass != "" && !conn.authenticated && !conn.inner && !conn.master
+}
+
+func allowedBeforeAuth(cmdName string) bool {
+	switch cmdName {
+	case "auth", "hello", "quit", "reset":
+		return true
+	default:
+		return false
+	}
+}
+
+func allowedInSubscribeContext(cmdName string) bool {
+	switch cmdName {
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ping", "echo", "quit", "reset":
+		return true
+	default:
+		return false
+	}
 }
 
 func (r *RedisServer) SelectDb(index int) (*DB, error) {
@@ -118,28 +521,48 @@ func (r *RedisServer) ForEach(dbIndex int, cb func(key string, entity *obj.Redis
 }
 
 func (r *RedisServer) clear() {
+	if r.loading.Load() {
+		return
+	}
 	if r.dbs != nil && len(r.dbs) > 0 {
 		for _, mdb := range r.dbs {
 			mdb.RandomCheckTTLAndClearV1()
 		}
+		// 与 redis 的 databasesCron 一样, 清理过期的key之后整理内存
+		r.activeDefragCycle()
+	}
+}
+
+// flushAll 清空所有的 db, 调用方持有锁
+func (r *RedisServer) flushAll(lazy bool) {
+	for _, mdb := range r.dbs {
+		if lazy {
+			mdb.FlushLazy()
+		} else {
+			mdb.Flush()
+		}
 	}
 }
 
+// rewrite 在后台执行aof重写, 重写已经在执行时返回 ErrAofRewriteIsRunning
 func (r *RedisServer) rewrite() error {
-	return r.aof.Rewrite()
+	if r.aof == nil {
+		return nil
+	}
+	return r.aof.BgRewrite()
 }
 
 func (r *RedisServer) doAofRewrite() {
-	if !config.Properties.AppendOnly {
+	// auto-aof-rewrite-percentage 为0时关闭自动重写
+	if !config.Properties.AppendOnly || r.aof == nil || config.Properties.AofRewritePercentage <= 0 {
 		return
 	}
-	defer r.lg.Sync()
-	// 当前aof文件的大小
-	currentAofFileSize, err := r.aof.CurrentAofSize()
-	if err != nil {
-		r.lg.Errorf("check aof filesize failed with error: %v", err)
+	// 和 redis 一样, 有 BGSAVE 或者重写正在执行时不触发
+	if r.aof.Rewriting() || r.rdbSaving.Load() {
 		return
 	}
+	// 当前aof文件的大小
+	currentAofFileSize := r.aof.CurrentAofSize()
 	// 上一次aof重写后的大小
 	lastAofRewriteSize := r.aof.LasAofRewriteSize()
 	// 计算aof文件的增长量
@@ -153,15 +576,55 @@ func (r *RedisServer) doAofRewrite() {
 		(currentAofFileSize >= int64(config.Properties.AofRewriteMinSize))
 
 	if rewriteNeeded {
-		go func() {
-			err2 := r.aof.Rewrite()
-			if err2 != nil {
-				if !errors.Is(err2, ErrAofRewriteIsRunning) {
-					r.lg.Errorf("aof rewrite failed with error: %v", err2)
-				}
-			} else {
-				r.lg.Info("aof rewrite successfully")
+		if lastAofRewriteSize > 0 {
+			r.lg.Infof("Starting automatic rewriting of AOF on %d%% growth", aofSizeIncrease*100/lastAofRewriteSize)
+		}
+		_ = r.rewrite()
+	}
+}
+
+// freeClient 连接关闭时清理订阅关系和 tracking, 需要和命令的执行互斥
+func (r *RedisServer) freeClient(conn *Client) {
+	lock.Lock()
+	defer lock.Unlock()
+	r.unlinkClient(conn)
+}
+
+// unlinkClient 见 freeClient, 调用方持有锁
+func (r *RedisServer) unlinkClient(conn *Client) {
+	conn.resetState()
+	if r.repl != nil && conn.repl != nil {
+		r.repl.removeReplica(conn)
+	}
+	if r.currentClient == conn {
+		r.currentClient = nil
+	}
+	if conn.paused {
+		for i, paused := range r.pausedClients {
+			if paused == conn {
+				r.pausedClients = append(r.pausedClients[:i], r.pausedClients[i+1:]...)
+				break
 			}
-		}()
+		}
+	}
+	r.removeBlocked(conn)
+}
+
+// killClient CLIENT KILL, 先取消订阅和阻塞, 连接在 event loop 中关闭. 调用方持有锁
+func (r *RedisServer) killClient(target *Client) {
+	r.unlinkClient(target)
+	if target.conn != nil {
+		_ = target.conn.Close()
+	}
+}
+
+// maxErrorArgLen 与 redis 一样, 错误中引用的参数最多保留这么多字节
+const maxErrorArgLen = 128
+
+// truncateArg 错误回复中引用客户端的参数时截断过长的参数
+func truncateArg(arg []byte) string {
+	if len(arg) > maxErrorArgLen {
+		arg = arg[:maxErrorArgLen]
 	}
+	return string(arg)
 }
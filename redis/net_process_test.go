@@ -0,0 +1,271 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipelineBatchedWrites(t *testing.T) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+
+	cmdLines := make([][]string, 0, 1000)
+	expected := &strings.Builder{}
+	for i := 0; i < 1000; i++ {
+		cmdLines = append(cmdLines, []string{"get", "foo"})
+		expected.WriteString("$3\r\nbar\r\n")
+	}
+	conn.writes = 0
+	action, out := traffic(server, conn, resp(cmdLines...))
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, expected.String(), out)
+	// 每次执行 maxCommandsPerEvent 条命令之后一起写入
+	assert.Equal(t, (1000+maxCommandsPerEvent-1)/maxCommandsPerEvent, conn.writes)
+
+	// 缓存的回复超过 replyFlushThreshold 时先发送一部分
+	value := strings.Repeat("v", 1024)
+	server.exec(t, client, "set", "big", value)
+	cmdLines, expected = cmdLines[:0], &strings.Builder{}
+	for i := 0; i < 100; i++ {
+		cmdLines = append(cmdLines, []string{"get", "big"})
+		expected.WriteString("$1024\r\n" + value + "\r\n")
+	}
+	conn.writes = 0
+	_, out = traffic(server, conn, resp(cmdLines...))
+	assert.Equal(t, expected.String(), out)
+	assert.True(t, conn.writes > 1 && conn.writes <= 100*1024/replyFlushThreshold+1, conn.writes)
+}
+
+func TestPipelineFairness(t *testing.T) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	for i := 0; i < 3*maxCommandsPerEvent; i++ {
+		client.PushCmd(util.ToCmdLine("incr", "counter"))
+	}
+	// 执行 maxCommandsPerEvent 条命令之后让出, 剩下的命令等待下一次 OnTraffic
+	_ = server.process(context.Background(), client)
+	assert.Equal(t, 1, conn.woken)
+	assert.Equal(t, 2*maxCommandsPerEvent, client.queryBuffer.Len())
+	assert.True(t, strings.HasSuffix(conn.take(), ":"+strconv.Itoa(maxCommandsPerEvent)+"\r\n"))
+	other, _ := server.newClient()
+	assert.Equal(t, "$2\r\n64\r\n", server.exec(t, other, "get", "counter"))
+
+	// 协议错误之前的命令全部执行完
+	cmdLines := make([][]string, 0, 2*maxCommandsPerEvent)
+	for i := 0; i < 2*maxCommandsPerEvent; i++ {
+		cmdLines = append(cmdLines, []string{"incr", "counter"})
+	}
+	_, conn = server.newClient()
+	action, out := traffic(server, conn, resp(cmdLines...)+"*1\r\n$3\r\nfoobar\r\n")
+	assert.Equal(t, gnet.Close, action)
+	assert.True(t, strings.HasSuffix(out, ":192\r\n-ERR Protocol error: expected: '\\r\\n',got'98, 97'\r\n"), out)
+}
+
+func TestPipelineFairnessNetwork(t *testing.T) {
+	server := newTestServer()
+	port := serve(t, server)
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		return conn
+	}
+
+	flooder, other := dial(), dial()
+	flooderReader, otherReader := bufio.NewReader(flooder), bufio.NewReader(other)
+	// 确认两个连接都已经注册到 event loop
+	for _, c := range []net.Conn{flooder, other} {
+		_ = c.SetDeadline(time.Now().Add(30 * time.Second))
+		_, _ = c.Write(MakeMultiBulkReply(util.ToCmdLine("ping")).ToBytes())
+	}
+	for _, r := range []*bufio.Reader{flooderReader, otherReader} {
+		line, _ := r.ReadString('\n')
+		assert.Equal(t, "+PONG\r\n", line)
+	}
+	// 一个客户端一次发送很长的流水线, 每条命令都要执行一段时间
+	slowIncr := []string{"eval", "local i = 0 while i < 20000 do i = i + 1 end return redis.call('incr', KEYS[1])", "1", "counter"}
+	total := 3 * maxCommandsPerEvent
+	cmdLines := make([][]string, 0, total)
+	for i := 0; i < total; i++ {
+		cmdLines = append(cmdLines, slowIncr)
+	}
+	_, err := flooder.Write([]byte(resp(cmdLines...)))
+	assert.Nil(t, err)
+
+	// 另一个客户端的命令在流水线的下一次让出时执行, 不需要等待流水线执行完
+	_, err = other.Write(MakeMultiBulkReply(util.ToCmdLine("get", "counter")).ToBytes())
+	assert.Nil(t, err)
+	reply, err := otherReader.ReadString('\n')
+	if !assert.Nil(t, err) {
+		return
+	}
+	executed := 0
+	if reply != "$-1\r\n" {
+		value, _ := otherReader.ReadString('\n')
+		executed, _ = strconv.Atoi(strings.TrimSpace(value))
+	}
+	assert.Less(t, executed, total, reply)
+	assert.Zero(t, executed%maxCommandsPerEvent, executed)
+
+	for i := 0; i < total; i++ {
+		line, err := flooderReader.ReadString('\n')
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, ":"+strconv.Itoa(i+1)+"\r\n", line)
+	}
+}
+
+func TestPipelinePushOrder(t *testing.T) {
+	server := newTestServer()
+	reader, readerConn := server.newClient()
+	writer, writerConn := server.newClient()
+	server.exec(t, reader, "hello", "3")
+	server.exec(t, reader, "client", "tracking", "on")
+	server.exec(t, writer, "set", "foo", "v1")
+
+	// 自己修改读取过的key, 失效消息和回复按照命令的顺序到达
+	_, out := traffic(server, readerConn, resp([]string{"get", "foo"}, []string{"set", "foo", "v2"},
+		[]string{"get", "foo"}, []string{"ping"}))
+	assert.Equal(t, "$2\r\nv1\r\n"+invalidatePush("foo")+"+OK\r\n$2\r\nv2\r\n+PONG\r\n", out)
+
+	// 其他客户端的流水线中产生的推送不会插入到这个客户端的回复中间
+	server.exec(t, reader, "subscribe", "ch")
+	_, out = traffic(server, writerConn, resp([]string{"publish", "ch", "m1"}, []string{"set", "foo", "v3"},
+		[]string{"publish", "ch", "m2"}))
+	assert.Equal(t, ":1\r\n+OK\r\n:1\r\n", out)
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nm1\r\n"+invalidatePush("foo")+
+		">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nm2\r\n", readerConn.take())
+}
+
+func TestClientReply(t *testing.T) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	publisher, _ := server.newClient()
+
+	// OFF 自己和之后的命令(包括错误)都没有回复
+	cmdLines := [][]string{{"client", "reply", "off"}}
+	for i := 0; i < 100; i++ {
+		cmdLines = append(cmdLines, []string{"set", "key:" + strconv.Itoa(i), "value"})
+	}
+	cmdLines = append(cmdLines, []string{"incr", "key:0"}, []string{"nosuchcommand"}, []string{"client", "reply", "skip"})
+	_, out := traffic(server, conn, resp(cmdLines...))
+	assert.Equal(t, "", out)
+	assert.Equal(t, "$5\r\nvalue\r\n", server.exec(t, publisher, "get", "key:99"))
+	_, out = traffic(server, conn, resp([]string{"client", "reply", "on"}, []string{"get", "key:1"}))
+	assert.Equal(t, "+OK\r\n$5\r\nvalue\r\n", out)
+
+	// SKIP 只跳过下一条命令
+	_, out = traffic(server, conn, resp([]string{"client", "reply", "skip"}, []string{"incr", "key:0"},
+		[]string{"ping"}))
+	assert.Equal(t, "+PONG\r\n", out)
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "client", "reply", "maybe"))
+
+	// 推送不受影响
+	_, out = traffic(server, conn, resp([]string{"hello", "3"}, []string{"client", "reply", "off"}))
+	assert.Contains(t, out, "%7\r\n")
+	server.exec(t, client, "subscribe", "ch")
+	assert.Equal(t, ":1\r\n", server.exec(t, publisher, "publish", "ch", "hi"))
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", conn.take())
+
+	// RESET 恢复回复
+	assert.Equal(t, "+RESET\r\n", server.exec(t, client, "reset"))
+	assert.Equal(t, 0, client.SubscriptionCount())
+	assert.Equal(t, resp2, client.Protocol())
+	assert.Equal(t, ":0\r\n", server.exec(t, publisher, "publish", "ch", "hi"))
+	assert.Equal(t, "$5\r\nvalue\r\n", server.exec(t, client, "get", "key:1"))
+}
+
+func TestQuit(t *testing.T) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	server.exec(t, client, "client", "tracking", "on")
+	server.exec(t, client, "subscribe", "ch")
+	publisher, _ := server.newClient()
+
+	// QUIT 之前的回复先发送, 之后的命令不再执行
+	action, out := traffic(server, conn, resp([]string{"ping"}, []string{"quit"}, []string{"ping"}))
+	assert.Equal(t, gnet.Close, action)
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n+OK\r\n", out)
+	assert.False(t, client.HasRemaining())
+	assert.True(t, client.IsTracking())
+	// 连接关闭时和 RESET 一样取消订阅和 tracking
+	server.OnClose(conn, nil)
+	assert.Equal(t, 0, client.SubscriptionCount())
+	assert.False(t, client.IsTracking())
+	assert.Equal(t, ":0\r\n", server.exec(t, publisher, "publish", "ch", "hi"))
+
+	assert.Equal(t, "-ERR wrong number of arguments for 'quit' command\r\n", server.exec(t, publisher, "quit", "now"))
+	assert.False(t, publisher.closeAfterReply)
+}
+
+func TestQuitOverNetwork(t *testing.T) {
+	server := newTestServer()
+	port := serve(t, server)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte(resp([]string{"set", "a", "1"}, []string{"quit"}, []string{"get", "a"})))
+	// SET 和 QUIT 的回复之后服务端关闭连接
+	out, err := io.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n+OK\r\n", string(out))
+	client, _ := server.newClient()
+	assert.Equal(t, "$1\r\n1\r\n", server.exec(t, client, "get", "a"))
+}
+
+func BenchmarkPipelineGet(b *testing.B) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	client.PushCmd([][]byte{[]byte("set"), []byte("foo"), []byte("bar")})
+	_ = server.process(context.Background(), client)
+	cmdLines := make([][]string, 0, 64)
+	for i := 0; i < 64; i++ {
+		cmdLines = append(cmdLines, []string{"get", "foo"})
+	}
+	data := resp(cmdLines...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		traffic(server, conn, data)
+	}
+}
+
+// BenchmarkSetGet 常见的回复(+OK, 小的整数, nil 和字符串)的分配次数
+func BenchmarkSetGet(b *testing.B) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	cmdLines := [][][]byte{
+		util.ToCmdLine("set", "foo", "bar"),
+		util.ToCmdLine("get", "foo"),
+		util.ToCmdLine("get", "missing"),
+		util.ToCmdLine("exists", "foo"),
+		util.ToCmdLine("del", "missing"),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, cmdLine := range cmdLines {
+			client.PushCmd(cmdLine)
+		}
+		_ = server.process(context.Background(), client)
+		conn.out.Reset()
+	}
+}
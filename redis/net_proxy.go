@@ -0,0 +1,203 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/config"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol, 见 https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+// 打开 enable-proxy-protocol 之后, tcp 连接发送的第一段数据必须是 v1 或者 v2 的头部, 之后才是 RESP.
+// 头部中的地址代替负载均衡器的地址, CLIENT LIST、保护模式和从节点的地址都使用它
+
+const (
+	// proxyV1MaxLen v1 头部的最大长度, 包括 \r\n
+	proxyV1MaxLen = 107
+	// proxyV2HeaderLen v2 固定部分的长度: 12字节的签名, 版本和命令, 地址族, 2字节的长度
+	proxyV2HeaderLen = 16
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// errProxyIncomplete 头部还没有完整到达
+var errProxyIncomplete = errors.New("incomplete PROXY header")
+
+// proxyHeader 解析出来的地址, LOCAL 和 UNKNOWN 时为空, 使用连接本身的地址
+type proxyHeader struct {
+	src net.Addr
+	dst net.Addr
+}
+
+// parseProxyHeader 解析 buf 开头的头部, 返回头部的长度
+func parseProxyHeader(buf []byte) (proxyHeader, int, error) {
+	if hasPrefixOf(buf, proxyV2Signature) {
+		return parseProxyV2(buf)
+	}
+	if hasPrefixOf(buf, proxyV1Prefix) {
+		return parseProxyV1(buf)
+	}
+	return proxyHeader{}, 0, errors.New("missing PROXY header")
+}
+
+// hasPrefixOf buf 以 prefix 开头, 或者 buf 还不够长但是是 prefix 的开头
+func hasPrefixOf(buf, prefix []byte) bool {
+	if len(buf) < len(prefix) {
+		return bytes.HasPrefix(prefix, buf)
+	}
+	return bytes.HasPrefix(buf, prefix)
+}
+
+// parseProxyV1 PROXY TCP4|TCP6 <src ip> <dst ip> <src port> <dst port>\r\n 或者 PROXY UNKNOWN ...\r\n
+func parseProxyV1(buf []byte) (proxyHeader, int, error) {
+	end := bytes.Index(buf, CRLFBytes)
+	if end < 0 {
+		if len(buf) >= proxyV1MaxLen {
+			return proxyHeader{}, 0, errors.New("PROXY v1 header too long")
+		}
+		return proxyHeader{}, 0, errProxyIncomplete
+	}
+	n := end + 2
+	if n > proxyV1MaxLen {
+		return proxyHeader{}, 0, errors.New("PROXY v1 header too long")
+	}
+	fields := strings.Split(string(buf[len(proxyV1Prefix):end]), " ")
+	if fields[0] == "UNKNOWN" {
+		return proxyHeader{}, n, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return proxyHeader{}, 0, fmt.Errorf("invalid PROXY v1 header %q", buf[:end])
+	}
+	src, err1 := parseProxyV1Addr(fields[0], fields[1], fields[3])
+	dst, err2 := parseProxyV1Addr(fields[0], fields[2], fields[4])
+	if err1 != nil || err2 != nil {
+		return proxyHeader{}, 0, fmt.Errorf("invalid PROXY v1 header %q", buf[:end])
+	}
+	return proxyHeader{src: src, dst: dst}, n, nil
+}
+
+func parseProxyV1Addr(family, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") != (family == "TCP6") {
+		return nil, errors.New("invalid address")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, errors.New("invalid port")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseProxyV2 二进制的头部, 地址之后的 TLV 被忽略
+func parseProxyV2(buf []byte) (proxyHeader, int, error) {
+	if len(buf) < proxyV2HeaderLen {
+		return proxyHeader{}, 0, errProxyIncomplete
+	}
+	verCmd, family := buf[12], buf[13]
+	length := int(binary.BigEndian.Uint16(buf[14:16]))
+	if verCmd>>4 != 2 {
+		return proxyHeader{}, 0, fmt.Errorf("unsupported PROXY version %d", verCmd>>4)
+	}
+	n := proxyV2HeaderLen + length
+	if len(buf) < n {
+		return proxyHeader{}, 0, errProxyIncomplete
+	}
+	payload := buf[proxyV2HeaderLen:n]
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL, 负载均衡器自己的健康检查
+		return proxyHeader{}, n, nil
+	case 0x1:
+	default:
+		return proxyHeader{}, 0, fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0x0f)
+	}
+	var addrLen, ipLen int
+	switch family {
+	case 0x11:
+		addrLen, ipLen = 12, net.IPv4len
+	case 0x21:
+		addrLen, ipLen = 36, net.IPv6len
+	case 0x00, 0x12, 0x22, 0x31, 0x32:
+		// UNSPEC、UDP 和 unix 的地址对 redis 没有意义, 使用连接本身的地址
+		return proxyHeader{}, n, nil
+	default:
+		return proxyHeader{}, 0, fmt.Errorf("unsupported PROXY v2 address family 0x%02x", family)
+	}
+	if len(payload) < addrLen {
+		return proxyHeader{}, 0, errors.New("PROXY v2 address too short")
+	}
+	if err := checkProxyTLVs(payload[addrLen:]); err != nil {
+		return proxyHeader{}, 0, err
+	}
+	src := &net.TCPAddr{IP: net.IP(append([]byte(nil), payload[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:]))}
+	dst := &net.TCPAddr{IP: net.IP(append([]byte(nil), payload[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))}
+	return proxyHeader{src: src, dst: dst}, n, nil
+}
+
+// checkProxyTLVs 每个 TLV 是1字节的类型, 2字节的长度和值, 长度不能超出头部
+func checkProxyTLVs(tlvs []byte) error {
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return errors.New("truncated PROXY v2 TLV")
+		}
+		length := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < length {
+			return errors.New("truncated PROXY v2 TLV")
+		}
+		tlvs = tlvs[length:]
+	}
+	return nil
+}
+
+// expectProxyHeader 新的连接是否需要先发送头部, unix socket 是本机的连接, 不经过负载均衡器
+func expectProxyHeader(c gnet.Conn) bool {
+	return config.Properties.EnableProxyProtocol && !isUnixConn(c)
+}
+
+// readProxyHeader 读取并丢弃头部, 返回 false 表示头部还没有完整到达. 在客户端的 event loop 中调用
+func (c *Client) readProxyHeader() (bool, error) {
+	buf, err := c.conn.Peek(-1)
+	if err != nil {
+		return false, err
+	}
+	header, n, err := parseProxyHeader(buf)
+	if errors.Is(err, errProxyIncomplete) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if _, err = c.conn.Discard(n); err != nil {
+		return false, err
+	}
+	c.proxyPending = false
+	c.proxySrc, c.proxyDst = header.src, header.dst
+	return true, nil
+}
+
+// acceptProxyHeader 收到头部之后按照客户端的地址检查保护模式, 头部之后还有数据时 next 为 true, 继续解码命令
+func (r *RedisServer) acceptProxyHeader(conn *Client) (action gnet.Action, next bool) {
+	done, err := conn.readProxyHeader()
+	if err != nil {
+		r.lg.Warnf("Closing connection from %v: %v", conn.conn.RemoteAddr(), err)
+		return gnet.Close, false
+	}
+	if !done {
+		return gnet.None, false
+	}
+	if protectedModeDenied(conn.conn, conn.RemoteAddr()) {
+		r.lg.Infof("Denied connection from %v because of protected mode", conn.RemoteAddr())
+		_ = protectedModeReply.WriteTo(conn)
+		return gnet.Close, false
+	}
+	return gnet.None, conn.conn.InboundBuffered() > 0
+}
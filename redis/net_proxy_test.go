@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"encoding/binary"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 按照 v2 的格式编码头部, tlvs 放在地址之后
+func proxyV2(command, family byte, addr []byte, tlvs []byte) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addr)+len(tlvs)))
+	header = append(header, addr...)
+	return string(append(header, tlvs...))
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	ipv4 := []byte{10, 0, 0, 5, 192, 168, 0, 1, 0xc3, 0x50, 0x18, 0xeb}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...),
+		0xc3, 0x50, 0x18, 0xeb)
+	tlvs := []byte{0x01, 0x00, 0x02, 'h', '2', 0x04, 0x00, 0x00}
+	cases := []struct {
+		name string
+		data string
+		src  string
+		dst  string
+		err  string
+	}{
+		{"v1 tcp4", "PROXY TCP4 10.0.0.5 192.168.0.1 50000 6379\r\n", "10.0.0.5:50000", "192.168.0.1:6379", ""},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 50000 6379\r\n", "[2001:db8::1]:50000", "[2001:db8::2]:6379", ""},
+		{"v1 unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", "", ""},
+		{"v2 tcp4", proxyV2(1, 0x11, ipv4, nil), "10.0.0.5:50000", "192.168.0.1:6379", ""},
+		{"v2 tcp6 with tlvs", proxyV2(1, 0x21, ipv6, tlvs), "[2001:db8::1]:50000", "[2001:db8::2]:6379", ""},
+		{"v2 local", proxyV2(0, 0x00, nil, nil), "", "", ""},
+		{"v2 unix", proxyV2(1, 0x31, make([]byte, 216), nil), "", "", ""},
+		{"v1 incomplete", "PROXY TCP4 10.0.0.5", "", "", errProxyIncomplete.Error()},
+		{"v2 incomplete", proxyV2(1, 0x11, ipv4, nil)[:20], "", "", errProxyIncomplete.Error()},
+		{"resp", "*1\r\n$4\r\nping\r\n", "", "", "missing PROXY header"},
+		{"v1 bad family", "PROXY UDP4 10.0.0.5 192.168.0.1 50000 6379\r\n", "", "", "invalid PROXY v1 header"},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 50000 6379\r\n", "", "", "invalid PROXY v1 header"},
+		{"v1 bad port", "PROXY TCP4 10.0.0.5 192.168.0.1 65536 6379\r\n", "", "", "invalid PROXY v1 header"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen), "", "", "PROXY v1 header too long"},
+		{"v2 bad version", strings.Replace(proxyV2(1, 0x11, ipv4, nil), "\x21", "\x11", 1), "", "", "unsupported PROXY version"},
+		{"v2 short address", proxyV2(1, 0x21, ipv4, nil), "", "", "PROXY v2 address too short"},
+		{"v2 truncated tlv", proxyV2(1, 0x11, ipv4, tlvs[:4]), "", "", "truncated PROXY v2 TLV"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// 头部之后的命令不属于头部
+			header, n, err := parseProxyHeader([]byte(c.data + "*1\r\n$4\r\nping\r\n"))
+			if c.err == errProxyIncomplete.Error() {
+				header, n, err = parseProxyHeader([]byte(c.data))
+			}
+			if c.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.err)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, len(c.data), n)
+			if c.src == "" {
+				assert.Nil(t, header.src)
+				assert.Nil(t, header.dst)
+				return
+			}
+			assert.Equal(t, c.src, header.src.String())
+			assert.Equal(t, c.dst, header.dst.String())
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	useListenConfig(t)
+	config.Properties.Bind, config.Properties.ProtectedMode, config.Properties.RequirePass = "", true, ""
+	server := newTestServer()
+	open := func() *fakeConn {
+		server.nextFd++
+		conn := &fakeConn{fd: server.nextFd, remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+		out, action := server.OnOpen(conn)
+		assert.Equal(t, "", string(out))
+		assert.Equal(t, gnet.None, action)
+		return conn
+	}
+
+	// 关闭时第一段数据就是 RESP
+	conn := open()
+	action, out := traffic(server, conn, "*1\r\n$4\r\nping\r\n")
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, "+PONG\r\n", out)
+
+	config.Properties.EnableProxyProtocol = true
+	// 头部可以分多次到达, 之后的命令在同一段数据中
+	conn = open()
+	action, out = traffic(server, conn, "PROXY TCP4 127.0.0.9 ")
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, "", out)
+	action, out = traffic(server, conn, "127.0.0.1 50000 6379\r\n*2\r\n$6\r\nclient\r\n$4\r\ninfo\r\n")
+	assert.Equal(t, gnet.None, action)
+	assert.Contains(t, out, " addr=127.0.0.9:50000 laddr=127.0.0.1:6379 ")
+
+	// 没有头部的连接被关闭
+	conn = open()
+	action, out = traffic(server, conn, "*1\r\n$4\r\nping\r\n")
+	assert.Equal(t, gnet.Close, action)
+	assert.Equal(t, "", out)
+
+	// 保护模式按照头部中的地址检查
+	conn = open()
+	action, out = traffic(server, conn, proxyV2(1, 0x11, []byte{10, 0, 0, 5, 127, 0, 0, 1, 0xc3, 0x50, 0x18, 0xeb}, nil))
+	assert.Equal(t, gnet.Close, action)
+	assert.True(t, strings.HasPrefix(out, "-DENIED Redis is running in protected mode"), out)
+
+	// LOCAL 使用连接本身的地址
+	conn = open()
+	action, out = traffic(server, conn, proxyV2(0, 0x00, nil, nil)+"*1\r\n$4\r\nping\r\n")
+	assert.Equal(t, gnet.None, action)
+	assert.Equal(t, "+PONG\r\n", out)
+	assert.Equal(t, "127.0.0.1:40000", server.connManager.Get(conn.fd).RemoteAddr().String())
+}
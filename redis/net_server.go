@@ -7,20 +7,21 @@ import (
 	"github.com/panjf2000/gnet/v2"
 	"github.com/xuning888/godis-tiny/config"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
 	"github.com/xuning888/godis-tiny/pkg/datastruct/ttl"
 	"github.com/xuning888/godis-tiny/pkg/logger"
 	"os"
-	"os/signal"
 	"sync/atomic"
-	"syscall"
 	"time"
 )
 
 var (
-	errStatusNotRunning = errors.New("server is not running")
+	ErrNotRunning     = errors.New("server is not running")
+	errAlreadyStarted = errors.New("server has already been started")
 )
 
-var defaultTimeout = 60
+// redisVersion HELLO 返回的版本号, 客户端会根据它判断服务端支持的功能
+const redisVersion = "7.0.0"
 
 const (
 	_ = iota
@@ -32,110 +33,241 @@ const (
 
 type RedisServer struct {
 	shutdown                atomic.Bool
-	dbs                     []*DB // dbs
+	loading                 atomic.Bool     // 正在加载aof或者rdb
+	loadingProgress         loadingProgress // 加载的进度, INFO persistence 中输出
+	rdbSaving               atomic.Bool     // BGSAVE 正在写入文件
+	lastSave                atomic.Int64    // 最近一次保存rdb成功的时间
+	dirty                   atomic.Int64    // 上一次保存rdb之后写入的次数
+	dbs                     []*DB           // dbs
 	aof                     *Aof
-	gnet.BuiltinEventEngine                            // eventHandler
-	engine                  gnet.Engine                // network engine
-	connManager             *Manager                   // conn manager
-	status                  uint32                     // server status
-	lg                      logger.Logger              // log
-	signalWaiter            func(err chan error) error // for shutdown
-}
-
-func waitSignal(errCh chan error) error {
-	signalToNotify := []os.Signal{syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM}
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, signalToNotify...)
-	select {
-	case sig := <-signals:
-		switch sig {
-		case syscall.SIGTERM:
-			// force shutdown
-			return errors.New(sig.String())
-		case syscall.SIGHUP, syscall.SIGINT:
-			return errors.New(sig.String())
-		}
-	case err := <-errCh:
-		// network engine error
-		return err
-	}
-	return nil
+	gnet.BuiltinEventEngine               // eventHandler
+	engine                  gnet.Engine   // network engine
+	connManager             *Manager      // conn manager
+	pubsub                  *PubSub       // pub/sub
+	tracking                *Tracking     // client side caching
+	watches                 *Watches      // WATCH 的 key
+	scripting               *Scripting    // lua scripting
+	repl                    *Replication  // master-replica replication
+	currentClient           *Client       // 正在执行命令的客户端
+	systemClient            *Client       // 执行定时任务的客户端, 只在 OnTick 中使用
+	pending                 []propagation // 正在执行的命令产生的写入效果
+	writesPaused            bool          // 写命令被暂停, 持有锁时读写
+	pausedClients           []*Client     // 等待恢复写命令的客户端
+	blocking                blockingState // 被 BLPOP, BRPOP, WAIT 阻塞的客户端
+	lastCron                time.Time     // 上一次执行 cron 的时间, OnTick 在两次 cron 之间检查阻塞命令的超时
+	status                  uint32        // server status
+	lg                      logger.Logger // log
+	shutdownReq             chan int      // SHUTDOWN 命令的参数
+	usedMemory              func() int64  // 使用的内存, 为空时是 go 堆上的对象, 测试中替换
+	stats                   *serverStats  // INFO stats 中的计数
+	nextEvictDb             int           // 随机淘汰时下一次开始的 db
+	hooks                   []Hook        // RegisterHook 注册的命令拦截器
+	// booted OnBoot 加载数据的结果, served 网络服务退出之后关闭, closed 关闭完成之后关闭. 只有 Start 启动的 server 才有
+	booted chan error
+	served chan struct{}
+	closed chan struct{}
+	// metrics metrics-addr 上的 /metrics, 没有配置时为 nil
+	metrics *metricsServer
+	// ctx 网络上的客户端执行命令使用的根 context, 开始关闭时 cancel
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func (r *RedisServer) Spin() {
-
-	if atomic.LoadUint32(&r.status) != statusInitialized {
-		return
-	}
-
+// Start 监听配置的地址并加载数据, 加载完成之后返回. 加载期间已经可以连接, 除了 INFO 和 SHUTDOWN 等命令都回复 -LOADING.
+// 之后 SHUTDOWN 命令和网络服务的错误在后台触发优雅关闭, 也可以调用 Shutdown 关闭, Done 在关闭完成之后返回.
+// ctx 只限制启动的时间, 超时之后加载完成时立即关闭
+func (r *RedisServer) Start(ctx context.Context) error {
 	if !atomic.CompareAndSwapUint32(&r.status, statusInitialized, statusRunning) {
-		return
+		return errAlreadyStarted
 	}
-
-	errCh := make(chan error)
-	address := fmt.Sprintf("tcp://%s:%d", config.Properties.Bind, config.Properties.Port)
+	addrs, err := listenAddrs()
+	if err != nil {
+		atomic.StoreUint32(&r.status, statusClosed)
+		return fmt.Errorf("Failed opening listening sockets: %w", err)
+	}
+	if r.metrics, err = r.listenMetrics(); err != nil {
+		atomic.StoreUint32(&r.status, statusClosed)
+		return err
+	}
+	r.booted = make(chan error, 1)
+	r.served = make(chan struct{})
+	r.closed = make(chan struct{})
+	errCh := make(chan error, 1)
 	go func() {
-		errCh <- gnet.Run(
-			r, address,
-			gnet.WithMulticore(false), // 关闭多核心, 设置numEventLoop = 1, 用于模拟redis的单线程
+		defer close(r.served)
+		errCh <- gnet.Rotate(
+			r, addrs,
+			// 命令在 process 的全局锁内串行执行, 仍然是redis的单线程模型.
+			// 开启多核心是为了在脚本执行超时的时候, 其他 event loop 上的连接可以收到 BUSY 和执行 SCRIPT KILL
+			gnet.WithMulticore(true),
 			// 启用定时任务
 			gnet.WithTicker(true),
-			// socket 60不活跃就会被驱逐
-			gnet.WithTCPKeepAlive(time.Second*time.Duration(defaultTimeout)),
 			gnet.WithReusePort(true),
 			// 使用最少连接的负载均衡算法为eventLoop分配conn
 			gnet.WithLoadBalancing(gnet.LeastConnections),
-			gnet.WithLogger(logger.Named("tcp-server")),
+			gnet.WithLogger(gnetLogger{logger.Named("tcp-server")}),
 		)
 	}()
+	select {
+	case err = <-r.booted:
+		if err != nil {
+			// OnBoot 返回 gnet.Shutdown, 等待网络服务退出
+			<-r.served
+		}
+	case err = <-errCh:
+		if err == nil {
+			err = errors.New("network engine stopped before the server was ready")
+		}
+	case flags := <-r.shutdownReq:
+		// 加载期间收到 SHUTDOWN, 加载中止之后关闭
+		r.shutdownWithTimeout(flags)
+		return ErrorsShutdown
+	case <-ctx.Done():
+		// 启动超时, 加载完成之后立即关闭, 加载失败或者网络服务退出时直接结束
+		go func() {
+			select {
+			case err := <-r.booted:
+				if err == nil {
+					r.shutdownWithTimeout(shutdownNow)
+					return
+				}
+				<-r.served
+			case <-r.served:
+			}
+			r.metrics.close(context.Background())
+			r.markClosed()
+		}()
+		return ctx.Err()
+	}
+	if err != nil {
+		r.metrics.close(context.Background())
+		r.markClosed()
+		return err
+	}
+	if r.metrics != nil {
+		go r.metrics.serve(r.lg)
+	}
+	go r.waitShutdown(errCh)
+	return nil
+}
 
-	signalWaiter := waitSignal
-	if r.signalWaiter != nil {
-		signalWaiter = r.signalWaiter
+// gnetLogger gnet 的 logger 还需要 Fatalf
+type gnetLogger struct {
+	logger.Logger
+}
+
+func (l gnetLogger) Fatalf(format string, args ...interface{}) {
+	l.Errorf(format, args...)
+	os.Exit(1)
+}
+
+// notifyBooted 通知 Start 加载数据的结果, 不是通过 Start 启动时没有等待的一方
+func (r *RedisServer) notifyBooted(err error) {
+	if r.booted != nil {
+		r.booted <- err
 	}
+}
 
-	if err := signalWaiter(errCh); err != nil {
-		logger.Infof("Received SIGINT %s scheduling shutdown...", err)
+// markClosed 没有启动成功时不需要关闭, 直接结束
+func (r *RedisServer) markClosed() {
+	atomic.StoreUint32(&r.status, statusClosed)
+	close(r.closed)
+}
+
+// waitShutdown 收到 SHUTDOWN 命令或者网络服务出错时开始关闭, 调用 Shutdown 关闭之后退出
+func (r *RedisServer) waitShutdown(errCh chan error) {
+	select {
+	case flags := <-r.shutdownReq:
+		r.shutdownWithTimeout(flags)
+	case err := <-errCh:
+		// Shutdown 停止 engine 之后 Rotate 也会返回
+		if atomic.LoadUint32(&r.status) != statusRunning {
+			return
+		}
+		r.lg.Errorf("network engine stopped: %v, scheduling shutdown...", err)
+		r.shutdownWithTimeout(0)
+	case <-r.closed:
 	}
+}
 
+// shutdownWithTimeout 后台开始的关闭最多等待一分钟
+func (r *RedisServer) shutdownWithTimeout(flags int) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
-
-	if err := r.Shutdown(ctx); err != nil {
+	if err := r.shutdownWith(ctx, flags); err != nil && !errors.Is(err, ErrNotRunning) {
 		r.lg.Errorf("Shutdown failed %v", err)
-		return
 	}
 }
 
+// Done Start 启动的 server 关闭完成之后返回
+func (r *RedisServer) Done() <-chan struct{} {
+	return r.closed
+}
+
 func (r *RedisServer) Shutdown(ctx context.Context) (err error) {
+	return r.shutdownWith(ctx, 0)
+}
+
+// shutdownWith 优雅关闭, flags 是 SHUTDOWN 的参数
+func (r *RedisServer) shutdownWith(ctx context.Context, flags int) (err error) {
 
 	if atomic.LoadUint32(&r.status) != statusRunning {
-		return errStatusNotRunning
+		return ErrNotRunning
 	}
 
+	// OnOpen 拒绝新的连接
 	if !atomic.CompareAndSwapUint32(&r.status, statusRunning, statusShutdown) {
 		return
 	}
+	r.lg.Infof("User requested shutdown...")
+	// 先中断正在执行的命令, 否则等待客户端时会一直等到命令执行完
+	if r.cancel != nil {
+		r.cancel()
+	}
+	// gnet 停止之前不能单独关闭 listener, 先删除 unix socket 文件, 新的连接无法再连接
+	if path := config.Properties.UnixSocket; path != "" {
+		_ = os.Remove(path)
+	}
+
+	// 等待客户端执行完已经收到的命令
+	if flags&shutdownNow == 0 {
+		r.drainClients(ctx, time.Duration(config.Properties.ShutdownTimeout)*time.Second)
+	}
 
 	// stop redis engine
-	if err = r.shutdown0(ctx); err != nil {
+	if err = r.shutdown0(ctx, flags); err != nil {
 		r.lg.Errorf("stop dbEngine failed with error: %v", err)
 	}
 
+	r.metrics.close(ctx)
 	// stop network engine
 	if err = r.engine.Stop(ctx); err != nil {
 		r.lg.Errorf("stop network engine failed with error: %v", err)
 	}
+	// 等待 event loop 都退出, 嵌入在其他程序中时不留下 goroutine
+	if r.served != nil {
+		select {
+		case <-r.served:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
 
-	r.lg.Info("Redis is now ready to exit, bye bye...")
+	r.lg.Infof("Redis is now ready to exit, bye bye...")
 
 	atomic.StoreUint32(&r.status, statusClosed)
+	if r.closed != nil {
+		close(r.closed)
+	}
 	return
 }
 
-func (r *RedisServer) shutdown0(ctx context.Context) (err error) {
+func (r *RedisServer) shutdown0(ctx context.Context, flags int) (err error) {
+	// 与 redis 一样加载期间不保存 rdb, 没有加载完的数据会覆盖原来的文件. 在拒绝新的请求之前读取, 加载不会在这之后完成
+	loading := r.loading.Load()
 	// 拒绝新的请求
 	r.shutdown.Store(true)
+	r.closeClients()
 	processDone := make(chan struct{})
 
 	// 启动一个 goroutine 来等待所有现有请求处理完毕
@@ -147,62 +279,200 @@ func (r *RedisServer) shutdown0(ctx context.Context) (err error) {
 	// 使用 select 等待所有请求处理完毕或上下文超时
 	select {
 	case <-processDone:
-		r.lg.Info("User requested shutdown...")
+		if flags&shutdownSave != 0 && !loading {
+			r.lg.Infof("Saving the final RDB snapshot before exiting.")
+			if err = r.SaveRdb(); err != nil {
+				r.lg.Errorf("Error trying to save the DB: %v", err)
+			}
+		}
 		if config.Properties.AppendOnly {
+			r.lg.Infof("Calling fsync() on the AOF file.")
 			err = r.aof.Shutdown(ctx)
 		}
 	case <-ctx.Done():
-		r.lg.Error("Shutdown was canceled or timed out.")
+		r.lg.Errorf("Shutdown was canceled or timed out.")
 		err = ctx.Err()
 	}
 	return
 }
 
-func NewRedisServer() *RedisServer {
-	server := &RedisServer{}
+// NewRedisServer 按照 config.Properties 创建 server, storage-backend 创建 db 失败或者打开 aof 失败时返回错误
+func NewRedisServer() (*RedisServer, error) {
+	if !dict.Registered(config.Properties.StorageBackend) {
+		return nil, fmt.Errorf("unknown storage-backend %q, available: %v", config.Properties.StorageBackend, dict.Backends())
+	}
+	level, err := logger.ParseLevel(config.Properties.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(level)
+	obj.SetMaxIntsetEntries(config.Properties.SetMaxIntsetEntries)
+	dbs, err := initDbs()
+	if err != nil {
+		return nil, err
+	}
+	server := &RedisServer{dbs: dbs}
+	server.ctx, server.cancel = context.WithCancel(context.Background())
 	server.connManager = NewManager()
-	ConnCounter = server.connManager
-	server.dbs = initDbs()
+	server.shutdownReq = make(chan int, 1)
+	server.bindStats()
+	server.lastSave.Store(time.Now().Unix())
+	server.pubsub = NewPubSub()
+	server.tracking = NewTracking(server.connManager)
+	server.watches = NewWatches()
+	server.scripting = NewScripting(server)
+	server.repl = NewReplication(server)
+	server.bindNotifier()
+	server.bindPropagator()
 
 	if config.Properties.AppendOnly {
 		aofServer, err := NewAof(
-			server.process, config.Properties.AppendFilename, config.Properties.AppendFsync, func() (Exec, ForEach) {
-				tempServer := makeTempServer()
-				return tempServer.process, tempServer.ForEach
-			})
+			server.process, aofDirname(), config.Properties.AppendFilename, config.Properties.AppendFsync, server.Snapshot)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		server.bindPersister(aofServer)
 	}
 
 	server.status = statusInitialized
 	server.lg = logger.Named("redis-server")
-	return server
+	return server, nil
 }
 
-func initDbs() []*DB {
+// initDbs 创建 databases 个 db, storage-backend 创建 dict 失败时返回错误
+func initDbs() ([]*DB, error) {
 	dbs := make([]*DB, config.Properties.Databases)
 	for i := 0; i < config.Properties.Databases; i++ {
-		dbs[i] = NewDB(i, dict.MakeSimpleDict(), ttl.MakeSimple())
+		data, err := newDbDict(i)
+		if err != nil {
+			for _, db := range dbs[:i] {
+				closeDict(db.data)
+			}
+			return nil, err
+		}
+		dbs[i] = NewDB(i, data, ttl.MakeSimple(dbClock), dbClock)
 	}
-	return dbs
+	return dbs, nil
 }
 
-func makeTempServer() *RedisServer {
-	server := &RedisServer{}
-	server.dbs = initDbs()
-	return server
+func makeTempServer() (*RedisServer, error) {
+	dbs, err := initDbs()
+	if err != nil {
+		return nil, err
+	}
+	server := &RedisServer{dbs: dbs}
+	server.bindStats()
+	server.lastSave.Store(time.Now().Unix())
+	server.watches = NewWatches()
+	// aof 中的 FUNCTION LOAD 需要在临时的 server 中执行
+	server.scripting = NewScripting(server)
+	server.repl = NewReplication(server)
+	return server, nil
 }
 
-func (r *RedisServer) bindPersister(aof *Aof) {
-	r.aof = aof
+func (r *RedisServer) bindNotifier() {
+	if _, err := setKeyspaceEvents(config.Properties.NotifyKeyspaceEvents); err != nil {
+		logger.Errorf("invalid notify-keyspace-events %s", config.Properties.NotifyKeyspaceEvents)
+	}
 	for _, ddb := range r.dbs {
 		mDb := ddb
-		mDb.AddAof = func(cmdLine [][]byte) {
-			if config.Properties.AppendOnly {
-				r.aof.AppendAof(mDb.Index, cmdLine)
+		mDb.Notify = func(class int, event string, key string) {
+			// new 和 keymiss 不是对key的修改
+			if class != notifyNew && class != notifyKeyMiss {
+				r.signalModifiedKey(mDb.Index, key)
 			}
+			notifyKeyspaceEvent(r.pubsub, class, event, key, mDb.Index)
+		}
+		mDb.SignalFlushed = func() {
+			r.watches.TouchDb(mDb.Index)
+			r.tracking.InvalidateAll()
+		}
+		mDb.SignalReady = func(key string) {
+			r.signalKeyReady(mDb.Index, key)
+		}
+	}
+}
+
+// signalModifiedKey 修改 key 的副作用, 所有的写命令按照同样的顺序:
+//  1. 命令修改数据
+//  2. WATCH 这个 key 的客户端的 EXEC 失败, 然后给缓存了这个 key 的客户端发送失效消息
+//  3. 发布 keyspace event, 每个实际生效的操作一个事件
+//  4. 命令执行完之后写入 aof 和复制流, 然后唤醒等待这个 key 的 BLPOP/BRPOP. 被唤醒的客户端弹出元素时同样按照 1-4
+//     修改数据(lpop, 为空之后 del), 所以 LPUSH 推入的元素被取走之后 key 不会留在 db 中
+//
+// 调用方持有锁
+func (r *RedisServer) signalModifiedKey(dbIndex int, key string) {
+	r.watches.Touch(dbIndex, key)
+	r.tracking.InvalidateKey(key, r.currentClient)
+}
+
+// InfoPersistence INFO persistence, aof 打开时包含 base 和 incr 文件的大小
+func (r *RedisServer) InfoPersistence() string {
+	aofEnabled := config.Properties.AppendOnly && r.aof != nil
+	rewriting, rewriteStatus, writeStatus := false, "ok", "ok"
+	if aofEnabled {
+		rewriting = r.aof.Rewriting()
+		if r.aof.LastRewriteError() != nil {
+			rewriteStatus = "err"
+		}
+		if r.aof.WriteError() != nil {
+			writeStatus = "err"
 		}
 	}
+	info := fmt.Sprintf("# Persistence\r\n"+
+		"loading:%d\r\n"+
+		"rdb_changes_since_last_save:%d\r\n"+
+		"rdb_bgsave_in_progress:%d\r\n"+
+		"rdb_last_save_time:%d\r\n"+
+		"aof_enabled:%d\r\n"+
+		"aof_rewrite_in_progress:%d\r\n"+
+		"aof_last_bgrewrite_status:%s\r\n"+
+		"aof_last_write_status:%s\r\n",
+		boolToInt(r.loading.Load()),
+		r.dirty.Load(),
+		boolToInt(r.rdbSaving.Load()),
+		r.LastSave(),
+		boolToInt(aofEnabled),
+		boolToInt(rewriting),
+		rewriteStatus,
+		writeStatus,
+	)
+	if r.loading.Load() {
+		progress := &r.loadingProgress
+		info += fmt.Sprintf("loading_start_time:%d\r\n"+
+			"loading_total_bytes:%d\r\n"+
+			"loading_loaded_bytes:%d\r\n"+
+			"loading_loaded_perc:%.2f\r\n"+
+			"loading_eta_seconds:%d\r\n",
+			progress.startTime.Load()/int64(time.Second),
+			progress.totalBytes.Load(),
+			progress.loadedBytes.Load(),
+			progress.percent(),
+			progress.eta(),
+		)
+	}
+	if !aofEnabled {
+		return info
+	}
+	return info + fmt.Sprintf("aof_rewrites:%d\r\n"+
+		"aof_current_size:%d\r\n"+
+		"aof_base_size:%d\r\n"+
+		"aof_delayed_fsync:%d\r\n",
+		r.aof.Rewrites(),
+		r.aof.CurrentAofSize(),
+		r.aof.LasAofRewriteSize(),
+		r.aof.DelayedFsync(),
+	)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (r *RedisServer) bindPersister(aof *Aof) {
+	r.aof = aof
+	aof.progress = &r.loadingProgress
 }
@@ -0,0 +1,93 @@
+package redis
+
+import (
+	"context"
+	"github.com/panjf2000/gnet/v2"
+	"time"
+)
+
+// 优雅关闭: 先拒绝新的连接, 在 shutdown-timeout 秒内等待客户端执行完已经收到的命令并且回复都发送出去,
+// 关闭空闲的客户端之后再关闭订阅的客户端和复制连接, 最后 fsync aof 并停止网络服务.
+// SIGTERM、SIGINT 和 SHUTDOWN 命令都走这个流程
+
+// SHUTDOWN 的参数
+const (
+	// shutdownSave SAVE, 退出之前保存 rdb
+	shutdownSave = 1 << iota
+	// shutdownNow NOW, 不等待正在执行的命令
+	shutdownNow
+)
+
+// drainInterval 等待客户端空闲时检查的间隔
+const drainInterval = 10 * time.Millisecond
+
+// requestShutdown SHUTDOWN 命令通知 Spin 开始关闭, 调用方持有锁
+func (r *RedisServer) requestShutdown(flags int) {
+	select {
+	case r.shutdownReq <- flags:
+	default:
+		// 已经在关闭
+	}
+}
+
+// drainable 需要等待命令执行完的客户端, 订阅的客户端和复制连接不会主动结束, 最后再关闭. 调用方持有锁
+func drainable(client *Client) bool {
+	return client.conn != nil && !client.master && client.repl == nil && client.SubscriptionCount() == 0
+}
+
+// drainClients 关闭已经空闲的客户端, 直到没有需要等待的客户端或者超过 timeout
+func (r *RedisServer) drainClients(ctx context.Context, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		clients := make([]*Client, 0)
+		lock.Lock()
+		r.connManager.ForEach(func(client *Client) {
+			if drainable(client) {
+				clients = append(clients, client)
+			}
+		})
+		lock.Unlock()
+		for _, client := range clients {
+			client := client
+			// 在客户端所在的 event loop 中检查, 与 OnTraffic 不会同时读写客户端的缓冲区
+			_ = client.conn.AsyncWrite(nil, func(c gnet.Conn, err error) error {
+				if err == nil && clientIdle(client, c) {
+					_ = c.Close()
+				}
+				return nil
+			})
+		}
+		pending := len(clients)
+		if pending == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			r.lg.Warnf("%d clients are still busy after shutdown-timeout, closing them", pending)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// clientIdle 队列中没有命令, 没有解码了一半的命令, 回复也都已经发送出去. 在客户端所在的 event loop 中调用
+func clientIdle(client *Client, c gnet.Conn) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return !client.HasRemaining() && !client.codec.Pending() && client.bufferedReplies() == 0 &&
+		c.InboundBuffered() == 0 && c.OutboundBuffered() == 0
+}
+
+// closeClients 关闭剩下的客户端: 订阅的客户端、复制连接和超时之后仍然在执行命令的客户端
+func (r *RedisServer) closeClients() {
+	r.connManager.ForEach(func(client *Client) {
+		if client.conn != nil {
+			_ = client.conn.Close()
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownCommand(t *testing.T) {
+	server := newTestServer()
+	server.shutdownReq = make(chan int, 1)
+	client, _ := server.newClient()
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "shutdown", "save", "nosave"))
+	assert.Equal(t, "-ERR syntax error\r\n", server.exec(t, client, "shutdown", "abort"))
+	assert.Equal(t, 0, len(server.shutdownReq))
+
+	// 成功时没有回复, 由 Spin 执行关闭
+	assert.Equal(t, "", server.exec(t, client, "shutdown", "SAVE", "now"))
+	assert.Equal(t, shutdownSave|shutdownNow, <-server.shutdownReq)
+	assert.Equal(t, "", server.exec(t, client, "shutdown", "nosave"))
+	assert.Equal(t, 0, <-server.shutdownReq)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	server := newTestServer()
+	server.status = statusRunning
+	port := serve(t, server)
+	assert.Eventually(t, func() bool {
+		return server.connManager.CountConnections() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	expectEOF := func(reader *bufio.Reader) {
+		_, err := reader.ReadByte()
+		assert.Equal(t, io.EOF, err)
+	}
+	command := func(cmd string, args ...string) []byte {
+		return MakeMultiBulkReply(util.ToCmdLine(cmd, args...)).ToBytes()
+	}
+
+	idle, idleReader := dial()
+	subscriber, subscriberReader := dial()
+	_, _ = subscriber.Write(command("subscribe", "ch"))
+	subscribed := make([]byte, len("*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"))
+	_, _ = io.ReadFull(subscriberReader, subscribed)
+
+	// 回复比 socket 的缓冲区大很多, 客户端读取之前大部分回复还在服务端的缓冲区中
+	conn, reader := dial()
+	value := strings.Repeat("x", 1<<20)
+	_, _ = conn.Write(command("set", "big", value))
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "+OK\r\n", line)
+	const batch = 20
+	pipeline := make([]byte, 0)
+	for i := 0; i < batch; i++ {
+		pipeline = append(pipeline, command("get", "big")...)
+	}
+	pipeline = append(pipeline, command("ping")...)
+	_, _ = conn.Write(pipeline)
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, fmt.Sprintf("$%d\r\n", len(value)), line)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(context.Background())
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint32(&server.status) == statusShutdown
+	}, 5*time.Second, time.Millisecond)
+
+	// 不再接受新的连接
+	_, rejectedReader := dial()
+	line, _ = rejectedReader.ReadString('\n')
+	assert.Equal(t, "-ERR Server is shutting down\r\n", line)
+
+	// 流水线中的回复全部发送之后才关闭连接
+	buf := make([]byte, len(value)+2)
+	for i := 0; i < batch; i++ {
+		if i > 0 {
+			line, _ = reader.ReadString('\n')
+			assert.Equal(t, fmt.Sprintf("$%d\r\n", len(value)), line)
+		}
+		_, err := io.ReadFull(reader, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, value+"\r\n", string(buf))
+	}
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "+PONG\r\n", line)
+	expectEOF(reader)
+
+	assert.Nil(t, <-done)
+	expectEOF(idleReader)
+	expectEOF(subscriberReader)
+	assert.Equal(t, uint32(statusClosed), atomic.LoadUint32(&server.status))
+	_ = idle.Close()
+}
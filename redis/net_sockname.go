@@ -0,0 +1,28 @@
+//go:build !windows
+
+package redis
+
+import (
+	"net"
+	"syscall"
+)
+
+// acceptedLocalAddr 连接实际的本地地址. gnet 的 LocalAddr 是 listener 的地址, 监听 0.0.0.0 时看不到客户端连接的是哪个地址,
+// 与 redis 一样用 getsockname 读取. 读取失败或者不是 TCP 连接时返回 nil
+func acceptedLocalAddr(fd int) net.Addr {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return nil
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr := &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+		if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); sa.ZoneId != 0 && err == nil {
+			addr.Zone = ifi.Name
+		}
+		return addr
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package redis
+
+import "net"
+
+// acceptedLocalAddr windows 上 gnet 使用标准库的连接, LocalAddr 已经是连接实际的本地地址
+func acceptedLocalAddr(fd int) net.Addr {
+	return nil
+}
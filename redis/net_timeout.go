@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/config"
+	"time"
+)
+
+// setKeepAlive 按照 tcp-keepalive 打开新连接的 SO_KEEPALIVE, 0 表示不打开
+func (r *RedisServer) setKeepAlive(c gnet.Conn) {
+	period := config.Properties.TcpKeepAlive
+	if period <= 0 || isUnixConn(c) {
+		return
+	}
+	if err := c.SetKeepAlivePeriod(time.Duration(period) * time.Second); err != nil {
+		r.lg.Warnf("set keepalive for %v failed: %v", c.RemoteAddr(), err)
+	}
+}
+
+// clientsCron 关闭超过 timeout 秒没有发送命令的客户端, 检查回复写不出去的客户端的 client-write-timeout.
+// 与 redis 一样, 主从复制的连接、订阅的客户端和被阻塞(暂停)的客户端不会空闲超时
+func (r *RedisServer) clientsCron() {
+	timeout := time.Duration(config.Properties.Timeout) * time.Second
+	writeTimeout := config.Properties.ClientWriteTimeout > 0
+	if timeout <= 0 && !writeTimeout {
+		return
+	}
+	// 脚本执行期间跳过, 下一次再检查
+	if !lock.TryLock() {
+		return
+	}
+	defer lock.Unlock()
+	now := time.Now()
+	r.connManager.ForEach(func(client *Client) {
+		if client.conn == nil || client.master || client.repl != nil {
+			return
+		}
+		if writeTimeout && client.OutputBytes() > 0 {
+			// 客户端不再发送命令时没有写入触发检查, 在它的 event loop 中检查
+			class := client.obufClass()
+			_ = client.conn.AsyncWrite(nil, func(gc gnet.Conn, err error) error {
+				if err == nil && !client.closeAsap.Load() {
+					client.checkWriteTimeout(gc, class, time.Now())
+				}
+				return nil
+			})
+		}
+		if timeout <= 0 || client.paused || client.blocked != nil || client.SubscriptionCount() > 0 {
+			return
+		}
+		if now.Sub(client.lastInteraction) <= timeout {
+			return
+		}
+		r.lg.Infof("Closing idle client %v", client.RemoteAddr())
+		_ = client.conn.Close()
+	})
+}
+
+// checkWriteTimeout 检查回复是否超过 client-write-timeout 毫秒没有写出任何字节. gnet 的写入不会阻塞 event loop,
+// socket 写不完的部分留在连接的输出缓冲区, 所以这里检查的是输出缓冲区有没有进展: 有输出缓冲区限制的一类客户端
+// (默认的 pubsub 和 replica)继续缓存, 由限制决定什么时候断开; 不限制的一类(默认的 normal)记录原因之后断开,
+// 避免不读取回复的客户端无限制地占用内存. 返回 true 表示正在断开. 在客户端的 event loop 中调用
+func (c *Client) checkWriteTimeout(gc gnet.Conn, class int, now time.Time) bool {
+	// 复制连接的推送不经过 socketWriter, 由 repl-timeout 检查
+	if c.master || c.repl != nil {
+		return false
+	}
+	outbound := int64(gc.OutboundBuffered())
+	sent := c.queuedBytes - outbound
+	if outbound == 0 {
+		c.lastSent, c.writeStalledSince = sent, time.Time{}
+		return false
+	}
+	if sent != c.lastSent || c.writeStalledSince.IsZero() {
+		// 上一次检查之后写出了数据, 重新计时
+		c.lastSent, c.writeStalledSince = sent, now
+		return false
+	}
+	timeout := time.Duration(config.Properties.ClientWriteTimeout) * time.Millisecond
+	stalled := now.Sub(c.writeStalledSince)
+	if timeout <= 0 || stalled <= timeout {
+		return false
+	}
+	if limit := currentOutputBufferLimits()[class]; limit.hard > 0 || limit.soft > 0 {
+		return false
+	}
+	c.closeAsync(fmt.Sprintf("Client id=%d addr=%s closed for write timeout (no progress for %dms, %s class, omem=%d).",
+		c.id, c.RemoteAddr(), stalled.Milliseconds(), obufClassNames[class], c.outputBytes.Load()))
+	return true
+}
@@ -0,0 +1,189 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientsCron(t *testing.T) {
+	defer func(timeout int) {
+		config.Properties.Timeout = timeout
+	}(config.Properties.Timeout)
+	server := newTestServer()
+	idle, idleConn := server.newClient()
+	active, activeConn := server.newClient()
+	subscriber, subscriberConn := server.newClient()
+	replicaClient, replicaConn := server.newClient()
+	server.exec(t, subscriber, "subscribe", "ch")
+	replicaClient.repl = &replica{}
+	past := time.Now().Add(-11 * time.Second)
+	for _, client := range []*Client{idle, active, subscriber, replicaClient} {
+		client.lastInteraction = past
+	}
+	server.exec(t, active, "ping")
+
+	// timeout 为0时不检查
+	server.clientsCron()
+	assert.False(t, idleConn.closed)
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, active, "config", "set", "timeout", "10"))
+	idle.lastInteraction = past
+	assert.Contains(t, server.exec(t, active, "client", "list"), " idle=11 ")
+	server.clientsCron()
+	assert.True(t, idleConn.closed)
+	assert.False(t, activeConn.closed)
+	// 订阅的客户端和从节点的连接不会超时
+	assert.False(t, subscriberConn.closed)
+	assert.False(t, replicaConn.closed)
+}
+
+func TestIdleClientTimeout(t *testing.T) {
+	timeout := config.Properties.Timeout
+	t.Cleanup(func() {
+		config.Properties.Timeout = timeout
+	})
+	config.Properties.Timeout = 1
+	server := newTestServer()
+	port := serve(t, server)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		return conn, bufio.NewReader(conn)
+	}
+	idleConn, idleReader := dial()
+	activeConn, activeReader := dial()
+
+	// 一直发送 PING 的客户端不会被关闭, 空闲的客户端收到 EOF
+	deadline := time.Now().Add(4 * time.Second)
+	_ = idleConn.SetReadDeadline(deadline)
+	closed := make(chan error, 1)
+	go func() {
+		_, err := idleReader.ReadByte()
+		closed <- err
+	}()
+	for {
+		select {
+		case err := <-closed:
+			assert.Equal(t, io.EOF, err)
+			_, err = activeConn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+			assert.Nil(t, err)
+			line, err := activeReader.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, "+PONG\r\n", line)
+			return
+		case <-time.After(200 * time.Millisecond):
+			_, err := activeConn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+			assert.Nil(t, err)
+			line, err := activeReader.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, "+PONG\r\n", line)
+		}
+	}
+}
+
+func TestCheckWriteTimeout(t *testing.T) {
+	useOutputBufferLimit(t)
+	defer func(timeout int) {
+		config.Properties.ClientWriteTimeout = timeout
+	}(config.Properties.ClientWriteTimeout)
+	config.Properties.ClientWriteTimeout = 100
+	server := newTestServer()
+	client, conn := server.newClient()
+	now := time.Now()
+
+	// 输出缓冲区是空的时候不计时
+	server.exec(t, client, "ping")
+	assert.False(t, client.checkWriteTimeout(conn, obufNormal, now))
+	assert.True(t, client.writeStalledSince.IsZero())
+
+	// 写不出去之后开始计时, 有进展时重新计时
+	client.queuedBytes += 1000
+	conn.outbound = 1000
+	assert.False(t, client.checkWriteTimeout(conn, obufNormal, now))
+	assert.Equal(t, now, client.writeStalledSince)
+	conn.outbound = 500
+	assert.False(t, client.checkWriteTimeout(conn, obufNormal, now.Add(90*time.Millisecond)))
+	assert.Equal(t, now.Add(90*time.Millisecond), client.writeStalledSince)
+	assert.False(t, client.checkWriteTimeout(conn, obufNormal, now.Add(150*time.Millisecond)))
+
+	// 有输出缓冲区限制的一类客户端继续缓存
+	config.Properties.ClientOutputBufferLimit = "pubsub 1mb 0 0"
+	assert.False(t, client.checkWriteTimeout(conn, obufPubSub, now.Add(time.Second)))
+	assert.False(t, conn.closed)
+	// timeout 为0时不检查
+	config.Properties.ClientWriteTimeout = 0
+	assert.False(t, client.checkWriteTimeout(conn, obufNormal, now.Add(time.Second)))
+	assert.False(t, conn.closed)
+
+	config.Properties.ClientWriteTimeout = 100
+	assert.True(t, client.checkWriteTimeout(conn, obufNormal, now.Add(time.Second)))
+	assert.True(t, conn.closed)
+	assert.True(t, client.closeAsap.Load())
+}
+
+func TestClientWriteTimeout(t *testing.T) {
+	defer func(timeout int) {
+		config.Properties.ClientWriteTimeout = timeout
+	}(config.Properties.ClientWriteTimeout)
+	config.Properties.ClientWriteTimeout = 200
+	server := newTestServer()
+	port := serve(t, server)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn
+	}
+	admin, _ := server.newClient()
+	server.exec(t, admin, "set", "big", strings.Repeat("v", 4<<20))
+
+	// 不读取回复的客户端, 几十 MB 的回复远远超过 socket 的缓冲区
+	connections := server.connManager.CountConnections()
+	slow := dial()
+	_ = slow.(*net.TCPConn).SetReadBuffer(4096)
+	for i := 0; i < 16; i++ {
+		_, err := slow.Write([]byte("*2\r\n$3\r\nGET\r\n$3\r\nbig\r\n"))
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return server.connManager.CountConnections() == connections+1 && server.exec(t, admin, "ping") == "+PONG\r\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 写超时期间其他的客户端不受影响
+	active := dial()
+	reader := bufio.NewReader(active)
+	ping := func() {
+		_, err := active.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		assert.Nil(t, err)
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "+PONG\r\n", line)
+	}
+	ping()
+	start := time.Now()
+	assert.Eventually(t, func() bool {
+		return server.connManager.CountConnections() == connections+1
+	}, 5*time.Second, 10*time.Millisecond)
+	// 200ms 的写超时, clientsCron 每秒检查一次
+	assert.Less(t, time.Since(start), 3*time.Second)
+	ping()
+}
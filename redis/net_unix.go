@@ -0,0 +1,43 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/config"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// removeStaleSocket 上一次没有正常退出时留下的 socket 文件需要删除, 但是不能删除其他进程正在监听的 socket
+func removeStaleSocket(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// chmodUnixSocket 按照 unixsocketperm 设置 socket 文件的权限, 与 redis 一致是八进制, 0 表示不修改
+func chmodUnixSocket() error {
+	path, perm := config.Properties.UnixSocket, config.Properties.UnixSocketPerm
+	if path == "" || perm == "" {
+		return nil
+	}
+	mode, err := strconv.ParseUint(perm, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid unixsocketperm %s", perm)
+	}
+	if mode == 0 {
+		return nil
+	}
+	return os.Chmod(path, os.FileMode(mode))
+}
+
+func isUnixConn(c gnet.Conn) bool {
+	return c.LocalAddr() != nil && c.LocalAddr().Network() == "unix"
+}
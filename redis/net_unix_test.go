@@ -0,0 +1,117 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readBulk 读取一个 bulk 回复
+func readBulk(t *testing.T, reader *bufio.Reader) string {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil {
+		t.Fatal(line)
+	}
+	buf := make([]byte, n+2)
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestUnixSocket(t *testing.T) {
+	bind, port, socket, perm := config.Properties.Bind, config.Properties.Port,
+		config.Properties.UnixSocket, config.Properties.UnixSocketPerm
+	t.Cleanup(func() {
+		config.Properties.Bind, config.Properties.Port = bind, port
+		config.Properties.UnixSocket, config.Properties.UnixSocketPerm = socket, perm
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Properties.Bind, config.Properties.Port = "127.0.0.1", listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	// t.TempDir 的路径中有大写字母
+	dir, err := os.MkdirTemp("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	config.Properties.UnixSocket = filepath.Join(dir, "Redis.sock")
+	_, err = listenAddrs()
+	assert.EqualError(t, err, "unixsocket "+config.Properties.UnixSocket+" must be lower case")
+	path := filepath.Join(dir, "redis.sock")
+	config.Properties.UnixSocket, config.Properties.UnixSocketPerm = path, "700"
+
+	// 上一次没有正常退出时留下的 socket 文件
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	addrs, err := listenAddrs()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("tcp://127.0.0.1:%d", config.Properties.Port), "unix://" + path}, addrs)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	server := newTestServer()
+	serveAddrs(t, server, []string{addrs[1], addrs[0]})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	send := func(cmd string, args ...string) {
+		_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine(cmd, args...)).ToBytes())
+	}
+	send("ping")
+	send("set", "key", "value")
+	send("get", "key")
+	for _, expected := range []string{"+PONG\r\n", "+OK\r\n", "$5\r\n", "value\r\n"} {
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, expected, line)
+	}
+
+	send("client", "info")
+	assert.Contains(t, readBulk(t, reader), fmt.Sprintf(" addr=%s:0 laddr=%s:0 ", path, path))
+	send("info", "server")
+	info := readBulk(t, reader)
+	assert.Contains(t, info, "unix_socket:"+path+"\r\n")
+	assert.Contains(t, info, fmt.Sprintf("tcp_port:%d\r\n", config.Properties.Port))
+
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+
+	// 正在监听的 socket 不能删除
+	_, err = listenAddrs()
+	assert.EqualError(t, err, path+" is already in use")
+}
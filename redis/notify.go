@@ -0,0 +1,158 @@
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// keyspace event 的类型, 与redis server.h 中的 NOTIFY_* 保持一致
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZSet                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyLoaded               // module only
+	notifyModule               // d
+	notifyNew                  // n
+	// notifyAll A 是 g$lshzxetd 的别名, 不包括 m 和 n
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZSet | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+var errInvalidEventClass = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+
+// keyspaceEventsFlags 当前生效的 notify-keyspace-events 配置
+var keyspaceEventsFlags int32 = 0
+
+// keyspaceEventsStringToFlags 把 notify-keyspace-events 的配置解析为flags
+func keyspaceEventsStringToFlags(classes string) (int, error) {
+	flags := 0
+	for i := 0; i < len(classes); i++ {
+		switch classes[i] {
+		case 'A':
+			flags |= notifyAll
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'l':
+			flags |= notifyList
+		case 's':
+			flags |= notifySet
+		case 'h':
+			flags |= notifyHash
+		case 'z':
+			flags |= notifyZSet
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 't':
+			flags |= notifyStream
+		case 'm':
+			flags |= notifyKeyMiss
+		case 'd':
+			flags |= notifyModule
+		case 'n':
+			flags |= notifyNew
+		default:
+			return 0, errInvalidEventClass
+		}
+	}
+	return flags, nil
+}
+
+// keyspaceEventsFlagsToString 把flags渲染为配置字符串, 用于 CONFIG GET
+func keyspaceEventsFlagsToString(flags int) string {
+	res := make([]byte, 0, 16)
+	if flags&notifyAll == notifyAll {
+		res = append(res, 'A')
+	} else {
+		if flags&notifyGeneric != 0 {
+			res = append(res, 'g')
+		}
+		if flags&notifyString != 0 {
+			res = append(res, '$')
+		}
+		if flags&notifyList != 0 {
+			res = append(res, 'l')
+		}
+		if flags&notifySet != 0 {
+			res = append(res, 's')
+		}
+		if flags&notifyHash != 0 {
+			res = append(res, 'h')
+		}
+		if flags&notifyZSet != 0 {
+			res = append(res, 'z')
+		}
+		if flags&notifyExpired != 0 {
+			res = append(res, 'x')
+		}
+		if flags&notifyEvicted != 0 {
+			res = append(res, 'e')
+		}
+		if flags&notifyStream != 0 {
+			res = append(res, 't')
+		}
+		if flags&notifyModule != 0 {
+			res = append(res, 'd')
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		res = append(res, 'K')
+	}
+	if flags&notifyKeyevent != 0 {
+		res = append(res, 'E')
+	}
+	if flags&notifyKeyMiss != 0 {
+		res = append(res, 'm')
+	}
+	if flags&notifyNew != 0 {
+		res = append(res, 'n')
+	}
+	return string(res)
+}
+
+// setKeyspaceEvents 修改 notify-keyspace-events, 返回规范化之后的配置
+func setKeyspaceEvents(classes string) (string, error) {
+	flags, err := keyspaceEventsStringToFlags(classes)
+	if err != nil {
+		return "", err
+	}
+	atomic.StoreInt32(&keyspaceEventsFlags, int32(flags))
+	return keyspaceEventsFlagsToString(flags), nil
+}
+
+// notifyKeyspaceEvent 按照 notify-keyspace-events 的配置发布 keyspace/keyevent 消息
+//
+//	__keyspace@<db>__:<key> -> event
+//	__keyevent@<db>__:<event> -> key
+func notifyKeyspaceEvent(pubsub *PubSub, class int, event string, key string, dbIndex int) {
+	flags := int(atomic.LoadInt32(&keyspaceEventsFlags))
+	if flags&class == 0 {
+		return
+	}
+	dbStr := strconv.Itoa(dbIndex)
+	if flags&notifyKeyspace != 0 {
+		channel := "__keyspace@" + dbStr + "__:" + key
+		pubsub.Publish(channel, []byte(event))
+	}
+	if flags&notifyKeyevent != 0 {
+		channel := "__keyevent@" + dbStr + "__:" + event
+		pubsub.Publish(channel, []byte(key))
+	}
+}
@@ -0,0 +1,103 @@
+package redis
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceEventsFlags(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Kg$", "g$K"},
+		{"El", "lE"},
+		{"Exe", "xeE"},
+		{"g$lshzxetdKE", "AKE"},
+		{"Am", "Am"},
+		{"Kn", "Kn"},
+	}
+	for _, tc := range testCases {
+		flags, err := keyspaceEventsStringToFlags(tc.input)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.want, keyspaceEventsFlagsToString(flags))
+	}
+	_, err := keyspaceEventsStringToFlags("KEQ")
+	assert.NotNil(t, err)
+}
+
+func TestNotifyKeyspaceEvents(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	defer setKeyspaceEvents("")
+	subscriber, subConn := server.newClient()
+	client, _ := server.newClient()
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "notify-keyspace-events", "KEA"))
+	assert.Equal(t, "*2\r\n$22\r\nnotify-keyspace-events\r\n$3\r\nAKE\r\n",
+		server.exec(t, client, "config", "get", "notify-keyspace-events"))
+	assert.Equal(t, "AKE", config.Properties.NotifyKeyspaceEvents)
+
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$22\r\n__keyevent@0__:expired\r\n:1\r\n",
+		server.exec(t, subscriber, "psubscribe", "__keyevent@0__:expired"))
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$18\r\n__keyspace@0__:foo\r\n:2\r\n",
+		server.exec(t, subscriber, "subscribe", "__keyspace@0__:foo"))
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "foo", "bar", "px", "10"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$18\r\n__keyspace@0__:foo\r\n$3\r\nset\r\n"+
+		"*3\r\n$7\r\nmessage\r\n$18\r\n__keyspace@0__:foo\r\n$6\r\nexpire\r\n", subConn.take())
+
+	clk.Advance(20 * time.Millisecond)
+	server.cron()
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$18\r\n__keyspace@0__:foo\r\n$7\r\nexpired\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$22\r\n__keyevent@0__:expired\r\n$22\r\n__keyevent@0__:expired\r\n$3\r\nfoo\r\n",
+		subConn.take())
+
+	// 订阅模式下不允许执行普通命令
+	assert.Equal(t, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET "+
+		"are allowed in this context\r\n", server.exec(t, subscriber, "get", "foo"))
+
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - "+
+		"Invalid event class character. Use 'Ag$lshzxeKEtmdn'.\r\n",
+		server.exec(t, client, "config", "set", "notify-keyspace-events", "KEQ"))
+}
+
+func TestPublish(t *testing.T) {
+	server := newTestServer()
+	subscriber, subConn := server.newClient()
+	client, _ := server.newClient()
+	server.exec(t, subscriber, "subscribe", "news")
+	server.exec(t, subscriber, "psubscribe", "n*")
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "publish", "news", "hello"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n", subConn.take())
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n", server.exec(t, subscriber, "unsubscribe"))
+	server.freeClient(subscriber)
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "publish", "news", "hello"))
+}
+
+// TestPublishResp3 RESP3 的订阅模式下可以执行所有的命令, 推送只出现在两条回复之间
+func TestPublishResp3(t *testing.T) {
+	server := newTestServer()
+	subscriber, subConn := server.newClient()
+	client, _ := server.newClient()
+	server.exec(t, subscriber, "hello", "3")
+	assert.Equal(t, ">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n", server.exec(t, subscriber, "subscribe", "news"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, subscriber, "set", "foo", "bar"))
+
+	// 自己的 PUBLISH 的推送在回复之前, 和 redis 一样
+	subscriber.PushCmd(util.ToCmdLine("publish", "news", "hi"))
+	subscriber.PushCmd(util.ToCmdLine("get", "foo"))
+	assert.NoError(t, server.process(context.Background(), subscriber))
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n:1\r\n$3\r\nbar\r\n", subConn.take())
+	// 其他客户端的 PUBLISH 在订阅者的 event loop 中写入
+	assert.Equal(t, ":1\r\n", server.exec(t, client, "publish", "news", "hello"))
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n", subConn.take())
+	assert.Equal(t, "_\r\n", server.exec(t, subscriber, "get", "missing"))
+}
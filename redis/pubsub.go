@@ -0,0 +1,143 @@
+package redis
+
+import (
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+var (
+	messageBytes      = []byte("message")
+	pmessageBytes     = []byte("pmessage")
+	subscribeBytes    = []byte("subscribe")
+	unsubscribeBytes  = []byte("unsubscribe")
+	psubscribeBytes   = []byte("psubscribe")
+	punsubscribeBytes = []byte("punsubscribe")
+)
+
+// PubSub 发布订阅的订阅关系
+// 所有的命令都在 process 的全局锁内执行, 所以这里不需要额外的锁
+type PubSub struct {
+	// channels channel -> 订阅了这个channel的客户端
+	channels map[string]map[*Client]struct{}
+	// patterns pattern -> 订阅了这个pattern的客户端
+	patterns map[string]map[*Client]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*Client]struct{}),
+		patterns: make(map[string]map[*Client]struct{}),
+	}
+}
+
+func (p *PubSub) Subscribe(client *Client, channel string) bool {
+	if _, ok := client.subChannels[channel]; ok {
+		return false
+	}
+	client.subChannels[channel] = struct{}{}
+	clients, ok := p.channels[channel]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		p.channels[channel] = clients
+	}
+	clients[client] = struct{}{}
+	return true
+}
+
+func (p *PubSub) Unsubscribe(client *Client, channel string) bool {
+	if _, ok := client.subChannels[channel]; !ok {
+		return false
+	}
+	delete(client.subChannels, channel)
+	if clients, ok := p.channels[channel]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(p.channels, channel)
+		}
+	}
+	return true
+}
+
+func (p *PubSub) PSubscribe(client *Client, pattern string) bool {
+	if _, ok := client.subPatterns[pattern]; ok {
+		return false
+	}
+	client.subPatterns[pattern] = struct{}{}
+	clients, ok := p.patterns[pattern]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		p.patterns[pattern] = clients
+	}
+	clients[client] = struct{}{}
+	return true
+}
+
+func (p *PubSub) PUnsubscribe(client *Client, pattern string) bool {
+	if _, ok := client.subPatterns[pattern]; !ok {
+		return false
+	}
+	delete(client.subPatterns, pattern)
+	if clients, ok := p.patterns[pattern]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(p.patterns, pattern)
+		}
+	}
+	return true
+}
+
+// UnsubscribeAll 连接关闭时清理这个客户端所有的订阅
+func (p *PubSub) UnsubscribeAll(client *Client) {
+	for channel := range client.subChannels {
+		p.Unsubscribe(client, channel)
+	}
+	for pattern := range client.subPatterns {
+		p.PUnsubscribe(client, pattern)
+	}
+}
+
+// Publish 向channel发布消息, 返回收到消息的客户端数量
+func (p *PubSub) Publish(channel string, message []byte) int64 {
+	var receivers int64 = 0
+	if clients, ok := p.channels[channel]; ok {
+		reply := MakePushReply([]Reply{MakeBulkReply(messageBytes), MakeBulkReply([]byte(channel)), MakeBulkReply(message)})
+		for client := range clients {
+			if err := client.Push(reply); err == nil {
+				receivers++
+			}
+		}
+	}
+	for pattern, clients := range p.patterns {
+		if !util.GlobMatch(pattern, channel) {
+			continue
+		}
+		reply := MakePushReply([]Reply{MakeBulkReply(pmessageBytes), MakeBulkReply([]byte(pattern)),
+			MakeBulkReply([]byte(channel)), MakeBulkReply(message)})
+		for client := range clients {
+			if err := client.Push(reply); err == nil {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// NumPat 返回所有被订阅的pattern数量
+func (p *PubSub) NumPat() int {
+	return len(p.patterns)
+}
+
+// NumSub 返回channel的订阅者数量
+func (p *PubSub) NumSub(channel string) int {
+	return len(p.channels[channel])
+}
+
+// Channels 返回至少有一个订阅者的channel
+func (p *PubSub) Channels(pattern string) []string {
+	result := make([]string, 0)
+	for channel := range p.channels {
+		if pattern == "" || util.GlobMatch(pattern, channel) {
+			result = append(result, channel)
+		}
+	}
+	return result
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package redis
+
+// raceEnabled -race 时为 true, 依赖内存统计或者耗时很长的测试可以跳过
+const raceEnabled = true
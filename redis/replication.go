@@ -0,0 +1,961 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 从节点到主节点的连接状态, 与 redis server.h 中的 REPL_STATE_* 对应
+const (
+	replStateNone = iota
+	// replStateConnect 等待连接主节点
+	replStateConnect
+	replStateConnecting
+	// replStateHandshake 发送 PING, REPLCONF 和 PSYNC
+	replStateHandshake
+	// replStateTransfer 接收主节点的 rdb
+	replStateTransfer
+	replStateConnected
+)
+
+// 从节点在主节点上的状态, 与 redis server.h 中的 SLAVE_STATE_* 对应
+const (
+	replicaWaitBgsave = iota
+	replicaSendBulk
+	replicaOnline
+)
+
+const (
+	// replAckPeriod 从节点发送 REPLCONF ACK 的间隔
+	replAckPeriod = time.Second
+	// replReconnectDelay 连接主节点失败之后重试的间隔
+	replReconnectDelay = time.Second
+	// replEOFMarkSize diskless 同步时 rdb 结束标记的长度
+	replEOFMarkSize = 40
+)
+
+// replPingPeriod 主节点向从节点发送 PING 的间隔, repl-ping-replica-period
+func replPingPeriod() time.Duration {
+	return time.Duration(config.Properties.ReplPingPeriod) * time.Second
+}
+
+// replTimeout 超过这个时间没有收到对方的数据就断开连接, repl-timeout
+func replTimeout() time.Duration {
+	return time.Duration(config.Properties.ReplTimeout) * time.Second
+}
+
+// emptyReplId 没有 replId2 时 INFO 中显示的值
+var emptyReplId = strings.Repeat("0", 40)
+
+// newReplId 与 redis 一样, 40 个随机的十六进制字符
+func newReplId() string {
+	return util.RandHex(40)
+}
+
+// replica 连接到当前节点的一个从节点
+type replica struct {
+	client *Client
+	state  int
+	// listeningPort REPLCONF listening-port, INFO replication 使用
+	listeningPort int
+	// pending 发送 rdb 期间产生的复制流, rdb 发送完成之后再发送
+	pending []byte
+	// ackOffset 从节点 REPLCONF ACK 确认的偏移量
+	ackOffset int64
+	// ackTime 最后一次收到 REPLCONF ACK 的时间, lag 和超时都按照它计算
+	ackTime time.Time
+}
+
+// send 发送复制流, rdb 还没有发送完成时先缓存起来
+func (rp *replica) send(data []byte) {
+	if rp.state != replicaOnline {
+		rp.pending = append(rp.pending, data...)
+		return
+	}
+	_ = rp.client.asyncWrite(data, obufReplica)
+}
+
+// ip 从节点的地址, FAILOVER TO 和 INFO replication 使用
+func (rp *replica) ip() string {
+	if addr, ok := rp.client.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+func (rp *replica) stateName() string {
+	switch rp.state {
+	case replicaWaitBgsave:
+		return "wait_bgsave"
+	case replicaSendBulk:
+		return "send_bulk"
+	default:
+		return "online"
+	}
+}
+
+// Replication 主从复制. 主节点把写命令追加到复制流发送给所有的从节点,
+// 从节点连接主节点, 全量同步 rdb 之后执行主节点发送的复制流
+type Replication struct {
+	server *RedisServer
+	lg     logger.Logger
+
+	// masterHost 和 masterPort 只在执行 REPLICAOF 时修改, 持有全局锁时读写
+	masterHost string
+	masterPort int
+	// master 执行主节点命令的客户端, 断线之后保留下来, 部分重同步时继续使用它选择的db. 持有全局锁时读写
+	master *Client
+
+	// 下面的字段会被同步 rdb 和连接主节点的协程读写, 由 mux 保护
+	mux sync.Mutex
+	// replId 复制流的id, 从节点全量同步之后使用主节点的 replId
+	replId string
+	// replId2 切换主节点之前的 replId, 偏移量不超过 secondOffset 的 PSYNC 也可以部分重同步
+	replId2      string
+	secondOffset int64
+	// offset 复制流的偏移量, 从节点上是已经执行的主节点复制流的偏移量
+	offset int64
+	// backlog 第一个从节点连接的时候创建, 之后一直保留
+	backlog *replBacklog
+	// replDb 复制流中最后一次 SELECT 的db, -1 表示下一条命令之前需要 SELECT
+	replDb   int
+	replicas map[*Client]*replica
+	lastPing time.Time
+	// 全量同步和部分重同步的次数, INFO stats 使用
+	syncFull       int64
+	syncPartialOk  int64
+	syncPartialErr int64
+	// state 从节点到主节点的连接状态
+	state int
+	// failover 正在执行的 FAILOVER
+	failover failoverState
+	// cancel 断开到主节点的连接
+	cancel context.CancelFunc
+	// lastIO 最后一次收到主节点数据的时间
+	lastIO time.Time
+	// timeout 读写主节点连接的超时时间, 持有 mux 时读写, replicationCron 从配置中更新
+	timeout time.Duration
+	// ackNow 主节点发送 REPLCONF GETACK 之后通知发送 ACK 的协程立即发送
+	ackNow chan struct{}
+	// linkDownSince 到主节点的连接断开的时间, 从来没有连接上时为空
+	linkDownSince time.Time
+}
+
+func NewReplication(server *RedisServer) *Replication {
+	return &Replication{
+		server:       server,
+		lg:           logger.Named("replication"),
+		replId:       newReplId(),
+		replId2:      emptyReplId,
+		secondOffset: -1,
+		timeout:      replTimeout(),
+		ackNow:       make(chan struct{}, 1),
+		replDb:       -1,
+		replicas:     make(map[*Client]*replica),
+	}
+}
+
+// IsReplica 当前节点是从节点, 调用方持有锁
+func (rp *Replication) IsReplica() bool {
+	return rp.masterHost != ""
+}
+
+/* ---- master ---- */
+
+// feed 把写命令追加到复制流, 调用方持有锁. 从节点执行的主节点命令由 feedRaw 原样转发,
+// 可写的从节点上普通客户端的写命令只在本地生效, 不发送给子节点
+func (rp *Replication) feed(dbIndex int, cmdLine [][]byte, fromMaster bool) {
+	if fromMaster || rp.IsReplica() {
+		return
+	}
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	// 没有从节点连接过时不需要复制流
+	if rp.backlog == nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	if dbIndex >= 0 && dbIndex != rp.replDb {
+		buf.Write(MakeMultiBulkReply(util.ToCmdLine("SELECT", strconv.Itoa(dbIndex))).ToBytes())
+		rp.replDb = dbIndex
+	}
+	buf.Write(MakeMultiBulkReply(cmdLine).ToBytes())
+	rp.propagate(buf.Bytes())
+}
+
+// feedRaw 从节点执行完主节点的命令之后在锁内更新偏移量, 并转发给自己的从节点
+func (rp *Replication) feedRaw(cmdLine [][]byte) {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	rp.propagate(MakeMultiBulkReply(cmdLine).ToBytes())
+}
+
+// propagate 写入积压缓冲区并发送给所有的从节点, 调用方持有 rp.mux
+func (rp *Replication) propagate(data []byte) {
+	rp.offset += int64(len(data))
+	if rp.backlog != nil {
+		rp.backlog.resize(config.Properties.ReplBacklogSize)
+		rp.backlog.write(data)
+	}
+	for _, r := range rp.replicas {
+		r.send(data)
+	}
+}
+
+// replicaFor 客户端对应的从节点, 第一次执行 REPLCONF 时创建, 调用方持有锁
+func (rp *Replication) replicaFor(conn *Client) *replica {
+	if conn.repl == nil {
+		conn.repl = &replica{client: conn, ackTime: time.Now()}
+	}
+	return conn.repl
+}
+
+// ack REPLCONF ACK offset
+func (rp *Replication) ack(conn *Client, offset int64) {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	if r, ok := rp.replicas[conn]; ok {
+		// 乱序到达的 ACK 不会让偏移量后退
+		if offset > r.ackOffset {
+			r.ackOffset = offset
+		}
+		r.ackTime = time.Now()
+		rp.server.ackReceived()
+	}
+}
+
+// ackedReplicas 确认的偏移量不小于 offset 的从节点个数, WAIT 的回复
+func (rp *Replication) ackedReplicas(offset int64) int {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	acked := 0
+	for _, r := range rp.replicas {
+		if r.state == replicaOnline && r.ackOffset >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
+// sync PSYNC 和 SYNC. 请求的数据还在积压缓冲区中时部分重同步, 否则在持有锁的时候创建快照,
+// 然后在后台把快照编码成 rdb 发送给从节点. 调用方持有锁
+func (rp *Replication) sync(conn *Client, psync bool, replId string, offset int64) error {
+	rp.mux.Lock()
+	if rp.IsReplica() && rp.state != replStateConnected {
+		rp.mux.Unlock()
+		return MakeStandardErrReply("NOMASTERLINK Can't SYNC while not connected with my master").WriteTo(conn)
+	}
+	// 已经是从节点的连接重复执行 PSYNC 时忽略
+	if _, ok := rp.replicas[conn]; ok {
+		rp.mux.Unlock()
+		return nil
+	}
+	if psync {
+		if ok, err := rp.partialSync(conn, replId, offset); ok {
+			rp.mux.Unlock()
+			return err
+		}
+		// PSYNC ? -1 是从节点主动要求全量同步, 不算失败
+		if replId != "?" {
+			rp.syncPartialErr++
+		}
+	}
+	if rp.backlog == nil {
+		// 之前的复制流没有保存下来, 使用新的 replId
+		rp.replId, rp.replId2, rp.secondOffset = newReplId(), emptyReplId, -1
+		rp.backlog = newReplBacklog(config.Properties.ReplBacklogSize, rp.offset)
+	}
+	r := rp.replicaFor(conn)
+	r.state = replicaWaitBgsave
+	r.ackTime = time.Now()
+	rp.replicas[conn] = r
+	rp.syncFull++
+	// 快照之后的第一条命令需要 SELECT
+	rp.replDb = -1
+	replId, offset = rp.replId, rp.offset
+	rp.mux.Unlock()
+
+	snapshot := rp.server.Snapshot()
+	// 从节点原样转发主节点的复制流, 子节点需要知道复制流当前选择的db
+	streamDb := -1
+	if rp.master != nil {
+		streamDb = rp.master.GetDbIndex()
+	}
+	rp.lg.Infof("Replica %s asks for synchronization, starting BGSAVE for SYNC with target: socket", conn.RemoteAddr())
+	go rp.sendRdb(r, snapshot, streamDb)
+	if !psync {
+		return nil
+	}
+	return MakeSimpleReply([]byte(fmt.Sprintf("FULLRESYNC %s %d", replId, offset))).WriteTo(conn)
+}
+
+// partialSync PSYNC replid offset 请求的数据都在积压缓冲区中时回复 +CONTINUE, 然后只发送缺失的部分. 调用方持有 rp.mux
+func (rp *Replication) partialSync(conn *Client, replId string, offset int64) (bool, error) {
+	if rp.backlog == nil || replId == "?" {
+		return false, nil
+	}
+	if replId != rp.replId && (replId != rp.replId2 || offset > rp.secondOffset) {
+		if replId != rp.replId2 {
+			rp.lg.Infof("Partial resynchronization not accepted: Replication ID mismatch "+
+				"(Replica asked for '%s', my replication IDs are '%s' and '%s')", replId, rp.replId, rp.replId2)
+		} else {
+			rp.lg.Infof("Partial resynchronization not accepted: Requested offset for second ID was %d, "+
+				"but I can reply up to %d", offset, rp.secondOffset)
+		}
+		return false, nil
+	}
+	data, ok := rp.backlog.readFrom(offset)
+	if !ok {
+		rp.lg.Infof("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).",
+			conn.RemoteAddr(), offset)
+		return false, nil
+	}
+	r := rp.replicaFor(conn)
+	r.state = replicaOnline
+	r.ackTime = time.Now()
+	rp.replicas[conn] = r
+	rp.syncPartialOk++
+	rp.lg.Infof("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.",
+		conn.RemoteAddr(), len(data), offset)
+	// 在 event loop 中直接写入, 之后的复制流通过 AsyncWrite 发送, 顺序不会乱
+	if _, err := conn.Write([]byte("+CONTINUE " + rp.replId + CRLF)); err != nil {
+		return true, err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return true, err
+	}
+	return true, conn.Flush()
+}
+
+// sendRdb 编码快照发送给从节点, 然后发送编码期间产生的复制流
+func (rp *Replication) sendRdb(r *replica, snapshot *Snapshot, streamDb int) {
+	defer snapshot.Release()
+	buf := &bytes.Buffer{}
+	var aux [][2]string
+	if streamDb >= 0 {
+		aux = append(aux, [2]string{"repl-stream-db", strconv.Itoa(streamDb)})
+	}
+	err := encodeRdb(buf, snapshot.ForEach, snapshot.ForEachLibrary, aux...)
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	// 编码期间从节点已经断开
+	if rp.replicas[r.client] != r {
+		return
+	}
+	if err != nil {
+		rp.lg.Errorf("Background RDB transfer error: %v", err)
+		delete(rp.replicas, r.client)
+		_ = r.client.conn.Close()
+		return
+	}
+	r.state = replicaSendBulk
+	payload := append([]byte(fmt.Sprintf("$%d\r\n", buf.Len())), buf.Bytes()...)
+	_ = r.client.conn.AsyncWrite(payload, nil)
+	r.state = replicaOnline
+	r.ackTime = time.Now()
+	if len(r.pending) > 0 {
+		_ = r.client.asyncWrite(r.pending, obufReplica)
+		r.pending = nil
+	}
+	rp.lg.Infof("Synchronization with replica %s succeeded", r.client.RemoteAddr())
+}
+
+// removeReplica 从节点的连接关闭, 调用方持有锁
+func (rp *Replication) removeReplica(conn *Client) {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	if _, ok := rp.replicas[conn]; ok {
+		delete(rp.replicas, conn)
+		rp.lg.Infof("Connection with replica %s lost", conn.RemoteAddr())
+	}
+}
+
+// disconnectReplicas 数据被主节点替换之后, 从节点需要重新同步
+func (rp *Replication) disconnectReplicas() {
+	for conn := range rp.replicas {
+		_ = conn.conn.Close()
+		delete(rp.replicas, conn)
+	}
+}
+
+// cron 主节点定时向从节点发送 PING, 并断开超过 repl-timeout 没有 ACK 的从节点
+func (rp *Replication) cron() {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	now := time.Now()
+	rp.timeout = replTimeout()
+	for conn, r := range rp.replicas {
+		if r.state == replicaOnline && now.Sub(r.ackTime) > rp.timeout {
+			rp.lg.Warnf("Disconnecting timedout replica: %s", conn.RemoteAddr())
+			delete(rp.replicas, conn)
+			_ = conn.conn.Close()
+		}
+	}
+	// 从节点转发主节点的 PING; 暂停写命令期间偏移量保持不变, FAILOVER 才能等到从节点追上
+	if rp.state != replStateNone || len(rp.replicas) == 0 || rp.server.writesPaused ||
+		now.Sub(rp.lastPing) < replPingPeriod() {
+		return
+	}
+	rp.lastPing = now
+	rp.propagate(MakeMultiBulkReply(util.ToCmdLine("PING")).ToBytes())
+}
+
+// RequestAcks 在复制流中追加 REPLCONF GETACK *, 从节点收到之后立即回复 ACK. 调用方持有锁
+func (rp *Replication) RequestAcks() {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	if rp.state != replStateNone || len(rp.replicas) == 0 {
+		return
+	}
+	rp.propagate(MakeMultiBulkReply(util.ToCmdLine("REPLCONF", "GETACK", "*")).ToBytes())
+}
+
+// ackMaster 执行主节点的 REPLCONF GETACK, 通知发送 ACK 的协程. 调用方持有锁
+func (rp *Replication) ackMaster() {
+	select {
+	case rp.ackNow <- struct{}{}:
+	default:
+	}
+}
+
+// linkTimeout 主节点连接的超时时间
+func (rp *Replication) linkTimeout() time.Duration {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	return rp.timeout
+}
+
+/* ---- replica ---- */
+
+// ReplicaOf REPLICAOF host port, 断开当前的主节点之后在后台连接新的主节点. 调用方持有锁
+func (rp *Replication) ReplicaOf(host string, port int) bool {
+	if rp.masterHost == host && rp.masterPort == port {
+		return false
+	}
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	rp.stopLink()
+	rp.masterHost, rp.masterPort = host, port
+	rp.state = replStateConnect
+	// 从节点的数据会被新的主节点替换
+	rp.disconnectReplicas()
+	ctx, cancel := context.WithCancel(context.Background())
+	rp.cancel = cancel
+	go rp.connectMaster(ctx, host, port)
+	rp.lg.Infof("Connecting to MASTER %s:%d", host, port)
+	return true
+}
+
+// ReplicaOfNoOne REPLICAOF NO ONE, 断开主节点之后作为主节点继续提供服务. 调用方持有锁
+func (rp *Replication) ReplicaOfNoOne() {
+	if !rp.IsReplica() {
+		return
+	}
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	rp.stopLink()
+	rp.masterHost, rp.masterPort = "", 0
+	rp.master = nil
+	rp.state = replStateNone
+	rp.linkDownSince = time.Time{}
+	// 新的复制流, 原来的从节点可以用之前的 replId 部分重同步
+	rp.shiftReplId(newReplId())
+	rp.replDb = -1
+	rp.lg.Infof("MASTER MODE enabled")
+}
+
+// shiftReplId 切换到新的 replId, 之前的复制流到当前的偏移量为止, 调用方持有 rp.mux
+func (rp *Replication) shiftReplId(replId string) {
+	rp.replId2, rp.secondOffset = rp.replId, rp.offset+1
+	rp.replId = replId
+	if rp.backlog == nil {
+		rp.backlog = newReplBacklog(config.Properties.ReplBacklogSize, rp.offset)
+	}
+}
+
+// ChangeReplId DEBUG CHANGE-REPL-ID, 换成新的 replId 并且清空 replId2, 之后的 PSYNC 都需要全量同步. 调用方持有锁
+func (rp *Replication) ChangeReplId() {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	rp.replId, rp.replId2, rp.secondOffset = newReplId(), emptyReplId, -1
+}
+
+// stopLink 调用方持有 rp.mux
+func (rp *Replication) stopLink() {
+	if rp.cancel != nil {
+		rp.cancel()
+		rp.cancel = nil
+	}
+	if rp.state == replStateConnected {
+		rp.linkDownSince = time.Now()
+	}
+}
+
+func (rp *Replication) setState(ctx context.Context, state int) {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	// 已经执行了 REPLICAOF, 不能覆盖新的状态
+	if ctx.Err() != nil {
+		return
+	}
+	if rp.state == replStateConnected && state != replStateConnected {
+		rp.linkDownSince = time.Now()
+	}
+	rp.state = state
+}
+
+func (rp *Replication) touch() {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	rp.lastIO = time.Now()
+}
+
+// connectMaster 连接断开之后一直重试, 直到执行了 REPLICAOF
+func (rp *Replication) connectMaster(ctx context.Context, host string, port int) {
+	for {
+		err := rp.syncWithMaster(ctx, host, port)
+		if ctx.Err() != nil || errors.Is(err, ErrorsShutdown) {
+			return
+		}
+		rp.lg.Warnf("Connection with master %s:%d lost: %v", host, port, err)
+		rp.setState(ctx, replStateConnect)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replReconnectDelay):
+		}
+	}
+}
+
+// syncWithMaster 握手和同步, 然后执行主节点的复制流直到连接断开
+func (rp *Replication) syncWithMaster(ctx context.Context, host string, port int) error {
+	rp.setState(ctx, replStateConnecting)
+	// FAILOVER 的最后一步, 通知目标节点提升为主节点, 连接或者握手失败时放弃 FAILOVER
+	failover := rp.failoverPsync()
+	endFailover := func(err error) {
+		if failover {
+			lock.Lock()
+			rp.finishFailover(err)
+			lock.Unlock()
+		}
+	}
+	timeout := rp.linkTimeout()
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		endFailover(err)
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// 执行 REPLICAOF 之后关闭连接, 阻塞的读写会返回错误
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+	link := &masterLink{conn: conn, reader: bufio.NewReader(&linkReader{conn: conn, rp: rp}), timeout: timeout}
+
+	rp.setState(ctx, replStateHandshake)
+	// 断线之前的 replId 和偏移量一直保留在内存中, 重连之后尝试部分重同步
+	rp.mux.Lock()
+	replId, offset := rp.replId, rp.offset
+	rp.mux.Unlock()
+	result, err := link.handshake(replId, offset+1, failover)
+	endFailover(err)
+	if err != nil {
+		return err
+	}
+	var master *Client
+	if result.full {
+		master, err = rp.fullResync(ctx, link, result)
+	} else {
+		master, err = rp.continueSync(ctx, result.replId)
+	}
+	if err != nil {
+		return err
+	}
+	go link.sendAcks(done, rp)
+	return rp.streamCommands(ctx, link.reader, master)
+}
+
+// fullResync 接收主节点的 rdb, 替换所有的数据
+func (rp *Replication) fullResync(ctx context.Context, link *masterLink, result *psyncResult) (*Client, error) {
+	rp.setState(ctx, replStateTransfer)
+	rp.lg.Infof("Full resync from master: %s:%d", result.replId, result.offset)
+	payload, err := link.readRdb()
+	if err != nil {
+		return nil, err
+	}
+	loader, err := decodeRdb(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed trying to load the MASTER synchronization DB: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err = loader.apply(rp.server); err != nil {
+		return nil, err
+	}
+	rp.master = NewClient(0, nil, false)
+	rp.master.master = true
+	if loader.streamDb >= 0 {
+		rp.master.SetDbIndex(loader.streamDb)
+	}
+	rp.mux.Lock()
+	rp.replId, rp.replId2, rp.secondOffset = result.replId, emptyReplId, -1
+	rp.offset = result.offset
+	rp.backlog = newReplBacklog(config.Properties.ReplBacklogSize, rp.offset)
+	rp.state = replStateConnected
+	rp.disconnectReplicas()
+	rp.mux.Unlock()
+	// 和 redis 一样, 加载完成之后重写aof, 让aof中保存主节点的数据
+	if config.Properties.AppendOnly && rp.server.aof != nil {
+		if err = rp.server.aof.BgRewrite(); err != nil {
+			rp.lg.Warnf("Failed to rewrite the AOF after synchronization: %v", err)
+		}
+	}
+	rp.lg.Infof("MASTER <-> REPLICA sync: Finished with success")
+	return rp.master, nil
+}
+
+// continueSync 部分重同步, 继续执行断线之前的复制流. 主节点的 replId 变化时保留之前的 replId
+func (rp *Replication) continueSync(ctx context.Context, replId string) (*Client, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	// 之前是主节点, 新的主节点在切换之后的第一条命令之前会 SELECT
+	if rp.master == nil {
+		rp.master = NewClient(0, nil, false)
+		rp.master.master = true
+	}
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	if replId != rp.replId {
+		rp.shiftReplId(replId)
+		rp.lg.Infof("Master replication ID changed to %s", replId)
+	}
+	if rp.backlog == nil {
+		rp.backlog = newReplBacklog(config.Properties.ReplBacklogSize, rp.offset)
+	}
+	rp.state = replStateConnected
+	rp.lg.Infof("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+	return rp.master, nil
+}
+
+// streamCommands 按照顺序执行主节点发送的命令, 回复不会发送给主节点.
+// MULTI 和 EXEC 之间的命令在一次 process 中执行, 其他客户端看不到中间状态
+func (rp *Replication) streamCommands(ctx context.Context, reader *bufio.Reader, master *Client) error {
+	ch := DecodeInStream(reader)
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	var tx [][][]byte
+	for p := range ch {
+		if p.Error != nil {
+			return p.Error
+		}
+		reply, ok := p.Data.(*MultiBulkReply)
+		if !ok || len(reply.Args) == 0 {
+			return errors.New("protocol error: require multi bulk protocol")
+		}
+		name := strings.ToLower(string(reply.Args[0]))
+		if tx != nil || (name == "multi" && len(reply.Args) == 1) {
+			tx = append(tx, reply.Args)
+			if name != "exec" {
+				continue
+			}
+		} else {
+			tx = [][][]byte{reply.Args}
+		}
+		for _, cmdLine := range tx {
+			master.PushCmd(cmdLine)
+		}
+		tx = nil
+		if err := rp.server.process(ctx, master); err != nil {
+			return err
+		}
+	}
+	return io.EOF
+}
+
+// Info INFO replication, 调用方持有锁
+func (rp *Replication) Info() string {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	now := time.Now()
+	builder := &strings.Builder{}
+	builder.WriteString("# Replication\r\n")
+	if !rp.IsReplica() {
+		builder.WriteString("role:master\r\n")
+	} else {
+		linkStatus, lastIO := "down", -1
+		if rp.state == replStateConnected {
+			linkStatus = "up"
+		}
+		if !rp.lastIO.IsZero() {
+			lastIO = int(now.Sub(rp.lastIO).Seconds())
+		}
+		fmt.Fprintf(builder, "role:slave\r\n"+
+			"master_host:%s\r\n"+
+			"master_port:%d\r\n"+
+			"master_link_status:%s\r\n"+
+			"master_last_io_seconds_ago:%d\r\n"+
+			"master_sync_in_progress:%d\r\n"+
+			"slave_repl_offset:%d\r\n",
+			rp.masterHost, rp.masterPort, linkStatus, lastIO,
+			boolToInt(rp.state == replStateTransfer), rp.offset)
+		if rp.state != replStateConnected {
+			downSince := -1
+			if !rp.linkDownSince.IsZero() {
+				downSince = int(now.Sub(rp.linkDownSince).Seconds())
+			}
+			fmt.Fprintf(builder, "master_link_down_since_seconds:%d\r\n", downSince)
+		}
+		builder.WriteString("slave_read_only:1\r\n")
+	}
+	fmt.Fprintf(builder, "connected_slaves:%d\r\n", len(rp.replicas))
+	// 按照连接的顺序输出
+	replicas := make([]*replica, 0, len(rp.replicas))
+	for _, r := range rp.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].client.id < replicas[j].client.id
+	})
+	for i, r := range replicas {
+		fmt.Fprintf(builder, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, r.ip(), r.listeningPort, r.stateName(), r.ackOffset, int(now.Sub(r.ackTime).Seconds()))
+	}
+	fmt.Fprintf(builder, "master_failover_state:%s\r\n", rp.failover.stateName())
+	fmt.Fprintf(builder, "master_replid:%s\r\n"+
+		"master_replid2:%s\r\n"+
+		"master_repl_offset:%d\r\n"+
+		"second_repl_offset:%d\r\n",
+		rp.replId, rp.replId2, rp.offset, rp.secondOffset)
+	active, size, firstOffset, histlen := 0, config.Properties.ReplBacklogSize, int64(0), 0
+	if rp.backlog != nil {
+		active, size, firstOffset, histlen = 1, len(rp.backlog.buf), rp.backlog.start(), rp.backlog.histlen
+	}
+	fmt.Fprintf(builder, "repl_backlog_active:%d\r\n"+
+		"repl_backlog_size:%d\r\n"+
+		"repl_backlog_first_byte_offset:%d\r\n"+
+		"repl_backlog_histlen:%d\r\n",
+		active, size, firstOffset, histlen)
+	return builder.String()
+}
+
+// Offset 复制流的偏移量, CLUSTER SHARDS 中的 replication-offset
+func (rp *Replication) Offset() int64 {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	return rp.offset
+}
+
+// InfoStats INFO stats 中全量同步和部分重同步的次数
+func (rp *Replication) InfoStats() string {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	return fmt.Sprintf("# Stats\r\n"+
+		"sync_full:%d\r\n"+
+		"sync_partial_ok:%d\r\n"+
+		"sync_partial_err:%d\r\n",
+		rp.syncFull, rp.syncPartialOk, rp.syncPartialErr)
+}
+
+// linkReader 每次读取之前更新超时时间, 并记录最后一次收到主节点数据的时间
+type linkReader struct {
+	conn net.Conn
+	rp   *Replication
+}
+
+func (l *linkReader) Read(p []byte) (int, error) {
+	_ = l.conn.SetReadDeadline(time.Now().Add(l.rp.linkTimeout()))
+	n, err := l.conn.Read(p)
+	if n > 0 {
+		l.rp.touch()
+	}
+	return n, err
+}
+
+// masterLink 从节点到主节点的连接
+type masterLink struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// wmux 握手之后只有发送 ACK 的协程写入
+	wmux sync.Mutex
+	// timeout 写入的超时时间, 连接时的 repl-timeout
+	timeout time.Duration
+}
+
+func (l *masterLink) send(args ...string) error {
+	l.wmux.Lock()
+	defer l.wmux.Unlock()
+	_ = l.conn.SetWriteDeadline(time.Now().Add(l.timeout))
+	_, err := l.conn.Write(MakeMultiBulkReply(util.ToCmdLine(args[0], args[1:]...)).ToBytes())
+	return err
+}
+
+// readLine 读取一行回复, 跳过主节点准备 rdb 期间发送的空行
+func (l *masterLink) readLine() (string, error) {
+	for {
+		line, err := l.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			return line, nil
+		}
+	}
+}
+
+func (l *masterLink) command(args ...string) (string, error) {
+	if err := l.send(args...); err != nil {
+		return "", err
+	}
+	return l.readLine()
+}
+
+// psyncResult 主节点对 PSYNC 的回复
+type psyncResult struct {
+	// full 主节点回复 +FULLRESYNC, 接下来发送 rdb
+	full   bool
+	replId string
+	offset int64
+}
+
+// handshake PING, AUTH masterauth, REPLCONF listening-port, REPLCONF capa, PSYNC replid offset [FAILOVER]
+func (l *masterLink) handshake(replId string, offset int64, failover bool) (*psyncResult, error) {
+	reply, err := l.command("PING")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(reply, "+") {
+		return nil, fmt.Errorf("error reply to PING from master: '%s'", reply)
+	}
+	if auth := config.Properties.MasterAuth; auth != "" {
+		if reply, err = l.command("AUTH", auth); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(reply, "+") {
+			return nil, fmt.Errorf("unable to AUTH to MASTER: '%s'", reply)
+		}
+	}
+	// 老版本的主节点不支持 REPLCONF, 忽略错误
+	if _, err = l.command("REPLCONF", "listening-port", strconv.Itoa(config.Properties.Port)); err != nil {
+		return nil, err
+	}
+	if _, err = l.command("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return nil, err
+	}
+	psync := []string{"PSYNC", replId, strconv.FormatInt(offset, 10)}
+	if failover {
+		psync = append(psync, "FAILOVER")
+	}
+	if reply, err = l.command(psync...); err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		if masterOffset, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+			return &psyncResult{full: true, replId: fields[1], offset: masterOffset}, nil
+		}
+	case len(fields) == 1 && fields[0] == "+CONTINUE":
+		// 老版本的主节点不会回复 replId
+		return &psyncResult{replId: replId}, nil
+	case len(fields) == 2 && fields[0] == "+CONTINUE" && len(fields[1]) == len(replId):
+		return &psyncResult{replId: fields[1]}, nil
+	}
+	return nil, fmt.Errorf("unexpected reply to PSYNC from master: '%s'", reply)
+}
+
+// readRdb 读取 $<length> 格式, 或者 diskless 同步的 $EOF:<mark> 格式的 rdb
+func (l *masterLink) readRdb() ([]byte, error) {
+	line, err := l.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(line, "-") {
+		return nil, fmt.Errorf("MASTER aborted replication with an error: %s", line[1:])
+	}
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("bad protocol from MASTER, the first byte is not '$': %s", line)
+	}
+	if strings.HasPrefix(line, "$EOF:") {
+		mark := []byte(line[len("$EOF:"):])
+		if len(mark) != replEOFMarkSize {
+			return nil, fmt.Errorf("bad EOF mark from MASTER: %s", line)
+		}
+		return l.readUntil(mark)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("bad bulk length from MASTER: %s", line)
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(l.reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readUntil 逐个字节读取, rdb 之后紧跟着复制流, 不能多读
+func (l *masterLink) readUntil(mark []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	last := mark[len(mark)-1]
+	for {
+		b, err := l.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(b)
+		if b == last && bytes.HasSuffix(buf.Bytes(), mark) {
+			return buf.Bytes()[:buf.Len()-len(mark)], nil
+		}
+	}
+}
+
+// sendAcks 定时或者收到 GETACK 之后向主节点确认已经执行的偏移量, 主节点根据它计算 lag
+func (l *masterLink) sendAcks(done chan struct{}, rp *Replication) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-rp.ackNow:
+		}
+		rp.mux.Lock()
+		offset := rp.offset
+		rp.mux.Unlock()
+		if err := l.send("REPLCONF", "ACK", strconv.FormatInt(offset, 10)); err != nil {
+			return
+		}
+	}
+}
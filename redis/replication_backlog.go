@@ -0,0 +1,77 @@
+package redis
+
+// replBacklogMinSize 与 redis 一致, 积压缓冲区最小16KB
+const replBacklogMinSize = 16 << 10
+
+// replBacklog 复制积压缓冲区, 环形保存最近写入复制流的数据, 从节点断线重连之后从这里补发缺失的部分
+type replBacklog struct {
+	buf []byte
+	// idx 下一次写入的位置
+	idx int
+	// histlen 缓冲区中有效数据的长度
+	histlen int
+	// end 最后一个字节的偏移量, 和复制流的 offset 一致
+	end int64
+}
+
+func newReplBacklog(size int, offset int64) *replBacklog {
+	if size < replBacklogMinSize {
+		size = replBacklogMinSize
+	}
+	return &replBacklog{buf: make([]byte, size), end: offset}
+}
+
+// write 追加到缓冲区, 超出大小时覆盖最老的数据
+func (b *replBacklog) write(data []byte) {
+	b.end += int64(len(data))
+	if len(data) > len(b.buf) {
+		data = data[len(data)-len(b.buf):]
+	}
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen += n
+		data = data[n:]
+	}
+	if b.histlen > len(b.buf) {
+		b.histlen = len(b.buf)
+	}
+}
+
+// start 缓冲区中第一个字节的偏移量, 和 redis 一样从1开始
+func (b *replBacklog) start() int64 {
+	return b.end - int64(b.histlen) + 1
+}
+
+// readFrom 从偏移量 offset 开始到最后的数据, offset 已经被覆盖或者还没有写入时返回false
+func (b *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	if offset < b.start() || offset > b.end+1 {
+		return nil, false
+	}
+	n := int(b.end - offset + 1)
+	result := make([]byte, 0, n)
+	pos := (b.idx - n + len(b.buf)) % len(b.buf)
+	if pos+n <= len(b.buf) {
+		return append(result, b.buf[pos:pos+n]...), true
+	}
+	result = append(result, b.buf[pos:]...)
+	return append(result, b.buf[:n-(len(b.buf)-pos)]...), true
+}
+
+// resize CONFIG SET repl-backlog-size, 保留最新的数据
+func (b *replBacklog) resize(size int) {
+	if size < replBacklogMinSize {
+		size = replBacklogMinSize
+	}
+	if size == len(b.buf) {
+		return
+	}
+	data, _ := b.readFrom(b.start())
+	if len(data) > size {
+		data = data[len(data)-size:]
+	}
+	b.buf = make([]byte, size)
+	copy(b.buf, data)
+	b.idx = len(data) % size
+	b.histlen = len(data)
+}
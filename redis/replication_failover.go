@@ -0,0 +1,188 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"time"
+)
+
+// FAILOVER 的状态, 与 redis server.h 中的 failover_state 对应
+const (
+	failoverNone = iota
+	// failoverWaitForSync 已经暂停写命令, 等待目标从节点确认的偏移量追上主节点
+	failoverWaitForSync
+	// failoverInProgress 作为从节点连接目标节点, 发送 PSYNC FAILOVER 让它提升为主节点
+	failoverInProgress
+)
+
+// failoverState 正在执行的 FAILOVER, 持有全局锁和 rp.mux 时修改
+type failoverState struct {
+	state int
+	// host 和 port 目标从节点, 没有指定 TO 时是第一个追上偏移量的从节点
+	host string
+	port int
+	// deadline TIMEOUT 到期的时间, 为空表示一直等待
+	deadline time.Time
+	// force 超时之后不放弃, 直接切换到目标节点
+	force bool
+}
+
+func (f *failoverState) stateName() string {
+	switch f.state {
+	case failoverWaitForSync:
+		return "waiting-for-sync"
+	case failoverInProgress:
+		return "failover-in-progress"
+	default:
+		return "no-failover"
+	}
+}
+
+func (f *failoverState) target() string {
+	if f.host == "" {
+		return "any replica"
+	}
+	return fmt.Sprintf("%s:%d", f.host, f.port)
+}
+
+// replicaByAddr 按照 ip 和 REPLCONF listening-port 查找从节点, 调用方持有 rp.mux
+func (rp *Replication) replicaByAddr(host string, port int) *replica {
+	for _, r := range rp.replicas {
+		if r.ip() == host && r.listeningPort == port {
+			return r
+		}
+	}
+	return nil
+}
+
+// Failover FAILOVER [TO host port [FORCE]] [TIMEOUT ms], 暂停写命令之后等待从节点追上偏移量. 调用方持有锁
+func (rp *Replication) Failover(host string, port int, force bool, timeout time.Duration) Reply {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	if rp.failover.state != failoverNone {
+		return MakeStandardErrReply("ERR FAILOVER already in progress.")
+	}
+	if rp.IsReplica() {
+		return MakeStandardErrReply("ERR FAILOVER is not valid when server is a replica.")
+	}
+	if len(rp.replicas) == 0 {
+		return MakeStandardErrReply("ERR FAILOVER requires connected replicas.")
+	}
+	if host != "" {
+		r := rp.replicaByAddr(host, port)
+		if r == nil {
+			return MakeStandardErrReply("ERR FAILOVER target HOST and PORT is not a replica.")
+		}
+		if r.state != replicaOnline {
+			return MakeStandardErrReply("ERR FAILOVER target replica is not online.")
+		}
+	}
+	rp.failover = failoverState{state: failoverWaitForSync, host: host, port: port, force: force}
+	if timeout > 0 {
+		rp.failover.deadline = time.Now().Add(timeout)
+	}
+	rp.lg.Infof("FAILOVER requested to %s.", rp.failover.target())
+	// 从节点收到之后立即确认, 不用等到下一次定时 ACK
+	rp.propagate(MakeMultiBulkReply(util.ToCmdLine("REPLCONF", "GETACK", "*")).ToBytes())
+	rp.server.pauseWrites()
+	return MakeOkReply()
+}
+
+// updateFailover 收到 ACK 和定时任务中检查目标从节点是否已经追上偏移量, 追上之后作为从节点连接它. 调用方持有锁
+func (rp *Replication) updateFailover() {
+	rp.mux.Lock()
+	f := &rp.failover
+	if f.state != failoverWaitForSync {
+		rp.mux.Unlock()
+		return
+	}
+	if !f.deadline.IsZero() && !time.Now().Before(f.deadline) {
+		if !f.force {
+			rp.mux.Unlock()
+			rp.AbortFailover("Replica never caught up before timeout")
+			return
+		}
+		rp.lg.Infof("FAILOVER to %s time out exceeded, failing over.", f.target())
+	} else if !rp.failoverTargetSynced() {
+		rp.mux.Unlock()
+		return
+	} else {
+		rp.lg.Infof("Failover target %s is synced, failing over.", f.target())
+	}
+	f.state = failoverInProgress
+	host, port := f.host, f.port
+	rp.mux.Unlock()
+	rp.ReplicaOf(host, port)
+}
+
+// failoverTargetSynced 目标从节点确认的偏移量等于主节点的偏移量, 没有指定目标时选择第一个追上的从节点. 调用方持有 rp.mux
+func (rp *Replication) failoverTargetSynced() bool {
+	f := &rp.failover
+	if f.host != "" {
+		r := rp.replicaByAddr(f.host, f.port)
+		return r != nil && r.ackOffset == rp.offset
+	}
+	for _, r := range rp.replicas {
+		if r.state == replicaOnline && r.ackOffset == rp.offset {
+			f.host, f.port = r.ip(), r.listeningPort
+			return true
+		}
+	}
+	return false
+}
+
+// failoverPsync 连接主节点时是否需要发送 PSYNC FAILOVER
+func (rp *Replication) failoverPsync() bool {
+	rp.mux.Lock()
+	defer rp.mux.Unlock()
+	return rp.failover.state == failoverInProgress
+}
+
+// finishFailover 目标节点回复了 PSYNC FAILOVER, 切换完成; 拒绝或者连接失败时恢复为主节点. 调用方持有锁
+func (rp *Replication) finishFailover(err error) {
+	if err != nil {
+		rp.AbortFailover("Failover target rejected psync request: " + err.Error())
+		return
+	}
+	rp.mux.Lock()
+	if rp.failover.state != failoverInProgress {
+		rp.mux.Unlock()
+		return
+	}
+	rp.lg.Infof("FAILOVER to %s succeeded.", rp.failover.target())
+	rp.failover = failoverState{}
+	rp.mux.Unlock()
+	rp.server.unpauseWrites()
+}
+
+// AbortFailover FAILOVER ABORT 或者超时, 已经开始连接目标节点时重新作为主节点. 调用方持有锁
+func (rp *Replication) AbortFailover(reason string) bool {
+	rp.mux.Lock()
+	f := rp.failover
+	rp.failover = failoverState{}
+	rp.mux.Unlock()
+	if f.state == failoverNone {
+		return false
+	}
+	rp.lg.Warnf("FAILOVER to %s aborted: %s", f.target(), reason)
+	if f.state == failoverInProgress {
+		rp.ReplicaOfNoOne()
+	}
+	rp.server.unpauseWrites()
+	return true
+}
+
+// promoteForFailover 收到 PSYNC FAILOVER, replId 和当前的 replId 一致时提升为主节点. 调用方持有锁
+func (rp *Replication) promoteForFailover(conn *Client, replId string) bool {
+	rp.mux.Lock()
+	matched := replId == rp.replId
+	rp.mux.Unlock()
+	if !matched {
+		return false
+	}
+	if rp.IsReplica() {
+		rp.ReplicaOfNoOne()
+		rp.lg.Infof("MASTER MODE enabled (failover request from '%s')", conn.RemoteAddr())
+	}
+	return true
+}
@@ -0,0 +1,729 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve 在随机端口上启动网络服务, 测试结束时停止
+func serve(t testing.TB, server *testServer) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	serveOn(t, server, port)
+	return port
+}
+
+// serveOn 在指定的端口上启动网络服务, 测试结束时停止
+func serveOn(t testing.TB, server *testServer, port int) {
+	serveAddrs(t, server, []string{fmt.Sprintf("tcp://127.0.0.1:%d", port)})
+}
+
+// serveAddrs 在多个地址上启动网络服务, 第一个地址可以连接并且加载完数据之后返回
+func serveAddrs(t testing.TB, server *testServer, addrs []string) {
+	serveLoading(t, server, addrs)
+	assert.Eventually(t, func() bool {
+		return !server.loading.Load()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// serveLoading 在多个地址上启动网络服务, 第一个地址可以连接之后返回, 这时可能还在加载数据
+func serveLoading(t testing.TB, server *testServer, addrs []string) {
+	done := make(chan error, 1)
+	go func() {
+		done <- gnet.Rotate(server, addrs, gnet.WithMulticore(true), gnet.WithTicker(true))
+	}()
+	t.Cleanup(func() {
+		lock.Lock()
+		engine := server.engine
+		lock.Unlock()
+		_ = engine.Stop(context.Background())
+		<-done
+	})
+	network, address := "tcp", strings.TrimPrefix(addrs[0], "tcp://")
+	if strings.HasPrefix(addrs[0], "unix://") {
+		network, address = "unix", strings.TrimPrefix(addrs[0], "unix://")
+	}
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial(network, address)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// infoField INFO replication 中的一个字段
+func infoField(t *testing.T, server *testServer, client *Client, field string) string {
+	for _, line := range strings.Split(server.exec(t, client, "info", "replication"), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return line[len(field)+1:]
+		}
+	}
+	return ""
+}
+
+func TestReplicaOf(t *testing.T) {
+	useTempDir(t)
+	master := newTestServer()
+	port := serve(t, master)
+	client, _ := master.newClient()
+	master.exec(t, client, "set", "before", "sync")
+	master.exec(t, client, "rpush", "list", "a", "b", "c")
+	master.exec(t, client, "select", "3")
+	master.exec(t, client, "set", "db3", "value")
+
+	replica := newTestServer()
+	other, _ := replica.newClient()
+	assert.Equal(t, "master", infoField(t, replica, other, "role"))
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "replicaof", "127.0.0.1", strconv.Itoa(port)))
+	assert.Equal(t, "+OK Already connected to specified master\r\n",
+		replica.exec(t, other, "replicaof", "127.0.0.1", strconv.Itoa(port)))
+	defer replica.exec(t, other, "replicaof", "no", "one")
+	assert.Eventually(t, func() bool {
+		return infoField(t, replica, other, "master_link_status") == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "slave", infoField(t, replica, other, "role"))
+	assert.Equal(t, "1", infoField(t, master, client, "connected_slaves"))
+	assert.Contains(t, infoField(t, master, client, "slave0"), "state=online")
+	assert.Equal(t, infoField(t, master, client, "master_replid"), infoField(t, replica, other, "master_replid"))
+
+	// 全量同步的数据
+	assert.Equal(t, "$4\r\nsync\r\n", replica.exec(t, other, "get", "before"))
+	assert.Equal(t, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", replica.exec(t, other, "lrange", "list", "0", "-1"))
+
+	// 同步之后的写命令, 第一条命令之前需要 SELECT
+	master.exec(t, client, "set", "after", "sync")
+	master.exec(t, client, "select", "0")
+	master.exec(t, client, "del", "before")
+	master.exec(t, client, "expire", "list", "100")
+	assert.Eventually(t, func() bool {
+		return replica.exec(t, other, "exists", "before") == ":0\r\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, []string{":99\r\n", ":100\r\n"}, replica.exec(t, other, "ttl", "list"))
+	replica.exec(t, other, "select", "3")
+	assert.Equal(t, "$5\r\nvalue\r\n", replica.exec(t, other, "get", "db3"))
+	assert.Equal(t, "$4\r\nsync\r\n", replica.exec(t, other, "get", "after"))
+	replica.exec(t, other, "select", "0")
+	assert.Equal(t, infoField(t, master, client, "master_repl_offset"), infoField(t, replica, other, "master_repl_offset"))
+
+	// 从节点是只读的
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", replica.exec(t, other, "set", "foo", "bar"))
+
+	// 提升为主节点之后可以写入, 不再接收原来的主节点的命令
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "replicaof", "no", "one"))
+	assert.Equal(t, "master", infoField(t, replica, other, "role"))
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "set", "foo", "bar"))
+	assert.Eventually(t, func() bool {
+		return infoField(t, master, client, "connected_slaves") == "0"
+	}, 5*time.Second, 10*time.Millisecond)
+	master.exec(t, client, "set", "promoted", "yes")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, ":0\r\n", replica.exec(t, other, "exists", "promoted"))
+}
+
+func TestReplicaOfLinkDown(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	assert.Equal(t, "-ERR Invalid master port\r\n", server.exec(t, client, "replicaof", "127.0.0.1", "port"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "replicaof", "127.0.0.1", strconv.Itoa(port)))
+	assert.Equal(t, "down", infoField(t, server, client, "master_link_status"))
+	assert.Equal(t, "-1", infoField(t, server, client, "master_link_down_since_seconds"))
+	assert.Equal(t, "-1", infoField(t, server, client, "master_last_io_seconds_ago"))
+
+	// 没有连接上主节点的从节点不能被同步
+	replica, _ := server.newClient()
+	assert.Equal(t, "-NOMASTERLINK Can't SYNC while not connected with my master\r\n",
+		server.exec(t, replica, "psync", "?", "-1"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "replicaof", "no", "one"))
+}
+
+func TestFullSync(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	replica, conn := server.newClient()
+	assert.Equal(t, "+OK\r\n", server.exec(t, replica, "replconf", "listening-port", "6380"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, replica, "replconf", "capa", "eof", "capa", "psync2"))
+	assert.Equal(t, "-ERR Unrecognized REPLCONF option: foo\r\n", server.exec(t, replica, "replconf", "foo", "bar"))
+	assert.True(t, strings.HasPrefix(server.exec(t, replica, "psync", "?", "-1"), "+FULLRESYNC "))
+	server.exec(t, client, "set", "during", "sync")
+	assert.Eventually(t, func() bool {
+		conn.mux.Lock()
+		defer conn.mux.Unlock()
+		return strings.Contains(conn.out.String(), "during")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// rdb 之后是快照之后的复制流, 不管写命令在 rdb 发送之前还是之后执行
+	out := conn.take()
+	header := out[:strings.Index(out, "\r\n")]
+	size, err := strconv.Atoi(header[1:])
+	assert.Nil(t, err)
+	payload := out[len(header)+2 : len(header)+2+size]
+	loader, err := decodeRdb(strings.NewReader(payload))
+	assert.Nil(t, err)
+	_, ok := loader.dbs[0].GetEntity("foo")
+	assert.True(t, ok)
+	stream := out[len(header)+2+size:]
+	assert.Equal(t, "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$6\r\nduring\r\n$4\r\nsync\r\n", stream)
+	assert.Equal(t, strconv.Itoa(len(stream)), infoField(t, server, client, "master_repl_offset"))
+	assert.Equal(t, "slave0:ip=127.0.0.1,port=6380,state=online,offset=0,lag=0", "slave0:"+infoField(t, server, client, "slave0"))
+
+	// REPLCONF ACK 不回复
+	assert.Equal(t, "", server.exec(t, replica, "replconf", "ack", strconv.Itoa(len(stream))))
+	assert.Contains(t, infoField(t, server, client, "slave0"), "offset="+strconv.Itoa(len(stream)))
+	server.freeClient(replica)
+	assert.Equal(t, "0", infoField(t, server, client, "connected_slaves"))
+}
+
+func TestReplBacklog(t *testing.T) {
+	backlog := newReplBacklog(0, 100)
+	assert.Equal(t, replBacklogMinSize, len(backlog.buf))
+	data, ok := backlog.readFrom(101)
+	assert.True(t, ok)
+	assert.Empty(t, data)
+	_, ok = backlog.readFrom(102)
+	assert.False(t, ok)
+
+	// 写满之后覆盖最老的数据
+	chunk := []byte(strings.Repeat("a", replBacklogMinSize-10) + "0123456789")
+	backlog.write(chunk)
+	backlog.write([]byte("abcdefghij"))
+	assert.Equal(t, int64(100+len(chunk)+10), backlog.end)
+	assert.Equal(t, replBacklogMinSize, backlog.histlen)
+	assert.Equal(t, int64(111), backlog.start())
+	_, ok = backlog.readFrom(110)
+	assert.False(t, ok)
+	data, ok = backlog.readFrom(backlog.end - 19)
+	assert.True(t, ok)
+	assert.Equal(t, "0123456789abcdefghij", string(data))
+
+	// 调整大小之后保留最新的数据
+	backlog.resize(replBacklogMinSize * 2)
+	data, ok = backlog.readFrom(backlog.end - 19)
+	assert.True(t, ok)
+	assert.Equal(t, "0123456789abcdefghij", string(data))
+	assert.Equal(t, int64(111), backlog.start())
+	backlog.write([]byte("klmn"))
+	data, _ = backlog.readFrom(backlog.end - 5)
+	assert.Equal(t, "ijklmn", string(data))
+}
+
+// dropReplicas 在主节点上关闭从节点的连接, 从节点会重新连接
+func dropReplicas(t *testing.T, server *testServer, client *Client) {
+	server.repl.mux.Lock()
+	for conn := range server.repl.replicas {
+		_ = conn.conn.Close()
+	}
+	server.repl.mux.Unlock()
+	assert.Eventually(t, func() bool {
+		return infoField(t, server, client, "connected_slaves") == "0"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// infoStats INFO stats 中的一个字段
+func infoStats(t *testing.T, server *testServer, client *Client, field string) string {
+	for _, line := range strings.Split(server.exec(t, client, "info", "stats"), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return line[len(field)+1:]
+		}
+	}
+	return ""
+}
+
+func TestPartialResync(t *testing.T) {
+	useTempDir(t)
+	master := newTestServer()
+	port := serve(t, master)
+	client, _ := master.newClient()
+	master.exec(t, client, "select", "2")
+	master.exec(t, client, "set", "foo", "bar")
+
+	replica := newTestServer()
+	other, _ := replica.newClient()
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "replicaof", "127.0.0.1", strconv.Itoa(port)))
+	defer replica.exec(t, other, "replicaof", "no", "one")
+	assert.Eventually(t, func() bool {
+		return infoField(t, replica, other, "master_link_status") == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "1", infoField(t, master, client, "repl_backlog_active"))
+
+	// 断线期间的写命令从积压缓冲区补发, 断线之前选择的db继续生效
+	dropReplicas(t, master, client)
+	master.exec(t, client, "set", "during", "disconnect")
+	master.exec(t, client, "incr", "counter")
+	assert.Eventually(t, func() bool {
+		return infoField(t, replica, other, "master_link_status") == "up" &&
+			infoField(t, master, client, "connected_slaves") == "1"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "1", infoStats(t, master, client, "sync_full"))
+	assert.Equal(t, "1", infoStats(t, master, client, "sync_partial_ok"))
+	// 和 redis 一样, 主节点切换成从节点时用自己的 replId 尝试部分重同步
+	assert.Equal(t, "1", infoStats(t, master, client, "sync_partial_err"))
+	master.exec(t, client, "set", "after", "reconnect")
+	assert.Eventually(t, func() bool {
+		return infoField(t, master, client, "master_repl_offset") == infoField(t, replica, other, "master_repl_offset")
+	}, 5*time.Second, 10*time.Millisecond)
+	replica.exec(t, other, "select", "2")
+	assert.Equal(t, "$10\r\ndisconnect\r\n", replica.exec(t, other, "get", "during"))
+	assert.Equal(t, "$1\r\n1\r\n", replica.exec(t, other, "get", "counter"))
+	assert.Equal(t, "$9\r\nreconnect\r\n", replica.exec(t, other, "get", "after"))
+
+	// 断线期间的数据超过积压缓冲区的大小时全量同步
+	assert.Equal(t, "+OK\r\n", master.exec(t, client, "config", "set", "repl-backlog-size", "16kb"))
+	defer master.exec(t, client, "config", "set", "repl-backlog-size", "1mb")
+	dropReplicas(t, master, client)
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 20; i++ {
+		master.exec(t, client, "set", "big"+strconv.Itoa(i), value)
+	}
+	assert.Eventually(t, func() bool {
+		return infoStats(t, master, client, "sync_full") == "2" &&
+			infoField(t, replica, other, "master_link_status") == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "2", infoStats(t, master, client, "sync_partial_err"))
+	assert.Equal(t, "16384", infoField(t, master, client, "repl_backlog_size"))
+	assert.Equal(t, ":1\r\n", replica.exec(t, other, "exists", "big19"))
+	assert.Equal(t, "$10\r\ndisconnect\r\n", replica.exec(t, other, "get", "during"))
+
+	// 提升为主节点之后, 原来的 replId 保存在 master_replid2 中
+	replId := infoField(t, replica, other, "master_replid")
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "replicaof", "no", "one"))
+	assert.Equal(t, replId, infoField(t, replica, other, "master_replid2"))
+	assert.NotEqual(t, replId, infoField(t, replica, other, "master_replid"))
+	offset, _ := strconv.Atoi(infoField(t, replica, other, "master_repl_offset"))
+	assert.Equal(t, strconv.Itoa(offset+1), infoField(t, replica, other, "second_repl_offset"))
+}
+
+func TestPsyncContinue(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	first, _ := server.newClient()
+	assert.True(t, strings.HasPrefix(server.exec(t, first, "psync", "?", "-1"), "+FULLRESYNC "))
+	server.exec(t, client, "set", "foo", "bar")
+	replId := infoField(t, server, client, "master_replid")
+	offset, _ := strconv.Atoi(infoField(t, server, client, "master_repl_offset"))
+
+	// 只发送请求的偏移量之后的复制流
+	replica, _ := server.newClient()
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", server.exec(t, replica, "psync", replId, "x"))
+	assert.Equal(t, "+CONTINUE "+replId+"\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+		server.exec(t, replica, "psync", replId, strconv.Itoa(offset-17)))
+	assert.Equal(t, "1", infoStats(t, server, client, "sync_partial_ok"))
+
+	// replId 不匹配或者偏移量超出范围时全量同步
+	for _, args := range [][]string{{"psync", "0123", "1"}, {"psync", replId, strconv.Itoa(offset + 2)}} {
+		other, _ := server.newClient()
+		assert.True(t, strings.HasPrefix(server.exec(t, other, args...), "+FULLRESYNC "))
+	}
+	assert.Equal(t, "2", infoStats(t, server, client, "sync_partial_err"))
+	assert.Equal(t, "3", infoStats(t, server, client, "sync_full"))
+	// 等待后台发送 rdb 的协程结束
+	assert.Eventually(t, func() bool {
+		return !strings.Contains(server.exec(t, client, "info", "replication"), "state=wait_bgsave")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplIds(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	hexId := regexp.MustCompile(`^[0-9a-f]{40}$`)
+	runId := ""
+	for _, line := range strings.Split(server.exec(t, client, "info", "server"), "\r\n") {
+		if strings.HasPrefix(line, "run_id:") {
+			runId = line[len("run_id:"):]
+		}
+	}
+	assert.Regexp(t, hexId, runId)
+	replId := infoField(t, server, client, "master_replid")
+	assert.Regexp(t, hexId, replId)
+	assert.NotEqual(t, runId, replId)
+	assert.Equal(t, emptyReplId, infoField(t, server, client, "master_replid2"))
+	assert.Equal(t, "-1", infoField(t, server, client, "second_repl_offset"))
+	server.exec(t, client, "set", "foo", "bar")
+
+	// 变成从节点时保留 replId, 连接上主节点之前不变
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "replicaof", "127.0.0.1", strconv.Itoa(port)))
+	assert.Equal(t, replId, infoField(t, server, client, "master_replid"))
+
+	// 提升为主节点时换成新的 replId, 之前的复制流到当前的偏移量为止
+	offset, _ := strconv.Atoi(infoField(t, server, client, "master_repl_offset"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "replicaof", "no", "one"))
+	newId := infoField(t, server, client, "master_replid")
+	assert.Regexp(t, hexId, newId)
+	assert.NotEqual(t, replId, newId)
+	assert.Equal(t, replId, infoField(t, server, client, "master_replid2"))
+	assert.Equal(t, strconv.Itoa(offset+1), infoField(t, server, client, "second_repl_offset"))
+	assert.Contains(t, server.exec(t, client, "info", "server"), "run_id:"+runId+"\r\n")
+
+	// 见过之前的 replId 的从节点可以部分重同步, 超过切换时的偏移量时不行
+	replica, _ := server.newClient()
+	assert.Equal(t, "+CONTINUE "+newId+"\r\n", server.exec(t, replica, "psync", replId, strconv.Itoa(offset+1)))
+	other, _ := server.newClient()
+	assert.True(t, strings.HasPrefix(server.exec(t, other, "psync", replId, strconv.Itoa(offset+2)), "+FULLRESYNC "))
+
+	// DEBUG CHANGE-REPL-ID 之后只能全量同步
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "debug", "change-repl-id"))
+	assert.NotEqual(t, newId, infoField(t, server, client, "master_replid"))
+	assert.Equal(t, emptyReplId, infoField(t, server, client, "master_replid2"))
+	assert.Equal(t, "-1", infoField(t, server, client, "second_repl_offset"))
+	for _, id := range []string{replId, newId} {
+		other, _ := server.newClient()
+		assert.True(t, strings.HasPrefix(server.exec(t, other, "psync", id, strconv.Itoa(offset+1)), "+FULLRESYNC "))
+	}
+	assert.Equal(t, "1", infoStats(t, server, client, "sync_partial_ok"))
+	assert.Equal(t, "3", infoStats(t, server, client, "sync_full"))
+	// 等待后台发送 rdb 的协程结束
+	assert.Eventually(t, func() bool {
+		return !strings.Contains(server.exec(t, client, "info", "replication"), "state=wait_bgsave")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	master, _ := server.newClient()
+	master.master = true
+	server.repl.masterHost, server.repl.masterPort = "127.0.0.1", 6379
+	defer func() {
+		server.repl.masterHost, server.repl.masterPort = "", 0
+	}()
+
+	// 普通客户端的写命令被拒绝, 主节点发送的命令直接执行
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", server.exec(t, client, "set", "foo", "bar"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, master, "set", "foo", "bar"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+
+	// 从节点不删除过期的key, 读取时当作不存在, 收到主节点的 DEL 之后才删除
+	server.exec(t, master, "pexpireat", "foo", "1")
+	server.exec(t, client, "ttlops")
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "get", "foo"))
+	assert.Equal(t, ":0\r\n", server.exec(t, client, "exists", "foo"))
+	assert.Equal(t, ":-2\r\n", server.exec(t, client, "ttl", "foo"))
+	assert.Equal(t, 1, server.dbs[0].Len())
+	assert.Equal(t, ":1\r\n", server.exec(t, master, "exists", "foo"))
+	server.exec(t, master, "del", "foo")
+	assert.Equal(t, 0, server.dbs[0].Len())
+
+	// replica-read-only no 时普通客户端可以写入, 写命令不会进入复制流
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "replica-read-only", "no"))
+	defer server.exec(t, client, "config", "set", "replica-read-only", "yes")
+	offset := infoField(t, server, client, "master_repl_offset")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "set", "local", "1"))
+	assert.Equal(t, offset, infoField(t, server, client, "master_repl_offset"))
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'replica-read-only') - argument must be 'yes' or 'no'\r\n",
+		server.exec(t, client, "config", "set", "replica-read-only", "maybe"))
+}
+
+// TestReplicaReadOnlyPerInvocation 只有部分参数写入的命令按照这次调用的参数判断是否拒绝
+func TestReplicaReadOnlyPerInvocation(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	master, _ := server.newClient()
+	master.master = true
+	server.repl.masterHost, server.repl.masterPort = "127.0.0.1", 6379
+	defer func() {
+		server.repl.masterHost, server.repl.masterPort = "", 0
+	}()
+	server.exec(t, master, "set", "foo", "bar")
+	server.exec(t, master, "rpush", "list", "2", "1")
+
+	readonlyErr := "-READONLY You can't write against a read only replica.\r\n"
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "getex", "foo"))
+	assert.Equal(t, readonlyErr, server.exec(t, client, "getex", "foo", "ex", "100"))
+	assert.Equal(t, readonlyErr, server.exec(t, client, "getex", "foo", "persist"))
+	assert.Equal(t, ":-1\r\n", server.exec(t, client, "ttl", "foo"))
+	assert.Equal(t, "*2\r\n$1\r\n1\r\n$1\r\n2\r\n", server.exec(t, client, "sort", "list"))
+	assert.Equal(t, readonlyErr, server.exec(t, client, "sort", "list", "store", "dst"))
+	assert.Equal(t, readonlyErr, server.exec(t, client, "getdel", "foo"))
+	assert.Equal(t, 2, server.dbs[0].Len())
+
+	// 事务和脚本中同样按照参数判断
+	server.exec(t, client, "multi")
+	assert.Equal(t, "+QUEUED\r\n", server.exec(t, client, "getex", "foo"))
+	assert.Equal(t, "+QUEUED\r\n", server.exec(t, client, "sort", "list", "limit", "0", "1"))
+	assert.Equal(t, "*2\r\n$3\r\nbar\r\n*1\r\n$1\r\n1\r\n", server.exec(t, client, "exec"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "eval", "return redis.call('getex', KEYS[1])", "1", "foo"))
+	assert.Equal(t, readonlyErr, server.exec(t, client, "eval", "return redis.pcall('getex', KEYS[1], 'px', '10')", "1", "foo"))
+
+	// 主节点发送的命令直接执行
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, master, "getex", "foo", "ex", "100"))
+	assert.Equal(t, ":100\r\n", server.exec(t, client, "ttl", "foo"))
+}
+
+func TestMasterExpirePropagatesDel(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	replica, conn := server.newClient()
+	assert.True(t, strings.HasPrefix(server.exec(t, replica, "psync", "?", "-1"), "+FULLRESYNC "))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(infoField(t, server, client, "slave0"), "state=online")
+	}, 5*time.Second, 10*time.Millisecond)
+	conn.take()
+
+	// 主节点访问过期的key时删除, 并把 DEL 发送给从节点
+	server.exec(t, client, "set", "foo", "bar", "px", "10")
+	clk.Advance(20 * time.Millisecond)
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "get", "foo"))
+	assert.Eventually(t, func() bool {
+		conn.mux.Lock()
+		defer conn.mux.Unlock()
+		return strings.HasSuffix(conn.out.String(), "*2\r\n$3\r\ndel\r\n$3\r\nfoo\r\n")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 定期删除和设置过去的过期时间同样发送 DEL, lazyfree-lazy-expire 打开时发送 UNLINK
+	lazyExpire := config.Properties.LazyfreeLazyExpire
+	defer func() { config.Properties.LazyfreeLazyExpire = lazyExpire }()
+	for _, c := range []struct{ lazy, cmd string }{{"no", "del"}, {"yes", "unlink"}} {
+		server.exec(t, client, "config", "set", "lazyfree-lazy-expire", c.lazy)
+		server.exec(t, client, "set", "active", "bar")
+		expireAt := clk.Now().Add(10 * time.Millisecond).UnixMilli()
+		server.exec(t, client, "pexpireat", "active", strconv.FormatInt(expireAt, 10))
+		clk.Advance(20 * time.Millisecond)
+		server.cron()
+		server.exec(t, client, "set", "past", "bar")
+		assert.Equal(t, ":1\r\n", server.exec(t, client, "pexpireat", "past", "1"))
+		// 定时任务之后还有发送给从节点的 PING
+		expected := resp([]string{"pexpireat", "active", strconv.FormatInt(expireAt, 10)}, []string{c.cmd, "active"})
+		assert.Eventually(t, func() bool {
+			conn.mux.Lock()
+			defer conn.mux.Unlock()
+			return strings.Contains(conn.out.String(), expected) &&
+				strings.Contains(conn.out.String(), resp([]string{"set", "past", "bar"}, []string{c.cmd, "past"}))
+		}, 5*time.Second, 10*time.Millisecond, c.cmd)
+	}
+}
+
+func TestReplicaExpireConvergence(t *testing.T) {
+	useTempDir(t)
+	master := newTestServer()
+	port := serve(t, master)
+	client, _ := master.newClient()
+	replica := newTestServer()
+	other, _ := replica.newClient()
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "replicaof", "127.0.0.1", strconv.Itoa(port)))
+	defer replica.exec(t, other, "replicaof", "no", "one")
+	assert.Eventually(t, func() bool {
+		return infoField(t, replica, other, "master_link_status") == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+	dbLen := func(server *testServer) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return server.dbs[0].Len()
+	}
+	master.exec(t, client, "set", "keep", "v")
+	for i := 0; i < 20; i++ {
+		master.exec(t, client, "set", "k:"+strconv.Itoa(i), "v", "px", "100")
+	}
+	assert.Eventually(t, func() bool {
+		return dbLen(replica) == 21
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 从节点的时钟比主节点快: 读取时当作不存在, 但是不自己删除, 等待主节点的 DEL
+	lock.Lock()
+	replica.dbs[0].ExpireV1("keep", time.Now().Add(-time.Second))
+	lock.Unlock()
+	replica.cron()
+	assert.Equal(t, "$-1\r\n", replica.exec(t, other, "get", "keep"))
+	assert.Equal(t, 21, dbLen(replica))
+	assert.Equal(t, "$1\r\nv\r\n", master.exec(t, client, "get", "keep"))
+
+	// 主节点的定时任务删除过期的key之后, 从节点收到 DEL 删除
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "$-1\r\n", replica.exec(t, other, "get", "k:"+strconv.Itoa(i)))
+	}
+	assert.Eventually(t, func() bool {
+		return dbLen(replica) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "20", infoAll(t, master, client, "expired_keys"))
+	assert.Equal(t, "0", infoAll(t, replica, other, "expired_keys"))
+	master.exec(t, client, "del", "keep")
+	assert.Eventually(t, func() bool {
+		return dbLen(replica) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplAck(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	replica, conn := server.newClient()
+	assert.True(t, strings.HasPrefix(server.exec(t, replica, "psync", "?", "-1"), "+FULLRESYNC "))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(infoField(t, server, client, "slave0"), "state=online")
+	}, 5*time.Second, 10*time.Millisecond)
+	server.exec(t, client, "set", "foo", "bar")
+	offset := infoField(t, server, client, "master_repl_offset")
+	conn.take()
+	assert.Equal(t, "", server.exec(t, replica, "replconf", "ack", offset))
+	assert.True(t, strings.HasSuffix(infoField(t, server, client, "slave0"), "offset="+offset+",lag=0"))
+	// 乱序的 ACK 不会让偏移量后退
+	server.exec(t, replica, "replconf", "ack", "1")
+	assert.Contains(t, infoField(t, server, client, "slave0"), "offset="+offset+",")
+
+	// 暂停的从节点不再发送 ACK, lag 是距离上一次 ACK 的秒数
+	server.repl.mux.Lock()
+	replica.repl.ackTime = time.Now().Add(-5 * time.Second)
+	server.repl.mux.Unlock()
+	assert.True(t, strings.HasSuffix(infoField(t, server, client, "slave0"), ",lag=5"))
+
+	// GETACK 追加到复制流中, 计入偏移量
+	server.repl.RequestAcks()
+	getAck := "*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n"
+	assert.Equal(t, getAck, conn.take())
+	before, _ := strconv.Atoi(offset)
+	assert.Equal(t, strconv.Itoa(before+len(getAck)), infoField(t, server, client, "master_repl_offset"))
+
+	// 空闲的连接定时发送 PING 保持心跳
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "repl-ping-replica-period", "1"))
+	defer server.exec(t, client, "config", "set", "repl-ping-replica-period", "10")
+	assert.Equal(t, "-ERR CONFIG SET failed (possibly related to argument 'repl-timeout') - argument must be greater than 0\r\n",
+		server.exec(t, client, "config", "set", "repl-timeout", "0"))
+	server.repl.cron()
+	assert.Equal(t, "*1\r\n$4\r\nPING\r\n", conn.take())
+	server.repl.cron()
+	assert.Equal(t, "", conn.take())
+
+	// 超过 repl-timeout 没有 ACK 的从节点被断开
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "repl-timeout", "10"))
+	defer server.exec(t, client, "config", "set", "repl-timeout", "60")
+	server.repl.cron()
+	assert.Equal(t, "1", infoField(t, server, client, "connected_slaves"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "set", "repl-timeout", "3"))
+	server.repl.cron()
+	assert.Equal(t, "0", infoField(t, server, client, "connected_slaves"))
+}
+
+func TestReplicaGetAck(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	// 普通客户端的 GETACK 被忽略
+	assert.Equal(t, "", server.exec(t, client, "replconf", "getack", "*"))
+	assert.Equal(t, 0, len(server.repl.ackNow))
+
+	// 主节点的 GETACK 通知发送 ACK 的协程立即发送
+	master, _ := server.newClient()
+	master.master = true
+	master.PushCmd([][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")})
+	assert.Nil(t, server.process(context.Background(), master))
+	assert.Equal(t, 1, len(server.repl.ackNow))
+}
+
+func TestFailoverPauseWrites(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "-ERR FAILOVER requires connected replicas.\r\n", server.exec(t, client, "failover"))
+	replica, _ := server.newClient()
+	server.exec(t, replica, "replconf", "listening-port", "6380")
+	assert.True(t, strings.HasPrefix(server.exec(t, replica, "psync", "?", "-1"), "+FULLRESYNC "))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(infoField(t, server, client, "slave0"), "state=online")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for args, reply := range map[string]string{
+		"failover to 127.0.0.1 6381":       "-ERR FAILOVER target HOST and PORT is not a replica.\r\n",
+		"failover to 127.0.0.1 6380 force": "-ERR FAILOVER with force option requires both a timeout and target HOST and IP.\r\n",
+		"failover timeout 0":               "-ERR FAILOVER timeout must be greater than 0\r\n",
+		"failover abort timeout 10":        "-ERR syntax error\r\n",
+		"failover abort":                   "-ERR No failover in progress.\r\n",
+	} {
+		assert.Equal(t, reply, server.exec(t, client, strings.Fields(args)...), args)
+	}
+	server.exec(t, client, "set", "foo", "bar")
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "failover", "to", "127.0.0.1", "6380"))
+	assert.Equal(t, "waiting-for-sync", infoField(t, server, client, "master_failover_state"))
+	assert.Equal(t, "-ERR FAILOVER already in progress.\r\n", server.exec(t, client, "failover"))
+
+	// 写命令和之后的命令留在队列中, 只读命令不受影响
+	writer, conn := server.newClient()
+	assert.Equal(t, "", server.exec(t, writer, "set", "foo", "baz"))
+	assert.Equal(t, "", server.exec(t, writer, "get", "foo"))
+	scripter, _ := server.newClient()
+	assert.Equal(t, "", server.exec(t, scripter, "eval", "return 1", "0"))
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, client, "get", "foo"))
+	// 暂停期间不发送 PING, 偏移量保持不变
+	offset := infoField(t, server, client, "master_repl_offset")
+	server.repl.cron()
+	assert.Equal(t, offset, infoField(t, server, client, "master_repl_offset"))
+
+	// ABORT 之后唤醒被暂停的客户端, 按照原来的顺序执行
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "failover", "abort"))
+	assert.Equal(t, "no-failover", infoField(t, server, client, "master_failover_state"))
+	assert.Equal(t, 1, conn.woken)
+	assert.Nil(t, server.process(context.Background(), writer))
+	assert.Equal(t, "+OK\r\n$3\r\nbaz\r\n", conn.take())
+
+	// 从节点没有在 TIMEOUT 之前追上时放弃
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "failover", "timeout", "1"))
+	time.Sleep(5 * time.Millisecond)
+	server.repl.updateFailover()
+	assert.Equal(t, "no-failover", infoField(t, server, client, "master_failover_state"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, writer, "set", "foo", "bar"))
+}
+
+func TestFailover(t *testing.T) {
+	useTempDir(t)
+	// 两个节点共用配置, 从节点通过 REPLCONF listening-port 告诉主节点自己的端口
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	replicaPort := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	port := config.Properties.Port
+	config.Properties.Port = replicaPort
+	t.Cleanup(func() {
+		config.Properties.Port = port
+	})
+	master := newTestServer()
+	masterPort := serve(t, master)
+	replica := newTestServer()
+	serveOn(t, replica, replicaPort)
+
+	client, _ := master.newClient()
+	other, _ := replica.newClient()
+	master.exec(t, client, "set", "foo", "bar")
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "replicaof", "127.0.0.1", strconv.Itoa(masterPort)))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(infoField(t, master, client, "slave0"), "state=online")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "-ERR PSYNC FAILOVER replid must match my replid.\r\n",
+		replica.exec(t, other, "psync", "0123", "1", "failover"))
+
+	assert.Equal(t, "+OK\r\n", master.exec(t, client, "failover", "to", "127.0.0.1", strconv.Itoa(replicaPort)))
+	defer master.exec(t, client, "replicaof", "no", "one")
+	assert.Eventually(t, func() bool {
+		return infoField(t, master, client, "master_link_status") == "up" &&
+			infoField(t, master, client, "master_failover_state") == "no-failover"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 角色互换, 原来的主节点部分重同步到新的主节点
+	assert.Equal(t, "master", infoField(t, replica, other, "role"))
+	assert.Equal(t, "slave", infoField(t, master, client, "role"))
+	assert.Equal(t, "1", infoStats(t, replica, other, "sync_partial_ok"))
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", master.exec(t, client, "set", "foo", "baz"))
+	assert.Equal(t, "+OK\r\n", replica.exec(t, other, "set", "foo", "new"))
+	assert.Eventually(t, func() bool {
+		return master.exec(t, client, "get", "foo") == "$3\r\nnew\r\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
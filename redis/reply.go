@@ -1,12 +1,35 @@
 package redis
 
 import (
-	"bytes"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// maxPooledReplyBuffer 超过这个大小的缓冲区不放回 replyBufferPool, 避免一次很大的回复一直占用内存
+const maxPooledReplyBuffer = 1 << 20
+
+// replyBufferPool 拼接数组回复时使用的临时缓冲区, 写入客户端之后就放回去
+var replyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+func getReplyBuffer() *[]byte {
+	return replyBufferPool.Get().(*[]byte)
+}
+
+func putReplyBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledReplyBuffer {
+		return
+	}
+	*buf = (*buf)[:0]
+	replyBufferPool.Put(buf)
+}
+
 type Reply interface {
 	WriteTo(client *Client) error
 	ToBytes() []byte
@@ -48,7 +71,7 @@ type IntReply struct {
 
 func (s *IntReply) WriteTo(client *Client) error {
 
-	if _, err := client.Write(smallTypeLineWithNum(':', int(s.Num))); err != nil {
+	if _, err := client.Write(s.ToBytes()); err != nil {
 		return err
 	}
 
@@ -56,10 +79,17 @@ func (s *IntReply) WriteTo(client *Client) error {
 }
 
 func (s *IntReply) ToBytes() []byte {
+	if s.Num >= 0 && s.Num < sharedIntegers {
+		return sharedIntBytes[s.Num]
+	}
 	return smallTypeLineWithNum(':', int(s.Num))
 }
 
+// MakeIntReply 小的非负整数返回共享的回复, 不能修改返回值的 Num
 func MakeIntReply(num int64) *IntReply {
+	if num >= 0 && num < sharedIntegers {
+		return sharedIntReplies[num]
+	}
 	return &IntReply{
 		Num: num,
 	}
@@ -79,20 +109,49 @@ func smallTypeLineWithNum(ttype byte, num int) []byte {
 	return result
 }
 
+// appendBulkHeader 追加 $<len>\r\n
+func appendBulkHeader(buf []byte, n int) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, CRLF...)
+}
+
 func (b *BulkReply) WriteTo(client *Client) error {
 	if b.Arg == nil {
 		return MakeNullBulkReply().WriteTo(client)
 	}
-	if _, err := client.Write(b.ToBytes()); err != nil {
+	// 直接写入客户端的缓冲区, 不用先拼接出完整的回复
+	buf := getReplyBuffer()
+	*buf = appendBulkHeader(*buf, len(b.Arg))
+	_, err := client.Write(*buf)
+	putReplyBuffer(buf)
+	if err != nil {
+		return err
+	}
+	if _, err = client.Write(b.Arg); err != nil {
+		return err
+	}
+	if _, err = client.Write(CRLFBytes); err != nil {
 		return err
 	}
 	return client.Flush()
 }
 
+// Encode 只有 nil 和协议版本有关, RESP3 中是 null
+func (b *BulkReply) Encode(protocol int) []byte {
+	if b.Arg == nil {
+		return MakeNullBulkReply().Encode(protocol)
+	}
+	return b.ToBytes()
+}
+
 func (b *BulkReply) ToBytes() []byte {
 	if b.Arg == nil {
 		return nullBulkReplyBytes
 	}
+	if len(b.Arg) == 0 {
+		return emptyBulkBytes
+	}
 	argLenStr := strconv.Itoa(len(b.Arg))
 	bufLen := 1 + len(argLenStr) + 2 + len(b.Arg) + 2
 	buffer := make([]byte, 0, bufLen)
@@ -137,17 +196,29 @@ func (m *MultiBulkReply) WriteTo(client *Client) error {
 	if m.Args == nil {
 		return MakeNullBulkReply().WriteTo(client)
 	}
-
-	if _, err := client.Write(smallTypeLineWithNum('*', len(m.Args))); err != nil {
+	// 在临时缓冲区中拼接好之后一次写入, 缓冲区可以复用
+	buf := getReplyBuffer()
+	*buf = m.appendTo(*buf, client.Protocol())
+	_, err := client.Write(*buf)
+	putReplyBuffer(buf)
+	if err != nil {
 		return err
 	}
+	return client.Flush()
+}
 
+func (m *MultiBulkReply) Encode(protocol int) []byte {
+	if protocol != resp3 {
+		return m.ToBytes()
+	}
+	if m.Args == nil {
+		return resp3NullBytes
+	}
+	replies := make([]Reply, 0, len(m.Args))
 	for _, arg := range m.Args {
-		if _, err := client.Write(MakeBulkReply(arg).ToBytes()); err != nil {
-			return err
-		}
+		replies = append(replies, MakeBulkReply(arg))
 	}
-	return client.Flush()
+	return encodeAggregate('*', len(replies), replies, protocol)
 }
 
 func (m *MultiBulkReply) ToBytes() []byte {
@@ -163,23 +234,24 @@ func (m *MultiBulkReply) ToBytes() []byte {
 			bufLen += 1 + len(strconv.Itoa(len(arg))) + 2 + len(arg) + 2
 		}
 	}
-	buffer := make([]byte, 0, bufLen)
-	buffer = append(buffer, '*')
-	buffer = append(buffer, []byte(strconv.Itoa(argLen))...)
-	buffer = append(buffer, CRLFBytes...)
+	return m.appendTo(make([]byte, 0, bufLen), resp2)
+}
+
+// appendTo 追加数组的编码, nil 元素按照协议版本编码
+func (m *MultiBulkReply) appendTo(buf []byte, protocol int) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(m.Args)), 10)
+	buf = append(buf, CRLF...)
 	for _, arg := range m.Args {
 		if arg == nil {
-			buffer = append(buffer, []byte{'$', '-', '1'}...)
-			buffer = append(buffer, CRLFBytes...)
-		} else {
-			buffer = append(buffer, '$')
-			buffer = append(buffer, []byte(strconv.Itoa(len(arg)))...)
-			buffer = append(buffer, CRLFBytes...)
-			buffer = append(buffer, arg...)
-			buffer = append(buffer, CRLFBytes...)
+			buf = append(buf, MakeNullBulkReply().Encode(protocol)...)
+			continue
 		}
+		buf = appendBulkHeader(buf, len(arg))
+		buf = append(buf, arg...)
+		buf = append(buf, CRLF...)
 	}
-	return buffer
+	return buf
 }
 
 func MakeMultiBulkReply(args [][]byte) *MultiBulkReply {
@@ -193,33 +265,18 @@ type MultiRowReply struct {
 }
 
 func (ml *MultiRowReply) WriteTo(client *Client) error {
-	if ml.replies == nil {
-		return MakeNullBulkReply().WriteTo(client)
-	}
-	argLen := len(ml.replies)
-	if _, err := client.Write(smallTypeLineWithNum('*', argLen)); err != nil {
-		return err
-	}
-	for _, reply := range ml.replies {
-		err := reply.WriteTo(client)
-		if err != nil {
-			return err
-		}
-	}
-	return client.Flush()
+	return writeReply(client, ml)
 }
 
 func (ml *MultiRowReply) ToBytes() []byte {
+	return ml.Encode(resp2)
+}
+
+func (ml *MultiRowReply) Encode(protocol int) []byte {
 	if ml.replies == nil {
-		return nullBulkReplyBytes
-	}
-	argLen := len(ml.replies)
-	var buf bytes.Buffer
-	buf.Write(smallTypeLineWithNum('*', argLen))
-	for _, reply := range ml.replies {
-		buf.Write(reply.ToBytes())
+		return MakeNullBulkReply().Encode(protocol)
 	}
-	return buf.Bytes()
+	return encodeAggregate('*', len(ml.replies), ml.replies, protocol)
 }
 
 func MakeMultiRowReply(replies []Reply) *MultiRowReply {
@@ -233,7 +290,7 @@ type StandardErrReply struct {
 }
 
 func (s *StandardErrReply) WriteTo(client *Client) error {
-	if _, err := client.Write(s.ToBytes()); err != nil {
+	if _, err := client.writeError(s.ToBytes()); err != nil {
 		return err
 	}
 	return client.Flush()
@@ -243,7 +300,8 @@ func (s *StandardErrReply) ToBytes() []byte {
 	bufLen := 3 + len(s.Status)
 	buff := make([]byte, 0, bufLen)
 	buff = append(buff, []byte{'-'}...)
-	buff = append(buff, []byte(s.Status)...)
+	// 与 redis 一样把错误中的换行替换为空格, 错误中带着客户端的参数时也不会破坏协议
+	buff = append(buff, oneLine(s.Status)...)
 	buff = append(buff, CRLFBytes...)
 	return buff
 }
@@ -279,28 +337,28 @@ func MakeNumberOfArgsErrReply(cmdName string) *NumberOfArgsErrReply {
 type UnknownCommandReply struct {
 	cmdName string
 	args    []string
+	// suggestions 相近的已注册命令, 附加在错误信息的末尾
+	suggestions []string
 }
 
-func (u *UnknownCommandReply) WriteTo(client *Client) error {
-	var errMsg string
-	if u.args != nil {
-		argJoin := strings.Join(u.args, ", ")
-		errMsg = fmt.Sprintf("ERR unknown command '%s', with args beginning with: %v", u.cmdName, argJoin)
-	} else {
-		errMsg = fmt.Sprintf("ERR unknown command '%s', with args beginning with: ", u.cmdName)
+func (u *UnknownCommandReply) errMsg() string {
+	errMsg := fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", u.cmdName, strings.Join(u.args, ", "))
+	if n := len(u.suggestions); n > 0 {
+		candidates := u.suggestions[0]
+		if n > 1 {
+			candidates = strings.Join(u.suggestions[:n-1], ", ") + " or " + u.suggestions[n-1]
+		}
+		errMsg += ". Did you mean " + candidates + "?"
 	}
-	return MakeStandardErrReply(errMsg).WriteTo(client)
+	return errMsg
+}
+
+func (u *UnknownCommandReply) WriteTo(client *Client) error {
+	return MakeStandardErrReply(u.errMsg()).WriteTo(client)
 }
 
 func (u *UnknownCommandReply) ToBytes() []byte {
-	var errMsg string
-	if u.args != nil {
-		argJoin := strings.Join(u.args, ", ")
-		errMsg = fmt.Sprintf("ERR unknown command '%s', with args beginning with: %v", u.cmdName, argJoin)
-	} else {
-		errMsg = fmt.Sprintf("ERR unknown command '%s', with args beginning with: ", u.cmdName)
-	}
-	return MakeStandardErrReply(errMsg).ToBytes()
+	return MakeStandardErrReply(u.errMsg()).ToBytes()
 }
 
 func MakeUnknownCommand(cmdName string, args ...string) *UnknownCommandReply {
@@ -309,3 +367,52 @@ func MakeUnknownCommand(cmdName string, args ...string) *UnknownCommandReply {
 		args:    args,
 	}
 }
+
+// MapReply RESP3 的map类型, RESP2 的客户端收到的是扁平的数组
+type MapReply struct {
+	pairs []Reply
+}
+
+func (m *MapReply) WriteTo(client *Client) error {
+	return writeReply(client, m)
+}
+
+func (m *MapReply) ToBytes() []byte {
+	return m.Encode(resp2)
+}
+
+func (m *MapReply) Encode(protocol int) []byte {
+	if protocol == resp3 {
+		return encodeAggregate('%', len(m.pairs)/2, m.pairs, protocol)
+	}
+	return encodeAggregate('*', len(m.pairs), m.pairs, protocol)
+}
+
+// MakeMapReply pairs 依次为 key, value
+func MakeMapReply(pairs []Reply) *MapReply {
+	return &MapReply{pairs: pairs}
+}
+
+// PushReply RESP3 的push类型, 用于服务端主动推送的消息, RESP2 的客户端收到的是数组
+type PushReply struct {
+	replies []Reply
+}
+
+func (p *PushReply) WriteTo(client *Client) error {
+	return writeReply(client, p)
+}
+
+func (p *PushReply) ToBytes() []byte {
+	return p.Encode(resp2)
+}
+
+func (p *PushReply) Encode(protocol int) []byte {
+	if protocol == resp3 {
+		return encodeAggregate('>', len(p.replies), p.replies, protocol)
+	}
+	return encodeAggregate('*', len(p.replies), p.replies, protocol)
+}
+
+func MakePushReply(replies []Reply) *PushReply {
+	return &PushReply{replies: replies}
+}
@@ -1,37 +1,79 @@
 package redis
 
+import "strconv"
+
 const (
 	CRLF               = "\r\n"
 	PING               = "+PONG" + CRLF
 	NullBulk           = "$-1" + CRLF
+	Resp3Null          = "_" + CRLF
 	EmptyMultiBulk     = "*0" + CRLF
+	NullMultiBulk      = "*-1" + CRLF
+	EmptyBulk          = "$0" + CRLF + CRLF
 	OKReply            = "+OK" + CRLF
+	Queued             = "+QUEUED" + CRLF
 	SyntaxReplyS       = "-ERR syntax error" + CRLF
 	OutOfRangeOrNotInt = "-ERR value is not an integer or out of range" + CRLF
 	wrongTypeStr       = "-WRONGTYPE Operation against a key holding the wrong kind of value" + CRLF
 )
 
+// 共享的回复和编码好的数据, 所有的客户端共用同一份, 不能修改.
+// cap 等于 len, 调用方 append 时会重新分配, 不会写到共享的数据里
 var (
-	CRLFBytes               = []byte(CRLF)
-	pongReplyBytes          = []byte(PING)
-	nullBulkReplyBytes      = []byte(NullBulk)
-	emptyMultiBulkBytes     = []byte(EmptyMultiBulk)
-	okReplyBytes            = []byte(OKReply)
-	synTaxReplyBytes        = []byte(SyntaxReplyS)
-	outOfRangeOrNotIntBytes = []byte(OutOfRangeOrNotInt)
-	wrongTypeErrBytes       = []byte(wrongTypeStr)
+	CRLFBytes               = sharedBytes(CRLF)
+	pongReplyBytes          = sharedBytes(PING)
+	nullBulkReplyBytes      = sharedBytes(NullBulk)
+	resp3NullBytes          = sharedBytes(Resp3Null)
+	emptyMultiBulkBytes     = sharedBytes(EmptyMultiBulk)
+	nullMultiBulkBytes      = sharedBytes(NullMultiBulk)
+	emptyBulkBytes          = sharedBytes(EmptyBulk)
+	okReplyBytes            = sharedBytes(OKReply)
+	queuedReplyBytes        = sharedBytes(Queued)
+	synTaxReplyBytes        = sharedBytes(SyntaxReplyS)
+	outOfRangeOrNotIntBytes = sharedBytes(OutOfRangeOrNotInt)
+	wrongTypeErrBytes       = sharedBytes(wrongTypeStr)
 )
 
 var (
 	poneReply             = &PongReply{}
 	nullBulkReply         = &NullBulkReply{}
 	emptyMultiBulkReply   = &EmptyMultiBulkReply{}
+	nullMultiBulkReply    = &NullMultiBulkReply{}
+	emptyBulkReply        = &BulkReply{Arg: []byte{}}
 	wrongTypeErrReply     = &WrongTypeErrReply{}
 	okReply               = &OkReply{}
+	queuedReply           = &QueuedReply{}
 	syntaxReply           = &SyntaxReply{}
 	outOfRangeOrNotIntErr = &OutOfRangeOrNotIntErr{}
 )
 
+// sharedIntegers [0, sharedIntegers) 的整数回复是共享的, 与 redis 的 OBJ_SHARED_INTEGERS 一致
+const sharedIntegers = 10000
+
+var (
+	sharedIntReplies [sharedIntegers]*IntReply
+	sharedIntBytes   [sharedIntegers][]byte
+)
+
+func init() {
+	// 所有的编码放在一块内存中, 长度按照位数算出来, append 不会重新分配
+	buf := make([]byte, 0, 3*sharedIntegers+len(strconv.Itoa(sharedIntegers))*sharedIntegers)
+	for i := 0; i < sharedIntegers; i++ {
+		start := len(buf)
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, CRLF...)
+		sharedIntBytes[i] = buf[start:len(buf):len(buf)]
+		sharedIntReplies[i] = &IntReply{Num: int64(i)}
+	}
+}
+
+// sharedBytes cap 等于 len 的编码, 见上面的说明
+func sharedBytes(s string) []byte {
+	b := []byte(s)
+	return b[:len(b):len(b)]
+}
+
 type PongReply struct{}
 
 func (*PongReply) WriteTo(client *Client) error {
@@ -50,23 +92,55 @@ func MakePongReply() *PongReply {
 	return poneReply
 }
 
+// NullBulkReply RESP2 的 $-1, RESP3 的 null
 type NullBulkReply struct{}
 
 func (n *NullBulkReply) WriteTo(client *Client) error {
-	if _, err := client.Write(nullBulkReplyBytes); err != nil {
-		return err
-	}
-	return client.Flush()
+	return writeReply(client, n)
 }
 
 func (n *NullBulkReply) ToBytes() []byte {
 	return nullBulkReplyBytes
 }
 
+func (n *NullBulkReply) Encode(protocol int) []byte {
+	if protocol == resp3 {
+		return resp3NullBytes
+	}
+	return nullBulkReplyBytes
+}
+
 func MakeNullBulkReply() *NullBulkReply {
 	return nullBulkReply
 }
 
+// NullMultiBulkReply RESP2 的 *-1, RESP3 的 null
+type NullMultiBulkReply struct{}
+
+func (n *NullMultiBulkReply) WriteTo(client *Client) error {
+	return writeReply(client, n)
+}
+
+func (n *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
+func (n *NullMultiBulkReply) Encode(protocol int) []byte {
+	if protocol == resp3 {
+		return resp3NullBytes
+	}
+	return nullMultiBulkBytes
+}
+
+func MakeNullMultiBulkReply() *NullMultiBulkReply {
+	return nullMultiBulkReply
+}
+
+// MakeEmptyBulkReply 空字符串 $0
+func MakeEmptyBulkReply() *BulkReply {
+	return emptyBulkReply
+}
+
 type EmptyMultiBulkReply struct{}
 
 func (e *EmptyMultiBulkReply) WriteTo(client *Client) error {
@@ -87,7 +161,7 @@ func MakeEmptyMultiBulkReply() *EmptyMultiBulkReply {
 type WrongTypeErrReply struct{}
 
 func (w *WrongTypeErrReply) WriteTo(client *Client) error {
-	if _, err := client.Write(wrongTypeErrBytes); err != nil {
+	if _, err := client.writeError(wrongTypeErrBytes); err != nil {
 		return err
 	}
 	return client.Flush()
@@ -102,10 +176,6 @@ func (w *WrongTypeErrReply) Error() string {
 	return "WRONGTYPE Operation against a key holding the wrong kind of value"
 }
 
-func MakeWrongTypeErrReply() *WrongTypeErrReply {
-	return wrongTypeErrReply
-}
-
 type OkReply struct{}
 
 func (o *OkReply) WriteTo(client *Client) error {
@@ -123,11 +193,29 @@ func MakeOkReply() *OkReply {
 	return okReply
 }
 
+// QueuedReply MULTI 之后的命令回复 +QUEUED
+type QueuedReply struct{}
+
+func (q *QueuedReply) WriteTo(client *Client) error {
+	if _, err := client.Write(queuedReplyBytes); err != nil {
+		return err
+	}
+	return client.Flush()
+}
+
+func (q *QueuedReply) ToBytes() []byte {
+	return queuedReplyBytes
+}
+
+func MakeQueuedReply() *QueuedReply {
+	return queuedReply
+}
+
 type SyntaxReply struct {
 }
 
 func (s *SyntaxReply) WriteTo(client *Client) error {
-	if _, err := client.Write(synTaxReplyBytes); err != nil {
+	if _, err := client.writeError(synTaxReplyBytes); err != nil {
 		return err
 	}
 	return client.Flush()
@@ -137,14 +225,14 @@ func (s *SyntaxReply) ToBytes() []byte {
 	return synTaxReplyBytes
 }
 
-func MakeSyntaxReply() *SyntaxReply {
-	return syntaxReply
+func (s *SyntaxReply) Error() string {
+	return "ERR syntax error"
 }
 
 type OutOfRangeOrNotIntErr struct{}
 
 func (o *OutOfRangeOrNotIntErr) WriteTo(client *Client) error {
-	if _, err := client.Write(outOfRangeOrNotIntBytes); err != nil {
+	if _, err := client.writeError(outOfRangeOrNotIntBytes); err != nil {
 		return err
 	}
 	return client.Flush()
@@ -154,6 +242,6 @@ func (o *OutOfRangeOrNotIntErr) ToBytes() []byte {
 	return outOfRangeOrNotIntBytes
 }
 
-func MakeOutOfRangeOrNotInt() *OutOfRangeOrNotIntErr {
-	return outOfRangeOrNotIntErr
+func (o *OutOfRangeOrNotIntErr) Error() string {
+	return "ERR value is not an integer or out of range"
 }
@@ -0,0 +1,182 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 与 redis 7 一样的错误回复. 客户端按照错误的前缀(WRONGTYPE, NOSCRIPT, BUSYKEY, MOVED 等)甚至完整的文本判断错误,
+// 命令中的错误都应该使用这里的构造函数, 不要自己拼接
+
+// ErrKind 错误回复的种类, 用于 Is
+type ErrKind int
+
+const (
+	ErrWrongType ErrKind = iota
+	ErrSyntax
+	ErrNotInteger
+	ErrNotFloat
+	ErrOutOfRange
+	ErrNoSuchKey
+	ErrOverflow
+	ErrBusyKey
+	ErrNoScript
+	ErrOOM
+	ErrNoAuth
+	ErrReadonly
+	ErrBusy
+	ErrNotBusy
+	ErrExecAbort
+	ErrMoved
+	ErrUnknownSubcommand
+	ErrLoading
+	ErrInvalidExpireTime
+)
+
+// errKindText 每种错误的完整文本, 带参数的错误只有固定的前缀
+var errKindText = map[ErrKind]struct {
+	text   string
+	prefix bool
+}{
+	ErrWrongType:         {text: "WRONGTYPE Operation against a key holding the wrong kind of value"},
+	ErrSyntax:            {text: "ERR syntax error"},
+	ErrNotInteger:        {text: "ERR value is not an integer or out of range"},
+	ErrNotFloat:          {text: "ERR value is not a valid float"},
+	ErrOutOfRange:        {text: "ERR index out of range"},
+	ErrNoSuchKey:         {text: "ERR no such key"},
+	ErrOverflow:          {text: "ERR increment or decrement would overflow"},
+	ErrBusyKey:           {text: "BUSYKEY Target key name already exists."},
+	ErrNoScript:          {text: "NOSCRIPT No matching script. Please use EVAL."},
+	ErrOOM:               {text: "OOM command not allowed when used memory > 'maxmemory'."},
+	ErrNoAuth:            {text: "NOAUTH Authentication required."},
+	ErrReadonly:          {text: "READONLY You can't write against a read only replica."},
+	ErrBusy:              {text: "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."},
+	ErrNotBusy:           {text: "NOTBUSY No scripts in execution right now."},
+	ErrExecAbort:         {text: "EXECABORT Transaction discarded because of previous errors."},
+	ErrMoved:             {text: "MOVED ", prefix: true},
+	ErrUnknownSubcommand: {text: "ERR unknown subcommand '", prefix: true},
+	ErrLoading:           {text: "LOADING Redis is loading the dataset in memory"},
+	ErrInvalidExpireTime: {text: "ERR invalid expire time in '", prefix: true},
+}
+
+// 不带参数的错误是共享的, 和 reply_const.go 中的回复一样不能修改
+var (
+	notFloatErr   = MakeStandardErrReply(errKindText[ErrNotFloat].text)
+	outOfRangeErr = MakeStandardErrReply(errKindText[ErrOutOfRange].text)
+	noSuchKeyErr  = MakeStandardErrReply(errKindText[ErrNoSuchKey].text)
+	overflowErr   = MakeStandardErrReply(errKindText[ErrOverflow].text)
+	busyKeyErr    = MakeStandardErrReply(errKindText[ErrBusyKey].text)
+	noScriptErr   = MakeStandardErrReply(errKindText[ErrNoScript].text)
+	oomErr        = MakeStandardErrReply(errKindText[ErrOOM].text)
+	noAuthErr     = MakeStandardErrReply(errKindText[ErrNoAuth].text)
+	readonlyErr   = MakeStandardErrReply(errKindText[ErrReadonly].text)
+	busyErr       = MakeStandardErrReply(errKindText[ErrBusy].text)
+	notBusyErr    = MakeStandardErrReply(errKindText[ErrNotBusy].text)
+	execAbortErr  = MakeStandardErrReply(errKindText[ErrExecAbort].text)
+	loadingErr    = MakeStandardErrReply(errKindText[ErrLoading].text)
+)
+
+// Is 返回 reply 是否是 kind 这种错误, 测试和内部的调用方不需要比较错误的文本
+func Is(reply Reply, kind ErrKind) bool {
+	errReply, ok := reply.(ErrReply)
+	if !ok {
+		return false
+	}
+	expected, ok := errKindText[kind]
+	if !ok {
+		return false
+	}
+	if expected.prefix {
+		return strings.HasPrefix(errReply.Error(), expected.text)
+	}
+	return errReply.Error() == expected.text
+}
+
+func MakeWrongTypeErr() *WrongTypeErrReply {
+	return wrongTypeErrReply
+}
+
+func MakeSyntaxErr() *SyntaxReply {
+	return syntaxReply
+}
+
+// MakeNotIntegerErr 参数不是整数或者超出了 int64 的范围
+func MakeNotIntegerErr() *OutOfRangeOrNotIntErr {
+	return outOfRangeOrNotIntErr
+}
+
+func MakeNotFloatErr() *StandardErrReply {
+	return notFloatErr
+}
+
+// MakeOutOfRangeErr 下标超出了范围, 与 redis 的 shared.outofrangeerr 一致
+func MakeOutOfRangeErr() *StandardErrReply {
+	return outOfRangeErr
+}
+
+func MakeNoSuchKeyErr() *StandardErrReply {
+	return noSuchKeyErr
+}
+
+// MakeOverflowErr INCR 等命令的结果超出了 int64 的范围
+func MakeOverflowErr() *StandardErrReply {
+	return overflowErr
+}
+
+func MakeBusyKeyErr() *StandardErrReply {
+	return busyKeyErr
+}
+
+func MakeNoScriptErr() *StandardErrReply {
+	return noScriptErr
+}
+
+func MakeOOMErr() *StandardErrReply {
+	return oomErr
+}
+
+func MakeNoAuthErr() *StandardErrReply {
+	return noAuthErr
+}
+
+func MakeReadonlyErr() *StandardErrReply {
+	return readonlyErr
+}
+
+func MakeBusyErr() *StandardErrReply {
+	return busyErr
+}
+
+func MakeNotBusyErr() *StandardErrReply {
+	return notBusyErr
+}
+
+func MakeExecAbortErr() *StandardErrReply {
+	return execAbortErr
+}
+
+// MakeLoadingErr 启动时还在加载数据
+func MakeLoadingErr() *StandardErrReply {
+	return loadingErr
+}
+
+// MakeMovedErr 哈希槽不在这个节点上, addr 是 ip:port
+func MakeMovedErr(slot int, addr string) *StandardErrReply {
+	return MakeStandardErrReply(errKindText[ErrMoved].text + strconv.Itoa(slot) + " " + addr)
+}
+
+// MakeInvalidExpireTimeErr 过期时间不是正数(SET EX, SETEX)或者转换为毫秒时间戳溢出, cmdName 是小写的命令名
+func MakeInvalidExpireTimeErr(cmdName string) *StandardErrReply {
+	return MakeStandardErrReply(errKindText[ErrInvalidExpireTime].text + cmdName + "' command")
+}
+
+// maxSubcommandLen 与 redis 一样, 错误中的子命令最多保留 128 个字节
+const maxSubcommandLen = 128
+
+// MakeUnknownSubcommandErr 不支持的子命令, cmd 是父命令的名字, eg: MakeUnknownSubcommandErr("foo", "CLIENT")
+func MakeUnknownSubcommandErr(subcommand, cmd string) *StandardErrReply {
+	if len(subcommand) > maxSubcommandLen {
+		subcommand = subcommand[:maxSubcommandLen]
+	}
+	return MakeStandardErrReply(errKindText[ErrUnknownSubcommand].text + subcommand + "'. Try " + cmd + " HELP.")
+}
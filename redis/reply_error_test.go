@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestErrorReplyConformance(t *testing.T) {
+	// redis-server 7 回复的原始数据
+	cases := []struct {
+		reply    ErrReply
+		kind     ErrKind
+		expected string
+	}{
+		{MakeWrongTypeErr(), ErrWrongType, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{MakeSyntaxErr(), ErrSyntax, "-ERR syntax error\r\n"},
+		{MakeNotIntegerErr(), ErrNotInteger, "-ERR value is not an integer or out of range\r\n"},
+		{MakeNotFloatErr(), ErrNotFloat, "-ERR value is not a valid float\r\n"},
+		{MakeOutOfRangeErr(), ErrOutOfRange, "-ERR index out of range\r\n"},
+		{MakeNoSuchKeyErr(), ErrNoSuchKey, "-ERR no such key\r\n"},
+		{MakeOverflowErr(), ErrOverflow, "-ERR increment or decrement would overflow\r\n"},
+		{MakeBusyKeyErr(), ErrBusyKey, "-BUSYKEY Target key name already exists.\r\n"},
+		{MakeNoScriptErr(), ErrNoScript, "-NOSCRIPT No matching script. Please use EVAL.\r\n"},
+		{MakeOOMErr(), ErrOOM, "-OOM command not allowed when used memory > 'maxmemory'.\r\n"},
+		{MakeNoAuthErr(), ErrNoAuth, "-NOAUTH Authentication required.\r\n"},
+		{MakeReadonlyErr(), ErrReadonly, "-READONLY You can't write against a read only replica.\r\n"},
+		{MakeBusyErr(), ErrBusy, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n"},
+		{MakeNotBusyErr(), ErrNotBusy, "-NOTBUSY No scripts in execution right now.\r\n"},
+		{MakeExecAbortErr(), ErrExecAbort, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{MakeLoadingErr(), ErrLoading, "-LOADING Redis is loading the dataset in memory\r\n"},
+		{MakeMovedErr(3999, "127.0.0.1:6381"), ErrMoved, "-MOVED 3999 127.0.0.1:6381\r\n"},
+		{MakeUnknownSubcommandErr("foo", "CLIENT"), ErrUnknownSubcommand, "-ERR unknown subcommand 'foo'. Try CLIENT HELP.\r\n"},
+		{MakeInvalidExpireTimeErr("set"), ErrInvalidExpireTime, "-ERR invalid expire time in 'set' command\r\n"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, string(c.reply.ToBytes()))
+		assert.Equal(t, strings.TrimSuffix(c.expected[1:], CRLF), c.reply.Error())
+		for _, other := range cases {
+			assert.Equal(t, c.kind == other.kind, Is(c.reply, other.kind), c.expected)
+		}
+	}
+	// 子命令最多保留 128 个字节
+	long := strings.Repeat("x", 200)
+	assert.Equal(t, "-ERR unknown subcommand '"+long[:128]+"'. Try CONFIG HELP.\r\n",
+		string(MakeUnknownSubcommandErr(long, "CONFIG").ToBytes()))
+	assert.False(t, Is(MakeOkReply(), ErrSyntax))
+	assert.False(t, Is(MakeStandardErrReply("ERR syntax error in HELLO"), ErrSyntax))
+}
+
+func TestErrorReplyKinds(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "rpush", "list", "a")
+	server.exec(t, client, "set", "str", "v")
+	// 命令回复的错误和构造函数的一致
+	assert.Equal(t, string(MakeWrongTypeErr().ToBytes()), server.exec(t, client, "get", "list"))
+	assert.Equal(t, string(MakeWrongTypeErr().ToBytes()), server.exec(t, client, "hget", "str", "f"))
+	assert.Equal(t, string(MakeNotIntegerErr().ToBytes()), server.exec(t, client, "incr", "str"))
+	assert.Equal(t, string(MakeNotFloatErr().ToBytes()), server.exec(t, client, "incrbyfloat", "str", "x"))
+	assert.Equal(t, string(MakeNoScriptErr().ToBytes()), server.exec(t, client, "evalsha", strings.Repeat("0", 40), "0"))
+	assert.Equal(t, string(MakeUnknownSubcommandErr("foo", "CONFIG").ToBytes()), server.exec(t, client, "config", "foo"))
+}
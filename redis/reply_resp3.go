@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+// RESP3 的类型. 客户端通过 HELLO 3 切换协议之后按照 RESP3 编码, RESP2 的客户端收到对应的 RESP2 类型:
+// map 和 set 变成数组, double 和 big number 变成字符串, boolean 变成整数, null 变成 $-1, push 变成数组
+
+// ProtocolReply 编码和客户端的协议版本有关的回复, ToBytes 返回 RESP2 的编码, 用于aof、复制流和脚本
+type ProtocolReply interface {
+	Reply
+	Encode(protocol int) []byte
+}
+
+// encodeReply 按照协议版本编码回复, 嵌套在数组和map中的回复同样按照这个版本编码
+func encodeReply(reply Reply, protocol int) []byte {
+	if p, ok := reply.(ProtocolReply); ok {
+		return p.Encode(protocol)
+	}
+	return reply.ToBytes()
+}
+
+// writeReply 按照客户端的协议版本写入回复
+func writeReply(client *Client, reply ProtocolReply) error {
+	if _, err := client.Write(reply.Encode(client.Protocol())); err != nil {
+		return err
+	}
+	return client.Flush()
+}
+
+// encodeAggregate 编码数组、map、set 和 push, num 是头部的数量, map 是键值对的数量
+func encodeAggregate(prefix byte, num int, replies []Reply, protocol int) []byte {
+	var buf bytes.Buffer
+	buf.Write(smallTypeLineWithNum(prefix, num))
+	for _, reply := range replies {
+		buf.Write(encodeReply(reply, protocol))
+	}
+	return buf.Bytes()
+}
+
+// bulkBytes RESP2 中用字符串表示的类型
+func bulkBytes(arg string) []byte {
+	return MakeBulkReply([]byte(arg)).ToBytes()
+}
+
+// SetReply RESP3 的set类型
+type SetReply struct {
+	members []Reply
+}
+
+func (s *SetReply) WriteTo(client *Client) error {
+	return writeReply(client, s)
+}
+
+func (s *SetReply) ToBytes() []byte {
+	return s.Encode(resp2)
+}
+
+func (s *SetReply) Encode(protocol int) []byte {
+	if protocol == resp3 {
+		return encodeAggregate('~', len(s.members), s.members, protocol)
+	}
+	return encodeAggregate('*', len(s.members), s.members, protocol)
+}
+
+func MakeSetReply(members []Reply) *SetReply {
+	return &SetReply{members: members}
+}
+
+// MakeBulkSetReply 成员都是字符串的set
+func MakeBulkSetReply(members [][]byte) *SetReply {
+	replies := make([]Reply, 0, len(members))
+	for _, member := range members {
+		replies = append(replies, MakeBulkReply(member))
+	}
+	return MakeSetReply(replies)
+}
+
+// DoubleReply RESP3 的double类型, RESP2 中是字符串
+type DoubleReply struct {
+	Value float64
+}
+
+func (d *DoubleReply) WriteTo(client *Client) error {
+	return writeReply(client, d)
+}
+
+func (d *DoubleReply) ToBytes() []byte {
+	return d.Encode(resp2)
+}
+
+func (d *DoubleReply) Encode(protocol int) []byte {
+	value := util.FormatFloat(d.Value)
+	if protocol == resp3 {
+		return []byte("," + value + CRLF)
+	}
+	return bulkBytes(value)
+}
+
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{Value: value}
+}
+
+// BoolReply RESP3 的boolean类型, RESP2 中是整数1和0
+type BoolReply struct {
+	Value bool
+}
+
+func (b *BoolReply) WriteTo(client *Client) error {
+	return writeReply(client, b)
+}
+
+func (b *BoolReply) ToBytes() []byte {
+	return b.Encode(resp2)
+}
+
+func (b *BoolReply) Encode(protocol int) []byte {
+	if protocol == resp3 {
+		if b.Value {
+			return []byte("#t" + CRLF)
+		}
+		return []byte("#f" + CRLF)
+	}
+	return smallTypeLineWithNum(':', boolToInt(b.Value))
+}
+
+func MakeBoolReply(value bool) *BoolReply {
+	return &BoolReply{Value: value}
+}
+
+// BigNumberReply RESP3 的big number类型, RESP2 中是字符串
+type BigNumberReply struct {
+	Num string
+}
+
+func (b *BigNumberReply) WriteTo(client *Client) error {
+	return writeReply(client, b)
+}
+
+func (b *BigNumberReply) ToBytes() []byte {
+	return b.Encode(resp2)
+}
+
+func (b *BigNumberReply) Encode(protocol int) []byte {
+	if protocol == resp3 {
+		return []byte("(" + b.Num + CRLF)
+	}
+	return bulkBytes(b.Num)
+}
+
+func MakeBigNumberReply(num string) *BigNumberReply {
+	return &BigNumberReply{Num: num}
+}
+
+// VerbatimReply RESP3 的verbatim string类型, format 是三个字符的格式, 比如 txt 和 mkd. RESP2 中是字符串
+type VerbatimReply struct {
+	Format string
+	Text   []byte
+}
+
+func (v *VerbatimReply) WriteTo(client *Client) error {
+	return writeReply(client, v)
+}
+
+func (v *VerbatimReply) ToBytes() []byte {
+	return v.Encode(resp2)
+}
+
+func (v *VerbatimReply) Encode(protocol int) []byte {
+	if protocol != resp3 {
+		return MakeBulkReply(v.Text).ToBytes()
+	}
+	var buf bytes.Buffer
+	buf.Write(smallTypeLineWithNum('=', len(v.Format)+1+len(v.Text)))
+	buf.WriteString(v.Format)
+	buf.WriteByte(':')
+	buf.Write(v.Text)
+	buf.Write(CRLFBytes)
+	return buf.Bytes()
+}
+
+// MakeVerbatimReply txt 格式的文本, 比如 INFO 和 CLIENT INFO
+func MakeVerbatimReply(text []byte) *VerbatimReply {
+	return &VerbatimReply{Format: "txt", Text: text}
+}
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestReplyEncoding(t *testing.T) {
+	bulk := func(arg string) Reply {
+		return MakeBulkReply([]byte(arg))
+	}
+	// 同一个回复分别按照 RESP2 和 RESP3 编码
+	cases := []struct {
+		name  string
+		reply Reply
+		resp2 string
+		resp3 string
+	}{
+		{"null", MakeNullBulkReply(), "$-1\r\n", "_\r\n"},
+		{"nil bulk", MakeBulkReply(nil), "$-1\r\n", "_\r\n"},
+		{"map", MakeMapReply([]Reply{bulk("a"), MakeIntReply(1), bulk("b"), MakeBulkReply(nil)}),
+			"*4\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n$-1\r\n", "%2\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n_\r\n"},
+		{"empty map", MakeMapReply(nil), "*0\r\n", "%0\r\n"},
+		{"set", MakeBulkSetReply([][]byte{[]byte("x"), []byte("y")}),
+			"*2\r\n$1\r\nx\r\n$1\r\ny\r\n", "~2\r\n$1\r\nx\r\n$1\r\ny\r\n"},
+		{"double", MakeDoubleReply(3.25), "$4\r\n3.25\r\n", ",3.25\r\n"},
+		{"double inf", MakeDoubleReply(math.Inf(-1)), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"double integral", MakeDoubleReply(1e6), "$7\r\n1000000\r\n", ",1000000\r\n"},
+		{"double exponent", MakeDoubleReply(1e17), "$5\r\n1e+17\r\n", ",1e+17\r\n"},
+		{"bool", MakeBoolReply(true), ":1\r\n", "#t\r\n"},
+		{"bool false", MakeBoolReply(false), ":0\r\n", "#f\r\n"},
+		{"big number", MakeBigNumberReply("3492890328409238509324850943850943825024385"),
+			"$43\r\n3492890328409238509324850943850943825024385\r\n", "(3492890328409238509324850943850943825024385\r\n"},
+		{"verbatim", MakeVerbatimReply([]byte("Some string")), "$11\r\nSome string\r\n", "=15\r\ntxt:Some string\r\n"},
+		{"push", MakePushReply([]Reply{bulk("message"), bulk("ch"), bulk("hi")}),
+			"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"},
+		{"nested", MakeMultiRowReply([]Reply{MakeMapReply([]Reply{bulk("k"), MakeDoubleReply(1.5)}), MakeBoolReply(false)}),
+			"*2\r\n*2\r\n$1\r\nk\r\n$3\r\n1.5\r\n:0\r\n", "*2\r\n%1\r\n$1\r\nk\r\n,1.5\r\n#f\r\n"},
+		{"multi bulk with nil", MakeMultiBulkReply([][]byte{[]byte("a"), nil}),
+			"*2\r\n$1\r\na\r\n$-1\r\n", "*2\r\n$1\r\na\r\n_\r\n"},
+	}
+	server := newTestServer()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.resp2, string(encodeReply(c.reply, resp2)))
+			assert.Equal(t, c.resp3, string(encodeReply(c.reply, resp3)))
+			// ToBytes 用于 aof、复制流和脚本, 总是 RESP2
+			assert.Equal(t, c.resp2, string(c.reply.ToBytes()))
+
+			// WriteTo 按照客户端协商的协议版本编码
+			client, conn := server.newClient()
+			assert.Nil(t, c.reply.WriteTo(client))
+			assert.Equal(t, c.resp2, conn.take())
+			client.protocol = resp3
+			assert.Nil(t, c.reply.WriteTo(client))
+			assert.Equal(t, c.resp3, conn.take())
+		})
+	}
+}
+
+func TestResp3Commands(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "hset", "hash", "f", "v")
+	server.exec(t, client, "sadd", "set", "m")
+
+	assert.Equal(t, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n", server.exec(t, client, "hgetall", "hash"))
+	assert.Equal(t, "*0\r\n", server.exec(t, client, "hgetall", "missing"))
+	assert.Equal(t, "*1\r\n$1\r\nm\r\n", server.exec(t, client, "smembers", "set"))
+	assert.Equal(t, "*2\r\n$12\r\nrepl-timeout\r\n$2\r\n60\r\n", server.exec(t, client, "config", "get", "repl-timeout"))
+	assert.True(t, strings.HasPrefix(server.exec(t, client, "client", "info"), "$"))
+
+	server.exec(t, client, "hello", "3")
+	assert.Equal(t, "%1\r\n$1\r\nf\r\n$1\r\nv\r\n", server.exec(t, client, "hgetall", "hash"))
+	assert.Equal(t, "%0\r\n", server.exec(t, client, "hgetall", "missing"))
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		server.exec(t, client, "hgetall", "set"))
+	assert.Equal(t, "~1\r\n$1\r\nm\r\n", server.exec(t, client, "smembers", "set"))
+	assert.Equal(t, "~0\r\n", server.exec(t, client, "smembers", "missing"))
+	assert.Equal(t, "%1\r\n$12\r\nrepl-timeout\r\n$2\r\n60\r\n", server.exec(t, client, "config", "get", "repl-timeout"))
+	assert.Equal(t, "%0\r\n", server.exec(t, client, "config", "get", "no-such-option"))
+	assert.Equal(t, "_\r\n", server.exec(t, client, "get", "missing"))
+	assert.True(t, strings.HasPrefix(server.exec(t, client, "info", "persistence"), "="))
+
+	info := server.exec(t, client, "client", "info")
+	assert.True(t, strings.HasPrefix(info, "="), info)
+	assert.Contains(t, info, "txt:id=")
+	assert.Contains(t, info, " flags=N ")
+	assert.Contains(t, info, " resp=3")
+
+	other, _ := server.newClient()
+	server.exec(t, other, "subscribe", "ch")
+	list := server.exec(t, client, "client", "list")
+	lines := strings.Split(strings.TrimSuffix(list[strings.Index(list, "txt:")+4:], "\n\r\n"), "\n")
+	assert.Equal(t, 2, len(lines), list)
+	assert.Contains(t, lines[1], " flags=P db=0 sub=1 psub=0 ")
+}
+
+func TestResp3PubSub(t *testing.T) {
+	server := newTestServer()
+	resp2Client, resp2Conn := server.newClient()
+	resp3Client, resp3Conn := server.newClient()
+	publisher, _ := server.newClient()
+	server.exec(t, resp3Client, "hello", "3")
+
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n", server.exec(t, resp2Client, "subscribe", "ch"))
+	assert.Equal(t, ">3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n", server.exec(t, resp3Client, "subscribe", "ch"))
+	assert.Equal(t, ":2\r\n", server.exec(t, publisher, "publish", "ch", "hi"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", resp2Conn.take())
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", resp3Conn.take())
+}
@@ -0,0 +1,131 @@
+package redis
+
+// 元素很多的数组回复(比如 10M 个元素的 LRANGE, HGETALL)如果先拼接出完整的回复再写入, 元素的切片和编码之后的字节同时在内存中.
+// StreamingReply 先写入头部, 然后逐个编码元素, 每凑够 streamChunkSize 个字节写入客户端的缓冲区,
+// 每次写入之后按照输出缓冲区的限制检查, 超过硬限制时停止编码并断开客户端.
+// 流式回复在客户端的 event loop 中持有锁写入, 期间其他的推送在 event loop 中排在回复之后, 不会插入到回复的中间
+
+const (
+	// streamReplyThreshold 元素超过这个数量时使用流式回复
+	streamReplyThreshold = 1024
+	// streamChunkSize 每次写入客户端缓冲区的字节数
+	streamChunkSize = 16 * 1024
+)
+
+// StreamWriter 流式回复的元素写入到这里
+type StreamWriter struct {
+	client *Client
+	buf    []byte
+	err    error
+	// aborted 客户端超过了输出缓冲区的限制或者写入失败, 不再编码之后的元素
+	aborted bool
+}
+
+// Bulk 写入一个 bulk string, 返回 false 时不再写入之后的元素
+func (w *StreamWriter) Bulk(arg []byte) bool {
+	w.buf = appendBulkHeader(w.buf, len(arg))
+	w.buf = append(w.buf, arg...)
+	w.buf = append(w.buf, CRLF...)
+	return w.maybeFlush()
+}
+
+// BulkString 和 Bulk 一样, 不用先把 string 转换为 []byte
+func (w *StreamWriter) BulkString(arg string) bool {
+	w.buf = appendBulkHeader(w.buf, len(arg))
+	w.buf = append(w.buf, arg...)
+	w.buf = append(w.buf, CRLF...)
+	return w.maybeFlush()
+}
+
+func (w *StreamWriter) maybeFlush() bool {
+	// 没有客户端时(Encode)编码完整的回复
+	if w.client == nil || len(w.buf) < streamChunkSize {
+		return true
+	}
+	return w.flush()
+}
+
+// flush 写入凑够的字节, 然后检查输出缓冲区
+func (w *StreamWriter) flush() bool {
+	if w.aborted {
+		return false
+	}
+	if len(w.buf) > 0 {
+		_, w.err = w.client.Write(w.buf)
+		w.buf = w.buf[:0]
+		if w.err != nil {
+			w.aborted = true
+			return false
+		}
+	}
+	// 有网络连接的客户端在自己的 event loop 中执行命令, 可以读取 gnet 的输出缓冲区
+	c := w.client
+	if c.conn != nil {
+		c.checkOutputLimit(c.conn, c.obufClass())
+		if c.closeAsap.Load() {
+			w.aborted = true
+		}
+	}
+	return !w.aborted
+}
+
+// StreamingReply 数组, map 或者 set, 元素都是 bulk string. num 是头部的数量, map 是键值对的数量.
+// each 按顺序写入元素, 写入的个数必须和头部一致
+type StreamingReply struct {
+	kind byte
+	num  int
+	each func(w *StreamWriter)
+}
+
+// MakeStreamingArrayReply num 个元素的数组
+func MakeStreamingArrayReply(num int, each func(w *StreamWriter)) *StreamingReply {
+	return &StreamingReply{kind: '*', num: num, each: each}
+}
+
+// MakeStreamingMapReply num 个键值对的 map, RESP2 中是 2*num 个元素的数组
+func MakeStreamingMapReply(num int, each func(w *StreamWriter)) *StreamingReply {
+	return &StreamingReply{kind: '%', num: num, each: each}
+}
+
+// MakeStreamingSetReply num 个元素的 set, RESP2 中是数组
+func MakeStreamingSetReply(num int, each func(w *StreamWriter)) *StreamingReply {
+	return &StreamingReply{kind: '~', num: num, each: each}
+}
+
+// header 按照协议版本编码头部
+func (s *StreamingReply) header(buf []byte, protocol int) []byte {
+	if protocol == resp3 {
+		return append(buf, smallTypeLineWithNum(s.kind, s.num)...)
+	}
+	num := s.num
+	if s.kind == '%' {
+		num *= 2
+	}
+	return append(buf, smallTypeLineWithNum('*', num)...)
+}
+
+func (s *StreamingReply) WriteTo(client *Client) error {
+	buf := getReplyBuffer()
+	w := &StreamWriter{client: client, buf: s.header(*buf, client.Protocol())}
+	client.streaming = true
+	s.each(w)
+	w.flush()
+	client.streaming = false
+	*buf = w.buf
+	putReplyBuffer(buf)
+	if w.err != nil {
+		return w.err
+	}
+	return client.Flush()
+}
+
+func (s *StreamingReply) ToBytes() []byte {
+	return s.Encode(resp2)
+}
+
+// Encode 编码完整的回复, 用于阻塞命令的回复和推送等需要完整字节的场景
+func (s *StreamingReply) Encode(protocol int) []byte {
+	w := &StreamWriter{buf: s.header(nil, protocol)}
+	s.each(w)
+	return w.buf
+}
@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+func TestStreamingReply(t *testing.T) {
+	pairs := func(w *StreamWriter) {
+		_ = w.BulkString("a") && w.Bulk([]byte("1")) && w.BulkString("b") && w.Bulk([]byte("2"))
+	}
+	replies := []Reply{MakeBulkReply([]byte("a")), MakeBulkReply([]byte("1")), MakeBulkReply([]byte("b")), MakeBulkReply([]byte("2"))}
+	// 和完整拼接的回复编码一致
+	for _, protocol := range []int{resp2, resp3} {
+		assert.Equal(t, MakeMapReply(replies).Encode(protocol), MakeStreamingMapReply(2, pairs).Encode(protocol))
+		assert.Equal(t, MakeSetReply(replies).Encode(protocol), MakeStreamingSetReply(4, pairs).Encode(protocol))
+		assert.Equal(t, MakeMultiBulkReply(util.ToCmdLine("a", "1", "b", "2")).Encode(protocol),
+			MakeStreamingArrayReply(4, pairs).Encode(protocol))
+	}
+
+	server := newTestServer()
+	client, _ := server.newClient()
+	const n = 3 * streamReplyThreshold
+	elements := make([]string, 0, n)
+	hset := []string{"hset", "hash"}
+	sadd := []string{"sadd", "set"}
+	for i := 0; i < n; i++ {
+		elements = append(elements, "e"+strconv.Itoa(i))
+		hset = append(hset, "f"+strconv.Itoa(i), "v")
+		sadd = append(sadd, "m"+strconv.Itoa(i))
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), "v")
+	}
+	server.exec(t, client, append([]string{"rpush", "list"}, elements...)...)
+	server.exec(t, client, hset...)
+	server.exec(t, client, sadd...)
+
+	// 分成多次写入, 内容和完整的回复一致
+	assert.Equal(t, string(MakeMultiBulkReply(util.ToCmdLine(elements[0], elements[1:]...)).ToBytes()),
+		server.exec(t, client, "lrange", "list", "0", "-1"))
+	assert.Equal(t, string(MakeMultiBulkReply(util.ToCmdLine(elements[1], elements[2:n-1]...)).ToBytes()),
+		server.exec(t, client, "lrange", "list", "1", "-2"))
+	keys := server.exec(t, client, "keys", "key:*")
+	assert.True(t, strings.HasPrefix(keys, fmt.Sprintf("*%d\r\n", n)))
+	assert.Equal(t, n, strings.Count(keys, "\r\nkey:"))
+	server.exec(t, client, "hello", "3")
+	hash := server.exec(t, client, "hgetall", "hash")
+	assert.True(t, strings.HasPrefix(hash, fmt.Sprintf("%%%d\r\n", n)))
+	assert.Equal(t, n, strings.Count(hash, "\r\n$1\r\nv\r\n"))
+	set := server.exec(t, client, "smembers", "set")
+	assert.True(t, strings.HasPrefix(set, fmt.Sprintf("~%d\r\n", n)))
+	assert.Equal(t, n, strings.Count(set, "\r\nm"))
+	assert.False(t, client.streaming)
+}
+
+// fillList 向 key 写入 n 个元素 elem:0, elem:1, ...
+func fillList(t *testing.T, server *testServer, key string, n int) {
+	client, _ := server.newClient()
+	const batch = 10000
+	for i := 0; i < n; i += batch {
+		args := []string{"rpush", key}
+		for j := i; j < i+batch && j < n; j++ {
+			args = append(args, "elem:"+strconv.Itoa(j))
+		}
+		server.exec(t, client, args...)
+	}
+}
+
+// dialSmallBuffer 接收缓冲区很小的连接, 服务端很快就写不进 socket. 连接之前设置缓冲区和 MSS,
+// 否则 loopback 的 MSS 比缓冲区大, 接收方一直不通告窗口, 只能等待零窗口探测
+func dialSmallBuffer(t *testing.T, port int) net.Conn {
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096); err == nil {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, 1024)
+			}
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}}
+	conn, err := dialer.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(60 * time.Second))
+	return conn
+}
+
+// TestStreamingReplySlowReader 接收缓冲区很小的客户端慢慢读取 1M 个元素的 LRANGE, 期间不断有失效消息推送给它,
+// 推送不会插入到回复的中间
+func TestStreamingReplySlowReader(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("slow")
+	}
+	server := newTestServer()
+	port := serve(t, server)
+	const n = 1000000
+	fillList(t, server, "list", n)
+
+	conn := dialSmallBuffer(t, port)
+	reader := bufio.NewReaderSize(conn, 16)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		return line
+	}
+	// skipValue 读取一个完整的值
+	var skipValue func(header string)
+	skipValue = func(header string) {
+		switch header[0] {
+		case '$':
+			readLine()
+		case '*', '>', '%':
+			num, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+			require.NoError(t, err)
+			if header[0] == '%' {
+				num *= 2
+			}
+			for i := 0; i < num; i++ {
+				skipValue(readLine())
+			}
+		}
+	}
+	_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("hello", "3")).ToBytes())
+	skipValue(readLine())
+	_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("client", "tracking", "on", "bcast")).ToBytes())
+	require.Equal(t, "+OK\r\n", readLine())
+
+	writer, _ := server.newClient()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			server.exec(t, writer, "set", "k", "v")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("lrange", "list", "0", "-1")).ToBytes())
+	// 推送之间只能出现完整的回复
+	pushes := 0
+	readPush := func(header string) {
+		require.Equal(t, ">2\r\n", header)
+		skipValue(header)
+		pushes++
+	}
+	for {
+		header := readLine()
+		if header[0] == '*' {
+			require.Equal(t, fmt.Sprintf("*%d\r\n", n), header)
+			break
+		}
+		readPush(header)
+	}
+	for i := 0; i < n; i++ {
+		value := "elem:" + strconv.Itoa(i)
+		require.Equal(t, fmt.Sprintf("$%d\r\n", len(value)), readLine(), i)
+		require.Equal(t, value+"\r\n", readLine(), i)
+	}
+	<-done
+	_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("ping")).ToBytes())
+	for header := readLine(); header != "+PONG\r\n"; header = readLine() {
+		readPush(header)
+	}
+	assert.Equal(t, 200, pushes)
+}
+
+// TestStreamingReplyOutputLimit 不读取的客户端超过输出缓冲区的硬限制之后停止编码并断开
+func TestStreamingReplyOutputLimit(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("slow")
+	}
+	useOutputBufferLimit(t)
+	config.Properties.ClientOutputBufferLimit = "normal 1mb 0 0"
+	server := newTestServer()
+	port := serve(t, server)
+	const n = 1000000
+	fillList(t, server, "list", n)
+
+	conn := dialSmallBuffer(t, port)
+	_, _ = conn.Write(MakeMultiBulkReply(util.ToCmdLine("lrange", "list", "0", "-1")).ToBytes())
+	client, _ := server.newClient()
+	// 断开时还有没有读取的数据, 可能收到 RST
+	received, _ := io.Copy(io.Discard, conn)
+	// 完整的回复大约 15MB, 断开之前只发送了限制附近的数据
+	assert.Less(t, received, int64(4<<20))
+	assert.Equal(t, ":1000000\r\n", server.exec(t, client, "llen", "list"))
+}
@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sharedReplies 共享的回复和它们应该编码成的数据
+func sharedReplies() map[string]Reply {
+	replies := map[string]Reply{
+		OKReply:        MakeOkReply(),
+		PING:           MakePongReply(),
+		Queued:         MakeQueuedReply(),
+		NullBulk:       MakeNullBulkReply(),
+		NullMultiBulk:  MakeNullMultiBulkReply(),
+		EmptyBulk:      MakeEmptyBulkReply(),
+		EmptyMultiBulk: MakeEmptyMultiBulkReply(),
+		SyntaxReplyS:   MakeSyntaxErr(),
+		wrongTypeStr:   MakeWrongTypeErr(),
+	}
+	for _, n := range []int64{0, 1, 9, 10, 99, 100, 9999} {
+		replies[":"+strconv.FormatInt(n, 10)+CRLF] = MakeIntReply(n)
+	}
+	return replies
+}
+
+func TestSharedReplies(t *testing.T) {
+	for expected, reply := range sharedReplies() {
+		data := reply.ToBytes()
+		assert.Equal(t, expected, string(data))
+		// 调用方 append 时重新分配, 不会写到共享的数据里
+		assert.Equal(t, len(data), cap(data), expected)
+		_ = append(data, "garbage"...)
+		assert.Equal(t, expected, string(reply.ToBytes()))
+	}
+	assert.Same(t, MakeIntReply(42), MakeIntReply(42))
+	assert.Same(t, MakeOkReply(), MakeOkReply())
+	// 范围之外的整数每次创建
+	assert.NotSame(t, MakeIntReply(sharedIntegers), MakeIntReply(sharedIntegers))
+	assert.NotSame(t, MakeIntReply(-1), MakeIntReply(-1))
+	assert.Equal(t, ":-1\r\n", string(MakeIntReply(-1).ToBytes()))
+	assert.Equal(t, ":10000\r\n", string(MakeIntReply(sharedIntegers).ToBytes()))
+	assert.Equal(t, "_\r\n", string(MakeNullMultiBulkReply().Encode(resp3)))
+}
+
+func TestSharedRepliesNotMutated(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	value := strings.Repeat("x", 1000)
+	// 各种回复都经过同一个临时缓冲区, 之后共享的回复不变
+	for i := 0; i < 100; i++ {
+		server.exec(t, client, "set", "key:"+strconv.Itoa(i), value)
+		server.exec(t, client, "exists", "foo", "key:"+strconv.Itoa(i))
+		server.exec(t, client, "mget", "foo", "missing", "key:"+strconv.Itoa(i))
+		server.exec(t, client, "getrange", "foo", "5", "10")
+		server.exec(t, client, "ping")
+	}
+	// 从共享的回复开始 append 的结果不会影响下一次回复
+	data := append(MakeIntReply(1).ToBytes(), MakeOkReply().ToBytes()...)
+	data[0] = '-'
+	assert.Equal(t, ":2\r\n", server.exec(t, client, "exists", "foo", "key:0"))
+	assert.Equal(t, "$0\r\n\r\n", server.exec(t, client, "getrange", "foo", "5", "10"))
+	assert.Equal(t, "*3\r\n$3\r\nbar\r\n$-1\r\n$3\r\nbar\r\n", server.exec(t, client, "mget", "foo", "missing", "foo"))
+	for expected, reply := range sharedReplies() {
+		assert.Equal(t, expected, string(reply.ToBytes()))
+		assert.Equal(t, len(reply.ToBytes()), cap(reply.ToBytes()))
+	}
+	for i := int64(0); i < sharedIntegers; i++ {
+		reply := MakeIntReply(i)
+		assert.Equal(t, i, reply.Num)
+		assert.Equal(t, ":"+strconv.FormatInt(i, 10)+CRLF, string(reply.ToBytes()))
+	}
+}
+
+func TestMultiBulkReplyBuffer(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	args := []string{"mget"}
+	for i := 0; i < 2000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		server.exec(t, client, "set", key, strings.Repeat("v", i%10))
+		args = append(args, key)
+	}
+	// 大的回复和之后小的回复使用同一个临时缓冲区, 内容互不影响
+	large := MakeMultiBulkReply(nil)
+	for i := 0; i < 2000; i++ {
+		large.Args = append(large.Args, []byte(strings.Repeat("v", i%10)))
+	}
+	assert.Equal(t, string(large.ToBytes()), server.exec(t, client, args...))
+	assert.Equal(t, "*2\r\n$0\r\n\r\n$-1\r\n", server.exec(t, client, "mget", "key:0", "missing"))
+	server.exec(t, client, "hello", "3")
+	assert.Equal(t, "*2\r\n$0\r\n\r\n_\r\n", server.exec(t, client, "mget", "key:0", "missing"))
+}
@@ -0,0 +1,559 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errScriptReply = errors.New("ERR Protocol error: bad reply from command called by script")
+
+// Scripting lua 脚本的执行环境, 所有的脚本共用一个 lua 虚拟机
+// 脚本和其他命令一样在 process 的全局锁内执行, 所以是原子的
+type Scripting struct {
+	lua *lua.LState
+	// scripts sha1 -> 编译好的脚本
+	scripts map[string]*lua.LFunction
+	server  *RedisServer
+	// client 用于执行 redis.call 的伪客户端, 回复写到 replySink 中
+	client *Client
+	lg     logger.Logger
+
+	// libraries 库名 -> FUNCTION LOAD 加载的函数库, functions 函数名 -> 函数
+	libraries map[string]*functionLibrary
+	functions map[string]*luaFunction
+	// loading 正在加载的库, 只有加载期间可以调用 redis.register_function
+	loading *functionLibrary
+	// readonly FCALL_RO 或者 no-writes 的函数, 不允许执行写命令
+	readonly bool
+
+	// 下面的字段在脚本执行期间会被其他 event loop 上的 SCRIPT KILL 读写
+	running   atomic.Bool
+	startTime atomic.Int64
+	// runningName 和 runningCmd 用于 FUNCTION STATS
+	runningName string
+	runningCmd  [][]byte
+	// wrote 脚本已经执行过写命令, 不能再被 SCRIPT KILL 终止
+	wrote  atomic.Bool
+	killed atomic.Bool
+	mux    sync.Mutex
+	cancel context.CancelFunc
+}
+
+func NewScripting(server *RedisServer) *Scripting {
+	s := &Scripting{
+		scripts:   make(map[string]*lua.LFunction),
+		libraries: make(map[string]*functionLibrary),
+		functions: make(map[string]*luaFunction),
+		server:    server,
+		lg:        logger.Named("scripting"),
+	}
+	s.client = NewClient(0, nil, false)
+	s.client.replySink = &bytes.Buffer{}
+	s.lua = s.newLuaState()
+	return s
+}
+
+func (s *Scripting) newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	// 只开放和redis一样的库, 不允许访问io, os
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "module", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redisLib := L.NewTable()
+	L.SetFuncs(redisLib, map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			return s.luaRedisCall(L, true)
+		},
+		"pcall": func(L *lua.LState) int {
+			return s.luaRedisCall(L, false)
+		},
+		"error_reply":       luaErrorReply,
+		"status_reply":      luaStatusReply,
+		"sha1hex":           luaSha1Hex,
+		"log":               s.luaLog,
+		"register_function": s.luaRegisterFunction,
+	})
+	redisLib.RawSetString("LOG_DEBUG", lua.LNumber(logDebug))
+	redisLib.RawSetString("LOG_VERBOSE", lua.LNumber(logVerbose))
+	redisLib.RawSetString("LOG_NOTICE", lua.LNumber(logNotice))
+	redisLib.RawSetString("LOG_WARNING", lua.LNumber(logWarning))
+	L.SetGlobal("redis", redisLib)
+
+	// 禁止脚本读写不存在的全局变量, 避免脚本之间互相影响
+	globalsMeta := L.NewTable()
+	globalsMeta.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to create global variable '%s'", L.CheckString(2))
+		return 0
+	}))
+	globalsMeta.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.CheckString(2))
+		return 0
+	}))
+	L.SetMetatable(L.G.Global, globalsMeta)
+	return L
+}
+
+// Sha1Hex 脚本的sha1, 用于 EVALSHA
+func Sha1Hex(body []byte) string {
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Load 编译并缓存脚本, 返回脚本的sha1
+func (s *Scripting) Load(body []byte) (string, *lua.LFunction, error) {
+	sha := Sha1Hex(body)
+	if fn, ok := s.scripts[sha]; ok {
+		return sha, fn, nil
+	}
+	chunk, err := parse.Parse(bytes.NewReader(body), "@user_script")
+	if err != nil {
+		return "", nil, errors.New("ERR Error compiling script (new function): " + oneLine(err.Error()))
+	}
+	proto, err := lua.Compile(chunk, "@user_script")
+	if err != nil {
+		return "", nil, errors.New("ERR Error compiling script (new function): " + oneLine(err.Error()))
+	}
+	fn := s.lua.NewFunctionFromProto(proto)
+	s.scripts[sha] = fn
+	return sha, fn, nil
+}
+
+// Lookup 按照sha1查找已经缓存的脚本
+func (s *Scripting) Lookup(sha string) (*lua.LFunction, bool) {
+	fn, ok := s.scripts[strings.ToLower(sha)]
+	return fn, ok
+}
+
+// Run 执行脚本, 脚本中 redis.call 执行的命令会各自写入aof, 脚本本身不会
+func (s *Scripting) Run(caller *Client, sha string, fn *lua.LFunction, keys, args [][]byte) Reply {
+	L := s.lua
+	L.G.Global.RawSetString("KEYS", bytesToLuaArray(L, keys))
+	L.G.Global.RawSetString("ARGV", bytesToLuaArray(L, args))
+	return s.execute(caller, "f_"+sha, fn, nil, false)
+}
+
+// Call 执行 FCALL 调用的函数, keys 和 args 作为函数的参数
+func (s *Scripting) Call(caller *Client, f *luaFunction, keys, args [][]byte, readonly bool) Reply {
+	L := s.lua
+	params := []lua.LValue{bytesToLuaArray(L, keys), bytesToLuaArray(L, args)}
+	return s.execute(caller, f.name, f.fn, params, readonly || f.flags&functionNoWrites != 0)
+}
+
+func (s *Scripting) execute(caller *Client, name string, fn *lua.LFunction, params []lua.LValue, readonly bool) Reply {
+	L := s.lua
+	// 脚本中的 select 不影响调用方
+	s.client.SetDbIndex(caller.GetDbIndex())
+	s.readonly = readonly
+
+	// 不受 command-timeout 限制, 执行超时之后由 SCRIPT KILL 结束; server 开始关闭时中断
+	root := s.server.rootContext()
+	ctx, cancel := context.WithCancel(root)
+	L.SetContext(ctx)
+	s.begin(cancel, name, caller.curCommand)
+	defer func() {
+		s.end()
+		L.RemoveContext()
+		s.readonly = false
+	}()
+
+	L.Push(fn)
+	for _, param := range params {
+		L.Push(param)
+	}
+	err := L.PCall(len(params), 1, nil)
+	if err != nil {
+		if s.killed.Load() {
+			return MakeStandardErrReply("ERR Script killed by user with SCRIPT KILL...")
+		}
+		if root.Err() != nil {
+			return interruptedReply(root)
+		}
+		return scriptErrorReply(name, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return luaToReply(ret)
+}
+
+func (s *Scripting) begin(cancel context.CancelFunc, name string, cmdLine [][]byte) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.cancel = cancel
+	s.runningName = name
+	s.runningCmd = cmdLine
+	s.wrote.Store(false)
+	s.killed.Store(false)
+	s.startTime.Store(time.Now().UnixMilli())
+	s.running.Store(true)
+}
+
+func (s *Scripting) end() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.running.Store(false)
+	s.cancel()
+	s.cancel = nil
+	s.runningCmd = nil
+}
+
+// RunningScript 正在执行的脚本的名称, 命令和执行时间, 没有脚本在执行时 ok 为 false
+func (s *Scripting) RunningScript() (name string, cmdLine [][]byte, durationMs int64, ok bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.running.Load() {
+		return "", nil, 0, false
+	}
+	return s.runningName, s.runningCmd, time.Now().UnixMilli() - s.startTime.Load(), true
+}
+
+// Running 是否有脚本正在执行
+func (s *Scripting) Running() bool {
+	return s.running.Load()
+}
+
+// Busy 脚本执行的时间超过了 busy-reply-threshold, 其他的客户端不再等待, 直接回复 BUSY
+func (s *Scripting) Busy() bool {
+	if !s.running.Load() {
+		return false
+	}
+	elapsed := time.Now().UnixMilli() - s.startTime.Load()
+	return elapsed >= int64(config.Properties.BusyReplyThreshold)
+}
+
+// Kill SCRIPT KILL, 已经执行过写命令的脚本不能被终止, 否则会破坏脚本的原子性
+func (s *Scripting) Kill() Reply {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.running.Load() {
+		return MakeNotBusyErr()
+	}
+	if s.wrote.Load() {
+		return MakeStandardErrReply("UNKILLABLE Sorry the script already executed write commands against " +
+			"the dataset. You can either wait the script termination or kill the server in a hard way using " +
+			"the SHUTDOWN NOSAVE command.")
+	}
+	s.killed.Store(true)
+	// lua 虚拟机每执行一条指令都会检查 context, 取消之后脚本会在下一条指令抛出异常
+	s.cancel()
+	return MakeOkReply()
+}
+
+// Flush SCRIPT FLUSH, 清空缓存的脚本
+// 函数库和脚本共用一个lua虚拟机, 所以不重建虚拟机, 全局变量是只读的, 脚本之间不会互相影响
+func (s *Scripting) Flush() {
+	s.scripts = make(map[string]*lua.LFunction)
+}
+
+// call 在伪客户端上执行 redis.call 的命令, 返回命令写回的数据
+func (s *Scripting) call(cmdLine [][]byte) []byte {
+	client := s.client
+	cmd := client.resolveCommand(cmdLine[0])
+	if cmd == nil {
+		return MakeStandardErrReply("ERR Unknown Redis command called from script").ToBytes()
+	}
+	if cmd.IsNoScript() {
+		return MakeStandardErrReply("ERR This Redis command is not allowed from script").ToBytes()
+	}
+	if !cmd.checkArity(len(cmdLine)) {
+		cmd.stats.reject()
+		return MakeStandardErrReply("ERR Wrong number of args calling Redis command from script").ToBytes()
+	}
+	if errReply := cmd.validate(cmdLine); errReply != nil {
+		cmd.stats.reject()
+		return errReply.ToBytes()
+	}
+	mdb, err := s.server.SelectDb(client.GetDbIndex())
+	if err != nil {
+		return MakeStandardErrReply(err.Error()).ToBytes()
+	}
+	s.server.bindClient(client)
+	client.SetDb(mdb)
+	client.replySink.Reset()
+	client.curCommand = cmdLine
+	defer func() {
+		client.curCommand = nil
+	}()
+	if cmd.IsWriteFor(cmdLine) {
+		if s.readonly {
+			cmd.stats.reject()
+			return MakeStandardErrReply("ERR Write commands are not allowed from read-only scripts.").ToBytes()
+		}
+		if errReply := s.server.checkWritable(s.server.currentClient); errReply != nil {
+			cmd.stats.reject()
+			return errReply.ToBytes()
+		}
+		// 脚本执行之前已经淘汰过, 脚本中不再淘汰
+		if _, over := s.server.overMaxMemory(); over && cmd.IsDenyOOM() {
+			cmd.stats.reject()
+			return MakeOOMErr().ToBytes()
+		}
+		s.wrote.Store(true)
+		mdb.prepareWrite(cmd, cmdLine)
+	}
+	client.replyFailed = false
+	start := time.Now()
+	err = processCommand(context.Background(), client, cmd)
+	cmd.stats.record(time.Since(start), client.replyFailed)
+	if err != nil {
+		return MakeStandardErrReply("ERR " + err.Error()).ToBytes()
+	}
+	return client.replySink.Bytes()
+}
+
+// luaRedisCall redis.call 和 redis.pcall, raise 为 true 时命令的错误会抛出lua异常
+func (s *Scripting) luaRedisCall(L *lua.LState, raise bool) int {
+	if s.loading != nil {
+		L.RaiseError("redis.call and redis.pcall are not allowed while loading a library")
+		return 0
+	}
+	argc := L.GetTop()
+	if argc == 0 {
+		return luaRaiseOrPush(L, luaErrorTable(L, "ERR Please specify at least one argument for this redis lib call"), raise)
+	}
+	cmdLine := make([][]byte, 0, argc)
+	for i := 1; i <= argc; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			cmdLine = append(cmdLine, []byte(v))
+		case lua.LNumber:
+			cmdLine = append(cmdLine, []byte(formatLuaNumber(v)))
+		default:
+			return luaRaiseOrPush(L, luaErrorTable(L,
+				"ERR Lua redis lib command arguments must be strings or integers"), raise)
+		}
+	}
+	value, _, err := respToLua(L, s.call(cmdLine))
+	if err != nil {
+		value = luaErrorTable(L, err.Error())
+	}
+	if table, ok := value.(*lua.LTable); ok && table.RawGetString("err") != lua.LNil {
+		return luaRaiseOrPush(L, table, raise)
+	}
+	L.Push(value)
+	return 1
+}
+
+func luaRaiseOrPush(L *lua.LState, errTable *lua.LTable, raise bool) int {
+	if raise {
+		L.Error(errTable, 1)
+		return 0
+	}
+	L.Push(errTable)
+	return 1
+}
+
+func luaErrorTable(L *lua.LState, msg string) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("err", lua.LString(msg))
+	return table
+}
+
+// luaErrorReply redis.error_reply(msg)
+func luaErrorReply(L *lua.LState) int {
+	L.Push(luaErrorTable(L, L.CheckString(1)))
+	return 1
+}
+
+// luaStatusReply redis.status_reply(msg)
+func luaStatusReply(L *lua.LState) int {
+	table := L.NewTable()
+	table.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(table)
+	return 1
+}
+
+// luaSha1Hex redis.sha1hex(str)
+func luaSha1Hex(L *lua.LState) int {
+	L.Push(lua.LString(Sha1Hex([]byte(L.CheckString(1)))))
+	return 1
+}
+
+const (
+	logDebug = iota
+	logVerbose
+	logNotice
+	logWarning
+)
+
+// luaLog redis.log(level, message, ...)
+func (s *Scripting) luaLog(L *lua.LState) int {
+	level := L.CheckInt(1)
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.ToString(i))
+	}
+	msg := strings.Join(parts, " ")
+	switch level {
+	case logDebug, logVerbose:
+		s.lg.Debugf("%s", msg)
+	case logNotice:
+		s.lg.Infof("%s", msg)
+	case logWarning:
+		s.lg.Warnf("%s", msg)
+	default:
+		L.RaiseError("Invalid debug level.")
+	}
+	return 0
+}
+
+func bytesToLuaArray(L *lua.LState, values [][]byte) *lua.LTable {
+	table := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		table.Append(lua.LString(value))
+	}
+	return table
+}
+
+// formatLuaNumber 整数按照整数格式化, 否则使用 %.17g
+func formatLuaNumber(n lua.LNumber) string {
+	f := float64(n)
+	if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+// scriptErrorReply lua 异常转换为错误回复, redis.call 抛出的错误原样返回
+func scriptErrorReply(name string, err error) Reply {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		if table, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := table.RawGetString("err").(lua.LString); ok {
+				return MakeStandardErrReply(string(msg))
+			}
+		}
+		return MakeStandardErrReply("ERR Error running script (call to " + name + "): " + oneLine(apiErr.Object.String()))
+	}
+	return MakeStandardErrReply("ERR Error running script (call to " + name + "): " + oneLine(err.Error()))
+}
+
+// oneLine 错误回复中不能包含换行
+func oneLine(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
+
+// luaToReply lua 的返回值转换为回复
+//
+//	number -> integer, 小数部分被截断
+//	string -> bulk string
+//	table(数组) -> multi bulk, 遇到第一个nil截断
+//	table 包含 ok 字段 -> status, 包含 err 字段 -> error
+//	true -> 1, false 和 nil -> nil bulk
+func luaToReply(value lua.LValue) Reply {
+	switch v := value.(type) {
+	case lua.LString:
+		return MakeBulkReply([]byte(v))
+	case lua.LNumber:
+		return MakeIntReply(int64(v))
+	case lua.LBool:
+		if v {
+			return MakeIntReply(1)
+		}
+		return MakeNullBulkReply()
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return MakeStandardErrReply(string(msg))
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return MakeSimpleReply([]byte(msg))
+		}
+		replies := make([]Reply, 0, v.Len())
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			replies = append(replies, luaToReply(item))
+		}
+		return MakeMultiRowReply(replies)
+	default:
+		return MakeNullBulkReply()
+	}
+}
+
+// respToLua 把命令的回复转换为lua的值
+//
+//	integer -> number
+//	bulk string -> string, nil bulk -> false
+//	multi bulk -> table, nil multi bulk -> false
+//	status -> {ok=status}, error -> {err=error}
+func respToLua(L *lua.LState, data []byte) (lua.LValue, []byte, error) {
+	idx := bytes.Index(data, CRLFBytes)
+	if len(data) == 0 || idx < 0 {
+		return nil, nil, errScriptReply
+	}
+	line, rest := data[1:idx], data[idx+2:]
+	switch data[0] {
+	case '+':
+		table := L.NewTable()
+		table.RawSetString("ok", lua.LString(line))
+		return table, rest, nil
+	case '-':
+		return luaErrorTable(L, string(line)), rest, nil
+	case ':':
+		num, err := strconv.ParseInt(string(line), 10, 64)
+		if err != nil {
+			return nil, nil, errScriptReply
+		}
+		return lua.LNumber(num), rest, nil
+	case '$':
+		size, err := strconv.Atoi(string(line))
+		if err != nil {
+			return nil, nil, errScriptReply
+		}
+		if size < 0 {
+			return lua.LFalse, rest, nil
+		}
+		if len(rest) < size+2 {
+			return nil, nil, errScriptReply
+		}
+		return lua.LString(rest[:size]), rest[size+2:], nil
+	case '*':
+		size, err := strconv.Atoi(string(line))
+		if err != nil {
+			return nil, nil, errScriptReply
+		}
+		if size < 0 {
+			return lua.LFalse, rest, nil
+		}
+		table := L.CreateTable(size, 0)
+		for i := 0; i < size; i++ {
+			var item lua.LValue
+			item, rest, err = respToLua(L, rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			table.Append(item)
+		}
+		return table, rest, nil
+	default:
+		return nil, nil, errScriptReply
+	}
+}
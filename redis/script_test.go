@@ -0,0 +1,179 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+
+	testCases := []struct {
+		name   string
+		args   []string
+		expect string
+	}{
+		{"keys and argv", []string{"return {KEYS[1],KEYS[2],ARGV[1],ARGV[2]}", "2", "key1", "key2", "first", "second"},
+			"*4\r\n$4\r\nkey1\r\n$4\r\nkey2\r\n$5\r\nfirst\r\n$6\r\nsecond\r\n"},
+		{"number to integer", []string{"return 3.99", "0"}, ":3\r\n"},
+		{"table truncated at nil", []string{"return {1,2,3,'foo',nil,'bar'}", "0"},
+			"*4\r\n:1\r\n:2\r\n:3\r\n$3\r\nfoo\r\n"},
+		{"true to 1", []string{"return true", "0"}, ":1\r\n"},
+		{"false to nil", []string{"return false", "0"}, "$-1\r\n"},
+		{"nil", []string{"return nil", "0"}, "$-1\r\n"},
+		{"status reply", []string{"return redis.status_reply('FINE')", "0"}, "+FINE\r\n"},
+		{"status table", []string{"return {ok='FINE'}", "0"}, "+FINE\r\n"},
+		{"error reply", []string{"return redis.error_reply('My Error')", "0"}, "-My Error\r\n"},
+		{"set", []string{"return redis.call('set', KEYS[1], ARGV[1])", "1", "foo", "bar"}, "+OK\r\n"},
+		{"get", []string{"return redis.call('get', KEYS[1])", "1", "foo"}, "$3\r\nbar\r\n"},
+		{"status to table", []string{"return redis.call('set', KEYS[1], ARGV[1]).ok", "1", "foo", "bar"}, "$2\r\nOK\r\n"},
+		{"nil bulk to false", []string{"return redis.call('get', 'nosuchkey') == false", "0"}, ":1\r\n"},
+		{"number arguments", []string{"redis.call('set', 'n', 10) return redis.call('incrby', 'n', 5)", "0"}, ":15\r\n"},
+		{"nested tables", []string{"return {1,{2,{'a'}}}", "0"}, "*2\r\n:1\r\n*2\r\n:2\r\n*1\r\n$1\r\na\r\n"},
+		{"lrange to table", []string{"redis.call('rpush', 'l', 'a', 'b') return #redis.call('lrange', 'l', 0, -1)", "0"}, ":2\r\n"},
+		{"sha1hex", []string{"return redis.sha1hex('')", "0"}, "$40\r\nda39a3ee5e6b4b0d3255bfef95601890afd80709\r\n"},
+		// 原子的 check-and-set
+		{"compare and set", []string{
+			"if redis.call('get', KEYS[1]) == ARGV[1] then redis.call('set', KEYS[1], ARGV[2]) return 1 end return 0",
+			"1", "foo", "bar", "baz"}, ":1\r\n"},
+		{"compare and set changed", []string{"return redis.call('get', KEYS[1])", "1", "foo"}, "$3\r\nbaz\r\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"eval"}, tc.args...)
+			assert.Equal(t, tc.expect, server.exec(t, client, args...))
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+
+	server.exec(t, client, "set", "foo", "bar")
+	// redis.call 的错误会中断脚本
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n",
+		server.exec(t, client, "eval", "redis.call('incr', KEYS[1]) return 'unreachable'", "1", "foo"))
+	// redis.pcall 的错误由脚本处理
+	assert.Equal(t, "$43\r\nERR value is not an integer or out of range\r\n",
+		server.exec(t, client, "eval", "local r = redis.pcall('incr', KEYS[1]) return r.err", "1", "foo"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n",
+		server.exec(t, client, "eval", "return redis.pcall('incr', KEYS[1])", "1", "foo"))
+	// pcall 可以捕获 redis.call 抛出的错误
+	assert.Equal(t, "$65\r\nWRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		server.exec(t, client, "eval", "local ok, e = pcall(redis.call, 'lpush', KEYS[1], 'x') return e.err", "1", "foo"))
+
+	assert.Equal(t, "-ERR Unknown Redis command called from script\r\n",
+		server.exec(t, client, "eval", "return redis.call('nosuchcommand')", "0"))
+	assert.Equal(t, "-ERR This Redis command is not allowed from script\r\n",
+		server.exec(t, client, "eval", "return redis.call('eval', 'return 1', '0')", "0"))
+	assert.Equal(t, "-ERR Please specify at least one argument for this redis lib call\r\n",
+		server.exec(t, client, "eval", "return redis.call()", "0"))
+	assert.Equal(t, "-ERR Lua redis lib command arguments must be strings or integers\r\n",
+		server.exec(t, client, "eval", "return redis.call('get', {})", "0"))
+
+	reply := server.exec(t, client, "eval", "a = 1", "0")
+	assert.True(t, strings.HasPrefix(reply, "-ERR Error running script"), reply)
+	assert.Contains(t, reply, "Script attempted to create global variable 'a'")
+	reply = server.exec(t, client, "eval", "return +", "0")
+	assert.True(t, strings.HasPrefix(reply, "-ERR Error compiling script"), reply)
+
+	assert.Equal(t, "-ERR Number of keys can't be greater than number of args\r\n",
+		server.exec(t, client, "eval", "return 1", "2", "a"))
+	assert.Equal(t, "-ERR Number of keys can't be negative\r\n",
+		server.exec(t, client, "eval", "return 1", "-1"))
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n",
+		server.exec(t, client, "eval", "return 1", "x"))
+}
+
+func TestEvalSha(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	script := "return ARGV[1]"
+	sha := Sha1Hex([]byte(script))
+	assert.Equal(t, "-NOSCRIPT No matching script. Please use EVAL.\r\n",
+		server.exec(t, client, "evalsha", sha, "0", "hello"))
+	assert.Equal(t, "$5\r\nhello\r\n", server.exec(t, client, "eval", script, "0", "hello"))
+	assert.Equal(t, "$5\r\nworld\r\n", server.exec(t, client, "evalsha", strings.ToUpper(sha), "0", "world"))
+}
+
+func TestEvalPropagatesEffects(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	records := make([]string, 0)
+	for _, mdb := range server.dbs {
+		mdb.Propagate = func(cmdLine [][]byte) {
+			parts := make([]string, 0, len(cmdLine))
+			for _, arg := range cmdLine {
+				parts = append(parts, string(arg))
+			}
+			records = append(records, strings.Join(parts, " "))
+		}
+	}
+	server.exec(t, client, "eval", "redis.call('set', KEYS[1], 'a') redis.call('get', KEYS[1]) "+
+		"redis.call('select', 1) return redis.call('incr', KEYS[1])", "1", "foo")
+	// aof 记录的是脚本执行的写命令, 而不是脚本本身
+	assert.Equal(t, []string{"set foo a", "incr foo"}, records)
+	// 脚本中的 select 不影响调用方
+	assert.Equal(t, "$1\r\na\r\n", server.exec(t, client, "get", "foo"))
+}
+
+func TestScriptCommands(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	script := "return 'hello'"
+	sha := Sha1Hex([]byte(script))
+	assert.Equal(t, "$40\r\n"+sha+"\r\n", server.exec(t, client, "script", "load", script))
+	assert.Equal(t, "*2\r\n:1\r\n:0\r\n", server.exec(t, client, "script", "exists", sha, "nosuchsha"))
+	assert.Equal(t, "$5\r\nhello\r\n", server.exec(t, client, "evalsha", sha, "0"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "script", "flush", "async"))
+	assert.Equal(t, "*1\r\n:0\r\n", server.exec(t, client, "script", "exists", sha))
+	assert.Equal(t, "-ERR SCRIPT FLUSH only support SYNC|ASYNC option\r\n",
+		server.exec(t, client, "script", "flush", "later"))
+	assert.Equal(t, "-NOTBUSY No scripts in execution right now.\r\n", server.exec(t, client, "script", "kill"))
+}
+
+// runBusyScript 在另一个协程中执行脚本, 等到脚本执行超过 busy-reply-threshold 之后返回
+func runBusyScript(t *testing.T, server *testServer, client *Client, script string) chan string {
+	done := make(chan string, 1)
+	go func() {
+		done <- server.exec(t, client, "eval", script, "0")
+	}()
+	for !server.scripting.Busy() {
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestScriptKill(t *testing.T) {
+	server := newTestServer()
+	defer func(threshold int) {
+		config.Properties.BusyReplyThreshold = threshold
+	}(config.Properties.BusyReplyThreshold)
+	config.Properties.BusyReplyThreshold = 10
+	runner, _ := server.newClient()
+	other, _ := server.newClient()
+
+	// 死循环中的 pcall 也不能捕获 SCRIPT KILL
+	done := runBusyScript(t, server, runner, "while true do pcall(function() while true do end end) end")
+	assert.Equal(t, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n",
+		server.exec(t, other, "get", "foo"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, other, "script", "kill"))
+	assert.Equal(t, "-ERR Script killed by user with SCRIPT KILL...\r\n", <-done)
+	assert.Equal(t, "$-1\r\n", server.exec(t, other, "get", "foo"))
+
+	// 已经执行过写命令的脚本不能被终止
+	done = runBusyScript(t, server, runner, "redis.call('set', 'foo', 'bar') while true do end")
+	assert.Equal(t, "-UNKILLABLE Sorry the script already executed write commands against the dataset. "+
+		"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n",
+		server.exec(t, other, "script", "kill"))
+	server.scripting.mux.Lock()
+	server.scripting.cancel()
+	server.scripting.mux.Unlock()
+	<-done
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, other, "get", "foo"))
+}
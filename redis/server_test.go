@@ -0,0 +1,167 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/xuning888/godis-tiny/pkg/clock"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger()
+	os.Exit(m.Run())
+}
+
+// fakeConn 用于测试的 gnet.Conn, 只实现了 Client 用到的方法
+type fakeConn struct {
+	gnet.Conn
+	fd  int
+	mux sync.Mutex
+	out bytes.Buffer
+	// woken 调用 Wake 的次数, 测试中再次调用 process 模拟 OnTraffic
+	woken int
+	// in 客户端发送过来还没有解码的数据
+	in bytes.Buffer
+	// writes 调用 Write 的次数, 每次对应一次系统调用
+	writes int
+	closed bool
+	// outbound 模拟 socket 写不完留在 gnet 输出缓冲区的字节数
+	outbound int
+	// remote 为空时是 127.0.0.1
+	remote net.Addr
+}
+
+func (f *fakeConn) InboundBuffered() int {
+	return f.in.Len()
+}
+
+func (f *fakeConn) Peek(n int) ([]byte, error) {
+	if n > f.in.Len() {
+		return nil, io.ErrShortBuffer
+	} else if n <= 0 {
+		n = f.in.Len()
+	}
+	return f.in.Bytes()[:n], nil
+}
+
+func (f *fakeConn) Discard(n int) (int, error) {
+	f.in.Next(n)
+	return n, nil
+}
+
+func (f *fakeConn) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.writes++
+	return f.out.Write(p)
+}
+
+func (f *fakeConn) AsyncWrite(p []byte, callback gnet.AsyncCallback) error {
+	var err error
+	if p != nil {
+		_, err = f.Write(p)
+	}
+	if callback != nil {
+		return callback(f, err)
+	}
+	return err
+}
+
+func (f *fakeConn) OutboundBuffered() int {
+	return f.outbound
+}
+
+func (f *fakeConn) Wake(callback gnet.AsyncCallback) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.woken++
+	return nil
+}
+
+func (f *fakeConn) Fd() int {
+	return f.fd
+}
+
+func (f *fakeConn) RemoteAddr() net.Addr {
+	if f.remote != nil {
+		return f.remote
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000 + f.fd}
+}
+
+func (f *fakeConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6379}
+}
+
+func (f *fakeConn) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.closed = true
+	return nil
+}
+
+// take 取出目前为止写入的所有数据
+func (f *fakeConn) take() string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	result := f.out.String()
+	f.out.Reset()
+	return result
+}
+
+type testServer struct {
+	*RedisServer
+	nextFd int
+}
+
+func newTestServer() *testServer {
+	server, err := makeTempServer()
+	if err != nil {
+		panic(err)
+	}
+	server.connManager = NewManager()
+	server.pubsub = NewPubSub()
+	server.tracking = NewTracking(server.connManager)
+	server.watches = NewWatches()
+	server.scripting = NewScripting(server)
+	server.bindNotifier()
+	server.bindPropagator()
+	server.lg = logger.Named("test-server")
+	return &testServer{RedisServer: server, nextFd: 100}
+}
+
+// useManualClock 之后创建的 server 使用手动控制的时钟, 测试结束时恢复系统时钟
+func useManualClock(t *testing.T) *clock.Manual {
+	c := clock.NewManual(time.Now())
+	SetClock(c)
+	t.Cleanup(func() {
+		SetClock(nil)
+	})
+	return c
+}
+
+func (s *testServer) newClient() (*Client, *fakeConn) {
+	s.nextFd++
+	conn := &fakeConn{fd: s.nextFd}
+	client := NewClient(conn.fd, conn, false)
+	s.connManager.RegisterConn(conn.fd, client)
+	return client, conn
+}
+
+// exec 执行一条命令, 返回这条命令写回给客户端的数据
+func (s *testServer) exec(t *testing.T, client *Client, args ...string) string {
+	t.Helper()
+	client.PushCmd(util.ToCmdLine(args[0], args[1:]...))
+	if err := s.process(context.Background(), client); err != nil {
+		t.Fatalf("process %v failed: %v", args, err)
+	}
+	return client.conn.(*fakeConn).take()
+}
@@ -0,0 +1,84 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/obj"
+	"sync/atomic"
+)
+
+// serverStats INFO stats 中的计数, server, 所有的 db 和客户端共用一份, CONFIG RESETSTAT 时清零
+type serverStats struct {
+	// keyspaceHits keyspaceMisses 只读命令查找key的命中和未命中次数
+	keyspaceHits   atomic.Int64
+	keyspaceMisses atomic.Int64
+	// expiredKeys 过期删除的key, evictedKeys 超过 maxmemory 淘汰的key
+	expiredKeys atomic.Int64
+	evictedKeys atomic.Int64
+	// netInputBytes netOutputBytes 从客户端读取和写给客户端的字节数, 不包括复制流
+	netInputBytes  atomic.Int64
+	netOutputBytes atomic.Int64
+	// defragHits defragMisses active defrag 重新分配和检查之后不需要重新分配的值, defragReclaimed 释放的字节数
+	defragHits      atomic.Int64
+	defragMisses    atomic.Int64
+	defragReclaimed atomic.Int64
+	// setReordered setShortCircuits setPresized setScratchReuses 集合运算选择的计划, 通过 DEBUG SETALGEBRA 查看
+	setReordered     atomic.Int64
+	setShortCircuits atomic.Int64
+	setPresized      atomic.Int64
+	setScratchReuses atomic.Int64
+	// encodingConversions 按照类型统计的编码转换次数, 比如集合从 intset 转换为 hashtable. 转换是单向的
+	encodingConversions [obj.RedisHash + 1]atomic.Int64
+}
+
+// encodingConverted 记录一次 objType 类型的值的编码转换
+func (s *serverStats) encodingConverted(objType obj.ObjectType) {
+	s.encodingConversions[objType].Add(1)
+}
+
+func (s *serverStats) reset() {
+	s.keyspaceHits.Store(0)
+	s.keyspaceMisses.Store(0)
+	s.expiredKeys.Store(0)
+	s.evictedKeys.Store(0)
+	s.netInputBytes.Store(0)
+	s.netOutputBytes.Store(0)
+	s.defragHits.Store(0)
+	s.defragMisses.Store(0)
+	s.defragReclaimed.Store(0)
+	s.setReordered.Store(0)
+	s.setShortCircuits.Store(0)
+	s.setPresized.Store(0)
+	s.setScratchReuses.Store(0)
+	for i := range s.encodingConversions {
+		s.encodingConversions[i].Store(0)
+	}
+}
+
+// info INFO stats 中的计数, 字段的名字与 redis 一致
+func (s *serverStats) info() string {
+	return fmt.Sprintf("total_net_input_bytes:%d\r\n"+
+		"total_net_output_bytes:%d\r\n"+
+		"expired_keys:%d\r\n"+
+		"evicted_keys:%d\r\n"+
+		"keyspace_hits:%d\r\n"+
+		"keyspace_misses:%d\r\n"+
+		"encoding_conversions:list=%d,set=%d,hash=%d\r\n",
+		s.netInputBytes.Load(),
+		s.netOutputBytes.Load(),
+		s.expiredKeys.Load(),
+		s.evictedKeys.Load(),
+		s.keyspaceHits.Load(),
+		s.keyspaceMisses.Load(),
+		s.encodingConversions[obj.RedisList].Load(),
+		s.encodingConversions[obj.RedisSet].Load(),
+		s.encodingConversions[obj.RedisHash].Load(),
+	)
+}
+
+// bindStats 所有的 db 共用 server 的统计
+func (r *RedisServer) bindStats() {
+	r.stats = &serverStats{}
+	for _, mdb := range r.dbs {
+		mdb.stats = r.stats
+	}
+}
@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceStats(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	server.exec(t, client, "set", "foo", "bar")
+	server.exec(t, client, "rpush", "list", "a")
+	// 写命令不计入命中率
+	server.exec(t, client, "append", "foo", "!")
+	server.exec(t, client, "get", "foo")
+	server.exec(t, client, "get", "missing")
+	server.exec(t, client, "mget", "foo", "missing", "nope")
+	server.exec(t, client, "exists", "foo", "missing")
+	server.exec(t, client, "llen", "list")
+	server.exec(t, client, "type", "missing")
+	server.exec(t, client, "del", "foo")
+	assert.Equal(t, "4", infoAll(t, server, client, "keyspace_hits"))
+	assert.Equal(t, "5", infoAll(t, server, client, "keyspace_misses"))
+	assert.Equal(t, "0", infoAll(t, server, client, "expired_keys"))
+
+	// 读到过期的key时删除, 计入 expired_keys 和 keyspace_misses
+	server.exec(t, client, "set", "temp", "v", "px", "1")
+	clk.Advance(5 * time.Millisecond)
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "get", "temp"))
+	assert.Equal(t, "1", infoAll(t, server, client, "expired_keys"))
+	assert.Equal(t, "6", infoAll(t, server, client, "keyspace_misses"))
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "resetstat"))
+	for _, field := range []string{"keyspace_hits", "keyspace_misses", "expired_keys", "evicted_keys", "total_net_input_bytes"} {
+		assert.Equal(t, "0", infoAll(t, server, client, field), field)
+	}
+}
+
+func TestNetBytesStats(t *testing.T) {
+	server := newTestServer()
+	client, conn := server.newClient()
+	// +OK\r\n 是 CONFIG RESETSTAT 之后的第一个回复
+	assert.Equal(t, "+OK\r\n", server.exec(t, client, "config", "resetstat"))
+	_, reply := traffic(server, conn, "*1\r\n$4\r\nPING\r\n")
+	assert.Equal(t, "+PONG\r\n", reply)
+	// 已经解码的部分先计入, 不完整的参数 hel 留在连接中
+	_, reply = traffic(server, conn, "*2\r\n$3\r\nGET\r\n$5\r\nhel")
+	assert.Equal(t, "", reply)
+	assert.Equal(t, "31", infoLine(t, server, client, "stats", "total_net_input_bytes:")[len("total_net_input_bytes:"):])
+	_, reply = traffic(server, conn, "lo\r\n")
+	assert.Equal(t, "$-1\r\n", reply)
+	assert.Equal(t, int64(14+24), server.stats.netInputBytes.Load())
+	assert.Equal(t, int64(client.totalReplyBytes), server.stats.netOutputBytes.Load())
+}
+
+func TestInfoKeyspace(t *testing.T) {
+	clk := useManualClock(t)
+	server := newTestServer()
+	client, _ := server.newClient()
+	assert.Equal(t, "$12\r\n# Keyspace\r\n\r\n", server.exec(t, client, "info", "keyspace"))
+
+	// 剩余时间是 100..1000 秒
+	server.exec(t, client, "set", "plain", "v")
+	for i := 1; i <= 10; i++ {
+		server.exec(t, client, "set", "k"+strconv.Itoa(i), "v", "ex", strconv.Itoa(i*100))
+	}
+	assert.Equal(t, "db0:keys=11,expires=10,avg_ttl=550000", infoLine(t, server, client, "keyspace", "db0:"))
+	assert.Contains(t, server.exec(t, client, "info"), "db0:keys=11,expires=10,avg_ttl=550000\r\n")
+	clk.Advance(50 * time.Second)
+	assert.Equal(t, "db0:keys=11,expires=10,avg_ttl=500000", infoLine(t, server, client, "keyspace", "db0:"))
+
+	// PERSIST, DEL, 覆盖和过期删除之后 expires 仍然准确
+	server.exec(t, client, "persist", "k10")
+	server.exec(t, client, "del", "k9")
+	server.exec(t, client, "set", "k8", "v")
+	server.exec(t, client, "expire", "plain", "1000")
+	clk.Advance(100 * time.Second)
+	assert.Equal(t, "$-1\r\n", server.exec(t, client, "get", "k1"))
+	assert.Equal(t, "db0:keys=9,expires=7,avg_ttl=", infoLine(t, server, client, "keyspace", "db0:")[:len("db0:keys=9,expires=7,avg_ttl=")])
+
+	server.exec(t, client, "select", "1")
+	server.exec(t, client, "set", "other", "v")
+	assert.Equal(t, "db1:keys=1,expires=0,avg_ttl=0", infoLine(t, server, client, "keyspace", "db1:"))
+	server.exec(t, client, "flushall")
+	assert.Equal(t, "", infoLine(t, server, client, "keyspace", "db"))
+}
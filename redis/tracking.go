@@ -0,0 +1,188 @@
+package redis
+
+import (
+	"github.com/xuning888/godis-tiny/config"
+	"strings"
+)
+
+var (
+	invalidateBytes         = []byte("invalidate")
+	invalidateChannelBytes  = []byte("__redis__:invalidate")
+	trackingRedirBrokenByte = []byte("tracking-redir-broken")
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+// Tracking client side caching 的 tracking table
+// 和 PubSub 一样, 所有的方法都在 process 的全局锁内执行
+type Tracking struct {
+	// keys key -> 读取过这个key的客户端id, 客户端断开后由 sendInvalidation 忽略
+	keys map[string]map[int64]struct{}
+	// prefixes BCAST 模式下 prefix -> 关注这个prefix的客户端
+	prefixes map[string]map[*Client]struct{}
+	clients  *Manager
+}
+
+func NewTracking(clients *Manager) *Tracking {
+	return &Tracking{
+		keys:     make(map[string]map[int64]struct{}),
+		prefixes: make(map[string]map[*Client]struct{}),
+		clients:  clients,
+	}
+}
+
+// Enable 开启 tracking, 参数已经在 CLIENT TRACKING 中校验过
+func (t *Tracking) Enable(client *Client, redirect int64, prefixes []string, options int) {
+	client.trackingFlags = trackingEnabled | options
+	client.trackingFlags &^= trackingCaching
+	client.trackingRedirect = redirect
+	if options&trackingBcast == 0 {
+		return
+	}
+	if len(prefixes) == 0 {
+		// 没有指定prefix时关注所有的key
+		prefixes = []string{""}
+	}
+	if client.trackingPrefixes == nil {
+		client.trackingPrefixes = make(map[string]struct{})
+	}
+	for _, prefix := range prefixes {
+		client.trackingPrefixes[prefix] = struct{}{}
+		clients, ok := t.prefixes[prefix]
+		if !ok {
+			clients = make(map[*Client]struct{})
+			t.prefixes[prefix] = clients
+		}
+		clients[client] = struct{}{}
+	}
+}
+
+// Disable 关闭 tracking, keys 中残留的id在失效时会被忽略
+func (t *Tracking) Disable(client *Client) {
+	for prefix := range client.trackingPrefixes {
+		clients := t.prefixes[prefix]
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+	client.trackingPrefixes = nil
+	client.trackingFlags = 0
+	client.trackingRedirect = 0
+}
+
+// RememberKeys 记录客户端通过只读命令读取过的key
+func (t *Tracking) RememberKeys(client *Client, keys [][]byte) {
+	flags := client.trackingFlags
+	if flags&trackingBcast != 0 {
+		return
+	}
+	// OPTIN 模式只记录 CLIENT CACHING yes 之后的命令, OPTOUT 模式不记录 CLIENT CACHING no 之后的命令
+	if flags&trackingOptin != 0 && flags&trackingCaching == 0 {
+		return
+	}
+	if flags&trackingOptout != 0 && flags&trackingCaching != 0 {
+		return
+	}
+	for _, key := range keys {
+		ids, ok := t.keys[string(key)]
+		if !ok {
+			ids = make(map[int64]struct{})
+			t.keys[string(key)] = ids
+		}
+		ids[client.id] = struct{}{}
+	}
+	t.limit()
+}
+
+// InvalidateKey key 被修改了, 通知所有读取过这个key的客户端. writer 是修改key的客户端, 用于 NOLOOP
+func (t *Tracking) InvalidateKey(key string, writer *Client) {
+	if ids, ok := t.keys[key]; ok {
+		delete(t.keys, key)
+		for id := range ids {
+			client := t.clients.GetById(id)
+			if client == nil || !client.IsTracking() || client.trackingFlags&trackingBcast != 0 {
+				continue
+			}
+			if client.trackingFlags&trackingNoloop != 0 && client == writer {
+				continue
+			}
+			t.sendInvalidation(client, MakeMultiBulkReply([][]byte{[]byte(key)}))
+		}
+	}
+	for prefix, clients := range t.prefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for client := range clients {
+			if client.trackingFlags&trackingNoloop != 0 && client == writer {
+				continue
+			}
+			t.sendInvalidation(client, MakeMultiBulkReply([][]byte{[]byte(key)}))
+		}
+	}
+}
+
+// InvalidateAll flushdb 之后所有的缓存都失效了, 给所有开启了 tracking 的客户端发送 null
+func (t *Tracking) InvalidateAll() {
+	t.keys = make(map[string]map[int64]struct{})
+	t.clients.ForEach(func(client *Client) {
+		if client.IsTracking() {
+			t.sendInvalidation(client, nil)
+		}
+	})
+}
+
+// Len tracking table 中key的数量
+func (t *Tracking) Len() int {
+	return len(t.keys)
+}
+
+// limit 超过 tracking-table-max-keys 时随机淘汰key, 被淘汰的key需要通知客户端失效
+func (t *Tracking) limit() {
+	maxKeys := config.Properties.TrackingTableMaxKeys
+	if maxKeys <= 0 {
+		return
+	}
+	for len(t.keys) > maxKeys {
+		// map 的遍历顺序是随机的
+		for key := range t.keys {
+			t.InvalidateKey(key, nil)
+			break
+		}
+	}
+}
+
+// sendInvalidation RESP3 的客户端直接推送 invalidate 消息,
+// 设置了 REDIRECT 的客户端发送到重定向的客户端, 如果它是 RESP2 则通过 __redis__:invalidate 频道发送
+func (t *Tracking) sendInvalidation(client *Client, keys Reply) {
+	target := client
+	if client.trackingRedirect != 0 {
+		target = t.clients.GetById(client.trackingRedirect)
+		if target == nil {
+			if client.protocol == resp3 {
+				_ = client.Push(MakePushReply([]Reply{MakeBulkReply(trackingRedirBrokenByte)}))
+			}
+			return
+		}
+	}
+	if keys == nil {
+		keys = MakeNullBulkReply()
+	}
+	if target.protocol == resp3 {
+		_ = target.Push(MakePushReply([]Reply{MakeBulkReply(invalidateBytes), keys}))
+		return
+	}
+	if client.trackingRedirect == 0 {
+		// RESP2 的客户端没有办法接收推送
+		return
+	}
+	if _, ok := target.subChannels[invalidateChannel]; !ok {
+		return
+	}
+	_ = target.Push(MakePushReply([]Reply{
+		MakeBulkReply(messageBytes),
+		MakeBulkReply(invalidateChannelBytes),
+		keys,
+	}))
+}
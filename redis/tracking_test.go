@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/xuning888/godis-tiny/config"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func invalidatePush(keys ...string) string {
+	res := "*" + strconv.Itoa(len(keys)) + "\r\n"
+	for _, key := range keys {
+		res += "$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"
+	}
+	return ">2\r\n$10\r\ninvalidate\r\n" + res
+}
+
+func TestHello(t *testing.T) {
+	server := newTestServer()
+	client, _ := server.newClient()
+	reply := server.exec(t, client, "hello")
+	assert.True(t, strings.HasPrefix(reply, "*14\r\n$6\r\nserver\r\n$5\r\nredis\r\n"))
+	reply = server.exec(t, client, "hello", "3", "setname", "cache")
+	assert.True(t, strings.HasPrefix(reply, "%7\r\n$6\r\nserver\r\n"))
+	assert.Contains(t, reply, "$5\r\nproto\r\n:3\r\n")
+	assert.Equal(t, resp3, client.protocol)
+	assert.Equal(t, "$5\r\ncache\r\n", server.exec(t, client, "client", "getname"))
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", server.exec(t, client, "hello", "4"))
+}
+
+func TestClientTracking(t *testing.T) {
+	server := newTestServer()
+	reader, readerConn := server.newClient()
+	writer, _ := server.newClient()
+
+	server.exec(t, reader, "hello", "3")
+	assert.Equal(t, "+OK\r\n", server.exec(t, reader, "client", "tracking", "on"))
+	server.exec(t, writer, "set", "foo", "bar")
+	assert.Equal(t, "$3\r\nbar\r\n", server.exec(t, reader, "get", "foo"))
+
+	// 失效消息在下一条回复之前到达
+	server.exec(t, writer, "set", "foo", "baz")
+	assert.Equal(t, invalidatePush("foo")+"$3\r\nbaz\r\n", server.exec(t, reader, "get", "foo"))
+
+	// 自己修改key也会收到失效消息
+	assert.Equal(t, invalidatePush("foo")+":1\r\n", server.exec(t, reader, "del", "foo"))
+
+	// 没有被读取过的key不会通知
+	server.exec(t, writer, "set", "other", "1")
+	assert.Equal(t, "", readerConn.take())
+
+	server.exec(t, reader, "get", "other")
+	server.exec(t, writer, "flushdb")
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n_\r\n", readerConn.take())
+	assert.Equal(t, 0, server.tracking.Len())
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, reader, "client", "tracking", "off"))
+	server.exec(t, reader, "get", "foo")
+	server.exec(t, writer, "set", "foo", "bar")
+	assert.Equal(t, "", readerConn.take())
+}
+
+func TestClientTrackingRedirect(t *testing.T) {
+	server := newTestServer()
+	reader, _ := server.newClient()
+	receiver, receiverConn := server.newClient()
+	writer, _ := server.newClient()
+
+	server.exec(t, receiver, "subscribe", "__redis__:invalidate")
+	redirect := strconv.FormatInt(receiver.GetId(), 10)
+	assert.Equal(t, "+OK\r\n", server.exec(t, reader, "client", "tracking", "on", "redirect", redirect))
+	assert.Equal(t, ":"+redirect+"\r\n", server.exec(t, reader, "client", "getredir"))
+	server.exec(t, reader, "mget", "a", "b")
+	server.exec(t, writer, "mset", "a", "1", "b", "2")
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\na\r\n"+
+		"*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\nb\r\n", receiverConn.take())
+
+	assert.Equal(t, "-ERR The client ID you want redirect to does not exist\r\n",
+		server.exec(t, writer, "client", "tracking", "on", "redirect", "100000"))
+}
+
+func TestClientTrackingBcast(t *testing.T) {
+	server := newTestServer()
+	reader, readerConn := server.newClient()
+	server.exec(t, reader, "hello", "3")
+
+	assert.Equal(t, "-ERR PREFIX option requires BCAST mode to be enabled\r\n",
+		server.exec(t, reader, "client", "tracking", "on", "prefix", "user:"))
+	assert.Equal(t, "-ERR Prefix 'user:1' overlaps with another provided prefix 'user:'. "+
+		"Prefixes for a single client must not overlap.\r\n",
+		server.exec(t, reader, "client", "tracking", "on", "bcast", "prefix", "user:1", "prefix", "user:"))
+	assert.Equal(t, "+OK\r\n", server.exec(t, reader, "client", "tracking", "on", "bcast", "noloop", "prefix", "user:"))
+
+	writer, _ := server.newClient()
+	server.exec(t, writer, "set", "user:1", "a")
+	server.exec(t, writer, "set", "order:1", "a")
+	assert.Equal(t, invalidatePush("user:1"), readerConn.take())
+
+	// NOLOOP 自己的修改不会通知
+	assert.Equal(t, "+OK\r\n", server.exec(t, reader, "set", "user:2", "a"))
+}
+
+func TestClientTrackingOptin(t *testing.T) {
+	server := newTestServer()
+	reader, readerConn := server.newClient()
+	writer, _ := server.newClient()
+	server.exec(t, reader, "hello", "3")
+
+	assert.Equal(t, "-ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN "+
+		"or OPTOUT mode enabled\r\n", server.exec(t, reader, "client", "caching", "yes"))
+	server.exec(t, reader, "client", "tracking", "on", "optin")
+	assert.Equal(t, "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n",
+		server.exec(t, reader, "client", "caching", "no"))
+
+	server.exec(t, reader, "get", "a")
+	assert.Equal(t, "+OK\r\n", server.exec(t, reader, "client", "caching", "yes"))
+	server.exec(t, reader, "get", "b")
+	// CLIENT CACHING 只对下一条命令生效
+	server.exec(t, reader, "get", "c")
+	server.exec(t, writer, "mset", "a", "1", "b", "1", "c", "1")
+	assert.Equal(t, invalidatePush("b"), readerConn.take())
+}
+
+func TestTrackingTableMaxKeys(t *testing.T) {
+	server := newTestServer()
+	defer func(maxKeys int) {
+		config.Properties.TrackingTableMaxKeys = maxKeys
+	}(config.Properties.TrackingTableMaxKeys)
+	reader, readerConn := server.newClient()
+	server.exec(t, reader, "hello", "3")
+	server.exec(t, reader, "client", "tracking", "on")
+
+	assert.Equal(t, "+OK\r\n", server.exec(t, reader, "config", "set", "tracking-table-max-keys", "1"))
+	server.exec(t, reader, "get", "a")
+	// 超过上限之后随机淘汰, 被淘汰的key需要通知客户端
+	reply := server.exec(t, reader, "get", "b")
+	assert.Contains(t, []string{"_\r\n" + invalidatePush("a"), "_\r\n" + invalidatePush("b")}, reply)
+	assert.Equal(t, 1, server.tracking.Len())
+	assert.Equal(t, "", readerConn.take())
+}
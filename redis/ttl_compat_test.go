@@ -0,0 +1,283 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/pkg/util"
+)
+
+// TTL 相关命令的兼容性矩阵在 testdata/ttl_compat.json 中, 每个用例检查命令的回复, 之后的检查命令的回复和写入 aof 的记录.
+// 回复来自真实的 redis-server: 设置 GODIS_COMPAT_REDIS=host:port 时同样的矩阵(local 的用例除外)在 redis 上执行并比较,
+// 加上 -update 时把 redis 的回复写回 fixture. aof 只检查本地的记录, redis 的传播方式不同(SET EX 传播为 SET PXAT)
+
+const ttlCompatFixture = "testdata/ttl_compat.json"
+
+var updateCompat = flag.Bool("update", false, "rewrite the replies in testdata fixtures from GODIS_COMPAT_REDIS")
+
+type compatCheck struct {
+	Cmd   []string `json:"cmd"`
+	Reply string   `json:"reply"`
+}
+
+type compatCase struct {
+	Name string `json:"name"`
+	// Local 依赖手动的时钟, 不在 redis 上执行
+	Local bool       `json:"local,omitempty"`
+	Setup [][]string `json:"setup,omitempty"`
+	// Advance setup 之后时钟前进的毫秒数
+	Advance int64         `json:"advance,omitempty"`
+	Cmd     []string      `json:"cmd"`
+	Reply   string        `json:"reply"`
+	Checks  []compatCheck `json:"checks,omitempty"`
+	// Aof cmd 写入 aof 的记录, 每条命令的参数用空格连接
+	Aof []string `json:"aof,omitempty"`
+}
+
+// transcript 用例的执行过程, 不一致时按行显示差异
+func (c *compatCase) transcript(reply string, checks []string, aof []string) string {
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "> %s\n%s\n", strings.Join(c.Cmd, " "), reply)
+	for i, check := range c.Checks {
+		fmt.Fprintf(builder, "> %s\n%s\n", strings.Join(check.Cmd, " "), checks[i])
+	}
+	if aof != nil {
+		fmt.Fprintf(builder, "aof:\n%s\n", strings.Join(aof, "\n"))
+	}
+	return builder.String()
+}
+
+func (c *compatCase) expected(now time.Time, withAof bool) string {
+	checks := make([]string, 0, len(c.Checks))
+	for _, check := range c.Checks {
+		checks = append(checks, check.Reply)
+	}
+	var aof []string
+	if withAof {
+		aof = make([]string, 0, len(c.Aof))
+		for _, record := range c.Aof {
+			aof = append(aof, expandCompat(record, now))
+		}
+	}
+	return c.transcript(c.Reply, checks, aof)
+}
+
+var compatPlaceholder = regexp.MustCompile(`\{(now|nowsec)([+-]\d+)?\}`)
+
+// expandCompat 替换 {now+N} (毫秒时间戳) 和 {nowsec+N} (秒)
+func expandCompat(s string, now time.Time) string {
+	return compatPlaceholder.ReplaceAllStringFunc(s, func(match string) string {
+		parts := compatPlaceholder.FindStringSubmatch(match)
+		base := now.UnixMilli()
+		if parts[1] == "nowsec" {
+			base = now.Unix()
+		}
+		offset, _ := strconv.ParseInt(parts[2], 10, 64)
+		return strconv.FormatInt(base+offset, 10)
+	})
+}
+
+func expandCompatArgs(args []string, now time.Time) []string {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		result = append(result, expandCompat(arg, now))
+	}
+	return result
+}
+
+// compatValue RESP2 的回复, 转换为一行文本比较
+type compatValue struct {
+	kind  byte
+	str   string
+	null  bool
+	elems []compatValue
+}
+
+func (v compatValue) String() string {
+	switch {
+	case v.null:
+		return "(nil)"
+	case v.kind == '$':
+		return strconv.Quote(v.str)
+	case v.kind == '*':
+		parts := make([]string, 0, len(v.elems))
+		for _, elem := range v.elems {
+			parts = append(parts, elem.String())
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return string(v.kind) + v.str
+}
+
+// args 命令的参数用空格连接, 用于显示 aof 的记录
+func (v compatValue) args() string {
+	parts := make([]string, 0, len(v.elems))
+	for _, elem := range v.elems {
+		parts = append(parts, elem.str)
+	}
+	return strings.Join(parts, " ")
+}
+
+func readCompatValue(reader *bufio.Reader) (compatValue, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return compatValue{}, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return compatValue{}, errors.New("empty line")
+	}
+	v := compatValue{kind: line[0], str: line[1:]}
+	switch v.kind {
+	case '+', '-', ':':
+		return v, nil
+	case '$', '*':
+		num, err := strconv.Atoi(v.str)
+		if err != nil {
+			return v, err
+		}
+		if num < 0 {
+			v.null = true
+			return v, nil
+		}
+		if v.kind == '$' {
+			buf := make([]byte, num+2)
+			if _, err = io.ReadFull(reader, buf); err != nil {
+				return v, err
+			}
+			v.str = string(buf[:num])
+			return v, nil
+		}
+		for i := 0; i < num; i++ {
+			elem, err := readCompatValue(reader)
+			if err != nil {
+				return v, err
+			}
+			v.elems = append(v.elems, elem)
+		}
+		return v, nil
+	}
+	return v, fmt.Errorf("unexpected reply %q", line)
+}
+
+// parseCompatValues 解析 data 中所有的回复
+func parseCompatValues(t *testing.T, data string) []compatValue {
+	reader := bufio.NewReader(strings.NewReader(data))
+	var values []compatValue
+	for {
+		if _, err := reader.Peek(1); err != nil {
+			return values
+		}
+		v, err := readCompatValue(reader)
+		require.NoError(t, err, data)
+		values = append(values, v)
+	}
+}
+
+func loadCompatCases(t *testing.T) []*compatCase {
+	data, err := os.ReadFile(ttlCompatFixture)
+	require.NoError(t, err)
+	var cases []*compatCase
+	require.NoError(t, json.Unmarshal(data, &cases))
+	return cases
+}
+
+func TestTTLCompat(t *testing.T) {
+	for _, c := range loadCompatCases(t) {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			clk := useManualClock(t)
+			server, file := newAofTestServer(t, FsyncNo)
+			client, _ := server.newClient()
+			now := clk.Now()
+			exec := func(args []string) string {
+				out := server.exec(t, client, expandCompatArgs(args, now)...)
+				values := parseCompatValues(t, out)
+				require.Len(t, values, 1, out)
+				return values[0].String()
+			}
+			for _, args := range c.Setup {
+				exec(args)
+			}
+			takeAof(server, file)
+			clk.Advance(time.Duration(c.Advance) * time.Millisecond)
+			reply := exec(c.Cmd)
+			aof := make([]string, 0)
+			for _, record := range parseCompatValues(t, takeAof(server, file)) {
+				aof = append(aof, record.args())
+			}
+			checks := make([]string, 0, len(c.Checks))
+			for _, check := range c.Checks {
+				checks = append(checks, exec(check.Cmd))
+			}
+			assert.Equal(t, c.expected(now, true), c.transcript(reply, checks, aof))
+		})
+	}
+}
+
+// TestTTLCompatRedis 在 GODIS_COMPAT_REDIS 指定的 redis-server 上执行矩阵, 使用 db 9 并且会清空它
+func TestTTLCompatRedis(t *testing.T) {
+	addr := os.Getenv("GODIS_COMPAT_REDIS")
+	if addr == "" {
+		t.Skip("GODIS_COMPAT_REDIS is not set")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	do := func(args ...string) string {
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Write(MakeMultiBulkReply(util.ToCmdLine(args[0], args[1:]...)).ToBytes())
+		require.NoError(t, err)
+		v, err := readCompatValue(reader)
+		require.NoError(t, err)
+		return v.String()
+	}
+	require.Equal(t, "+OK", do("select", "9"))
+
+	cases := loadCompatCases(t)
+	for _, c := range cases {
+		if c.Local {
+			continue
+		}
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			do("flushdb")
+			now := time.Now()
+			for _, args := range c.Setup {
+				do(expandCompatArgs(args, now)...)
+			}
+			reply := do(expandCompatArgs(c.Cmd, now)...)
+			checks := make([]string, 0, len(c.Checks))
+			for _, check := range c.Checks {
+				checks = append(checks, do(expandCompatArgs(check.Cmd, now)...))
+			}
+			if *updateCompat {
+				c.Reply = reply
+				for i := range c.Checks {
+					c.Checks[i].Reply = checks[i]
+				}
+				return
+			}
+			assert.Equal(t, c.expected(now, false), c.transcript(reply, checks, nil))
+		})
+	}
+	if *updateCompat {
+		data, err := json.MarshalIndent(cases, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(ttlCompatFixture, append(data, '\n'), 0644))
+	}
+}
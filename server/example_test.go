@@ -0,0 +1,28 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/server"
+	"go.uber.org/zap"
+)
+
+func Example() {
+	s, err := server.New(server.WithAddr("127.0.0.1:0"), server.WithLogger(logger.Zap(zap.NewNop())))
+	if err != nil {
+		panic(err)
+	}
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		panic(err)
+	}
+	defer s.Shutdown(ctx)
+
+	client := goredis.NewClient(&goredis.Options{Addr: s.Addr().String()})
+	defer client.Close()
+	client.Set(ctx, "greeting", "hello", 0)
+	fmt.Println(client.Get(ctx, "greeting").Val())
+	// Output: hello
+}
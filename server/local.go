@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/xuning888/godis-tiny/redis"
+	"strings"
+	"sync"
+)
+
+// localMessageBuffer 每个 LocalClient 缓存的 pub/sub 消息, 满了之后新的消息被丢弃
+const localMessageBuffer = 1024
+
+var errClientClosed = errors.New("redis: client is closed")
+
+// Message pub/sub 的消息, Pattern 是 PSUBSCRIBE 匹配到的 pattern
+type Message struct {
+	Channel string
+	Pattern string
+	Payload string
+}
+
+// LocalClient 在同一个进程中执行命令, 不经过 RESP 编码的网络连接. 和一个网络连接一样有自己的 SELECT, 认证和订阅状态,
+// 可以在多个 goroutine 中使用, 命令依次执行
+type LocalClient struct {
+	conn     *redis.LocalConn
+	messages chan *Message
+	mux      sync.Mutex
+	closed   bool
+}
+
+// NewLocalClient 创建一个不经过网络的客户端, 服务关闭之后 Do 返回错误
+func (s *Server) NewLocalClient() *LocalClient {
+	c := &LocalClient{messages: make(chan *Message, localMessageBuffer)}
+	c.conn = s.srv.NewLocalConn(c.onPush)
+	return c
+}
+
+// Do 执行一条命令. 错误回复同时作为 error 返回; 一条命令有多个回复时(SUBSCRIBE 多个 channel)返回最后一个
+func (c *LocalClient) Do(ctx context.Context, args ...string) (Reply, error) {
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	return c.do(ctx, cmdLine)
+}
+
+func (c *LocalClient) do(ctx context.Context, cmdLine [][]byte) (Reply, error) {
+	if len(cmdLine) == 0 {
+		return Reply{}, errors.New("redis: empty command")
+	}
+	c.mux.Lock()
+	closed := c.closed
+	c.mux.Unlock()
+	if closed {
+		return Reply{}, errClientClosed
+	}
+	data, err := c.conn.Exec(ctx, cmdLine)
+	if err != nil {
+		return Reply{}, err
+	}
+	// CLIENT REPLY OFF 之后没有回复
+	if len(data) == 0 {
+		return Reply{Kind: KindNil}, nil
+	}
+	var reply Reply
+	for len(data) > 0 {
+		if reply, data, err = parseReply(data); err != nil {
+			return Reply{}, err
+		}
+	}
+	return reply, reply.Err()
+}
+
+// Messages 订阅的 channel 和 pattern 收到的消息, Close 之后关闭
+func (c *LocalClient) Messages() <-chan *Message {
+	return c.messages
+}
+
+// Subscribe SUBSCRIBE channel [channel ...], 消息从 Messages 读取
+func (c *LocalClient) Subscribe(ctx context.Context, channels ...string) error {
+	_, err := c.Do(ctx, append([]string{"subscribe"}, channels...)...)
+	return err
+}
+
+// PSubscribe PSUBSCRIBE pattern [pattern ...], 消息从 Messages 读取
+func (c *LocalClient) PSubscribe(ctx context.Context, patterns ...string) error {
+	_, err := c.Do(ctx, append([]string{"psubscribe"}, patterns...)...)
+	return err
+}
+
+// onPush 在发布消息的客户端持有锁时调用, 不能阻塞
+func (c *LocalClient) onPush(data []byte) {
+	reply, _, err := parseReply(data)
+	if err != nil {
+		return
+	}
+	values, err := reply.Strings()
+	if err != nil || len(values) < 3 {
+		return
+	}
+	var msg *Message
+	switch strings.ToLower(values[0]) {
+	case "message":
+		msg = &Message{Channel: values[1], Payload: values[2]}
+	case "pmessage":
+		if len(values) < 4 {
+			return
+		}
+		msg = &Message{Pattern: values[1], Channel: values[2], Payload: values[3]}
+	default:
+		return
+	}
+	select {
+	case c.messages <- msg:
+	default:
+	}
+}
+
+// Close 取消所有的订阅, 之后不能再执行命令
+func (c *LocalClient) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	// 取消订阅之后不会再调用 onPush
+	c.conn.Close()
+	close(c.messages)
+	return nil
+}
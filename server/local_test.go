@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func localClient(t *testing.T, s *Server) *LocalClient {
+	client := s.NewLocalClient()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+func TestLocalClient(t *testing.T) {
+	s := start(t)
+	ctx := context.Background()
+	client := localClient(t, s)
+
+	reply, err := client.Do(ctx, "set", "foo", "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, KindStatus, reply.Kind)
+	assert.Equal(t, "OK", reply.Text)
+
+	reply, err = client.Do(ctx, "get", "foo")
+	assert.NoError(t, err)
+	str, err := reply.Str()
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", str)
+
+	reply, err = client.Do(ctx, "incr", "counter")
+	assert.NoError(t, err)
+	num, err := reply.Int64()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), num)
+
+	reply, err = client.Do(ctx, "get", "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, KindNil, reply.Kind)
+	_, err = reply.Str()
+	assert.Equal(t, Nil, err)
+
+	reply, err = client.Do(ctx, "mget", "foo", "missing")
+	assert.NoError(t, err)
+	elems, err := reply.Slice()
+	assert.NoError(t, err)
+	assert.Equal(t, []Reply{{Kind: KindBulk, Text: "bar"}, {Kind: KindNil}}, elems)
+
+	reply, err = client.Do(ctx, "incr", "foo")
+	assert.EqualError(t, err, "ERR value is not an integer or out of range")
+	assert.Equal(t, KindError, reply.Kind)
+	assert.Equal(t, err, reply.Err())
+	_, err = reply.Int64()
+	assert.Equal(t, Error("ERR value is not an integer or out of range"), err)
+
+	_, err = client.Do(ctx, "nosuchcommand")
+	assert.Error(t, err)
+	_, err = client.Do(ctx)
+	assert.Error(t, err)
+
+	// 和网络上的客户端看到相同的数据
+	network := connect(t, s, &goredis.Options{})
+	assert.Equal(t, "bar", network.Get(ctx, "foo").Val())
+}
+
+func TestLocalClientResp3(t *testing.T) {
+	s := start(t)
+	ctx := context.Background()
+	client := localClient(t, s)
+	reply, err := client.Do(ctx, "hello", "3")
+	assert.NoError(t, err)
+	assert.Equal(t, KindMap, reply.Kind)
+
+	_, err = client.Do(ctx, "hset", "hash", "field", "value")
+	assert.NoError(t, err)
+	reply, err = client.Do(ctx, "hgetall", "hash")
+	assert.NoError(t, err)
+	assert.Equal(t, KindMap, reply.Kind)
+	values, err := reply.Strings()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"field", "value"}, values)
+
+	_, err = client.Do(ctx, "sadd", "set", "a")
+	assert.NoError(t, err)
+	reply, err = client.Do(ctx, "smembers", "set")
+	assert.NoError(t, err)
+	assert.Equal(t, KindSet, reply.Kind)
+
+	reply, err = client.Do(ctx, "get", "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, KindNil, reply.Kind)
+
+	reply, err = client.Do(ctx, "cluster", "info")
+	assert.NoError(t, err)
+	assert.Equal(t, KindVerbatim, reply.Kind)
+	assert.Contains(t, reply.Text, "cluster_enabled:0")
+}
+
+func TestParseReply(t *testing.T) {
+	for _, tc := range []struct {
+		data  string
+		reply Reply
+	}{
+		{",3.5\r\n", Reply{Kind: KindDouble, Float: 3.5}},
+		{"#t\r\n", Reply{Kind: KindBool, Bool: true}},
+		{"(12345678901234567890\r\n", Reply{Kind: KindBigNumber, Text: "12345678901234567890"}},
+		{"!3\r\nERR\r\n", Reply{Kind: KindError, Text: "ERR"}},
+		{"=7\r\ntxt:abc\r\n", Reply{Kind: KindVerbatim, Text: "abc"}},
+		{"*-1\r\n", Reply{Kind: KindNil}},
+		{">2\r\n+a\r\n:1\r\n", Reply{Kind: KindPush, Elems: []Reply{{Kind: KindStatus, Text: "a"}, {Kind: KindInt, Int: 1}}}},
+	} {
+		reply, rest, err := parseReply([]byte(tc.data))
+		assert.NoError(t, err, tc.data)
+		assert.Empty(t, rest, tc.data)
+		assert.Equal(t, tc.reply, reply, tc.data)
+	}
+	str, err := Reply{Kind: KindDouble, Float: 3.5}.Str()
+	assert.NoError(t, err)
+	assert.Equal(t, "3.5", str)
+	_, _, err = parseReply([]byte("$5\r\nab\r\n"))
+	assert.Error(t, err)
+}
+
+func TestLocalClientSelect(t *testing.T) {
+	s := start(t)
+	ctx := context.Background()
+	first, second := localClient(t, s), localClient(t, s)
+	_, err := first.Do(ctx, "select", "1")
+	assert.NoError(t, err)
+	_, err = first.Do(ctx, "set", "foo", "db1")
+	assert.NoError(t, err)
+	reply, err := second.Do(ctx, "get", "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, KindNil, reply.Kind)
+	reply, _ = first.Do(ctx, "get", "foo")
+	assert.Equal(t, "db1", reply.Text)
+}
+
+func TestLocalClientPassword(t *testing.T) {
+	s := start(t, WithPassword("secret"))
+	ctx := context.Background()
+	client := localClient(t, s)
+	_, err := client.Do(ctx, "get", "foo")
+	assert.EqualError(t, err, "NOAUTH Authentication required.")
+	_, err = client.Do(ctx, "auth", "secret")
+	assert.NoError(t, err)
+	_, err = client.Do(ctx, "get", "foo")
+	assert.NoError(t, err)
+}
+
+func TestLocalClientPubSub(t *testing.T) {
+	s := start(t)
+	ctx := context.Background()
+	subscriber, publisher := localClient(t, s), localClient(t, s)
+	require.NoError(t, subscriber.Subscribe(ctx, "news", "sports"))
+	require.NoError(t, subscriber.PSubscribe(ctx, "n*"))
+	// 订阅之后只能执行订阅相关的命令
+	_, err := subscriber.Do(ctx, "get", "foo")
+	assert.Error(t, err)
+
+	reply, err := publisher.Do(ctx, "publish", "news", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), reply.Int)
+	network := connect(t, s, &goredis.Options{})
+	assert.Equal(t, int64(1), network.Publish(ctx, "sports", "goal").Val())
+
+	var messages []*Message
+	for len(messages) < 3 {
+		select {
+		case msg := <-subscriber.Messages():
+			messages = append(messages, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for messages")
+		}
+	}
+	assert.ElementsMatch(t, []*Message{
+		{Channel: "news", Payload: "hello"},
+		{Channel: "news", Pattern: "n*", Payload: "hello"},
+		{Channel: "sports", Payload: "goal"},
+	}, messages)
+
+	require.NoError(t, subscriber.Close())
+	_, ok := <-subscriber.Messages()
+	assert.False(t, ok)
+	reply, _ = publisher.Do(ctx, "publish", "news", "again")
+	assert.Equal(t, int64(0), reply.Int)
+	_, err = subscriber.Do(ctx, "ping")
+	assert.Equal(t, errClientClosed, err)
+}
+
+func TestLocalClientContext(t *testing.T) {
+	s := start(t)
+	client := localClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.Do(ctx, "ping")
+	assert.Equal(t, context.Canceled, err)
+
+}
+
+func TestLocalClientShutdown(t *testing.T) {
+	s, err := New(WithAddr("127.0.0.1:0"))
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, s.Start(ctx))
+	client := s.NewLocalClient()
+	require.NoError(t, s.Shutdown(ctx))
+	_, err = client.Do(ctx, "ping")
+	assert.Error(t, err)
+	assert.NoError(t, client.Close())
+}
+
+// BenchmarkGet 比较 LocalClient 和经过本机 TCP 的 go-redis 执行 GET 的耗时
+func BenchmarkGet(b *testing.B) {
+	s, err := New(WithAddr("127.0.0.1:0"), WithLogger(logger.Zap(zap.NewNop())))
+	require.NoError(b, err)
+	ctx := context.Background()
+	require.NoError(b, s.Start(ctx))
+	defer s.Shutdown(ctx)
+	local := s.NewLocalClient()
+	defer local.Close()
+	_, err = local.Do(ctx, "set", "foo", "bar")
+	require.NoError(b, err)
+
+	b.Run("local", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := local.Do(ctx, "get", "foo"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("tcp", func(b *testing.B) {
+		network := goredis.NewClient(&goredis.Options{Addr: s.Addr().String()})
+		defer network.Close()
+		for i := 0; i < b.N; i++ {
+			if err := network.Get(ctx, "foo").Err(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
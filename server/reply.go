@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/pkg/util"
+	"strconv"
+)
+
+// ReplyKind 回复的类型, 与 RESP2 和 RESP3 的类型对应
+type ReplyKind int
+
+const (
+	KindStatus ReplyKind = iota
+	KindError
+	KindInt
+	KindBulk
+	KindNil
+	KindArray
+	KindMap
+	KindSet
+	KindPush
+	KindDouble
+	KindBool
+	KindVerbatim
+	KindBigNumber
+)
+
+var kindNames = []string{"status", "error", "int", "bulk", "nil", "array", "map", "set", "push", "double", "bool", "verbatim", "bignumber"}
+
+func (k ReplyKind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return "unknown"
+}
+
+// Nil 读取空回复(不存在的 key)时返回的错误
+var Nil = errors.New("redis: nil")
+
+// Error 命令回复的错误, 比如 "ERR wrong number of arguments for 'get' command"
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Reply LocalClient 收到的回复. map 的 Elems 按照 key, value 依次排列
+type Reply struct {
+	Kind ReplyKind
+	// Text status, error, bulk, verbatim, bignumber 的内容, verbatim 不包括格式前缀
+	Text  string
+	Int   int64
+	Float float64
+	Bool  bool
+	Elems []Reply
+}
+
+// Err 错误回复返回 Error, 其他的回复返回 nil
+func (r Reply) Err() error {
+	if r.Kind == KindError {
+		return Error(r.Text)
+	}
+	return nil
+}
+
+// Int64 整数回复, 或者内容是整数的字符串回复
+func (r Reply) Int64() (int64, error) {
+	switch r.Kind {
+	case KindInt:
+		return r.Int, nil
+	case KindBool:
+		if r.Bool {
+			return 1, nil
+		}
+		return 0, nil
+	case KindStatus, KindBulk, KindVerbatim, KindBigNumber:
+		return strconv.ParseInt(r.Text, 10, 64)
+	default:
+		return 0, r.mismatch("int")
+	}
+}
+
+// Str 字符串回复, 整数和浮点数转换为字符串
+func (r Reply) Str() (string, error) {
+	switch r.Kind {
+	case KindStatus, KindBulk, KindVerbatim, KindBigNumber:
+		return r.Text, nil
+	case KindInt:
+		return strconv.FormatInt(r.Int, 10), nil
+	case KindDouble:
+		return util.FormatFloat(r.Float), nil
+	default:
+		return "", r.mismatch("string")
+	}
+}
+
+// Slice 数组, 集合, 推送和 map 的元素
+func (r Reply) Slice() ([]Reply, error) {
+	switch r.Kind {
+	case KindArray, KindSet, KindPush, KindMap:
+		return r.Elems, nil
+	default:
+		return nil, r.mismatch("array")
+	}
+}
+
+// Strings 元素都是字符串的数组, 空的元素是空字符串
+func (r Reply) Strings() ([]string, error) {
+	elems, err := r.Slice()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(elems))
+	for i, elem := range elems {
+		if elem.Kind == KindNil {
+			continue
+		}
+		if result[i], err = elem.Str(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// mismatch 错误回复返回它本身, 空回复返回 Nil
+func (r Reply) mismatch(want string) error {
+	switch r.Kind {
+	case KindError:
+		return Error(r.Text)
+	case KindNil:
+		return Nil
+	default:
+		return fmt.Errorf("redis: can't read %s reply as %s", r.Kind, want)
+	}
+}
+
+var errBadReply = errors.New("redis: bad reply")
+
+// parseReply 解析一个 RESP2 或者 RESP3 编码的回复, 返回剩下的数据
+func parseReply(data []byte) (Reply, []byte, error) {
+	idx := bytes.Index(data, []byte("\r\n"))
+	if len(data) == 0 || idx < 0 {
+		return Reply{}, nil, errBadReply
+	}
+	line, rest := string(data[1:idx]), data[idx+2:]
+	switch data[0] {
+	case '+':
+		return Reply{Kind: KindStatus, Text: line}, rest, nil
+	case '-':
+		return Reply{Kind: KindError, Text: line}, rest, nil
+	case ':':
+		num, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return Reply{}, nil, errBadReply
+		}
+		return Reply{Kind: KindInt, Int: num}, rest, nil
+	case '_':
+		return Reply{Kind: KindNil}, rest, nil
+	case '#':
+		return Reply{Kind: KindBool, Bool: line == "t"}, rest, nil
+	case ',':
+		num, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return Reply{}, nil, errBadReply
+		}
+		return Reply{Kind: KindDouble, Float: num}, rest, nil
+	case '(':
+		return Reply{Kind: KindBigNumber, Text: line}, rest, nil
+	case '$', '=', '!':
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return Reply{}, nil, errBadReply
+		}
+		if size < 0 {
+			return Reply{Kind: KindNil}, rest, nil
+		}
+		if len(rest) < size+2 {
+			return Reply{}, nil, errBadReply
+		}
+		text := string(rest[:size])
+		rest = rest[size+2:]
+		switch data[0] {
+		case '=':
+			// 去掉 txt: 这样的格式前缀
+			if len(text) >= 4 && text[3] == ':' {
+				text = text[4:]
+			}
+			return Reply{Kind: KindVerbatim, Text: text}, rest, nil
+		case '!':
+			return Reply{Kind: KindError, Text: text}, rest, nil
+		}
+		return Reply{Kind: KindBulk, Text: text}, rest, nil
+	case '*', '%', '~', '>':
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return Reply{}, nil, errBadReply
+		}
+		if size < 0 {
+			return Reply{Kind: KindNil}, rest, nil
+		}
+		kind := map[byte]ReplyKind{'*': KindArray, '%': KindMap, '~': KindSet, '>': KindPush}[data[0]]
+		if kind == KindMap {
+			size *= 2
+		}
+		reply := Reply{Kind: kind, Elems: make([]Reply, size)}
+		for i := 0; i < size; i++ {
+			if reply.Elems[i], rest, err = parseReply(rest); err != nil {
+				return Reply{}, nil, err
+			}
+		}
+		return reply, rest, nil
+	default:
+		return Reply{}, nil, errBadReply
+	}
+}
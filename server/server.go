@@ -0,0 +1,291 @@
+// Package server 把 godis-tiny 嵌入到其他程序中, 比如在测试中启动一个真实的 redis 服务:
+//
+//	s, err := server.New(server.WithAddr("127.0.0.1:0"))
+//	if err != nil { ... }
+//	if err := s.Start(ctx); err != nil { ... }
+//	defer s.Shutdown(ctx)
+//	client := redis.NewClient(&redis.Options{Addr: s.Addr().String()})
+//
+// 配置, 命令表和日志都是进程级别的, 同一时间只能运行一个 Server, 上一个 Server 关闭之后才能创建下一个
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xuning888/godis-tiny/config"
+	"github.com/xuning888/godis-tiny/pkg/clock"
+	"github.com/xuning888/godis-tiny/pkg/datastruct/dict"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/redis"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Option 修改 Server 的配置, 按照传入的顺序生效
+type Option func(s *Server) error
+
+// Server 嵌入的 redis 服务
+type Server struct {
+	srv *redis.RedisServer
+	lg  logger.Logger
+	// host anyPort WithAddr 的地址, 端口是0时启动时选择一个空闲的端口
+	host    string
+	anyPort bool
+	addr    net.Addr
+	// configWarnings 加载配置文件时的警告, 设置 logger 之后输出
+	configWarnings []string
+	// clock WithClock 的时钟
+	clock clock.Clock
+}
+
+// WithAddr 监听的 TCP 地址 host:port, host 为空时监听所有的 IPv4 地址, port 是0时选择一个空闲的端口, 启动之后从 Addr 读取
+func WithAddr(addr string) Option {
+	return func(s *Server) error {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("invalid port in address %q", addr)
+		}
+		s.host, s.anyPort = host, port == 0
+		config.Properties.Bind = host
+		config.Properties.Port = port
+		return nil
+	}
+}
+
+// WithUnixSocket 同时监听 unix socket, 只使用 unix socket 时再加上 WithTCPDisabled
+func WithUnixSocket(path string) Option {
+	return func(s *Server) error {
+		config.Properties.UnixSocket = path
+		return nil
+	}
+}
+
+// WithTCPDisabled 不监听 TCP 端口, 与 redis 的 port 0 一致, 需要配合 WithUnixSocket 使用
+func WithTCPDisabled() Option {
+	return func(s *Server) error {
+		s.host, s.anyPort = "", false
+		config.Properties.Port = 0
+		return nil
+	}
+}
+
+// WithDatabases db 的数量
+func WithDatabases(n int) Option {
+	return func(s *Server) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid number of databases %d", n)
+		}
+		config.Properties.Databases = n
+		return nil
+	}
+}
+
+// WithStorageBackend db 使用的 dict 实现, 比如 tiered 只在内存中保留最近访问的 hotKeys 个值, hotKeys 为0时使用默认值
+func WithStorageBackend(name string, hotKeys int) Option {
+	return func(s *Server) error {
+		if !dict.Registered(name) {
+			return fmt.Errorf("unknown storage backend %q, available: %v", name, dict.Backends())
+		}
+		config.Properties.StorageBackend = name
+		if hotKeys > 0 {
+			config.Properties.StorageHotKeys = hotKeys
+		}
+		return nil
+	}
+}
+
+// WithPassword 与 requirepass 一致, 客户端需要先 AUTH
+func WithPassword(password string) Option {
+	return func(s *Server) error {
+		config.Properties.RequirePass = password
+		return nil
+	}
+}
+
+// WithMetricsAddr 在 addr 上提供 Prometheus 的 /metrics, 端口为 0 时选择一个空闲的端口, 地址由 MetricsAddr 返回
+func WithMetricsAddr(addr string) Option {
+	return func(s *Server) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+		config.Properties.MetricsAddr = addr
+		return nil
+	}
+}
+
+// WithAppendOnly 打开 aof, aof 和 rdb 文件都写在 dir 中, 重新启动时从 dir 加载数据
+func WithAppendOnly(dir string) Option {
+	return func(s *Server) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		config.Properties.AppendOnly = true
+		config.Properties.Dir = dir
+		return nil
+	}
+}
+
+// WithLogger 使用调用方的 logger, 比如 logger.Zap(zapLogger). 没有指定时输出到 stderr
+func WithLogger(lg logger.Logger) Option {
+	return func(s *Server) error {
+		s.lg = lg
+		return nil
+	}
+}
+
+// WithClock 过期时间, TTL 和 LRU/LFU 使用 c 的时间, 测试中可以用 clock.Manual 冻结时间, 调用 Advance 让 key 过期.
+// 没有指定时使用系统时钟
+func WithClock(c clock.Clock) Option {
+	return func(s *Server) error {
+		s.clock = c
+		return nil
+	}
+}
+
+// WithLogLevel 与 loglevel 一致: debug, verbose, notice, warning, nothing, 运行时可以通过 CONFIG SET loglevel 修改
+func WithLogLevel(level string) Option {
+	return func(s *Server) error {
+		if _, err := logger.ParseLevel(level); err != nil {
+			return err
+		}
+		config.Properties.LogLevel = strings.ToLower(level)
+		return nil
+	}
+}
+
+// WithConfigFile 从 redis.conf 格式的配置文件加载配置, overrides 是之后应用的配置行(比如 "port 6380"). 会覆盖之前的选项,
+// 需要放在其他选项的前面. 值无效时返回带有文件名和行号的 *config.LoadError, 未知的配置项在 New 中记录警告日志
+func WithConfigFile(path string, overrides ...string) Option {
+	return func(s *Server) error {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if stat.IsDir() {
+			return fmt.Errorf("config file %s is a directory", path)
+		}
+		warnings, err := config.LoadFile(path, overrides...)
+		if err != nil {
+			return err
+		}
+		s.configWarnings = append(s.configWarnings, warnings...)
+		return nil
+	}
+}
+
+// WithConfigLines 没有配置文件时应用 redis.conf 格式的配置行, 与 WithConfigFile 一样会覆盖之前的选项
+func WithConfigLines(lines ...string) Option {
+	return func(s *Server) error {
+		warnings, err := config.LoadFile("", lines...)
+		if err != nil {
+			return err
+		}
+		s.configWarnings = append(s.configWarnings, warnings...)
+		return nil
+	}
+}
+
+// New 使用默认配置和 opts 创建 Server, 还没有开始监听
+func New(opts ...Option) (*Server, error) {
+	config.Properties = config.Default()
+	s := &Server{}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.lg != nil {
+		logger.SetLogger(s.lg)
+	}
+	for _, warning := range s.configWarnings {
+		logger.Named("config").Warnf("%s", warning)
+	}
+	redis.SetClock(s.clock)
+	srv, err := redis.NewRedisServer()
+	if err != nil {
+		return nil, err
+	}
+	s.srv = srv
+	return s, nil
+}
+
+// Start 开始监听并加载数据, 可以接受连接之后返回. ctx 只限制启动的时间
+func (s *Server) Start(ctx context.Context) error {
+	if s.anyPort {
+		port, err := freePort(s.host)
+		if err != nil {
+			return err
+		}
+		config.Properties.Port = port
+	}
+	if err := s.srv.Start(ctx); err != nil {
+		return err
+	}
+	s.addr = listenAddr(s.host)
+	return nil
+}
+
+// freePort 选择一个空闲的端口. 关闭探测的 listener 到 gnet 监听之间端口可能被其他程序占用, 这时 Start 返回错误
+func freePort(host string) (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// listenAddr 实际监听的地址, 监听了 TCP 端口时是 *net.TCPAddr, 只监听 unix socket 时是 *net.UnixAddr
+func listenAddr(host string) net.Addr {
+	if port := config.Properties.Port; port != 0 {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ip = net.IPv4zero
+		}
+		return &net.TCPAddr{IP: ip, Port: port}
+	}
+	return &net.UnixAddr{Name: config.Properties.UnixSocket, Net: "unix"}
+}
+
+// Addr 监听的地址, Start 之前返回 nil
+func (s *Server) Addr() net.Addr {
+	return s.addr
+}
+
+// MetricsAddr /metrics 监听的地址, 没有配置 WithMetricsAddr 或者 Start 之前返回 nil
+func (s *Server) MetricsAddr() net.Addr {
+	return s.srv.MetricsAddr()
+}
+
+// Shutdown 优雅关闭: 不再接受新的连接, 等待客户端执行完已经收到的命令, 写完 aof 之后返回.
+// 已经关闭(比如客户端执行了 SHUTDOWN)时返回 nil
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if !errors.Is(err, redis.ErrNotRunning) || s.srv.Done() == nil {
+		return err
+	}
+	// 已经在关闭中, 等待关闭完成
+	select {
+	case <-s.srv.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RegisterHook 注册命令执行的拦截器, 网络上的客户端和 LocalClient 的命令都会经过它
+func (s *Server) RegisterHook(h redis.Hook) {
+	s.srv.RegisterHook(h)
+}
+
+// Done 关闭完成之后返回, 包括客户端执行 SHUTDOWN 的情况
+func (s *Server) Done() <-chan struct{} {
+	return s.srv.Done()
+}
@@ -0,0 +1,612 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuning888/godis-tiny/pkg/clock"
+	"github.com/xuning888/godis-tiny/pkg/logger"
+	"github.com/xuning888/godis-tiny/redis"
+	"go.uber.org/goleak"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+// start 在随机端口上启动, 测试结束时关闭
+func start(t *testing.T, opts ...Option) *Server {
+	s, err := New(append([]Option{WithAddr("127.0.0.1:0")}, opts...)...)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, s.Start(ctx))
+	t.Cleanup(func() {
+		assert.NoError(t, s.Shutdown(context.Background()))
+	})
+	return s
+}
+
+func connect(t *testing.T, s *Server, opts *goredis.Options) *goredis.Client {
+	opts.Addr = s.Addr().String()
+	client := goredis.NewClient(opts)
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+func TestServer(t *testing.T) {
+	s := start(t, WithDatabases(2))
+	assert.NotZero(t, s.Addr().(*net.TCPAddr).Port)
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	assert.NoError(t, client.Set(ctx, "foo", "bar", 0).Err())
+	assert.Equal(t, "bar", client.Get(ctx, "foo").Val())
+
+	other := connect(t, s, &goredis.Options{DB: 1})
+	assert.Equal(t, goredis.Nil, other.Get(ctx, "foo").Err())
+	err := connect(t, s, &goredis.Options{DB: 2}).Ping(ctx).Err()
+	assert.EqualError(t, err, "ERR DB index is out of range")
+}
+
+func TestServerPassword(t *testing.T) {
+	s := start(t, WithPassword("secret"))
+	ctx := context.Background()
+	err := connect(t, s, &goredis.Options{}).Set(ctx, "foo", "bar", 0).Err()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "NOAUTH")
+	assert.NoError(t, connect(t, s, &goredis.Options{Password: "secret"}).Set(ctx, "foo", "bar", 0).Err())
+}
+
+func TestServerAppendOnly(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	ctx := context.Background()
+	s, err := New(WithAddr("127.0.0.1:0"), WithAppendOnly(dir))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(ctx))
+	client := connect(t, s, &goredis.Options{})
+	assert.NoError(t, client.RPush(ctx, "list", "a", "b", "c").Err())
+	require.NoError(t, client.Close())
+	require.NoError(t, s.Shutdown(ctx))
+
+	// 重新启动之后从 aof 加载
+	s = start(t, WithAppendOnly(dir))
+	client = connect(t, s, &goredis.Options{})
+	assert.Equal(t, []string{"a", "b", "c"}, client.LRange(ctx, "list", 0, -1).Val())
+}
+
+func TestServerTieredStorage(t *testing.T) {
+	_, err := New(WithStorageBackend("nosuchbackend", 0))
+	assert.Error(t, err)
+	// dir 不可用时创建 db 失败, New 返回错误
+	_, err = New(WithConfigLines("dir "+filepath.Join(t.TempDir(), "missing")), WithStorageBackend("tiered", 4))
+	assert.Error(t, err)
+
+	s := start(t, WithStorageBackend("tiered", 4))
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	for i := 0; i < 50; i++ {
+		require.NoError(t, client.Set(ctx, fmt.Sprintf("key:%d", i), i, 0).Err())
+	}
+	assert.NoError(t, client.RPush(ctx, "list", "a", "b").Err())
+	// 换出之后再修改
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, client.Get(ctx, fmt.Sprintf("key:%d", i)).Err())
+	}
+	assert.NoError(t, client.RPush(ctx, "list", "c").Err())
+	assert.Len(t, client.Keys(ctx, "*").Val(), 51)
+	assert.Equal(t, "49", client.Get(ctx, "key:49").Val())
+	assert.Equal(t, []string{"a", "b", "c"}, client.LRange(ctx, "list", 0, -1).Val())
+	assert.NoError(t, client.FlushAll(ctx).Err())
+	assert.Empty(t, client.Keys(ctx, "*").Val())
+}
+
+func TestServerClock(t *testing.T) {
+	c := clock.NewManual(time.Now())
+	s := start(t, WithClock(c))
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	require.NoError(t, client.Set(ctx, "foo", "bar", 10*time.Second).Err())
+	require.NoError(t, client.Set(ctx, "idle", "v", 0).Err())
+	assert.Equal(t, 10*time.Second, client.TTL(ctx, "foo").Val())
+	c.Advance(4 * time.Second)
+	assert.Equal(t, 6*time.Second, client.TTL(ctx, "foo").Val())
+	assert.Equal(t, 4*time.Second, client.ObjectIdleTime(ctx, "idle").Val())
+	c.Advance(6*time.Second + time.Millisecond)
+	assert.Equal(t, goredis.Nil, client.Get(ctx, "foo").Err())
+}
+
+func TestServerShutdownCommand(t *testing.T) {
+	s := start(t)
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	// 与 redis 一样, SHUTDOWN 成功时没有回复, 连接直接关闭
+	_ = client.Shutdown(ctx).Err()
+	select {
+	case <-s.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	// 已经关闭时 Shutdown 返回 nil
+	assert.NoError(t, s.Shutdown(ctx))
+}
+
+func TestStartError(t *testing.T) {
+	_, err := New(WithAddr("127.0.0.1"))
+	assert.Error(t, err)
+	_, err = New(WithDatabases(0))
+	assert.Error(t, err)
+	s, err := New(WithTCPDisabled())
+	require.NoError(t, err)
+	assert.EqualError(t, s.Start(context.Background()), "Failed opening listening sockets: Configured to not listen anywhere, exiting.")
+}
+
+// denyFlush 拒绝 FLUSHALL 和 FLUSHDB
+type denyFlush struct{}
+
+func (denyFlush) BeforeCommand(ctx context.Context, cmd *redis.CommandContext) (bool, redis.Reply) {
+	if strings.HasPrefix(cmd.Name, "flush") {
+		return false, redis.MakeStandardErrReply("ERR flush is disabled")
+	}
+	return true, nil
+}
+
+func (denyFlush) AfterCommand(ctx context.Context, cmd *redis.CommandContext, reply redis.Reply, err error, dur time.Duration) {
+}
+
+func TestServerHook(t *testing.T) {
+	s := start(t)
+	s.RegisterHook(denyFlush{})
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	assert.NoError(t, client.Set(ctx, "foo", "bar", 0).Err())
+	assert.EqualError(t, client.FlushAll(ctx).Err(), "ERR flush is disabled")
+	_, err := localClient(t, s).Do(ctx, "flushdb")
+	assert.EqualError(t, err, "ERR flush is disabled")
+	assert.Equal(t, "bar", client.Get(ctx, "foo").Val())
+}
+
+// scrape 读取 /metrics, 返回每个样本(名字和标签)的值
+func scrape(t *testing.T, s *Server) map[string]float64 {
+	resp, err := http.Get("http://" + s.MetricsAddr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[idx+1:], 64)
+		require.NoError(t, err, line)
+		samples[line[:idx]] = value
+	}
+	require.NoError(t, scanner.Err())
+	return samples
+}
+
+func TestServerMetrics(t *testing.T) {
+	s := start(t, WithMetricsAddr("127.0.0.1:0"), WithDatabases(2))
+	ctx := context.Background()
+	// 命令的统计是进程级别的, 比较执行前后的差值
+	before := scrape(t, s)
+	client := connect(t, s, &goredis.Options{})
+	for i := 0; i < 5; i++ {
+		require.NoError(t, client.Set(ctx, fmt.Sprintf("key:%d", i), "value", 0).Err())
+	}
+	require.NoError(t, client.Get(ctx, "key:0").Err())
+	require.Equal(t, goredis.Nil, client.Get(ctx, "missing").Err())
+	require.NoError(t, client.Del(ctx, "key:1").Err())
+	require.NoError(t, client.Do(ctx, "select", "1").Err())
+	require.NoError(t, client.Set(ctx, "other", "value", 0).Err())
+
+	after := scrape(t, s)
+	assert.Equal(t, float64(1), after["godis_connected_clients"])
+	assert.Equal(t, float64(1), after["godis_keyspace_hits_total"])
+	assert.Equal(t, float64(1), after["godis_keyspace_misses_total"])
+	assert.Equal(t, float64(4), after[`godis_db_keys{db="0"}`])
+	assert.Equal(t, float64(1), after[`godis_db_keys{db="1"}`])
+	assert.Equal(t, float64(0), after["godis_aof_pending_fsync"])
+	assert.Equal(t, float64(0), after["godis_connected_slaves"])
+	assert.Greater(t, after["godis_used_memory_bytes"], float64(0))
+	assert.Equal(t, float64(6), after[`godis_commands_processed_total{cmd="set"}`]-before[`godis_commands_processed_total{cmd="set"}`])
+	assert.Equal(t, float64(2), after[`godis_commands_processed_total{cmd="get"}`]-before[`godis_commands_processed_total{cmd="get"}`])
+	count := `godis_command_duration_seconds_count{cmd="set"}`
+	assert.Equal(t, float64(6), after[count]-before[count])
+	assert.Equal(t, after[count], after[`godis_command_duration_seconds_bucket{cmd="set",le="+Inf"}`])
+}
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// captureLogger 记录所有的日志, With 创建的 logger 共用同一份记录
+type captureLogger struct {
+	mux     *sync.Mutex
+	entries *[]logEntry
+	fields  []interface{}
+}
+
+func newCaptureLogger() *captureLogger {
+	return &captureLogger{mux: &sync.Mutex{}, entries: &[]logEntry{}}
+}
+
+func (l *captureLogger) log(level, format string, args []interface{}) {
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		fields[fmt.Sprint(l.fields[i])] = l.fields[i+1]
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	*l.entries = append(*l.entries, logEntry{level: level, msg: fmt.Sprintf(format, args...), fields: fields})
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.log("debug", format, args) }
+func (l *captureLogger) Infof(format string, args ...interface{})  { l.log("info", format, args) }
+func (l *captureLogger) Warnf(format string, args ...interface{})  { l.log("warn", format, args) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.log("error", format, args) }
+
+func (l *captureLogger) With(keysAndValues ...interface{}) logger.Logger {
+	fields := append(append([]interface{}(nil), l.fields...), keysAndValues...)
+	return &captureLogger{mux: l.mux, entries: l.entries, fields: fields}
+}
+
+// find 第一条内容是 msg 的日志
+func (l *captureLogger) find(msg string) (logEntry, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, entry := range *l.entries {
+		if entry.msg == msg {
+			return entry, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func TestServerLogger(t *testing.T) {
+	capture := newCaptureLogger()
+	t.Cleanup(func() {
+		logger.SetLogger(logger.NewStd(os.Stderr))
+	})
+	s := start(t, WithLogger(capture))
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	require.NoError(t, client.Do(ctx, "debug", "log", "marker-1").Err())
+	entry, ok := capture.find("DEBUG LOG: marker-1")
+	require.True(t, ok)
+	assert.Equal(t, "warn", entry.level)
+
+	// 默认的 notice 不输出 debug 日志
+	closeConn := func() string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("PING\r\n"))
+		require.NoError(t, err)
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		addr := conn.LocalAddr().String()
+		require.NoError(t, conn.Close())
+		return addr
+	}
+	closed := func(addr string) bool {
+		capture.mux.Lock()
+		defer capture.mux.Unlock()
+		for _, entry := range *capture.entries {
+			if entry.msg == "Client closed connection" && entry.fields["addr"] == addr {
+				return true
+			}
+		}
+		return false
+	}
+	addr := closeConn()
+	// 等待服务端处理关闭
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, closed(addr))
+
+	require.NoError(t, client.ConfigSet(ctx, "loglevel", "debug").Err())
+	assert.Equal(t, []interface{}{"loglevel", "debug"}, client.ConfigGet(ctx, "loglevel").Val())
+	addr = closeConn()
+	assert.Eventually(t, func() bool {
+		return closed(addr)
+	}, 5*time.Second, 10*time.Millisecond)
+	capture.mux.Lock()
+	for _, entry := range *capture.entries {
+		if entry.msg == "Client closed connection" {
+			assert.Equal(t, "debug", entry.level)
+			assert.Equal(t, "redis-server", entry.fields["logger"])
+		}
+	}
+	capture.mux.Unlock()
+	assert.Error(t, client.ConfigSet(ctx, "loglevel", "loud").Err())
+}
+
+func TestServerConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	include := filepath.Join(dir, "extra.conf")
+	require.NoError(t, os.WriteFile(include, []byte("maxmemory-samples 7\ncluster-announce-port 7000\n"), 0644))
+	path := filepath.Join(dir, "redis.conf")
+	require.NoError(t, os.WriteFile(path, []byte(`# godis-tiny 的测试配置
+bind 127.0.0.1
+Databases 8
+maxclients 500
+dir `+dir+`
+dbfilename "my dump.rdb"
+appendfilename appendonly.aof
+appendfsync always
+aof-load-truncated no
+auto-aof-rewrite-min-size 32mb
+auto-aof-rewrite-percentage 80
+notify-keyspace-events "KEA"
+tracking-table-max-keys 500
+busy-reply-threshold 2000
+repl-backlog-size 2mb
+replica-read-only no
+repl-ping-replica-period 5
+repl-timeout 30
+proto-max-bulk-len 1gb
+client-query-buffer-limit 512mb
+tcp-keepalive 60
+shutdown-timeout 5
+protected-mode no
+masterauth 'se"cret'
+# 每一类客户端写一行
+client-output-buffer-limit normal 0 0 0
+client-output-buffer-limit pubsub 64mb 16mb 30
+maxmemory 100mb
+maxmemory-policy allkeys-lru
+maxmemory-samples 10
+lfu-log-factor 20
+lazyfree-lazy-expire yes
+save 900 1
+save 300 10
+loglevel warning
+slowlog-max-len 128
+include `+include+`
+`), 0644))
+	capture := newCaptureLogger()
+	t.Cleanup(func() {
+		logger.SetLogger(logger.NewStd(os.Stderr))
+	})
+	s := start(t, WithConfigFile(path, "timeout 120"), WithLogger(capture))
+	ctx := context.Background()
+	client := localClient(t, s)
+	configGet := func(name string) string {
+		reply, err := client.Do(ctx, "config", "get", name)
+		require.NoError(t, err)
+		values, err := reply.Strings()
+		require.NoError(t, err)
+		require.Len(t, values, 2, name)
+		return values[1]
+	}
+	want := map[string]string{
+		"bind":                        "127.0.0.1",
+		"databases":                   "8",
+		"maxclients":                  "500",
+		"dir":                         dir,
+		"dbfilename":                  "my dump.rdb",
+		"appendonly":                  "no",
+		"appendfsync":                 "always",
+		"aof-load-truncated":          "no",
+		"auto-aof-rewrite-min-size":   strconv.Itoa(32 << 20),
+		"auto-aof-rewrite-percentage": "80",
+		"notify-keyspace-events":      "KEA",
+		"tracking-table-max-keys":     "500",
+		"busy-reply-threshold":        "2000",
+		"repl-backlog-size":           strconv.Itoa(2 << 20),
+		"replica-read-only":           "no",
+		"repl-ping-replica-period":    "5",
+		"repl-timeout":                "30",
+		"proto-max-bulk-len":          strconv.Itoa(1 << 30),
+		"client-query-buffer-limit":   strconv.Itoa(512 << 20),
+		"tcp-keepalive":               "60",
+		"shutdown-timeout":            "5",
+		"protected-mode":              "no",
+		"masterauth":                  `se"cret`,
+		"client-output-buffer-limit":  "normal 0 0 0 pubsub 64mb 16mb 30",
+		"maxmemory":                   strconv.Itoa(100 << 20),
+		"maxmemory-policy":            "allkeys-lru",
+		"lfu-log-factor":              "20",
+		"lazyfree-lazy-expire":        "yes",
+		"save":                        "900 1 300 10",
+		"loglevel":                    "warning",
+		// include 的文件覆盖前面的值
+		"maxmemory-samples":     "7",
+		"cluster-announce-port": "7000",
+		// 命令行的配置在文件之后生效
+		"timeout": "120",
+	}
+	for name, value := range want {
+		assert.Equal(t, value, configGet(name), name)
+	}
+	_, ok := capture.find(path + ":36: unknown directive 'slowlog-max-len', ignored")
+	assert.True(t, ok)
+
+	// CONFIG REWRITE 保留注释, 在原来的位置修改
+	_, err := client.Do(ctx, "config", "set", "maxmemory-samples", "9", "repl-timeout", "45")
+	require.NoError(t, err)
+	_, err = client.Do(ctx, "config", "rewrite")
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	content := string(data)
+	assert.Contains(t, content, "# godis-tiny 的测试配置\nbind 127.0.0.1\n")
+	assert.Contains(t, content, "\nrepl-timeout 45\n")
+	assert.Contains(t, content, "# 每一类客户端写一行\nclient-output-buffer-limit normal 0 0 0\nclient-output-buffer-limit pubsub 64mb 16mb 30\n")
+	assert.Contains(t, content, "\ninclude "+include+"\n")
+	assert.Contains(t, content, "\nmaxmemory-samples 9\n")
+	assert.Contains(t, content, "# Generated by CONFIG REWRITE\n")
+}
+
+func TestServerConfigFileError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	require.NoError(t, os.WriteFile(path, []byte("port 6379\n\nmaxclients lots\n"), 0644))
+	_, err := New(WithConfigFile(path))
+	assert.EqualError(t, err, path+":3: 'maxclients lots': argument couldn't be parsed into an integer")
+
+	s := start(t)
+	_, err = localClient(t, s).Do(context.Background(), "config", "rewrite")
+	assert.EqualError(t, err, "ERR The server is running without a config file")
+}
+
+func TestServerShutdownInterruptsCommand(t *testing.T) {
+	s, err := New(WithAddr("127.0.0.1:0"))
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, s.Start(ctx))
+	client := connect(t, s, &goredis.Options{ReadTimeout: 30 * time.Second})
+	result := make(chan error, 1)
+	go func() {
+		result <- client.Do(ctx, "debug", "sleep", "10").Err()
+	}()
+	// 等待 DEBUG SLEEP 开始执行
+	time.Sleep(200 * time.Millisecond)
+	begin := time.Now()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.Less(t, time.Since(begin), 5*time.Second)
+	select {
+	case err := <-result:
+		// 回复在关闭连接之前发送出去
+		assert.EqualError(t, err, "ERR command interrupted")
+	case <-time.After(5 * time.Second):
+		t.Fatal("DEBUG SLEEP is still running after shutdown")
+	}
+}
+
+func TestServerPubSubPing(t *testing.T) {
+	s := start(t)
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	pubsub := client.Subscribe(ctx, "news")
+	t.Cleanup(func() {
+		_ = pubsub.Close()
+	})
+	_, err := pubsub.Receive(ctx)
+	require.NoError(t, err)
+
+	// go-redis 用 PING 检查订阅的连接, 回复从消息中读取
+	require.NoError(t, pubsub.Ping(ctx, "health"))
+	msg, err := pubsub.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &goredis.Pong{Payload: "health"}, msg)
+	require.NoError(t, pubsub.Ping(ctx))
+	msg, err = pubsub.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &goredis.Pong{}, msg)
+
+	// 之后的消息不受影响
+	require.NoError(t, client.Publish(ctx, "news", "hello").Err())
+	msg, err = pubsub.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &goredis.Message{Channel: "news", Payload: "hello"}, msg)
+
+	// Channel 在后台定期 PING, 不影响消息的接收
+	messages := pubsub.ChannelSize(10)
+	require.NoError(t, client.Publish(ctx, "news", "world").Err())
+	select {
+	case m := <-messages:
+		assert.Equal(t, "world", m.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestServerBinarySafe(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	data := map[string]string{
+		string(all):        string(all),
+		"\r\n":             "\r\n\r\n",
+		"\x00":             "",
+		"key\r\nset x 1":   "*1\r\n$3\r\nfoo\r\n",
+		"\xff\xfe invalid": "\x00\r\n\xff",
+	}
+	for i := 0; i < 256; i++ {
+		data["byte:"+string([]byte{byte(i)})] = string(all[i:]) + string(all[:i])
+	}
+	verify := func(client *goredis.Client) {
+		ctx := context.Background()
+		for key, value := range data {
+			got, err := client.Get(ctx, key).Result()
+			require.NoError(t, err, "%q", key)
+			assert.Equal(t, []byte(value), []byte(got), "%q", key)
+		}
+		keys, err := client.Keys(ctx, "*").Result()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, mapKeys(data), keys)
+	}
+
+	dir := filepath.Join(t.TempDir(), "data")
+	ctx := context.Background()
+	s, err := New(WithAddr("127.0.0.1:0"), WithAppendOnly(dir))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(ctx))
+	client := connect(t, s, &goredis.Options{})
+	for key, value := range data {
+		require.NoError(t, client.Set(ctx, key, value, 0).Err(), "%q", key)
+	}
+	verify(client)
+	require.NoError(t, client.Close())
+	require.NoError(t, s.Shutdown(ctx))
+
+	// 重新启动之后从 aof 读出来的 key 和值与写入的完全一样
+	s, err = New(WithAddr("127.0.0.1:0"), WithAppendOnly(dir))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(ctx))
+	client = connect(t, s, &goredis.Options{})
+	verify(client)
+
+	// 重写之后的 aof 也一样
+	require.NoError(t, client.BgRewriteAOF(ctx).Err())
+	require.Eventually(t, func() bool {
+		info := client.Info(ctx, "persistence").Val()
+		return strings.Contains(info, "aof_rewrites:1\r\n") && strings.Contains(info, "aof_rewrite_in_progress:0")
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, client.Close())
+	require.NoError(t, s.Shutdown(ctx))
+	s = start(t, WithAppendOnly(dir))
+	verify(connect(t, s, &goredis.Options{}))
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestServerCommandInfo(t *testing.T) {
+	s := start(t)
+	ctx := context.Background()
+	client := connect(t, s, &goredis.Options{})
+	// go-redis 的集群客户端用 COMMAND 判断哪些命令是只读的
+	commands, err := client.Command(ctx).Result()
+	require.NoError(t, err)
+	require.Contains(t, commands, "substr")
+	assert.Equal(t, &goredis.CommandInfo{
+		Name: "substr", Arity: 4, Flags: []string{"readonly"}, ACLFlags: []string{"@read"},
+		FirstKeyPos: 1, LastKeyPos: 1, StepCount: 1, ReadOnly: true,
+	}, commands["substr"])
+	assert.Equal(t, commands["getrange"].Flags, commands["substr"].Flags)
+	assert.False(t, commands["getset"].ReadOnly)
+}